@@ -0,0 +1,182 @@
+package saml
+
+import (
+	"crypto/sha1" //nolint:gosec // SHA-1 is mandated by the SAML artifact format
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ArtifactTypeCode is the type code of the SAML 2.0 artifact format, the only
+// format defined by the SAML 2.0 bindings specification (section 3.6.4).
+const ArtifactTypeCode uint16 = 0x0004
+
+// artifactLength is the length in bytes of a decoded type 0x0004 artifact.
+const artifactLength = 2 + 2 + 20 + 20
+
+// Artifact represents a SAML 2.0 type 0x0004 artifact, as sent in the SAMLart
+// parameter of the HTTP-Artifact binding.
+type Artifact struct {
+	// EndpointIndex is the index of the issuer's ArtifactResolutionService
+	// that must be used to resolve the artifact.
+	EndpointIndex uint16
+
+	// SourceID identifies the issuer of the artifact. It is the SHA-1 hash
+	// of the issuer's entity ID, see ArtifactSourceID.
+	SourceID [20]byte
+
+	// MessageHandle is the random value that references the message held
+	// by the issuer.
+	MessageHandle [20]byte
+}
+
+// ParseArtifact decodes a base64 encoded SAML 2.0 artifact.
+func ParseArtifact(s string) (*Artifact, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode artifact: %s", err)
+	}
+	if len(buf) != artifactLength {
+		return nil, fmt.Errorf("artifact has length %d, expected %d", len(buf), artifactLength)
+	}
+	if typeCode := binary.BigEndian.Uint16(buf[0:2]); typeCode != ArtifactTypeCode {
+		return nil, fmt.Errorf("unsupported artifact type code 0x%04x", typeCode)
+	}
+
+	a := Artifact{
+		EndpointIndex: binary.BigEndian.Uint16(buf[2:4]),
+	}
+	copy(a.SourceID[:], buf[4:24])
+	copy(a.MessageHandle[:], buf[24:44])
+	return &a, nil
+}
+
+// String returns the base64 encoding of the artifact, suitable for use as the
+// SAMLart parameter.
+func (a Artifact) String() string {
+	buf := make([]byte, artifactLength)
+	binary.BigEndian.PutUint16(buf[0:2], ArtifactTypeCode)
+	binary.BigEndian.PutUint16(buf[2:4], a.EndpointIndex)
+	copy(buf[4:24], a.SourceID[:])
+	copy(buf[24:44], a.MessageHandle[:])
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// ArtifactSourceID returns the SourceID of artifacts issued by the entity
+// with the specified entity ID.
+func ArtifactSourceID(entityID string) [20]byte {
+	return sha1.Sum([]byte(entityID)) //nolint:gosec // SHA-1 is mandated by the SAML artifact format
+}
+
+// ArtifactMessage is a message issued by an IdentityProvider using the
+// HTTP-Artifact binding that is waiting to be resolved.
+type ArtifactMessage struct {
+	// ServiceProviderID is the entity ID of the service provider the message
+	// is destined for. Only this service provider may resolve the artifact.
+	ServiceProviderID string
+
+	// ExpireTime is the time after which the artifact can no longer be
+	// resolved.
+	ExpireTime time.Time
+
+	// Message is the signed protocol message, in XML form.
+	Message []byte
+}
+
+// ArtifactStore is an interface used by IdentityProvider to hold the
+// messages it issues using the HTTP-Artifact binding until the service
+// provider resolves them. The default implementation is MemoryArtifactStore.
+type ArtifactStore interface {
+	// PutArtifact stores message under artifact, which is the base64
+	// encoding of an Artifact.
+	PutArtifact(artifact string, message *ArtifactMessage) error
+
+	// TakeArtifact returns the message stored under artifact and removes it
+	// from the store, so that each artifact is resolved at most once. If
+	// there is no such message, or the message has expired, the returned
+	// error must be os.ErrNotExist.
+	TakeArtifact(artifact string) (*ArtifactMessage, error)
+}
+
+// MemoryArtifactStore is an implementation of ArtifactStore that resides
+// completely in memory. It is suitable for an IDP that runs as a single
+// process.
+//
+// TimeSource, if not nil, is the source of the current time used to expire
+// messages. Otherwise the TimeSource of the IdentityProvider is used, or
+// TimeNow.
+type MemoryArtifactStore struct {
+	TimeSource TimeSource
+
+	mu       sync.Mutex
+	messages map[string]*ArtifactMessage
+}
+
+// PutArtifact implements ArtifactStore. Expired messages are discarded as a
+// side effect.
+func (s *MemoryArtifactStore) PutArtifact(artifact string, message *ArtifactMessage) error {
+	return s.putArtifact(artifact, message, timeNow(s.TimeSource))
+}
+
+func (s *MemoryArtifactStore) putArtifact(artifact string, message *ArtifactMessage, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.messages == nil {
+		s.messages = map[string]*ArtifactMessage{}
+	}
+
+	for k, v := range s.messages {
+		if now.After(v.ExpireTime) {
+			delete(s.messages, k)
+		}
+	}
+	s.messages[artifact] = message
+	return nil
+}
+
+// TakeArtifact implements ArtifactStore.
+func (s *MemoryArtifactStore) TakeArtifact(artifact string) (*ArtifactMessage, error) {
+	return s.takeArtifact(artifact, timeNow(s.TimeSource))
+}
+
+func (s *MemoryArtifactStore) takeArtifact(artifact string, now time.Time) (*ArtifactMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message, ok := s.messages[artifact]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	delete(s.messages, artifact)
+	if now.After(message.ExpireTime) {
+		return nil, os.ErrNotExist
+	}
+	return message, nil
+}
+
+// memoryArtifactStoreView is a MemoryArtifactStore that expires messages
+// using the TimeSource of the IdentityProvider that uses it.
+type memoryArtifactStoreView struct {
+	store      *MemoryArtifactStore
+	timeSource TimeSource
+}
+
+func (v memoryArtifactStoreView) PutArtifact(artifact string, message *ArtifactMessage) error {
+	return v.store.putArtifact(artifact, message, timeNow(v.timeSource))
+}
+
+func (v memoryArtifactStoreView) TakeArtifact(artifact string) (*ArtifactMessage, error) {
+	return v.store.takeArtifact(artifact, timeNow(v.timeSource))
+}
+
+// artifactStore returns the ArtifactStore of the IDP. A MemoryArtifactStore
+// without a TimeSource of its own uses that of the IDP.
+func (idp *IdentityProvider) artifactStore() ArtifactStore {
+	if s, ok := idp.ArtifactStore.(*MemoryArtifactStore); ok && s.TimeSource == nil {
+		return memoryArtifactStoreView{store: s, timeSource: idp.TimeSource}
+	}
+	return idp.ArtifactStore
+}
@@ -0,0 +1,65 @@
+package saml
+
+import (
+	"encoding/base64"
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestArtifactRoundTrip(t *testing.T) {
+	a := Artifact{
+		EndpointIndex: 3,
+		SourceID:      ArtifactSourceID("https://idp.example.com/saml/metadata"),
+	}
+	copy(a.MessageHandle[:], "0123456789abcdefghij")
+
+	b, err := ParseArtifact(a.String())
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(&a, b))
+
+	buf, err := base64.StdEncoding.DecodeString(a.String())
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual([]byte{0x00, 0x04, 0x00, 0x03}, buf[:4]))
+}
+
+func TestParseArtifactRejectsInvalid(t *testing.T) {
+	_, err := ParseArtifact("!!!")
+	assert.Check(t, is.ErrorContains(err, "cannot decode artifact"))
+
+	_, err = ParseArtifact(base64.StdEncoding.EncodeToString([]byte{0x00, 0x04, 0x00, 0x00}))
+	assert.Check(t, is.Error(err, "artifact has length 4, expected 44"))
+
+	buf := make([]byte, 44)
+	buf[1] = 0x02
+	_, err = ParseArtifact(base64.StdEncoding.EncodeToString(buf))
+	assert.Check(t, is.Error(err, "unsupported artifact type code 0x0002"))
+}
+
+func TestMemoryArtifactStore(t *testing.T) {
+	store := &MemoryArtifactStore{}
+	message := &ArtifactMessage{
+		ServiceProviderID: "https://sp.example.com/saml2/metadata",
+		ExpireTime:        TimeNow().Add(time.Minute),
+		Message:           []byte("<Response/>"),
+	}
+
+	_, err := store.TakeArtifact("artifact")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	assert.Check(t, store.PutArtifact("artifact", message))
+	got, err := store.TakeArtifact("artifact")
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(message, got))
+
+	_, err = store.TakeArtifact("artifact")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	message.ExpireTime = TimeNow().Add(-time.Second)
+	assert.Check(t, store.PutArtifact("artifact", message))
+	_, err = store.TakeArtifact("artifact")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+}
@@ -0,0 +1,310 @@
+package saml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/beevik/etree"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+)
+
+// AttributeQuerySessionProvider is an interface that a SessionProvider may
+// implement so that IdentityProvider can answer AttributeQuery requests,
+// which service providers send without the user agent, about a subject they
+// know by its NameID.
+type AttributeQuerySessionProvider interface {
+	// GetSubjectSession returns a Session that describes the subject that
+	// the service provider serviceProviderID knows by nameID, which is the
+	// NameID that the IDP issued to it. The session need not be active; it
+	// only carries the attributes of the subject.
+	//
+	// If the subject is not known, the returned error must be
+	// os.ErrNotExist.
+	GetSubjectSession(r *http.Request, serviceProviderID string, nameID *NameID) (*Session, error)
+}
+
+// ServeAttributeQuery handles AttributeQuery requests sent by service
+// providers using the SOAP binding. Requests must be signed by the service
+// provider. The subject of the query is looked up with the SessionProvider,
+// if it implements AttributeQuerySessionProvider, or else among the sessions
+// of the SessionStore that the service provider participates in, and its
+// attributes are
+// resolved as for an assertion made by DefaultAssertionMaker, including the
+// AttributeReleasePolicy. Only the attributes, and values, that the query
+// asks for are returned, in a signed assertion in a signed Response.
+//
+// If the IDP has a ConsentPrompter, the attributes are only returned if a
+// decision of the user in the ConsentStore grants their release to the
+// service provider, since the user cannot be asked; otherwise the Response
+// has the RequestDenied status and no assertion.
+//
+// If the subject is unknown, the Response has the UnknownPrincipal status
+// and no assertion. If the request is invalid or cannot be verified a simple
+// StatusBadRequest response is sent.
+func (idp *IdentityProvider) ServeAttributeQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	_, span := startSpan(r.Context(), idp.Tracer, "saml.IdentityProvider.ServeAttributeQuery")
+	var err error
+	defer func() { span.End(err) }()
+	span.SetAttribute(AttributeBinding, SOAPBinding)
+
+	requestBuf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		idp.Logger.Printf("cannot read request: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	query, serviceProvider, err := idp.parseAttributeQuery(r, requestBuf)
+	if err != nil {
+		idp.Logger.Printf("invalid AttributeQuery: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	span.SetAttribute(AttributeSPEntityID, query.Issuer.Value)
+	span.SetAttribute(AttributeMessageID, query.ID)
+
+	status := Status{StatusCode: StatusCode{Value: StatusSuccess}}
+	var attributes []Attribute
+	if !idp.canFindSubjectSession() {
+		status.StatusCode = StatusCode{Value: StatusResponder, StatusCode: &StatusCode{Value: StatusRequestUnsupported}}
+	} else if session, err := idp.findSubjectSession(r, query.Issuer.Value, query.Subject.NameID); errors.Is(err, os.ErrNotExist) {
+		status.StatusCode = StatusCode{Value: StatusRequester, StatusCode: &StatusCode{Value: StatusUnknownPrincipal}}
+	} else if err != nil {
+		idp.Logger.Printf("cannot find subject of AttributeQuery: %s", err)
+		status.StatusCode = StatusCode{Value: StatusResponder}
+	} else if attributes, err = idp.queryAttributes(r, query, serviceProvider, session); errors.Is(err, errConsentNotGranted) {
+		idp.Logger.Printf("user has not consented to release attributes to %s", query.Issuer.Value)
+		status = requestDeniedStatus
+	} else if err != nil {
+		idp.Logger.Printf("cannot resolve attributes: %s", err)
+		status.StatusCode = StatusCode{Value: StatusResponder}
+	}
+
+	respEl, err := idp.makeAttributeQueryResponse(query, serviceProvider, status, attributes)
+	if err != nil {
+		idp.Logger.Printf("failed to make response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(soapEnvelope(respEl))
+	w.Header().Set("Content-Type", "text/xml")
+	if _, err = doc.WriteTo(w); err != nil {
+		idp.Logger.Printf("failed to write response: %s", err)
+	}
+}
+
+// canFindSubjectSession returns true if the IDP can look up the session of
+// the subject of a query.
+func (idp *IdentityProvider) canFindSubjectSession() bool {
+	_, ok := idp.SessionProvider.(AttributeQuerySessionProvider)
+	return ok || idp.SessionStore != nil
+}
+
+// findSubjectSession returns a session of the subject that the service
+// provider serviceProviderID knows by nameID. If there is none, the
+// returned error is os.ErrNotExist.
+func (idp *IdentityProvider) findSubjectSession(r *http.Request, serviceProviderID string, nameID *NameID) (*Session, error) {
+	if sessionProvider, ok := idp.SessionProvider.(AttributeQuerySessionProvider); ok {
+		return sessionProvider.GetSubjectSession(r, serviceProviderID, nameID)
+	}
+	store := idp.sessionStore()
+	sessionID, err := store.FindSession(serviceProviderID, nameID.Value, "")
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(sessionID)
+}
+
+// parseAttributeQuery parses and validates the SOAP encoded AttributeQuery
+// in requestBuf, and returns it along with the metadata of the service
+// provider that sent it.
+func (idp *IdentityProvider) parseAttributeQuery(r *http.Request, requestBuf []byte) (*AttributeQuery, *EntityDescriptor, error) {
+	if err := xrv.Validate(bytes.NewReader(requestBuf)); err != nil {
+		return nil, nil, err
+	}
+	if err := idp.checkStructure(requestBuf); err != nil {
+		return nil, nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(requestBuf); err != nil {
+		return nil, nil, err
+	}
+	requestEl := doc.FindElement("Envelope/Body/AttributeQuery")
+	if requestEl == nil {
+		return nil, nil, fmt.Errorf("missing AttributeQuery")
+	}
+
+	query := &AttributeQuery{}
+	if err := unmarshalEtreeHack(requestEl.Copy(), query); err != nil {
+		return nil, nil, err
+	}
+	if query.Version != "2.0" {
+		return nil, nil, fmt.Errorf("expected SAML request version 2.0 got %v", query.Version)
+	}
+	if query.IssueInstant.Add(MaxIssueDelay).Before(idp.now()) {
+		return nil, nil, fmt.Errorf("request expired at %s", query.IssueInstant.Add(MaxIssueDelay))
+	}
+	if query.Destination != "" && query.Destination != idp.AttributeQueryURL.String() {
+		return nil, nil, fmt.Errorf("expected destination to be %q, not %q", idp.AttributeQueryURL.String(), query.Destination)
+	}
+	if query.Issuer == nil {
+		return nil, nil, fmt.Errorf("request has no Issuer")
+	}
+	if query.Subject == nil || query.Subject.NameID == nil {
+		return nil, nil, fmt.Errorf("request has no NameID")
+	}
+
+	serviceProvider, err := idp.ServiceProviderProvider.GetServiceProvider(r, query.Issuer.Value)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("cannot handle request from unknown service provider %s", query.Issuer.Value)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("cannot find service provider %s: %v", query.Issuer.Value, err)
+	}
+	if err := idp.validateSPSignature(requestEl, serviceProvider); err != nil {
+		return nil, nil, fmt.Errorf("cannot validate signature on AttributeQuery: %v", err)
+	}
+	return query, serviceProvider, nil
+}
+
+// queryAttributes returns the attributes of the principal of session that
+// are released to serviceProvider and that query asks for. If the user has
+// not consented to their release, the returned error is
+// errConsentNotGranted.
+func (idp *IdentityProvider) queryAttributes(r *http.Request, query *AttributeQuery, serviceProvider *EntityDescriptor, session *Session) ([]Attribute, error) {
+	var attributes []Attribute
+	if idp.AttributeResolver != nil {
+		var err error
+		attributes, err = idp.AttributeResolver.Resolve(r.Context(), session, serviceProvider)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		attributes = sessionAttributes(session)
+	}
+	attributes = idp.releaseAttributes(serviceProvider, session, attributes)
+	attributes = query.filterAttributes(attributes)
+	if err := idp.checkStoredConsent(serviceProvider.EntityID, session, attributes); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+// filterAttributes returns the attributes that the query asks for, which
+// are all of them if it names none. Of an attribute that the query asks for
+// with specific values, only those values are returned, and the attribute
+// is left out if it has none of them (SAML core 3.3.2.3).
+func (r *AttributeQuery) filterAttributes(attributes []Attribute) []Attribute {
+	if len(r.Attributes) == 0 {
+		return attributes
+	}
+	rv := []Attribute{}
+	for _, attr := range attributes {
+		for _, requested := range r.Attributes {
+			if requested.Name != attr.Name {
+				continue
+			}
+			if requested.NameFormat != "" && attr.NameFormat != "" && requested.NameFormat != attr.NameFormat {
+				continue
+			}
+			if len(requested.Values) > 0 {
+				values := []AttributeValue{}
+				for _, value := range attr.Values {
+					if hasAttributeValue(requested.Values, value.Value) {
+						values = append(values, value)
+					}
+				}
+				if len(values) == 0 {
+					continue
+				}
+				attr.Values = values
+			}
+			rv = append(rv, attr)
+			break
+		}
+	}
+	return rv
+}
+
+// makeAttributeQueryResponse returns a signed Response to query with status
+// and, if status is success, a signed assertion of attributes about the
+// subject of the query.
+func (idp *IdentityProvider) makeAttributeQueryResponse(query *AttributeQuery, serviceProvider *EntityDescriptor, status Status, attributes []Attribute) (*etree.Element, error) {
+	signingContext, err := idp.signingContext()
+	if err != nil {
+		return nil, err
+	}
+
+	now := idp.now()
+	resp := &Response{
+		ID:           fmt.Sprintf("id-%x", idp.randomBytes(20)),
+		InResponseTo: query.ID,
+		Version:      "2.0",
+		IssueInstant: now,
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL.String(),
+		},
+		Status: status,
+	}
+
+	var assertionEl *etree.Element
+	if status.StatusCode.Value == StatusSuccess {
+		assertion := &Assertion{
+			ID:           fmt.Sprintf("id-%x", idp.randomBytes(20)),
+			IssueInstant: now,
+			Version:      "2.0",
+			Issuer: Issuer{
+				Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+				Value:  idp.Metadata().EntityID,
+			},
+			Subject: &Subject{
+				NameID: query.Subject.NameID,
+			},
+			Conditions: &Conditions{
+				NotBefore:    now.Add(-1 * MaxClockSkew),
+				NotOnOrAfter: now.Add(MaxIssueDelay),
+				AudienceRestrictions: []AudienceRestriction{
+					{
+						Audience: Audience{Value: serviceProvider.EntityID},
+					},
+				},
+			},
+		}
+		if len(attributes) > 0 {
+			assertion.AttributeStatements = []AttributeStatement{{Attributes: attributes}}
+		}
+
+		signedAssertionEl, err := signingContext.SignEnveloped(assertion.Element())
+		if err != nil {
+			return nil, err
+		}
+		assertion.Signature = signedAssertionEl.ChildElements()[len(signedAssertionEl.ChildElements())-1]
+		assertionEl = assertion.Element()
+	}
+
+	respEl := resp.Element()
+	if assertionEl != nil {
+		respEl.AddChild(assertionEl)
+	}
+	signedRespEl, err := signingContext.SignEnveloped(respEl)
+	if err != nil {
+		return nil, err
+	}
+	resp.Signature = signedRespEl.ChildElements()[len(signedRespEl.ChildElements())-1]
+
+	respEl = resp.Element()
+	if assertionEl != nil {
+		respEl.AddChild(assertionEl)
+	}
+	return respEl, nil
+}
@@ -0,0 +1,121 @@
+package saml
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type mockAttributeQuerySessionProvider struct {
+	mockSessionProvider
+	GetSubjectSessionFunc func(r *http.Request, serviceProviderID string, nameID *NameID) (*Session, error)
+}
+
+func (m *mockAttributeQuerySessionProvider) GetSubjectSession(r *http.Request, serviceProviderID string, nameID *NameID) (*Session, error) {
+	return m.GetSubjectSessionFunc(r, serviceProviderID, nameID)
+}
+
+func TestIDPCanHandleAttributeQuery(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	test.IDP.SessionProvider = &mockAttributeQuerySessionProvider{
+		GetSubjectSessionFunc: func(r *http.Request, serviceProviderID string, nameID *NameID) (*Session, error) {
+			assert.Check(t, is.Equal(serviceProviderID, test.SP.MetadataURL.String()))
+			if nameID.Value != "ba5eba11" {
+				return nil, os.ErrNotExist
+			}
+			return &Session{
+				ID:            "f00df00df00d",
+				NameID:        "ba5eba11",
+				UserName:      "alice",
+				UserEmail:     "alice@example.com",
+				UserGivenName: "Alice",
+				Groups:        []string{"Users", "Administrators"},
+			}, nil
+		},
+	}
+	test.IDP.AttributeReleasePolicy = &AttributeReleasePolicy{
+		Rules: []AttributeReleaseRule{
+			{
+				EntityIDs:  []string{"https://sp.example.com/*"},
+				Attributes: []string{"urn:oid:0.9.2342.19200300.100.1.1", "urn:oid:1.3.6.1.4.1.5923.1.1.1.1", "urn:oid:2.5.4.42"},
+			},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(test.IDP.ServeAttributeQuery))
+	defer server.Close()
+	test.IDP.AttributeQueryURL = mustParseURL(server.URL + "/saml/attributes")
+	test.SP.IDPMetadata = test.IDP.Metadata()
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	assert.Assert(t, is.Len(test.SP.IDPMetadata.AttributeAuthorityDescriptors, 1))
+	assert.Check(t, is.Equal(server.URL+"/saml/attributes", test.SP.GetAttributeServiceLocation(SOAPBinding)))
+
+	nameID := &NameID{Format: string(TransientNameIDFormat), Value: "ba5eba11"}
+	assertion, err := test.SP.QueryAttributes(nameID, []Attribute{
+		NewQueryAttribute("urn:oid:0.9.2342.19200300.100.1.1", ""),
+		NewQueryAttribute("urn:oid:1.3.6.1.4.1.5923.1.1.1.1", "", "Administrators", "Guests"),
+		NewQueryAttribute("urn:oid:1.3.6.1.4.1.5923.1.1.1.6", ""),
+	})
+	assert.Assert(t, err)
+	assert.Check(t, is.Equal("ba5eba11", assertion.Subject.NameID.Value))
+	assert.Assert(t, is.Len(assertion.AttributeStatements, 1))
+	attributes := assertion.AttributeStatements[0].Attributes
+	assert.Assert(t, is.Len(attributes, 2))
+
+	// the uid is released and requested
+	assert.Check(t, is.Equal("urn:oid:0.9.2342.19200300.100.1.1", attributes[0].Name))
+	assert.Check(t, is.Equal("alice", attributes[0].Values[0].Value))
+
+	// only the requested values of the groups are returned
+	assert.Check(t, is.Equal("urn:oid:1.3.6.1.4.1.5923.1.1.1.1", attributes[1].Name))
+	assert.Assert(t, is.Len(attributes[1].Values, 1))
+	assert.Check(t, is.Equal("Administrators", attributes[1].Values[0].Value))
+
+	// unknown subjects are reported as such
+	_, err = test.SP.QueryAttributes(&NameID{Format: string(TransientNameIDFormat), Value: "bob"}, nil)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"urn:oasis:names:tc:SAML:2.0:status:Requester"))
+
+	// unsigned requests are rejected
+	test.SP.SignatureMethod = ""
+	_, err = test.SP.QueryAttributes(nameID, nil)
+	assert.Check(t, is.ErrorContains(err, "HTTP status 400"))
+}
+
+func TestIDPAttributeQueryRequiresSubjectLookup(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+	test.IDP.AttributeQueryURL = mustParseURL("https://idp.example.com/saml/attributes")
+	test.SP.IDPMetadata = test.IDP.Metadata()
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	query, err := test.SP.MakeAttributeQuery(test.IDP.AttributeQueryURL.String(),
+		&NameID{Format: string(TransientNameIDFormat), Value: "ba5eba11"}, nil)
+	assert.Assert(t, err)
+	doc := etree.NewDocument()
+	doc.SetRoot(query.SoapRequest())
+	requestBuf, err := doc.WriteToBytes()
+	assert.Assert(t, err)
+
+	// the IDP cannot look up the subject of the query without an
+	// AttributeQuerySessionProvider
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", test.IDP.AttributeQueryURL.String(), bytes.NewReader(requestBuf))
+	test.IDP.ServeAttributeQuery(w, r)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Contains(w.Body.String(), StatusRequestUnsupported))
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", test.IDP.AttributeQueryURL.String(), nil)
+	test.IDP.ServeAttributeQuery(w, r)
+	assert.Check(t, is.Equal(http.StatusMethodNotAllowed, w.Code))
+}
@@ -0,0 +1,191 @@
+package saml
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ResearchAndScholarshipAttributes are the names of the attributes of the
+// REFEDS Research and Scholarship attribute bundle: a shared user
+// identifier, the name and email address of the user and, optionally, their
+// scoped affiliation.
+//
+// See https://refeds.org/category/research-and-scholarship
+var ResearchAndScholarshipAttributes = []string{
+	"urn:oid:1.3.6.1.4.1.5923.1.1.1.6",              // eduPersonPrincipalName
+	"urn:oid:1.3.6.1.4.1.5923.1.1.1.10",             // eduPersonTargetedID
+	"urn:oasis:names:tc:SAML:attribute:subject-id",  // subject-id
+	"urn:oasis:names:tc:SAML:attribute:pairwise-id", // pairwise-id
+	"urn:oid:0.9.2342.19200300.100.1.3",             // mail
+	"urn:oid:2.16.840.1.113730.3.1.241",             // displayName
+	"urn:oid:2.5.4.42",                              // givenName
+	"urn:oid:2.5.4.4",                               // sn
+	"urn:oid:1.3.6.1.4.1.5923.1.1.1.9",              // eduPersonScopedAffiliation
+}
+
+// AttributeReleasePolicy decides which attributes each service provider
+// receives. It is deny by default: an attribute is only released to a
+// service provider if one of the Rules that apply to the service provider
+// releases it. See IdentityProvider.AttributeReleasePolicy.
+//
+// For example, to release the Research and Scholarship bundle to the
+// service providers of that category, and the uid to those of
+// example.com:
+//
+//	idp.AttributeReleasePolicy = &saml.AttributeReleasePolicy{
+//		Rules: []saml.AttributeReleaseRule{
+//			{
+//				EntityCategories: []string{saml.REFEDSResearchAndScholarshipCategory},
+//				Attributes:       saml.ResearchAndScholarshipAttributes,
+//			},
+//			{
+//				EntityIDs:  []string{"https://*.example.com/*"},
+//				Attributes: []string{"urn:oid:0.9.2342.19200300.100.1.1"},
+//			},
+//		},
+//	}
+type AttributeReleasePolicy struct {
+	Rules []AttributeReleaseRule
+
+	// Audit, if not nil, is called with the attributes that are released
+	// to, and withheld from, a service provider each time an assertion is
+	// made, for an audit log. It is called synchronously, so it should not
+	// block.
+	Audit func(event AttributeReleaseEvent)
+}
+
+// AttributeReleaseRule releases attributes to the service providers that
+// it applies to. A rule applies to a service provider if its entity ID
+// matches one of EntityIDs, and if it is a member of one of
+// EntityCategories. An empty list matches any service provider.
+type AttributeReleaseRule struct {
+	// EntityIDs are patterns of the entity IDs of service providers, in
+	// which "*" matches any sequence of characters, i.e.
+	// "https://*.example.com/*".
+	EntityIDs []string
+
+	// EntityCategories are the entity categories of service providers, as
+	// published in their metadata, i.e.
+	// REFEDSResearchAndScholarshipCategory.
+	EntityCategories []string
+
+	// Attributes are the names of the attributes that the rule releases. A
+	// name of "*" releases all attributes.
+	Attributes []string
+}
+
+// AttributeReleaseEvent describes the attributes released to a service
+// provider. Released and Withheld are attribute names.
+type AttributeReleaseEvent struct {
+	SPEntityID string
+	NameID     string
+	Released   []string
+	Withheld   []string
+	Time       time.Time
+}
+
+// appliesTo returns true if the rule applies to the service provider sp.
+func (rule AttributeReleaseRule) appliesTo(sp *EntityDescriptor) bool {
+	if len(rule.EntityIDs) > 0 {
+		matched := false
+		for _, pattern := range rule.EntityIDs {
+			if matchEntityIDPattern(pattern, sp.EntityID) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.EntityCategories) > 0 {
+		matched := false
+		for _, category := range rule.EntityCategories {
+			if sp.HasEntityCategory(category) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchEntityIDPattern returns true if entityID matches pattern, in which
+// "*" matches any sequence of characters.
+func matchEntityIDPattern(pattern string, entityID string) bool {
+	re := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	return regexp.MustCompile(re).MatchString(entityID)
+}
+
+// releases returns true if the rule releases the attribute called name.
+func (rule AttributeReleaseRule) releases(name string) bool {
+	for _, released := range rule.Attributes {
+		if released == "*" || released == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the attributes that are released to the service provider
+// sp, and the names of those that are withheld from it.
+func (p *AttributeReleasePolicy) Filter(sp *EntityDescriptor, attributes []Attribute) (released []Attribute, withheld []string) {
+	rules := []AttributeReleaseRule{}
+	for _, rule := range p.Rules {
+		if rule.appliesTo(sp) {
+			rules = append(rules, rule)
+		}
+	}
+
+	released = []Attribute{}
+	for _, attribute := range attributes {
+		ok := false
+		for _, rule := range rules {
+			if rule.releases(attribute.Name) {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			released = append(released, attribute)
+		} else {
+			withheld = append(withheld, attribute.Name)
+		}
+	}
+	return released, withheld
+}
+
+// releaseAttributes returns the attributes of session that the attribute
+// release policy of the IDP, if any, releases to the service provider of
+// req, and reports them to its Audit function.
+func (req *IdpAuthnRequest) releaseAttributes(session *Session, attributes []Attribute) []Attribute {
+	return req.IDP.releaseAttributes(req.ServiceProviderMetadata, session, attributes)
+}
+
+// releaseAttributes returns the attributes of session that the attribute
+// release policy of the IDP, if any, releases to the service provider sp,
+// and reports them to its Audit function.
+func (idp *IdentityProvider) releaseAttributes(sp *EntityDescriptor, session *Session, attributes []Attribute) []Attribute {
+	policy := idp.AttributeReleasePolicy
+	if policy == nil {
+		return attributes
+	}
+	released, withheld := policy.Filter(sp, attributes)
+	if policy.Audit != nil {
+		event := AttributeReleaseEvent{
+			SPEntityID: sp.EntityID,
+			NameID:     session.NameID,
+			Withheld:   withheld,
+			Time:       idp.now(),
+		}
+		for _, attribute := range released {
+			event.Released = append(event.Released, attribute.Name)
+		}
+		policy.Audit(event)
+	}
+	return released
+}
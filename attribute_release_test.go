@@ -0,0 +1,127 @@
+package saml
+
+import (
+	"net/http"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestAttributeReleasePolicyFilter(t *testing.T) {
+	policy := &AttributeReleasePolicy{
+		Rules: []AttributeReleaseRule{
+			{
+				EntityCategories: []string{REFEDSResearchAndScholarshipCategory},
+				Attributes:       ResearchAndScholarshipAttributes,
+			},
+			{
+				EntityIDs:  []string{"https://*.example.com/*"},
+				Attributes: []string{"urn:oid:0.9.2342.19200300.100.1.1"},
+			},
+			{
+				EntityIDs:  []string{"https://trusted.example.org/metadata"},
+				Attributes: []string{"*"},
+			},
+		},
+	}
+	attributes := []Attribute{
+		stringAttribute("urn:oid:0.9.2342.19200300.100.1.1", "alice"),
+		stringAttribute("urn:oid:1.3.6.1.4.1.5923.1.1.1.6", "alice@example.com"),
+		stringAttribute("urn:oid:1.3.6.1.4.1.5923.1.1.1.1", "staff"),
+	}
+	researchAndScholarship := &EntityDescriptor{
+		EntityID: "https://wiki.example.net/metadata",
+		Extensions: &MetadataExtensions{
+			EntityAttributes: &EntityAttributes{
+				Attributes: []Attribute{stringAttribute(EntityCategoryAttributeName, REFEDSResearchAndScholarshipCategory)},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		sp       *EntityDescriptor
+		released []Attribute
+		withheld []string
+	}{
+		{
+			name:     "entity category",
+			sp:       researchAndScholarship,
+			released: attributes[1:2],
+			withheld: []string{"urn:oid:0.9.2342.19200300.100.1.1", "urn:oid:1.3.6.1.4.1.5923.1.1.1.1"},
+		},
+		{
+			name:     "entity ID pattern",
+			sp:       &EntityDescriptor{EntityID: "https://app.example.com/saml/metadata"},
+			released: attributes[:1],
+			withheld: []string{"urn:oid:1.3.6.1.4.1.5923.1.1.1.6", "urn:oid:1.3.6.1.4.1.5923.1.1.1.1"},
+		},
+		{
+			name:     "all attributes",
+			sp:       &EntityDescriptor{EntityID: "https://trusted.example.org/metadata"},
+			released: attributes,
+		},
+		{
+			name:     "deny by default",
+			sp:       &EntityDescriptor{EntityID: "https://unknown.example.net/metadata"},
+			released: []Attribute{},
+			withheld: []string{"urn:oid:0.9.2342.19200300.100.1.1", "urn:oid:1.3.6.1.4.1.5923.1.1.1.6", "urn:oid:1.3.6.1.4.1.5923.1.1.1.1"},
+		},
+	} {
+		released, withheld := policy.Filter(tc.sp, attributes)
+		assert.Check(t, is.DeepEqual(tc.released, released), tc.name)
+		assert.Check(t, is.DeepEqual(tc.withheld, withheld), tc.name)
+	}
+}
+
+func TestIDPMakeAssertionWithAttributeReleasePolicy(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	events := []AttributeReleaseEvent{}
+	test.IDP.AttributeReleasePolicy = &AttributeReleasePolicy{
+		Rules: []AttributeReleaseRule{
+			{
+				EntityIDs:  []string{"https://sp.example.com/*"},
+				Attributes: []string{"urn:oid:0.9.2342.19200300.100.1.1"},
+			},
+		},
+		Audit: func(event AttributeReleaseEvent) {
+			events = append(events, event)
+		},
+	}
+	req := IdpAuthnRequest{
+		Now: TimeNow(),
+		IDP: &test.IDP,
+		RequestBuffer: []byte("" +
+			"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+			"  AssertionConsumerServiceURL=\"https://sp.example.com/saml2/acs\" " +
+			"  Destination=\"https://idp.example.com/saml/sso\" " +
+			"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+			"  IssueInstant=\"2015-12-01T01:57:09Z\" ProtocolBinding=\"\" " +
+			"  Version=\"2.0\">" +
+			"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+			"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+			"</AuthnRequest>"),
+	}
+	req.HTTPRequest, _ = http.NewRequest("POST", "http://idp.example.com/saml/sso", nil)
+	assert.Check(t, req.Validate())
+
+	err := DefaultAssertionMaker{}.MakeAssertion(&req, &Session{
+		ID:        "f00df00df00d",
+		NameID:    "ba5eba11",
+		UserName:  "alice",
+		UserEmail: "alice@example.com",
+	})
+	assert.Check(t, err)
+	attributes := req.Assertion.AttributeStatements[0].Attributes
+	assert.Check(t, is.Len(attributes, 1))
+	assert.Check(t, is.Equal("urn:oid:0.9.2342.19200300.100.1.1", attributes[0].Name))
+
+	assert.Check(t, is.DeepEqual([]AttributeReleaseEvent{{
+		SPEntityID: "https://sp.example.com/saml2/metadata",
+		NameID:     "ba5eba11",
+		Released:   []string{"urn:oid:0.9.2342.19200300.100.1.1"},
+		Withheld:   []string{"urn:oid:1.3.6.1.4.1.5923.1.1.1.6"},
+		Time:       TimeNow(),
+	}}, events))
+}
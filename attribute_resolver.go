@@ -0,0 +1,201 @@
+package saml
+
+import (
+	"context"
+)
+
+// AttributeResolver is an interface used by IdentityProvider to look up the
+// attributes of the principal that are sent to a service provider, for
+// instance from an LDAP directory, a database or a REST API, rather than
+// from the Session. See IdentityProvider.AttributeResolver.
+type AttributeResolver interface {
+	// Resolve returns the attributes of the principal of session for the
+	// service provider sp. ctx is the context of the request that is being
+	// answered. If Resolve returns an error, no assertion is issued.
+	Resolve(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error)
+}
+
+// AttributeResolverFunc is an AttributeResolver that is a function.
+type AttributeResolverFunc func(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error)
+
+// Resolve implements AttributeResolver.
+func (f AttributeResolverFunc) Resolve(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error) {
+	return f(ctx, session, sp)
+}
+
+// SessionAttributeResolver is an AttributeResolver that returns the
+// attributes that the Session carries: the uid, eduPersonPrincipalName, sn,
+// givenName, cn, eduPersonScopedAffiliation and eduPersonAffiliation
+// attributes of its fields, and its CustomAttributes. These are the
+// attributes that DefaultAssertionMaker sends if the IdentityProvider has
+// no AttributeResolver.
+type SessionAttributeResolver struct{}
+
+// Resolve implements AttributeResolver.
+func (SessionAttributeResolver) Resolve(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error) {
+	return sessionAttributes(session), nil
+}
+
+// ChainAttributeResolvers returns an AttributeResolver that calls each of
+// resolvers in turn and returns the attributes of all of them. An attribute
+// replaces any attribute of the same Name that an earlier resolver
+// returned, so later resolvers can override earlier ones. The first error
+// is returned.
+//
+// For example, to send the attributes of the session along with the
+// groups of the principal in a directory:
+//
+//	idp.AttributeResolver = saml.ChainAttributeResolvers(
+//		saml.SessionAttributeResolver{},
+//		saml.AttributeResolverFunc(func(ctx context.Context, session *saml.Session, sp *saml.EntityDescriptor) ([]saml.Attribute, error) {
+//			return directory.MemberOf(ctx, session.UserName)
+//		}),
+//	)
+func ChainAttributeResolvers(resolvers ...AttributeResolver) AttributeResolver {
+	return AttributeResolverFunc(func(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error) {
+		rv := []Attribute{}
+		for _, resolver := range resolvers {
+			attributes, err := resolver.Resolve(ctx, session, sp)
+			if err != nil {
+				return nil, err
+			}
+			for _, attribute := range attributes {
+				rv = appendOrReplaceAttribute(rv, attribute)
+			}
+		}
+		return rv, nil
+	})
+}
+
+// appendOrReplaceAttribute returns attributes with attribute in place of
+// the first attribute of the same Name, or appended if there is none.
+func appendOrReplaceAttribute(attributes []Attribute, attribute Attribute) []Attribute {
+	for i := range attributes {
+		if attributes[i].Name == attribute.Name {
+			attributes[i] = attribute
+			return attributes
+		}
+	}
+	return append(attributes, attribute)
+}
+
+// ServiceProviderAttributeResolvers is an AttributeResolver that resolves
+// the attributes of each service provider with the resolver registered for
+// its entity ID in ServiceProviders, or with Default if there is none. If
+// there is no resolver for a service provider, no attributes are sent.
+type ServiceProviderAttributeResolvers struct {
+	Default          AttributeResolver
+	ServiceProviders map[string]AttributeResolver
+}
+
+// Resolve implements AttributeResolver.
+func (r ServiceProviderAttributeResolvers) Resolve(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error) {
+	resolver := r.Default
+	if sp != nil {
+		if spResolver, ok := r.ServiceProviders[sp.EntityID]; ok {
+			resolver = spResolver
+		}
+	}
+	if resolver == nil {
+		return nil, nil
+	}
+	return resolver.Resolve(ctx, session, sp)
+}
+
+// sessionAttributes returns the attributes that session carries. See
+// SessionAttributeResolver.
+func sessionAttributes(session *Session) []Attribute {
+	attributes := []Attribute{}
+
+	if session.UserName != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "uid",
+			Name:         "urn:oid:0.9.2342.19200300.100.1.1",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+			Values: []AttributeValue{{
+				Type:  "xs:string",
+				Value: session.UserName,
+			}},
+		})
+	}
+
+	if session.UserEmail != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "eduPersonPrincipalName",
+			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+			Values: []AttributeValue{{
+				Type:  "xs:string",
+				Value: session.UserEmail,
+			}},
+		})
+	}
+	if session.UserSurname != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "sn",
+			Name:         "urn:oid:2.5.4.4",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+			Values: []AttributeValue{{
+				Type:  "xs:string",
+				Value: session.UserSurname,
+			}},
+		})
+	}
+	if session.UserGivenName != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "givenName",
+			Name:         "urn:oid:2.5.4.42",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+			Values: []AttributeValue{{
+				Type:  "xs:string",
+				Value: session.UserGivenName,
+			}},
+		})
+	}
+
+	if session.UserCommonName != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "cn",
+			Name:         "urn:oid:2.5.4.3",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+			Values: []AttributeValue{{
+				Type:  "xs:string",
+				Value: session.UserCommonName,
+			}},
+		})
+	}
+
+	if session.UserScopedAffiliation != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "uid",
+			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.9",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+			Values: []AttributeValue{{
+				Type:  "xs:string",
+				Value: session.UserScopedAffiliation,
+			}},
+		})
+	}
+
+	for _, ca := range session.CustomAttributes {
+		attributes = append(attributes, ca)
+	}
+
+	if len(session.Groups) != 0 {
+		groupMemberAttributeValues := []AttributeValue{}
+		for _, group := range session.Groups {
+			groupMemberAttributeValues = append(groupMemberAttributeValues, AttributeValue{
+				Type:  "xs:string",
+				Value: group,
+			})
+		}
+		attributes = append(attributes, Attribute{
+			FriendlyName: "eduPersonAffiliation",
+			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+			Values:       groupMemberAttributeValues,
+		})
+	}
+
+	return attributes
+}
@@ -0,0 +1,116 @@
+package saml
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func stringAttribute(name string, values ...string) Attribute {
+	attribute := Attribute{
+		Name:       name,
+		NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+	}
+	for _, value := range values {
+		attribute.Values = append(attribute.Values, AttributeValue{Type: "xs:string", Value: value})
+	}
+	return attribute
+}
+
+func staticAttributeResolver(attributes ...Attribute) AttributeResolver {
+	return AttributeResolverFunc(func(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error) {
+		return attributes, nil
+	})
+}
+
+func TestChainAttributeResolvers(t *testing.T) {
+	resolver := ChainAttributeResolvers(
+		SessionAttributeResolver{},
+		staticAttributeResolver(stringAttribute("department", "Sales"), stringAttribute("memberOf", "users")),
+		staticAttributeResolver(stringAttribute("memberOf", "users", "admins")),
+	)
+	attributes, err := resolver.Resolve(context.Background(), &Session{UserName: "alice"}, &EntityDescriptor{})
+	assert.Check(t, err)
+	assert.Check(t, is.Len(attributes, 3))
+	assert.Check(t, is.Equal("urn:oid:0.9.2342.19200300.100.1.1", attributes[0].Name))
+	assert.Check(t, is.DeepEqual(stringAttribute("department", "Sales"), attributes[1]))
+	assert.Check(t, is.DeepEqual(stringAttribute("memberOf", "users", "admins"), attributes[2]))
+
+	resolver = ChainAttributeResolvers(
+		SessionAttributeResolver{},
+		AttributeResolverFunc(func(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error) {
+			return nil, errors.New("directory is unavailable")
+		}),
+	)
+	_, err = resolver.Resolve(context.Background(), &Session{UserName: "alice"}, &EntityDescriptor{})
+	assert.Check(t, is.Error(err, "directory is unavailable"))
+}
+
+func TestServiceProviderAttributeResolvers(t *testing.T) {
+	resolver := ServiceProviderAttributeResolvers{
+		Default: staticAttributeResolver(stringAttribute("role", "user")),
+		ServiceProviders: map[string]AttributeResolver{
+			"https://sp.example.com/saml2/metadata": staticAttributeResolver(stringAttribute("role", "admin")),
+		},
+	}
+	attributes, err := resolver.Resolve(context.Background(), &Session{}, &EntityDescriptor{EntityID: "https://sp.example.com/saml2/metadata"})
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual([]Attribute{stringAttribute("role", "admin")}, attributes))
+
+	attributes, err = resolver.Resolve(context.Background(), &Session{}, &EntityDescriptor{EntityID: "https://other.example.com/metadata"})
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual([]Attribute{stringAttribute("role", "user")}, attributes))
+
+	resolver.Default = nil
+	attributes, err = resolver.Resolve(context.Background(), &Session{}, &EntityDescriptor{EntityID: "https://other.example.com/metadata"})
+	assert.Check(t, err)
+	assert.Check(t, is.Len(attributes, 0))
+}
+
+func TestIDPMakeAssertionWithAttributeResolver(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	type contextKey struct{}
+	test.IDP.AttributeResolver = AttributeResolverFunc(func(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error) {
+		assert.Check(t, is.Equal("request", ctx.Value(contextKey{})))
+		assert.Check(t, is.Equal("https://sp.example.com/saml2/metadata", sp.EntityID))
+		if session.UserName != "alice" {
+			return nil, errors.New("no such user")
+		}
+		return []Attribute{stringAttribute("department", "Sales")}, nil
+	})
+	req := IdpAuthnRequest{
+		Now: TimeNow(),
+		IDP: &test.IDP,
+		RequestBuffer: []byte("" +
+			"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+			"  AssertionConsumerServiceURL=\"https://sp.example.com/saml2/acs\" " +
+			"  Destination=\"https://idp.example.com/saml/sso\" " +
+			"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+			"  IssueInstant=\"2015-12-01T01:57:09Z\" ProtocolBinding=\"\" " +
+			"  Version=\"2.0\">" +
+			"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+			"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+			"</AuthnRequest>"),
+	}
+	req.HTTPRequest, _ = http.NewRequest("POST", "http://idp.example.com/saml/sso", nil)
+	req.HTTPRequest = req.HTTPRequest.WithContext(context.WithValue(req.HTTPRequest.Context(), contextKey{}, "request"))
+	assert.Check(t, req.Validate())
+
+	err := DefaultAssertionMaker{}.MakeAssertion(&req, &Session{
+		ID:        "f00df00df00d",
+		UserName:  "alice",
+		UserEmail: "alice@example.com",
+	})
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual([]Attribute{stringAttribute("department", "Sales")},
+		req.Assertion.AttributeStatements[0].Attributes))
+
+	req.Assertion = nil
+	err = DefaultAssertionMaker{}.MakeAssertion(&req, &Session{ID: "f00df00df00d", UserName: "bob"})
+	assert.Check(t, is.Error(err, "no such user"))
+	assert.Check(t, is.Nil(req.Assertion))
+}
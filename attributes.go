@@ -0,0 +1,177 @@
+package saml
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrMissingAttribute is matched with errors.Is by the error that
+// UnmarshalAttributes returns when a required attribute is missing.
+var ErrMissingAttribute = errors.New("saml: missing attribute")
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// UnmarshalAttributes sets the fields of the struct that v points to from
+// the attributes of the assertion. Each field is set from the attribute
+// named in its `saml` tag, which is matched against both the Name and the
+// FriendlyName of the attributes in all the attribute statements:
+//
+//	type User struct {
+//		Email  string    `saml:"urn:oid:0.9.2342.19200300.100.1.3,required"`
+//		Groups []string  `saml:"memberOf"`
+//		Admin  bool      `saml:"isAdmin"`
+//		Expiry time.Time `saml:"accountExpires"`
+//	}
+//
+// Fields without a tag, or tagged "-", are left alone. A field may be a
+// string, a bool, an integer, a float, a time.Time, which is parsed like
+// RelaxedTime, or implement encoding.TextUnmarshaler, or be a pointer to or
+// a slice of any of those. A slice receives all the values of the
+// attribute; any other field must not receive more than one. Values that
+// are a NameID are taken as the value of the NameID.
+//
+// If the tag has the "required" option, an error that matches
+// ErrMissingAttribute is returned when the attribute has no value.
+// Otherwise fields of missing attributes keep their value.
+func UnmarshalAttributes(assertion *Assertion, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("saml: UnmarshalAttributes requires a pointer to a struct, not %T", v)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag := field.Tag.Get("saml")
+		if tag == "" || tag == "-" || field.PkgPath != "" {
+			continue
+		}
+		name, options := tag, ""
+		if i := strings.IndexByte(tag, ','); i >= 0 {
+			name, options = tag[:i], tag[i+1:]
+		}
+		required := false
+		for _, option := range strings.Split(options, ",") {
+			switch option {
+			case "":
+			case "required":
+				required = true
+			default:
+				return fmt.Errorf("saml: field %s has unknown option %q", field.Name, option)
+			}
+		}
+
+		values := assertionAttributeValues(assertion, name)
+		if len(values) == 0 {
+			if required {
+				return errorOfKind(ErrMissingAttribute, "saml: missing required attribute %q for field %s", name, field.Name)
+			}
+			continue
+		}
+		if err := setAttributeField(rv.Field(i), values); err != nil {
+			return fmt.Errorf("saml: cannot set field %s from attribute %q: %v", field.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// assertionAttributeValues returns the values of the attributes of the
+// assertion whose Name or FriendlyName is name.
+func assertionAttributeValues(assertion *Assertion, name string) []string {
+	var values []string
+	for _, attributeStatement := range assertion.AttributeStatements {
+		for _, attr := range attributeStatement.Attributes {
+			if attr.Name != name && attr.FriendlyName != name {
+				continue
+			}
+			for _, value := range attr.Values {
+				if value.NameID != nil {
+					values = append(values, value.NameID.Value)
+				} else {
+					values = append(values, value.Value)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// setAttributeField sets field from the values of an attribute.
+func setAttributeField(field reflect.Value, values []string) error {
+	if field.Kind() == reflect.Slice && !reflect.PtrTo(field.Type()).Implements(textUnmarshalerType) {
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setAttributeValue(slice.Index(i), value); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+	if len(values) > 1 {
+		return fmt.Errorf("%d values for a field that is not a slice", len(values))
+	}
+	return setAttributeValue(field, values[0])
+}
+
+// setAttributeValue sets v from the attribute value s.
+func setAttributeValue(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setAttributeValue(v.Elem(), s)
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	if v.Type() == timeType {
+		var t RelaxedTime
+		if err := t.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(time.Time(t)))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(strings.TrimSpace(s), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package saml
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func testAttributesAssertion() *Assertion {
+	return &Assertion{
+		AttributeStatements: []AttributeStatement{
+			{
+				Attributes: []Attribute{
+					NewQueryAttribute("urn:oid:0.9.2342.19200300.100.1.3", "", "alice@example.com"),
+					NewQueryAttribute("memberOf", "", "staff", "admins"),
+					NewQueryAttribute("isAdmin", "", "true"),
+					NewQueryAttribute("accountExpires", "", "2030-01-02T03:04:05Z"),
+					NewQueryAttribute("loginCount", "", "42"),
+					NewQueryAttribute("lastAddress", "", "192.0.2.1"),
+				},
+			},
+			{
+				Attributes: []Attribute{
+					{
+						Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.10",
+						FriendlyName: "eduPersonTargetedID",
+						Values:       []AttributeValue{{NameID: &NameID{Value: "_41bd295976dadd70e1480f318e772841"}}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestCanUnmarshalAttributes(t *testing.T) {
+	var user struct {
+		Email       string    `saml:"urn:oid:0.9.2342.19200300.100.1.3,required"`
+		Groups      []string  `saml:"memberOf"`
+		Admin       bool      `saml:"isAdmin"`
+		Expires     time.Time `saml:"accountExpires"`
+		LoginCount  *int      `saml:"loginCount"`
+		LastAddress net.IP    `saml:"lastAddress"`
+		TargetedID  string    `saml:"eduPersonTargetedID"`
+		Phone       string    `saml:"telephoneNumber"`
+		Ignored     string
+		Skipped     string `saml:"-"`
+	}
+	user.Phone = "555-5555"
+
+	assert.Check(t, UnmarshalAttributes(testAttributesAssertion(), &user))
+	assert.Check(t, is.Equal("alice@example.com", user.Email))
+	assert.Check(t, is.DeepEqual([]string{"staff", "admins"}, user.Groups))
+	assert.Check(t, user.Admin)
+	assert.Check(t, user.Expires.Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)))
+	assert.Assert(t, user.LoginCount != nil)
+	assert.Check(t, is.Equal(42, *user.LoginCount))
+	assert.Check(t, user.LastAddress.Equal(net.ParseIP("192.0.2.1")))
+	assert.Check(t, is.Equal("_41bd295976dadd70e1480f318e772841", user.TargetedID))
+
+	// missing optional attributes keep their value
+	assert.Check(t, is.Equal("555-5555", user.Phone))
+}
+
+func TestUnmarshalAttributesReportsErrors(t *testing.T) {
+	var missing struct {
+		Phone string `saml:"telephoneNumber,required"`
+	}
+	err := UnmarshalAttributes(testAttributesAssertion(), &missing)
+	assert.Check(t, is.Error(err, `saml: missing required attribute "telephoneNumber" for field Phone`))
+	assert.Check(t, errors.Is(err, ErrMissingAttribute))
+
+	var multiValued struct {
+		Group string `saml:"memberOf"`
+	}
+	assert.Check(t, is.Error(UnmarshalAttributes(testAttributesAssertion(), &multiValued),
+		`saml: cannot set field Group from attribute "memberOf": 2 values for a field that is not a slice`))
+
+	var malformed struct {
+		Admin int `saml:"isAdmin"`
+	}
+	assert.Check(t, is.ErrorContains(UnmarshalAttributes(testAttributesAssertion(), &malformed),
+		`saml: cannot set field Admin from attribute "isAdmin": `))
+
+	var unknownOption struct {
+		Email string `saml:"mail,omitempty"`
+	}
+	assert.Check(t, is.Error(UnmarshalAttributes(testAttributesAssertion(), &unknownOption),
+		`saml: field Email has unknown option "omitempty"`))
+
+	var notAStruct string
+	assert.Check(t, is.Error(UnmarshalAttributes(testAttributesAssertion(), &notAStruct),
+		"saml: UnmarshalAttributes requires a pointer to a struct, not *string"))
+}
@@ -0,0 +1,82 @@
+package saml
+
+import "fmt"
+
+// Authentication context classes that identity providers commonly assert,
+// i.e. in Session.AuthnContextClassRef.
+const (
+	PasswordProtectedTransportAuthnContext = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	TLSClientAuthnContext                  = "urn:oasis:names:tc:SAML:2.0:ac:classes:TLSClient"
+	SmartcardAuthnContext                  = "urn:oasis:names:tc:SAML:2.0:ac:classes:Smartcard"
+	SmartcardPKIAuthnContext               = "urn:oasis:names:tc:SAML:2.0:ac:classes:SmartcardPKI"
+
+	// REFEDSMFAAuthnContext tells that the user authenticated with multiple
+	// factors, as described by the REFEDS MFA profile.
+	//
+	// See https://refeds.org/profile/mfa
+	REFEDSMFAAuthnContext = "https://refeds.org/profile/mfa"
+)
+
+// DefaultAuthnContextClassOrder is the default value of
+// ServiceProvider.AuthnContextClassOrder and
+// IdentityProvider.AuthnContextClassOrder. It ranks the authentication
+// context classes of the SAML specification that are commonly used, and the
+// REFEDS MFA profile, from the weakest to the strongest.
+var DefaultAuthnContextClassOrder = []string{
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:InternetProtocol",
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:InternetProtocolPassword",
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:Password",
+	PasswordProtectedTransportAuthnContext,
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:Kerberos",
+	TLSClientAuthnContext,
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:X509",
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:TimeSyncToken",
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:MobileTwoFactorUnregistered",
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:MobileTwoFactorContract",
+	REFEDSMFAAuthnContext,
+	SmartcardAuthnContext,
+	SmartcardPKIAuthnContext,
+}
+
+// authnContextSatisfies returns true if an authentication of the class
+// classRef satisfies requested, according to its Comparison (SAML core
+// 3.3.2.2.1). Classes are ranked by classOrder, or by
+// DefaultAuthnContextClassOrder if it is nil; a class that is not listed
+// only satisfies an exact match.
+func authnContextSatisfies(requested *RequestedAuthnContext, classRef string, classOrder []string) (bool, error) {
+	if classOrder == nil {
+		classOrder = DefaultAuthnContextClassOrder
+	}
+	rank := func(classRef string) int {
+		for i, c := range classOrder {
+			if c == classRef {
+				return i
+			}
+		}
+		return -1
+	}
+
+	actualRank := rank(classRef)
+	for _, requestedClassRef := range requested.AuthnContextClassRefs {
+		requestedRank := rank(requestedClassRef)
+		satisfied := false
+		switch requested.Comparison {
+		case "", "exact":
+			satisfied = classRef == requestedClassRef
+		case "minimum":
+			satisfied = classRef == requestedClassRef ||
+				(actualRank >= 0 && requestedRank >= 0 && actualRank >= requestedRank)
+		case "better":
+			satisfied = actualRank >= 0 && requestedRank >= 0 && actualRank > requestedRank
+		case "maximum":
+			satisfied = classRef == requestedClassRef ||
+				(actualRank >= 0 && requestedRank >= 0 && actualRank <= requestedRank)
+		default:
+			return false, fmt.Errorf("unknown RequestedAuthnContext Comparison %q", requested.Comparison)
+		}
+		if satisfied {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,113 @@
+package saml
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestIDPValidateAuthnContext(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	requestedAuthnContext := func(comparison string, classRefs ...string) string {
+		rv := "<RequestedAuthnContext xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" Comparison=\"" + comparison + "\">"
+		for _, classRef := range classRefs {
+			rv += "<AuthnContextClassRef xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\">" + classRef + "</AuthnContextClassRef>"
+		}
+		return rv + "</RequestedAuthnContext>"
+	}
+
+	for _, tc := range []struct {
+		name      string
+		requested string
+		classRef  string
+		satisfied bool
+	}{
+		{"none requested", "", "", true},
+		{"default class", requestedAuthnContext("exact", PasswordProtectedTransportAuthnContext), "", true},
+		{"exact", requestedAuthnContext("exact", REFEDSMFAAuthnContext), PasswordProtectedTransportAuthnContext, false},
+		{"exact of several", requestedAuthnContext("exact", SmartcardAuthnContext, REFEDSMFAAuthnContext), REFEDSMFAAuthnContext, true},
+		{"minimum", requestedAuthnContext("minimum", REFEDSMFAAuthnContext), SmartcardPKIAuthnContext, true},
+		{"minimum not met", requestedAuthnContext("minimum", REFEDSMFAAuthnContext), TLSClientAuthnContext, false},
+		{"better", requestedAuthnContext("better", REFEDSMFAAuthnContext), REFEDSMFAAuthnContext, false},
+		{"maximum", requestedAuthnContext("maximum", REFEDSMFAAuthnContext), PasswordProtectedTransportAuthnContext, true},
+		{"unranked", requestedAuthnContext("minimum", PasswordProtectedTransportAuthnContext), "urn:example:biometric", false},
+	} {
+		req := newNameIDTestRequest(t, test, tc.requested)
+		err := req.ValidateAuthnContext(&Session{ID: "f00df00df00d", AuthnContextClassRef: tc.classRef})
+		if tc.satisfied {
+			assert.Check(t, err, tc.name)
+		} else {
+			assert.Check(t, errors.Is(err, ErrInsufficientAuthnContext), tc.name)
+		}
+	}
+
+	// classes that the IDP ranks can satisfy a comparison
+	test.IDP.AuthnContextClassOrder = []string{PasswordProtectedTransportAuthnContext, "urn:example:biometric"}
+	req := newNameIDTestRequest(t, test, requestedAuthnContext("minimum", PasswordProtectedTransportAuthnContext))
+	assert.Check(t, req.ValidateAuthnContext(&Session{ID: "f00df00df00d", AuthnContextClassRef: "urn:example:biometric"}))
+}
+
+func TestIDPRespondsWithNoAuthnContext(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	test.SP.RequestedAuthnContext = &RequestedAuthnContext{
+		Comparison:            "minimum",
+		AuthnContextClassRefs: []string{REFEDSMFAAuthnContext},
+	}
+	session := &Session{ID: "f00df00df00d", UserName: "alice"}
+	test.IDP.SessionProvider = &mockSessionProvider{
+		GetSessionFunc: func(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest) *Session {
+			return session
+		},
+	}
+	serveSSO := func() *Response {
+		requestURL, err := test.SP.MakeRedirectAuthenticationRequest("ThisIsTheRelayState")
+		assert.Check(t, err)
+		r, _ := http.NewRequest("GET", requestURL.String(), nil)
+		w := httptest.NewRecorder()
+		test.IDP.ServeSSO(w, r)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+		rs := regexp.MustCompile(`name="SAMLResponse" value="(.*?)"`).FindStringSubmatch(w.Body.String())
+		assert.Assert(t, is.Len(rs, 2))
+		buf, err := base64.StdEncoding.DecodeString(html.UnescapeString(rs[1]))
+		assert.Check(t, err)
+		response := &Response{}
+		assert.Check(t, xml.Unmarshal(buf, response))
+		return response
+	}
+
+	// a password does not satisfy the request for multiple factors
+	response := serveSSO()
+	assert.Check(t, is.Equal(StatusRequester, response.Status.StatusCode.Value))
+	assert.Assert(t, response.Status.StatusCode.StatusCode != nil)
+	assert.Check(t, is.Equal(StatusNoAuthnContext, response.Status.StatusCode.StatusCode.Value))
+	assert.Check(t, is.Nil(response.Assertion))
+	assert.Check(t, is.Nil(response.EncryptedAssertion))
+
+	// the class that the user authenticated with is asserted
+	session.AuthnContextClassRef = REFEDSMFAAuthnContext
+	response = serveSSO()
+	assert.Check(t, is.Equal(StatusSuccess, response.Status.StatusCode.Value))
+}
+
+func TestIDPMakeAssertionWithAuthnContextClassRef(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	req := newNameIDTestRequest(t, test, "")
+	session := &Session{ID: "f00df00df00d", UserName: "alice"}
+	assert.Check(t, DefaultAssertionMaker{}.MakeAssertion(req, session))
+	assert.Check(t, is.Equal(PasswordProtectedTransportAuthnContext,
+		req.Assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef.Value))
+
+	session.AuthnContextClassRef = SmartcardPKIAuthnContext
+	assert.Check(t, DefaultAssertionMaker{}.MakeAssertion(req, session))
+	assert.Check(t, is.Equal(SmartcardPKIAuthnContext,
+		req.Assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef.Value))
+}
@@ -0,0 +1,168 @@
+// Package awskms implements a crypto.Signer backed by an asymmetric AWS KMS
+// key, so that the private key of a saml.ServiceProvider or
+// saml.IdentityProvider never has to leave KMS.
+//
+//	signer, err := awskms.New(ctx, kms.NewFromConfig(cfg), "alias/saml-signing")
+//	if err != nil {
+//		panic(err)
+//	}
+//	sp := saml.ServiceProvider{
+//		Key:             signer,
+//		Certificate:     cert, // the certificate issued for the KMS key
+//		SignatureMethod: signer.SignatureMethod(),
+//		// ...
+//	}
+package awskms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Client is the subset of the AWS KMS API used by Signer. It is
+// implemented by *kms.Client.
+type Client interface {
+	GetPublicKey(ctx context.Context, params *kms.GetPublicKeyInput, optFns ...func(*kms.Options)) (*kms.GetPublicKeyOutput, error)
+	Sign(ctx context.Context, params *kms.SignInput, optFns ...func(*kms.Options)) (*kms.SignOutput, error)
+}
+
+var _ Client = (*kms.Client)(nil)
+
+// Signer is a crypto.Signer that signs digests with an asymmetric KMS key.
+//
+// The public key is fetched once, by New, and cached for the lifetime of
+// the Signer.
+type Signer struct {
+	client            Client
+	keyID             string
+	publicKey         crypto.PublicKey
+	signingAlgorithms []types.SigningAlgorithmSpec
+
+	// Context, if not nil, is used for the calls to KMS made by Sign. The
+	// default is context.Background().
+	Context context.Context
+}
+
+// New returns a Signer for the KMS key identified by keyID, which may be a
+// key ID, key ARN, alias name or alias ARN. The key must have a key usage
+// of SIGN_VERIFY.
+func New(ctx context.Context, client Client, keyID string) (*Signer, error) {
+	out, err := client.GetPublicKey(ctx, &kms.GetPublicKeyInput{KeyId: &keyID})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get public key for %s: %v", keyID, err)
+	}
+	if out.KeyUsage != types.KeyUsageTypeSignVerify {
+		return nil, fmt.Errorf("key %s cannot be used for signing", keyID)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key for %s: %v", keyID, err)
+	}
+	switch publicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("key %s has unsupported type %T", keyID, publicKey)
+	}
+
+	return &Signer{
+		client:            client,
+		keyID:             keyID,
+		publicKey:         publicKey,
+		signingAlgorithms: out.SigningAlgorithms,
+	}, nil
+}
+
+// Public implements crypto.Signer.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign implements crypto.Signer. The digest is signed by KMS using the
+// signing algorithm that corresponds to the type of the key and
+// opts.HashFunc(). RSA-PSS is not supported.
+func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("awskms: RSA-PSS is not supported")
+	}
+	signingAlgorithm, err := s.signingAlgorithm(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	out, err := s.client.Sign(ctx, &kms.SignInput{
+		KeyId:            &s.keyID,
+		Message:          digest,
+		MessageType:      types.MessageTypeDigest,
+		SigningAlgorithm: signingAlgorithm,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("awskms: cannot sign with %s: %v", s.keyID, err)
+	}
+	return out.Signature, nil
+}
+
+// SignatureMethod returns the XML signature method URI to use with this
+// key: rsa-sha256 for RSA keys, and the ECDSA method matching the size of
+// the curve for EC keys.
+func (s *Signer) SignatureMethod() string {
+	if publicKey, ok := s.publicKey.(*ecdsa.PublicKey); ok {
+		switch publicKey.Curve {
+		case elliptic.P384():
+			return dsig.ECDSASHA384SignatureMethod
+		case elliptic.P521():
+			return dsig.ECDSASHA512SignatureMethod
+		default:
+			return dsig.ECDSASHA256SignatureMethod
+		}
+	}
+	return dsig.RSASHA256SignatureMethod
+}
+
+// signingAlgorithm returns the KMS signing algorithm for hash, or an error
+// if the key does not support one.
+func (s *Signer) signingAlgorithm(hash crypto.Hash) (types.SigningAlgorithmSpec, error) {
+	var signingAlgorithm types.SigningAlgorithmSpec
+	switch s.publicKey.(type) {
+	case *rsa.PublicKey:
+		signingAlgorithm = rsaSigningAlgorithms[hash]
+	case *ecdsa.PublicKey:
+		signingAlgorithm = ecdsaSigningAlgorithms[hash]
+	}
+	if signingAlgorithm == "" {
+		return "", fmt.Errorf("awskms: unsupported hash function %v", hash)
+	}
+
+	for _, supported := range s.signingAlgorithms {
+		if supported == signingAlgorithm {
+			return signingAlgorithm, nil
+		}
+	}
+	return "", fmt.Errorf("awskms: key %s does not support %s", s.keyID, signingAlgorithm)
+}
+
+var rsaSigningAlgorithms = map[crypto.Hash]types.SigningAlgorithmSpec{
+	crypto.SHA256: types.SigningAlgorithmSpecRsassaPkcs1V15Sha256,
+	crypto.SHA384: types.SigningAlgorithmSpecRsassaPkcs1V15Sha384,
+	crypto.SHA512: types.SigningAlgorithmSpecRsassaPkcs1V15Sha512,
+}
+
+var ecdsaSigningAlgorithms = map[crypto.Hash]types.SigningAlgorithmSpec{
+	crypto.SHA256: types.SigningAlgorithmSpecEcdsaSha256,
+	crypto.SHA384: types.SigningAlgorithmSpecEcdsaSha384,
+	crypto.SHA512: types.SigningAlgorithmSpecEcdsaSha512,
+}
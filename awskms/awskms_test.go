@@ -0,0 +1,138 @@
+package awskms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	dsig "github.com/russellhaering/goxmldsig"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeClient implements Client with an in-memory key.
+type fakeClient struct {
+	key               crypto.Signer
+	keyUsage          types.KeyUsageType
+	signingAlgorithms []types.SigningAlgorithmSpec
+	getPublicKeyCalls int
+	signInputs        []*kms.SignInput
+}
+
+func (c *fakeClient) GetPublicKey(ctx context.Context, params *kms.GetPublicKeyInput, optFns ...func(*kms.Options)) (*kms.GetPublicKeyOutput, error) {
+	c.getPublicKeyCalls++
+	if *params.KeyId != "alias/saml" {
+		return nil, errors.New("NotFoundException")
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(c.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GetPublicKeyOutput{
+		KeyId:             params.KeyId,
+		KeyUsage:          c.keyUsage,
+		PublicKey:         publicKey,
+		SigningAlgorithms: c.signingAlgorithms,
+	}, nil
+}
+
+func (c *fakeClient) Sign(ctx context.Context, params *kms.SignInput, optFns ...func(*kms.Options)) (*kms.SignOutput, error) {
+	c.signInputs = append(c.signInputs, params)
+	var hash crypto.Hash
+	switch params.SigningAlgorithm {
+	case types.SigningAlgorithmSpecRsassaPkcs1V15Sha256, types.SigningAlgorithmSpecEcdsaSha256:
+		hash = crypto.SHA256
+	case types.SigningAlgorithmSpecRsassaPkcs1V15Sha512, types.SigningAlgorithmSpecEcdsaSha512:
+		hash = crypto.SHA512
+	default:
+		return nil, errors.New("UnsupportedOperationException")
+	}
+	signature, err := c.key.Sign(rand.Reader, params.Message, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{KeyId: params.KeyId, Signature: signature, SigningAlgorithm: params.SigningAlgorithm}, nil
+}
+
+func TestCanSignWithRSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Assert(t, err)
+	client := &fakeClient{
+		key:      key,
+		keyUsage: types.KeyUsageTypeSignVerify,
+		signingAlgorithms: []types.SigningAlgorithmSpec{
+			types.SigningAlgorithmSpecRsassaPkcs1V15Sha256,
+			types.SigningAlgorithmSpecRsassaPkcs1V15Sha512,
+		},
+	}
+
+	signer, err := New(context.Background(), client, "alias/saml")
+	assert.Assert(t, err)
+	assert.Check(t, is.DeepEqual(&key.PublicKey, signer.Public()))
+	assert.Check(t, is.Equal(dsig.RSASHA256SignatureMethod, signer.SignatureMethod()))
+
+	digest := sha256.Sum256([]byte("hello"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Check(t, err)
+	assert.Check(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+	assert.Check(t, is.Equal(types.MessageTypeDigest, client.signInputs[0].MessageType))
+
+	digest512 := sha512.Sum512([]byte("hello"))
+	signature, err = signer.Sign(rand.Reader, digest512[:], crypto.SHA512)
+	assert.Check(t, err)
+	assert.Check(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA512, digest512[:], signature))
+
+	// the public key is only fetched once
+	assert.Check(t, is.Equal(1, client.getPublicKeyCalls))
+
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA1)
+	assert.Check(t, is.Error(err, "awskms: unsupported hash function SHA-1"))
+
+	_, err = signer.Sign(rand.Reader, digest[:], &rsa.PSSOptions{Hash: crypto.SHA256})
+	assert.Check(t, is.Error(err, "awskms: RSA-PSS is not supported"))
+}
+
+func TestCanSignWithECDSAKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Assert(t, err)
+	client := &fakeClient{
+		key:               key,
+		keyUsage:          types.KeyUsageTypeSignVerify,
+		signingAlgorithms: []types.SigningAlgorithmSpec{types.SigningAlgorithmSpecEcdsaSha256},
+	}
+
+	signer, err := New(context.Background(), client, "alias/saml")
+	assert.Assert(t, err)
+	assert.Check(t, is.Equal(dsig.ECDSASHA256SignatureMethod, signer.SignatureMethod()))
+
+	digest := sha256.Sum256([]byte("hello"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Check(t, err)
+	assert.Check(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature))
+
+	// the key does not allow ECDSA_SHA_512
+	digest512 := sha512.Sum512([]byte("hello"))
+	_, err = signer.Sign(rand.Reader, digest512[:], crypto.SHA512)
+	assert.Check(t, is.Error(err, "awskms: key alias/saml does not support ECDSA_SHA_512"))
+}
+
+func TestNewRejectsInvalidKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Assert(t, err)
+
+	_, err = New(context.Background(), &fakeClient{key: key, keyUsage: types.KeyUsageTypeSignVerify}, "alias/missing")
+	assert.Check(t, is.Error(err, "cannot get public key for alias/missing: NotFoundException"))
+
+	_, err = New(context.Background(), &fakeClient{key: key, keyUsage: types.KeyUsageTypeEncryptDecrypt}, "alias/saml")
+	assert.Check(t, is.Error(err, "key alias/saml cannot be used for signing"))
+}
@@ -0,0 +1,10 @@
+module github.com/crewjam/saml/awskms
+
+go 1.16
+
+require (
+	github.com/aws/aws-sdk-go-v2/service/kms v1.17.5
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/russellhaering/goxmldsig v1.3.0
+	gotest.tools v2.2.0+incompatible
+)
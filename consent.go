@@ -0,0 +1,233 @@
+package saml
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Consent is the decision of a user about the release of their attributes
+// to a service provider.
+type Consent struct {
+	// Subject is the NameID of the Session of the user.
+	Subject string
+
+	// ServiceProviderID is the entity ID of the service provider.
+	ServiceProviderID string
+
+	// Attributes are the names of the attributes that the user was asked
+	// to release. The user is asked again if the service provider is to
+	// receive any other attribute.
+	Attributes []string
+
+	// Granted is true if the user agreed to release the attributes.
+	Granted bool
+
+	// ExpireTime, if not zero, is the time after which the user is asked
+	// again.
+	ExpireTime time.Time
+}
+
+// covers returns true if the decision applies to the release of the
+// attributes named names, and has not expired.
+func (c *Consent) covers(names []string, now time.Time) bool {
+	if !c.ExpireTime.IsZero() && now.After(c.ExpireTime) {
+		return false
+	}
+	decided := map[string]bool{}
+	for _, name := range c.Attributes {
+		decided[name] = true
+	}
+	for _, name := range names {
+		if !decided[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// ConsentPrompter is an interface used by IdentityProvider to ask users
+// whether they consent to the release of their attributes to a service
+// provider, after they have been authenticated and their attributes have
+// been resolved.
+type ConsentPrompter interface {
+	// PromptConsent returns the decision of the user of session about the
+	// release of attributes to the service provider of req.
+	//
+	// If (and only if) the user has not decided yet, PromptConsent must
+	// complete the HTTP request and return nil, typically by showing a page
+	// that lists the service provider and the attributes, and that posts
+	// the decision back to the SSOURL of the IDP along with the
+	// SAMLRequest and RelayState. The IDP fills in the Subject,
+	// ServiceProviderID and Attributes of the decision.
+	PromptConsent(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest, session *Session, attributes []Attribute) *Consent
+}
+
+// ConsentStore is an interface used by IdentityProvider to remember the
+// decisions of users about the release of their attributes, so that they
+// are not asked again each time they log in. See MemoryConsentStore.
+type ConsentStore interface {
+	// GetConsent returns the latest decision of the user subject about the
+	// release of attributes to the service provider serviceProviderID. If
+	// there is none, the returned error must be os.ErrNotExist.
+	GetConsent(subject string, serviceProviderID string) (*Consent, error)
+
+	// PutConsent stores consent, replacing any previous decision of the
+	// same user about the same service provider.
+	PutConsent(consent *Consent) error
+}
+
+// MemoryConsentStore is an implementation of ConsentStore that resides
+// completely in memory.
+type MemoryConsentStore struct {
+	mu       sync.Mutex
+	consents map[memoryConsentKey]Consent
+}
+
+type memoryConsentKey struct {
+	Subject           string
+	ServiceProviderID string
+}
+
+// GetConsent implements ConsentStore.
+func (s *MemoryConsentStore) GetConsent(subject string, serviceProviderID string) (*Consent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	consent, ok := s.consents[memoryConsentKey{Subject: subject, ServiceProviderID: serviceProviderID}]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &consent, nil
+}
+
+// PutConsent implements ConsentStore.
+func (s *MemoryConsentStore) PutConsent(consent *Consent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.consents == nil {
+		s.consents = map[memoryConsentKey]Consent{}
+	}
+	s.consents[memoryConsentKey{Subject: consent.Subject, ServiceProviderID: consent.ServiceProviderID}] = *consent
+	return nil
+}
+
+// errConsentNotGranted is returned when attributes would be released without
+// the consent of the user.
+var errConsentNotGranted = errors.New("the user has not consented to the release of the attributes")
+
+// requestDeniedStatus is the status of the response to a request whose user
+// declined to release their attributes to the service provider.
+var requestDeniedStatus = Status{
+	StatusCode: StatusCode{
+		Value:      StatusResponder,
+		StatusCode: &StatusCode{Value: StatusRequestDenied},
+	},
+}
+
+// getConsent returns the decision of the user of session about the release
+// of the attributes that the service provider of req is to receive. The
+// decision is taken from the ConsentStore of the IDP, if it covers those
+// attributes, or else asked for with its ConsentPrompter and stored. If
+// there is no ConsentPrompter, or no attributes to release, consent is
+// granted. If the ConsentPrompter completed the HTTP request, the returned
+// decision is nil.
+func (req *IdpAuthnRequest) getConsent(w http.ResponseWriter, session *Session) (*Consent, error) {
+	if req.IDP.ConsentPrompter == nil {
+		return &Consent{Granted: true}, nil
+	}
+
+	attributes, err := req.attributes(session)
+	if err != nil {
+		return nil, err
+	}
+	if policy := req.IDP.AttributeReleasePolicy; policy != nil {
+		attributes, _ = policy.Filter(req.ServiceProviderMetadata, attributes)
+	}
+	if len(attributes) == 0 {
+		return &Consent{Granted: true}, nil
+	}
+	names := attributeNames(attributes)
+
+	serviceProviderID := req.ServiceProviderMetadata.EntityID
+	if req.IDP.ConsentStore != nil {
+		consent, err := req.IDP.ConsentStore.GetConsent(session.NameID, serviceProviderID)
+		if err == nil && consent.covers(names, req.IDP.now()) {
+			return consent, nil
+		} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	consent := req.IDP.ConsentPrompter.PromptConsent(w, req.HTTPRequest, req, session, attributes)
+	if consent == nil {
+		return nil, nil
+	}
+	consent.Subject = session.NameID
+	consent.ServiceProviderID = serviceProviderID
+	consent.Attributes = names
+	if req.IDP.ConsentStore != nil {
+		if err := req.IDP.ConsentStore.PutConsent(consent); err != nil {
+			return nil, err
+		}
+	}
+	return consent, nil
+}
+
+// checkStoredConsent returns nil if the ConsentStore of the IDP holds a
+// decision of the user of session that grants the release of attributes to
+// the service provider serviceProviderID, or if the IDP does not ask for
+// consent at all. Otherwise it returns errConsentNotGranted. It is used when
+// the user cannot be asked, i.e. to answer an AttributeQuery.
+func (idp *IdentityProvider) checkStoredConsent(serviceProviderID string, session *Session, attributes []Attribute) error {
+	if idp.ConsentPrompter == nil || len(attributes) == 0 {
+		return nil
+	}
+	if idp.ConsentStore == nil {
+		return errConsentNotGranted
+	}
+	consent, err := idp.ConsentStore.GetConsent(session.NameID, serviceProviderID)
+	if errors.Is(err, os.ErrNotExist) {
+		return errConsentNotGranted
+	} else if err != nil {
+		return err
+	}
+	if !consent.Granted || !consent.covers(attributeNames(attributes), idp.now()) {
+		return errConsentNotGranted
+	}
+	return nil
+}
+
+// attributeNames returns the sorted names of attributes.
+func attributeNames(attributes []Attribute) []string {
+	names := make([]string, 0, len(attributes))
+	for _, attribute := range attributes {
+		names = append(names, attribute.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// obtainConsent returns true if the user of session consents to the release
+// of their attributes to the service provider of req. Otherwise it
+// completes the HTTP request, with a response with the RequestDenied status
+// if the user declined, and returns false.
+func (idp *IdentityProvider) obtainConsent(w http.ResponseWriter, req *IdpAuthnRequest, session *Session) bool {
+	consent, err := req.getConsent(w, session)
+	if err != nil {
+		idp.Logger.Printf("failed to get consent: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if consent == nil {
+		return false
+	}
+	if !consent.Granted {
+		idp.Logger.Printf("user declined to release attributes to %s", consent.ServiceProviderID)
+		req.writeStatusResponse(w, requestDeniedStatus)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package saml
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	dsig "github.com/russellhaering/goxmldsig"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type mockConsentPrompter struct {
+	PromptConsentFunc func(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest, session *Session, attributes []Attribute) *Consent
+}
+
+func (mcp *mockConsentPrompter) PromptConsent(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest, session *Session, attributes []Attribute) *Consent {
+	return mcp.PromptConsentFunc(w, r, req, session, attributes)
+}
+
+func TestIDPAsksForConsent(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	test.IDP.SessionProvider = &mockSessionProvider{
+		GetSessionFunc: func(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest) *Session {
+			return &Session{ID: "f00df00df00d", NameID: "alice", UserEmail: "alice@example.com"}
+		},
+	}
+	attributes := []Attribute{{
+		Name:   "urn:oid:0.9.2342.19200300.100.1.3",
+		Values: []AttributeValue{{Type: "xs:string", Value: "alice@example.com"}},
+	}}
+	test.IDP.AttributeResolver = AttributeResolverFunc(func(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error) {
+		return attributes, nil
+	})
+	store := &MemoryConsentStore{}
+	test.IDP.ConsentStore = store
+
+	prompts := 0
+	var decision *Consent
+	test.IDP.ConsentPrompter = &mockConsentPrompter{
+		PromptConsentFunc: func(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest, session *Session, attributes []Attribute) *Consent {
+			prompts++
+			assert.Check(t, is.Equal("https://sp.example.com/saml2/metadata", req.ServiceProviderMetadata.EntityID))
+			assert.Check(t, is.Equal("urn:oid:0.9.2342.19200300.100.1.3", attributes[0].Name))
+			if decision == nil {
+				_, _ = w.Write([]byte("consent form"))
+				return nil
+			}
+			rv := *decision
+			return &rv
+		},
+	}
+
+	serveSSO := func() *httptest.ResponseRecorder {
+		requestURL, err := test.SP.MakeRedirectAuthenticationRequest("ThisIsTheRelayState")
+		assert.Check(t, err)
+		r, _ := http.NewRequest("GET", requestURL.String(), nil)
+		w := httptest.NewRecorder()
+		test.IDP.ServeSSO(w, r)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+		return w
+	}
+	parseResponse := func(w *httptest.ResponseRecorder) *Response {
+		rs := regexp.MustCompile(`name="SAMLResponse" value="(.*?)"`).FindStringSubmatch(w.Body.String())
+		assert.Assert(t, is.Len(rs, 2))
+		buf, err := base64.StdEncoding.DecodeString(html.UnescapeString(rs[1]))
+		assert.Check(t, err)
+		response := &Response{}
+		assert.Check(t, xml.Unmarshal(buf, response))
+		return response
+	}
+
+	// the user is shown the consent form
+	assert.Check(t, is.Equal("consent form", serveSSO().Body.String()))
+	assert.Check(t, is.Equal(1, prompts))
+
+	// and agrees to release the attributes
+	decision = &Consent{Granted: true}
+	response := parseResponse(serveSSO())
+	assert.Check(t, is.Equal(StatusSuccess, response.Status.StatusCode.Value))
+	assert.Check(t, is.Equal(2, prompts))
+	consent, err := store.GetConsent("alice", "https://sp.example.com/saml2/metadata")
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(&Consent{
+		Subject:           "alice",
+		ServiceProviderID: "https://sp.example.com/saml2/metadata",
+		Attributes:        []string{"urn:oid:0.9.2342.19200300.100.1.3"},
+		Granted:           true,
+	}, consent))
+
+	// the decision is remembered
+	response = parseResponse(serveSSO())
+	assert.Check(t, is.Equal(StatusSuccess, response.Status.StatusCode.Value))
+	assert.Check(t, is.Equal(2, prompts))
+
+	// the user is asked again when another attribute is to be released,
+	// and declines
+	attributes = append(attributes, Attribute{
+		Name:   "urn:oid:2.5.4.42",
+		Values: []AttributeValue{{Type: "xs:string", Value: "Alice"}},
+	})
+	decision = &Consent{Granted: false, ExpireTime: TimeNow().Add(time.Hour)}
+	response = parseResponse(serveSSO())
+	assert.Check(t, is.Equal(StatusResponder, response.Status.StatusCode.Value))
+	assert.Assert(t, response.Status.StatusCode.StatusCode != nil)
+	assert.Check(t, is.Equal(StatusRequestDenied, response.Status.StatusCode.StatusCode.Value))
+	assert.Check(t, is.Nil(response.Assertion))
+	assert.Check(t, is.Equal(3, prompts))
+
+	response = parseResponse(serveSSO())
+	assert.Check(t, is.Equal(StatusResponder, response.Status.StatusCode.Value))
+	assert.Check(t, is.Equal(3, prompts))
+
+	// or once the decision has expired
+	consent, err = store.GetConsent("alice", "https://sp.example.com/saml2/metadata")
+	assert.Check(t, err)
+	consent.ExpireTime = TimeNow().Add(-time.Minute)
+	assert.Check(t, store.PutConsent(consent))
+	decision = &Consent{Granted: true}
+	response = parseResponse(serveSSO())
+	assert.Check(t, is.Equal(StatusSuccess, response.Status.StatusCode.Value))
+	assert.Check(t, is.Equal(4, prompts))
+}
+
+func TestIDPDoesNotAskForConsentWithoutAttributes(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	test.IDP.AttributeResolver = AttributeResolverFunc(func(ctx context.Context, session *Session, sp *EntityDescriptor) ([]Attribute, error) {
+		return nil, nil
+	})
+	test.IDP.ConsentPrompter = &mockConsentPrompter{
+		PromptConsentFunc: func(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest, session *Session, attributes []Attribute) *Consent {
+			t.Error("the user must not be asked for consent")
+			return nil
+		},
+	}
+	req := newNameIDTestRequest(t, test, "")
+	consent, err := req.getConsent(httptest.NewRecorder(), &Session{ID: "f00df00df00d", NameID: "alice"})
+	assert.Check(t, err)
+	assert.Check(t, consent.Granted)
+}
+
+func TestIDPAttributeQueryHonorsConsent(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	test.IDP.SessionProvider = &mockAttributeQuerySessionProvider{
+		GetSubjectSessionFunc: func(r *http.Request, serviceProviderID string, nameID *NameID) (*Session, error) {
+			return &Session{ID: "f00df00df00d", NameID: "ba5eba11", UserName: "alice", UserEmail: "alice@example.com"}, nil
+		},
+	}
+	test.IDP.ConsentPrompter = &mockConsentPrompter{
+		PromptConsentFunc: func(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest, session *Session, attributes []Attribute) *Consent {
+			t.Error("the user cannot be asked for consent")
+			return nil
+		},
+	}
+	store := &MemoryConsentStore{}
+	test.IDP.ConsentStore = store
+	server := httptest.NewServer(http.HandlerFunc(test.IDP.ServeAttributeQuery))
+	defer server.Close()
+	test.IDP.AttributeQueryURL = mustParseURL(server.URL + "/saml/attributes")
+	test.SP.IDPMetadata = test.IDP.Metadata()
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	nameID := &NameID{Format: string(TransientNameIDFormat), Value: "ba5eba11"}
+	query := []Attribute{NewQueryAttribute("urn:oid:0.9.2342.19200300.100.1.1", "")}
+
+	// users who never decided are not queried
+	_, err := test.SP.QueryAttributes(nameID, query)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, StatusResponder))
+
+	// nor are users who declined
+	assert.Check(t, store.PutConsent(&Consent{
+		Subject:           "ba5eba11",
+		ServiceProviderID: "https://sp.example.com/saml2/metadata",
+		Attributes:        []string{"urn:oid:0.9.2342.19200300.100.1.1"},
+		Granted:           false,
+	}))
+	_, err = test.SP.QueryAttributes(nameID, query)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, StatusResponder))
+
+	// but users who agreed are
+	assert.Check(t, store.PutConsent(&Consent{
+		Subject:           "ba5eba11",
+		ServiceProviderID: "https://sp.example.com/saml2/metadata",
+		Attributes:        []string{"urn:oid:0.9.2342.19200300.100.1.1"},
+		Granted:           true,
+	}))
+	assertion, err := test.SP.QueryAttributes(nameID, query)
+	assert.Assert(t, err)
+	assert.Assert(t, is.Len(assertion.AttributeStatements, 1))
+	assert.Check(t, is.Equal("alice", assertion.AttributeStatements[0].Attributes[0].Values[0].Value))
+
+	// only for the attributes they agreed to release
+	_, err = test.SP.QueryAttributes(nameID, nil)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, StatusResponder))
+}
@@ -0,0 +1,204 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+)
+
+// ECPProfile is the URN of the SAML Enhanced Client or Proxy (ECP) profile.
+// It is also the namespace of the ECP SOAP header blocks.
+const ECPProfile = "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"
+
+// PAOSNamespace is the namespace of the PAOS SOAP header blocks.
+const PAOSNamespace = "urn:liberty:paos:2003-08"
+
+// PAOSContentType is the media type of messages sent using the PAOS binding.
+const PAOSContentType = "application/vnd.paos+xml"
+
+// soapActorNext is the SOAP actor that every ECP header block is addressed to.
+const soapActorNext = "http://schemas.xmlsoap.org/soap/actor/next"
+
+// IsECPRequest returns true if r was sent by an ECP client, that is, a client
+// that accepts PAOS responses and advertises support for the ECP profile in
+// its PAOS header.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf §4.2.3.1
+func IsECPRequest(r *http.Request) bool {
+	if !strings.Contains(strings.Join(r.Header.Values("Accept"), ","), PAOSContentType) {
+		return false
+	}
+	paos := r.Header.Get("PAOS")
+	return strings.Contains(paos, PAOSNamespace) && strings.Contains(paos, ECPProfile)
+}
+
+// PAOSRequest returns a SOAP envelope suitable for using the PAOS binding with
+// the request. The envelope carries the paos:Request, ecp:Request and, if
+// relayState is not empty, ecp:RelayState header blocks that the ECP client
+// needs to forward the request to the IDP and the response back to us.
+func (req *AuthnRequest) PAOSRequest(relayState string) *etree.Element {
+	header := etree.NewElement("soapenv:Header")
+
+	paosRequest := header.CreateElement("paos:Request")
+	paosRequest.CreateAttr("xmlns:paos", PAOSNamespace)
+	paosRequest.CreateAttr("soapenv:mustUnderstand", "1")
+	paosRequest.CreateAttr("soapenv:actor", soapActorNext)
+	paosRequest.CreateAttr("responseConsumerURL", req.AssertionConsumerServiceURL)
+	paosRequest.CreateAttr("service", ECPProfile)
+
+	ecpRequest := header.CreateElement("ecp:Request")
+	ecpRequest.CreateAttr("xmlns:ecp", ECPProfile)
+	ecpRequest.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	ecpRequest.CreateAttr("soapenv:mustUnderstand", "1")
+	ecpRequest.CreateAttr("soapenv:actor", soapActorNext)
+	if req.ProviderName != "" {
+		ecpRequest.CreateAttr("ProviderName", req.ProviderName)
+	}
+	if req.IsPassive != nil && *req.IsPassive {
+		ecpRequest.CreateAttr("IsPassive", "1")
+	} else {
+		ecpRequest.CreateAttr("IsPassive", "0")
+	}
+	if req.Issuer != nil {
+		ecpRequest.AddChild(req.Issuer.Element())
+	}
+
+	if relayState != "" {
+		ecpRelayState := header.CreateElement("ecp:RelayState")
+		ecpRelayState.CreateAttr("xmlns:ecp", ECPProfile)
+		ecpRelayState.CreateAttr("soapenv:mustUnderstand", "1")
+		ecpRelayState.CreateAttr("soapenv:actor", soapActorNext)
+		ecpRelayState.SetText(relayState)
+	}
+
+	envelope := soapEnvelope(req.Element())
+	envelope.InsertChildAt(0, header)
+	return envelope
+}
+
+// ecpResponseEnvelope returns the SOAP envelope that carries responseEl from
+// the IDP to the ECP client. The ecp:Response header block tells the client
+// where to deliver the response.
+func ecpResponseEnvelope(responseEl *etree.Element, acsURL string) *etree.Element {
+	header := etree.NewElement("soapenv:Header")
+	ecpResponse := header.CreateElement("ecp:Response")
+	ecpResponse.CreateAttr("xmlns:ecp", ECPProfile)
+	ecpResponse.CreateAttr("soapenv:mustUnderstand", "1")
+	ecpResponse.CreateAttr("soapenv:actor", soapActorNext)
+	ecpResponse.CreateAttr("AssertionConsumerServiceURL", acsURL)
+
+	envelope := soapEnvelope(responseEl)
+	envelope.InsertChildAt(0, header)
+	return envelope
+}
+
+// detachedElementBytes serializes el as a standalone document. The namespace
+// declarations that el inherits from its ancestors, such as a SOAP envelope,
+// are copied onto the serialized element.
+func detachedElementBytes(el *etree.Element) ([]byte, error) {
+	detachedEl := el.Copy()
+	for parent := el.Parent(); parent != nil; parent = parent.Parent() {
+		for _, attr := range parent.Attr {
+			if attr.Space != "xmlns" && !(attr.Space == "" && attr.Key == "xmlns") {
+				continue
+			}
+			if detachedEl.SelectAttr(attr.FullKey()) == nil {
+				detachedEl.CreateAttr(attr.FullKey(), attr.Value)
+			}
+		}
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(detachedEl)
+	return doc.WriteToBytes()
+}
+
+// ParseECPResponse validates the SOAP envelope that an ECP client sent to the
+// assertion consumer service using the PAOS binding. It returns the verified
+// assertion and the relay state that the client returned in the ecp:RelayState
+// header block.
+//
+// If the function fails it will return an InvalidResponseError whose
+// properties are useful in describing which part of the parsing process
+// failed. However, to discourage inadvertent disclosure the diagnostic
+// information, the Error() method returns a static string.
+func (sp *ServiceProvider) ParseECPResponse(req *http.Request, possibleRequestIDs []string) (*Assertion, string, error) {
+	start := time.Now()
+	ctx, span := startSpan(withPresentingRequest(req.Context(), req), sp.Tracer, "saml.ServiceProvider.ParseECPResponse")
+	span.SetAttribute(AttributeBinding, PAOSBinding)
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		err = &InvalidResponseError{
+			Now:        sp.now(),
+			PrivateErr: fmt.Errorf("cannot read response: %s", err),
+		}
+		sp.responseProcessed(start, span, nil, nil, err)
+		return nil, "", err
+	}
+
+	assertion, relayState, err := sp.parseECPResponse(ctx, buf, possibleRequestIDs)
+	sp.responseProcessed(start, span, buf, assertion, err)
+	return assertion, relayState, err
+}
+
+func (sp *ServiceProvider) parseECPResponse(ctx context.Context, buf []byte, possibleRequestIDs []string) (*Assertion, string, error) {
+	now := sp.now()
+	retErr := &InvalidResponseError{
+		Now:      now,
+		Response: string(buf),
+	}
+
+	// ensure that the response XML is well formed before we parse it
+	if err := xrv.Validate(bytes.NewReader(buf)); err != nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "invalid xml: %s", err)
+		return nil, "", retErr
+	}
+	if err := sp.checkStructure(buf); err != nil {
+		retErr.PrivateErr = err
+		return nil, "", retErr
+	}
+
+	envelope := &struct {
+		XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+		Header  struct {
+			RelayState string `xml:"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp RelayState"`
+		} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Header"`
+		Body struct {
+			Response Response
+		} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	}{}
+	if err := xml.Unmarshal(buf, &envelope); err != nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "cannot unmarshal response: %s", err)
+		return nil, "", retErr
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		retErr.PrivateErr = err
+		return nil, "", retErr
+	}
+	responseEl := doc.FindElement("Envelope/Body/Response")
+	if responseEl == nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "missing Response")
+		return nil, "", retErr
+	}
+
+	assertion, updatedResponse, err := sp.validateXMLResponse(ctx, &envelope.Body.Response, responseEl, possibleRequestIDs, now, true)
+	if err != nil {
+		retErr.PrivateErr = err
+		if updatedResponse != nil {
+			retErr.Response = *updatedResponse
+		}
+		return nil, "", retErr
+	}
+
+	return assertion, envelope.Header.RelayState, nil
+}
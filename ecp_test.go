@@ -0,0 +1,41 @@
+package saml
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestIsECPRequest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://sp.example.com/", nil)
+	assert.Check(t, !IsECPRequest(req))
+
+	req.Header.Set("Accept", "text/html; application/vnd.paos+xml")
+	assert.Check(t, !IsECPRequest(req))
+
+	req.Header.Set("PAOS", `ver="urn:liberty:paos:2003-08";"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"`)
+	assert.Check(t, IsECPRequest(req))
+
+	req.Header.Del("Accept")
+	assert.Check(t, !IsECPRequest(req))
+}
+
+func TestSPRejectsECPResponseWithoutResponse(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+	}
+
+	req, _ := http.NewRequest("POST", "https://15661444.ngrok.io/saml2/acs", strings.NewReader(``+
+		`<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/"><S:Body/></S:Envelope>`))
+	req.Header.Set("Content-Type", PAOSContentType)
+	_, _, err := s.ParseECPResponse(req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "missing Response"))
+}
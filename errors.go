@@ -0,0 +1,106 @@
+package saml
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The following errors tell why a response or assertion was rejected by
+// ServiceProvider. The errors returned by ParseResponse and the other
+// methods that validate responses match them with errors.Is, while keeping
+// a detailed message, so that applications can branch on the class of a
+// failure without parsing messages. An *InvalidResponseError unwraps to the
+// error it carries. A response with a status other than success results in
+// an ErrBadStatus, which can be found with errors.As.
+var (
+	ErrMalformedResponse        = errors.New("saml: malformed response")
+	ErrWrongDestination         = errors.New("saml: wrong destination")
+	ErrStaleInResponseTo        = errors.New("saml: response is not to an outstanding request")
+	ErrUnsolicitedResponse      = errors.New("saml: unsolicited response")
+	ErrExpiredResponse          = errors.New("saml: response has expired")
+	ErrWrongIssuer              = errors.New("saml: wrong issuer")
+	ErrMissingSignature         = errors.New("saml: missing signature")
+	ErrSignatureInvalid         = errors.New("saml: invalid signature")
+	ErrDecryptionFailed         = errors.New("saml: cannot decrypt assertion")
+	ErrMissingAssertion         = errors.New("saml: missing assertion")
+	ErrExpiredAssertion         = errors.New("saml: assertion has expired")
+	ErrAssertionNotYetValid     = errors.New("saml: assertion is not yet valid")
+	ErrWrongAudience            = errors.New("saml: wrong audience")
+	ErrInsufficientAuthnContext = errors.New("saml: authentication context does not satisfy the request")
+	ErrUnauthorizedScope        = errors.New("saml: attribute scope is not authorized")
+	ErrReplayedAssertion        = errors.New("saml: assertion has already been used")
+	ErrHolderOfKeyMismatch      = errors.New("saml: presenter does not hold the key of the assertion")
+	ErrWrongAddress             = errors.New("saml: presenter does not have the address of the assertion")
+	ErrUnsupportedCondition     = errors.New("saml: assertion has a condition that cannot be enforced")
+)
+
+// kindError is an error with the message of err that matches kind, one of
+// the errors above, with errors.Is.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e kindError) Unwrap() error {
+	return e.err
+}
+
+func (e kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// errorOfKind returns an error formatted like fmt.Errorf that matches kind
+// with errors.Is.
+func errorOfKind(kind error, format string, args ...interface{}) error {
+	return kindError{kind: kind, err: fmt.Errorf(format, args...)}
+}
+
+// errorCodes are the codes returned by ErrorCode for the errors above.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrMalformedResponse, "malformed_response"},
+	{ErrWrongDestination, "wrong_destination"},
+	{ErrStaleInResponseTo, "stale_in_response_to"},
+	{ErrUnsolicitedResponse, "unsolicited_response"},
+	{ErrExpiredResponse, "expired_response"},
+	{ErrWrongIssuer, "wrong_issuer"},
+	{ErrMissingSignature, "missing_signature"},
+	{ErrSignatureInvalid, "signature_invalid"},
+	{ErrDecryptionFailed, "decryption_failed"},
+	{ErrMissingAssertion, "missing_assertion"},
+	{ErrExpiredAssertion, "expired_assertion"},
+	{ErrAssertionNotYetValid, "assertion_not_yet_valid"},
+	{ErrWrongAudience, "wrong_audience"},
+	{ErrInsufficientAuthnContext, "insufficient_authn_context"},
+	{ErrUnauthorizedScope, "unauthorized_scope"},
+	{ErrReplayedAssertion, "replayed_assertion"},
+	{ErrHolderOfKeyMismatch, "holder_of_key_mismatch"},
+	{ErrWrongAddress, "wrong_address"},
+	{ErrUnsupportedCondition, "unsupported_condition"},
+}
+
+// ErrorCode returns a short, stable code for the class of err, suitable for
+// logs and metrics, e.g. "expired_response" for an error that matches
+// ErrExpiredResponse. It returns "bad_status" for an ErrBadStatus, "other"
+// for an error of no known class, and "" if err is nil.
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	var badStatus ErrBadStatus
+	if errors.As(err, &badStatus) {
+		return "bad_status"
+	}
+	return "other"
+}
@@ -0,0 +1,223 @@
+package saml
+
+import (
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// EventSink receives events from a ServiceProvider as they happen, for audit
+// logging and security monitoring. The methods are called synchronously, so
+// they should not block, and concurrently, so they must be safe for
+// concurrent use.
+type EventSink interface {
+	// OnRequestIssued is called when the SP issues an authentication,
+	// logout or query request.
+	OnRequestIssued(event RequestEvent)
+
+	// OnResponseAccepted is called when an authentication response is
+	// accepted, and OnResponseRejected when it is rejected.
+	OnResponseAccepted(event ResponseEvent)
+	OnResponseRejected(event ResponseEvent)
+
+	// OnLogout is called when the SP receives a LogoutRequest or a
+	// LogoutResponse from the IDP.
+	OnLogout(event LogoutEvent)
+
+	// OnAttributeQuery is called when the response to an AttributeQuery is
+	// processed.
+	OnAttributeQuery(event AttributeQueryEvent)
+}
+
+// RequestEvent describes a request issued by a ServiceProvider.
+type RequestEvent struct {
+	// Type is the name of the request element, e.g. "AuthnRequest",
+	// "LogoutRequest" or "AttributeQuery".
+	Type        string
+	SPEntityID  string
+	RequestID   string
+	Destination string
+	Time        time.Time
+}
+
+// ResponseEvent describes an authentication response received by a
+// ServiceProvider. The fields that describe the response and its assertion
+// are empty if they could not be determined, e.g. because the response is
+// malformed.
+type ResponseEvent struct {
+	SPEntityID   string
+	IDPEntityID  string
+	ResponseID   string
+	InResponseTo string
+	AssertionID  string
+	NameID       string
+	Time         time.Time
+
+	// Duration is how long it took to process the response.
+	Duration time.Duration
+
+	// Err is the reason why the response was rejected, and ErrorCode its
+	// class as returned by ErrorCode.
+	Err       error
+	ErrorCode string
+}
+
+// LogoutEvent describes a logout message received by a ServiceProvider.
+type LogoutEvent struct {
+	// Type is "LogoutRequest" or "LogoutResponse".
+	Type         string
+	SPEntityID   string
+	IDPEntityID  string
+	ID           string
+	NameID       string
+	SessionIndex string
+	Time         time.Time
+
+	// Err is the reason why the message was rejected, and ErrorCode its
+	// class as returned by ErrorCode.
+	Err       error
+	ErrorCode string
+}
+
+// AttributeQueryEvent describes the outcome of an AttributeQuery made by a
+// ServiceProvider.
+type AttributeQueryEvent struct {
+	SPEntityID  string
+	IDPEntityID string
+	QueryID     string
+	NameID      string
+	Time        time.Time
+
+	// Duration is how long it took to process the response.
+	Duration time.Duration
+
+	// Err is the reason why the query failed, and ErrorCode its class as
+	// returned by ErrorCode.
+	Err       error
+	ErrorCode string
+}
+
+func (sp *ServiceProvider) requestIssued(requestType string, requestID string, destination string) {
+	if sp.EventSink == nil {
+		return
+	}
+	sp.EventSink.OnRequestIssued(RequestEvent{
+		Type:        requestType,
+		SPEntityID:  firstSet(sp.EntityID, sp.MetadataURL.String()),
+		RequestID:   requestID,
+		Destination: destination,
+		Time:        sp.now(),
+	})
+}
+
+// responseProcessed reports the outcome of processing responseXML, which
+// began at start, to sp.EventSink, and annotates and ends span.
+func (sp *ServiceProvider) responseProcessed(start time.Time, span Span, responseXML []byte, assertion *Assertion, err error) {
+	if sp.EventSink == nil && sp.Tracer == nil {
+		return
+	}
+	event := ResponseEvent{
+		SPEntityID: firstSet(sp.EntityID, sp.MetadataURL.String()),
+		Time:       sp.now(),
+		Duration:   time.Since(start),
+		Err:        err,
+		ErrorCode:  ErrorCode(err),
+	}
+
+	// the response may be wrapped in a SOAP envelope or an ArtifactResponse
+	doc := etree.NewDocument()
+	if responseXML != nil && doc.ReadFromBytes(responseXML) == nil {
+		if responseEl := doc.FindElement("//Response"); responseEl != nil {
+			event.ResponseID = responseEl.SelectAttrValue("ID", "")
+			event.InResponseTo = responseEl.SelectAttrValue("InResponseTo", "")
+			if issuerEl := responseEl.SelectElement("Issuer"); issuerEl != nil {
+				event.IDPEntityID = issuerEl.Text()
+			}
+		}
+	}
+	if assertion != nil {
+		event.AssertionID = assertion.ID
+		if assertion.Issuer.Value != "" {
+			event.IDPEntityID = assertion.Issuer.Value
+		}
+		if assertion.Subject != nil && assertion.Subject.NameID != nil {
+			event.NameID = assertion.Subject.NameID.Value
+		}
+	}
+
+	span.SetAttribute(AttributeIDPEntityID, event.IDPEntityID)
+	span.SetAttribute(AttributeMessageID, event.ResponseID)
+	span.End(err)
+
+	if sp.EventSink == nil {
+		return
+	}
+	if err != nil {
+		sp.EventSink.OnResponseRejected(event)
+		return
+	}
+	sp.EventSink.OnResponseAccepted(event)
+}
+
+// logoutRequestReceived reports the outcome of validating a LogoutRequest to
+// sp.EventSink. req is nil if it could not be parsed.
+func (sp *ServiceProvider) logoutRequestReceived(req *LogoutRequest, err error) {
+	if sp.EventSink == nil {
+		return
+	}
+	event := LogoutEvent{
+		Type:        "LogoutRequest",
+		SPEntityID:  firstSet(sp.EntityID, sp.MetadataURL.String()),
+		IDPEntityID: sp.idpMetadata().EntityID,
+		Time:        sp.now(),
+		Err:         err,
+		ErrorCode:   ErrorCode(err),
+	}
+	if req != nil {
+		event.ID = req.ID
+		if req.NameID != nil {
+			event.NameID = req.NameID.Value
+		}
+		if len(req.SessionIndexes) > 0 {
+			event.SessionIndex = req.SessionIndexes[0].Value
+		}
+	}
+	sp.EventSink.OnLogout(event)
+}
+
+// logoutResponseReceived reports the outcome of validating a LogoutResponse
+// to sp.EventSink.
+func (sp *ServiceProvider) logoutResponseReceived(err error) {
+	if sp.EventSink == nil {
+		return
+	}
+	sp.EventSink.OnLogout(LogoutEvent{
+		Type:        "LogoutResponse",
+		SPEntityID:  firstSet(sp.EntityID, sp.MetadataURL.String()),
+		IDPEntityID: sp.idpMetadata().EntityID,
+		Time:        sp.now(),
+		Err:         err,
+		ErrorCode:   ErrorCode(err),
+	})
+}
+
+// attributeQueryProcessed reports the outcome of processing the response to
+// query, which began at start, to sp.EventSink.
+func (sp *ServiceProvider) attributeQueryProcessed(start time.Time, query *AttributeQuery, err error) {
+	if sp.EventSink == nil {
+		return
+	}
+	event := AttributeQueryEvent{
+		SPEntityID:  firstSet(sp.EntityID, sp.MetadataURL.String()),
+		IDPEntityID: sp.idpMetadata().EntityID,
+		QueryID:     query.ID,
+		Time:        sp.now(),
+		Duration:    time.Since(start),
+		Err:         err,
+		ErrorCode:   ErrorCode(err),
+	}
+	if query.Subject != nil && query.Subject.NameID != nil {
+		event.NameID = query.Subject.NameID.Value
+	}
+	sp.EventSink.OnAttributeQuery(event)
+}
@@ -0,0 +1,100 @@
+package saml
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type recordingEventSink struct {
+	requests  []RequestEvent
+	accepted  []ResponseEvent
+	rejected  []ResponseEvent
+	logouts   []LogoutEvent
+	attrQuery []AttributeQueryEvent
+}
+
+func (s *recordingEventSink) OnRequestIssued(event RequestEvent) {
+	s.requests = append(s.requests, event)
+}
+
+func (s *recordingEventSink) OnResponseAccepted(event ResponseEvent) {
+	s.accepted = append(s.accepted, event)
+}
+
+func (s *recordingEventSink) OnResponseRejected(event ResponseEvent) {
+	s.rejected = append(s.rejected, event)
+}
+
+func (s *recordingEventSink) OnLogout(event LogoutEvent) {
+	s.logouts = append(s.logouts, event)
+}
+
+func (s *recordingEventSink) OnAttributeQuery(event AttributeQueryEvent) {
+	s.attrQuery = append(s.attrQuery, event)
+}
+
+func TestSPReportsEvents(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	sink := &recordingEventSink{}
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+		EventSink:   sink,
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	authnRequest, err := s.MakeAuthenticationRequest(s.GetSSOBindingLocation(HTTPRedirectBinding), HTTPRedirectBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	assert.Assert(t, is.Len(sink.requests, 1))
+	assert.Check(t, is.Equal("AuthnRequest", sink.requests[0].Type))
+	assert.Check(t, is.Equal(authnRequest.ID, sink.requests[0].RequestID))
+	assert.Check(t, is.Equal("https://15661444.ngrok.io/saml2/metadata", sink.requests[0].SPEntityID))
+	assert.Check(t, is.Equal("https://idp.testshib.org/idp/profile/SAML2/Redirect/SSO", sink.requests[0].Destination))
+
+	req := http.Request{PostForm: url.Values{}}
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+	assert.Assert(t, is.Len(sink.accepted, 1))
+	assert.Check(t, is.Len(sink.rejected, 0))
+	assert.Check(t, is.Equal("_e9b3332eeaf348da6786aed16300aca9", sink.accepted[0].ResponseID))
+	assert.Check(t, is.Equal("id-9e61753d64e928af5a7a341a97f420c9", sink.accepted[0].InResponseTo))
+	assert.Check(t, is.Equal("_543eb64ea4ce19647a1f2aef5b91245d", sink.accepted[0].AssertionID))
+	assert.Check(t, is.Equal("https://idp.testshib.org/idp/shibboleth", sink.accepted[0].IDPEntityID))
+	assert.Check(t, is.Equal(TimeNow(), sink.accepted[0].Time))
+	assert.Check(t, is.Equal("", sink.accepted[0].ErrorCode))
+
+	_, err = s.ParseResponse(&req, []string{"wrong"})
+	assert.Check(t, err != nil)
+	assert.Assert(t, is.Len(sink.rejected, 1))
+	assert.Check(t, is.Equal("_e9b3332eeaf348da6786aed16300aca9", sink.rejected[0].ResponseID))
+	assert.Check(t, is.Equal("", sink.rejected[0].AssertionID))
+	assert.Check(t, is.Equal(err, sink.rejected[0].Err))
+	assert.Check(t, is.Equal("stale_in_response_to", sink.rejected[0].ErrorCode))
+
+	req.PostForm.Set("SAMLResponse", "!")
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err != nil)
+	assert.Assert(t, is.Len(sink.rejected, 2))
+	assert.Check(t, is.Equal("malformed_response", sink.rejected[1].ErrorCode))
+}
+
+func TestErrorCode(t *testing.T) {
+	assert.Check(t, is.Equal("", ErrorCode(nil)))
+	assert.Check(t, is.Equal("wrong_audience", ErrorCode(&InvalidResponseError{
+		PrivateErr: errorOfKind(ErrWrongAudience, "assertion invalid: audience restriction not met"),
+	})))
+	assert.Check(t, is.Equal("bad_status", ErrorCode(newErrBadStatus(Status{StatusCode: StatusCode{Value: StatusRequester}}))))
+	assert.Check(t, is.Equal("other", ErrorCode(errors.New("something else"))))
+}
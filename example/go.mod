@@ -4,7 +4,7 @@ replace github.com/crewjam/saml => ../
 
 replace github.com/crewjam/saml/samlidp => ../samlidp
 
-go 1.16
+go 1.26
 
 require (
 	github.com/crewjam/saml v0.0.0-00010101000000-000000000000
@@ -15,3 +15,15 @@ require (
 )
 
 require github.com/crewjam/saml/samlidp v0.0.0-00010101000000-000000000000
+
+require (
+	github.com/beevik/etree v1.1.0 // indirect
+	github.com/crewjam/httperr v0.2.0 // indirect
+	github.com/golang-jwt/jwt/v4 v4.4.2 // indirect
+	github.com/jonboulle/clockwork v0.2.2 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/mattermost/xml-roundtrip-validator v0.1.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/rogpeppe/go-internal v1.8.0 // indirect
+	github.com/russellhaering/goxmldsig v1.3.0 // indirect
+)
@@ -0,0 +1,161 @@
+// Package gcpkms implements a crypto.Signer backed by an asymmetric Google
+// Cloud KMS key version, so that the private key of a saml.ServiceProvider
+// or saml.IdentityProvider never has to leave Cloud KMS.
+//
+//	client, err := kms.NewKeyManagementClient(ctx)
+//	if err != nil {
+//		panic(err)
+//	}
+//	signer, err := gcpkms.New(ctx, client, "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1")
+//	if err != nil {
+//		panic(err)
+//	}
+//	sp := saml.ServiceProvider{
+//		Key:             signer,
+//		Certificate:     cert, // the certificate issued for the key version
+//		SignatureMethod: signer.SignatureMethod(),
+//		// ...
+//	}
+package gcpkms
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/googleapis/gax-go/v2"
+	dsig "github.com/russellhaering/goxmldsig"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Client is the subset of the Cloud KMS API used by Signer. It is
+// implemented by *kms.KeyManagementClient.
+type Client interface {
+	GetPublicKey(ctx context.Context, req *kmspb.GetPublicKeyRequest, opts ...gax.CallOption) (*kmspb.PublicKey, error)
+	AsymmetricSign(ctx context.Context, req *kmspb.AsymmetricSignRequest, opts ...gax.CallOption) (*kmspb.AsymmetricSignResponse, error)
+}
+
+// algorithm describes how a Cloud KMS key version algorithm is used to
+// produce XML signatures.
+type algorithm struct {
+	Hash            crypto.Hash
+	SignatureMethod string
+}
+
+// algorithms maps the Cloud KMS signing algorithms that can produce XML
+// signatures to the digest they sign and the matching signature method.
+var algorithms = map[kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm]algorithm{
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256: {crypto.SHA256, dsig.RSASHA256SignatureMethod},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_3072_SHA256: {crypto.SHA256, dsig.RSASHA256SignatureMethod},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA256: {crypto.SHA256, dsig.RSASHA256SignatureMethod},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA512: {crypto.SHA512, dsig.RSASHA512SignatureMethod},
+	kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256:        {crypto.SHA256, dsig.ECDSASHA256SignatureMethod},
+	kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384:        {crypto.SHA384, dsig.ECDSASHA384SignatureMethod},
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Signer is a crypto.Signer that signs digests with an asymmetric Cloud KMS
+// key version.
+//
+// The public key is fetched once, by New, and cached for the lifetime of
+// the Signer.
+type Signer struct {
+	client    Client
+	name      string
+	publicKey crypto.PublicKey
+	algorithm algorithm
+
+	// Context, if not nil, is used for the calls to Cloud KMS made by Sign.
+	// The default is context.Background().
+	Context context.Context
+}
+
+// New returns a Signer for the key version name, which is the full
+// resource name of a CryptoKeyVersion. The key version must use one of the
+// RSA_SIGN_PKCS1 or EC_SIGN_P256/P384 algorithms.
+func New(ctx context.Context, client Client, name string) (*Signer, error) {
+	resp, err := client.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get public key for %s: %v", name, err)
+	}
+	if resp.PemCrc32C != nil && int64(crc32.Checksum([]byte(resp.Pem), crc32cTable)) != resp.PemCrc32C.Value {
+		return nil, fmt.Errorf("public key for %s was corrupted in transit", name)
+	}
+	alg, ok := algorithms[resp.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("key %s has unsupported algorithm %s", name, resp.Algorithm)
+	}
+
+	block, _ := pem.Decode([]byte(resp.Pem))
+	if block == nil {
+		return nil, fmt.Errorf("cannot decode public key for %s", name)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key for %s: %v", name, err)
+	}
+
+	return &Signer{
+		client:    client,
+		name:      name,
+		publicKey: publicKey,
+		algorithm: alg,
+	}, nil
+}
+
+// Public implements crypto.Signer.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign implements crypto.Signer. Cloud KMS key versions are bound to a
+// single algorithm, so opts.HashFunc() must be the digest of that
+// algorithm; use SignatureMethod to configure a matching signature method.
+func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != s.algorithm.Hash {
+		return nil, fmt.Errorf("gcpkms: key %s signs %v digests, not %v", s.name, s.algorithm.Hash, opts.HashFunc())
+	}
+
+	req := &kmspb.AsymmetricSignRequest{
+		Name:         s.name,
+		Digest:       &kmspb.Digest{},
+		DigestCrc32C: wrapperspb.Int64(int64(crc32.Checksum(digest, crc32cTable))),
+	}
+	switch s.algorithm.Hash {
+	case crypto.SHA256:
+		req.Digest.Digest = &kmspb.Digest_Sha256{Sha256: digest}
+	case crypto.SHA384:
+		req.Digest.Digest = &kmspb.Digest_Sha384{Sha384: digest}
+	case crypto.SHA512:
+		req.Digest.Digest = &kmspb.Digest_Sha512{Sha512: digest}
+	}
+
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	resp, err := s.client.AsymmetricSign(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("gcpkms: cannot sign with %s: %v", s.name, err)
+	}
+	if !resp.VerifiedDigestCrc32C {
+		return nil, errors.New("gcpkms: digest was corrupted in transit")
+	}
+	if resp.SignatureCrc32C != nil && int64(crc32.Checksum(resp.Signature, crc32cTable)) != resp.SignatureCrc32C.Value {
+		return nil, errors.New("gcpkms: signature was corrupted in transit")
+	}
+	return resp.Signature, nil
+}
+
+// SignatureMethod returns the XML signature method URI that matches the
+// algorithm of the key version.
+func (s *Signer) SignatureMethod() string {
+	return s.algorithm.SignatureMethod
+}
@@ -0,0 +1,138 @@
+package gcpkms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"hash/crc32"
+	"testing"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"github.com/googleapis/gax-go/v2"
+	dsig "github.com/russellhaering/goxmldsig"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+const keyVersionName = "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+
+var _ Client = (*kms.KeyManagementClient)(nil)
+
+// fakeClient implements Client with an in-memory key.
+type fakeClient struct {
+	key               crypto.Signer
+	algorithm         kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+	corruptSignature  bool
+	getPublicKeyCalls int
+}
+
+func (c *fakeClient) GetPublicKey(ctx context.Context, req *kmspb.GetPublicKeyRequest, opts ...gax.CallOption) (*kmspb.PublicKey, error) {
+	c.getPublicKeyCalls++
+	if req.Name != keyVersionName {
+		return nil, errors.New("NotFound")
+	}
+	der, err := x509.MarshalPKIXPublicKey(c.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	pemStr := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return &kmspb.PublicKey{
+		Pem:       pemStr,
+		Algorithm: c.algorithm,
+		PemCrc32C: wrapperspb.Int64(int64(crc32.Checksum([]byte(pemStr), crc32cTable))),
+	}, nil
+}
+
+func (c *fakeClient) AsymmetricSign(ctx context.Context, req *kmspb.AsymmetricSignRequest, opts ...gax.CallOption) (*kmspb.AsymmetricSignResponse, error) {
+	var digest []byte
+	var hash crypto.Hash
+	switch d := req.Digest.Digest.(type) {
+	case *kmspb.Digest_Sha256:
+		digest, hash = d.Sha256, crypto.SHA256
+	case *kmspb.Digest_Sha384:
+		digest, hash = d.Sha384, crypto.SHA384
+	case *kmspb.Digest_Sha512:
+		digest, hash = d.Sha512, crypto.SHA512
+	}
+	signature, err := c.key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, err
+	}
+	signatureCrc32C := int64(crc32.Checksum(signature, crc32cTable))
+	if c.corruptSignature {
+		signatureCrc32C++
+	}
+	return &kmspb.AsymmetricSignResponse{
+		Signature:            signature,
+		SignatureCrc32C:      wrapperspb.Int64(signatureCrc32C),
+		VerifiedDigestCrc32C: int64(crc32.Checksum(digest, crc32cTable)) == req.DigestCrc32C.Value,
+		Name:                 req.Name,
+	}, nil
+}
+
+func TestCanSignWithRSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Assert(t, err)
+	client := &fakeClient{key: key, algorithm: kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA512}
+
+	signer, err := New(context.Background(), client, keyVersionName)
+	assert.Assert(t, err)
+	assert.Check(t, is.DeepEqual(&key.PublicKey, signer.Public()))
+	assert.Check(t, is.Equal(dsig.RSASHA512SignatureMethod, signer.SignatureMethod()))
+
+	digest := sha512.Sum512([]byte("hello"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA512)
+	assert.Check(t, err)
+	assert.Check(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA512, digest[:], signature))
+
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA512)
+	assert.Check(t, err)
+
+	// the public key is only fetched once
+	assert.Check(t, is.Equal(1, client.getPublicKeyCalls))
+
+	// the key version is bound to SHA-512
+	digest256 := sha256.Sum256([]byte("hello"))
+	_, err = signer.Sign(rand.Reader, digest256[:], crypto.SHA256)
+	assert.Check(t, is.Error(err, "gcpkms: key "+keyVersionName+" signs SHA-512 digests, not SHA-256"))
+}
+
+func TestCanSignWithECDSAKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Assert(t, err)
+	client := &fakeClient{key: key, algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256}
+
+	signer, err := New(context.Background(), client, keyVersionName)
+	assert.Assert(t, err)
+	assert.Check(t, is.Equal(dsig.ECDSASHA256SignatureMethod, signer.SignatureMethod()))
+
+	digest := sha256.Sum256([]byte("hello"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Check(t, err)
+	assert.Check(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature))
+
+	client.corruptSignature = true
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Check(t, is.Error(err, "gcpkms: signature was corrupted in transit"))
+}
+
+func TestNewRejectsInvalidKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Assert(t, err)
+
+	_, err = New(context.Background(), &fakeClient{key: key, algorithm: kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256}, "missing")
+	assert.Check(t, is.Error(err, "cannot get public key for missing: NotFound"))
+
+	_, err = New(context.Background(), &fakeClient{key: key, algorithm: kmspb.CryptoKeyVersion_RSA_SIGN_PSS_2048_SHA256}, keyVersionName)
+	assert.Check(t, is.Error(err, "key "+keyVersionName+" has unsupported algorithm RSA_SIGN_PSS_2048_SHA256"))
+}
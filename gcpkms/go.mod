@@ -0,0 +1,13 @@
+module github.com/crewjam/saml/gcpkms
+
+go 1.16
+
+require (
+	cloud.google.com/go/kms v1.4.0
+	github.com/googleapis/gax-go/v2 v2.1.1
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/russellhaering/goxmldsig v1.3.0
+	google.golang.org/genproto v0.0.0-20220222213610-43724f9ea8cf
+	google.golang.org/protobuf v1.27.1
+	gotest.tools v2.2.0+incompatible
+)
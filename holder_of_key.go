@@ -0,0 +1,65 @@
+package saml
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"regexp"
+)
+
+// The methods of subject confirmation.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf §3
+const (
+	BearerConfirmationMethod      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	HolderOfKeyConfirmationMethod = "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key"
+)
+
+// holderOfKeyKeyInfo returns the KeyInfo that confirms the holder of cert.
+func holderOfKeyKeyInfo(cert *x509.Certificate) KeyInfo {
+	return KeyInfo{
+		X509Data: X509Data{
+			X509Certificates: []X509Certificate{
+				{Data: base64.StdEncoding.EncodeToString(cert.Raw)},
+			},
+		},
+	}
+}
+
+// validateHolderOfKey checks that the client that presented assertion holds
+// the key of each of its holder-of-key subject confirmations, i.e. that it
+// authenticated with one of their certificates as a TLS client. The client
+// certificate is taken from the request in ctx; see withPresentingRequest.
+func (sp *ServiceProvider) validateHolderOfKey(ctx context.Context, assertion *Assertion) error {
+	if assertion.Subject == nil {
+		return nil
+	}
+	for _, subjectConfirmation := range assertion.Subject.SubjectConfirmations {
+		if subjectConfirmation.Method != HolderOfKeyConfirmationMethod {
+			continue
+		}
+		cert := tlsClientCertificate(presentingRequest(ctx))
+		if cert == nil {
+			return errorOfKind(ErrHolderOfKeyMismatch, "holder-of-key assertion was not presented with a TLS client certificate")
+		}
+		if subjectConfirmation.SubjectConfirmationData == nil || !holdsKey(subjectConfirmation.SubjectConfirmationData.KeyInfos, cert) {
+			return errorOfKind(ErrHolderOfKeyMismatch, "TLS client certificate is not a key of the holder-of-key SubjectConfirmation")
+		}
+	}
+	return nil
+}
+
+// holdsKey reports whether cert is one of the certificates of keyInfos.
+func holdsKey(keyInfos []KeyInfo, cert *x509.Certificate) bool {
+	regex := regexp.MustCompile(`\s+`)
+	for _, keyInfo := range keyInfos {
+		for _, x509Cert := range keyInfo.X509Data.X509Certificates {
+			der, err := base64.StdEncoding.DecodeString(regex.ReplaceAllString(x509Cert.Data, ""))
+			if err == nil && bytes.Equal(der, cert.Raw) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package saml
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/beevik/etree"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestIDPCanMakeHolderOfKeyAssertions(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	test.IDP.HolderOfKeyConfirmation = true
+	req := IdpAuthnRequest{
+		Now: TimeNow(),
+		IDP: &test.IDP,
+		RequestBuffer: []byte("" +
+			"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+			"  AssertionConsumerServiceURL=\"https://sp.example.com/saml2/acs\" " +
+			"  Destination=\"https://idp.example.com/saml/sso\" " +
+			"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+			"  IssueInstant=\"2015-12-01T01:57:09Z\" ProtocolBinding=\"\" " +
+			"  Version=\"2.0\">" +
+			"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+			"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+			"</AuthnRequest>"),
+	}
+	req.HTTPRequest, _ = http.NewRequest("POST", "https://idp.example.com/saml/sso", nil)
+	assert.Check(t, req.Validate())
+
+	// without a client certificate, the subject is confirmed as a bearer
+	err := DefaultAssertionMaker{}.MakeAssertion(&req, &Session{ID: "f00df00df00d", UserName: "alice"})
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(BearerConfirmationMethod, req.Assertion.Subject.SubjectConfirmations[0].Method))
+
+	req.HTTPRequest.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.SPCertificate}}
+	err = DefaultAssertionMaker{}.MakeAssertion(&req, &Session{ID: "f00df00df00d", UserName: "alice"})
+	assert.Check(t, err)
+	subjectConfirmation := req.Assertion.Subject.SubjectConfirmations[0]
+	assert.Check(t, is.Equal(HolderOfKeyConfirmationMethod, subjectConfirmation.Method))
+	assert.Check(t, is.Equal("https://sp.example.com/saml2/acs", subjectConfirmation.SubjectConfirmationData.Recipient))
+	assert.Check(t, holdsKey(subjectConfirmation.SubjectConfirmationData.KeyInfos, test.SPCertificate))
+
+	// the key survives a round trip through XML
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Assertion.Element())
+	buf, err := doc.WriteToBytes()
+	assert.Assert(t, err)
+	var assertion Assertion
+	assert.Assert(t, xml.Unmarshal(buf, &assertion))
+	data := assertion.Subject.SubjectConfirmations[0].SubjectConfirmationData
+	assert.Check(t, holdsKey(data.KeyInfos, test.SPCertificate))
+	assert.Check(t, is.Equal(TimeNow().Add(MaxIssueDelay), data.NotOnOrAfter))
+}
+
+func TestSPValidatesHolderOfKey(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	s := test.SP
+	assertion := &Assertion{
+		Subject: &Subject{
+			SubjectConfirmations: []SubjectConfirmation{
+				{
+					Method: HolderOfKeyConfirmationMethod,
+					SubjectConfirmationData: &SubjectConfirmationData{
+						KeyInfos: []KeyInfo{holderOfKeyKeyInfo(test.SPCertificate)},
+					},
+				},
+			},
+		},
+	}
+	withCert := func(cert *x509.Certificate) context.Context {
+		r, _ := http.NewRequest("POST", "https://sp.example.com/saml2/acs", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		return withPresentingRequest(context.Background(), r)
+	}
+
+	assert.Check(t, s.validateHolderOfKey(withCert(test.SPCertificate), assertion))
+
+	err := s.validateHolderOfKey(withCert(&x509.Certificate{Raw: []byte("another certificate")}), assertion)
+	assert.Check(t, errors.Is(err, ErrHolderOfKeyMismatch))
+	assert.Check(t, is.Error(err, "TLS client certificate is not a key of the holder-of-key SubjectConfirmation"))
+
+	err = s.validateHolderOfKey(context.Background(), assertion)
+	assert.Check(t, is.Error(err, "holder-of-key assertion was not presented with a TLS client certificate"))
+	assert.Check(t, is.Equal("holder_of_key_mismatch", ErrorCode(err)))
+
+	// bearer assertions need no client certificate
+	assertion.Subject.SubjectConfirmations[0].Method = BearerConfirmationMethod
+	assert.Check(t, s.validateHolderOfKey(context.Background(), assertion))
+}
@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"compress/flate"
 	"crypto"
-	"crypto/tls"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -46,6 +47,20 @@ type Session struct {
 	UserScopedAffiliation string
 
 	CustomAttributes []Attribute
+
+	// AuthnContextClassRef is the authentication context class that the
+	// authentication of the user satisfied, i.e. REFEDSMFAAuthnContext if
+	// they authenticated with multiple factors. It is asserted to service
+	// providers and checked against their RequestedAuthnContext. The default
+	// is PasswordProtectedTransportAuthnContext.
+	AuthnContextClassRef string
+
+	// Delegates, if not empty, is the chain of delegates listed in a
+	// DelegationRestriction condition of the assertions issued for the
+	// session. An IDP that proxies an assertion it received re-issues the
+	// delegates of that assertion followed by the party that acted on
+	// behalf of the subject.
+	Delegates []Delegate
 }
 
 // SessionProvider is an interface used by IdentityProvider to determine the
@@ -69,6 +84,61 @@ type ServiceProviderProvider interface {
 	GetServiceProvider(r *http.Request, serviceProviderID string) (*EntityDescriptor, error)
 }
 
+// AssertionEncryptionProvider is an optional interface that a
+// ServiceProviderProvider may implement to choose, for each service
+// provider, whether and how the assertions issued to it are encrypted.
+type AssertionEncryptionProvider interface {
+	// GetAssertionEncryption returns the encryption settings for the service
+	// provider ID. A nil result selects the defaults.
+	GetAssertionEncryption(r *http.Request, serviceProviderID string) (*AssertionEncryption, error)
+}
+
+// AssertionEncryption describes how assertions are encrypted for a service
+// provider. Assertions are only encrypted if the service provider metadata
+// contains an encryption certificate. The content encryption key is always
+// transported using RSA-OAEP.
+type AssertionEncryption struct {
+	// Disabled, if true, causes assertions to be sent unencrypted even if the
+	// service provider metadata contains an encryption certificate.
+	Disabled bool
+
+	// BlockCipher encrypts the assertion. If nil, the first supported
+	// algorithm in the EncryptionMethods of the service provider's
+	// encryption KeyDescriptor is used, or AES-128-CBC if there is none.
+	BlockCipher xmlenc.BlockCipher
+
+	// DigestMethod is the digest used with RSA-OAEP. If nil, SHA-1 is used.
+	DigestMethod xmlenc.DigestMethod
+}
+
+// ResponseSigningProvider is an optional interface that a
+// ServiceProviderProvider may implement to choose which elements of the
+// responses sent to each service provider are signed.
+type ResponseSigningProvider interface {
+	// GetResponseSigning returns what is signed in the responses sent to
+	// the service provider ID.
+	GetResponseSigning(r *http.Request, serviceProviderID string) (ResponseSigning, error)
+}
+
+// ResponseSigning selects which elements of a response the IDP signs.
+type ResponseSigning int
+
+const (
+	// SignResponseDefault signs the Response, and the Assertion unless the
+	// service provider metadata declares WantAssertionsSigned="false".
+	SignResponseDefault ResponseSigning = iota
+
+	// SignAssertionOnly signs the Assertion but not the Response.
+	SignAssertionOnly
+
+	// SignResponseOnly signs the Response but not the Assertion, whatever
+	// the WantAssertionsSigned of the service provider metadata.
+	SignResponseOnly
+
+	// SignAssertionAndResponse signs both the Assertion and the Response.
+	SignAssertionAndResponse
+)
+
 // AssertionMaker is an interface used by IdentityProvider to construct the
 // assertion for a request. The default implementation is DefaultAssertionMaker,
 // which is used if not AssertionMaker is specified.
@@ -78,13 +148,70 @@ type AssertionMaker interface {
 	MakeAssertion(req *IdpAuthnRequest, session *Session) error
 }
 
+// ManageNameIDProvider is an interface used by IdentityProvider to update the
+// linkage between principals and the name identifiers of service providers
+// when it receives a ManageNameIDRequest.
+type ManageNameIDProvider interface {
+	// ManageNameID applies req, which was sent by the service provider
+	// serviceProviderID. Any encrypted identifiers in req have been
+	// decrypted into NameID and NewID. If req.Terminate is set, the service
+	// provider will no longer use NameID for the principal; otherwise it will
+	// use NewID from now on.
+	//
+	// If the principal is not known, the returned error must be os.ErrNotExist.
+	ManageNameID(r *http.Request, serviceProviderID string, req *ManageNameIDRequest) error
+}
+
+// LogoutSessionProvider is an interface that a SessionProvider may implement
+// so that IdentityProvider can end sessions when it processes a
+// LogoutRequest.
+type LogoutSessionProvider interface {
+	// DeleteSession ends the session with ID sessionID. The request may
+	// have been sent by the user agent or, using the SOAP binding, by a
+	// service provider.
+	DeleteSession(w http.ResponseWriter, r *http.Request, sessionID string) error
+}
+
+// ECPAuthenticator is an interface used by IdentityProvider to authenticate
+// the principal of requests received using the ECP profile. ECP clients
+// cannot be shown a login form, so the credentials must accompany the
+// request, typically using HTTP Basic authentication. See
+// BasicAuthECPAuthenticator.
+type ECPAuthenticator interface {
+	// AuthenticateECP returns the session of the principal that sent r. If
+	// the principal cannot be authenticated it must return nil, and the IDP
+	// responds with an HTTP Basic authentication challenge.
+	AuthenticateECP(r *http.Request, req *IdpAuthnRequest) *Session
+}
+
+// BasicAuthECPAuthenticator is an ECPAuthenticator that authenticates the
+// principal using the credentials of HTTP Basic authentication. It is
+// called with the username and password, and must return nil if they are
+// not valid.
+type BasicAuthECPAuthenticator func(r *http.Request, username, password string) *Session
+
+// AuthenticateECP implements ECPAuthenticator.
+func (f BasicAuthECPAuthenticator) AuthenticateECP(r *http.Request, req *IdpAuthnRequest) *Session {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+	return f(r, username, password)
+}
+
+// DefaultArtifactValidDuration is how long an artifact issued by the IDP can
+// be resolved by the service provider.
+const DefaultArtifactValidDuration = time.Minute
+
 // IdentityProvider implements the SAML Identity Provider role (IDP).
 //
 // An identity provider receives SAML assertion requests and responds
 // with SAML Assertions.
 //
 // You must provide a keypair that is used to
-// sign assertions.
+// sign assertions. The private key may be any crypto.Signer with an RSA
+// or ECDSA public key, so it can be held in an HSM or a cloud KMS; the
+// matching certificate is supplied separately in Certificate.
 //
 // You must provide an implementation of ServiceProviderProvider which
 // returns
@@ -92,6 +219,81 @@ type AssertionMaker interface {
 // You must provide an implementation of the SessionProvider which
 // handles the actual authentication (i.e. prompting for a username
 // and password).
+//
+// Signed requests from service providers must use one of the
+// AllowedSignatureMethods and AllowedDigestMethods, which default to
+// DefaultAllowedSignatureMethods and DefaultAllowedDigestMethods.
+//
+// If WantAuthnRequestsSigned is true, it is published in the metadata and
+// authentication requests must be signed by the service provider. They must
+// also be signed if the metadata of the service provider sets
+// AuthnRequestsSigned. Signatures that requests carry anyway are verified too.
+//
+// The metadata is valid for ValidDuration, which defaults to
+// DefaultValidDuration, and may be cached for CacheDuration, which defaults
+// to ValidDuration. OmitValidUntil leaves the validity out altogether.
+//
+// Organization and ContactPeople, if set, are published in the metadata.
+//
+// If StrictStructureCheck is true, the authentication requests, logout
+// requests and responses, ArtifactResolve requests and SOAP queries that
+// the IDP receives are rejected if they fail CheckStructure, which helps to
+// find the faults of broken service provider implementations.
+//
+// TimeSource, if not nil, is the source of the current time used to issue
+// messages and to check their validity, instead of TimeNow. RandReader, if
+// not nil, is the source of the random bytes of the IDs and artifacts it
+// issues, instead of the package-level RandReader.
+//
+// Tracer, if not nil, traces the handling of authentication requests and
+// artifact resolution.
+//
+// If HolderOfKeyConfirmation is true, the DefaultAssertionMaker confirms the
+// subject of the assertions it makes for users who authenticated with a TLS
+// client certificate with the holder-of-key method, naming the certificate
+// as the key, instead of the bearer method. The service provider must then
+// see the same client certificate when the assertion is presented to it.
+//
+// Responses are signed, and so are the assertions they carry unless the
+// service provider metadata declares WantAssertionsSigned="false". If the
+// ServiceProviderProvider is a ResponseSigningProvider, it chooses which of
+// them are signed for each service provider instead.
+//
+// AttributeResolver, if not nil, provides the attributes that the
+// DefaultAssertionMaker sends to service providers, instead of the
+// attributes of the Session. See ChainAttributeResolvers and
+// ServiceProviderAttributeResolvers. AttributeReleasePolicy, if not nil,
+// decides which of the attributes each service provider receives.
+//
+// NameIDGenerator, if not nil, makes the NameIDs of the subjects of
+// assertions, i.e. pairwise persistent identifiers. See
+// DefaultNameIDGenerator. Otherwise the NameID of the Session is sent as a
+// transient identifier.
+//
+// The authentication context class of each Session must satisfy the
+// RequestedAuthnContext of the request, if any, or the service provider is
+// sent a response with the NoAuthnContext status. AuthnContextClassOrder
+// ranks the classes for the "minimum", "better" and "maximum" comparisons;
+// it defaults to DefaultAuthnContextClassOrder.
+//
+// SessionStore, if not nil, records each session that an assertion is
+// issued in, with the service providers that participate in it, so that
+// they can be logged out when it ends. It must be shared by all the
+// processes of the IDP. SingleLogoutStore keeps the progress of the logouts
+// that are propagated to them using front-channel bindings. Earlier versions
+// recorded the participants in the SingleLogoutStore; an IDP that only
+// configures a SingleLogoutStore must now configure a SessionStore as well,
+// i.e. a MemorySessionStore, or logouts are not propagated and an error is
+// logged each time an assertion is issued.
+//
+// ConsentPrompter, if not nil, asks users whether they consent to the
+// release of their attributes to each service provider before an assertion
+// is made for it, and the service provider is sent a response with the
+// RequestDenied status if they decline. ConsentStore, if not nil, remembers
+// their decisions so that they are not asked again each time they log in.
+//
+// If AttributeQueryURL is set, the IDP is also an attribute authority that
+// answers AttributeQuery requests at that URL. See ServeAttributeQuery.
 type IdentityProvider struct {
 	Key                     crypto.PrivateKey
 	Logger                  logger.Interface
@@ -100,16 +302,49 @@ type IdentityProvider struct {
 	MetadataURL             url.URL
 	SSOURL                  url.URL
 	LogoutURL               url.URL
+	ManageNameIDURL         url.URL
+	ArtifactResolutionURL   url.URL
+	ECPURL                  url.URL
+	AttributeQueryURL       url.URL
 	ServiceProviderProvider ServiceProviderProvider
 	SessionProvider         SessionProvider
 	AssertionMaker          AssertionMaker
+	ManageNameIDProvider    ManageNameIDProvider
+	ArtifactStore           ArtifactStore
+	ECPAuthenticator        ECPAuthenticator
+	SingleLogoutStore       SingleLogoutStore
+	SessionStore            SessionStore
+	HTTPClient              *http.Client
 	SignatureMethod         string
+	AllowedSignatureMethods []string
+	AllowedDigestMethods    []string
 	ValidDuration           *time.Duration
+	CacheDuration           *time.Duration
+	OmitValidUntil          bool
+	ArtifactValidDuration   *time.Duration
+	Organization            *Organization
+	ContactPeople           []ContactPerson
+	StrictStructureCheck    bool
+	TimeSource              TimeSource
+	RandReader              io.Reader
+	Tracer                  Tracer
+	HolderOfKeyConfirmation bool
+	WantAuthnRequestsSigned bool
+	AttributeResolver       AttributeResolver
+	AttributeReleasePolicy  *AttributeReleasePolicy
+	NameIDGenerator         NameIDGenerator
+	AuthnContextClassOrder  []string
+	ConsentPrompter         ConsentPrompter
+	ConsentStore            ConsentStore
+
+	// PostForm, if not nil, writes the pages that send responses and
+	// logout messages to service providers with the HTTP-POST binding.
+	PostForm *PostForm
 }
 
 // Metadata returns the metadata structure for this identity provider.
 func (idp *IdentityProvider) Metadata() *EntityDescriptor {
-	certStr := base64.StdEncoding.EncodeToString(idp.Certificate.Raw)
+	chain := append([]*x509.Certificate{idp.Certificate}, idp.Intermediates...)
 
 	var validDuration time.Duration
 	if idp.ValidDuration != nil {
@@ -118,10 +353,17 @@ func (idp *IdentityProvider) Metadata() *EntityDescriptor {
 		validDuration = DefaultValidDuration
 	}
 
+	cacheDuration := validDuration
+	if idp.CacheDuration != nil {
+		cacheDuration = *idp.CacheDuration
+	}
+
 	ed := &EntityDescriptor{
 		EntityID:      idp.MetadataURL.String(),
-		ValidUntil:    TimeNow().Add(validDuration),
-		CacheDuration: validDuration,
+		CacheDuration: cacheDuration,
+		Extensions:    idp.signaturePolicy().metadataExtensions(),
+		Organization:  idp.Organization,
+		ContactPeople: idp.ContactPeople,
 		IDPSSODescriptors: []IDPSSODescriptor{
 			{
 				SSODescriptor: SSODescriptor{
@@ -129,24 +371,12 @@ func (idp *IdentityProvider) Metadata() *EntityDescriptor {
 						ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
 						KeyDescriptors: []KeyDescriptor{
 							{
-								Use: "signing",
-								KeyInfo: KeyInfo{
-									X509Data: X509Data{
-										X509Certificates: []X509Certificate{
-											{Data: certStr},
-										},
-									},
-								},
+								Use:     "signing",
+								KeyInfo: certificateKeyInfo(chain),
 							},
 							{
-								Use: "encryption",
-								KeyInfo: KeyInfo{
-									X509Data: X509Data{
-										X509Certificates: []X509Certificate{
-											{Data: certStr},
-										},
-									},
-								},
+								Use:     "encryption",
+								KeyInfo: certificateKeyInfo(chain),
 								EncryptionMethods: []EncryptionMethod{
 									{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
 									{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
@@ -156,7 +386,7 @@ func (idp *IdentityProvider) Metadata() *EntityDescriptor {
 							},
 						},
 					},
-					NameIDFormats: []NameIDFormat{NameIDFormat("urn:oasis:names:tc:SAML:2.0:nameid-format:transient")},
+					NameIDFormats: idp.nameIDFormats(),
 				},
 				SingleSignOnServices: []Endpoint{
 					{
@@ -171,6 +401,20 @@ func (idp *IdentityProvider) Metadata() *EntityDescriptor {
 			},
 		},
 	}
+	if !idp.OmitValidUntil {
+		ed.ValidUntil = idp.now().Add(validDuration)
+	}
+
+	// Messages can only be encrypted to an RSA key, so an EC certificate is
+	// published for signing only.
+	if _, ok := idp.Certificate.PublicKey.(*rsa.PublicKey); !ok {
+		ed.IDPSSODescriptors[0].KeyDescriptors = ed.IDPSSODescriptors[0].KeyDescriptors[:1]
+	}
+
+	if idp.WantAuthnRequestsSigned {
+		wantAuthnRequestsSigned := true
+		ed.IDPSSODescriptors[0].WantAuthnRequestsSigned = &wantAuthnRequestsSigned
+	}
 
 	if idp.LogoutURL.String() != "" {
 		ed.IDPSSODescriptors[0].SSODescriptor.SingleLogoutServices = []Endpoint{
@@ -178,18 +422,108 @@ func (idp *IdentityProvider) Metadata() *EntityDescriptor {
 				Binding:  HTTPRedirectBinding,
 				Location: idp.LogoutURL.String(),
 			},
+			{
+				Binding:  HTTPPostBinding,
+				Location: idp.LogoutURL.String(),
+			},
+			{
+				Binding:  SOAPBinding,
+				Location: idp.LogoutURL.String(),
+			},
+		}
+	}
+
+	if idp.ManageNameIDURL.String() != "" {
+		ed.IDPSSODescriptors[0].SSODescriptor.ManageNameIDServices = []Endpoint{
+			{
+				Binding:  SOAPBinding,
+				Location: idp.ManageNameIDURL.String(),
+			},
+			{
+				Binding:  HTTPRedirectBinding,
+				Location: idp.ManageNameIDURL.String(),
+			},
+		}
+	}
+
+	if idp.ECPURL.String() != "" {
+		ed.IDPSSODescriptors[0].SingleSignOnServices = append(ed.IDPSSODescriptors[0].SingleSignOnServices, Endpoint{
+			Binding:  SOAPBinding,
+			Location: idp.ECPURL.String(),
+		})
+	}
+
+	if idp.ArtifactResolutionURL.String() != "" {
+		ed.IDPSSODescriptors[0].SSODescriptor.ArtifactResolutionServices = []IndexedEndpoint{
+			{
+				Binding:  SOAPBinding,
+				Location: idp.ArtifactResolutionURL.String(),
+				Index:    0,
+			},
+		}
+	}
+
+	if idp.AttributeQueryURL.String() != "" {
+		ed.AttributeAuthorityDescriptors = []AttributeAuthorityDescriptor{
+			{
+				RoleDescriptor: RoleDescriptor{
+					ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+					KeyDescriptors: []KeyDescriptor{
+						{
+							Use:     "signing",
+							KeyInfo: certificateKeyInfo(chain),
+						},
+					},
+				},
+				AttributeServices: []Endpoint{
+					{
+						Binding:  SOAPBinding,
+						Location: idp.AttributeQueryURL.String(),
+					},
+				},
+				NameIDFormats: idp.nameIDFormats(),
+			},
 		}
 	}
 
 	return ed
 }
 
+// SignedMetadata returns the metadata structure for this identity provider
+// with an enveloped signature made with the key of the identity provider.
+func (idp *IdentityProvider) SignedMetadata() (*EntityDescriptor, error) {
+	signingContext, err := idp.signingContext()
+	if err != nil {
+		return nil, err
+	}
+	md := idp.Metadata()
+	if err := signMetadata(md, signingContext, idp.RandReader); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
 // Handler returns an http.Handler that serves the metadata and SSO
 // URLs
 func (idp *IdentityProvider) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc(idp.MetadataURL.Path, idp.ServeMetadata)
 	mux.HandleFunc(idp.SSOURL.Path, idp.ServeSSO)
+	if idp.LogoutURL.Path != "" {
+		mux.HandleFunc(idp.LogoutURL.Path, idp.ServeSLO)
+	}
+	if idp.ManageNameIDURL.Path != "" {
+		mux.HandleFunc(idp.ManageNameIDURL.Path, idp.ServeManageNameID)
+	}
+	if idp.ArtifactResolutionURL.Path != "" {
+		mux.HandleFunc(idp.ArtifactResolutionURL.Path, idp.ServeArtifactResolve)
+	}
+	if idp.ECPURL.Path != "" {
+		mux.HandleFunc(idp.ECPURL.Path, idp.ServeECP)
+	}
+	if idp.AttributeQueryURL.Path != "" {
+		mux.HandleFunc(idp.AttributeQueryURL.Path, idp.ServeAttributeQuery)
+	}
 	return mux
 }
 
@@ -213,11 +547,25 @@ func (idp *IdentityProvider) ServeMetadata(w http.ResponseWriter, r *http.Reques
 // endpoint.
 //
 // If the SAML request is invalid or cannot be verified a simple StatusBadRequest
-// response is sent.
+// response is sent. If its NameIDPolicy cannot be honored, the service
+// provider is sent a response with the InvalidNameIDPolicy status, and if
+// the authentication of the user does not satisfy its RequestedAuthnContext,
+// one with the NoAuthnContext status. If the user does not consent to the
+// release of their attributes, it is sent one with the RequestDenied
+// status.
 //
 // If the assertion cannot be created or returned, a StatusInternalServerError
 // response is sent.
 func (idp *IdentityProvider) ServeSSO(w http.ResponseWriter, r *http.Request) {
+	_, span := startSpan(r.Context(), idp.Tracer, "saml.IdentityProvider.ServeSSO")
+	var err error
+	defer func() { span.End(err) }()
+	if r.Method == "GET" {
+		span.SetAttribute(AttributeBinding, HTTPRedirectBinding)
+	} else {
+		span.SetAttribute(AttributeBinding, HTTPPostBinding)
+	}
+
 	req, err := NewIdpAuthnRequest(idp, r)
 	if err != nil {
 		idp.Logger.Printf("failed to parse request: %s", err)
@@ -225,7 +573,12 @@ func (idp *IdentityProvider) ServeSSO(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := req.Validate(); err != nil {
+	err = req.Validate()
+	if req.ServiceProviderMetadata != nil {
+		span.SetAttribute(AttributeSPEntityID, req.ServiceProviderMetadata.EntityID)
+	}
+	span.SetAttribute(AttributeMessageID, req.Request.ID)
+	if err != nil {
 		idp.Logger.Printf("failed to validate request: %s", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
@@ -234,16 +587,135 @@ func (idp *IdentityProvider) ServeSSO(w http.ResponseWriter, r *http.Request) {
 	// TODO(ross): we must check that the request ID has not been previously
 	//   issued.
 
+	if err = req.ValidateNameIDPolicy(); err != nil {
+		idp.Logger.Printf("cannot honor NameIDPolicy: %s", err)
+		req.writeStatusResponse(w, invalidNameIDPolicyStatus)
+		return
+	}
+
 	session := idp.SessionProvider.GetSession(w, r, req)
 	if session == nil {
 		return
 	}
+	if err = req.ValidateSubject(session); err != nil {
+		idp.Logger.Printf("failed to validate subject: %s", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if err = req.ValidateAuthnContext(session); errors.Is(err, ErrInsufficientAuthnContext) {
+		idp.Logger.Printf("cannot satisfy RequestedAuthnContext: %s", err)
+		req.writeStatusResponse(w, noAuthnContextStatus)
+		return
+	} else if err != nil {
+		idp.Logger.Printf("failed to validate authentication context: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !idp.obtainConsent(w, req, session) {
+		return
+	}
 
 	assertionMaker := idp.AssertionMaker
 	if assertionMaker == nil {
 		assertionMaker = DefaultAssertionMaker{}
 	}
-	if err := assertionMaker.MakeAssertion(req, session); err != nil {
+	if err = assertionMaker.MakeAssertion(req, session); errors.Is(err, ErrInvalidNameIDPolicy) {
+		idp.Logger.Printf("cannot honor NameIDPolicy: %s", err)
+		req.writeStatusResponse(w, invalidNameIDPolicyStatus)
+		return
+	} else if err != nil {
+		idp.Logger.Printf("failed to make assertion: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err = req.WriteResponse(w); err != nil {
+		idp.Logger.Printf("failed to write response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	idp.addSessionParticipant(req, session)
+}
+
+// ServeECP handles SAML auth requests sent by ECP clients using the SOAP
+// binding, as described by the ECP profile. The principal is authenticated
+// by the ECPAuthenticator. If the principal cannot be authenticated, a
+// StatusUnauthorized response with an HTTP Basic challenge is sent.
+//
+// The response is returned to the ECP client in a SOAP envelope whose
+// ecp:Response header block tells the client where to deliver it. The
+// service provider must have an assertion consumer service using the PAOS
+// binding.
+//
+// If the SAML request is invalid or cannot be verified a simple StatusBadRequest
+// response is sent. If its NameIDPolicy cannot be honored, the client is
+// sent a response with the InvalidNameIDPolicy status, and if the
+// authentication of the user does not satisfy its RequestedAuthnContext, one
+// with the NoAuthnContext status.
+func (idp *IdentityProvider) ServeECP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if idp.ECPAuthenticator == nil {
+		idp.Logger.Printf("cannot handle ECP request: no ECPAuthenticator is configured")
+		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+		return
+	}
+
+	req, err := NewIdpECPAuthnRequest(idp, r)
+	if err != nil {
+		idp.Logger.Printf("failed to parse request: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.Validate(); err != nil {
+		idp.Logger.Printf("failed to validate request: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := req.getECPACSEndpoint(); err != nil {
+		idp.Logger.Printf("cannot find PAOS assertion consumer service: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.ValidateNameIDPolicy(); err != nil {
+		idp.Logger.Printf("cannot honor NameIDPolicy: %s", err)
+		req.writeStatusResponse(w, invalidNameIDPolicyStatus)
+		return
+	}
+
+	session := idp.ECPAuthenticator.AuthenticateECP(r, req)
+	if session == nil {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", idp.MetadataURL.Host))
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err := req.ValidateSubject(session); err != nil {
+		idp.Logger.Printf("failed to validate subject: %s", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if err := req.ValidateAuthnContext(session); errors.Is(err, ErrInsufficientAuthnContext) {
+		idp.Logger.Printf("cannot satisfy RequestedAuthnContext: %s", err)
+		req.writeStatusResponse(w, noAuthnContextStatus)
+		return
+	} else if err != nil {
+		idp.Logger.Printf("failed to validate authentication context: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	assertionMaker := idp.AssertionMaker
+	if assertionMaker == nil {
+		assertionMaker = DefaultAssertionMaker{}
+	}
+	if err := assertionMaker.MakeAssertion(req, session); errors.Is(err, ErrInvalidNameIDPolicy) {
+		idp.Logger.Printf("cannot honor NameIDPolicy: %s", err)
+		req.writeStatusResponse(w, invalidNameIDPolicyStatus)
+		return
+	} else if err != nil {
 		idp.Logger.Printf("failed to make assertion: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
@@ -253,6 +725,7 @@ func (idp *IdentityProvider) ServeSSO(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	idp.addSessionParticipant(req, session)
 }
 
 // ServeIDPInitiated handes an IDP-initiated authorization request. Requests of this
@@ -263,7 +736,7 @@ func (idp *IdentityProvider) ServeIDPInitiated(w http.ResponseWriter, r *http.Re
 		IDP:         idp,
 		HTTPRequest: r,
 		RelayState:  relayState,
-		Now:         TimeNow(),
+		Now:         idp.now(),
 	}
 
 	session := idp.SessionProvider.GetSession(w, r, req)
@@ -311,6 +784,9 @@ func (idp *IdentityProvider) ServeIDPInitiated(w http.ResponseWriter, r *http.Re
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	if !idp.obtainConsent(w, req, session) {
+		return
+	}
 
 	assertionMaker := idp.AssertionMaker
 	if assertionMaker == nil {
@@ -327,6 +803,435 @@ func (idp *IdentityProvider) ServeIDPInitiated(w http.ResponseWriter, r *http.Re
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	idp.addSessionParticipant(req, session)
+}
+
+// ServeManageNameID handles ManageNameIDRequests sent by service providers
+// using either the SOAP or the HTTP-Redirect binding. Requests must be signed
+// by the service provider; with the HTTP-Redirect binding the signature may
+// be carried in the query. Valid requests are passed to the
+// ManageNameIDProvider and the outcome is returned to the service provider as
+// a signed ManageNameIDResponse using the same binding.
+//
+// If the request is invalid or cannot be verified a simple StatusBadRequest
+// response is sent.
+func (idp *IdentityProvider) ServeManageNameID(w http.ResponseWriter, r *http.Request) {
+	var binding, relayState string
+	var requestBuf []byte
+	switch r.Method {
+	case "GET":
+		binding = HTTPRedirectBinding
+		compressedRequest, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("SAMLRequest"))
+		if err != nil {
+			idp.Logger.Printf("cannot decode request: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		requestBuf, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressedRequest)))
+		if err != nil {
+			idp.Logger.Printf("cannot decompress request: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		relayState = r.URL.Query().Get("RelayState")
+	case "POST":
+		binding = SOAPBinding
+		var err error
+		requestBuf, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			idp.Logger.Printf("cannot read request: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, serviceProvider, err := idp.parseManageNameIDRequest(r, requestBuf, binding)
+	if err != nil {
+		idp.Logger.Printf("invalid ManageNameIDRequest: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	status := Status{StatusCode: StatusCode{Value: StatusSuccess}}
+	if idp.ManageNameIDProvider == nil {
+		status.StatusCode = StatusCode{Value: StatusResponder, StatusCode: &StatusCode{Value: StatusRequestUnsupported}}
+	} else if err := idp.ManageNameIDProvider.ManageNameID(r, req.Issuer.Value, req); err == os.ErrNotExist {
+		status.StatusCode = StatusCode{Value: StatusRequester, StatusCode: &StatusCode{Value: StatusUnknownPrincipal}}
+	} else if err != nil {
+		idp.Logger.Printf("failed to manage name id: %s", err)
+		status.StatusCode = StatusCode{Value: StatusResponder}
+	}
+
+	if binding == SOAPBinding {
+		resp, err := idp.makeManageNameIDResponse(req, "", status)
+		if err != nil {
+			idp.Logger.Printf("failed to make response: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		doc := etree.NewDocument()
+		doc.SetRoot(soapEnvelope(resp.Element()))
+		w.Header().Set("Content-Type", "text/xml")
+		if _, err := doc.WriteTo(w); err != nil {
+			idp.Logger.Printf("failed to write response: %s", err)
+		}
+		return
+	}
+
+	location := ""
+	for _, spssoDescriptor := range serviceProvider.SPSSODescriptors {
+		for _, endpoint := range spssoDescriptor.ManageNameIDServices {
+			if endpoint.Binding == HTTPRedirectBinding && location == "" {
+				location = firstSet(endpoint.ResponseLocation, endpoint.Location)
+			}
+		}
+	}
+	if location == "" {
+		idp.Logger.Printf("service provider %s has no ManageNameIDService with the HTTP-Redirect binding", req.Issuer.Value)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	resp, err := idp.makeManageNameIDResponse(req, location, status)
+	if err != nil {
+		idp.Logger.Printf("failed to make response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// the binding carries the signature in the query instead
+	resp.Signature = nil
+	redirectURL, err := idp.redirectURL(resp.Destination, "SAMLResponse", resp.Element(), relayState)
+	if err != nil {
+		idp.Logger.Printf("failed to make response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+}
+
+// parseManageNameIDRequest parses and validates the ManageNameIDRequest in
+// requestBuf, which was received using binding, and returns it along with the
+// metadata of the service provider that sent it. Encrypted identifiers are
+// decrypted into the NameID and NewID fields of the request.
+func (idp *IdentityProvider) parseManageNameIDRequest(r *http.Request, requestBuf []byte, binding string) (*ManageNameIDRequest, *EntityDescriptor, error) {
+	if err := xrv.Validate(bytes.NewReader(requestBuf)); err != nil {
+		return nil, nil, err
+	}
+	if err := idp.checkStructure(requestBuf); err != nil {
+		return nil, nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(requestBuf); err != nil {
+		return nil, nil, err
+	}
+	requestEl := doc.Root()
+	if binding == SOAPBinding {
+		requestEl = doc.FindElement("Envelope/Body/ManageNameIDRequest")
+	}
+	if requestEl == nil || requestEl.Tag != "ManageNameIDRequest" {
+		return nil, nil, fmt.Errorf("missing ManageNameIDRequest")
+	}
+
+	req := &ManageNameIDRequest{}
+	if err := unmarshalEtreeHack(requestEl.Copy(), req); err != nil {
+		return nil, nil, err
+	}
+	if req.Version != "2.0" {
+		return nil, nil, fmt.Errorf("expected SAML request version 2.0 got %v", req.Version)
+	}
+	if req.IssueInstant.Add(MaxIssueDelay).Before(idp.now()) {
+		return nil, nil, fmt.Errorf("request expired at %s", req.IssueInstant.Add(MaxIssueDelay))
+	}
+	if req.Destination != "" && req.Destination != idp.ManageNameIDURL.String() {
+		return nil, nil, fmt.Errorf("expected destination to be %q, not %q", idp.ManageNameIDURL.String(), req.Destination)
+	}
+	if req.Issuer == nil {
+		return nil, nil, fmt.Errorf("request has no Issuer")
+	}
+
+	serviceProvider, err := idp.ServiceProviderProvider.GetServiceProvider(r, req.Issuer.Value)
+	if err == os.ErrNotExist {
+		return nil, nil, fmt.Errorf("cannot handle request from unknown service provider %s", req.Issuer.Value)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("cannot find service provider %s: %v", req.Issuer.Value, err)
+	}
+	if err := idp.validateSPMessageSignature(r, requestEl, serviceProvider); err != nil {
+		return nil, nil, fmt.Errorf("cannot validate signature on ManageNameIDRequest: %v", err)
+	}
+
+	if req.EncryptedID != nil {
+		plaintext, err := decryptElement(idp.Key, requestEl.FindElement("./EncryptedID"))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.NameID = &NameID{}
+		if err := xml.Unmarshal(plaintext, req.NameID); err != nil {
+			return nil, nil, err
+		}
+	}
+	if req.NewEncryptedID != nil {
+		plaintext, err := decryptElement(idp.Key, requestEl.FindElement("./NewEncryptedID"))
+		if err != nil {
+			return nil, nil, err
+		}
+		newID := struct {
+			Value string `xml:",chardata"`
+		}{}
+		if err := xml.Unmarshal(plaintext, &newID); err != nil {
+			return nil, nil, err
+		}
+		req.NewID = newID.Value
+	}
+	if req.NameID == nil {
+		return nil, nil, fmt.Errorf("request has no NameID")
+	}
+	if req.NewID == "" && req.Terminate == nil {
+		return nil, nil, fmt.Errorf("request has neither NewID nor Terminate")
+	}
+	return req, serviceProvider, nil
+}
+
+// makeManageNameIDResponse returns a signed ManageNameIDResponse to req.
+func (idp *IdentityProvider) makeManageNameIDResponse(req *ManageNameIDRequest, destination string, status Status) (*ManageNameIDResponse, error) {
+	resp := &ManageNameIDResponse{
+		ID:           fmt.Sprintf("id-%x", idp.randomBytes(20)),
+		InResponseTo: req.ID,
+		Version:      "2.0",
+		IssueInstant: idp.now(),
+		Destination:  destination,
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL.String(),
+		},
+		Status: status,
+	}
+
+	signingContext, err := idp.signingContext()
+	if err != nil {
+		return nil, err
+	}
+	signedResponseEl, err := signingContext.SignEnveloped(resp.Element())
+	if err != nil {
+		return nil, err
+	}
+	sigEl := signedResponseEl.Child[len(signedResponseEl.Child)-1]
+	resp.Signature = sigEl.(*etree.Element)
+	return resp, nil
+}
+
+// Redirect returns a URL suitable for using the redirect binding with the response
+func (resp *ManageNameIDResponse) Redirect(relayState string) *url.URL {
+	w := &bytes.Buffer{}
+	w1 := base64.NewEncoder(base64.StdEncoding, w)
+	w2, _ := flate.NewWriter(w1, 9)
+	doc := etree.NewDocument()
+	doc.SetRoot(resp.Element())
+	if _, err := doc.WriteTo(w2); err != nil {
+		panic(err)
+	}
+	w2.Close()
+	w1.Close()
+
+	rv, _ := url.Parse(resp.Destination)
+
+	query := rv.Query()
+	query.Set("SAMLResponse", string(w.Bytes()))
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	rv.RawQuery = query.Encode()
+
+	return rv
+}
+
+// ServeArtifactResolve handles ArtifactResolve requests sent by service
+// providers using the SOAP binding. Requests must be signed by the service
+// provider. The message referenced by the artifact is removed from the
+// ArtifactStore and returned to the service provider in a signed
+// ArtifactResponse. If the artifact is unknown, has expired or was issued to
+// another service provider, the ArtifactResponse carries no message.
+//
+// If the request is invalid or cannot be verified a simple StatusBadRequest
+// response is sent.
+func (idp *IdentityProvider) ServeArtifactResolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	_, span := startSpan(r.Context(), idp.Tracer, "saml.IdentityProvider.ServeArtifactResolve")
+	var err error
+	defer func() { span.End(err) }()
+	span.SetAttribute(AttributeBinding, SOAPBinding)
+
+	requestBuf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		idp.Logger.Printf("cannot read request: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	req, err := idp.parseArtifactResolve(r, requestBuf)
+	if err != nil {
+		idp.Logger.Printf("invalid ArtifactResolve: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	span.SetAttribute(AttributeSPEntityID, req.Issuer.Value)
+	span.SetAttribute(AttributeMessageID, req.ID)
+
+	var messageEl *etree.Element
+	message, err := idp.artifactStore().TakeArtifact(req.Artifact)
+	switch {
+	case err == os.ErrNotExist:
+		idp.Logger.Printf("cannot resolve unknown artifact for %s", req.Issuer.Value)
+	case err != nil:
+		idp.Logger.Printf("cannot resolve artifact: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	case message.ServiceProviderID != req.Issuer.Value:
+		idp.Logger.Printf("service provider %s cannot resolve artifact issued to %s", req.Issuer.Value, message.ServiceProviderID)
+	default:
+		doc := etree.NewDocument()
+		if err = doc.ReadFromBytes(message.Message); err != nil {
+			idp.Logger.Printf("cannot parse artifact message: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		messageEl = doc.Root()
+	}
+
+	respEl, err := idp.makeArtifactResponse(req, messageEl)
+	if err != nil {
+		idp.Logger.Printf("failed to make response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(soapEnvelope(respEl))
+	w.Header().Set("Content-Type", "text/xml")
+	if _, err = doc.WriteTo(w); err != nil {
+		idp.Logger.Printf("failed to write response: %s", err)
+	}
+}
+
+// parseArtifactResolve parses and validates the SOAP encoded ArtifactResolve
+// request in requestBuf.
+func (idp *IdentityProvider) parseArtifactResolve(r *http.Request, requestBuf []byte) (*ArtifactResolve, error) {
+	if idp.ArtifactStore == nil {
+		return nil, fmt.Errorf("no ArtifactStore is configured")
+	}
+	if err := xrv.Validate(bytes.NewReader(requestBuf)); err != nil {
+		return nil, err
+	}
+	if err := idp.checkStructure(requestBuf); err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(requestBuf); err != nil {
+		return nil, err
+	}
+	requestEl := doc.FindElement("Envelope/Body/ArtifactResolve")
+	if requestEl == nil {
+		return nil, fmt.Errorf("missing ArtifactResolve")
+	}
+
+	req := &ArtifactResolve{}
+	if err := unmarshalEtreeHack(requestEl.Copy(), req); err != nil {
+		return nil, err
+	}
+	if req.Version != "2.0" {
+		return nil, fmt.Errorf("expected SAML request version 2.0 got %v", req.Version)
+	}
+	if req.IssueInstant.Add(MaxIssueDelay).Before(idp.now()) {
+		return nil, fmt.Errorf("request expired at %s", req.IssueInstant.Add(MaxIssueDelay))
+	}
+	if req.Issuer == nil {
+		return nil, fmt.Errorf("request has no Issuer")
+	}
+
+	serviceProvider, err := idp.ServiceProviderProvider.GetServiceProvider(r, req.Issuer.Value)
+	if err == os.ErrNotExist {
+		return nil, fmt.Errorf("cannot handle request from unknown service provider %s", req.Issuer.Value)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot find service provider %s: %v", req.Issuer.Value, err)
+	}
+	if err := idp.validateSPSignature(requestEl, serviceProvider); err != nil {
+		return nil, fmt.Errorf("cannot validate signature on ArtifactResolve: %v", err)
+	}
+	return req, nil
+}
+
+// makeArtifactResponse returns a signed ArtifactResponse to req that carries
+// messageEl, or no message if messageEl is nil.
+func (idp *IdentityProvider) makeArtifactResponse(req *ArtifactResolve, messageEl *etree.Element) (*etree.Element, error) {
+	resp := &ArtifactResponse{
+		ID:           fmt.Sprintf("id-%x", idp.randomBytes(20)),
+		InResponseTo: req.ID,
+		Version:      "2.0",
+		IssueInstant: idp.now(),
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL.String(),
+		},
+		Status: Status{
+			StatusCode: StatusCode{
+				Value: StatusSuccess,
+			},
+		},
+	}
+
+	respEl := resp.Element()
+	if messageEl != nil {
+		respEl.AddChild(messageEl)
+	}
+
+	signingContext, err := idp.signingContext()
+	if err != nil {
+		return nil, err
+	}
+	signedRespEl, err := signingContext.SignEnveloped(respEl)
+	if err != nil {
+		return nil, err
+	}
+	resp.Signature = signedRespEl.ChildElements()[len(signedRespEl.ChildElements())-1]
+
+	respEl = resp.Element()
+	if messageEl != nil {
+		respEl.AddChild(messageEl)
+	}
+	return respEl, nil
+}
+
+// issueArtifact stores message in the ArtifactStore until it is resolved by
+// the service provider serviceProviderID, and returns the artifact that
+// references it.
+func (idp *IdentityProvider) issueArtifact(serviceProviderID string, message []byte) (string, error) {
+	if idp.ArtifactStore == nil {
+		return "", fmt.Errorf("no ArtifactStore is configured")
+	}
+
+	validDuration := DefaultArtifactValidDuration
+	if idp.ArtifactValidDuration != nil {
+		validDuration = *idp.ArtifactValidDuration
+	}
+
+	artifact := Artifact{
+		SourceID: ArtifactSourceID(idp.MetadataURL.String()),
+	}
+	copy(artifact.MessageHandle[:], idp.randomBytes(20))
+
+	if err := idp.artifactStore().PutArtifact(artifact.String(), &ArtifactMessage{
+		ServiceProviderID: serviceProviderID,
+		ExpireTime:        idp.now().Add(validDuration),
+		Message:           message,
+	}); err != nil {
+		return "", err
+	}
+	return artifact.String(), nil
 }
 
 // IdpAuthnRequest is used by IdentityProvider to handle a single authentication request.
@@ -351,7 +1256,7 @@ func NewIdpAuthnRequest(idp *IdentityProvider, r *http.Request) (*IdpAuthnReques
 	req := &IdpAuthnRequest{
 		IDP:         idp,
 		HTTPRequest: r,
-		Now:         TimeNow(),
+		Now:         idp.now(),
 	}
 
 	switch r.Method {
@@ -382,6 +1287,39 @@ func NewIdpAuthnRequest(idp *IdentityProvider, r *http.Request) (*IdpAuthnReques
 	return req, nil
 }
 
+// NewIdpECPAuthnRequest returns a new IdpAuthnRequest for the given HTTP
+// request to the ECP service, which carries the AuthnRequest in a SOAP
+// envelope.
+func NewIdpECPAuthnRequest(idp *IdentityProvider, r *http.Request) (*IdpAuthnRequest, error) {
+	req := &IdpAuthnRequest{
+		IDP:         idp,
+		HTTPRequest: r,
+		Now:         idp.now(),
+	}
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read request: %s", err)
+	}
+	if err := xrv.Validate(bytes.NewReader(buf)); err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return nil, err
+	}
+	requestEl := doc.FindElement("Envelope/Body/AuthnRequest")
+	if requestEl == nil {
+		return nil, fmt.Errorf("missing AuthnRequest")
+	}
+
+	req.RequestBuffer, err = detachedElementBytes(requestEl)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
 // Validate checks that the authentication request is valid and assigns
 // the AuthnRequest and Metadata properties. Returns a non-nil error if the
 // request is not valid.
@@ -389,6 +1327,9 @@ func (req *IdpAuthnRequest) Validate() error {
 	if err := xrv.Validate(bytes.NewReader(req.RequestBuffer)); err != nil {
 		return err
 	}
+	if err := req.IDP.checkStructure(req.RequestBuffer); err != nil {
+		return err
+	}
 
 	if err := xml.Unmarshal(req.RequestBuffer, &req.Request); err != nil {
 		return err
@@ -400,13 +1341,6 @@ func (req *IdpAuthnRequest) Validate() error {
 	}
 	idpSsoDescriptor := req.IDP.Metadata().IDPSSODescriptors[0]
 
-	// TODO(ross): support signed authn requests
-	// For now we do the safe thing and fail in the case where we think
-	// requests might be signed.
-	if idpSsoDescriptor.WantAuthnRequestsSigned != nil && *idpSsoDescriptor.WantAuthnRequestsSigned {
-		return fmt.Errorf("authn request signature checking is not currently supported")
-	}
-
 	// In http://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf §3.4.5.2
 	// we get a description of the Destination attribute:
 	//
@@ -421,7 +1355,8 @@ func (req *IdpAuthnRequest) Validate() error {
 	mustHaveDestination := idpSsoDescriptor.WantAuthnRequestsSigned != nil && *idpSsoDescriptor.WantAuthnRequestsSigned
 	mustHaveDestination = mustHaveDestination || req.Request.Destination != ""
 	if mustHaveDestination {
-		if req.Request.Destination != req.IDP.SSOURL.String() {
+		isECPDestination := req.IDP.ECPURL.String() != "" && req.Request.Destination == req.IDP.ECPURL.String()
+		if req.Request.Destination != req.IDP.SSOURL.String() && !isECPDestination {
 			return fmt.Errorf("expected destination to be %q, not %q", req.IDP.SSOURL.String(), req.Request.Destination)
 		}
 	}
@@ -449,9 +1384,120 @@ func (req *IdpAuthnRequest) Validate() error {
 		return fmt.Errorf("cannot find assertion consumer service: %v", err)
 	}
 
+	if req.Request.AttributeConsumingServiceIndex != "" && req.attributeConsumingService() == nil {
+		return fmt.Errorf("cannot find attribute consuming service %s", req.Request.AttributeConsumingServiceIndex)
+	}
+
+	mustBeSigned := req.IDP.WantAuthnRequestsSigned ||
+		(req.SPSSODescriptor != nil && req.SPSSODescriptor.AuthnRequestsSigned != nil && *req.SPSSODescriptor.AuthnRequestsSigned)
+	if err := req.validateSignature(mustBeSigned); err != nil {
+		return fmt.Errorf("cannot validate signature on AuthnRequest: %v", err)
+	}
+
 	return nil
 }
 
+// validateSignature returns nil iff the request carries a valid signature
+// made with a key of the service provider, either enveloped in the request
+// or, for the HTTP-Redirect binding, in the query. If the request is not
+// signed, it returns nil unless mustBeSigned is true.
+func (req *IdpAuthnRequest) validateSignature(mustBeSigned bool) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(req.RequestBuffer); err != nil {
+		return err
+	}
+	if !mustBeSigned {
+		isRedirectSigned := req.HTTPRequest != nil && req.HTTPRequest.Method == http.MethodGet &&
+			hasRedirectSignature(req.HTTPRequest.URL.Query())
+		sigEl, err := findChild(doc.Root(), "http://www.w3.org/2000/09/xmldsig#", "Signature")
+		if err != nil {
+			return err
+		}
+		if !isRedirectSigned && sigEl == nil {
+			return nil
+		}
+	}
+	return req.IDP.validateSPMessageSignature(req.HTTPRequest, doc.Root(), req.ServiceProviderMetadata)
+}
+
+// ValidateSubject checks that the principal of session is the one that the
+// request asks to authenticate, if the request carries a Subject. The
+// assertion issued in response must strongly match that Subject, so a
+// request for another principal must not be answered with an assertion
+// about the principal of session.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.4.1.4
+func (req *IdpAuthnRequest) ValidateSubject(session *Session) error {
+	if req.Request.Subject == nil || req.Request.Subject.NameID == nil {
+		return nil
+	}
+	nameID := req.Request.Subject.NameID
+	if nameID.Value != session.NameID && !req.isGeneratedNameID(nameID, session) {
+		return fmt.Errorf("request is for subject %q but the session is for %q", nameID.Value, session.NameID)
+	}
+	if nameID.NameQualifier != "" && nameID.NameQualifier != req.IDP.Metadata().EntityID {
+		return fmt.Errorf("request is for a subject qualified by %q", nameID.NameQualifier)
+	}
+	return nil
+}
+
+// ValidateNameIDPolicy returns an error that matches ErrInvalidNameIDPolicy
+// if the request has a NameIDPolicy that asks for a format of NameID that
+// the IDP does not issue.
+func (req *IdpAuthnRequest) ValidateNameIDPolicy() error {
+	_, err := requestedNameIDFormat(req, req.IDP.nameIDFormats())
+	return err
+}
+
+// ValidateAuthnContext returns an error that matches
+// ErrInsufficientAuthnContext if the authentication context class of session
+// does not satisfy the RequestedAuthnContext of the request. A
+// SessionProvider may call it to decide whether the user must authenticate
+// again, i.e. with a second factor.
+func (req *IdpAuthnRequest) ValidateAuthnContext(session *Session) error {
+	requested := req.Request.RequestedAuthnContext
+	if requested == nil || len(requested.AuthnContextClassRefs) == 0 {
+		return nil
+	}
+	classRef := sessionAuthnContextClassRef(session)
+	satisfied, err := authnContextSatisfies(requested, classRef, req.IDP.AuthnContextClassOrder)
+	if err != nil {
+		return err
+	}
+	if !satisfied {
+		return errorOfKind(ErrInsufficientAuthnContext, "authentication context %q does not satisfy the %s comparison with %q",
+			classRef, firstSet(requested.Comparison, "exact"), requested.AuthnContextClassRefs)
+	}
+	return nil
+}
+
+// sessionAuthnContextClassRef returns the authentication context class of
+// session.
+func sessionAuthnContextClassRef(session *Session) string {
+	return firstSet(session.AuthnContextClassRef, PasswordProtectedTransportAuthnContext)
+}
+
+// isGeneratedNameID returns true if nameID is the NameID that the
+// NameIDGenerator of the IDP makes for the principal of session, i.e. the
+// persistent identifier by which the service provider knows them. The
+// NameID is made as if the request did not allow identifiers to be
+// created, so that checking the subject never creates one.
+func (req *IdpAuthnRequest) isGeneratedNameID(nameID *NameID, session *Session) bool {
+	if req.IDP.NameIDGenerator == nil {
+		return false
+	}
+	allowCreate := false
+	policy := NameIDPolicy{}
+	if req.Request.NameIDPolicy != nil {
+		policy = *req.Request.NameIDPolicy
+	}
+	policy.AllowCreate = &allowCreate
+	lookup := *req
+	lookup.Request.NameIDPolicy = &policy
+	generated, err := req.IDP.NameIDGenerator.MakeNameID(&lookup, session)
+	return err == nil && generated.Value == nameID.Value
+}
+
 func (req *IdpAuthnRequest) getACSEndpoint() error {
 	if req.Request.AssertionConsumerServiceIndex != "" {
 		for _, spssoDescriptor := range req.ServiceProviderMetadata.SPSSODescriptors {
@@ -531,40 +1577,195 @@ func (req *IdpAuthnRequest) getACSEndpoint() error {
 					// but it certainly doesn't hurt anything and may prevent bugs in the future.)
 					spssoDescriptor, spAssertionConsumerService := spssoDescriptor, spAssertionConsumerService
 
-					req.SPSSODescriptor = &spssoDescriptor
-					req.ACSEndpoint = &spAssertionConsumerService
-					return nil
-				}
-			}
+					req.SPSSODescriptor = &spssoDescriptor
+					req.ACSEndpoint = &spAssertionConsumerService
+					return nil
+				}
+			}
+		}
+	}
+
+	return os.ErrNotExist // no ACS url found or specified
+}
+
+// attributeConsumingService returns the attribute consuming service of the
+// service provider that the request refers to by its
+// AttributeConsumingServiceIndex, or nil if there is none.
+func (req *IdpAuthnRequest) attributeConsumingService() *AttributeConsumingService {
+	if req.Request.AttributeConsumingServiceIndex == "" || req.SPSSODescriptor == nil {
+		return nil
+	}
+	for _, acs := range req.SPSSODescriptor.AttributeConsumingServices {
+		if strconv.Itoa(acs.Index) == req.Request.AttributeConsumingServiceIndex {
+			acs := acs
+			return &acs
+		}
+	}
+	return nil
+}
+
+// getECPACSEndpoint replaces the assertion consumer service found by Validate
+// with the one at the same location that uses the PAOS binding, which is the
+// only binding an ECP client can use to deliver the response.
+func (req *IdpAuthnRequest) getECPACSEndpoint() error {
+	for _, spssoDescriptor := range req.ServiceProviderMetadata.SPSSODescriptors {
+		for _, spAssertionConsumerService := range spssoDescriptor.AssertionConsumerServices {
+			if spAssertionConsumerService.Binding == PAOSBinding && spAssertionConsumerService.Location == req.ACSEndpoint.Location {
+				// explicitly copy loop iterator variables
+				//
+				// c.f. https://github.com/golang/go/wiki/CommonMistakes#using-reference-to-loop-iterator-variable
+				spssoDescriptor, spAssertionConsumerService := spssoDescriptor, spAssertionConsumerService
+
+				req.SPSSODescriptor = &spssoDescriptor
+				req.ACSEndpoint = &spAssertionConsumerService
+				return nil
+			}
+		}
+	}
+	return os.ErrNotExist
+}
+
+// DefaultAssertionMaker produces a SAML assertion for the
+// given request and assigns it to req.Assertion.
+type DefaultAssertionMaker struct {
+}
+
+// MakeAssertion implements AssertionMaker. It produces a SAML assertion from the
+// given request and assigns it to req.Assertion.
+func (DefaultAssertionMaker) MakeAssertion(req *IdpAuthnRequest, session *Session) error {
+	attributes, err := req.attributes(session)
+	if err != nil {
+		return err
+	}
+	attributes = req.releaseAttributes(session, attributes)
+	nameID, err := req.nameID(session)
+	if err != nil {
+		return err
+	}
+
+	// allow for some clock skew in the validity period using the
+	// issuer's apparent clock.
+	notBefore := req.Now.Add(-1 * MaxClockSkew)
+	notOnOrAfterAfter := req.Now.Add(MaxIssueDelay)
+	if notBefore.Before(req.Request.IssueInstant) {
+		notBefore = req.Request.IssueInstant
+		notOnOrAfterAfter = notBefore.Add(MaxIssueDelay)
+	}
+
+	req.Assertion = &Assertion{
+		ID:           fmt.Sprintf("id-%x", req.IDP.randomBytes(20)),
+		IssueInstant: req.IDP.now(),
+		Version:      "2.0",
+		Issuer: Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  req.IDP.Metadata().EntityID,
+		},
+		Subject: &Subject{
+			NameID: nameID,
+			SubjectConfirmations: []SubjectConfirmation{
+				{
+					Method: BearerConfirmationMethod,
+					SubjectConfirmationData: &SubjectConfirmationData{
+						Address:      req.HTTPRequest.RemoteAddr,
+						InResponseTo: req.Request.ID,
+						NotOnOrAfter: req.Now.Add(MaxIssueDelay),
+						Recipient:    req.ACSEndpoint.Location,
+					},
+				},
+			},
+		},
+		Conditions: &Conditions{
+			NotBefore:    notBefore,
+			NotOnOrAfter: notOnOrAfterAfter,
+			AudienceRestrictions: []AudienceRestriction{
+				{
+					Audience: Audience{Value: req.ServiceProviderMetadata.EntityID},
+				},
+			},
+		},
+		AuthnStatements: []AuthnStatement{
+			{
+				AuthnInstant: session.CreateTime,
+				SessionIndex: session.Index,
+				SubjectLocality: &SubjectLocality{
+					Address: req.HTTPRequest.RemoteAddr,
+				},
+				AuthnContext: AuthnContext{
+					AuthnContextClassRef: &AuthnContextClassRef{
+						Value: sessionAuthnContextClassRef(session),
+					},
+				},
+			},
+		},
+		AttributeStatements: []AttributeStatement{
+			{
+				Attributes: attributes,
+			},
+		},
+	}
+
+	if req.IDP.HolderOfKeyConfirmation {
+		if cert := tlsClientCertificate(req.HTTPRequest); cert != nil {
+			subjectConfirmation := &req.Assertion.Subject.SubjectConfirmations[0]
+			subjectConfirmation.Method = HolderOfKeyConfirmationMethod
+			subjectConfirmation.SubjectConfirmationData.KeyInfos = []KeyInfo{holderOfKeyKeyInfo(cert)}
 		}
 	}
 
-	return os.ErrNotExist // no ACS url found or specified
+	if len(session.Delegates) > 0 {
+		req.Assertion.Conditions.DelegationRestriction = &DelegationRestriction{
+			Delegates: session.Delegates,
+		}
+	}
+
+	return nil
 }
 
-// DefaultAssertionMaker produces a SAML assertion for the
-// given request and assigns it to req.Assertion.
-type DefaultAssertionMaker struct {
+// nameID returns the NameID of the principal of session in the assertion
+// issued in response to req.
+func (req *IdpAuthnRequest) nameID(session *Session) (*NameID, error) {
+	if req.IDP.NameIDGenerator != nil {
+		return req.IDP.NameIDGenerator.MakeNameID(req, session)
+	}
+	if err := req.ValidateNameIDPolicy(); err != nil {
+		return nil, err
+	}
+	return &NameID{
+		Format:          string(TransientNameIDFormat),
+		NameQualifier:   req.IDP.Metadata().EntityID,
+		SPNameQualifier: req.ServiceProviderMetadata.EntityID,
+		Value:           session.NameID,
+	}, nil
 }
 
-// MakeAssertion implements AssertionMaker. It produces a SAML assertion from the
-// given request and assigns it to req.Assertion.
-func (DefaultAssertionMaker) MakeAssertion(req *IdpAuthnRequest, session *Session) error {
+// attributes returns the attributes of the principal of session that are
+// sent in the assertion: those of the AttributeResolver of the IDP, if it
+// has one, or else those that the session carries, including the attributes
+// that the service provider requests in its attribute consuming service.
+func (req *IdpAuthnRequest) attributes(session *Session) ([]Attribute, error) {
+	if req.IDP.AttributeResolver != nil {
+		return req.IDP.AttributeResolver.Resolve(req.HTTPRequest.Context(), session, req.ServiceProviderMetadata)
+	}
+
 	attributes := []Attribute{}
 
-	var attributeConsumingService *AttributeConsumingService
-	for _, acs := range req.SPSSODescriptor.AttributeConsumingServices {
-		if acs.IsDefault != nil && *acs.IsDefault {
-			// explicitly copy loop iterator variables
-			//
-			// c.f. https://github.com/golang/go/wiki/CommonMistakes#using-reference-to-loop-iterator-variable
-			//
-			// (note that I'm pretty sure this isn't strictly necessary because we break out of the loop immediately,
-			// but it certainly doesn't hurt anything and may prevent bugs in the future.)
-			acs := acs
+	// use the attribute consuming service that the request refers to, if
+	// any, or else the default one
+	attributeConsumingService := req.attributeConsumingService()
+	if attributeConsumingService == nil {
+		for _, acs := range req.SPSSODescriptor.AttributeConsumingServices {
+			if acs.IsDefault != nil && *acs.IsDefault {
+				// explicitly copy loop iterator variables
+				//
+				// c.f. https://github.com/golang/go/wiki/CommonMistakes#using-reference-to-loop-iterator-variable
+				//
+				// (note that I'm pretty sure this isn't strictly necessary because we break out of the loop immediately,
+				// but it certainly doesn't hurt anything and may prevent bugs in the future.)
+				acs := acs
 
-			attributeConsumingService = &acs
-			break
+				attributeConsumingService = &acs
+				break
+			}
 		}
 	}
 	if attributeConsumingService == nil {
@@ -644,202 +1845,91 @@ func (DefaultAssertionMaker) MakeAssertion(req *IdpAuthnRequest, session *Sessio
 		}
 	}
 
-	if session.UserName != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "uid",
-			Name:         "urn:oid:0.9.2342.19200300.100.1.1",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{{
-				Type:  "xs:string",
-				Value: session.UserName,
-			}},
-		})
-	}
+	attributes = append(attributes, sessionAttributes(session)...)
+	return attributes, nil
+}
 
-	if session.UserEmail != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "eduPersonPrincipalName",
-			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{{
-				Type:  "xs:string",
-				Value: session.UserEmail,
-			}},
-		})
-	}
-	if session.UserSurname != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "sn",
-			Name:         "urn:oid:2.5.4.4",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{{
-				Type:  "xs:string",
-				Value: session.UserSurname,
-			}},
-		})
-	}
-	if session.UserGivenName != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "givenName",
-			Name:         "urn:oid:2.5.4.42",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{{
-				Type:  "xs:string",
-				Value: session.UserGivenName,
-			}},
-		})
-	}
+// The Canonicalizer prefix list MUST be empty. Various implementations
+// (maybe ours?) do not appear to support non-empty prefix lists in XML C14N.
+const canonicalizerPrefixList = ""
 
-	if session.UserCommonName != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "cn",
-			Name:         "urn:oid:2.5.4.3",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{{
-				Type:  "xs:string",
-				Value: session.UserCommonName,
-			}},
-		})
+// nameIDFormats returns the formats of the NameIDs that the IDP issues.
+func (idp *IdentityProvider) nameIDFormats() []NameIDFormat {
+	if idp.NameIDGenerator != nil {
+		return idp.NameIDGenerator.NameIDFormats()
 	}
+	return []NameIDFormat{TransientNameIDFormat}
+}
 
-	if session.UserScopedAffiliation != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "uid",
-			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.9",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{{
-				Type:  "xs:string",
-				Value: session.UserScopedAffiliation,
-			}},
-		})
-	}
+// randomBytes returns n bytes read from the IDP's RandReader.
+func (idp *IdentityProvider) randomBytes(n int) []byte {
+	return randomBytesFrom(idp.RandReader, n)
+}
 
-	for _, ca := range session.CustomAttributes {
-		attributes = append(attributes, ca)
-	}
+// now returns the current time of the IDP's TimeSource.
+func (idp *IdentityProvider) now() time.Time {
+	return timeNow(idp.TimeSource)
+}
 
-	if len(session.Groups) != 0 {
-		groupMemberAttributeValues := []AttributeValue{}
-		for _, group := range session.Groups {
-			groupMemberAttributeValues = append(groupMemberAttributeValues, AttributeValue{
-				Type:  "xs:string",
-				Value: group,
-			})
-		}
-		attributes = append(attributes, Attribute{
-			FriendlyName: "eduPersonAffiliation",
-			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values:       groupMemberAttributeValues,
-		})
-	}
+// signingContext returns the context used to sign the assertions and
+// messages of the IDP.
+func (idp *IdentityProvider) signingContext() (*dsig.SigningContext, error) {
+	return newSigningContext(idp.Key, idp.Certificate, idp.Intermediates, idp.signatureMethod())
+}
 
-	// allow for some clock skew in the validity period using the
-	// issuer's apparent clock.
-	notBefore := req.Now.Add(-1 * MaxClockSkew)
-	notOnOrAfterAfter := req.Now.Add(MaxIssueDelay)
-	if notBefore.Before(req.Request.IssueInstant) {
-		notBefore = req.Request.IssueInstant
-		notOnOrAfterAfter = notBefore.Add(MaxIssueDelay)
+// signatureMethod returns the signature method that the IDP signs with.
+func (idp *IdentityProvider) signatureMethod() string {
+	if idp.SignatureMethod == "" {
+		return defaultSignatureMethod(idp.Key)
 	}
+	return idp.SignatureMethod
+}
 
-	req.Assertion = &Assertion{
-		ID:           fmt.Sprintf("id-%x", randomBytes(20)),
-		IssueInstant: TimeNow(),
-		Version:      "2.0",
-		Issuer: Issuer{
-			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
-			Value:  req.IDP.Metadata().EntityID,
-		},
-		Subject: &Subject{
-			NameID: &NameID{
-				Format:          "urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
-				NameQualifier:   req.IDP.Metadata().EntityID,
-				SPNameQualifier: req.ServiceProviderMetadata.EntityID,
-				Value:           session.NameID,
-			},
-			SubjectConfirmations: []SubjectConfirmation{
-				{
-					Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
-					SubjectConfirmationData: &SubjectConfirmationData{
-						Address:      req.HTTPRequest.RemoteAddr,
-						InResponseTo: req.Request.ID,
-						NotOnOrAfter: req.Now.Add(MaxIssueDelay),
-						Recipient:    req.ACSEndpoint.Location,
-					},
-				},
-			},
-		},
-		Conditions: &Conditions{
-			NotBefore:    notBefore,
-			NotOnOrAfter: notOnOrAfterAfter,
-			AudienceRestrictions: []AudienceRestriction{
-				{
-					Audience: Audience{Value: req.ServiceProviderMetadata.EntityID},
-				},
-			},
-		},
-		AuthnStatements: []AuthnStatement{
-			{
-				AuthnInstant: session.CreateTime,
-				SessionIndex: session.Index,
-				SubjectLocality: &SubjectLocality{
-					Address: req.HTTPRequest.RemoteAddr,
-				},
-				AuthnContext: AuthnContext{
-					AuthnContextClassRef: &AuthnContextClassRef{
-						Value: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
-					},
-				},
-			},
-		},
-		AttributeStatements: []AttributeStatement{
-			{
-				Attributes: attributes,
-			},
-		},
+// redirectURL returns a URL that sends el to destination using the
+// HTTP-Redirect binding, signed with the IDP key.
+func (idp *IdentityProvider) redirectURL(destination string, param string, el *etree.Element, relayState string) (*url.URL, error) {
+	signingContext, err := idp.signingContext()
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	return signedRedirectURL(destination, param, el, relayState, idp.signatureMethod(), signingContext)
 }
 
-// The Canonicalizer prefix list MUST be empty. Various implementations
-// (maybe ours?) do not appear to support non-empty prefix lists in XML C14N.
-const canonicalizerPrefixList = ""
-
 // MakeAssertionEl sets `AssertionEl` to a signed, possibly encrypted, version of `Assertion`.
+// The assertion is not signed if the service provider metadata declares
+// WantAssertionsSigned="false", since the response that carries it is, or
+// if the ServiceProviderProvider selects SignResponseOnly for it.
 func (req *IdpAuthnRequest) MakeAssertionEl() error {
-	keyPair := tls.Certificate{
-		Certificate: [][]byte{req.IDP.Certificate.Raw},
-		PrivateKey:  req.IDP.Key,
-		Leaf:        req.IDP.Certificate,
-	}
-	for _, cert := range req.IDP.Intermediates {
-		keyPair.Certificate = append(keyPair.Certificate, cert.Raw)
-	}
-	keyStore := dsig.TLSCertKeyStore(keyPair)
-
-	signatureMethod := req.IDP.SignatureMethod
-	if signatureMethod == "" {
-		signatureMethod = dsig.RSASHA1SignatureMethod
+	signingContext, err := req.IDP.signingContext()
+	if err != nil {
+		return err
 	}
 
-	signingContext := dsig.NewDefaultSigningContext(keyStore)
-	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(canonicalizerPrefixList)
-	if err := signingContext.SetSignatureMethod(signatureMethod); err != nil {
+	signAssertion, _, err := req.responseSigning()
+	if err != nil {
 		return err
 	}
 
-	assertionEl := req.Assertion.Element()
+	signedAssertionEl := req.Assertion.Element()
+	if signAssertion {
+		signedAssertionEl, err = signingContext.SignEnveloped(signedAssertionEl)
+		if err != nil {
+			return err
+		}
+
+		sigEl := signedAssertionEl.Child[len(signedAssertionEl.Child)-1]
+		req.Assertion.Signature = sigEl.(*etree.Element)
+		signedAssertionEl = req.Assertion.Element()
+	}
 
-	signedAssertionEl, err := signingContext.SignEnveloped(assertionEl)
+	encryption, err := req.getAssertionEncryption()
 	if err != nil {
 		return err
 	}
-
-	sigEl := signedAssertionEl.Child[len(signedAssertionEl.Child)-1]
-	req.Assertion.Signature = sigEl.(*etree.Element)
-	signedAssertionEl = req.Assertion.Element()
+	if encryption.Disabled {
+		req.AssertionEl = signedAssertionEl
+		return nil
+	}
 
 	certBuf, err := req.getSPEncryptionCert()
 	if err == os.ErrNotExist {
@@ -860,8 +1950,8 @@ func (req *IdpAuthnRequest) MakeAssertionEl() error {
 	}
 
 	encryptor := xmlenc.OAEP()
-	encryptor.BlockCipher = xmlenc.AES128CBC
-	encryptor.DigestMethod = &xmlenc.SHA1
+	encryptor.BlockCipher = encryption.BlockCipher
+	encryptor.DigestMethod = encryption.DigestMethod
 	encryptedDataEl, err := encryptor.Encrypt(certBuf, signedAssertionBuf, nil)
 	if err != nil {
 		return err
@@ -891,9 +1981,16 @@ func (req *IdpAuthnRequest) WriteResponse(w http.ResponseWriter) error {
 		return err
 	}
 
-	// the only supported binding is the HTTP-POST binding
 	switch req.ACSEndpoint.Binding {
 	case HTTPPostBinding:
+		if req.IDP.PostForm != nil {
+			return req.IDP.PostForm.Write(w, PostFormData{
+				URL:        req.ACSEndpoint.Location,
+				Param:      "SAMLResponse",
+				Value:      base64.StdEncoding.EncodeToString(responseBuf),
+				RelayState: req.RelayState,
+			})
+		}
 		tmpl := template.Must(template.New("saml-post-form").Parse(`<html>` +
 			`<form method="post" action="{{.URL}}" id="SAMLResponseForm">` +
 			`<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}" />` +
@@ -922,6 +2019,35 @@ func (req *IdpAuthnRequest) WriteResponse(w http.ResponseWriter) error {
 		}
 		return nil
 
+	case HTTPArtifactBinding:
+		artifact, err := req.IDP.issueArtifact(req.ServiceProviderMetadata.EntityID, responseBuf)
+		if err != nil {
+			return err
+		}
+
+		location, err := url.Parse(req.ACSEndpoint.Location)
+		if err != nil {
+			return err
+		}
+		query := location.Query()
+		query.Set("SAMLart", artifact)
+		if req.RelayState != "" {
+			query.Set("RelayState", req.RelayState)
+		}
+		location.RawQuery = query.Encode()
+
+		http.Redirect(w, req.HTTPRequest, location.String(), http.StatusFound)
+		return nil
+
+	case PAOSBinding:
+		doc := etree.NewDocument()
+		doc.SetRoot(ecpResponseEnvelope(req.ResponseEl, req.ACSEndpoint.Location))
+		w.Header().Set("Content-Type", "text/xml")
+		if _, err := doc.WriteTo(w); err != nil {
+			return err
+		}
+		return nil
+
 	default:
 		return fmt.Errorf("%s: unsupported binding %s",
 			req.ServiceProviderMetadata.EntityID,
@@ -929,11 +2055,109 @@ func (req *IdpAuthnRequest) WriteResponse(w http.ResponseWriter) error {
 	}
 }
 
+// assertionBlockCiphers are the block ciphers that we can use to encrypt
+// assertions, by algorithm.
+var assertionBlockCiphers = map[string]xmlenc.BlockCipher{
+	xmlenc.AES128CBC.Algorithm(): xmlenc.AES128CBC,
+	xmlenc.AES192CBC.Algorithm(): xmlenc.AES192CBC,
+	xmlenc.AES256CBC.Algorithm(): xmlenc.AES256CBC,
+	xmlenc.AES128GCM.Algorithm(): xmlenc.AES128GCM,
+	xmlenc.AES192GCM.Algorithm(): xmlenc.AES192GCM,
+	xmlenc.AES256GCM.Algorithm(): xmlenc.AES256GCM,
+}
+
+// getAssertionEncryption returns the settings used to encrypt the assertion
+// for the SP, filling in the defaults for any that are not specified.
+func (req *IdpAuthnRequest) getAssertionEncryption() (*AssertionEncryption, error) {
+	encryption := AssertionEncryption{}
+	if provider, ok := req.IDP.ServiceProviderProvider.(AssertionEncryptionProvider); ok && req.ServiceProviderMetadata != nil {
+		spEncryption, err := provider.GetAssertionEncryption(req.HTTPRequest, req.ServiceProviderMetadata.EntityID)
+		if err != nil {
+			return nil, err
+		}
+		if spEncryption != nil {
+			encryption = *spEncryption
+		}
+	}
+
+	if encryption.BlockCipher == nil {
+		encryption.BlockCipher = blockCipherFromMetadata(req.SPSSODescriptor.KeyDescriptors)
+	}
+	if encryption.DigestMethod == nil {
+		encryption.DigestMethod = &xmlenc.SHA1
+	}
+	return &encryption, nil
+}
+
+// responseSigning returns whether the assertion and the response sent to
+// the SP are signed, as selected by the ServiceProviderProvider if it is a
+// ResponseSigningProvider, or else by the WantAssertionsSigned of the SP
+// metadata.
+func (req *IdpAuthnRequest) responseSigning() (signAssertion bool, signResponse bool, err error) {
+	signing := SignResponseDefault
+	if provider, ok := req.IDP.ServiceProviderProvider.(ResponseSigningProvider); ok && req.ServiceProviderMetadata != nil {
+		signing, err = provider.GetResponseSigning(req.HTTPRequest, req.ServiceProviderMetadata.EntityID)
+		if err != nil {
+			return false, false, err
+		}
+	}
+
+	switch signing {
+	case SignAssertionOnly:
+		return true, false, nil
+	case SignResponseOnly:
+		return false, true, nil
+	case SignAssertionAndResponse:
+		return true, true, nil
+	case SignResponseDefault:
+		// the response is signed, so the assertion need not be if the
+		// service provider says it does not want it to be
+		wantAssertionsSigned := req.SPSSODescriptor == nil || req.SPSSODescriptor.WantAssertionsSigned == nil ||
+			*req.SPSSODescriptor.WantAssertionsSigned
+		return wantAssertionsSigned, true, nil
+	default:
+		return false, false, fmt.Errorf("unknown response signing %d", signing)
+	}
+}
+
+// blockCipherFromMetadata returns the first block cipher that we support in
+// the EncryptionMethods of the encryption keys in keyDescriptors, or
+// AES-128-CBC if there is none.
+func blockCipherFromMetadata(keyDescriptors []KeyDescriptor) xmlenc.BlockCipher {
+	for _, keyDescriptor := range keyDescriptors {
+		if keyDescriptor.Use != "encryption" && keyDescriptor.Use != "" {
+			continue
+		}
+		for _, encryptionMethod := range keyDescriptor.EncryptionMethods {
+			if blockCipher, ok := assertionBlockCiphers[encryptionMethod.Algorithm]; ok {
+				return blockCipher
+			}
+		}
+	}
+	return xmlenc.AES128CBC
+}
+
 // getSPEncryptionCert returns the certificate which we can use to encrypt things
 // to the SP in PEM format, or nil if no such certificate is found.
 func (req *IdpAuthnRequest) getSPEncryptionCert() (*x509.Certificate, error) {
+	return encryptionCert(req.SPSSODescriptor.KeyDescriptors)
+}
+
+// spEncryptionCert returns the certificate which we can use to encrypt
+// things to serviceProvider, or os.ErrNotExist if there is none.
+func spEncryptionCert(serviceProvider *EntityDescriptor) (*x509.Certificate, error) {
+	var keyDescriptors []KeyDescriptor
+	for _, spssoDescriptor := range serviceProvider.SPSSODescriptors {
+		keyDescriptors = append(keyDescriptors, spssoDescriptor.KeyDescriptors...)
+	}
+	return encryptionCert(keyDescriptors)
+}
+
+// encryptionCert returns the first encryption certificate in keyDescriptors,
+// or os.ErrNotExist if there is none.
+func encryptionCert(keyDescriptors []KeyDescriptor) (*x509.Certificate, error) {
 	certStr := ""
-	for _, keyDescriptor := range req.SPSSODescriptor.KeyDescriptors {
+	for _, keyDescriptor := range keyDescriptors {
 		if keyDescriptor.Use == "encryption" {
 			certStr = keyDescriptor.KeyInfo.X509Data.X509Certificates[0].Data
 			break
@@ -943,7 +2167,7 @@ func (req *IdpAuthnRequest) getSPEncryptionCert() (*x509.Certificate, error) {
 	// If there are no certs explicitly labeled for encryption, return the first
 	// non-empty cert we find.
 	if certStr == "" {
-		for _, keyDescriptor := range req.SPSSODescriptor.KeyDescriptors {
+		for _, keyDescriptor := range keyDescriptors {
 			if keyDescriptor.Use == "" && len(keyDescriptor.KeyInfo.X509Data.X509Certificates) != 0 && keyDescriptor.KeyInfo.X509Data.X509Certificates[0].Data != "" {
 				certStr = keyDescriptor.KeyInfo.X509Data.X509Certificates[0].Data
 				break
@@ -968,6 +2192,64 @@ func (req *IdpAuthnRequest) getSPEncryptionCert() (*x509.Certificate, error) {
 	return cert, nil
 }
 
+// validateSPSignature returns nil iff el carries a valid signature made with
+// one of the signing certificates in the service provider metadata.
+func (idp *IdentityProvider) validateSPSignature(el *etree.Element, serviceProvider *EntityDescriptor) error {
+	sigEl, err := findChild(el, "http://www.w3.org/2000/09/xmldsig#", "Signature")
+	if err != nil {
+		return err
+	}
+	if sigEl == nil {
+		return errors.New("request is not signed")
+	}
+
+	certs, err := spSigningCerts(serviceProvider)
+	if err != nil {
+		return err
+	}
+	return verifySignature(el, certs, nil, idp.signaturePolicy(), dsigClock(idp.TimeSource))
+}
+
+// validateSPMessageSignature returns nil iff el, the message received in r,
+// is signed by the service provider. Messages sent using the HTTP-Redirect
+// binding may carry the signature in the query rather than in el.
+func (idp *IdentityProvider) validateSPMessageSignature(r *http.Request, el *etree.Element, serviceProvider *EntityDescriptor) error {
+	if r == nil || r.Method != http.MethodGet || !hasRedirectSignature(r.URL.Query()) {
+		return idp.validateSPSignature(el, serviceProvider)
+	}
+	certs, err := spSigningCerts(serviceProvider)
+	if err != nil {
+		return err
+	}
+	return verifyRedirectSignature(r.URL.RawQuery, certs, idp.signaturePolicy())
+}
+
+// spSigningCerts returns the signing certificates in the service provider
+// metadata.
+func spSigningCerts(serviceProvider *EntityDescriptor) ([]*x509.Certificate, error) {
+	var keyDescriptors []KeyDescriptor
+	for _, spssoDescriptor := range serviceProvider.SPSSODescriptors {
+		keyDescriptors = append(keyDescriptors, spssoDescriptor.KeyDescriptors...)
+	}
+	certs, err := signingCerts(keyDescriptors)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("cannot find any signing certificate in the SP SSO descriptor")
+	}
+	return certs, nil
+}
+
+// signaturePolicy returns the algorithms allowed in signatures from service
+// providers.
+func (idp *IdentityProvider) signaturePolicy() signaturePolicy {
+	return signaturePolicy{
+		SignatureMethods: idp.AllowedSignatureMethods,
+		DigestMethods:    idp.AllowedDigestMethods,
+	}
+}
+
 // unmarshalEtreeHack parses `el` and sets values in the structure `v`.
 //
 // This is a hack -- it first serializes the element, then uses xml.Unmarshal.
@@ -983,7 +2265,8 @@ func unmarshalEtreeHack(el *etree.Element, v interface{}) error {
 
 // MakeResponse creates and assigns a new SAML response in ResponseEl. `Assertion` must
 // be non-nil. If MakeAssertionEl() has not been called, this function calls it for
-// you.
+// you. The response is signed unless the ServiceProviderProvider selects
+// SignAssertionOnly for the service provider.
 func (req *IdpAuthnRequest) MakeResponse() error {
 	if req.AssertionEl == nil {
 		if err := req.MakeAssertionEl(); err != nil {
@@ -993,7 +2276,7 @@ func (req *IdpAuthnRequest) MakeResponse() error {
 
 	response := &Response{
 		Destination:  req.ACSEndpoint.Location,
-		ID:           fmt.Sprintf("id-%x", randomBytes(20)),
+		ID:           fmt.Sprintf("id-%x", req.IDP.randomBytes(20)),
 		InResponseTo: req.Request.ID,
 		IssueInstant: req.Now,
 		Version:      "2.0",
@@ -1011,26 +2294,15 @@ func (req *IdpAuthnRequest) MakeResponse() error {
 	responseEl := response.Element()
 	responseEl.AddChild(req.AssertionEl) // AssertionEl either an EncryptedAssertion or Assertion element
 
-	// Sign the response element (we've already signed the Assertion element)
-	{
-		keyPair := tls.Certificate{
-			Certificate: [][]byte{req.IDP.Certificate.Raw},
-			PrivateKey:  req.IDP.Key,
-			Leaf:        req.IDP.Certificate,
-		}
-		for _, cert := range req.IDP.Intermediates {
-			keyPair.Certificate = append(keyPair.Certificate, cert.Raw)
-		}
-		keyStore := dsig.TLSCertKeyStore(keyPair)
-
-		signatureMethod := req.IDP.SignatureMethod
-		if signatureMethod == "" {
-			signatureMethod = dsig.RSASHA1SignatureMethod
-		}
+	_, signResponse, err := req.responseSigning()
+	if err != nil {
+		return err
+	}
 
-		signingContext := dsig.NewDefaultSigningContext(keyStore)
-		signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(canonicalizerPrefixList)
-		if err := signingContext.SetSignatureMethod(signatureMethod); err != nil {
+	// Sign the response element (we've already signed the Assertion element)
+	if signResponse {
+		signingContext, err := req.IDP.signingContext()
+		if err != nil {
 			return err
 		}
 
@@ -1048,3 +2320,66 @@ func (req *IdpAuthnRequest) MakeResponse() error {
 	req.ResponseEl = responseEl
 	return nil
 }
+
+// noAuthnContextStatus is the status of the response to a request whose
+// RequestedAuthnContext the authentication of the user does not satisfy.
+var noAuthnContextStatus = Status{
+	StatusCode: StatusCode{
+		Value:      StatusRequester,
+		StatusCode: &StatusCode{Value: StatusNoAuthnContext},
+	},
+}
+
+// invalidNameIDPolicyStatus is the status of the response to a request
+// whose NameIDPolicy cannot be honored.
+var invalidNameIDPolicyStatus = Status{
+	StatusCode: StatusCode{
+		Value:      StatusRequester,
+		StatusCode: &StatusCode{Value: StatusInvalidNameIDPolicy},
+	},
+}
+
+// MakeErrorResponse makes a signed response to the request with status,
+// and without an assertion, and assigns it to req.ResponseEl, so that
+// WriteResponse sends it to the service provider. Use it to tell the
+// service provider why the request failed, i.e. with the
+// InvalidNameIDPolicy status.
+func (req *IdpAuthnRequest) MakeErrorResponse(status Status) error {
+	response := &Response{
+		Destination:  req.ACSEndpoint.Location,
+		ID:           fmt.Sprintf("id-%x", req.IDP.randomBytes(20)),
+		InResponseTo: req.Request.ID,
+		IssueInstant: req.Now,
+		Version:      "2.0",
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  req.IDP.MetadataURL.String(),
+		},
+		Status: status,
+	}
+
+	signingContext, err := req.IDP.signingContext()
+	if err != nil {
+		return err
+	}
+	signedResponseEl, err := signingContext.SignEnveloped(response.Element())
+	if err != nil {
+		return err
+	}
+	req.ResponseEl = signedResponseEl
+	return nil
+}
+
+// writeStatusResponse sends the service provider a response to the request
+// with status, or responds with an HTTP error if it cannot.
+func (req *IdpAuthnRequest) writeStatusResponse(w http.ResponseWriter, status Status) {
+	if err := req.MakeErrorResponse(status); err != nil {
+		req.IDP.Logger.Printf("failed to make response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := req.WriteResponse(w); err != nil {
+		req.IDP.Logger.Printf("failed to write response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -1,6 +1,8 @@
 package saml
 
 import (
+	"bytes"
+	"compress/flate"
 	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
@@ -8,6 +10,8 @@ import (
 	"encoding/pem"
 	"encoding/xml"
 	"fmt"
+	"html/template"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
@@ -23,6 +27,7 @@ import (
 
 	"github.com/beevik/etree"
 	"github.com/golang-jwt/jwt/v4"
+	dsig "github.com/russellhaering/goxmldsig"
 
 	"github.com/crewjam/saml/logger"
 	"github.com/crewjam/saml/testsaml"
@@ -53,6 +58,13 @@ func mustParsePrivateKey(pemStr []byte) crypto.PrivateKey {
 	if b == nil {
 		panic("cannot parse PEM")
 	}
+	if b.Type == "EC PRIVATE KEY" {
+		k, err := x509.ParseECPrivateKey(b.Bytes)
+		if err != nil {
+			panic(err)
+		}
+		return k
+	}
 	k, err := x509.ParsePKCS1PrivateKey(b.Bytes)
 	if err != nil {
 		panic(err)
@@ -137,12 +149,45 @@ func (mspp *mockServiceProviderProvider) GetServiceProvider(r *http.Request, ser
 	return mspp.GetServiceProviderFunc(r, serviceProviderID)
 }
 
+type mockAssertionEncryptionProvider struct {
+	mockServiceProviderProvider
+	GetAssertionEncryptionFunc func(r *http.Request, serviceProviderID string) (*AssertionEncryption, error)
+}
+
+func (maep *mockAssertionEncryptionProvider) GetAssertionEncryption(r *http.Request, serviceProviderID string) (*AssertionEncryption, error) {
+	return maep.GetAssertionEncryptionFunc(r, serviceProviderID)
+}
+
+type mockResponseSigningProvider struct {
+	mockServiceProviderProvider
+	GetResponseSigningFunc func(r *http.Request, serviceProviderID string) (ResponseSigning, error)
+}
+
+func (mrsp *mockResponseSigningProvider) GetResponseSigning(r *http.Request, serviceProviderID string) (ResponseSigning, error) {
+	return mrsp.GetResponseSigningFunc(r, serviceProviderID)
+}
+
 func TestIDPCanProduceMetadata(t *testing.T) {
 	test := NewIdentifyProviderTest(t)
 	expected := &EntityDescriptor{
 		ValidUntil:    TimeNow().Add(DefaultValidDuration),
 		CacheDuration: DefaultValidDuration,
 		EntityID:      "https://idp.example.com/saml/metadata",
+		Extensions: &MetadataExtensions{
+			DigestMethods: []DigestMethod{
+				{Algorithm: "http://www.w3.org/2001/04/xmlenc#sha256"},
+				{Algorithm: "http://www.w3.org/2001/04/xmldsig-more#sha384"},
+				{Algorithm: "http://www.w3.org/2001/04/xmlenc#sha512"},
+			},
+			SigningMethods: []SigningMethod{
+				{Algorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"},
+				{Algorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha384"},
+				{Algorithm: "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"},
+				{Algorithm: "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"},
+				{Algorithm: "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha384"},
+				{Algorithm: "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"},
+			},
+		},
 		IDPSSODescriptors: []IDPSSODescriptor{
 			{
 				SSODescriptor: SSODescriptor{
@@ -198,6 +243,59 @@ func TestIDPCanProduceMetadata(t *testing.T) {
 	assert.Check(t, is.DeepEqual(expected, test.IDP.Metadata()))
 }
 
+func TestIDPCanProduceMetadataWithContacts(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	test.IDP.Organization = &Organization{
+		OrganizationNames: []LocalizedName{{Lang: "en", Value: "Example"}},
+	}
+	test.IDP.ContactPeople = []ContactPerson{
+		{ContactType: "support", EmailAddresses: []string{"mailto:help@example.com"}},
+		{ContactType: "other", RemdContactType: REFEDSSecurityContactType, EmailAddresses: []string{"mailto:security@example.com"}},
+	}
+
+	buf, err := xml.Marshal(test.IDP.Metadata())
+	assert.Assert(t, err)
+	var actual EntityDescriptor
+	assert.Assert(t, xml.Unmarshal(buf, &actual))
+	assert.Check(t, is.DeepEqual(test.IDP.Organization, actual.Organization))
+	assert.Check(t, is.DeepEqual(test.IDP.ContactPeople, actual.ContactPeople))
+}
+
+func TestIDPCanProduceMetadataWithCacheDuration(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	cacheDuration := 6 * time.Hour
+	test.IDP.CacheDuration = &cacheDuration
+
+	md := test.IDP.Metadata()
+	assert.Check(t, is.Equal(TimeNow().Add(DefaultValidDuration), md.ValidUntil))
+	assert.Check(t, is.Equal(cacheDuration, md.CacheDuration))
+
+	test.IDP.OmitValidUntil = true
+	buf, err := xml.Marshal(test.IDP.Metadata())
+	assert.Assert(t, err)
+	assert.Check(t, !strings.Contains(string(buf), "validUntil"), string(buf))
+	assert.Check(t, strings.Contains(string(buf), `cacheDuration="PT6H"`), string(buf))
+}
+
+func TestIDPCanUseItsOwnClock(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	test.IDP.TimeSource = dsig.NewFakeClockAt(now)
+
+	assert.Check(t, is.Equal(now.Add(DefaultValidDuration), test.IDP.Metadata().ValidUntil))
+}
+
+func TestIDPCanProduceSignedMetadata(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	md, err := test.IDP.SignedMetadata()
+	assert.Assert(t, err)
+	buf, err := xml.Marshal(md)
+	assert.Assert(t, err)
+	assert.Check(t, VerifyMetadataSignature(buf, []*x509.Certificate{test.IDP.Certificate}))
+}
+
 func TestIDPHTTPCanHandleMetadataRequest(t *testing.T) {
 	test := NewIdentifyProviderTest(t)
 	w := httptest.NewRecorder()
@@ -289,6 +387,68 @@ func TestIDPCanHandlePostRequestWithExistingSession(t *testing.T) {
 	golden.Assert(t, w.Body.String(), t.Name()+"_http_response_body")
 }
 
+func TestIDPCanRejectRequestsThatFailTheStructureCheck(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	req := IdpAuthnRequest{
+		Now: TimeNow(),
+		IDP: &test.IDP,
+		RequestBuffer: []byte("" +
+			"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+			"  AssertionConsumerServiceURL=\"https://sp.example.com/saml2/acs\" " +
+			"  Destination=\"https://idp.example.com/saml/sso\" " +
+			"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+			"  IssueInstant=\"2015-12-01T01:57:09Z\" ProtocolBinding=\"\" " +
+			"  Version=\"2.0\">" +
+			"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+			"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+			"  <NameIDPolicy xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+			"    AllowCreate=\"true\">urn:oasis:names:tc:SAML:2.0:nameid-format:transient</NameIDPolicy>" +
+			"</AuthnRequest>"),
+	}
+	assert.Check(t, req.Validate())
+
+	test.IDP.StrictStructureCheck = true
+	req.Request = AuthnRequest{}
+	assert.Check(t, is.Error(req.Validate(), "structure check failed: /AuthnRequest/NameIDPolicy: unexpected text content"))
+}
+
+func TestIDPRejectsRequestForOtherSubject(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	test.IDP.SessionProvider = &mockSessionProvider{
+		GetSessionFunc: func(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest) *Session {
+			return &Session{
+				ID:       "f00df00df00d",
+				NameID:   "alice",
+				UserName: "alice",
+			}
+		},
+	}
+
+	serveSSO := func(subject *Subject) int {
+		authRequest, err := test.SP.MakeAuthenticationRequest(test.SP.GetSSOBindingLocation(HTTPRedirectBinding), HTTPRedirectBinding, HTTPPostBinding)
+		assert.Check(t, err)
+		authRequest.Subject = subject
+		authRequestBuf, err := xml.Marshal(authRequest)
+		assert.Check(t, err)
+		q := url.Values{}
+		q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(authRequestBuf))
+		q.Set("RelayState", "ThisIsTheRelayState")
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "https://idp.example.com/saml/sso", strings.NewReader(q.Encode()))
+		r.Header.Set("Content-type", "application/x-www-form-urlencoded")
+		test.IDP.ServeSSO(w, r)
+		return w.Code
+	}
+
+	assert.Check(t, is.Equal(http.StatusOK, serveSSO(&Subject{NameID: &NameID{Value: "alice"}})))
+	assert.Check(t, is.Equal(http.StatusForbidden, serveSSO(&Subject{NameID: &NameID{Value: "bob"}})))
+	assert.Check(t, is.Equal(http.StatusForbidden, serveSSO(&Subject{NameID: &NameID{
+		NameQualifier: "https://other-idp.example.com/saml/metadata",
+		Value:         "alice",
+	}})))
+}
+
 func TestIDPRejectsInvalidRequest(t *testing.T) {
 	test := NewIdentifyProviderTest(t)
 	test.IDP.SessionProvider = &mockSessionProvider{
@@ -334,6 +494,295 @@ func TestIDPCanParse(t *testing.T) {
 	assert.Check(t, is.Error(err, "method not allowed"))
 }
 
+func TestIDPCanParseScoping(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	proxyCount := 0
+	test.SP.Scoping = &Scoping{
+		ProxyCount: &proxyCount,
+		IDPList: &IDPList{
+			IDPEntries: []IDPEntry{{ProviderID: "https://idp.example.com/saml/metadata"}},
+		},
+		RequesterIDs: []string{"https://requester.example.com/"},
+	}
+
+	authRequest, err := test.SP.MakeAuthenticationRequest(test.SP.GetSSOBindingLocation(HTTPRedirectBinding), HTTPRedirectBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	redirectURL, err := authRequest.Redirect("ThisIsTheRelayState", &test.SP)
+	assert.Check(t, err)
+
+	r, _ := http.NewRequest("GET", redirectURL.String(), nil)
+	req, err := NewIdpAuthnRequest(&test.IDP, r)
+	assert.Check(t, err)
+	assert.Check(t, req.Validate())
+	assert.Assert(t, req.Request.Scoping != nil)
+	assert.Check(t, is.Equal(0, *req.Request.Scoping.ProxyCount))
+	assert.Check(t, is.Len(req.Request.Scoping.IDPList.IDPEntries, 1))
+	assert.Check(t, is.Equal("https://idp.example.com/saml/metadata", req.Request.Scoping.IDPList.IDPEntries[0].ProviderID))
+	assert.Check(t, is.DeepEqual([]string{"https://requester.example.com/"}, req.Request.Scoping.RequesterIDs))
+}
+
+func TestIDPCanHandleRequestWithServiceIndexes(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	test.IDP.ServiceProviderProvider = &mockServiceProviderProvider{
+		GetServiceProviderFunc: func(r *http.Request, serviceProviderID string) (*EntityDescriptor, error) {
+			metadata := test.SP.Metadata()
+			metadata.SPSSODescriptors[0].AttributeConsumingServices = []AttributeConsumingService{
+				{
+					Index: 1,
+					RequestedAttributes: []RequestedAttribute{{
+						Attribute: Attribute{
+							FriendlyName: "mail",
+							Name:         "email",
+							NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+						},
+					}},
+				},
+			}
+			return metadata, nil
+		},
+	}
+	acsIndex, attributeIndex := 2, 1
+	test.SP.AssertionConsumerServiceIndex = &acsIndex
+	test.SP.AttributeConsumingServiceIndex = &attributeIndex
+
+	authRequest, err := test.SP.MakeAuthenticationRequest(test.SP.GetSSOBindingLocation(HTTPRedirectBinding), HTTPRedirectBinding, HTTPPostBinding)
+	assert.Assert(t, err)
+	assert.Check(t, is.Equal("", authRequest.AssertionConsumerServiceURL))
+	assert.Check(t, is.Equal("", authRequest.ProtocolBinding))
+	redirectURL, err := authRequest.Redirect("ThisIsTheRelayState", &test.SP)
+	assert.Assert(t, err)
+
+	r, _ := http.NewRequest("GET", redirectURL.String(), nil)
+	req, err := NewIdpAuthnRequest(&test.IDP, r)
+	assert.Assert(t, err)
+	assert.Assert(t, req.Validate())
+	assert.Check(t, is.Equal(2, req.ACSEndpoint.Index))
+	assert.Check(t, is.Equal(HTTPArtifactBinding, req.ACSEndpoint.Binding))
+
+	err = DefaultAssertionMaker{}.MakeAssertion(req, &Session{
+		ID:        "f00df00df00d",
+		NameID:    "alice",
+		UserEmail: "alice@example.com",
+	})
+	assert.Assert(t, err)
+	attributes := req.Assertion.AttributeStatements[0].Attributes
+	assert.Check(t, is.Equal("mail", attributes[0].FriendlyName))
+	assert.Check(t, is.Equal("alice@example.com", attributes[0].Values[0].Value))
+
+	// the attribute consuming service must exist
+	attributeIndex = 3
+	authRequest, err = test.SP.MakeAuthenticationRequest(test.SP.GetSSOBindingLocation(HTTPRedirectBinding), HTTPRedirectBinding, HTTPPostBinding)
+	assert.Assert(t, err)
+	redirectURL, err = authRequest.Redirect("ThisIsTheRelayState", &test.SP)
+	assert.Assert(t, err)
+	r, _ = http.NewRequest("GET", redirectURL.String(), nil)
+	req, err = NewIdpAuthnRequest(&test.IDP, r)
+	assert.Assert(t, err)
+	assert.Check(t, is.Error(req.Validate(), "cannot find attribute consuming service 3"))
+}
+
+func TestIDPCanVerifySignedRequestWithExtensions(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+	spType := etree.NewElement("eidas:SPType")
+	spType.CreateAttr("xmlns:eidas", "http://eidas.europa.eu/saml-extensions")
+	spType.SetText("public")
+	test.SP.AuthnRequestExtensions = []*etree.Element{spType}
+
+	authRequest, err := test.SP.MakeAuthenticationRequest(test.SP.GetSSOBindingLocation(HTTPPostBinding), HTTPPostBinding, HTTPPostBinding)
+	assert.Assert(t, err)
+	doc := etree.NewDocument()
+	doc.SetRoot(authRequest.Element())
+	requestBuffer, err := doc.WriteToBytes()
+	assert.Assert(t, err)
+
+	// the extensions are covered by the signature
+	requestDoc := etree.NewDocument()
+	assert.Assert(t, requestDoc.ReadFromBytes(requestBuffer))
+	assert.Check(t, test.IDP.validateSPSignature(requestDoc.Root(), test.SP.Metadata()))
+
+	var request AuthnRequest
+	assert.Assert(t, xml.Unmarshal(requestBuffer, &request))
+	assert.Assert(t, request.Extensions != nil)
+	assert.Assert(t, is.Len(request.Extensions.Elements, 1))
+	el := request.Extensions.Elements[0]
+	assert.Check(t, is.Equal("SPType", el.Tag))
+	assert.Check(t, is.Equal("http://eidas.europa.eu/saml-extensions", el.SelectAttrValue("xmlns", "")))
+	assert.Check(t, is.Equal("public", el.Text()))
+}
+
+func TestIDPRequiresSignedRequestsWhenSPDeclaresThem(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	makeRequest := func(method string) IdpAuthnRequest {
+		authRequest, err := test.SP.MakeAuthenticationRequest(test.SP.GetSSOBindingLocation(HTTPPostBinding), HTTPPostBinding, HTTPPostBinding)
+		assert.Assert(t, err)
+		doc := etree.NewDocument()
+		doc.SetRoot(authRequest.Element())
+		requestBuffer, err := doc.WriteToBytes()
+		assert.Assert(t, err)
+		req := IdpAuthnRequest{
+			Now:           TimeNow(),
+			IDP:           &test.IDP,
+			RequestBuffer: requestBuffer,
+		}
+		req.HTTPRequest, _ = http.NewRequest(method, "https://idp.example.com/saml/sso", nil)
+		return req
+	}
+
+	// the SP signs its requests and says so in its metadata
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+	req := makeRequest("POST")
+	assert.Check(t, req.Validate())
+
+	// the SP says it signs its requests, but does not
+	test.SP.SignatureMethod = ""
+	authnRequestsSigned := true
+	test.SP.AuthnRequestsSigned = &authnRequestsSigned
+	req = makeRequest("POST")
+	assert.Check(t, is.Error(req.Validate(), "cannot validate signature on AuthnRequest: request is not signed"))
+
+	// unsigned requests are accepted from an SP that does not sign them
+	authnRequestsSigned = false
+	req = makeRequest("POST")
+	assert.Check(t, req.Validate())
+}
+
+func TestIDPCanRequireSignedRedirectRequests(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+	test.IDP.WantAuthnRequestsSigned = true
+	assert.Check(t, is.DeepEqual(true, *test.IDP.Metadata().IDPSSODescriptors[0].WantAuthnRequestsSigned))
+
+	makeRequest := func(relayState string) *url.URL {
+		authRequest, err := test.SP.MakeAuthenticationRequest(test.SP.GetSSOBindingLocation(HTTPRedirectBinding), HTTPRedirectBinding, HTTPPostBinding)
+		assert.Assert(t, err)
+		redirectURL, err := authRequest.Redirect(relayState, &test.SP)
+		assert.Assert(t, err)
+		return redirectURL
+	}
+	validate := func(redirectURL *url.URL) error {
+		r, _ := http.NewRequest("GET", redirectURL.String(), nil)
+		req, err := NewIdpAuthnRequest(&test.IDP, r)
+		assert.Assert(t, err)
+		return req.Validate()
+	}
+
+	// the signature is carried in the query
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+	redirectURL := makeRequest("ThisIsTheRelayState")
+	assert.Check(t, redirectURL.Query().Get("Signature") != "")
+	assert.Check(t, validate(redirectURL))
+
+	// the signature covers the relay state
+	query := redirectURL.Query()
+	query.Set("RelayState", "SomeOtherRelayState")
+	redirectURL.RawQuery = query.Encode()
+	assert.Check(t, is.ErrorContains(validate(redirectURL), "cannot validate signature on AuthnRequest: "))
+
+	// unsigned requests are rejected
+	test.SP.SignatureMethod = ""
+	assert.Check(t, is.Error(validate(makeRequest("ThisIsTheRelayState")),
+		"cannot validate signature on AuthnRequest: request is not signed"))
+}
+
+func TestIDPHonorsWantAssertionsSigned(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	req := IdpAuthnRequest{
+		Now: TimeNow(),
+		IDP: &test.IDP,
+		RequestBuffer: []byte("" +
+			"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+			"  AssertionConsumerServiceURL=\"https://sp.example.com/saml2/acs\" " +
+			"  Destination=\"https://idp.example.com/saml/sso\" " +
+			"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+			"  IssueInstant=\"2015-12-01T01:57:09Z\" ProtocolBinding=\"\" " +
+			"  Version=\"2.0\">" +
+			"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+			"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+			"</AuthnRequest>"),
+	}
+	req.HTTPRequest, _ = http.NewRequest("POST", "https://idp.example.com/saml/sso", nil)
+	assert.Check(t, req.Validate())
+	assert.Check(t, DefaultAssertionMaker{}.MakeAssertion(&req, &Session{ID: "f00df00df00d", UserName: "alice"}))
+	assert.Check(t, req.MakeAssertionEl())
+	assert.Check(t, req.Assertion.Signature != nil)
+
+	// the response is signed, so the assertion need not be
+	wantAssertionsSigned := false
+	test.SP.WantAssertionsSigned = &wantAssertionsSigned
+	assert.Check(t, req.Validate())
+	assert.Check(t, DefaultAssertionMaker{}.MakeAssertion(&req, &Session{ID: "f00df00df00d", UserName: "alice"}))
+	assert.Check(t, req.MakeAssertionEl())
+	assert.Check(t, is.Nil(req.Assertion.Signature))
+	assert.Check(t, req.MakeResponse())
+	assert.Check(t, req.ResponseEl.FindElement("./Signature") != nil)
+}
+
+func TestIDPCanChooseResponseSigning(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	var signing ResponseSigning
+	test.IDP.ServiceProviderProvider = &mockResponseSigningProvider{
+		mockServiceProviderProvider: mockServiceProviderProvider{
+			GetServiceProviderFunc: func(r *http.Request, serviceProviderID string) (*EntityDescriptor, error) {
+				return test.SP.Metadata(), nil
+			},
+		},
+		GetResponseSigningFunc: func(r *http.Request, serviceProviderID string) (ResponseSigning, error) {
+			assert.Check(t, is.Equal("https://sp.example.com/saml2/metadata", serviceProviderID))
+			return signing, nil
+		},
+	}
+
+	makeResponse := func() (assertionSigned bool, responseSigned bool) {
+		req := IdpAuthnRequest{
+			Now: TimeNow(),
+			IDP: &test.IDP,
+			RequestBuffer: []byte("" +
+				"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+				"  AssertionConsumerServiceURL=\"https://sp.example.com/saml2/acs\" " +
+				"  Destination=\"https://idp.example.com/saml/sso\" " +
+				"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+				"  IssueInstant=\"2015-12-01T01:57:09Z\" ProtocolBinding=\"\" " +
+				"  Version=\"2.0\">" +
+				"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+				"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+				"</AuthnRequest>"),
+		}
+		req.HTTPRequest, _ = http.NewRequest("POST", "https://idp.example.com/saml/sso", nil)
+		assert.Check(t, req.Validate())
+		assert.Check(t, DefaultAssertionMaker{}.MakeAssertion(&req, &Session{ID: "f00df00df00d", UserName: "alice"}))
+		assert.Check(t, req.MakeAssertionEl())
+		assert.Check(t, req.MakeResponse())
+		return req.Assertion.Signature != nil, req.ResponseEl.FindElement("./Signature") != nil
+	}
+
+	// by default both are signed
+	assertionSigned, responseSigned := makeResponse()
+	assert.Check(t, assertionSigned)
+	assert.Check(t, responseSigned)
+
+	signing = SignAssertionOnly
+	assertionSigned, responseSigned = makeResponse()
+	assert.Check(t, assertionSigned)
+	assert.Check(t, !responseSigned)
+
+	signing = SignResponseOnly
+	assertionSigned, responseSigned = makeResponse()
+	assert.Check(t, !assertionSigned)
+	assert.Check(t, responseSigned)
+
+	// the choice overrides the metadata of the service provider
+	wantAssertionsSigned := false
+	test.SP.WantAssertionsSigned = &wantAssertionsSigned
+	signing = SignAssertionAndResponse
+	assertionSigned, responseSigned = makeResponse()
+	assert.Check(t, assertionSigned)
+	assert.Check(t, responseSigned)
+}
+
 func TestIDPCanValidate(t *testing.T) {
 	test := NewIdentifyProviderTest(t)
 	req := IdpAuthnRequest{
@@ -672,7 +1121,7 @@ func TestIDPMarshalAssertion(t *testing.T) {
 	assert.Check(t, err)
 
 	// Compare the plaintext first
-	expectedPlaintext := "<saml:Assertion xmlns:saml=\"urn:oasis:names:tc:SAML:2.0:assertion\" ID=\"id-00020406080a0c0e10121416181a1c1e20222426\" IssueInstant=\"2015-12-01T01:57:09Z\" Version=\"2.0\"><saml:Issuer Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://idp.example.com/saml/metadata</saml:Issuer><ds:Signature xmlns:ds=\"http://www.w3.org/2000/09/xmldsig#\"><ds:SignedInfo><ds:CanonicalizationMethod Algorithm=\"http://www.w3.org/2001/10/xml-exc-c14n#\"/><ds:SignatureMethod Algorithm=\"http://www.w3.org/2000/09/xmldsig#rsa-sha1\"/><ds:Reference URI=\"#id-00020406080a0c0e10121416181a1c1e20222426\"><ds:Transforms><ds:Transform Algorithm=\"http://www.w3.org/2000/09/xmldsig#enveloped-signature\"/><ds:Transform Algorithm=\"http://www.w3.org/2001/10/xml-exc-c14n#\"/></ds:Transforms><ds:DigestMethod Algorithm=\"http://www.w3.org/2000/09/xmldsig#sha1\"/><ds:DigestValue>gjE0eLUMVt+kK0rIGYvnzHV/2Ok=</ds:DigestValue></ds:Reference></ds:SignedInfo><ds:SignatureValue>Jm1rrxo2x7SYTnaS97bCdnVLQGeQuCMTjiSUvwzBkWFR+xcPr+n38dXmv0q0R68tO7L2ELhLtBdLm/dWsxruN23TMGVQyHIPMgJExdnYb7fwqx6es/NAdbDUBTbSdMX0vhIlTsHu5F0bJ0Tg0iAo9uRk9VeBdkaxtPa7+4yl1PQ=</ds:SignatureValue><ds:KeyInfo><ds:X509Data><ds:X509Certificate>MIIB7zCCAVgCCQDFzbKIp7b3MTANBgkqhkiG9w0BAQUFADA8MQswCQYDVQQGEwJVUzELMAkGA1UECAwCR0ExDDAKBgNVBAoMA2ZvbzESMBAGA1UEAwwJbG9jYWxob3N0MB4XDTEzMTAwMjAwMDg1MVoXDTE0MTAwMjAwMDg1MVowPDELMAkGA1UEBhMCVVMxCzAJBgNVBAgMAkdBMQwwCgYDVQQKDANmb28xEjAQBgNVBAMMCWxvY2FsaG9zdDCBnzANBgkqhkiG9w0BAQEFAAOBjQAwgYkCgYEA1PMHYmhZj308kWLhZVT4vOulqx/9ibm5B86fPWwUKKQ2i12MYtz07tzukPymisTDhQaqyJ8Kqb/6JjhmeMnEOdTvSPmHO8m1ZVveJU6NoKRn/mP/BD7FW52WhbrUXLSeHVSKfWkNk6S4hk9MV9TswTvyRIKvRsw0X/gfnqkroJcCAwEAATANBgkqhkiG9w0BAQUFAAOBgQCMMlIO+GNcGekevKgkakpMdAqJfs24maGb90DvTLbRZRD7Xvn1MnVBBS9hzlXiFLYOInXACMW5gcoRFfeTQLSouMM8o57h0uKjfTmuoWHLQLi6hnF+cvCsEFiJZ4AbF+DgmO6TarJ8O05t8zvnOwJlNCASPZRH/JmF8tX0hoHuAQ==</ds:X509Certificate></ds:X509Data></ds:KeyInfo></ds:Signature><saml:Subject><saml:NameID Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:transient\" NameQualifier=\"https://idp.example.com/saml/metadata\" SPNameQualifier=\"https://sp.example.com/saml2/metadata\"/><saml:SubjectConfirmation Method=\"urn:oasis:names:tc:SAML:2.0:cm:bearer\"><saml:SubjectConfirmationData InResponseTo=\"id-00020406080a0c0e10121416181a1c1e\" NotOnOrAfter=\"2015-12-01T01:58:39Z\" Recipient=\"https://sp.example.com/saml2/acs\"/></saml:SubjectConfirmation></saml:Subject><saml:Conditions NotBefore=\"2015-12-01T01:57:09Z\" NotOnOrAfter=\"2015-12-01T01:58:39Z\"><saml:AudienceRestriction><saml:Audience>https://sp.example.com/saml2/metadata</saml:Audience></saml:AudienceRestriction></saml:Conditions><saml:AuthnStatement AuthnInstant=\"0001-01-01T00:00:00Z\"><saml:SubjectLocality/><saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef></saml:AuthnContext></saml:AuthnStatement><saml:AttributeStatement><saml:Attribute FriendlyName=\"uid\" Name=\"urn:oid:0.9.2342.19200300.100.1.1\" NameFormat=\"urn:oasis:names:tc:SAML:2.0:attrname-format:uri\"><saml:AttributeValue xmlns:xsi=\"http://www.w3.org/2001/XMLSchema-instance\" xsi:type=\"xs:string\">alice</saml:AttributeValue></saml:Attribute></saml:AttributeStatement></saml:Assertion>"
+	expectedPlaintext := "<saml:Assertion xmlns:saml=\"urn:oasis:names:tc:SAML:2.0:assertion\" ID=\"id-00020406080a0c0e10121416181a1c1e20222426\" IssueInstant=\"2015-12-01T01:57:09Z\" Version=\"2.0\"><saml:Issuer Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://idp.example.com/saml/metadata</saml:Issuer><ds:Signature xmlns:ds=\"http://www.w3.org/2000/09/xmldsig#\"><ds:SignedInfo><ds:CanonicalizationMethod Algorithm=\"http://www.w3.org/2001/10/xml-exc-c14n#\"/><ds:SignatureMethod Algorithm=\"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256\"/><ds:Reference URI=\"#id-00020406080a0c0e10121416181a1c1e20222426\"><ds:Transforms><ds:Transform Algorithm=\"http://www.w3.org/2000/09/xmldsig#enveloped-signature\"/><ds:Transform Algorithm=\"http://www.w3.org/2001/10/xml-exc-c14n#\"/></ds:Transforms><ds:DigestMethod Algorithm=\"http://www.w3.org/2001/04/xmlenc#sha256\"/><ds:DigestValue>EGhYhFSFoO9OqpzlqS2QX/I7FZmPoFsRrbwhsRgX2+M=</ds:DigestValue></ds:Reference></ds:SignedInfo><ds:SignatureValue>hovEcpKNyDPCc9SOj6UQf56k2r2TubTHRLVFNZNZNpeopV6G+QceibdeYEY43ixHWPY14lWaH/EwknWA5ktDAW2hiM78VC0hi2GaXlJ6N7DAdXHlY5LyEUJNL01rMoO5Bwh4gPrzcYxFzltnERcQT56TT/V9p3mFidL/aNJH0aE=</ds:SignatureValue><ds:KeyInfo><ds:X509Data><ds:X509Certificate>MIIB7zCCAVgCCQDFzbKIp7b3MTANBgkqhkiG9w0BAQUFADA8MQswCQYDVQQGEwJVUzELMAkGA1UECAwCR0ExDDAKBgNVBAoMA2ZvbzESMBAGA1UEAwwJbG9jYWxob3N0MB4XDTEzMTAwMjAwMDg1MVoXDTE0MTAwMjAwMDg1MVowPDELMAkGA1UEBhMCVVMxCzAJBgNVBAgMAkdBMQwwCgYDVQQKDANmb28xEjAQBgNVBAMMCWxvY2FsaG9zdDCBnzANBgkqhkiG9w0BAQEFAAOBjQAwgYkCgYEA1PMHYmhZj308kWLhZVT4vOulqx/9ibm5B86fPWwUKKQ2i12MYtz07tzukPymisTDhQaqyJ8Kqb/6JjhmeMnEOdTvSPmHO8m1ZVveJU6NoKRn/mP/BD7FW52WhbrUXLSeHVSKfWkNk6S4hk9MV9TswTvyRIKvRsw0X/gfnqkroJcCAwEAATANBgkqhkiG9w0BAQUFAAOBgQCMMlIO+GNcGekevKgkakpMdAqJfs24maGb90DvTLbRZRD7Xvn1MnVBBS9hzlXiFLYOInXACMW5gcoRFfeTQLSouMM8o57h0uKjfTmuoWHLQLi6hnF+cvCsEFiJZ4AbF+DgmO6TarJ8O05t8zvnOwJlNCASPZRH/JmF8tX0hoHuAQ==</ds:X509Certificate></ds:X509Data></ds:KeyInfo></ds:Signature><saml:Subject><saml:NameID Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:transient\" NameQualifier=\"https://idp.example.com/saml/metadata\" SPNameQualifier=\"https://sp.example.com/saml2/metadata\"/><saml:SubjectConfirmation Method=\"urn:oasis:names:tc:SAML:2.0:cm:bearer\"><saml:SubjectConfirmationData InResponseTo=\"id-00020406080a0c0e10121416181a1c1e\" NotOnOrAfter=\"2015-12-01T01:58:39Z\" Recipient=\"https://sp.example.com/saml2/acs\"/></saml:SubjectConfirmation></saml:Subject><saml:Conditions NotBefore=\"2015-12-01T01:57:09Z\" NotOnOrAfter=\"2015-12-01T01:58:39Z\"><saml:AudienceRestriction><saml:Audience>https://sp.example.com/saml2/metadata</saml:Audience></saml:AudienceRestriction></saml:Conditions><saml:AuthnStatement AuthnInstant=\"0001-01-01T00:00:00Z\"><saml:SubjectLocality/><saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef></saml:AuthnContext></saml:AuthnStatement><saml:AttributeStatement><saml:Attribute FriendlyName=\"uid\" Name=\"urn:oid:0.9.2342.19200300.100.1.1\" NameFormat=\"urn:oasis:names:tc:SAML:2.0:attrname-format:uri\"><saml:AttributeValue xmlns:xsi=\"http://www.w3.org/2001/XMLSchema-instance\" xsi:type=\"xs:string\">alice</saml:AttributeValue></saml:Attribute></saml:AttributeStatement></saml:Assertion>"
 	actualPlaintext := ""
 	{
 		doc := etree.NewDocument()
@@ -691,6 +1140,79 @@ func TestIDPMarshalAssertion(t *testing.T) {
 	golden.Assert(t, string(assertionBuffer), t.Name()+"_encrypted_assertion")
 }
 
+func TestIDPCanChooseAssertionEncryption(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	makeAssertionEl := func() *etree.Element {
+		req := IdpAuthnRequest{
+			Now: TimeNow(),
+			IDP: &test.IDP,
+			RequestBuffer: []byte("" +
+				"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+				"  AssertionConsumerServiceURL=\"https://sp.example.com/saml2/acs\" " +
+				"  Destination=\"https://idp.example.com/saml/sso\" " +
+				"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+				"  IssueInstant=\"2015-12-01T01:57:09Z\" ProtocolBinding=\"\" " +
+				"  Version=\"2.0\">" +
+				"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+				"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+				"</AuthnRequest>"),
+		}
+		req.HTTPRequest, _ = http.NewRequest("POST", "http://idp.example.com/saml/sso", nil)
+		assert.Check(t, req.Validate())
+		assert.Check(t, DefaultAssertionMaker{}.MakeAssertion(&req, &Session{
+			ID:       "f00df00df00d",
+			UserName: "alice",
+		}))
+		assert.Check(t, req.MakeAssertionEl())
+		return req.AssertionEl
+	}
+	checkEncryption := func(assertionEl *etree.Element, blockCipher string, digestMethod string) {
+		assert.Check(t, is.Equal("EncryptedAssertion", assertionEl.Tag))
+		encryptedDataEl := assertionEl.FindElement("./EncryptedData")
+		assert.Check(t, is.Equal(blockCipher, encryptedDataEl.FindElement("./EncryptionMethod").SelectAttrValue("Algorithm", "")))
+		assert.Check(t, is.Equal(digestMethod, encryptedDataEl.FindElement(".//EncryptedKey/EncryptionMethod/DigestMethod").SelectAttrValue("Algorithm", "")))
+		plaintext, err := xmlenc.Decrypt(test.SPKey, encryptedDataEl)
+		assert.Check(t, err)
+		assert.Check(t, is.Contains(string(plaintext), "<saml:Assertion"))
+	}
+
+	// the first supported algorithm in the SP metadata is used
+	test.IDP.ServiceProviderProvider = &mockServiceProviderProvider{
+		GetServiceProviderFunc: func(r *http.Request, serviceProviderID string) (*EntityDescriptor, error) {
+			metadata := test.SP.Metadata()
+			metadata.SPSSODescriptors[0].KeyDescriptors[0].EncryptionMethods = []EncryptionMethod{
+				{Algorithm: "http://www.w3.org/2009/xmlenc11#rsa-oaep"},
+				{Algorithm: "http://www.w3.org/2009/xmlenc11#aes256-gcm"},
+				{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
+			}
+			return metadata, nil
+		},
+	}
+	checkEncryption(makeAssertionEl(), "http://www.w3.org/2009/xmlenc11#aes256-gcm", "http://www.w3.org/2000/09/xmldsig#sha1")
+
+	// the IDP can choose the algorithms for each SP
+	var encryption *AssertionEncryption
+	test.IDP.ServiceProviderProvider = &mockAssertionEncryptionProvider{
+		mockServiceProviderProvider: mockServiceProviderProvider{
+			GetServiceProviderFunc: func(r *http.Request, serviceProviderID string) (*EntityDescriptor, error) {
+				return test.SP.Metadata(), nil
+			},
+		},
+		GetAssertionEncryptionFunc: func(r *http.Request, serviceProviderID string) (*AssertionEncryption, error) {
+			assert.Check(t, is.Equal("https://sp.example.com/saml2/metadata", serviceProviderID))
+			return encryption, nil
+		},
+	}
+	checkEncryption(makeAssertionEl(), "http://www.w3.org/2001/04/xmlenc#aes128-cbc", "http://www.w3.org/2000/09/xmldsig#sha1")
+
+	encryption = &AssertionEncryption{BlockCipher: xmlenc.AES128GCM, DigestMethod: &xmlenc.SHA256}
+	checkEncryption(makeAssertionEl(), "http://www.w3.org/2009/xmlenc11#aes128-gcm", "http://www.w3.org/2001/04/xmlenc#sha256")
+
+	// or turn encryption off
+	encryption = &AssertionEncryption{Disabled: true}
+	assert.Check(t, is.Equal("Assertion", makeAssertionEl().Tag))
+}
+
 func TestIDPMakeResponse(t *testing.T) {
 	test := NewIdentifyProviderTest(t)
 	req := IdpAuthnRequest{
@@ -745,6 +1267,40 @@ func TestIDPWriteResponse(t *testing.T) {
 	golden.Assert(t, w.Body.String(), t.Name()+"response.html")
 }
 
+func TestIDPWriteResponseWithPostForm(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	test.IDP.PostForm = &PostForm{
+		Template: template.Must(template.New("branded").Parse(`<p>Signing you in to {{.URL}}</p>` +
+			`<form method="post" action="{{.URL}}"><input type="hidden" name="{{.Param}}" value="{{.Value}}" />` +
+			`<input type="hidden" name="RelayState" value="{{.RelayState}}" /></form>` +
+			`<script nonce="{{.Nonce}}">document.forms[0].submit();</script>`)),
+	}
+	req := IdpAuthnRequest{
+		Now:           TimeNow(),
+		IDP:           &test.IDP,
+		RelayState:    "THIS_IS_THE_RELAY_STATE",
+		RequestBuffer: golden.Get(t, "TestIDPWriteResponse_RequestBuffer.xml"),
+		ResponseEl:    etree.NewElement("THIS_IS_THE_SAML_RESPONSE"),
+	}
+	req.HTTPRequest, _ = http.NewRequest("POST", "http://idp.example.com/saml/sso", nil)
+	assert.Check(t, req.Validate())
+
+	w := httptest.NewRecorder()
+	assert.Check(t, req.WriteResponse(w))
+	assert.Check(t, is.Equal(200, w.Code))
+	nonce := w.Body.String()[strings.LastIndex(w.Body.String(), `nonce="`)+7:]
+	nonce = nonce[:strings.Index(nonce, `"`)]
+	assert.Check(t, is.Len(nonce, 24))
+	assert.Check(t, is.Equal("default-src 'none'; script-src 'nonce-"+nonce+"'; style-src 'nonce-"+nonce+"'; "+
+		"img-src 'self' data:; base-uri 'none'; frame-ancestors 'none'", w.Header().Get("Content-Security-Policy")))
+	assert.Check(t, is.Equal(""+
+		`<p>Signing you in to https://sp.example.com/saml2/acs</p>`+
+		`<form method="post" action="https://sp.example.com/saml2/acs">`+
+		`<input type="hidden" name="SAMLResponse" value="PFRISVNfSVNfVEhFX1NBTUxfUkVTUE9OU0UvPg==" />`+
+		`<input type="hidden" name="RelayState" value="THIS_IS_THE_RELAY_STATE" /></form>`+
+		`<script nonce="`+nonce+`">document.forms[0].submit();</script>`, w.Body.String()))
+}
+
 func TestIDPIDPInitiatedNewSession(t *testing.T) {
 	test := NewIdentifyProviderTest(t)
 	test.IDP.SessionProvider = &mockSessionProvider{
@@ -1013,3 +1569,527 @@ func TestIDPNoDestination(t *testing.T) {
 	err = req.MakeResponse()
 	assert.Check(t, err)
 }
+
+type mockManageNameIDProvider struct {
+	ManageNameIDFunc func(r *http.Request, serviceProviderID string, req *ManageNameIDRequest) error
+}
+
+func (m *mockManageNameIDProvider) ManageNameID(r *http.Request, serviceProviderID string, req *ManageNameIDRequest) error {
+	return m.ManageNameIDFunc(r, serviceProviderID, req)
+}
+
+func TestIDPCanHandleManageNameIDRequest(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	var gotRequest *ManageNameIDRequest
+	test.IDP.ManageNameIDProvider = &mockManageNameIDProvider{
+		ManageNameIDFunc: func(r *http.Request, serviceProviderID string, req *ManageNameIDRequest) error {
+			assert.Check(t, is.Equal(serviceProviderID, test.SP.MetadataURL.String()))
+			if req.NameID.Value != "alice" {
+				return os.ErrNotExist
+			}
+			gotRequest = req
+			return nil
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(test.IDP.ServeManageNameID))
+	defer server.Close()
+	test.IDP.ManageNameIDURL = mustParseURL(server.URL + "/saml/manage")
+	test.SP.IDPMetadata = test.IDP.Metadata()
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	err := test.SP.ChangeNameID(&NameID{Format: string(PersistentNameIDFormat), Value: "alice"}, "alice-2")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(gotRequest.NewID, "alice-2"))
+	assert.Check(t, is.Nil(gotRequest.Terminate))
+
+	err = test.SP.TerminateNameID(&NameID{Format: string(PersistentNameIDFormat), Value: "alice"})
+	assert.Check(t, err)
+	assert.Check(t, gotRequest.Terminate != nil)
+
+	err = test.SP.TerminateNameID(&NameID{Format: string(PersistentNameIDFormat), Value: "bob"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"urn:oasis:names:tc:SAML:2.0:status:Requester"))
+
+	// unsigned requests are rejected
+	test.SP.SignatureMethod = ""
+	err = test.SP.TerminateNameID(&NameID{Format: string(PersistentNameIDFormat), Value: "alice"})
+	assert.Check(t, is.Error(err, "error during name identifier management: HTTP status 400 (400 Bad Request)"))
+}
+
+func TestIDPCanHandleRedirectManageNameIDRequest(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	test.IDP.ManageNameIDURL = mustParseURL("https://idp.example.com/saml/manage")
+	test.IDP.ManageNameIDProvider = &mockManageNameIDProvider{
+		ManageNameIDFunc: func(r *http.Request, serviceProviderID string, req *ManageNameIDRequest) error {
+			return nil
+		},
+	}
+	test.IDP.ServiceProviderProvider = &mockServiceProviderProvider{
+		GetServiceProviderFunc: func(r *http.Request, serviceProviderID string) (*EntityDescriptor, error) {
+			metadata := test.SP.Metadata()
+			metadata.SPSSODescriptors[0].ManageNameIDServices = []Endpoint{{
+				Binding:  HTTPRedirectBinding,
+				Location: "https://sp.example.com/saml2/manage",
+			}}
+			return metadata, nil
+		},
+	}
+	test.SP.IDPMetadata = test.IDP.Metadata()
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	req, err := test.SP.MakeManageNameIDRequest(test.SP.GetManageNameIDServiceLocation(HTTPRedirectBinding),
+		&NameID{Format: string(PersistentNameIDFormat), Value: "alice"}, "", true)
+	assert.Check(t, err)
+	requestURL, _ := url.Parse(req.Destination)
+	w := &bytes.Buffer{}
+	w1 := base64.NewEncoder(base64.StdEncoding, w)
+	w2, _ := flate.NewWriter(w1, 9)
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Element())
+	_, err = doc.WriteTo(w2)
+	assert.Check(t, err)
+	w2.Close()
+	w1.Close()
+	requestURL.RawQuery = url.Values{"SAMLRequest": {w.String()}, "RelayState": {"state"}}.Encode()
+
+	rw := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", requestURL.String(), nil)
+	test.IDP.ServeManageNameID(rw, r)
+	assert.Check(t, is.Equal(http.StatusFound, rw.Code))
+
+	location, err := url.Parse(rw.Header().Get("Location"))
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(location.Host, "sp.example.com"))
+	assert.Check(t, is.Equal(location.Query().Get("RelayState"), "state"))
+	compressedResponse, err := base64.StdEncoding.DecodeString(location.Query().Get("SAMLResponse"))
+	assert.Check(t, err)
+	responseBuf, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressedResponse)))
+	assert.Check(t, err)
+	resp := ManageNameIDResponse{}
+	assert.Check(t, xml.Unmarshal(responseBuf, &resp))
+	assert.Check(t, is.Equal(resp.InResponseTo, req.ID))
+	assert.Check(t, is.Equal(resp.Status.StatusCode.Value, StatusSuccess))
+
+	// the response is signed in the query
+	assert.Check(t, is.Nil(resp.Signature))
+	assert.Check(t, verifyRedirectSignature(location.RawQuery, []*x509.Certificate{test.IDP.Certificate}, signaturePolicy{}))
+}
+
+func TestIDPCanHandleQuerySignedManageNameIDRequest(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	var gotRequest *ManageNameIDRequest
+	test.IDP.ManageNameIDURL = mustParseURL("https://idp.example.com/saml/manage")
+	test.IDP.ManageNameIDProvider = &mockManageNameIDProvider{
+		ManageNameIDFunc: func(r *http.Request, serviceProviderID string, req *ManageNameIDRequest) error {
+			gotRequest = req
+			return nil
+		},
+	}
+	test.IDP.ServiceProviderProvider = &mockServiceProviderProvider{
+		GetServiceProviderFunc: func(r *http.Request, serviceProviderID string) (*EntityDescriptor, error) {
+			metadata := test.SP.Metadata()
+			metadata.SPSSODescriptors[0].ManageNameIDServices = []Endpoint{{
+				Binding:  HTTPRedirectBinding,
+				Location: "https://sp.example.com/saml2/manage",
+			}}
+			return metadata, nil
+		},
+	}
+	test.SP.IDPMetadata = test.IDP.Metadata()
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	req, err := test.SP.MakeManageNameIDRequest(test.SP.GetManageNameIDServiceLocation(HTTPRedirectBinding),
+		&NameID{Format: string(PersistentNameIDFormat), Value: "alice"}, "alice-2", false)
+	assert.Check(t, err)
+	unsignedReq := *req
+	unsignedReq.Signature = nil
+	requestURL, err := test.SP.redirectURL(req.Destination, "SAMLRequest", unsignedReq.Element(), "state")
+	assert.Check(t, err)
+
+	rw := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", requestURL.String(), nil)
+	test.IDP.ServeManageNameID(rw, r)
+	assert.Check(t, is.Equal(http.StatusFound, rw.Code))
+	assert.Assert(t, gotRequest != nil)
+	assert.Check(t, is.Equal("alice-2", gotRequest.NewID))
+
+	location, err := url.Parse(rw.Header().Get("Location"))
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("state", location.Query().Get("RelayState")))
+	assert.Check(t, verifyRedirectSignature(location.RawQuery, []*x509.Certificate{test.IDP.Certificate}, signaturePolicy{}))
+
+	// a request whose query was tampered with is rejected
+	gotRequest = nil
+	tamperedURL := strings.Replace(requestURL.String(), "RelayState=state", "RelayState=other", 1)
+	rw = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", tamperedURL, nil)
+	test.IDP.ServeManageNameID(rw, r)
+	assert.Check(t, is.Equal(http.StatusBadRequest, rw.Code))
+	assert.Check(t, is.Nil(gotRequest))
+}
+
+func TestIDPCanResolveArtifact(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	server := httptest.NewServer(http.HandlerFunc(test.IDP.ServeArtifactResolve))
+	defer server.Close()
+	test.IDP.ArtifactResolutionURL = mustParseURL(server.URL + "/saml/artifact")
+	test.IDP.ArtifactStore = &MemoryArtifactStore{}
+	test.SP.IDPMetadata = test.IDP.Metadata()
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	writeArtifact := func() *http.Request {
+		req := IdpAuthnRequest{
+			Now:                     TimeNow(),
+			IDP:                     &test.IDP,
+			RelayState:              "THIS_IS_THE_RELAY_STATE",
+			Request:                 AuthnRequest{ID: "id-00020406080a0c0e10121416181a1c1e20222426"},
+			ServiceProviderMetadata: test.SP.Metadata(),
+			ACSEndpoint: &IndexedEndpoint{
+				Binding:  HTTPArtifactBinding,
+				Location: test.SP.AcsURL.String(),
+			},
+		}
+		req.SPSSODescriptor = &req.ServiceProviderMetadata.SPSSODescriptors[0]
+		req.HTTPRequest, _ = http.NewRequest("GET", "https://idp.example.com/saml/sso", nil)
+		err := DefaultAssertionMaker{}.MakeAssertion(&req, &Session{
+			ID:       "f00df00df00d",
+			UserName: "alice",
+		})
+		assert.Check(t, err)
+
+		w := httptest.NewRecorder()
+		err = req.WriteResponse(w)
+		assert.Check(t, err)
+		assert.Check(t, is.Equal(http.StatusFound, w.Code))
+
+		r, _ := http.NewRequest("GET", w.Header().Get("Location"), nil)
+		assert.Check(t, r.ParseForm())
+		assert.Check(t, is.Equal(test.SP.AcsURL.Host, r.URL.Host))
+		assert.Check(t, is.Equal("THIS_IS_THE_RELAY_STATE", r.Form.Get("RelayState")))
+		return r
+	}
+
+	r := writeArtifact()
+	assertion, err := test.SP.ParseResponse(r, []string{"id-00020406080a0c0e10121416181a1c1e20222426"})
+	assert.Check(t, err)
+	assert.Assert(t, assertion != nil)
+	assert.Check(t, is.Equal(test.IDP.MetadataURL.String(), assertion.Issuer.Value))
+
+	// artifacts can only be resolved once
+	_, err = test.SP.ParseResponse(r, []string{"id-00020406080a0c0e10121416181a1c1e20222426"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "missing inner Response"))
+
+	// unsigned requests are rejected
+	r = writeArtifact()
+	test.SP.SignatureMethod = ""
+	_, err = test.SP.ParseResponse(r, []string{"id-00020406080a0c0e10121416181a1c1e20222426"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"Error during artifact resolution: HTTP status 400 (400 Bad Request)"))
+}
+
+func TestIDPAndSPCanSignWithECDSAKeys(t *testing.T) {
+	for _, tc := range []struct {
+		Name            string
+		KeyFile         string
+		CertFile        string
+		SignatureMethod string
+		SignatureSize   int
+	}{
+		{"P256", "ec_p256_key.pem", "ec_p256_cert.pem", dsig.ECDSASHA256SignatureMethod, 64},
+		{"P384", "ec_p384_key.pem", "ec_p384_cert.pem", dsig.ECDSASHA384SignatureMethod, 96},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			test := NewIdentifyProviderTest(t)
+			key := mustParsePrivateKey(golden.Get(t, tc.KeyFile))
+			cert := mustParseCertificate(golden.Get(t, tc.CertFile))
+			Clock = dsig.NewFakeClockAt(cert.NotBefore)
+
+			test.IDP.Key = key
+			test.IDP.Certificate = cert
+			test.IDP.SignatureMethod = tc.SignatureMethod
+			test.SP.IDPMetadata = test.IDP.Metadata()
+
+			// an EC key cannot be used for encryption
+			keyDescriptors := test.SP.IDPMetadata.IDPSSODescriptors[0].KeyDescriptors
+			assert.Check(t, is.Len(keyDescriptors, 1))
+			assert.Check(t, is.Equal("signing", keyDescriptors[0].Use))
+
+			// the IDP signs assertions with its EC key
+			req := IdpAuthnRequest{
+				Now:                     TimeNow(),
+				IDP:                     &test.IDP,
+				Request:                 AuthnRequest{ID: "id-00020406080a0c0e10121416181a1c1e20222426"},
+				ServiceProviderMetadata: test.SP.Metadata(),
+				ACSEndpoint: &IndexedEndpoint{
+					Binding:  HTTPPostBinding,
+					Location: test.SP.AcsURL.String(),
+				},
+			}
+			req.SPSSODescriptor = &req.ServiceProviderMetadata.SPSSODescriptors[0]
+			req.HTTPRequest, _ = http.NewRequest("GET", "https://idp.example.com/saml/sso", nil)
+			err := DefaultAssertionMaker{}.MakeAssertion(&req, &Session{
+				ID:       "f00df00df00d",
+				UserName: "alice",
+			})
+			assert.Check(t, err)
+			assert.Check(t, req.MakeAssertionEl())
+
+			signatureValue := req.AssertionEl.FindElement("./Signature/SignatureValue")
+			if signatureValue == nil {
+				plaintext, err := xmlenc.Decrypt(test.SPKey, req.AssertionEl.FindElement("./EncryptedData"))
+				assert.Assert(t, err)
+				doc := etree.NewDocument()
+				assert.Assert(t, doc.ReadFromBytes(plaintext))
+				signatureValue = doc.Root().FindElement("./Signature/SignatureValue")
+			}
+			assert.Assert(t, signatureValue != nil)
+			rawSignature, err := base64.StdEncoding.DecodeString(signatureValue.Text())
+			assert.Check(t, err)
+			assert.Check(t, is.Len(rawSignature, tc.SignatureSize))
+
+			assert.Check(t, req.MakeResponse())
+			doc := etree.NewDocument()
+			doc.SetRoot(req.ResponseEl)
+			responseBuf, err := doc.WriteToBytes()
+			assert.Check(t, err)
+
+			assertion, err := test.SP.ParseXMLResponse(responseBuf, []string{req.Request.ID})
+			assert.Check(t, err)
+			assert.Assert(t, assertion != nil)
+			assert.Check(t, is.Equal(test.IDP.MetadataURL.String(), assertion.Issuer.Value))
+
+			// the SP signs requests with its EC key, and the IDP signs its
+			// responses
+			var gotRequest *ManageNameIDRequest
+			test.IDP.ManageNameIDProvider = &mockManageNameIDProvider{
+				ManageNameIDFunc: func(r *http.Request, serviceProviderID string, req *ManageNameIDRequest) error {
+					gotRequest = req
+					return nil
+				},
+			}
+			server := httptest.NewServer(http.HandlerFunc(test.IDP.ServeManageNameID))
+			defer server.Close()
+			test.IDP.ManageNameIDURL = mustParseURL(server.URL + "/saml/manage")
+			test.SP.IDPMetadata = test.IDP.Metadata()
+			test.SP.Key = key
+			test.SP.Certificate = cert
+			test.SP.SignatureMethod = tc.SignatureMethod
+
+			spKeyDescriptors := test.SP.Metadata().SPSSODescriptors[0].KeyDescriptors
+			assert.Check(t, is.Len(spKeyDescriptors, 1))
+			assert.Check(t, is.Equal("signing", spKeyDescriptors[0].Use))
+
+			err = test.SP.TerminateNameID(&NameID{Format: string(PersistentNameIDFormat), Value: "alice"})
+			assert.Check(t, err)
+			assert.Assert(t, gotRequest != nil)
+			assert.Check(t, gotRequest.Terminate != nil)
+
+			// an RSA signature method cannot be used with an EC key
+			test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+			err = test.SP.TerminateNameID(&NameID{Format: string(PersistentNameIDFormat), Value: "alice"})
+			assert.Check(t, err != nil)
+		})
+	}
+}
+
+// opaqueSigner hides the type of the wrapped key, as is the case for keys
+// held in an HSM or a cloud KMS.
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestIDPAndSPCanSignWithCryptoSigner(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+	test.IDP.Key = opaqueSigner{test.Key.(crypto.Signer)}
+	test.IDP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	var gotRequest *ManageNameIDRequest
+	test.IDP.ManageNameIDProvider = &mockManageNameIDProvider{
+		ManageNameIDFunc: func(r *http.Request, serviceProviderID string, req *ManageNameIDRequest) error {
+			gotRequest = req
+			return nil
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(test.IDP.ServeManageNameID))
+	defer server.Close()
+	test.IDP.ManageNameIDURL = mustParseURL(server.URL + "/saml/manage")
+	test.SP.IDPMetadata = test.IDP.Metadata()
+	test.SP.Key = opaqueSigner{test.SPKey}
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	err := test.SP.TerminateNameID(&NameID{Format: string(PersistentNameIDFormat), Value: "alice"})
+	assert.Check(t, err)
+	assert.Assert(t, gotRequest != nil)
+	assert.Check(t, gotRequest.Terminate != nil)
+
+	// the certificate must match the key
+	test.SP.Certificate = mustParseCertificate(golden.Get(t, "cert_2017.pem"))
+	err = test.SP.TerminateNameID(&NameID{Format: string(PersistentNameIDFormat), Value: "alice"})
+	assert.Check(t, is.Error(err, "certificate does not match the signing key"))
+}
+
+func TestIDPAndSPCanUseCertificateChains(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	intermediate := mustParseCertificate(golden.Get(t, "idp_intermediate_cert.pem"))
+	test.IDP.Certificate = mustParseCertificate(golden.Get(t, "idp_chain_cert.pem"))
+	test.IDP.Intermediates = []*x509.Certificate{intermediate}
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	// the metadata carries the whole chain, one certificate per element
+	metadata := test.IDP.Metadata()
+	for _, keyDescriptor := range metadata.IDPSSODescriptors[0].KeyDescriptors {
+		certs := keyDescriptor.KeyInfo.X509Data.X509Certificates
+		assert.Assert(t, is.Len(certs, 2))
+		assert.Check(t, is.Equal(base64.StdEncoding.EncodeToString(test.IDP.Certificate.Raw), certs[0].Data))
+		assert.Check(t, is.Equal(base64.StdEncoding.EncodeToString(intermediate.Raw), certs[1].Data))
+	}
+	test.SP.IDPMetadata = metadata
+
+	signingContext, err := test.IDP.signingContext()
+	assert.Assert(t, err)
+	el := etree.NewElement("Response")
+	el.CreateAttr("ID", "id-9e61753d64e928af5a7a341a97f420c9")
+	signedEl, err := signingContext.SignEnveloped(el)
+	assert.Assert(t, err)
+
+	// the leaf is accepted wherever it appears in the KeyInfo, which is
+	// not covered by the signature
+	x509DataEl := signedEl.FindElement("./Signature/KeyInfo/X509Data")
+	certEls := x509DataEl.SelectElements("X509Certificate")
+	assert.Assert(t, is.Len(certEls, 2))
+	x509DataEl.RemoveChild(certEls[1])
+	x509DataEl.InsertChildAt(certEls[0].Index(), certEls[1])
+	assert.Check(t, test.SP.validateSignature(signedEl.Copy()))
+
+	// the intermediate did not make the signature
+	x509DataEl.RemoveChild(certEls[0])
+	assert.Check(t, test.SP.validateSignature(signedEl.Copy()) != nil)
+
+	// the SP publishes its chain the same way
+	test.SP.Intermediates = []*x509.Certificate{intermediate}
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+	for _, keyDescriptor := range test.SP.Metadata().SPSSODescriptors[0].KeyDescriptors {
+		assert.Check(t, is.Len(keyDescriptor.KeyInfo.X509Data.X509Certificates, 2))
+	}
+}
+
+func TestIDPCanHandleECPRequest(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	test.IDP.ECPURL = mustParseURL("https://idp.example.com/saml/ecp")
+	test.IDP.ECPAuthenticator = BasicAuthECPAuthenticator(func(r *http.Request, username, password string) *Session {
+		if username != "alice" || password != "hunter2" {
+			return nil
+		}
+		return &Session{
+			ID:       "f00df00df00d",
+			UserName: "alice",
+		}
+	})
+	test.SP.AllowECP = true
+	test.SP.IDPMetadata = test.IDP.Metadata()
+
+	// the SP answers the ECP client with a PAOS request...
+	authnRequest, err := test.SP.MakeAuthenticationRequest(test.SP.GetSSOBindingLocation(SOAPBinding), SOAPBinding, PAOSBinding)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://idp.example.com/saml/ecp", authnRequest.Destination))
+	doc := etree.NewDocument()
+	doc.SetRoot(authnRequest.PAOSRequest("THIS_IS_THE_RELAY_STATE"))
+
+	// ...which the client forwards to the IDP without the header blocks
+	doc.Root().RemoveChildAt(0)
+	requestBuf, err := doc.WriteToBytes()
+	assert.Check(t, err)
+
+	r, _ := http.NewRequest("POST", "https://idp.example.com/saml/ecp", bytes.NewReader(requestBuf))
+	w := httptest.NewRecorder()
+	test.IDP.ServeECP(w, r)
+	assert.Check(t, is.Equal(http.StatusUnauthorized, w.Code))
+	assert.Check(t, is.Equal(`Basic realm="idp.example.com"`, w.Header().Get("WWW-Authenticate")))
+
+	r, _ = http.NewRequest("POST", "https://idp.example.com/saml/ecp", bytes.NewReader(requestBuf))
+	r.SetBasicAuth("alice", "hunter2")
+	w = httptest.NewRecorder()
+	test.IDP.ServeECP(w, r)
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+	doc = etree.NewDocument()
+	assert.Check(t, doc.ReadFromBytes(w.Body.Bytes()))
+	ecpResponseEl := doc.FindElement("Envelope/Header/Response")
+	assert.Assert(t, ecpResponseEl != nil)
+	assert.Check(t, is.Equal(test.SP.AcsURL.String(), ecpResponseEl.SelectAttrValue("AssertionConsumerServiceURL", "")))
+
+	// the client then delivers the response to the SP using PAOS
+	header := doc.FindElement("Envelope/Header")
+	header.RemoveChild(ecpResponseEl)
+	relayStateEl := header.CreateElement("ecp:RelayState")
+	relayStateEl.CreateAttr("xmlns:ecp", ECPProfile)
+	relayStateEl.SetText("THIS_IS_THE_RELAY_STATE")
+	responseBuf, err := doc.WriteToBytes()
+	assert.Check(t, err)
+
+	r, _ = http.NewRequest("POST", test.SP.AcsURL.String(), bytes.NewReader(responseBuf))
+	r.Header.Set("Content-Type", PAOSContentType)
+	assertion, relayState, err := test.SP.ParseECPResponse(r, []string{authnRequest.ID})
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("THIS_IS_THE_RELAY_STATE", relayState))
+	assert.Assert(t, assertion != nil)
+	assert.Check(t, is.Equal(test.IDP.MetadataURL.String(), assertion.Issuer.Value))
+
+	// service providers without a PAOS endpoint are rejected
+	test.SP.AllowECP = false
+	r, _ = http.NewRequest("POST", "https://idp.example.com/saml/ecp", bytes.NewReader(requestBuf))
+	r.SetBasicAuth("alice", "hunter2")
+	w = httptest.NewRecorder()
+	test.IDP.ServeECP(w, r)
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+}
+
+func TestIDPCanAddDelegates(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	req := IdpAuthnRequest{
+		Now: TimeNow(),
+		IDP: &test.IDP,
+		RequestBuffer: []byte("" +
+			"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+			"  AssertionConsumerServiceURL=\"https://sp.example.com/saml2/acs\" " +
+			"  Destination=\"https://idp.example.com/saml/sso\" " +
+			"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+			"  IssueInstant=\"2015-12-01T01:57:09Z\" ProtocolBinding=\"\" " +
+			"  Version=\"2.0\">" +
+			"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+			"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+			"</AuthnRequest>"),
+	}
+	req.HTTPRequest, _ = http.NewRequest("POST", "https://idp.example.com/saml/sso", nil)
+	assert.Check(t, req.Validate())
+
+	err := DefaultAssertionMaker{}.MakeAssertion(&req, &Session{ID: "f00df00df00d", UserName: "alice"})
+	assert.Check(t, err)
+	assert.Check(t, is.Nil(req.Assertion.Conditions.DelegationRestriction))
+
+	delegates := []Delegate{
+		{NameID: &NameID{Value: "https://upstream.example.com/"}},
+		{DelegationInstant: TimeNow(), NameID: &NameID{Value: "https://idp.example.com/saml/metadata"}},
+	}
+	err = DefaultAssertionMaker{}.MakeAssertion(&req, &Session{ID: "f00df00df00d", UserName: "alice", Delegates: delegates})
+	assert.Check(t, err)
+
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Assertion.Element())
+	buf, err := doc.WriteToBytes()
+	assert.Assert(t, err)
+	var assertion Assertion
+	assert.Assert(t, xml.Unmarshal(buf, &assertion))
+	assert.Check(t, is.DeepEqual(&DelegationRestriction{Delegates: delegates}, assertion.Conditions.DelegationRestriction))
+}
@@ -2,9 +2,14 @@ package saml
 
 import (
 	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
 )
 
 // HTTPPostBinding is the official URN for the HTTP-POST binding (transport)
@@ -19,6 +24,9 @@ const HTTPArtifactBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"
 // SOAPBinding is the official URN for the SOAP binding (transport)
 const SOAPBinding = "urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
 
+// PAOSBinding is the official URN for the Reverse SOAP (PAOS) binding (transport)
+const PAOSBinding = "urn:oasis:names:tc:SAML:2.0:bindings:PAOS"
+
 // EntitiesDescriptor represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf §2.3.1
@@ -52,6 +60,7 @@ type EntityDescriptor struct {
 	ValidUntil                    time.Time     `xml:"validUntil,attr,omitempty"`
 	CacheDuration                 time.Duration `xml:"cacheDuration,attr,omitempty"`
 	Signature                     *etree.Element
+	Extensions                    *MetadataExtensions
 	RoleDescriptors               []RoleDescriptor               `xml:"RoleDescriptor"`
 	IDPSSODescriptors             []IDPSSODescriptor             `xml:"IDPSSODescriptor"`
 	SPSSODescriptors              []SPSSODescriptor              `xml:"SPSSODescriptor"`
@@ -60,22 +69,36 @@ type EntityDescriptor struct {
 	PDPDescriptors                []PDPDescriptor                `xml:"PDPDescriptor"`
 	AffiliationDescriptor         *AffiliationDescriptor
 	Organization                  *Organization
-	ContactPerson                 *ContactPerson
-	AdditionalMetadataLocations   []string `xml:"AdditionalMetadataLocation"`
+	ContactPeople                 []ContactPerson `xml:"ContactPerson"`
+	AdditionalMetadataLocations   []string        `xml:"AdditionalMetadataLocation"`
+
+	// AnyElements and AnyAttrs hold the elements and attributes of the
+	// entity descriptor that are not modeled above, so that they survive a
+	// round trip.
+	AnyElements []AnyElement `xml:",any"`
+	AnyAttrs    []xml.Attr   `xml:",any,attr"`
 }
 
 // MarshalXML implements xml.Marshaler
 func (m EntityDescriptor) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
 	type Alias EntityDescriptor
 	aux := &struct {
-		ValidUntil    RelaxedTime `xml:"validUntil,attr,omitempty"`
-		CacheDuration Duration    `xml:"cacheDuration,attr,omitempty"`
+		ValidUntil    *RelaxedTime `xml:"validUntil,attr,omitempty"`
+		CacheDuration Duration     `xml:"cacheDuration,attr,omitempty"`
+		Signature     *AnyElement  `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
 		*Alias
 	}{
-		ValidUntil:    RelaxedTime(m.ValidUntil),
 		CacheDuration: Duration(m.CacheDuration),
 		Alias:         (*Alias)(&m),
 	}
+	if !m.ValidUntil.IsZero() {
+		validUntil := RelaxedTime(m.ValidUntil)
+		aux.ValidUntil = &validUntil
+	}
+	if m.Signature != nil {
+		aux.Signature = &AnyElement{Element: m.Signature}
+		m.Signature = nil
+	}
 	return e.Encode(aux)
 }
 
@@ -85,6 +108,7 @@ func (m *EntityDescriptor) UnmarshalXML(d *xml.Decoder, start xml.StartElement)
 	aux := &struct {
 		ValidUntil    RelaxedTime `xml:"validUntil,attr,omitempty"`
 		CacheDuration Duration    `xml:"cacheDuration,attr,omitempty"`
+		Signature     *AnyElement `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
 		*Alias
 	}{
 		Alias: (*Alias)(m),
@@ -94,6 +118,34 @@ func (m *EntityDescriptor) UnmarshalXML(d *xml.Decoder, start xml.StartElement)
 	}
 	m.ValidUntil = time.Time(aux.ValidUntil)
 	m.CacheDuration = time.Duration(aux.CacheDuration)
+	m.AnyAttrs = withoutNamespaceDeclarations(m.AnyAttrs)
+	if aux.Signature != nil {
+		m.Signature = aux.Signature.Element
+	}
+	return nil
+}
+
+// signMetadata adds an enveloped signature made with signingContext to
+// md, assigning md an ID read from randReader to refer to if it has none.
+func signMetadata(md *EntityDescriptor, signingContext *dsig.SigningContext, randReader io.Reader) error {
+	if md.ID == "" {
+		md.ID = fmt.Sprintf("id-%x", randomBytesFrom(randReader, 20))
+	}
+	md.Signature = nil
+
+	buf, err := xml.Marshal(md)
+	if err != nil {
+		return err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return err
+	}
+	signedEl, err := signingContext.SignEnveloped(doc.Root())
+	if err != nil {
+		return err
+	}
+	md.Signature = signedEl.Child[len(signedEl.Child)-1].(*etree.Element)
 	return nil
 }
 
@@ -124,16 +176,45 @@ type LocalizedURI struct {
 
 // ContactPerson represents the SAML element ContactPerson.
 //
+// ContactType is one of "technical", "support", "administrative", "billing"
+// or "other". A security contact is of type "other" and has
+// RemdContactType set to REFEDSSecurityContactType.
+//
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf §2.3.2.2
 type ContactPerson struct {
-	ContactType      string `xml:"contactType,attr"`
-	Company          string
-	GivenName        string
-	SurName          string
+	ContactType      string   `xml:"contactType,attr"`
+	RemdContactType  string   `xml:"http://refeds.org/metadata contactType,attr,omitempty"`
+	Company          string   `xml:",omitempty"`
+	GivenName        string   `xml:",omitempty"`
+	SurName          string   `xml:",omitempty"`
 	EmailAddresses   []string `xml:"EmailAddress"`
 	TelephoneNumbers []string `xml:"TelephoneNumber"`
 }
 
+// UnmarshalXML implements xml.Unmarshaler
+func (c *ContactPerson) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias ContactPerson
+	if err := d.DecodeElement((*Alias)(c), &start); err != nil {
+		return err
+	}
+
+	// encoding/xml matches contactType in any namespace, so the
+	// remd:contactType would otherwise replace it
+	c.ContactType = ""
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "" && attr.Name.Local == "contactType" {
+			c.ContactType = attr.Value
+		}
+	}
+	return nil
+}
+
+// REFEDSSecurityContactType is the remd:contactType of security contacts,
+// as defined by the REFEDS Security Contact Metadata Extension.
+//
+// See https://refeds.org/metadata/contactType/security
+const REFEDSSecurityContactType = "http://refeds.org/metadata/contactType/security"
+
 // RoleDescriptor represents the SAML element RoleDescriptor.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf §2.4.1
@@ -144,11 +225,271 @@ type RoleDescriptor struct {
 	ProtocolSupportEnumeration string        `xml:"protocolSupportEnumeration,attr"`
 	ErrorURL                   string        `xml:"errorURL,attr,omitempty"`
 	Signature                  *etree.Element
+	Extensions                 *MetadataExtensions
 	KeyDescriptors             []KeyDescriptor `xml:"KeyDescriptor,omitempty"`
 	Organization               *Organization   `xml:"Organization,omitempty"`
 	ContactPeople              []ContactPerson `xml:"ContactPerson,omitempty"`
 }
 
+// MetadataExtensions represents the md:Extensions element of an entity or
+// role descriptor, which carries the extensions that are not part of the
+// SAML metadata schema.
+type MetadataExtensions struct {
+	XMLName        xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
+	UIInfo         *UIInfo         `xml:"urn:oasis:names:tc:SAML:metadata:ui UIInfo"`
+	DigestMethods  []DigestMethod  `xml:"urn:oasis:names:tc:SAML:metadata:algsupport DigestMethod"`
+	SigningMethods []SigningMethod `xml:"urn:oasis:names:tc:SAML:metadata:algsupport SigningMethod"`
+	Scopes         []Scope         `xml:"urn:mace:shibboleth:metadata:1.0 Scope"`
+
+	EntityAttributes *EntityAttributes `xml:"urn:oasis:names:tc:SAML:metadata:attribute EntityAttributes"`
+	RegistrationInfo *RegistrationInfo `xml:"urn:oasis:names:tc:SAML:metadata:rpi RegistrationInfo"`
+}
+
+// AlgorithmSupportNamespace is the namespace of the Metadata Profile for
+// Algorithm Support.
+const AlgorithmSupportNamespace = "urn:oasis:names:tc:SAML:metadata:algsupport"
+
+// DigestMethod represents the alg:DigestMethod element, a digest algorithm
+// that an entity supports, in order of preference.
+//
+// See https://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-metadata-algsupport-v1.0.pdf §2.2
+type DigestMethod struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:metadata:algsupport DigestMethod"`
+	Algorithm string   `xml:"Algorithm,attr"`
+}
+
+// SigningMethod represents the alg:SigningMethod element, a signature
+// algorithm that an entity supports, in order of preference, and the sizes
+// of the keys it supports the algorithm with.
+//
+// See https://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-metadata-algsupport-v1.0.pdf §2.3
+type SigningMethod struct {
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:metadata:algsupport SigningMethod"`
+	Algorithm  string   `xml:"Algorithm,attr"`
+	MinKeySize int      `xml:"MinKeySize,attr,omitempty"`
+	MaxKeySize int      `xml:"MaxKeySize,attr,omitempty"`
+}
+
+// UIInfoNamespace is the namespace of the Metadata Extensions for Login and
+// Discovery User Interface.
+const UIInfoNamespace = "urn:oasis:names:tc:SAML:metadata:ui"
+
+// UIInfo represents the mdui:UIInfo element, which describes an entity to
+// the users of login and discovery interfaces in their language.
+//
+// See https://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-metadata-ui/v1.0/sstc-saml-metadata-ui-v1.0.pdf §2.1
+type UIInfo struct {
+	XMLName              xml.Name        `xml:"urn:oasis:names:tc:SAML:metadata:ui UIInfo"`
+	DisplayNames         []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui DisplayName"`
+	Descriptions         []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui Description"`
+	Keywords             []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui Keywords"`
+	Logos                []Logo          `xml:"urn:oasis:names:tc:SAML:metadata:ui Logo"`
+	InformationURLs      []LocalizedURI  `xml:"urn:oasis:names:tc:SAML:metadata:ui InformationURL"`
+	PrivacyStatementURLs []LocalizedURI  `xml:"urn:oasis:names:tc:SAML:metadata:ui PrivacyStatementURL"`
+}
+
+// Logo represents the mdui:Logo element, the URL of a logo of an entity
+// and its size in pixels. Lang is empty if the logo is suitable for all
+// languages.
+type Logo struct {
+	Lang   string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Height int    `xml:"height,attr"`
+	Width  int    `xml:"width,attr"`
+	Value  string `xml:",chardata"`
+}
+
+// DisplayName returns the display name of the entity in lang, or in
+// English if there is none in lang, or else the first one. It returns an
+// empty string if the entity has no display names.
+func (u *UIInfo) DisplayName(lang string) string {
+	return localizedValue(u.DisplayNames, lang)
+}
+
+// Description returns the description of the entity in lang. See
+// DisplayName.
+func (u *UIInfo) Description(lang string) string {
+	return localizedValue(u.Descriptions, lang)
+}
+
+func localizedValue(names []LocalizedName, lang string) string {
+	for _, preferred := range []string{lang, "en"} {
+		for _, name := range names {
+			if name.Lang == preferred {
+				return name.Value
+			}
+		}
+	}
+	if len(names) > 0 {
+		return names[0].Value
+	}
+	return ""
+}
+
+// SigningMethods returns the signature algorithms that the entity declares
+// support for in its metadata, either for the entity as a whole or for its
+// identity provider role, in order of preference. It returns nil if the
+// entity does not declare any.
+func (m *EntityDescriptor) SigningMethods() []SigningMethod {
+	var rv []SigningMethod
+	if m.Extensions != nil {
+		rv = append(rv, m.Extensions.SigningMethods...)
+	}
+	for _, descriptor := range m.IDPSSODescriptors {
+		if descriptor.Extensions != nil {
+			rv = append(rv, descriptor.Extensions.SigningMethods...)
+		}
+	}
+	return rv
+}
+
+// ShibbolethMetadataNamespace is the namespace of the Shibboleth metadata
+// extensions.
+const ShibbolethMetadataNamespace = "urn:mace:shibboleth:metadata:1.0"
+
+// Scope represents the shibmd:Scope element, a scope, i.e. the domain
+// part of values such as user@example.org, that an identity provider is
+// authorized to assert. If Regexp is true, Value is a regular expression
+// that the scope must match.
+type Scope struct {
+	Regexp bool   `xml:"regexp,attr,omitempty"`
+	Value  string `xml:",chardata"`
+}
+
+// Matches returns true if scope is authorized by s.
+func (s Scope) Matches(scope string) bool {
+	if !s.Regexp {
+		return strings.EqualFold(s.Value, scope)
+	}
+	re, err := regexp.Compile(s.Value)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(scope)
+}
+
+// Scopes returns the shibmd:Scope extensions of the entity and of its
+// IDPSSODescriptors, which are the scopes that the identity provider
+// described by m is authorized to assert.
+func (m *EntityDescriptor) Scopes() []Scope {
+	var rv []Scope
+	if m.Extensions != nil {
+		rv = append(rv, m.Extensions.Scopes...)
+	}
+	for _, descriptor := range m.IDPSSODescriptors {
+		if descriptor.Extensions != nil {
+			rv = append(rv, descriptor.Extensions.Scopes...)
+		}
+	}
+	return rv
+}
+
+// EntityAttributesNamespace is the namespace of the Metadata Extension for
+// Entity Attributes.
+const EntityAttributesNamespace = "urn:oasis:names:tc:SAML:metadata:attribute"
+
+// RegistrationInfoNamespace is the namespace of the Metadata Extensions for
+// Registration and Publication Information.
+const RegistrationInfoNamespace = "urn:oasis:names:tc:SAML:metadata:rpi"
+
+// EntityCategoryAttributeName is the name of the entity attribute whose
+// values are the entity categories that an entity is a member of.
+const EntityCategoryAttributeName = "http://macedir.org/entity-category"
+
+// EntityCategorySupportAttributeName is the name of the entity attribute
+// whose values are the entity categories that an identity provider
+// supports, i.e. releases the attributes of to service providers that are
+// members of them.
+const EntityCategorySupportAttributeName = "http://macedir.org/entity-category-support"
+
+// REFEDSResearchAndScholarshipCategory is the REFEDS Research and
+// Scholarship entity category.
+const REFEDSResearchAndScholarshipCategory = "http://refeds.org/category/research-and-scholarship"
+
+// EntityAttributes represents the mdattr:EntityAttributes element, which
+// carries attributes of an entity, such as the entity categories that it
+// is a member of.
+type EntityAttributes struct {
+	XMLName    xml.Name    `xml:"urn:oasis:names:tc:SAML:metadata:attribute EntityAttributes"`
+	Attributes []Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+}
+
+// RegistrationInfo represents the mdrpi:RegistrationInfo element, which
+// names the federation that registered an entity, and the policies under
+// which it did.
+type RegistrationInfo struct {
+	XMLName               xml.Name       `xml:"urn:oasis:names:tc:SAML:metadata:rpi RegistrationInfo"`
+	RegistrationAuthority string         `xml:"registrationAuthority,attr"`
+	RegistrationInstant   *time.Time     `xml:"registrationInstant,attr,omitempty"`
+	RegistrationPolicies  []LocalizedURI `xml:"urn:oasis:names:tc:SAML:metadata:rpi RegistrationPolicy"`
+}
+
+// EntityAttributes returns the mdattr:EntityAttributes of the entity
+// described by m.
+func (m *EntityDescriptor) EntityAttributes() []Attribute {
+	if m.Extensions == nil || m.Extensions.EntityAttributes == nil {
+		return nil
+	}
+	return m.Extensions.EntityAttributes.Attributes
+}
+
+// EntityAttributeValues returns the values of the entity attribute called
+// name of the entity described by m.
+func (m *EntityDescriptor) EntityAttributeValues(name string) []string {
+	var rv []string
+	for _, attribute := range m.EntityAttributes() {
+		if attribute.Name != name {
+			continue
+		}
+		for _, value := range attribute.Values {
+			rv = append(rv, value.Value)
+		}
+	}
+	return rv
+}
+
+// EntityCategories returns the entity categories that the entity
+// described by m is a member of.
+func (m *EntityDescriptor) EntityCategories() []string {
+	return m.EntityAttributeValues(EntityCategoryAttributeName)
+}
+
+// HasEntityCategory returns true if the entity described by m is a member
+// of category.
+func (m *EntityDescriptor) HasEntityCategory(category string) bool {
+	for _, value := range m.EntityCategories() {
+		if value == category {
+			return true
+		}
+	}
+	return false
+}
+
+// RegistrationInfo returns the mdrpi:RegistrationInfo of the entity
+// described by m, or nil if there is none.
+func (m *EntityDescriptor) RegistrationInfo() *RegistrationInfo {
+	if m.Extensions == nil {
+		return nil
+	}
+	return m.Extensions.RegistrationInfo
+}
+
+// UIInfo returns the mdui:UIInfo of the identity provider or, if the entity
+// is not an identity provider, the service provider described by m, or nil
+// if there is none.
+func (m *EntityDescriptor) UIInfo() *UIInfo {
+	for _, descriptor := range m.IDPSSODescriptors {
+		if descriptor.Extensions != nil && descriptor.Extensions.UIInfo != nil {
+			return descriptor.Extensions.UIInfo
+		}
+	}
+	for _, descriptor := range m.SPSSODescriptors {
+		if descriptor.Extensions != nil && descriptor.Extensions.UIInfo != nil {
+			return descriptor.Extensions.UIInfo
+		}
+	}
+	return nil
+}
+
 // KeyDescriptor represents the XMLSEC object of the same name
 type KeyDescriptor struct {
 	Use               string             `xml:"use,attr"`
@@ -218,14 +559,62 @@ type IDPSSODescriptor struct {
 	SSODescriptor
 	WantAuthnRequestsSigned *bool `xml:",attr"`
 
-	SingleSignOnServices       []Endpoint  `xml:"SingleSignOnService"`
-	ArtifactResolutionServices []Endpoint  `xml:"ArtifactResolutionService"`
+	SingleSignOnServices []Endpoint `xml:"SingleSignOnService"`
+
+	// ArtifactResolutionServices are the ArtifactResolutionServices of
+	// SSODescriptor without their indexes. They are filled in when the
+	// descriptor is unmarshaled, and ignored when it is marshaled. If
+	// SSODescriptor has no ArtifactResolutionServices, the service provider
+	// resolves artifacts against these instead, taking the position of each
+	// endpoint as its index.
+	//
+	// Deprecated: Use SSODescriptor.ArtifactResolutionServices, which
+	// artifacts are resolved against by their EndpointIndex.
+	ArtifactResolutionServices []Endpoint `xml:"-"`
+
 	NameIDMappingServices      []Endpoint  `xml:"NameIDMappingService"`
 	AssertionIDRequestServices []Endpoint  `xml:"AssertionIDRequestService"`
 	AttributeProfiles          []string    `xml:"AttributeProfile"`
 	Attributes                 []Attribute `xml:"Attribute"`
 }
 
+// UnmarshalXML implements xml.Unmarshaler
+func (m *IDPSSODescriptor) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias IDPSSODescriptor
+	if err := d.DecodeElement((*Alias)(m), &start); err != nil {
+		return err
+	}
+
+	m.ArtifactResolutionServices = nil
+	for _, e := range m.SSODescriptor.ArtifactResolutionServices {
+		endpoint := Endpoint{Binding: e.Binding, Location: e.Location}
+		if e.ResponseLocation != nil {
+			endpoint.ResponseLocation = *e.ResponseLocation
+		}
+		m.ArtifactResolutionServices = append(m.ArtifactResolutionServices, endpoint)
+	}
+	return nil
+}
+
+// artifactResolutionServices returns the ArtifactResolutionServices of
+// SSODescriptor, or else those of the deprecated ArtifactResolutionServices
+// field, indexed by their position.
+func (m *IDPSSODescriptor) artifactResolutionServices() []IndexedEndpoint {
+	if len(m.SSODescriptor.ArtifactResolutionServices) > 0 {
+		return m.SSODescriptor.ArtifactResolutionServices
+	}
+	var rv []IndexedEndpoint
+	for i, e := range m.ArtifactResolutionServices {
+		endpoint := IndexedEndpoint{Binding: e.Binding, Location: e.Location, Index: i}
+		if e.ResponseLocation != "" {
+			responseLocation := e.ResponseLocation
+			endpoint.ResponseLocation = &responseLocation
+		}
+		rv = append(rv, endpoint)
+	}
+	return rv
+}
+
 // SPSSODescriptor represents the SAML SPSSODescriptorType object.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf §2.4.2
@@ -87,6 +87,128 @@ func TestCanParseMetadata(t *testing.T) {
 
 }
 
+func TestCanParseUIInfo(t *testing.T) {
+	buf := golden.Get(t, "TestCanParseUIInfo_metadata.xml")
+
+	metadata := EntityDescriptor{}
+	err := xml.Unmarshal(buf, &metadata)
+	assert.Check(t, err)
+
+	uiInfo := metadata.UIInfo()
+	assert.Assert(t, uiInfo != nil)
+	assert.Check(t, is.Equal("Beispieluniversität", uiInfo.DisplayName("de")))
+	assert.Check(t, is.Equal("Example University", uiInfo.DisplayName("fr")))
+	assert.Check(t, is.Equal("Login for members of Example University", uiInfo.Description("de")))
+	assert.Check(t, is.DeepEqual([]Logo{
+		{Height: 16, Width: 16, Value: "https://idp.example.com/favicon.png"},
+		{Lang: "en", Height: 60, Width: 80, Value: "https://idp.example.com/logo.png"},
+	}, uiInfo.Logos))
+	assert.Check(t, is.DeepEqual([]LocalizedURI{{Lang: "en", Value: "https://example.com/about"}}, uiInfo.InformationURLs))
+	assert.Check(t, is.DeepEqual([]LocalizedURI{{Lang: "en", Value: "https://example.com/privacy"}}, uiInfo.PrivacyStatementURLs))
+
+	assert.Check(t, is.Nil((&EntityDescriptor{}).UIInfo()))
+}
+
+func TestCanParseAlgorithmSupport(t *testing.T) {
+	buf := []byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:alg="urn:oasis:names:tc:SAML:metadata:algsupport" entityID="https://idp.example.com/saml/metadata">
+  <md:Extensions>
+    <alg:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>
+    <alg:SigningMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256" MinKeySize="2048"/>
+  </md:Extensions>
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:Extensions>
+      <alg:SigningMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"/>
+    </md:Extensions>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`)
+
+	metadata := EntityDescriptor{}
+	err := xml.Unmarshal(buf, &metadata)
+	assert.Check(t, err)
+
+	assert.Check(t, is.DeepEqual([]DigestMethod{{
+		XMLName:   xml.Name{Space: AlgorithmSupportNamespace, Local: "DigestMethod"},
+		Algorithm: "http://www.w3.org/2001/04/xmlenc#sha256",
+	}}, metadata.Extensions.DigestMethods))
+	assert.Check(t, is.DeepEqual([]SigningMethod{
+		{
+			XMLName:    xml.Name{Space: AlgorithmSupportNamespace, Local: "SigningMethod"},
+			Algorithm:  "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256",
+			MinKeySize: 2048,
+		},
+		{
+			XMLName:   xml.Name{Space: AlgorithmSupportNamespace, Local: "SigningMethod"},
+			Algorithm: "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256",
+		},
+	}, metadata.SigningMethods()))
+}
+
+func TestCanParseScopes(t *testing.T) {
+	buf := []byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:shibmd="urn:mace:shibboleth:metadata:1.0" entityID="https://idp.example.com/saml/metadata">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:Extensions>
+      <shibmd:Scope regexp="false">example.com</shibmd:Scope>
+      <shibmd:Scope regexp="true">^.+\.example\.org$</shibmd:Scope>
+    </md:Extensions>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`)
+
+	metadata := EntityDescriptor{}
+	err := xml.Unmarshal(buf, &metadata)
+	assert.Check(t, err)
+
+	scopes := metadata.Scopes()
+	assert.Check(t, is.DeepEqual([]Scope{
+		{Value: "example.com"},
+		{Regexp: true, Value: `^.+\.example\.org$`},
+	}, scopes))
+	assert.Check(t, scopes[0].Matches("Example.com"))
+	assert.Check(t, !scopes[0].Matches("sub.example.com"))
+	assert.Check(t, scopes[1].Matches("sub.example.org"))
+	assert.Check(t, !scopes[1].Matches("example.org"))
+	assert.Check(t, !scopes[1].Matches("sub.example.org.evil.com"))
+}
+
+func TestCanParseEntityAttributes(t *testing.T) {
+	buf := []byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:mdattr="urn:oasis:names:tc:SAML:metadata:attribute" xmlns:mdrpi="urn:oasis:names:tc:SAML:metadata:rpi" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" entityID="https://idp.example.com/saml/metadata">
+  <md:Extensions>
+    <mdrpi:RegistrationInfo registrationAuthority="https://federation.example.org" registrationInstant="2015-12-01T00:00:00Z">
+      <mdrpi:RegistrationPolicy xml:lang="en">https://federation.example.org/policy</mdrpi:RegistrationPolicy>
+    </mdrpi:RegistrationInfo>
+    <mdattr:EntityAttributes>
+      <saml:Attribute Name="http://macedir.org/entity-category" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:uri">
+        <saml:AttributeValue>http://refeds.org/category/research-and-scholarship</saml:AttributeValue>
+      </saml:Attribute>
+      <saml:Attribute Name="http://macedir.org/entity-category-support" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:uri">
+        <saml:AttributeValue>http://refeds.org/category/research-and-scholarship</saml:AttributeValue>
+        <saml:AttributeValue>https://refeds.org/category/code-of-conduct/v2</saml:AttributeValue>
+      </saml:Attribute>
+    </mdattr:EntityAttributes>
+  </md:Extensions>
+</md:EntityDescriptor>`)
+
+	metadata := EntityDescriptor{}
+	err := xml.Unmarshal(buf, &metadata)
+	assert.Check(t, err)
+
+	assert.Check(t, is.Len(metadata.EntityAttributes(), 2))
+	assert.Check(t, is.DeepEqual([]string{REFEDSResearchAndScholarshipCategory}, metadata.EntityCategories()))
+	assert.Check(t, metadata.HasEntityCategory(REFEDSResearchAndScholarshipCategory))
+	assert.Check(t, !metadata.HasEntityCategory("https://refeds.org/category/code-of-conduct/v2"))
+	assert.Check(t, is.DeepEqual([]string{
+		REFEDSResearchAndScholarshipCategory,
+		"https://refeds.org/category/code-of-conduct/v2",
+	}, metadata.EntityAttributeValues(EntityCategorySupportAttributeName)))
+
+	registrationInstant := time.Date(2015, 12, 1, 0, 0, 0, 0, time.UTC)
+	assert.Check(t, is.DeepEqual(&RegistrationInfo{
+		XMLName:               xml.Name{Space: RegistrationInfoNamespace, Local: "RegistrationInfo"},
+		RegistrationAuthority: "https://federation.example.org",
+		RegistrationInstant:   &registrationInstant,
+		RegistrationPolicies:  []LocalizedURI{{Lang: "en", Value: "https://federation.example.org/policy"}},
+	}, metadata.RegistrationInfo()))
+}
+
 func TestCanProduceSPMetadata(t *testing.T) {
 	validUntil, _ := time.Parse("2006-02-01T15:04:05.000000", "2013-10-03T00:32:19.104000")
 	AuthnRequestsSigned := true
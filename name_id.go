@@ -0,0 +1,235 @@
+package saml
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ErrInvalidNameIDPolicy is matched with errors.Is by the errors returned
+// when the NameIDPolicy of a request cannot be honored, because it asks for
+// a format that the IDP does not issue, or for a persistent identifier
+// that does not exist yet without allowing it to be created. The IDP
+// responds to such requests with the InvalidNameIDPolicy status.
+var ErrInvalidNameIDPolicy = errors.New("saml: invalid NameIDPolicy")
+
+// ErrUnsupportedNameIDFormat is matched with errors.Is, along with
+// ErrInvalidNameIDPolicy, by the error returned when the NameIDPolicy of a
+// request asks for a format that the IDP does not issue.
+var ErrUnsupportedNameIDFormat = errors.New("saml: unsupported NameID format")
+
+// NameIDGenerator is an interface used by IdentityProvider to make the
+// NameID of the subject of the assertions it issues. See
+// DefaultNameIDGenerator.
+type NameIDGenerator interface {
+	// NameIDFormats returns the formats of the NameIDs that the generator
+	// makes, which are published in the metadata of the IDP.
+	NameIDFormats() []NameIDFormat
+
+	// MakeNameID returns the NameID of the principal of session in the
+	// assertion issued in response to req.
+	MakeNameID(req *IdpAuthnRequest, session *Session) (*NameID, error)
+}
+
+// PersistentNameIDStore is an interface used by DefaultNameIDGenerator to
+// look up the persistent identifiers of principals, which are pairwise:
+// each service provider knows a principal by a different identifier.
+//
+// DefaultNameIDGenerator passes create as true unless the request has a
+// NameIDPolicy that does not set AllowCreate to true, so requests without
+// a NameIDPolicy, such as IDP-initiated ones, may create identifiers. It
+// passes false when it only checks an identifier that the request names.
+type PersistentNameIDStore interface {
+	// PersistentNameID returns the persistent identifier of principal at
+	// the service provider spEntityID. If there is none, it assigns one if
+	// create is true, and otherwise returns os.ErrNotExist. A store that
+	// derives identifiers rather than assigning them always has one, and
+	// so never returns os.ErrNotExist.
+	PersistentNameID(ctx context.Context, principal string, spEntityID string, create bool) (string, error)
+}
+
+// HashedPersistentNameIDs is a PersistentNameIDStore that derives the
+// persistent identifier of a principal at a service provider from a keyed
+// hash of both with Salt, so that it need not be stored. Salt must be kept
+// secret and must not change, or the identifiers change with it.
+//
+// Every principal has an identifier at every service provider, so create
+// makes no difference.
+type HashedPersistentNameIDs struct {
+	Salt []byte
+}
+
+// PersistentNameID implements PersistentNameIDStore.
+func (s HashedPersistentNameIDs) PersistentNameID(ctx context.Context, principal string, spEntityID string, create bool) (string, error) {
+	if len(s.Salt) == 0 {
+		return "", errors.New("HashedPersistentNameIDs requires a salt")
+	}
+	mac := hmac.New(sha256.New, s.Salt)
+	mac.Write([]byte(spEntityID + "!" + principal))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// MemoryPersistentNameIDStore is a PersistentNameIDStore that keeps random
+// persistent identifiers in memory. It is intended for testing; a real
+// deployment must store the mappings durably.
+type MemoryPersistentNameIDStore struct {
+	mu      sync.Mutex
+	nameIDs map[string]string
+}
+
+// PersistentNameID implements PersistentNameIDStore.
+func (s *MemoryPersistentNameIDStore) PersistentNameID(ctx context.Context, principal string, spEntityID string, create bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := spEntityID + "!" + principal
+	if nameID, ok := s.nameIDs[key]; ok {
+		return nameID, nil
+	}
+	if !create {
+		return "", os.ErrNotExist
+	}
+	if s.nameIDs == nil {
+		s.nameIDs = map[string]string{}
+	}
+	nameID := fmt.Sprintf("id-%x", randomBytes(20))
+	s.nameIDs[key] = nameID
+	return nameID, nil
+}
+
+// DefaultNameIDGenerator makes transient, persistent and email address
+// NameIDs, in the format that the NameIDPolicy of the request asks for or,
+// if it asks for none, in the first of Formats that the service provider
+// lists in its metadata, or else the first of Formats.
+//
+// Transient identifiers are random. If TransientKey is set, they are
+// derived from a keyed hash of the session ID and the service provider
+// instead, so that a service provider knows the principal by the same
+// identifier for the life of the session, and by another one in the next.
+//
+// Persistent identifiers are looked up in PersistentNameIDs for the
+// UserName of the session, or its NameID if it has no UserName. If there is
+// none yet, one is created unless the request has a NameIDPolicy that does
+// not allow it.
+type DefaultNameIDGenerator struct {
+	// Formats are the formats that the generator makes, in order of
+	// preference. The default is transient, followed by persistent if
+	// PersistentNameIDs is set.
+	Formats []NameIDFormat
+
+	PersistentNameIDs PersistentNameIDStore
+	TransientKey      []byte
+}
+
+// NameIDFormats implements NameIDGenerator.
+func (g DefaultNameIDGenerator) NameIDFormats() []NameIDFormat {
+	if len(g.Formats) > 0 {
+		return g.Formats
+	}
+	if g.PersistentNameIDs != nil {
+		return []NameIDFormat{TransientNameIDFormat, PersistentNameIDFormat}
+	}
+	return []NameIDFormat{TransientNameIDFormat}
+}
+
+// MakeNameID implements NameIDGenerator.
+func (g DefaultNameIDGenerator) MakeNameID(req *IdpAuthnRequest, session *Session) (*NameID, error) {
+	format, err := g.nameIDFormat(req)
+	if err != nil {
+		return nil, err
+	}
+
+	spEntityID := req.ServiceProviderMetadata.EntityID
+	nameID := &NameID{
+		Format:          string(format),
+		NameQualifier:   req.IDP.Metadata().EntityID,
+		SPNameQualifier: spEntityID,
+	}
+	switch format {
+	case TransientNameIDFormat:
+		if len(g.TransientKey) == 0 {
+			nameID.Value = fmt.Sprintf("id-%x", req.IDP.randomBytes(20))
+			break
+		}
+		mac := hmac.New(sha256.New, g.TransientKey)
+		mac.Write([]byte(session.ID + "!" + spEntityID))
+		nameID.Value = fmt.Sprintf("id-%x", mac.Sum(nil)[:20])
+	case PersistentNameIDFormat:
+		if g.PersistentNameIDs == nil {
+			return nil, unsupportedNameIDFormatError(format)
+		}
+		principal := firstSet(session.UserName, session.NameID)
+		policy := req.Request.NameIDPolicy
+		create := policy == nil || (policy.AllowCreate != nil && *policy.AllowCreate)
+		nameID.Value, err = g.PersistentNameIDs.PersistentNameID(req.HTTPRequest.Context(), principal, spEntityID, create)
+		if err != nil && !create && errors.Is(err, os.ErrNotExist) {
+			return nil, errorOfKind(ErrInvalidNameIDPolicy, "%s has no persistent NameID at %s and the request does not allow one to be created: %w",
+				principal, spEntityID, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot find persistent NameID of %s at %s: %w", principal, spEntityID, err)
+		}
+	case EmailAddressNameIDFormat:
+		if session.UserEmail == "" {
+			return nil, fmt.Errorf("session has no email address")
+		}
+		nameID = &NameID{Format: string(format), Value: session.UserEmail}
+	default:
+		return nil, unsupportedNameIDFormatError(format)
+	}
+	return nameID, nil
+}
+
+// nameIDFormat returns the format of the NameID issued in response to req.
+func (g DefaultNameIDGenerator) nameIDFormat(req *IdpAuthnRequest) (NameIDFormat, error) {
+	formats := g.NameIDFormats()
+	format, err := requestedNameIDFormat(req, formats)
+	if err != nil || format != "" {
+		return format, err
+	}
+	if req.SPSSODescriptor != nil {
+		for _, format := range req.SPSSODescriptor.NameIDFormats {
+			if containsNameIDFormat(formats, format) {
+				return format, nil
+			}
+		}
+	}
+	return formats[0], nil
+}
+
+// requestedNameIDFormat returns the format that the NameIDPolicy of req asks
+// for, or an empty string if it asks for none in particular. It returns an
+// error that matches ErrInvalidNameIDPolicy if the format is not one of
+// formats.
+func requestedNameIDFormat(req *IdpAuthnRequest, formats []NameIDFormat) (NameIDFormat, error) {
+	policy := req.Request.NameIDPolicy
+	if policy == nil || policy.Format == nil || *policy.Format == "" ||
+		NameIDFormat(*policy.Format) == UnspecifiedNameIDFormat {
+		return "", nil
+	}
+	format := NameIDFormat(*policy.Format)
+	if !containsNameIDFormat(formats, format) {
+		return "", unsupportedNameIDFormatError(format)
+	}
+	return format, nil
+}
+
+// unsupportedNameIDFormatError returns the error that tells that format is
+// not supported, which matches both ErrInvalidNameIDPolicy and
+// ErrUnsupportedNameIDFormat.
+func unsupportedNameIDFormatError(format NameIDFormat) error {
+	return errorOfKind(ErrInvalidNameIDPolicy, "%w: %s", ErrUnsupportedNameIDFormat, format)
+}
+
+func containsNameIDFormat(formats []NameIDFormat, format NameIDFormat) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package saml
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func newNameIDTestRequest(t *testing.T, test *IdentityProviderTest, nameIDPolicy string) *IdpAuthnRequest {
+	req := &IdpAuthnRequest{
+		Now: TimeNow(),
+		IDP: &test.IDP,
+		RequestBuffer: []byte("" +
+			"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " +
+			"  AssertionConsumerServiceURL=\"https://sp.example.com/saml2/acs\" " +
+			"  Destination=\"https://idp.example.com/saml/sso\" " +
+			"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+			"  IssueInstant=\"2015-12-01T01:57:09Z\" ProtocolBinding=\"\" " +
+			"  Version=\"2.0\">" +
+			"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+			"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+			nameIDPolicy +
+			"</AuthnRequest>"),
+	}
+	req.HTTPRequest, _ = http.NewRequest("POST", "http://idp.example.com/saml/sso", nil)
+	assert.Check(t, req.Validate())
+	return req
+}
+
+func TestDefaultNameIDGeneratorTransient(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	req := newNameIDTestRequest(t, test, "")
+	session := &Session{ID: "f00df00df00d", UserName: "alice"}
+
+	generator := DefaultNameIDGenerator{}
+	nameID, err := generator.MakeNameID(req, session)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(string(TransientNameIDFormat), nameID.Format))
+	assert.Check(t, is.Equal("https://idp.example.com/saml/metadata", nameID.NameQualifier))
+	assert.Check(t, is.Equal("https://sp.example.com/saml2/metadata", nameID.SPNameQualifier))
+	otherNameID, err := generator.MakeNameID(req, session)
+	assert.Check(t, err)
+	assert.Check(t, nameID.Value != otherNameID.Value)
+
+	// with a key, the identifier lasts as long as the session
+	generator.TransientKey = []byte("transient key")
+	nameID, err = generator.MakeNameID(req, session)
+	assert.Check(t, err)
+	otherNameID, err = generator.MakeNameID(req, session)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(nameID.Value, otherNameID.Value))
+	otherNameID, err = generator.MakeNameID(req, &Session{ID: "ba5eba11", UserName: "alice"})
+	assert.Check(t, err)
+	assert.Check(t, nameID.Value != otherNameID.Value)
+}
+
+func TestDefaultNameIDGeneratorPersistent(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	session := &Session{ID: "f00df00df00d", UserName: "alice"}
+	generator := DefaultNameIDGenerator{
+		PersistentNameIDs: HashedPersistentNameIDs{Salt: []byte("salt")},
+	}
+
+	req := newNameIDTestRequest(t, test, ""+
+		"<NameIDPolicy xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" "+
+		"  Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:persistent\"/>")
+	nameID, err := generator.MakeNameID(req, session)
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(&NameID{
+		Format:          string(PersistentNameIDFormat),
+		NameQualifier:   "https://idp.example.com/saml/metadata",
+		SPNameQualifier: "https://sp.example.com/saml2/metadata",
+		Value:           "v9qGZLOIdhunXHNwJ88XSSLz3DqPNJkuGXiA0PhAdXo=",
+	}, nameID))
+
+	// the identifiers are pairwise
+	otherNameID, err := HashedPersistentNameIDs{Salt: []byte("salt")}.PersistentNameID(
+		req.HTTPRequest.Context(), "alice", "https://other.example.com/metadata", true)
+	assert.Check(t, err)
+	assert.Check(t, nameID.Value != otherNameID)
+
+	// a request without a NameIDPolicy gets the first format that the
+	// service provider lists in its metadata
+	req = newNameIDTestRequest(t, test, "")
+	req.SPSSODescriptor.NameIDFormats = []NameIDFormat{EmailAddressNameIDFormat, PersistentNameIDFormat}
+	nameID, err = generator.MakeNameID(req, session)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(string(PersistentNameIDFormat), nameID.Format))
+
+	// stored identifiers are only created if the request allows it
+	generator.PersistentNameIDs = &MemoryPersistentNameIDStore{}
+	req = newNameIDTestRequest(t, test, ""+
+		"<NameIDPolicy xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" "+
+		"  Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:persistent\" AllowCreate=\"false\"/>")
+	_, err = generator.MakeNameID(req, session)
+	assert.Check(t, errors.Is(err, os.ErrNotExist))
+	assert.Check(t, errors.Is(err, ErrInvalidNameIDPolicy))
+
+	req = newNameIDTestRequest(t, test, ""+
+		"<NameIDPolicy xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" "+
+		"  Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:persistent\" AllowCreate=\"true\"/>")
+	nameID, err = generator.MakeNameID(req, session)
+	assert.Check(t, err)
+	sameNameID, err := generator.MakeNameID(req, session)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(nameID.Value, sameNameID.Value))
+
+	// or if it has no NameIDPolicy
+	req = newNameIDTestRequest(t, test, "")
+	req.SPSSODescriptor.NameIDFormats = []NameIDFormat{PersistentNameIDFormat}
+	nameID, err = generator.MakeNameID(req, &Session{ID: "ba5eba11", UserName: "bob"})
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(string(PersistentNameIDFormat), nameID.Format))
+}
+
+func TestDefaultNameIDGeneratorRejectsUnsupportedFormat(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	req := newNameIDTestRequest(t, test, ""+
+		"<NameIDPolicy xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" "+
+		"  Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:persistent\"/>")
+	_, err := DefaultNameIDGenerator{}.MakeNameID(req, &Session{ID: "f00df00df00d", UserName: "alice"})
+	assert.Check(t, errors.Is(err, ErrUnsupportedNameIDFormat))
+	assert.Check(t, errors.Is(err, ErrInvalidNameIDPolicy))
+
+	// the IDP without a NameIDGenerator only issues transient identifiers
+	assert.Check(t, errors.Is(req.ValidateNameIDPolicy(), ErrInvalidNameIDPolicy))
+	err = DefaultAssertionMaker{}.MakeAssertion(req, &Session{ID: "f00df00df00d", UserName: "alice"})
+	assert.Check(t, errors.Is(err, ErrInvalidNameIDPolicy))
+}
+
+func TestIDPMakeAssertionWithNameIDGenerator(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	test.IDP.NameIDGenerator = DefaultNameIDGenerator{
+		PersistentNameIDs: HashedPersistentNameIDs{Salt: []byte("salt")},
+	}
+	assert.Check(t, is.DeepEqual([]NameIDFormat{TransientNameIDFormat, PersistentNameIDFormat},
+		test.IDP.Metadata().IDPSSODescriptors[0].NameIDFormats))
+
+	req := newNameIDTestRequest(t, test, ""+
+		"<NameIDPolicy xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" "+
+		"  Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:persistent\"/>")
+	session := &Session{ID: "f00df00df00d", UserName: "alice", NameID: "alice"}
+	assert.Check(t, DefaultAssertionMaker{}.MakeAssertion(req, session))
+	assert.Check(t, is.Equal("v9qGZLOIdhunXHNwJ88XSSLz3DqPNJkuGXiA0PhAdXo=", req.Assertion.Subject.NameID.Value))
+
+	// requests for the subject by its persistent identifier are answered
+	req.Request.Subject = &Subject{NameID: &NameID{
+		Format: string(PersistentNameIDFormat),
+		Value:  "v9qGZLOIdhunXHNwJ88XSSLz3DqPNJkuGXiA0PhAdXo=",
+	}}
+	assert.Check(t, req.ValidateSubject(session))
+	req.Request.Subject.NameID.Value = "bob"
+	assert.Check(t, is.ErrorContains(req.ValidateSubject(session), "request is for subject"))
+
+	// checking the subject does not create a persistent identifier
+	store := &MemoryPersistentNameIDStore{}
+	test.IDP.NameIDGenerator = DefaultNameIDGenerator{PersistentNameIDs: store}
+	req = newNameIDTestRequest(t, test, "")
+	req.Request.Subject = &Subject{NameID: &NameID{Format: string(PersistentNameIDFormat), Value: "id-1234"}}
+	req.SPSSODescriptor.NameIDFormats = []NameIDFormat{PersistentNameIDFormat}
+	assert.Check(t, is.ErrorContains(req.ValidateSubject(session), "request is for subject"))
+	_, err := store.PersistentNameID(req.HTTPRequest.Context(), "alice", "https://sp.example.com/saml2/metadata", false)
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+}
+
+func TestIDPRespondsWithInvalidNameIDPolicy(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	test.SP.AuthnNameIDFormat = PersistentNameIDFormat
+	sessions := 0
+	test.IDP.SessionProvider = &mockSessionProvider{
+		GetSessionFunc: func(w http.ResponseWriter, r *http.Request, req *IdpAuthnRequest) *Session {
+			sessions++
+			return &Session{ID: "f00df00df00d", UserName: "alice"}
+		},
+	}
+	serveSSO := func() *Response {
+		requestURL, err := test.SP.MakeRedirectAuthenticationRequest("ThisIsTheRelayState")
+		assert.Check(t, err)
+		r, _ := http.NewRequest("GET", requestURL.String(), nil)
+		w := httptest.NewRecorder()
+		test.IDP.ServeSSO(w, r)
+		assert.Check(t, is.Equal(http.StatusOK, w.Code))
+
+		rs := regexp.MustCompile(`name="SAMLResponse" value="(.*?)"`).FindStringSubmatch(w.Body.String())
+		assert.Assert(t, is.Len(rs, 2))
+		buf, err := base64.StdEncoding.DecodeString(html.UnescapeString(rs[1]))
+		assert.Check(t, err)
+		response := &Response{}
+		assert.Check(t, xml.Unmarshal(buf, response))
+		return response
+	}
+
+	// the IDP only issues transient identifiers, and says so without
+	// authenticating the user
+	response := serveSSO()
+	assert.Check(t, is.Equal(0, sessions))
+	assert.Check(t, is.Equal(StatusRequester, response.Status.StatusCode.Value))
+	assert.Assert(t, response.Status.StatusCode.StatusCode != nil)
+	assert.Check(t, is.Equal(StatusInvalidNameIDPolicy, response.Status.StatusCode.StatusCode.Value))
+	assert.Check(t, is.Nil(response.Assertion))
+	assert.Check(t, is.Nil(response.EncryptedAssertion))
+	assert.Check(t, response.Signature != nil)
+
+	// with persistent identifiers, it answers with one
+	test.IDP.NameIDGenerator = DefaultNameIDGenerator{PersistentNameIDs: HashedPersistentNameIDs{Salt: []byte("salt")}}
+	response = serveSSO()
+	assert.Check(t, is.Equal(1, sessions))
+	assert.Check(t, is.Equal(StatusSuccess, response.Status.StatusCode.Value))
+
+	// unless the identifier must be created but the request does not allow it
+	test.IDP.NameIDGenerator = DefaultNameIDGenerator{PersistentNameIDs: &MemoryPersistentNameIDStore{}}
+	allowCreate := false
+	test.SP.NameIDPolicy = &NameIDPolicy{AllowCreate: &allowCreate}
+	response = serveSSO()
+	assert.Check(t, is.Equal(2, sessions))
+	assert.Check(t, is.Equal(StatusRequester, response.Status.StatusCode.Value))
+	assert.Assert(t, response.Status.StatusCode.StatusCode != nil)
+	assert.Check(t, is.Equal(StatusInvalidNameIDPolicy, response.Status.StatusCode.StatusCode.Value))
+}
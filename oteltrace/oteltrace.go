@@ -0,0 +1,63 @@
+// Package oteltrace implements a saml.Tracer that records spans with an
+// OpenTelemetry TracerProvider, so that the parsing and validation of SAML
+// responses, SOAP round-trips, signature verification and decryption show
+// up in distributed traces.
+//
+//	sp := saml.ServiceProvider{
+//		Tracer: oteltrace.New(otel.GetTracerProvider()),
+//		// ...
+//	}
+package oteltrace
+
+import (
+	"context"
+
+	"github.com/crewjam/saml"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName is the name of the instrumentation library that
+// spans are recorded under.
+const InstrumentationName = "github.com/crewjam/saml"
+
+// Tracer is a saml.Tracer that records spans with an OpenTelemetry tracer.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+var _ saml.Tracer = (*Tracer)(nil)
+
+// New returns a Tracer that records spans with a tracer of tracerProvider.
+func New(tracerProvider trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: tracerProvider.Tracer(InstrumentationName)}
+}
+
+// Start implements saml.Tracer.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, saml.Span) {
+	ctx, s := t.tracer.Start(ctx, name)
+	return ctx, span{span: s}
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s span) SetAttribute(key string, value string) {
+	if value == "" {
+		return
+	}
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// End ends the span. The message of err is recorded as is; the errors of
+// the saml package do not disclose the details of why a message was
+// rejected in their messages.
+func (s span) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
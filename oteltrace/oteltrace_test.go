@@ -0,0 +1,71 @@
+package oteltrace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/crewjam/saml"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func newTestTracer() (*Tracer, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	return New(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))), recorder
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[string]string {
+	rv := map[string]string{}
+	for _, kv := range span.Attributes() {
+		rv[string(kv.Key)] = kv.Value.AsString()
+	}
+	return rv
+}
+
+func TestTracerRecordsSpans(t *testing.T) {
+	tracer, recorder := newTestTracer()
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttribute(saml.AttributeMessageID, "id-1")
+	child.SetAttribute(saml.AttributeIDPEntityID, "")
+	child.End(errors.New("failed"))
+	parent.End(nil)
+
+	spans := recorder.Ended()
+	assert.Assert(t, is.Len(spans, 2))
+	assert.Check(t, is.Equal("child", spans[0].Name()))
+	assert.Check(t, is.Equal(spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID()))
+	assert.Check(t, is.DeepEqual(map[string]string{saml.AttributeMessageID: "id-1"}, attributes(spans[0])))
+	assert.Check(t, is.Equal(codes.Error, spans[0].Status().Code))
+	assert.Check(t, is.Equal("failed", spans[0].Status().Description))
+	assert.Check(t, is.Equal("parent", spans[1].Name()))
+	assert.Check(t, is.Equal(codes.Unset, spans[1].Status().Code))
+}
+
+func TestServiceProviderIsTraced(t *testing.T) {
+	tracer, recorder := newTestTracer()
+	sp := saml.ServiceProvider{
+		IDPMetadata: &saml.EntityDescriptor{EntityID: "https://idp.example.com/metadata"},
+		Tracer:      tracer,
+	}
+
+	req := http.Request{PostForm: url.Values{"SAMLResponse": {"!"}}, Form: url.Values{}}
+	_, err := sp.ParseResponse(&req, nil)
+	assert.Check(t, err != nil)
+
+	spans := recorder.Ended()
+	assert.Assert(t, is.Len(spans, 1))
+	assert.Check(t, is.Equal("saml.ServiceProvider.ParseResponse", spans[0].Name()))
+	assert.Check(t, is.DeepEqual(map[string]string{
+		saml.AttributeIDPEntityID: "https://idp.example.com/metadata",
+		saml.AttributeBinding:     saml.HTTPPostBinding,
+	}, attributes(spans[0])))
+	assert.Check(t, is.Equal(codes.Error, spans[0].Status().Code))
+}
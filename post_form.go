@@ -0,0 +1,131 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// DefaultPostFormTemplate is the template of the page that PostForm writes
+// unless it has one of its own. It is executed with a PostFormData.
+var DefaultPostFormTemplate = template.Must(template.New("saml-post-form").Parse(`` +
+	`<!DOCTYPE html><html><body>` +
+	`<form method="post" action="{{.URL}}" id="SAMLForm">` +
+	`<input type="hidden" name="{{.Param}}" value="{{.Value}}" />` +
+	`<input type="hidden" name="RelayState" value="{{.RelayState}}" />` +
+	`<input id="SAMLSubmitButton" type="submit" value="Continue" />` +
+	`</form>` +
+	`<script nonce="{{.Nonce}}">document.getElementById('SAMLSubmitButton').style.visibility="hidden";` +
+	`document.getElementById('SAMLForm').submit();</script>` +
+	`</body></html>`))
+
+// DefaultPostFormContentSecurityPolicy is the Content-Security-Policy of the
+// page that PostForm writes unless it has one of its own. Only the inline
+// scripts and styles that carry the nonce of the page may run.
+const DefaultPostFormContentSecurityPolicy = "default-src 'none'; " +
+	"script-src 'nonce-{nonce}'; style-src 'nonce-{nonce}'; img-src 'self' data:; " +
+	"base-uri 'none'; frame-ancestors 'none'"
+
+// PostFormData is the data that the template of a PostForm is executed
+// with.
+type PostFormData struct {
+	// URL is the URL that the form is posted to.
+	URL string
+
+	// Param is the name of the form field that carries the message,
+	// either "SAMLRequest" or "SAMLResponse", and Value is the message,
+	// base64 encoded.
+	Param string
+	Value string
+
+	RelayState string
+
+	// Nonce is the nonce that the inline scripts and styles of the page
+	// must carry in their nonce attribute, i.e. <script nonce="{{.Nonce}}">.
+	Nonce string
+}
+
+// newPostFormData returns the PostFormData that sends el to url as the
+// form field param.
+func newPostFormData(url string, param string, el *etree.Element, relayState string) PostFormData {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		panic(err)
+	}
+	return PostFormData{
+		URL:        url,
+		Param:      param,
+		Value:      base64.StdEncoding.EncodeToString(buf),
+		RelayState: relayState,
+	}
+}
+
+// PostFormData returns the PostFormData that sends the request with the
+// HTTP-POST binding.
+func (req *AuthnRequest) PostFormData(relayState string) PostFormData {
+	return newPostFormData(req.Destination, "SAMLRequest", req.Element(), relayState)
+}
+
+// PostFormData returns the PostFormData that sends the request with the
+// HTTP-POST binding.
+func (req *LogoutRequest) PostFormData(relayState string) PostFormData {
+	return newPostFormData(req.Destination, "SAMLRequest", req.Element(), relayState)
+}
+
+// PostFormData returns the PostFormData that sends the response with the
+// HTTP-POST binding.
+func (resp *LogoutResponse) PostFormData(relayState string) PostFormData {
+	return newPostFormData(resp.Destination, "SAMLResponse", resp.Element(), relayState)
+}
+
+// PostForm writes the HTML pages that send SAML messages with the HTTP-POST
+// binding, whose forms submit themselves, so that they can carry the
+// branding of the site or show progress.
+//
+// A nil *PostForm writes DefaultPostFormTemplate with
+// DefaultPostFormContentSecurityPolicy.
+type PostForm struct {
+	// Template is executed with a PostFormData to produce the page. It
+	// must post a form to .URL with the field named .Param set to .Value
+	// and the RelayState field set to .RelayState. If it is nil,
+	// DefaultPostFormTemplate is used.
+	Template *template.Template
+
+	// ContentSecurityPolicy is the Content-Security-Policy header of the
+	// page, in which each "{nonce}" is replaced by the nonce of the page. If
+	// it is empty, DefaultPostFormContentSecurityPolicy is used.
+	ContentSecurityPolicy string
+}
+
+// Write writes the page that sends data, with a new nonce.
+func (f *PostForm) Write(w http.ResponseWriter, data PostFormData) error {
+	tmpl, csp := DefaultPostFormTemplate, DefaultPostFormContentSecurityPolicy
+	if f != nil && f.Template != nil {
+		tmpl = f.Template
+	}
+	if f != nil && f.ContentSecurityPolicy != "" {
+		csp = f.ContentSecurityPolicy
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(RandReader, nonce); err != nil {
+		return err
+	}
+	data.Nonce = base64.StdEncoding.EncodeToString(nonce)
+
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Security-Policy", strings.ReplaceAll(csp, "{nonce}", data.Nonce))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := buf.WriteTo(w)
+	return err
+}
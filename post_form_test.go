@@ -0,0 +1,71 @@
+package saml
+
+import (
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestPostFormWritesDefaultTemplate(t *testing.T) {
+	RandReader = &testRandomReader{}
+	data := PostFormData{
+		URL:        "https://idp.example.com/saml/sso",
+		Param:      "SAMLRequest",
+		Value:      "PHNhbWxwOkF1dGhuUmVxdWVzdC8+",
+		RelayState: `"><script>alert(1)</script>`,
+	}
+
+	var f *PostForm
+	w := httptest.NewRecorder()
+	assert.Check(t, f.Write(w, data))
+	assert.Check(t, is.Equal("text/html; charset=utf-8", w.Header().Get("Content-Type")))
+	assert.Check(t, is.Equal(""+
+		"default-src 'none'; script-src 'nonce-AAIEBggKDA4QEhQWGBocHg=='; style-src 'nonce-AAIEBggKDA4QEhQWGBocHg=='; "+
+		"img-src 'self' data:; base-uri 'none'; frame-ancestors 'none'",
+		w.Header().Get("Content-Security-Policy")))
+	assert.Check(t, is.Equal(""+
+		`<!DOCTYPE html><html><body>`+
+		`<form method="post" action="https://idp.example.com/saml/sso" id="SAMLForm">`+
+		`<input type="hidden" name="SAMLRequest" value="PHNhbWxwOkF1dGhuUmVxdWVzdC8&#43;" />`+
+		`<input type="hidden" name="RelayState" value="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;" />`+
+		`<input id="SAMLSubmitButton" type="submit" value="Continue" />`+
+		`</form>`+
+		`<script nonce="AAIEBggKDA4QEhQWGBocHg==">document.getElementById('SAMLSubmitButton').style.visibility="hidden";`+
+		`document.getElementById('SAMLForm').submit();</script>`+
+		`</body></html>`,
+		w.Body.String()))
+
+	// each page has a nonce of its own
+	w2 := httptest.NewRecorder()
+	assert.Check(t, f.Write(w2, data))
+	assert.Check(t, w.Header().Get("Content-Security-Policy") != w2.Header().Get("Content-Security-Policy"))
+}
+
+func TestPostFormWritesCustomTemplate(t *testing.T) {
+	RandReader = &testRandomReader{}
+	f := &PostForm{
+		Template: template.Must(template.New("branded").Parse(`` +
+			`<style nonce="{{.Nonce}}">body { background: #036; }</style>` +
+			`<form method="post" action="{{.URL}}"><input type="hidden" name="{{.Param}}" value="{{.Value}}" /></form>` +
+			`<script nonce="{{.Nonce}}">document.forms[0].submit();</script>`)),
+		ContentSecurityPolicy: "default-src 'self'; script-src 'nonce-{nonce}'; style-src 'nonce-{nonce}'",
+	}
+
+	w := httptest.NewRecorder()
+	assert.Check(t, f.Write(w, PostFormData{URL: "https://sp.example.com/saml/acs", Param: "SAMLResponse", Value: "eA=="}))
+	assert.Check(t, is.Equal("default-src 'self'; script-src 'nonce-AAIEBggKDA4QEhQWGBocHg=='; style-src 'nonce-AAIEBggKDA4QEhQWGBocHg=='",
+		w.Header().Get("Content-Security-Policy")))
+	assert.Check(t, is.Equal(2, strings.Count(w.Body.String(), `nonce="AAIEBggKDA4QEhQWGBocHg=="`)))
+	assert.Check(t, is.Contains(w.Body.String(), `name="SAMLResponse" value="eA=="`))
+
+	// nothing is written if the template fails
+	f.Template = template.Must(template.New("broken").Parse(`{{.Missing}}`))
+	w = httptest.NewRecorder()
+	assert.Check(t, f.Write(w, PostFormData{}) != nil)
+	assert.Check(t, is.Equal("", w.Body.String()))
+	assert.Check(t, is.Equal("", w.Header().Get("Content-Security-Policy")))
+}
@@ -0,0 +1,97 @@
+package saml
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type presentingRequestKey struct{}
+
+// withPresentingRequest returns a context that carries r, the request with
+// which the client presented a response to the SP, so that the validation
+// of the response can check the client against its assertion.
+func withPresentingRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, presentingRequestKey{}, r)
+}
+
+// presentingRequest returns the request carried by ctx, or nil.
+func presentingRequest(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(presentingRequestKey{}).(*http.Request)
+	return r
+}
+
+// tlsClientCertificate returns the TLS client certificate that r was sent
+// with, or nil.
+func tlsClientCertificate(r *http.Request) *x509.Certificate {
+	if r == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// clientIP returns the IP address of the client that sent r. If r came from
+// one of trustedProxies, the address is taken from the X-Forwarded-For
+// header, skipping the trusted proxies that appended to it.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	ip := parseAddress(r.RemoteAddr)
+	if ip == nil || !isTrustedProxy(ip, trustedProxies) {
+		return ip
+	}
+
+	var forwardedFor []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwardedFor = append(forwardedFor, strings.Split(header, ",")...)
+	}
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		ip = parseAddress(strings.TrimSpace(forwardedFor[i]))
+		if ip == nil || !isTrustedProxy(ip, trustedProxies) {
+			return ip
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddress parses an IP address that may be followed by a port, as in
+// http.Request.RemoteAddr. It returns nil if address is not valid.
+func parseAddress(address string) net.IP {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(address)
+}
+
+// validateSubjectAddress checks, if sp.ValidateSubjectAddress is set, that
+// the client that presented assertion has the Address of each of its
+// SubjectConfirmationData elements that has one. The client is taken from
+// the request in ctx; see withPresentingRequest.
+func (sp *ServiceProvider) validateSubjectAddress(ctx context.Context, assertion *Assertion) error {
+	if !sp.ValidateSubjectAddress || assertion.Subject == nil {
+		return nil
+	}
+	for _, subjectConfirmation := range assertion.Subject.SubjectConfirmations {
+		data := subjectConfirmation.SubjectConfirmationData
+		if data == nil || data.Address == "" {
+			continue
+		}
+		r := presentingRequest(ctx)
+		if r == nil {
+			return errorOfKind(ErrWrongAddress, "cannot check the SubjectConfirmationData Address without the request of the client")
+		}
+		if ip := clientIP(r, sp.TrustedProxies); ip == nil || !ip.Equal(parseAddress(data.Address)) {
+			return errorOfKind(ErrWrongAddress, "assertion SubjectConfirmationData Address is not the address of the client")
+		}
+	}
+	return nil
+}
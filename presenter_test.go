@@ -0,0 +1,78 @@
+package saml
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies := []*net.IPNet{proxies}
+
+	newRequest := func(remoteAddr string, forwardedFor ...string) *http.Request {
+		r, _ := http.NewRequest("POST", "https://sp.example.com/saml2/acs", nil)
+		r.RemoteAddr = remoteAddr
+		for _, header := range forwardedFor {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		return r
+	}
+
+	// the header is ignored unless the request came from a trusted proxy
+	assert.Check(t, is.Equal("192.0.2.1", clientIP(newRequest("192.0.2.1:1234", "198.51.100.1"), trustedProxies).String()))
+	assert.Check(t, is.Equal("10.0.0.1", clientIP(newRequest("10.0.0.1:1234", "198.51.100.1"), nil).String()))
+
+	assert.Check(t, is.Equal("198.51.100.1", clientIP(newRequest("10.0.0.1:1234", "198.51.100.1"), trustedProxies).String()))
+	assert.Check(t, is.Equal("198.51.100.2", clientIP(newRequest("10.0.0.1:1234", "198.51.100.1, 198.51.100.2, 10.0.0.2"), trustedProxies).String()))
+	assert.Check(t, is.Equal("198.51.100.2", clientIP(newRequest("10.0.0.1:1234", "198.51.100.1", "198.51.100.2"), trustedProxies).String()))
+	assert.Check(t, is.Equal("2001:db8::1", clientIP(newRequest("[2001:db8::1]:1234"), trustedProxies).String()))
+	assert.Check(t, clientIP(newRequest("10.0.0.1:1234", "garbage"), trustedProxies) == nil)
+}
+
+func TestSPCanValidateSubjectAddress(t *testing.T) {
+	s := ServiceProvider{}
+	assertion := &Assertion{
+		Subject: &Subject{
+			SubjectConfirmations: []SubjectConfirmation{
+				{
+					Method:                  BearerConfirmationMethod,
+					SubjectConfirmationData: &SubjectConfirmationData{Address: "198.51.100.1:5678"},
+				},
+			},
+		},
+	}
+	r, _ := http.NewRequest("POST", "https://sp.example.com/saml2/acs", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	ctx := withPresentingRequest(context.Background(), r)
+
+	// the check is opt-in
+	assert.Check(t, s.validateSubjectAddress(ctx, assertion))
+
+	s.ValidateSubjectAddress = true
+	err := s.validateSubjectAddress(ctx, assertion)
+	assert.Check(t, errors.Is(err, ErrWrongAddress))
+	assert.Check(t, is.Error(err, "assertion SubjectConfirmationData Address is not the address of the client"))
+
+	err = s.validateSubjectAddress(context.Background(), assertion)
+	assert.Check(t, is.Equal("wrong_address", ErrorCode(err)))
+
+	r.RemoteAddr = "198.51.100.1:4321"
+	assert.Check(t, s.validateSubjectAddress(ctx, assertion))
+
+	// behind a proxy
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	s.TrustedProxies = []*net.IPNet{proxies}
+	r.RemoteAddr = "10.1.2.3:4321"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Check(t, s.validateSubjectAddress(ctx, assertion))
+
+	// assertions without an Address are not checked
+	assertion.Subject.SubjectConfirmations[0].SubjectConfirmationData.Address = ""
+	assert.Check(t, s.validateSubjectAddress(context.Background(), assertion))
+}
@@ -0,0 +1,211 @@
+// Package prommetrics implements a Prometheus collector of the metrics of
+// SAML service providers and identity providers: logins by outcome and
+// class of error, response validation latency, signature verification time,
+// metadata refresh failures, authentication requests handled by an IDP and
+// active sessions.
+//
+// The Collector is fed by the hooks of the saml and samlsp packages, and is
+// registered with the registry of the application. An IdentityProvider
+// reports to it through its Tracer:
+//
+//	collector := prommetrics.NewCollector(nil)
+//	prometheus.MustRegister(collector)
+//	sp := saml.ServiceProvider{
+//		EventSink: collector,
+//		Tracer:    collector.Tracer(nil),
+//		// ...
+//	}
+//	refresher := samlsp.MetadataRefresher{
+//		OnError: collector.OnMetadataRefreshError,
+//		// ...
+//	}
+//	idp := saml.IdentityProvider{
+//		Tracer: collector.Tracer(nil),
+//		// ...
+//	}
+package prommetrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector of the metrics of service providers
+// and identity providers.
+// It implements saml.EventSink. Create it with NewCollector.
+type Collector struct {
+	logins                  *prometheus.CounterVec
+	responseDuration        prometheus.Histogram
+	signatureDuration       prometheus.Histogram
+	metadataRefreshFailures prometheus.Counter
+	idpRequests             *prometheus.CounterVec
+	idpRequestDuration      prometheus.Histogram
+	activeSessions          prometheus.GaugeFunc
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+var _ saml.EventSink = (*Collector)(nil)
+
+// NewCollector returns a new Collector. activeSessions, if not nil, is
+// called when the metrics are collected and returns the number of active
+// sessions, e.g. the number of sessions in a server-side session store.
+func NewCollector(activeSessions func() int) *Collector {
+	c := &Collector{
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "saml_sp_logins_total",
+			Help: "Number of SAML responses processed, by result and class of error.",
+		}, []string{"result", "error_class"}),
+		responseDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "saml_sp_response_validation_duration_seconds",
+			Help:    "Time taken to parse and validate SAML responses.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		signatureDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "saml_sp_signature_verification_duration_seconds",
+			Help:    "Time taken to verify XML signatures.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		metadataRefreshFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "saml_sp_metadata_refresh_failures_total",
+			Help: "Number of failed refreshes of IDP metadata.",
+		}),
+		idpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "saml_idp_sso_requests_total",
+			Help: "Number of authentication requests handled by the IDP, by result.",
+		}, []string{"result"}),
+		idpRequestDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "saml_idp_sso_request_duration_seconds",
+			Help:    "Time taken to handle authentication requests.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	if activeSessions != nil {
+		c.activeSessions = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "saml_sp_active_sessions",
+			Help: "Number of active sessions.",
+		}, func() float64 {
+			return float64(activeSessions())
+		})
+	}
+	return c
+}
+
+func (c *Collector) collectors() []prometheus.Collector {
+	rv := []prometheus.Collector{c.logins, c.responseDuration, c.signatureDuration, c.metadataRefreshFailures,
+		c.idpRequests, c.idpRequestDuration}
+	if c.activeSessions != nil {
+		rv = append(rv, c.activeSessions)
+	}
+	return rv
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+// OnRequestIssued implements saml.EventSink.
+func (c *Collector) OnRequestIssued(event saml.RequestEvent) {}
+
+// OnResponseAccepted implements saml.EventSink.
+func (c *Collector) OnResponseAccepted(event saml.ResponseEvent) {
+	c.logins.WithLabelValues("succeeded", "").Inc()
+	c.responseDuration.Observe(event.Duration.Seconds())
+}
+
+// OnResponseRejected implements saml.EventSink.
+func (c *Collector) OnResponseRejected(event saml.ResponseEvent) {
+	c.logins.WithLabelValues("failed", event.ErrorCode).Inc()
+	c.responseDuration.Observe(event.Duration.Seconds())
+}
+
+// OnLogout implements saml.EventSink.
+func (c *Collector) OnLogout(event saml.LogoutEvent) {}
+
+// OnAttributeQuery implements saml.EventSink.
+func (c *Collector) OnAttributeQuery(event saml.AttributeQueryEvent) {}
+
+// OnMetadataRefreshError counts a failed refresh of IDP metadata. It can be
+// used as the OnError function of a samlsp.MetadataRefresher.
+func (c *Collector) OnMetadataRefreshError(err error) {
+	c.metadataRefreshFailures.Inc()
+}
+
+// The names of the spans that the collector times.
+const (
+	signatureSpanName = "saml.ServiceProvider.VerifySignature"
+	idpSSOSpanName    = "saml.IdentityProvider.ServeSSO"
+)
+
+// Tracer returns a saml.Tracer that times signature verification and the
+// authentication requests handled by an IDP. Spans are passed on to next,
+// if not nil, so that the metrics can be collected alongside tracing.
+func (c *Collector) Tracer(next saml.Tracer) saml.Tracer {
+	return tracer{collector: c, next: next}
+}
+
+type tracer struct {
+	collector *Collector
+	next      saml.Tracer
+}
+
+func (t tracer) Start(ctx context.Context, name string) (context.Context, saml.Span) {
+	var next saml.Span = noopSpan{}
+	if t.next != nil {
+		ctx, next = t.next.Start(ctx, name)
+	}
+	switch name {
+	case signatureSpanName:
+		return ctx, &timedSpan{start: time.Now(), next: next, onEnd: t.collector.signatureVerified}
+	case idpSSOSpanName:
+		return ctx, &timedSpan{start: time.Now(), next: next, onEnd: t.collector.idpRequestHandled}
+	}
+	return ctx, next
+}
+
+func (c *Collector) signatureVerified(d time.Duration, err error) {
+	c.signatureDuration.Observe(d.Seconds())
+}
+
+func (c *Collector) idpRequestHandled(d time.Duration, err error) {
+	if err != nil {
+		c.idpRequests.WithLabelValues("failed").Inc()
+	} else {
+		c.idpRequests.WithLabelValues("succeeded").Inc()
+	}
+	c.idpRequestDuration.Observe(d.Seconds())
+}
+
+// timedSpan is a span that reports its duration to onEnd.
+type timedSpan struct {
+	start time.Time
+	next  saml.Span
+	onEnd func(d time.Duration, err error)
+}
+
+func (s *timedSpan) SetAttribute(key string, value string) {
+	s.next.SetAttribute(key, value)
+}
+
+func (s *timedSpan) End(err error) {
+	s.onEnd(time.Since(s.start), err)
+	s.next.End(err)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value string) {}
+
+func (noopSpan) End(err error) {}
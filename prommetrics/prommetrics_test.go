@@ -0,0 +1,120 @@
+package prommetrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestCollectorCountsLogins(t *testing.T) {
+	c := NewCollector(nil)
+	c.OnResponseAccepted(saml.ResponseEvent{Duration: time.Millisecond})
+	c.OnResponseAccepted(saml.ResponseEvent{Duration: time.Millisecond})
+	c.OnResponseRejected(saml.ResponseEvent{Duration: time.Millisecond, ErrorCode: "expired_response"})
+
+	assert.Check(t, is.Equal(2.0, testutil.ToFloat64(c.logins.WithLabelValues("succeeded", ""))))
+	assert.Check(t, is.Equal(1.0, testutil.ToFloat64(c.logins.WithLabelValues("failed", "expired_response"))))
+	assert.Check(t, is.Equal(0.0, testutil.ToFloat64(c.logins.WithLabelValues("failed", "wrong_audience"))))
+	assert.Check(t, is.Equal(1, testutil.CollectAndCount(c.responseDuration)))
+}
+
+func TestCollectorCanBeRegistered(t *testing.T) {
+	sessions := 3
+	c := NewCollector(func() int { return sessions })
+	registry := prometheus.NewPedanticRegistry()
+	assert.Check(t, registry.Register(c))
+
+	c.OnMetadataRefreshError(errors.New("cannot fetch metadata"))
+	c.OnResponseRejected(saml.ResponseEvent{ErrorCode: "other"})
+	assert.Check(t, is.Equal(1.0, testutil.ToFloat64(c.metadataRefreshFailures)))
+	assert.Check(t, is.Equal(3.0, testutil.ToFloat64(c.activeSessions)))
+
+	families, err := registry.Gather()
+	assert.Check(t, err)
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	assert.Check(t, is.DeepEqual([]string{
+		"saml_idp_sso_request_duration_seconds",
+		"saml_sp_active_sessions",
+		"saml_sp_logins_total",
+		"saml_sp_metadata_refresh_failures_total",
+		"saml_sp_response_validation_duration_seconds",
+		"saml_sp_signature_verification_duration_seconds",
+	}, names))
+}
+
+type recordingTracer struct {
+	names []string
+	ended int
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, saml.Span) {
+	t.names = append(t.names, name)
+	return ctx, recordingSpan{t}
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+}
+
+func (s recordingSpan) SetAttribute(key string, value string) {}
+
+func (s recordingSpan) End(err error) {
+	s.tracer.ended++
+}
+
+func TestTracerTimesSignatureVerification(t *testing.T) {
+	c := NewCollector(nil)
+	next := &recordingTracer{}
+	tracer := c.Tracer(next)
+
+	_, span := tracer.Start(context.Background(), "saml.ServiceProvider.ParseXMLResponse")
+	_, sigSpan := tracer.Start(context.Background(), "saml.ServiceProvider.VerifySignature")
+	sigSpan.End(nil)
+	span.End(nil)
+	assert.Check(t, is.Equal(1, testutil.CollectAndCount(c.signatureDuration)))
+	assert.Check(t, is.DeepEqual([]string{"saml.ServiceProvider.ParseXMLResponse", "saml.ServiceProvider.VerifySignature"}, next.names))
+	assert.Check(t, is.Equal(2, next.ended))
+
+	// without a next tracer
+	_, span = c.Tracer(nil).Start(context.Background(), "saml.ServiceProvider.ParseResponse")
+	span.End(nil)
+}
+
+func TestTracerCountsIDPRequests(t *testing.T) {
+	c := NewCollector(nil)
+	tracer := c.Tracer(nil)
+
+	_, span := tracer.Start(context.Background(), "saml.IdentityProvider.ServeSSO")
+	span.End(nil)
+	_, span = tracer.Start(context.Background(), "saml.IdentityProvider.ServeSSO")
+	span.End(errors.New("cannot validate request"))
+	assert.Check(t, is.Equal(1.0, testutil.ToFloat64(c.idpRequests.WithLabelValues("succeeded"))))
+	assert.Check(t, is.Equal(1.0, testutil.ToFloat64(c.idpRequests.WithLabelValues("failed"))))
+	assert.Check(t, is.Equal(1, testutil.CollectAndCount(c.idpRequestDuration)))
+}
+
+func TestServiceProviderFeedsCollector(t *testing.T) {
+	c := NewCollector(nil)
+	sp := saml.ServiceProvider{
+		IDPMetadata: &saml.EntityDescriptor{EntityID: "https://idp.example.com/metadata"},
+		EventSink:   c,
+		Tracer:      c.Tracer(nil),
+	}
+
+	req := http.Request{PostForm: url.Values{"SAMLResponse": {"!"}}, Form: url.Values{}}
+	_, err := sp.ParseResponse(&req, nil)
+	assert.Check(t, err != nil)
+	assert.Check(t, is.Equal(1.0, testutil.ToFloat64(c.logins.WithLabelValues("failed", "malformed_response"))))
+}
@@ -0,0 +1,198 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// redirectSignatureHashes maps the signature methods that can be used to
+// sign messages sent with the HTTP-Redirect binding to their hash function.
+var redirectSignatureHashes = map[string]crypto.Hash{
+	dsig.RSASHA1SignatureMethod:     crypto.SHA1,
+	dsig.RSASHA256SignatureMethod:   crypto.SHA256,
+	dsig.RSASHA384SignatureMethod:   crypto.SHA384,
+	dsig.RSASHA512SignatureMethod:   crypto.SHA512,
+	dsig.ECDSASHA1SignatureMethod:   crypto.SHA1,
+	dsig.ECDSASHA256SignatureMethod: crypto.SHA256,
+	dsig.ECDSASHA384SignatureMethod: crypto.SHA384,
+	dsig.ECDSASHA512SignatureMethod: crypto.SHA512,
+}
+
+// signRedirectQuery returns query, which holds the SAMLRequest or
+// SAMLResponse parameter of a message sent with the HTTP-Redirect binding
+// and optionally its RelayState parameter, with the SigAlg and Signature
+// parameters appended.
+//
+// See 3.4.4.1 DEFLATE Encoding of https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf
+func signRedirectQuery(query string, signatureMethod string, signingContext *dsig.SigningContext) (string, error) {
+	query += "&SigAlg=" + url.QueryEscape(signatureMethod)
+	sig, err := signingContext.SignString(query)
+	if err != nil {
+		return "", err
+	}
+	return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// signedRedirectURL returns a URL that sends el to destination using the
+// HTTP-Redirect binding, in the query parameter named param, along with
+// relayState if it is not empty. The message is signed with signingContext
+// using signatureMethod. The binding does not allow el to carry an
+// enveloped signature as well.
+func signedRedirectURL(destination string, param string, el *etree.Element, relayState string, signatureMethod string, signingContext *dsig.SigningContext) (*url.URL, error) {
+	w := &bytes.Buffer{}
+	w1 := base64.NewEncoder(base64.StdEncoding, w)
+	w2, _ := flate.NewWriter(w1, 9)
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	if _, err := doc.WriteTo(w2); err != nil {
+		return nil, err
+	}
+	w2.Close()
+	w1.Close()
+
+	rv, err := url.Parse(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	// the signed parameters must appear in this order, so the query is
+	// built by hand rather than with url.Values
+	query := param + "=" + url.QueryEscape(w.String())
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query, err = signRedirectQuery(query, signatureMethod, signingContext)
+	if err != nil {
+		return nil, err
+	}
+	if rv.RawQuery != "" {
+		query = rv.RawQuery + "&" + query
+	}
+	rv.RawQuery = query
+	return rv, nil
+}
+
+// hasRedirectSignature returns true if query, the query of a message sent
+// with the HTTP-Redirect binding, carries a signature.
+func hasRedirectSignature(query url.Values) bool {
+	return query.Get("Signature") != "" || query.Get("SigAlg") != ""
+}
+
+// verifyRedirectSignature returns nil iff rawQuery, the query of a message
+// sent with the HTTP-Redirect binding, carries a valid signature that uses
+// a signature method allowed by policy and was made with one of certs.
+//
+// The signature covers the SAMLRequest or SAMLResponse, RelayState and
+// SigAlg parameters exactly as they were encoded by the sender, so they are
+// taken from rawQuery rather than re-encoded.
+func verifyRedirectSignature(rawQuery string, certs []*x509.Certificate, policy signaturePolicy) error {
+	params := map[string]string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		name, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			name, value = param[:i], param[i+1:]
+		}
+		switch name {
+		case "SAMLRequest", "SAMLResponse", "RelayState", "SigAlg", "Signature":
+			if _, ok := params[name]; ok {
+				return fmt.Errorf("duplicate %s parameter", name)
+			}
+			params[name] = value
+		}
+	}
+
+	var signed string
+	if value, ok := params["SAMLRequest"]; ok {
+		signed = "SAMLRequest=" + value
+	} else if value, ok := params["SAMLResponse"]; ok {
+		signed = "SAMLResponse=" + value
+	} else {
+		return errors.New("missing SAMLRequest or SAMLResponse parameter")
+	}
+	if value, ok := params["RelayState"]; ok {
+		signed += "&RelayState=" + value
+	}
+	rawSigAlg, ok := params["SigAlg"]
+	if !ok {
+		return errors.New("missing SigAlg parameter")
+	}
+	signed += "&SigAlg=" + rawSigAlg
+
+	signatureMethod, err := url.QueryUnescape(rawSigAlg)
+	if err != nil {
+		return fmt.Errorf("cannot decode SigAlg: %v", err)
+	}
+	signatureMethods, _ := policy.methods()
+	if !containsString(signatureMethods, signatureMethod) {
+		return fmt.Errorf("signature method %q is not allowed", signatureMethod)
+	}
+	hash, ok := redirectSignatureHashes[signatureMethod]
+	if !ok || !hash.Available() {
+		return fmt.Errorf("unsupported signature method %q", signatureMethod)
+	}
+
+	rawSignature, ok := params["Signature"]
+	if !ok {
+		return errors.New("missing Signature parameter")
+	}
+	encodedSignature, err := url.QueryUnescape(rawSignature)
+	if err != nil {
+		return fmt.Errorf("cannot decode Signature: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return fmt.Errorf("cannot decode Signature: %v", err)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	for _, cert := range certs {
+		if verifyDigestSignature(cert.PublicKey, signatureMethod, hash, digest, signature) {
+			return nil
+		}
+	}
+	return errors.New("signature could not be verified with any trusted certificate")
+}
+
+// verifyDigestSignature returns true if signature is a valid signature of
+// digest made with the private part of publicKey using signatureMethod.
+// ECDSA signatures may be either the concatenation of r and s, as XML
+// Signature requires, or ASN.1 encoded.
+func verifyDigestSignature(publicKey crypto.PublicKey, signatureMethod string, hash crypto.Hash, digest []byte, signature []byte) bool {
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		if isECDSASignatureMethod(signatureMethod) {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(publicKey, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		if !isECDSASignatureMethod(signatureMethod) {
+			return false
+		}
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(publicKey, digest, r, s) {
+				return true
+			}
+		}
+		return ecdsa.VerifyASN1(publicKey, digest, signature)
+	}
+	return false
+}
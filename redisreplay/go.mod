@@ -0,0 +1,9 @@
+module github.com/crewjam/saml/redisreplay
+
+go 1.16
+
+require (
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/pkg/errors v0.9.1 // indirect
+	gotest.tools v2.2.0+incompatible
+)
@@ -0,0 +1,126 @@
+// Package redisreplay implements a saml.ReplayCache and a
+// saml.RequestIDStore backed by Redis, so that the service providers of
+// many processes can share the IDs of the assertions they have accepted and
+// of the requests they have issued.
+//
+//	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+//	sp := saml.ServiceProvider{
+//		ReplayCache:    &redisreplay.Cache{Client: client},
+//		RequestIDStore: &redisreplay.RequestIDStore{Client: client},
+//		// ...
+//	}
+package redisreplay
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Client is the subset of the Redis API used by Cache and RequestIDStore.
+// It is implemented by *redis.Client, *redis.ClusterClient and
+// redis.UniversalClient.
+type Client interface {
+	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+}
+
+var _ Client = (*redis.Client)(nil)
+
+// DefaultPrefix is the default prefix of the keys that Cache stores the IDs
+// of assertions under.
+const DefaultPrefix = "saml:assertion:"
+
+// DefaultRequestIDPrefix is the default prefix of the keys that
+// RequestIDStore stores the IDs of requests under.
+const DefaultRequestIDPrefix = "saml:request:"
+
+// Cache is a saml.ReplayCache that records each assertion ID as a key that
+// expires along with the assertion.
+type Cache struct {
+	Client Client
+
+	// Prefix is prepended to the assertion IDs to form keys. The default is
+	// DefaultPrefix.
+	Prefix string
+
+	// Context, if not nil, is used for the calls to Redis. The default is
+	// context.Background().
+	Context context.Context
+}
+
+// Seen implements saml.ReplayCache. The key is set only if it does not
+// exist, so that of two concurrent requests with the same assertion only
+// one succeeds.
+func (c *Cache) Seen(id string, expiry time.Time) (bool, error) {
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	set, err := c.Client.SetNX(contextOrBackground(c.Context), prefix+id, 1, ttl(expiry)).Result()
+	if err != nil {
+		return false, err
+	}
+	return !set, nil
+}
+
+// RequestIDStore is a saml.RequestIDStore that records each request ID as a
+// key that expires along with the request.
+type RequestIDStore struct {
+	Client Client
+
+	// Prefix is prepended to the request IDs to form keys. The default is
+	// DefaultRequestIDPrefix.
+	Prefix string
+
+	// Context, if not nil, is used for the calls to Redis. The default is
+	// context.Background().
+	Context context.Context
+}
+
+func (s *RequestIDStore) key(id string) string {
+	if s.Prefix != "" {
+		return s.Prefix + id
+	}
+	return DefaultRequestIDPrefix + id
+}
+
+// PutRequestID implements saml.RequestIDStore.
+func (s *RequestIDStore) PutRequestID(id string, expiry time.Time) error {
+	return s.Client.Set(contextOrBackground(s.Context), s.key(id), 1, ttl(expiry)).Err()
+}
+
+// TakeRequestID implements saml.RequestIDStore. Deleting the key is atomic,
+// so that of two concurrent responses to the same request only one is
+// accepted.
+func (s *RequestIDStore) TakeRequestID(id string) error {
+	deleted, err := s.Client.Del(contextOrBackground(s.Context), s.key(id)).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func contextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// ttl returns the expiration of a key that expires at expiry. An
+// expiration of zero would keep the key forever, so it is at least a
+// second.
+func ttl(expiry time.Time) time.Duration {
+	rv := time.Until(expiry)
+	if rv < time.Second {
+		return time.Second
+	}
+	return rv
+}
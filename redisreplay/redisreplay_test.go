@@ -0,0 +1,95 @@
+package redisreplay
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeClient implements Client with an in-memory map.
+type fakeClient struct {
+	keys        map[string]time.Duration
+	err         error
+	expirations []time.Duration
+}
+
+func (c *fakeClient) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	if c.err != nil {
+		return redis.NewBoolResult(false, c.err)
+	}
+	c.expirations = append(c.expirations, expiration)
+	if _, ok := c.keys[key]; ok {
+		return redis.NewBoolResult(false, nil)
+	}
+	c.keys[key] = expiration
+	return redis.NewBoolResult(true, nil)
+}
+
+func (c *fakeClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	if c.err != nil {
+		return redis.NewStatusResult("", c.err)
+	}
+	c.expirations = append(c.expirations, expiration)
+	c.keys[key] = expiration
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (c *fakeClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	if c.err != nil {
+		return redis.NewIntResult(0, c.err)
+	}
+	var deleted int64
+	for _, key := range keys {
+		if _, ok := c.keys[key]; ok {
+			delete(c.keys, key)
+			deleted++
+		}
+	}
+	return redis.NewIntResult(deleted, nil)
+}
+
+func TestCache(t *testing.T) {
+	client := &fakeClient{keys: map[string]time.Duration{}}
+	c := &Cache{Client: client}
+
+	seen, err := c.Seen("id-1", time.Now().Add(time.Hour))
+	assert.Check(t, err)
+	assert.Check(t, !seen)
+	assert.Check(t, is.Contains(client.keys, "saml:assertion:id-1"))
+	assert.Check(t, client.expirations[0] > 59*time.Minute && client.expirations[0] <= time.Hour)
+
+	seen, err = c.Seen("id-1", time.Now().Add(time.Hour))
+	assert.Check(t, err)
+	assert.Check(t, seen)
+
+	// keys never outlive their expiry, even if it has already passed
+	c.Prefix = "sp1:"
+	seen, err = c.Seen("id-1", time.Now().Add(-time.Hour))
+	assert.Check(t, err)
+	assert.Check(t, !seen)
+	assert.Check(t, is.Equal(time.Second, client.keys["sp1:id-1"]))
+
+	client.err = errors.New("connection refused")
+	_, err = c.Seen("id-2", time.Now().Add(time.Hour))
+	assert.Check(t, is.Error(err, "connection refused"))
+}
+
+func TestRequestIDStore(t *testing.T) {
+	client := &fakeClient{keys: map[string]time.Duration{}}
+	s := &RequestIDStore{Client: client}
+
+	assert.Check(t, s.PutRequestID("id-1", time.Now().Add(time.Minute)))
+	assert.Check(t, is.Contains(client.keys, "saml:request:id-1"))
+	assert.Check(t, s.TakeRequestID("id-1"))
+	assert.Check(t, is.Equal(os.ErrNotExist, s.TakeRequestID("id-1")))
+
+	client.err = errors.New("connection refused")
+	assert.Check(t, is.Error(s.PutRequestID("id-2", time.Now().Add(time.Minute)), "connection refused"))
+	assert.Check(t, is.Error(s.TakeRequestID("id-2"), "connection refused"))
+}
@@ -0,0 +1,25 @@
+module github.com/crewjam/saml/redissession
+
+go 1.26
+
+replace github.com/crewjam/saml => ../
+
+require (
+	github.com/crewjam/saml v0.0.0-00010101000000-000000000000
+	github.com/go-redis/redis/v8 v8.11.5
+	gotest.tools v2.2.0+incompatible
+)
+
+require (
+	github.com/beevik/etree v1.1.0 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/crewjam/httperr v0.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/golang-jwt/jwt/v4 v4.4.2 // indirect
+	github.com/google/go-cmp v0.5.8 // indirect
+	github.com/jonboulle/clockwork v0.2.2 // indirect
+	github.com/mattermost/xml-roundtrip-validator v0.1.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/russellhaering/goxmldsig v1.3.0 // indirect
+	golang.org/x/crypto v0.0.0-20220128200615-198e4374d7ed // indirect
+)
@@ -0,0 +1,268 @@
+package redissession
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/crewjam/saml"
+)
+
+var _ saml.SessionStore = (*IDPStore)(nil)
+
+var _ saml.SingleLogoutStore = (*IDPStore)(nil)
+
+// DefaultIDPPrefix is the default prefix of the keys that IDPStore stores
+// sessions under.
+const DefaultIDPPrefix = "saml:idp-session:"
+
+// DefaultParticipantPrefix is the default prefix of the keys of the sets
+// that IDPStore keeps the IDs of the sessions of each subject of each
+// service provider in.
+const DefaultParticipantPrefix = "saml:idp-session-participant:"
+
+// DefaultLogoutStatePrefix is the default prefix of the keys that IDPStore
+// stores the states of logouts under.
+const DefaultLogoutStatePrefix = "saml:idp-logout-state:"
+
+// IDPStore is a saml.SessionStore that stores the sessions of an identity
+// provider, and their participants, in Redis, so that the IDP can run as
+// many processes and still log users out of every service provider. Each
+// session is stored as a key that expires along with the session. The IDs
+// of the sessions in which a service provider was issued a NameID are kept
+// in a set, which is used to find the session that a LogoutRequest refers
+// to.
+//
+// IDPStore is also a saml.SingleLogoutStore that keeps the states of
+// logouts in Redis:
+//
+//	store := &redissession.IDPStore{Client: client}
+//	idp.SessionStore = store
+//	idp.SingleLogoutStore = store
+//
+// Participants are added to a session by reading and rewriting it, so a
+// participant added concurrently from another process may be lost.
+type IDPStore struct {
+	Client Client
+
+	// Prefix is prepended to the session IDs to form keys. The default is
+	// DefaultIDPPrefix.
+	Prefix string
+
+	// ParticipantPrefix is prepended to the service provider IDs and
+	// NameIDs to form the keys of the sets of session IDs. The default is
+	// DefaultParticipantPrefix.
+	ParticipantPrefix string
+
+	// LogoutStatePrefix is prepended to the IDs of logout states to form
+	// keys. The default is DefaultLogoutStatePrefix.
+	LogoutStatePrefix string
+
+	// Context, if not nil, is used for the calls to Redis. The default is
+	// context.Background().
+	Context context.Context
+}
+
+// idpRecord is the value stored under the key of a session.
+type idpRecord struct {
+	Session      saml.Session
+	Participants []saml.SessionParticipant
+}
+
+func (s *IDPStore) key(id string) string {
+	if s.Prefix != "" {
+		return s.Prefix + id
+	}
+	return DefaultIDPPrefix + id
+}
+
+func (s *IDPStore) participantKey(serviceProviderID string, nameID string) string {
+	prefix := s.ParticipantPrefix
+	if prefix == "" {
+		prefix = DefaultParticipantPrefix
+	}
+	return prefix + serviceProviderID + "!" + nameID
+}
+
+func (s *IDPStore) logoutStateKey(id string) string {
+	if s.LogoutStatePrefix != "" {
+		return s.LogoutStatePrefix + id
+	}
+	return DefaultLogoutStatePrefix + id
+}
+
+func (s *IDPStore) get(ctx context.Context, id string) (*idpRecord, error) {
+	value, err := s.Client.Get(ctx, s.key(id)).Bytes()
+	if err == redis.Nil {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	var rv idpRecord
+	if err := json.Unmarshal(value, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+func (s *IDPStore) put(ctx context.Context, record *idpRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.Client.Set(ctx, s.key(record.Session.ID), value, s.ttl(record)).Err()
+}
+
+// ttl returns the expiration of the key of record. A session without an
+// expiry time is kept for as long as its participants are valid, or
+// forever if they have none either.
+func (s *IDPStore) ttl(record *idpRecord) time.Duration {
+	expiry := record.Session.ExpireTime
+	for _, participant := range record.Participants {
+		if participant.ExpireTime.After(expiry) {
+			expiry = participant.ExpireTime
+		}
+	}
+	if expiry.IsZero() {
+		return 0
+	}
+	return ttl(expiry)
+}
+
+// Create implements saml.SessionStore.
+func (s *IDPStore) Create(session *saml.Session) error {
+	return s.put(contextOrBackground(s.Context), &idpRecord{Session: *session})
+}
+
+// Get implements saml.SessionStore.
+func (s *IDPStore) Get(sessionID string) (*saml.Session, error) {
+	record, err := s.get(contextOrBackground(s.Context), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &record.Session, nil
+}
+
+// AddServiceProvider implements saml.SessionStore.
+func (s *IDPStore) AddServiceProvider(sessionID string, participant saml.SessionParticipant) error {
+	ctx := contextOrBackground(s.Context)
+	record, err := s.get(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i, p := range record.Participants {
+		if p.ServiceProviderID == participant.ServiceProviderID {
+			record.Participants[i] = participant
+			replaced = true
+		}
+	}
+	if !replaced {
+		record.Participants = append(record.Participants, participant)
+	}
+	if err := s.put(ctx, record); err != nil {
+		return err
+	}
+
+	key := s.participantKey(participant.ServiceProviderID, participant.NameID.Value)
+	if err := s.Client.SAdd(ctx, key, sessionID).Err(); err != nil {
+		return err
+	}
+	if expiration := s.ttl(record); expiration > 0 {
+		return s.Client.Expire(ctx, key, expiration).Err()
+	}
+	return nil
+}
+
+// FindSession implements saml.SessionStore. The IDs of sessions that have
+// expired are removed from the set of the service provider and NameID as a
+// side effect.
+func (s *IDPStore) FindSession(serviceProviderID string, nameID string, sessionIndex string) (string, error) {
+	ctx := contextOrBackground(s.Context)
+	key := s.participantKey(serviceProviderID, nameID)
+	ids, err := s.Client.SMembers(ctx, key).Result()
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		record, err := s.get(ctx, id)
+		if err == os.ErrNotExist {
+			if err := s.Client.SRem(ctx, key, id).Err(); err != nil {
+				return "", err
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		for _, p := range record.Participants {
+			if p.ServiceProviderID != serviceProviderID || p.NameID.Value != nameID {
+				continue
+			}
+			if sessionIndex != "" && p.SessionIndex != sessionIndex {
+				continue
+			}
+			return id, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// Delete implements saml.SessionStore.
+func (s *IDPStore) Delete(sessionID string) ([]saml.SessionParticipant, error) {
+	ctx := contextOrBackground(s.Context)
+	record, err := s.get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Client.Del(ctx, s.key(sessionID)).Err(); err != nil {
+		return nil, err
+	}
+	for _, p := range record.Participants {
+		if err := s.Client.SRem(ctx, s.participantKey(p.ServiceProviderID, p.NameID.Value), sessionID).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return record.Participants, nil
+}
+
+// DeleteExpired implements saml.SessionStore. Redis removes the keys of
+// sessions when they expire, so it does nothing.
+func (s *IDPStore) DeleteExpired() error {
+	return nil
+}
+
+// PutLogoutState implements saml.SingleLogoutStore.
+func (s *IDPStore) PutLogoutState(id string, state *saml.LogoutState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.Client.Set(contextOrBackground(s.Context), s.logoutStateKey(id), value, ttl(state.ExpireTime)).Err()
+}
+
+// TakeLogoutState implements saml.SingleLogoutStore.
+func (s *IDPStore) TakeLogoutState(id string) (*saml.LogoutState, error) {
+	ctx := contextOrBackground(s.Context)
+	value, err := s.Client.Get(ctx, s.logoutStateKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	if err := s.Client.Del(ctx, s.logoutStateKey(id)).Err(); err != nil {
+		return nil, err
+	}
+	state := &saml.LogoutState{}
+	if err := json.Unmarshal(value, state); err != nil {
+		return nil, err
+	}
+	if saml.TimeNow().After(state.ExpireTime) {
+		return nil, os.ErrNotExist
+	}
+	return state, nil
+}
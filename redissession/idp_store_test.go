@@ -0,0 +1,92 @@
+package redissession
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml"
+)
+
+func TestIDPStore(t *testing.T) {
+	client := newFakeClient()
+	s := &IDPStore{Client: client}
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	assert.Check(t, s.Create(&saml.Session{ID: "session-1", UserName: "alice", ExpireTime: expiry}))
+	assert.Check(t, is.Contains(client.keys, "saml:idp-session:session-1"))
+	session, err := s.Get("session-1")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("alice", session.UserName))
+	_, err = s.Get("session-2")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	participant := saml.SessionParticipant{
+		ServiceProviderID: "https://sp.example.com/saml2/metadata",
+		NameID:            saml.NameID{Value: "ba5eba11"},
+		SessionIndex:      "index-1",
+		ExpireTime:        expiry,
+	}
+	assert.Check(t, s.AddServiceProvider("session-1", participant))
+	assert.Check(t, is.DeepEqual([]string{"session-1"},
+		client.sets["saml:idp-session-participant:https://sp.example.com/saml2/metadata!ba5eba11"]))
+	expiration := client.expirations["saml:idp-session-participant:https://sp.example.com/saml2/metadata!ba5eba11"]
+	assert.Check(t, expiration > 59*time.Minute && expiration <= time.Hour)
+	assert.Check(t, is.Equal(os.ErrNotExist, s.AddServiceProvider("session-2", participant)))
+
+	sessionID, err := s.FindSession("https://sp.example.com/saml2/metadata", "ba5eba11", "")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("session-1", sessionID))
+	sessionID, err = s.FindSession("https://sp.example.com/saml2/metadata", "ba5eba11", "index-1")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("session-1", sessionID))
+	_, err = s.FindSession("https://sp.example.com/saml2/metadata", "ba5eba11", "index-2")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+	_, err = s.FindSession("https://other.example.com/metadata", "ba5eba11", "")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	participants, err := s.Delete("session-1")
+	assert.Check(t, err)
+	assert.Assert(t, is.Len(participants, 1))
+	assert.Check(t, is.Equal("index-1", participants[0].SessionIndex))
+	assert.Check(t, participants[0].ExpireTime.Equal(expiry))
+	assert.Check(t, is.Len(client.sets["saml:idp-session-participant:https://sp.example.com/saml2/metadata!ba5eba11"], 0))
+	_, err = s.Delete("session-1")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	// sessions that have expired are removed from the sets when they are
+	// searched
+	assert.Check(t, s.Create(&saml.Session{ID: "session-3", ExpireTime: expiry}))
+	assert.Check(t, s.AddServiceProvider("session-3", participant))
+	delete(client.keys, "saml:idp-session:session-3")
+	_, err = s.FindSession("https://sp.example.com/saml2/metadata", "ba5eba11", "")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+	assert.Check(t, is.Len(client.sets["saml:idp-session-participant:https://sp.example.com/saml2/metadata!ba5eba11"], 0))
+
+	client.err = errors.New("connection refused")
+	assert.Check(t, is.Error(s.Create(&saml.Session{ID: "session-4"}), "connection refused"))
+	_, err = s.FindSession("https://sp.example.com/saml2/metadata", "ba5eba11", "")
+	assert.Check(t, is.Error(err, "connection refused"))
+}
+
+func TestIDPStoreLogoutState(t *testing.T) {
+	client := newFakeClient()
+	s := &IDPStore{Client: client}
+
+	state := &saml.LogoutState{RequestID: "id-1", ExpireTime: saml.TimeNow().Add(time.Minute)}
+	assert.Check(t, s.PutLogoutState("state-1", state))
+	assert.Check(t, is.Contains(client.keys, "saml:idp-logout-state:state-1"))
+	got, err := s.TakeLogoutState("state-1")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("id-1", got.RequestID))
+	_, err = s.TakeLogoutState("state-1")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	assert.Check(t, s.PutLogoutState("state-2", &saml.LogoutState{ExpireTime: saml.TimeNow().Add(-time.Minute)}))
+	_, err = s.TakeLogoutState("state-2")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+}
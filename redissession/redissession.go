@@ -0,0 +1,186 @@
+// Package redissession implements a samlsp.SessionStore backed by Redis, so
+// that the service providers of many processes can share server-side
+// sessions.
+//
+//	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+//	m, _ := samlsp.New(opts)
+//	m.Session = samlsp.NewServerSessionProvider(opts, &redissession.Store{Client: client})
+//
+// It also implements a saml.SessionStore, IDPStore, so that the identity
+// providers of many processes can share the sessions of users and the
+// service providers that participate in them.
+package redissession
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+// Client is the subset of the Redis API used by Store. It is implemented
+// by *redis.Client, *redis.ClusterClient and redis.UniversalClient.
+type Client interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+	SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	SMembers(ctx context.Context, key string) *redis.StringSliceCmd
+	SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+}
+
+var _ Client = (*redis.Client)(nil)
+
+var _ samlsp.SessionStore = (*Store)(nil)
+
+// DefaultPrefix is the default prefix of the keys that Store stores
+// sessions under.
+const DefaultPrefix = "saml:session:"
+
+// DefaultNameIDPrefix is the default prefix of the keys of the sets that
+// Store keeps the IDs of the sessions of each subject in. The key of a set
+// is formed of the query-escaped entity ID of the IDP and the NameID of
+// the subject, separated by a colon.
+const DefaultNameIDPrefix = "saml:session-name-id:"
+
+// Store is a samlsp.SessionStore that stores each session as a key that
+// expires along with the session. The IDs of the sessions of each subject
+// are kept in a set, which expires along with the last one stored; the IDs
+// of the sessions that have expired are removed from it when the sessions
+// of the subject are listed.
+type Store struct {
+	Client Client
+
+	// Prefix is prepended to the session IDs to form keys. The default is
+	// DefaultPrefix.
+	Prefix string
+
+	// NameIDPrefix is prepended to the IDP entity IDs and NameIDs to form
+	// the keys of the sets of session IDs. The default is
+	// DefaultNameIDPrefix.
+	NameIDPrefix string
+
+	// Context, if not nil, is used for the calls to Redis. The default is
+	// context.Background().
+	Context context.Context
+}
+
+func (s *Store) key(id string) string {
+	if s.Prefix != "" {
+		return s.Prefix + id
+	}
+	return DefaultPrefix + id
+}
+
+// nameIDKey returns the key of the set of the sessions of the subject
+// nameID of the IDP issuer. The issuer is escaped so that it cannot
+// contain the separator.
+func (s *Store) nameIDKey(issuer, nameID string) string {
+	prefix := DefaultNameIDPrefix
+	if s.NameIDPrefix != "" {
+		prefix = s.NameIDPrefix
+	}
+	return prefix + url.QueryEscape(issuer) + ":" + nameID
+}
+
+// record is the value stored under the key of a session.
+type record struct {
+	Info samlsp.SessionInfo
+	Data []byte
+}
+
+// Put implements samlsp.SessionStore.
+func (s *Store) Put(info samlsp.SessionInfo, data []byte) error {
+	ctx := contextOrBackground(s.Context)
+	value, err := json.Marshal(record{Info: info, Data: data})
+	if err != nil {
+		return err
+	}
+	if err := s.Client.Set(ctx, s.key(info.ID), value, ttl(info.Expiry)).Err(); err != nil {
+		return err
+	}
+	if info.NameID == "" {
+		return nil
+	}
+	if err := s.Client.SAdd(ctx, s.nameIDKey(info.Issuer, info.NameID), info.ID).Err(); err != nil {
+		return err
+	}
+	return s.Client.Expire(ctx, s.nameIDKey(info.Issuer, info.NameID), ttl(info.Expiry)).Err()
+}
+
+func (s *Store) get(ctx context.Context, id string) (*record, error) {
+	value, err := s.Client.Get(ctx, s.key(id)).Bytes()
+	if err == redis.Nil {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	var rv record
+	if err := json.Unmarshal(value, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+// Get implements samlsp.SessionStore.
+func (s *Store) Get(id string) ([]byte, error) {
+	rv, err := s.get(contextOrBackground(s.Context), id)
+	if err != nil {
+		return nil, err
+	}
+	return rv.Data, nil
+}
+
+// Delete implements samlsp.SessionStore.
+func (s *Store) Delete(id string) error {
+	return s.Client.Del(contextOrBackground(s.Context), s.key(id)).Err()
+}
+
+// List implements samlsp.SessionStore.
+func (s *Store) List(issuer, nameID string) ([]samlsp.SessionInfo, error) {
+	ctx := contextOrBackground(s.Context)
+	ids, err := s.Client.SMembers(ctx, s.nameIDKey(issuer, nameID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var rv []samlsp.SessionInfo
+	for _, id := range ids {
+		session, err := s.get(ctx, id)
+		if err == os.ErrNotExist {
+			if err := s.Client.SRem(ctx, s.nameIDKey(issuer, nameID), id).Err(); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		rv = append(rv, session.Info)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Expiry.Before(rv[j].Expiry) })
+	return rv, nil
+}
+
+func contextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// ttl returns the expiration of a key that expires at expiry. An
+// expiration of zero would keep the key forever, so it is at least a
+// second.
+func ttl(expiry time.Time) time.Duration {
+	rv := time.Until(expiry)
+	if rv < time.Second {
+		return time.Second
+	}
+	return rv
+}
@@ -0,0 +1,166 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+// fakeClient implements Client with in-memory maps.
+type fakeClient struct {
+	keys        map[string][]byte
+	sets        map[string][]string
+	expirations map[string]time.Duration
+	err         error
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		keys:        map[string][]byte{},
+		sets:        map[string][]string{},
+		expirations: map[string]time.Duration{},
+	}
+}
+
+func (c *fakeClient) Get(ctx context.Context, key string) *redis.StringCmd {
+	if c.err != nil {
+		return redis.NewStringResult("", c.err)
+	}
+	data, ok := c.keys[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(string(data), nil)
+}
+
+func (c *fakeClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	if c.err != nil {
+		return redis.NewStatusResult("", c.err)
+	}
+	c.keys[key] = value.([]byte)
+	c.expirations[key] = expiration
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (c *fakeClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	if c.err != nil {
+		return redis.NewIntResult(0, c.err)
+	}
+	var deleted int64
+	for _, key := range keys {
+		if _, ok := c.keys[key]; ok {
+			delete(c.keys, key)
+			deleted++
+		}
+		if _, ok := c.sets[key]; ok {
+			delete(c.sets, key)
+			deleted++
+		}
+	}
+	return redis.NewIntResult(deleted, nil)
+}
+
+func (c *fakeClient) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	if c.err != nil {
+		return redis.NewIntResult(0, c.err)
+	}
+	for _, member := range members {
+		c.sets[key] = append(c.sets[key], member.(string))
+	}
+	return redis.NewIntResult(int64(len(members)), nil)
+}
+
+func (c *fakeClient) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	if c.err != nil {
+		return redis.NewStringSliceResult(nil, c.err)
+	}
+	return redis.NewStringSliceResult(c.sets[key], nil)
+}
+
+func (c *fakeClient) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	if c.err != nil {
+		return redis.NewIntResult(0, c.err)
+	}
+	var removed int64
+	for _, member := range members {
+		for i, v := range c.sets[key] {
+			if v == member.(string) {
+				c.sets[key] = append(c.sets[key][:i], c.sets[key][i+1:]...)
+				removed++
+				break
+			}
+		}
+	}
+	return redis.NewIntResult(removed, nil)
+}
+
+func (c *fakeClient) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	if c.err != nil {
+		return redis.NewBoolResult(false, c.err)
+	}
+	c.expirations[key] = expiration
+	return redis.NewBoolResult(true, nil)
+}
+
+func TestStore(t *testing.T) {
+	client := newFakeClient()
+	s := &Store{Client: client}
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	issuer := "https://idp.example.com/metadata"
+	alice1 := samlsp.SessionInfo{ID: "session-1", Issuer: issuer, NameID: "alice", SessionIndex: "index-1", Expiry: expiry}
+	alice2 := samlsp.SessionInfo{ID: "session-2", Issuer: issuer, NameID: "alice", SessionIndex: "index-2", Expiry: expiry.Add(time.Minute)}
+	bob := samlsp.SessionInfo{ID: "session-3", Issuer: issuer, NameID: "bob", Expiry: expiry}
+	otherAlice := samlsp.SessionInfo{ID: "session-5", Issuer: "https://other-idp.example.com/metadata", NameID: "alice", Expiry: expiry}
+
+	assert.Check(t, s.Put(alice2, []byte("token-2")))
+	assert.Check(t, s.Put(alice1, []byte("token-1")))
+	assert.Check(t, s.Put(bob, []byte("token-3")))
+	assert.Check(t, s.Put(otherAlice, []byte("token-5")))
+	assert.Check(t, is.Contains(client.keys, "saml:session:session-1"))
+	assert.Check(t, is.DeepEqual([]string{"session-2", "session-1"}, client.sets["saml:session-name-id:https%3A%2F%2Fidp.example.com%2Fmetadata:alice"]))
+	expiration := client.expirations["saml:session-name-id:https%3A%2F%2Fidp.example.com%2Fmetadata:alice"]
+	assert.Check(t, expiration > 59*time.Minute && expiration <= time.Hour)
+
+	data, err := s.Get("session-1")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("token-1", string(data)))
+
+	// the sessions of another IDP's subject with the same NameID are not
+	// listed
+	sessions, err := s.List(issuer, "alice")
+	assert.Check(t, err)
+	assert.Check(t, is.Len(sessions, 2))
+	assert.Check(t, is.Equal("index-1", sessions[0].SessionIndex))
+	assert.Check(t, sessions[0].Expiry.Equal(expiry))
+	assert.Check(t, is.Equal("index-2", sessions[1].SessionIndex))
+
+	// deleted sessions are removed from the set of their subject when it is
+	// listed
+	assert.Check(t, s.Delete("session-1"))
+	_, err = s.Get("session-1")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+	sessions, err = s.List(issuer, "alice")
+	assert.Check(t, err)
+	assert.Check(t, is.Len(sessions, 1))
+	assert.Check(t, is.DeepEqual([]string{"session-2"}, client.sets["saml:session-name-id:https%3A%2F%2Fidp.example.com%2Fmetadata:alice"]))
+
+	// keys never outlive their expiry, even if it has already passed
+	s.Prefix = "sp1:"
+	assert.Check(t, s.Put(samlsp.SessionInfo{ID: "session-4", Expiry: time.Now().Add(-time.Hour)}, []byte("token-4")))
+	assert.Check(t, is.Equal(time.Second, client.expirations["sp1:session-4"]))
+
+	client.err = errors.New("connection refused")
+	assert.Check(t, is.Error(s.Put(bob, []byte("token-3")), "connection refused"))
+	_, err = s.Get("session-3")
+	assert.Check(t, is.Error(err, "connection refused"))
+	_, err = s.List(issuer, "bob")
+	assert.Check(t, is.Error(err, "connection refused"))
+}
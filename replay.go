@@ -0,0 +1,76 @@
+package saml
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplayCache is an interface used by ServiceProvider to remember the IDs of
+// the assertions it has accepted, so that an assertion captured in transit
+// cannot be presented to the assertion consumer service again while it is
+// still valid. The reference implementation is MemoryReplayCache; the
+// redisreplay module provides one that can be shared by many processes.
+type ReplayCache interface {
+	// Seen records that the assertion with the given ID has been received
+	// and reports whether it had already been recorded. The ID need not be
+	// remembered after expiry, at which point the assertion is rejected
+	// anyway.
+	Seen(id string, expiry time.Time) (bool, error)
+}
+
+// MemoryReplayCache is an implementation of ReplayCache that resides
+// completely in memory. It is suitable for a service provider that runs as
+// a single process.
+//
+// TimeSource, if not nil, is the source of the current time used to expire
+// IDs. Otherwise the TimeSource of the ServiceProvider is used, or TimeNow.
+type MemoryReplayCache struct {
+	TimeSource TimeSource
+
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+// Seen implements ReplayCache. Expired IDs are discarded as a side effect.
+func (c *MemoryReplayCache) Seen(id string, expiry time.Time) (bool, error) {
+	return c.seen(id, expiry, timeNow(c.TimeSource))
+}
+
+func (c *MemoryReplayCache) seen(id string, expiry time.Time, now time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ids == nil {
+		c.ids = map[string]time.Time{}
+	}
+
+	for k, v := range c.ids {
+		if now.After(v) {
+			delete(c.ids, k)
+		}
+	}
+	if _, ok := c.ids[id]; ok {
+		return true, nil
+	}
+	c.ids[id] = expiry
+	return false, nil
+}
+
+// memoryReplayCacheView is a MemoryReplayCache that expires IDs using the
+// TimeSource of the ServiceProvider that uses it.
+type memoryReplayCacheView struct {
+	cache      *MemoryReplayCache
+	timeSource TimeSource
+}
+
+func (v memoryReplayCacheView) Seen(id string, expiry time.Time) (bool, error) {
+	return v.cache.seen(id, expiry, timeNow(v.timeSource))
+}
+
+// replayCache returns the ReplayCache of the SP. A MemoryReplayCache without
+// a TimeSource of its own uses that of the SP.
+func (sp *ServiceProvider) replayCache() ReplayCache {
+	if c, ok := sp.ReplayCache.(*MemoryReplayCache); ok && c.TimeSource == nil {
+		return memoryReplayCacheView{cache: c, timeSource: sp.TimeSource}
+	}
+	return sp.ReplayCache
+}
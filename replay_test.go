@@ -0,0 +1,57 @@
+package saml
+
+import (
+	"testing"
+	"time"
+
+	dsig "github.com/russellhaering/goxmldsig"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestMemoryReplayCache(t *testing.T) {
+	now := time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC)
+	TimeNow = func() time.Time { return now }
+
+	c := &MemoryReplayCache{}
+	seen, err := c.Seen("id-1", now.Add(time.Minute))
+	assert.Check(t, err)
+	assert.Check(t, !seen)
+
+	seen, err = c.Seen("id-1", now.Add(time.Minute))
+	assert.Check(t, err)
+	assert.Check(t, seen)
+
+	seen, err = c.Seen("id-2", now.Add(time.Minute))
+	assert.Check(t, err)
+	assert.Check(t, !seen)
+
+	// expired IDs are forgotten
+	now = now.Add(2 * time.Minute)
+	seen, err = c.Seen("id-1", now.Add(time.Minute))
+	assert.Check(t, err)
+	assert.Check(t, !seen)
+	assert.Check(t, is.Len(c.ids, 1))
+}
+
+func TestMemoryReplayCacheUsesTimeSource(t *testing.T) {
+	TimeNow = func() time.Time { return time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC) }
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// the cache's own TimeSource is used instead of TimeNow
+	c := &MemoryReplayCache{TimeSource: dsig.NewFakeClockAt(now)}
+	_, err := c.Seen("id-1", now.Add(-time.Minute))
+	assert.Check(t, err)
+	_, err = c.Seen("id-2", now.Add(time.Minute))
+	assert.Check(t, err)
+	assert.Check(t, is.Len(c.ids, 1))
+
+	// otherwise that of the SP that uses it
+	c = &MemoryReplayCache{}
+	sp := ServiceProvider{ReplayCache: c, TimeSource: dsig.NewFakeClockAt(now)}
+	_, err = sp.replayCache().Seen("id-1", now.Add(-time.Minute))
+	assert.Check(t, err)
+	_, err = sp.replayCache().Seen("id-2", now.Add(time.Minute))
+	assert.Check(t, err)
+	assert.Check(t, is.Len(c.ids, 1))
+}
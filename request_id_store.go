@@ -0,0 +1,103 @@
+package saml
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// RequestIDStore is an interface used by ServiceProvider to remember the IDs
+// of the authentication requests and queries it has issued, so that the
+// InResponseTo of a response can be validated by any instance of a service
+// provider that is scaled horizontally, not only by the one that issued the
+// request. The default implementation is MemoryRequestIDStore; the
+// redisreplay module provides one that can be shared by many processes.
+type RequestIDStore interface {
+	// PutRequestID records that a request with the given ID has been issued
+	// and can be responded to until expiry.
+	PutRequestID(id string, expiry time.Time) error
+
+	// TakeRequestID removes the request ID from the store, so that each
+	// request is responded to at most once. If there is no such ID, or it
+	// has expired, the returned error must be os.ErrNotExist.
+	TakeRequestID(id string) error
+}
+
+// MemoryRequestIDStore is an implementation of RequestIDStore that resides
+// completely in memory. It is suitable for a service provider that runs as
+// a single process.
+//
+// TimeSource, if not nil, is the source of the current time used to expire
+// IDs. Otherwise the TimeSource of the ServiceProvider is used, or TimeNow.
+type MemoryRequestIDStore struct {
+	TimeSource TimeSource
+
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+// PutRequestID implements RequestIDStore. Expired IDs are discarded as a
+// side effect.
+func (s *MemoryRequestIDStore) PutRequestID(id string, expiry time.Time) error {
+	return s.putRequestID(id, expiry, timeNow(s.TimeSource))
+}
+
+func (s *MemoryRequestIDStore) putRequestID(id string, expiry time.Time, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids == nil {
+		s.ids = map[string]time.Time{}
+	}
+
+	for k, v := range s.ids {
+		if now.After(v) {
+			delete(s.ids, k)
+		}
+	}
+	s.ids[id] = expiry
+	return nil
+}
+
+// TakeRequestID implements RequestIDStore.
+func (s *MemoryRequestIDStore) TakeRequestID(id string) error {
+	return s.takeRequestID(id, timeNow(s.TimeSource))
+}
+
+func (s *MemoryRequestIDStore) takeRequestID(id string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiry, ok := s.ids[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(s.ids, id)
+	if now.After(expiry) {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// memoryRequestIDStoreView is a MemoryRequestIDStore that expires IDs using
+// the TimeSource of the ServiceProvider that uses it.
+type memoryRequestIDStoreView struct {
+	store      *MemoryRequestIDStore
+	timeSource TimeSource
+}
+
+func (v memoryRequestIDStoreView) PutRequestID(id string, expiry time.Time) error {
+	return v.store.putRequestID(id, expiry, timeNow(v.timeSource))
+}
+
+func (v memoryRequestIDStoreView) TakeRequestID(id string) error {
+	return v.store.takeRequestID(id, timeNow(v.timeSource))
+}
+
+// requestIDStore returns the RequestIDStore of the SP. A
+// MemoryRequestIDStore without a TimeSource of its own uses that of the SP.
+func (sp *ServiceProvider) requestIDStore() RequestIDStore {
+	if s, ok := sp.RequestIDStore.(*MemoryRequestIDStore); ok && s.TimeSource == nil {
+		return memoryRequestIDStoreView{store: s, timeSource: sp.TimeSource}
+	}
+	return sp.RequestIDStore
+}
@@ -0,0 +1,26 @@
+package saml
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestMemoryRequestIDStore(t *testing.T) {
+	now := time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC)
+	TimeNow = func() time.Time { return now }
+
+	s := &MemoryRequestIDStore{}
+	assert.Check(t, s.PutRequestID("id-1", now.Add(time.Minute)))
+	assert.Check(t, s.PutRequestID("id-2", now.Add(time.Minute)))
+	assert.Check(t, s.TakeRequestID("id-1"))
+	assert.Check(t, is.Equal(os.ErrNotExist, s.TakeRequestID("id-1")))
+	assert.Check(t, is.Equal(os.ErrNotExist, s.TakeRequestID("id-3")))
+
+	// expired IDs cannot be taken
+	now = now.Add(2 * time.Minute)
+	assert.Check(t, is.Equal(os.ErrNotExist, s.TakeRequestID("id-2")))
+}
@@ -2,7 +2,7 @@ module github.com/crewjam/saml/samlidp
 
 replace github.com/crewjam/saml => ../
 
-go 1.16
+go 1.26
 
 require (
 	github.com/crewjam/saml v0.0.0-00010101000000-000000000000
@@ -12,3 +12,11 @@ require (
 	golang.org/x/crypto v0.0.0-20220128200615-198e4374d7ed
 	gotest.tools v2.2.0+incompatible
 )
+
+require (
+	github.com/beevik/etree v1.1.0 // indirect
+	github.com/google/go-cmp v0.5.8 // indirect
+	github.com/jonboulle/clockwork v0.2.2 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/russellhaering/goxmldsig v1.3.0 // indirect
+)
@@ -22,6 +22,7 @@ type Options struct {
 	Logger      logger.Interface
 	Certificate *x509.Certificate
 	Store       Store
+	Tracer      saml.Tracer
 }
 
 // Server represents an IDP server. The server provides the following URLs:
@@ -62,6 +63,7 @@ func New(opts Options) (*Server, error) {
 			Certificate: opts.Certificate,
 			MetadataURL: metadataURL,
 			SSOURL:      ssoURL,
+			Tracer:      opts.Tracer,
 		},
 		logger: logr,
 		Store:  opts.Store,
@@ -0,0 +1,90 @@
+package samlsp
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// APIChallenge is the JSON body of the 401 responses that RequireAccount
+// sends to API clients that have no session. See
+// Middleware.APIRequestMatcher.
+type APIChallenge struct {
+	Error string `json:"error"`
+
+	// LoginURL, if m.LoginURL is set, is the URL that the client should
+	// send the user to in order to log in. The user is returned to the
+	// page that made the request afterwards.
+	LoginURL string `json:"login_url,omitempty"`
+}
+
+// IsAPIRequest reports whether r appears to be made by a script or an API
+// client rather than by a user navigating to a page: it has the
+// X-Requested-With header of XMLHttpRequest, or it accepts JSON but not
+// HTML.
+func IsAPIRequest(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return true
+	}
+	acceptsJSON, acceptsHTML := false, false
+	for _, accept := range strings.Split(strings.Join(r.Header.Values("Accept"), ","), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			acceptsJSON = true
+		case mediaType == "text/html" || mediaType == "*/*":
+			acceptsHTML = true
+		}
+	}
+	return acceptsJSON && !acceptsHTML
+}
+
+// apiRequestMatcher returns the APIRequestMatcher for the provided options:
+// one that matches the requests for paths under opts.APIPathPrefixes and,
+// if opts.APIChallenge is set, those that IsAPIRequest matches. It returns
+// nil if neither is set.
+func apiRequestMatcher(opts Options) func(r *http.Request) bool {
+	if !opts.APIChallenge && len(opts.APIPathPrefixes) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		for _, prefix := range opts.APIPathPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				return true
+			}
+		}
+		return opts.APIChallenge && IsAPIRequest(r)
+	}
+}
+
+// writeAPIChallenge answers r with a 401 response with an APIChallenge.
+func (m *Middleware) writeAPIChallenge(w http.ResponseWriter, r *http.Request) {
+	challenge := APIChallenge{Error: "login_required"}
+	if m.LoginURL.Path != "" {
+		loginURL := m.LoginURL
+		loginURL.RawQuery = url.Values{returnTargetParam: {m.apiChallengeTarget(r)}}.Encode()
+		challenge.LoginURL = loginURL.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", "SAML")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(challenge)
+}
+
+// apiChallengeTarget returns the local URI of the page that made r, which
+// is where the user returns after logging in, or the DefaultRedirectURI
+// of the ServiceProvider if the page is unknown.
+func (m *Middleware) apiChallengeTarget(r *http.Request) string {
+	if referer, err := url.Parse(r.Referer()); err == nil && referer.Host != "" && referer.Host == r.Host {
+		if target := referer.RequestURI(); isLocalURI(target) {
+			return target
+		}
+	}
+	return m.redirectURIAfterLogin(r, "")
+}
@@ -0,0 +1,105 @@
+package samlsp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestIsAPIRequest(t *testing.T) {
+	for _, tc := range []struct {
+		header http.Header
+		api    bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Accept": {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}}, false},
+		{http.Header{"Accept": {"application/json"}}, true},
+		{http.Header{"Accept": {"application/problem+json, text/plain"}}, true},
+		{http.Header{"Accept": {"application/json, */*"}}, false},
+		{http.Header{"X-Requested-With": {"XMLHttpRequest"}}, true},
+	} {
+		req, _ := http.NewRequest("GET", "/frob", nil)
+		req.Header = tc.header
+		assert.Check(t, is.Equal(tc.api, IsAPIRequest(req)), "%v", tc.header)
+	}
+}
+
+func TestMiddlewareChallengesAPIRequests(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.APIRequestMatcher = apiRequestMatcher(Options{APIChallenge: true, APIPathPrefixes: []string{"/api/"}})
+	test.Middleware.LoginURL = mustParseURL("https://15661444.ngrok.io/saml2/login")
+	handler := test.Middleware.RequireAccount(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("not reached")
+		}))
+
+	// scripts are told where to send the user
+	req, _ := http.NewRequest("GET", "https://15661444.ngrok.io/frob", nil)
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	req.Header.Set("Referer", "https://15661444.ngrok.io/app?page=2")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusUnauthorized, resp.Code))
+	assert.Check(t, is.Equal("application/json", resp.Header().Get("Content-Type")))
+	assert.Check(t, is.Len(resp.Header()["Set-Cookie"], 0))
+	var challenge APIChallenge
+	assert.Check(t, json.NewDecoder(resp.Body).Decode(&challenge))
+	assert.Check(t, is.DeepEqual(APIChallenge{
+		Error:    "login_required",
+		LoginURL: "https://15661444.ngrok.io/saml2/login?target=%2Fapp%3Fpage%3D2",
+	}, challenge))
+
+	// as are the clients of API paths, who are returned to the default URI
+	req, _ = http.NewRequest("GET", "https://15661444.ngrok.io/api/frob", nil)
+	req.Header.Set("Referer", "https://evil.com/app")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusUnauthorized, resp.Code))
+	assert.Check(t, is.Contains(resp.Body.String(), `"login_url":"https://15661444.ngrok.io/saml2/login?target=%2F"`))
+
+	// users navigating to pages are still redirected to the IDP
+	req, _ = http.NewRequest("GET", "https://15661444.ngrok.io/frob", nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+}
+
+func TestMiddlewareServeLogin(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.LoginURL = mustParseURL("https://15661444.ngrok.io/saml2/login")
+
+	req, _ := http.NewRequest("GET", "/saml2/login?target=%2Fapp%3Fpage%3D2", nil)
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	redirectURL, err := url.Parse(resp.Header().Get("Location"))
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("idp.testshib.org", redirectURL.Host))
+	codec := test.Middleware.RequestTracker.(CookieRequestTracker).Codec
+	trackedRequest, err := codec.Decode(resp.Result().Cookies()[0].Value)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("/app?page=2", trackedRequest.URI))
+
+	// users that have a session are returned immediately
+	req, _ = http.NewRequest("GET", "/saml2/login?target=%2Fapp", nil)
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("/app", resp.Header().Get("Location")))
+
+	req, _ = http.NewRequest("GET", "/saml2/login?target=https%3A%2F%2Fevil.com%2F", nil)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusBadRequest, resp.Code))
+
+	// New enables the endpoint along with the challenges
+	m, err := New(Options{URL: mustParseURL("https://15661444.ngrok.io/"), APIChallenge: true})
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://15661444.ngrok.io/saml/login", m.LoginURL.String()))
+}
@@ -0,0 +1,145 @@
+package samlsp
+
+import (
+	"strings"
+
+	"github.com/crewjam/saml"
+)
+
+// AttributeMapper rewrites the attributes of an assertion before the
+// session is created from it, so that the application sees the attributes
+// under the keys it expects whatever the identity provider calls them.
+//
+// Each attribute is stored under the key that Names maps its Name or, if
+// its Name is not mapped, its FriendlyName to. Attributes that are not
+// mapped keep their FriendlyName or Name, or are dropped if DropUnmapped
+// is true. Attributes stored under the same key are merged into one, and
+// duplicate values are removed.
+//
+// The values of the attributes whose key is in Separators are split on the
+// separator, for identity providers that send a multi-valued attribute as
+// one value such as "staff,member". Finally, the values of the attributes
+// whose key is in Transforms are replaced by what the function returns for
+// them. Attributes left without values are dropped.
+type AttributeMapper struct {
+	Names        map[string]string
+	DropUnmapped bool
+	Separators   map[string]string
+	Transforms   map[string]func(values []string) []string
+}
+
+// Map returns the attributes of the assertion, mapped to their keys.
+func (am *AttributeMapper) Map(assertion *saml.Assertion) Attributes {
+	_, attributes := am.mapAttributes(assertion)
+	return attributes
+}
+
+// mapAttributes returns the attributes of the assertion, mapped to their
+// keys, and the keys in the order that the attributes appear in.
+func (am *AttributeMapper) mapAttributes(assertion *saml.Assertion) ([]string, Attributes) {
+	var keys []string
+	attributes := Attributes{}
+	for _, attributeStatement := range assertion.AttributeStatements {
+		for _, attr := range attributeStatement.Attributes {
+			key, ok := am.key(attr)
+			if !ok {
+				continue
+			}
+			if _, ok := attributes[key]; !ok {
+				keys = append(keys, key)
+				attributes[key] = nil
+			}
+			for _, value := range attr.Values {
+				v := value.Value
+				if value.NameID != nil {
+					v = value.NameID.Value
+				}
+				for _, v := range am.split(key, v) {
+					if !containsValue(attributes[key], v) {
+						attributes[key] = append(attributes[key], v)
+					}
+				}
+			}
+		}
+	}
+
+	var mappedKeys []string
+	for _, key := range keys {
+		if transform := am.Transforms[key]; transform != nil {
+			attributes[key] = transform(attributes[key])
+		}
+		if len(attributes[key]) == 0 {
+			delete(attributes, key)
+			continue
+		}
+		mappedKeys = append(mappedKeys, key)
+	}
+	return mappedKeys, attributes
+}
+
+// MapAssertion returns a copy of assertion with a single attribute
+// statement that holds the attributes returned by Map, each named by its
+// key. The assertion itself is not modified.
+func (am *AttributeMapper) MapAssertion(assertion *saml.Assertion) *saml.Assertion {
+	keys, attributes := am.mapAttributes(assertion)
+
+	statement := saml.AttributeStatement{}
+	for _, key := range keys {
+		attr := saml.Attribute{
+			Name:       key,
+			NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified",
+		}
+		for _, value := range attributes[key] {
+			attr.Values = append(attr.Values, saml.AttributeValue{Type: "xs:string", Value: value})
+		}
+		statement.Attributes = append(statement.Attributes, attr)
+	}
+
+	rv := *assertion
+	rv.AttributeStatements = nil
+	if len(statement.Attributes) > 0 {
+		rv.AttributeStatements = []saml.AttributeStatement{statement}
+	}
+	return &rv
+}
+
+// key returns the key that attr is stored under, or false if it is dropped.
+func (am *AttributeMapper) key(attr saml.Attribute) (string, bool) {
+	if key, ok := am.Names[attr.Name]; ok && attr.Name != "" {
+		return key, true
+	}
+	if key, ok := am.Names[attr.FriendlyName]; ok && attr.FriendlyName != "" {
+		return key, true
+	}
+	if am.DropUnmapped {
+		return "", false
+	}
+	if attr.FriendlyName != "" {
+		return attr.FriendlyName, true
+	}
+	return attr.Name, true
+}
+
+// split returns the values in value of the attribute stored under key.
+func (am *AttributeMapper) split(key string, value string) []string {
+	separator := am.Separators[key]
+	if separator == "" {
+		return []string{value}
+	}
+	var values []string
+	for _, v := range strings.Split(value, separator) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package samlsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml"
+)
+
+func testAttributeMapperAssertion() *saml.Assertion {
+	stringValues := func(values ...string) []saml.AttributeValue {
+		var rv []saml.AttributeValue
+		for _, v := range values {
+			rv = append(rv, saml.AttributeValue{Type: "xs:string", Value: v})
+		}
+		return rv
+	}
+	return &saml.Assertion{
+		Issuer: saml.Issuer{Value: "https://idp.example.com/saml/metadata"},
+		Subject: &saml.Subject{
+			NameID: &saml.NameID{Value: "alice"},
+		},
+		AttributeStatements: []saml.AttributeStatement{
+			{
+				Attributes: []saml.Attribute{
+					{Name: "urn:oid:2.5.4.42", FriendlyName: "givenName", Values: stringValues("Alice")},
+					{Name: "urn:oid:0.9.2342.19200300.100.1.3", Values: stringValues("alice@example.com")},
+					{Name: "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress", Values: stringValues("ALICE@example.com")},
+					{Name: "groups", Values: stringValues("staff, admins")},
+				},
+			},
+			{
+				Attributes: []saml.Attribute{
+					{Name: "urn:oid:0.9.2342.19200300.100.1.3", Values: stringValues("alice@example.com")},
+					{Name: "groups", Values: stringValues("staff")},
+					{Name: "urn:oid:2.5.4.4", FriendlyName: "sn", Values: stringValues("Smith")},
+				},
+			},
+		},
+	}
+}
+
+func TestAttributeMapperMapsAttributes(t *testing.T) {
+	mapper := &AttributeMapper{
+		Names: map[string]string{
+			"urn:oid:0.9.2342.19200300.100.1.3":                                  "email",
+			"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress": "email",
+			"givenName": "first_name",
+		},
+		Separators: map[string]string{
+			"groups": ",",
+		},
+		Transforms: map[string]func([]string) []string{
+			"email": func(values []string) []string {
+				var rv []string
+				for _, v := range values {
+					if v = strings.ToLower(v); !containsValue(rv, v) {
+						rv = append(rv, v)
+					}
+				}
+				return rv
+			},
+			"sn": func([]string) []string { return nil },
+		},
+	}
+
+	assertion := testAttributeMapperAssertion()
+	assert.Check(t, is.DeepEqual(Attributes{
+		"first_name": {"Alice"},
+		"email":      {"alice@example.com"},
+		"groups":     {"staff", "admins"},
+	}, mapper.Map(assertion)))
+
+	mappedAssertion := mapper.MapAssertion(assertion)
+	assert.Assert(t, is.Len(mappedAssertion.AttributeStatements, 1))
+	var names []string
+	for _, attr := range mappedAssertion.AttributeStatements[0].Attributes {
+		names = append(names, attr.Name)
+	}
+	assert.Check(t, is.DeepEqual([]string{"first_name", "email", "groups"}, names))
+	assert.Check(t, is.Equal("alice", mappedAssertion.Subject.NameID.Value))
+
+	// the assertion itself is not modified
+	assert.Check(t, is.Len(assertion.AttributeStatements, 2))
+}
+
+func TestAttributeMapperCanDropUnmappedAttributes(t *testing.T) {
+	mapper := &AttributeMapper{
+		Names:        map[string]string{"urn:oid:2.5.4.4": "last_name"},
+		DropUnmapped: true,
+	}
+	assert.Check(t, is.DeepEqual(Attributes{"last_name": {"Smith"}}, mapper.Map(testAttributeMapperAssertion())))
+}
+
+func TestMiddlewareMapsSessionAttributes(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.AttributeMapper = &AttributeMapper{
+		Names: map[string]string{"urn:oid:0.9.2342.19200300.100.1.1": "username"},
+	}
+
+	r, _ := http.NewRequest("GET", "/frob", nil)
+	r.Form = url.Values{}
+	resp := httptest.NewRecorder()
+	assertion := testAttributeMapperAssertion()
+	assertion.AttributeStatements[0].Attributes = append(assertion.AttributeStatements[0].Attributes, saml.Attribute{
+		Name:   "urn:oid:0.9.2342.19200300.100.1.1",
+		Values: []saml.AttributeValue{{Value: "alice"}},
+	})
+	test.Middleware.CreateSessionFromAssertion(resp, r, assertion, "/")
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+
+	r, _ = http.NewRequest("GET", "/frob", nil)
+	r.Header.Set("Cookie", resp.Header().Get("Set-Cookie"))
+	session, err := test.Middleware.Session.GetSession(r)
+	assert.Assert(t, err)
+	attributes := session.(SessionWithAttributes).GetAttributes()
+	assert.Check(t, is.DeepEqual([]string{"alice"}, attributes["username"]))
+	assert.Check(t, is.DeepEqual([]string{"Alice"}, attributes["givenName"]))
+	assert.Check(t, is.Len(attributes["urn:oid:0.9.2342.19200300.100.1.1"], 0))
+}
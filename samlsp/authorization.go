@@ -0,0 +1,118 @@
+package samlsp
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// AttributeRule is a condition on the attributes of a session. See
+// RequireAttributes.
+type AttributeRule interface {
+	Match(attributes Attributes) bool
+}
+
+// AttributeRuleFunc is an AttributeRule that is a function.
+type AttributeRuleFunc func(attributes Attributes) bool
+
+// Match implements AttributeRule.
+func (f AttributeRuleFunc) Match(attributes Attributes) bool {
+	return f(attributes)
+}
+
+// AttributeContains returns an AttributeRule that the attributes match if
+// the attribute `name` has the value `value`.
+func AttributeContains(name, value string) AttributeRule {
+	return AttributeRuleFunc(func(attributes Attributes) bool {
+		for _, v := range attributes[name] {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// AttributeMatches returns an AttributeRule that the attributes match if
+// one of the values of the attribute `name` matches re. Anchor re, i.e.
+// `^cn=admins,`, to match whole values.
+func AttributeMatches(name string, re *regexp.Regexp) AttributeRule {
+	return AttributeRuleFunc(func(attributes Attributes) bool {
+		for _, v := range attributes[name] {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// AttributePresent returns an AttributeRule that the attributes match if
+// the attribute `name` has a value.
+func AttributePresent(name string) AttributeRule {
+	return AttributeRuleFunc(func(attributes Attributes) bool {
+		return len(attributes[name]) > 0
+	})
+}
+
+// AllOf returns an AttributeRule that the attributes match if they match
+// all of rules.
+func AllOf(rules ...AttributeRule) AttributeRule {
+	return AttributeRuleFunc(func(attributes Attributes) bool {
+		for _, rule := range rules {
+			if !rule.Match(attributes) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// AnyOf returns an AttributeRule that the attributes match if they match
+// at least one of rules.
+func AnyOf(rules ...AttributeRule) AttributeRule {
+	return AttributeRuleFunc(func(attributes Attributes) bool {
+		for _, rule := range rules {
+			if rule.Match(attributes) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RequireAttributes returns a handler that serves handler if the
+// attributes of the session match rule, and forbidden otherwise. If
+// forbidden is nil, it responds with 403 Forbidden. Like RequireAttribute,
+// it relies on the session assigned to the context in RequireAccount; a
+// request without one is forbidden.
+//
+// For example:
+//
+//	rule := samlsp.AnyOf(
+//		samlsp.AttributeContains("eduPersonAffiliation", "staff"),
+//		samlsp.AttributeMatches("memberOf", regexp.MustCompile(`^cn=admins,`)),
+//	)
+//	http.Handle("/admin", m.RequireAccount(samlsp.RequireAttributes(admin, rule, nil)))
+func RequireAttributes(handler http.Handler, rule AttributeRule, forbidden http.Handler) http.Handler {
+	if forbidden == nil {
+		forbidden = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := SessionFromContext(r.Context())
+		if session == nil {
+			forbidden.ServeHTTP(w, r)
+			return
+		}
+		var attributes Attributes
+		if s, ok := session.(SessionWithAttributes); ok {
+			attributes = s.GetAttributes()
+		}
+		if !rule.Match(attributes) {
+			forbidden.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
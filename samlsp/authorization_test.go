@@ -0,0 +1,87 @@
+package samlsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestAttributeRules(t *testing.T) {
+	attributes := Attributes{
+		"eduPersonAffiliation": {"Member", "Staff"},
+		"memberOf":             {"cn=users,dc=example,dc=com", "cn=admins,dc=example,dc=com"},
+	}
+	for _, tc := range []struct {
+		name  string
+		rule  AttributeRule
+		match bool
+	}{
+		{"contains", AttributeContains("eduPersonAffiliation", "Staff"), true},
+		{"contains is exact", AttributeContains("eduPersonAffiliation", "staff"), false},
+		{"contains missing", AttributeContains("mail", "Staff"), false},
+		{"matches", AttributeMatches("memberOf", regexp.MustCompile(`^cn=admins,`)), true},
+		{"matches none", AttributeMatches("memberOf", regexp.MustCompile(`^cn=root,`)), false},
+		{"present", AttributePresent("memberOf"), true},
+		{"absent", AttributePresent("mail"), false},
+		{"all of", AllOf(AttributeContains("eduPersonAffiliation", "Member"), AttributePresent("memberOf")), true},
+		{"not all of", AllOf(AttributeContains("eduPersonAffiliation", "Member"), AttributePresent("mail")), false},
+		{"any of", AnyOf(AttributePresent("mail"), AttributeContains("eduPersonAffiliation", "Staff")), true},
+		{"none of", AnyOf(AttributePresent("mail"), AttributeContains("eduPersonAffiliation", "Faculty")), false},
+		{"nested", AllOf(AttributePresent("memberOf"), AnyOf(AttributePresent("mail"), AttributeContains("eduPersonAffiliation", "Staff"))), true},
+		{"empty all of", AllOf(), true},
+		{"empty any of", AnyOf(), false},
+	} {
+		assert.Check(t, is.Equal(tc.match, tc.rule.Match(attributes)), tc.name)
+	}
+}
+
+func TestMiddlewareRequireAttributes(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	newHandler := func(rule AttributeRule, forbidden http.Handler) http.Handler {
+		return test.Middleware.RequireAccount(
+			RequireAttributes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}), rule, forbidden))
+	}
+	serve := func(handler http.Handler) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/frob", nil)
+		req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := serve(newHandler(AnyOf(
+		AttributeContains("eduPersonAffiliation", "Faculty"),
+		AttributeMatches("cn", regexp.MustCompile(`^Me Myself`)),
+	), nil))
+	assert.Check(t, is.Equal(http.StatusTeapot, resp.Code))
+
+	resp = serve(newHandler(AllOf(
+		AttributeContains("eduPersonAffiliation", "Staff"),
+		AttributeContains("eduPersonAffiliation", "Faculty"),
+	), nil))
+	assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+
+	resp = serve(newHandler(AttributePresent("mail"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Check(t, SessionFromContext(r.Context()) != nil)
+		http.Error(w, "staff only", http.StatusForbidden)
+	})))
+	assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+	assert.Check(t, is.Equal("staff only\n", resp.Body.String()))
+}
+
+func TestMiddlewareRequireAttributesMissingAccount(t *testing.T) {
+	handler := RequireAttributes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("not reached")
+	}), AllOf(), nil)
+
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+}
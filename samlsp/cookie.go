@@ -0,0 +1,30 @@
+package samlsp
+
+import "net/http"
+
+// setCookie adds a Set-Cookie header for cookie to w, like http.SetCookie.
+// Browsers reject cookies that are SameSite=None or partitioned unless they
+// are Secure, so such cookies always are. The Partitioned attribute (see
+// CHIPS) is appended by hand, since http.Cookie cannot represent it in the
+// versions of Go this package supports.
+func setCookie(w http.ResponseWriter, cookie *http.Cookie, partitioned bool) {
+	if cookie.SameSite == http.SameSiteNoneMode || partitioned {
+		cookie.Secure = true
+	}
+	v := cookie.String()
+	if v == "" {
+		return
+	}
+	if partitioned {
+		v += "; Partitioned"
+	}
+	w.Header().Add("Set-Cookie", v)
+}
+
+// cookiePath returns path, or "/" if it is empty.
+func cookiePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,83 @@
+package samlsp
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// DiscoveryService describes an identity provider discovery service, which
+// lets the users of a service provider that trusts many identity providers
+// choose the one to authenticate with.
+//
+// See the Identity Provider Discovery Service Protocol and Profile,
+// https://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-idp-discovery.pdf
+type DiscoveryService struct {
+	// URL is the URL of the discovery service.
+	URL url.URL
+
+	// ReturnURL is the URL of the endpoint of the service provider that the
+	// discovery service returns the user to, i.e.
+	// https://example.com/saml/disco
+	ReturnURL url.URL
+
+	// ReturnIDParam is the name of the query parameter in which the
+	// discovery service returns the entity ID of the chosen identity
+	// provider. The default is "entityID".
+	ReturnIDParam string
+
+	// IsPassive, if true, asks the discovery service not to interact with
+	// the user.
+	IsPassive bool
+}
+
+// returnTargetParam is the parameter of ReturnURL that carries the URI to
+// send the user back to once authenticated.
+const returnTargetParam = "target"
+
+func (ds *DiscoveryService) returnIDParam() string {
+	if ds.ReturnIDParam != "" {
+		return ds.ReturnIDParam
+	}
+	return "entityID"
+}
+
+// RedirectURL returns the URL of the discovery service to send the user to.
+// spEntityID is the entity ID of the service provider, and target is the
+// local URI to return the user to once they have authenticated.
+func (ds *DiscoveryService) RedirectURL(spEntityID string, target string) *url.URL {
+	returnURL := ds.ReturnURL
+	returnQuery := returnURL.Query()
+	returnQuery.Set(returnTargetParam, target)
+	returnURL.RawQuery = returnQuery.Encode()
+
+	rv := ds.URL
+	query := rv.Query()
+	query.Set("entityID", spEntityID)
+	query.Set("return", returnURL.String())
+	if ds.ReturnIDParam != "" {
+		query.Set("returnIDParam", ds.ReturnIDParam)
+	}
+	if ds.IsPassive {
+		query.Set("isPassive", "true")
+	}
+	rv.RawQuery = query.Encode()
+	return &rv
+}
+
+// ParseResponse returns the entity ID of the identity provider chosen by the
+// user, and the URI to return the user to, from a request that the
+// discovery service sent to ReturnURL. The entity ID is empty if no
+// identity provider was chosen.
+func (ds *DiscoveryService) ParseResponse(r *http.Request) (entityID string, target string, err error) {
+	query := r.URL.Query()
+
+	// target must be a local URI, lest the discovery response be used as
+	// an open redirect
+	target = query.Get(returnTargetParam)
+	if !isLocalURI(target) {
+		return "", "", errors.New("invalid discovery response target")
+	}
+
+	return query.Get(ds.returnIDParam()), target, nil
+}
@@ -0,0 +1,118 @@
+package samlsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"gotest.tools/golden"
+
+	"github.com/crewjam/saml/testsaml"
+)
+
+func TestDiscoveryServiceRedirectURL(t *testing.T) {
+	ds := DiscoveryService{
+		URL:       mustParseURL("https://ds.example.com/disco"),
+		ReturnURL: mustParseURL("https://sp.example.com/saml/disco"),
+	}
+	assert.Check(t, is.Equal("https://ds.example.com/disco?entityID=https%3A%2F%2Fsp.example.com%2Fsaml%2Fmetadata&return=https%3A%2F%2Fsp.example.com%2Fsaml%2Fdisco%3Ftarget%3D%252Ffrob%253Fa%253Db",
+		ds.RedirectURL("https://sp.example.com/saml/metadata", "/frob?a=b").String()))
+
+	ds.ReturnIDParam = "idp"
+	ds.IsPassive = true
+	assert.Check(t, is.Equal("https://ds.example.com/disco?entityID=https%3A%2F%2Fsp.example.com%2Fsaml%2Fmetadata&isPassive=true&return=https%3A%2F%2Fsp.example.com%2Fsaml%2Fdisco%3Ftarget%3D%252Ffrob&returnIDParam=idp",
+		ds.RedirectURL("https://sp.example.com/saml/metadata", "/frob").String()))
+}
+
+func TestDiscoveryServiceParseResponse(t *testing.T) {
+	ds := DiscoveryService{ReturnIDParam: "idp"}
+
+	r, _ := http.NewRequest("GET", "/saml/disco?target=%2Ffrob&idp=https%3A%2F%2Fidp.example.com%2F", nil)
+	entityID, target, err := ds.ParseResponse(r)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://idp.example.com/", entityID))
+	assert.Check(t, is.Equal("/frob", target))
+
+	for _, target := range []string{"", "https://evil.example.com/", "//evil.example.com/", "/\\evil.example.com/"} {
+		r, _ := http.NewRequest("GET", "/saml/disco?idp=https%3A%2F%2Fidp.example.com%2F&target="+url.QueryEscape(target), nil)
+		_, _, err := ds.ParseResponse(r)
+		assert.Check(t, is.Error(err, "invalid discovery response target"), target)
+	}
+}
+
+func TestMiddlewareCanUseDiscoveryService(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.ServiceProvider.AcsURL.Scheme = "http"
+	idpMetadata, err := ReadMetadataMap(bytes.NewReader(test.IDPMetadata))
+	assert.Assert(t, err)
+	test.Middleware.ServiceProvider.IDPMetadata = nil
+	test.Middleware.IDPMetadataResolver = idpMetadata
+	test.Middleware.Discovery = &DiscoveryService{
+		URL:       mustParseURL("https://ds.example.com/disco"),
+		ReturnURL: mustParseURL("https://15661444.ngrok.io/saml2/disco"),
+	}
+
+	// the user is sent to the discovery service...
+	handler := test.Middleware.RequireAccount(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("not reached")
+		}))
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal(test.Middleware.Discovery.RedirectURL("https://15661444.ngrok.io/saml2/metadata", "/frob").String(),
+		resp.Header().Get("Location")))
+
+	// ...which returns them with their choice of identity provider
+	req, _ = http.NewRequest("GET", "/saml2/disco?target=%2Ffrob&entityID=https%3A%2F%2Fidp.testshib.org%2Fidp%2Fshibboleth", nil)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+
+		test.makeTrackedRequestForIDP("id-00020406080a0c0e10121416181a1c1e20222426", "https://idp.testshib.org/idp/shibboleth")+"; Path=/saml2/acs; Max-Age=90; HttpOnly",
+		resp.Header().Get("Set-Cookie")))
+	redirectURL, err := url.Parse(resp.Header().Get("Location"))
+	assert.Check(t, err)
+	decodedRequest, err := testsaml.ParseRedirectRequest(redirectURL)
+	assert.Check(t, err)
+	golden.Assert(t, string(decodedRequest), "expected_authn_request.xml")
+
+	// the response is validated against the metadata of the chosen identity provider
+	test.Middleware.ServiceProvider.AcsURL.Scheme = "https"
+	v := &url.Values{}
+	v.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	v.Set("RelayState", "KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6")
+	req, _ = http.NewRequest("POST", "/saml2/acs", bytes.NewReader([]byte(v.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", ""+
+		"saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+test.makeTrackedRequestForIDP("id-9e61753d64e928af5a7a341a97f420c9", "https://idp.testshib.org/idp/shibboleth"))
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("/frob", resp.Header().Get("Location")))
+}
+
+func TestMiddlewareRejectsUnknownDiscoveredIDP(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.IDPMetadataResolver = MetadataMap{}
+	test.Middleware.Discovery = &DiscoveryService{
+		URL:       mustParseURL("https://ds.example.com/disco"),
+		ReturnURL: mustParseURL("https://15661444.ngrok.io/saml2/disco"),
+	}
+
+	req, _ := http.NewRequest("GET", "/saml2/disco?target=%2Ffrob&entityID=https%3A%2F%2Fidp.example.com%2F", nil)
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+
+	req, _ = http.NewRequest("GET", "/saml2/disco?target=https%3A%2F%2Fevil.example.com%2F&entityID=https%3A%2F%2Fidp.example.com%2F", nil)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusBadRequest, resp.Code))
+}
@@ -0,0 +1,144 @@
+package samlsp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/crewjam/saml"
+)
+
+const metadataNamespace = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+// EntityFilter reports whether an entity of a metadata document should be
+// selected.
+type EntityFilter func(entity *saml.EntityDescriptor) bool
+
+// WithEntityID returns an EntityFilter that selects the entity with the
+// given entity ID.
+func WithEntityID(entityID string) EntityFilter {
+	return func(entity *saml.EntityDescriptor) bool {
+		return entity.EntityID == entityID
+	}
+}
+
+// IsIdentityProvider is an EntityFilter that selects entities with an
+// IDPSSODescriptor.
+func IsIdentityProvider(entity *saml.EntityDescriptor) bool {
+	return len(entity.IDPSSODescriptors) > 0
+}
+
+// IsAttributeAuthority is an EntityFilter that selects entities with an
+// AttributeAuthorityDescriptor.
+func IsAttributeAuthority(entity *saml.EntityDescriptor) bool {
+	return len(entity.AttributeAuthorityDescriptors) > 0
+}
+
+// ReadEntities reads the metadata document from r, which is either a single
+// EntityDescriptor or an EntitiesDescriptor aggregate whose groups may be
+// nested, and calls fn with each entity that matches all of filters.
+//
+// The document is parsed as a stream and only one entity is held in memory
+// at a time, so large federation aggregates can be processed without
+// loading them whole. If fn returns an error, reading stops and the error
+// is returned.
+func ReadEntities(r io.Reader, fn func(entity *saml.EntityDescriptor) error, filters ...EntityFilter) error {
+	d := xml.NewDecoder(r)
+	root := true
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			if root {
+				return errors.New("metadata is empty")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		isMetadata := start.Name.Space == metadataNamespace
+		switch {
+		case isMetadata && start.Name.Local == "EntitiesDescriptor":
+			// descend into the group
+		case isMetadata && start.Name.Local == "EntityDescriptor":
+			entity := &saml.EntityDescriptor{}
+			if err := d.DecodeElement(entity, &start); err != nil {
+				return err
+			}
+			if matchesAll(entity, filters) {
+				if err := fn(entity); err != nil {
+					return err
+				}
+			}
+		case root:
+			return fmt.Errorf("expected element <EntitiesDescriptor> or <EntityDescriptor> in name space %s but have <%s>",
+				metadataNamespace, start.Name.Local)
+		default:
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		}
+		root = false
+	}
+}
+
+// FindEntity returns the first entity of the metadata document read from
+// r that matches all of filters. See ReadEntities.
+func FindEntity(r io.Reader, filters ...EntityFilter) (*saml.EntityDescriptor, error) {
+	var found *saml.EntityDescriptor
+	err := ReadEntities(r, func(entity *saml.EntityDescriptor) error {
+		found = entity
+		return errStopReading
+	}, filters...)
+	if err != nil && err != errStopReading {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrEntityNotFound
+	}
+	return found, nil
+}
+
+var errStopReading = errors.New("stop reading")
+
+func matchesAll(entity *saml.EntityDescriptor, filters []EntityFilter) bool {
+	for _, filter := range filters {
+		if !filter(entity) {
+			return false
+		}
+	}
+	return true
+}
+
+// MetadataMap is a MetadataResolver that resolves entities from metadata
+// held in memory, keyed by entity ID.
+type MetadataMap map[string]*saml.EntityDescriptor
+
+// ResolveMetadata implements MetadataResolver.
+func (m MetadataMap) ResolveMetadata(ctx context.Context, entityID string) (*saml.EntityDescriptor, error) {
+	if entity, ok := m[entityID]; ok {
+		return entity, nil
+	}
+	return nil, ErrEntityNotFound
+}
+
+// ReadMetadataMap reads the entities of the metadata document from r that
+// match all of filters into a MetadataMap. See ReadEntities.
+func ReadMetadataMap(r io.Reader, filters ...EntityFilter) (MetadataMap, error) {
+	m := MetadataMap{}
+	err := ReadEntities(r, func(entity *saml.EntityDescriptor) error {
+		m[entity.EntityID] = entity
+		return nil
+	}, filters...)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,91 @@
+package samlsp
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml"
+)
+
+const testAggregate = `<?xml version="1.0" encoding="UTF-8"?>
+<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" Name="urn:example:federation">
+  <Extensions><PublicationInfo xmlns="urn:oasis:names:tc:SAML:metadata:rpi" publisher="urn:example:federation"/></Extensions>
+  <EntityDescriptor entityID="https://sp.example.com/">
+    <SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"/>
+  </EntityDescriptor>
+  <EntitiesDescriptor Name="urn:example:federation:universities">
+    <EntitiesDescriptor Name="urn:example:federation:universities:north">
+      <EntityDescriptor entityID="https://aa.north.example.edu/">
+        <AttributeAuthorityDescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"/>
+      </EntityDescriptor>
+      <EntityDescriptor entityID="https://idp.north.example.edu/">
+        <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"/>
+        <AttributeAuthorityDescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"/>
+      </EntityDescriptor>
+    </EntitiesDescriptor>
+    <EntityDescriptor entityID="https://idp.south.example.edu/">
+      <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"/>
+    </EntityDescriptor>
+  </EntitiesDescriptor>
+</EntitiesDescriptor>
+`
+
+func TestReadEntitiesDescendsIntoNestedGroups(t *testing.T) {
+	var entityIDs []string
+	collect := func(entity *saml.EntityDescriptor) error {
+		entityIDs = append(entityIDs, entity.EntityID)
+		return nil
+	}
+
+	assert.Check(t, ReadEntities(strings.NewReader(testAggregate), collect))
+	assert.Check(t, is.DeepEqual([]string{
+		"https://sp.example.com/",
+		"https://aa.north.example.edu/",
+		"https://idp.north.example.edu/",
+		"https://idp.south.example.edu/",
+	}, entityIDs))
+
+	entityIDs = nil
+	assert.Check(t, ReadEntities(strings.NewReader(testAggregate), collect, IsIdentityProvider))
+	assert.Check(t, is.DeepEqual([]string{"https://idp.north.example.edu/", "https://idp.south.example.edu/"}, entityIDs))
+
+	entityIDs = nil
+	assert.Check(t, ReadEntities(strings.NewReader(testAggregate), collect, IsAttributeAuthority, IsIdentityProvider))
+	assert.Check(t, is.DeepEqual([]string{"https://idp.north.example.edu/"}, entityIDs))
+
+	// an error from fn stops reading
+	errBoom := errors.New("boom")
+	err := ReadEntities(strings.NewReader(testAggregate), func(entity *saml.EntityDescriptor) error {
+		return errBoom
+	})
+	assert.Check(t, is.Equal(errBoom, err))
+}
+
+func TestFindEntity(t *testing.T) {
+	entity, err := FindEntity(strings.NewReader(testAggregate), WithEntityID("https://idp.south.example.edu/"))
+	assert.Check(t, err)
+	assert.Check(t, is.Len(entity.IDPSSODescriptors, 1))
+
+	_, err = FindEntity(strings.NewReader(testAggregate), WithEntityID("https://sp.example.com/"), IsIdentityProvider)
+	assert.Check(t, is.Equal(ErrEntityNotFound, err))
+
+	// a single EntityDescriptor is an entity too
+	test := NewMiddlewareTest(t)
+	entity, err = FindEntity(bytes.NewReader(test.IDPMetadata), IsIdentityProvider)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://idp.testshib.org/idp/shibboleth", entity.EntityID))
+
+	_, err = FindEntity(strings.NewReader(`<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol"/>`))
+	assert.Check(t, is.Error(err, "expected element <EntitiesDescriptor> or <EntityDescriptor> in name space urn:oasis:names:tc:SAML:2.0:metadata but have <Response>"))
+}
+
+func TestParseMetadataFindsIDPInNestedGroups(t *testing.T) {
+	entity, err := ParseMetadata([]byte(testAggregate))
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://idp.north.example.edu/", entity.EntityID))
+}
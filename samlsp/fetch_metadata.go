@@ -3,6 +3,7 @@ package samlsp
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
 	"encoding/xml"
 	"errors"
 	"io/ioutil"
@@ -19,7 +20,8 @@ import (
 //
 // Note: this is needed because IDP metadata is sometimes wrapped in
 // an <EntitiesDescriptor>, and sometimes the top level element is an
-// <EntityDescriptor>.
+// <EntityDescriptor>. From an <EntitiesDescriptor>, the first entity with
+// an IDPSSODescriptor is returned; use FindEntity to select another one.
 func ParseMetadata(data []byte) (*saml.EntityDescriptor, error) {
 	entity := &saml.EntityDescriptor{}
 
@@ -31,17 +33,11 @@ func ParseMetadata(data []byte) (*saml.EntityDescriptor, error) {
 
 	// this comparison is ugly, but it is how the error is generated in encoding/xml
 	if err != nil && err.Error() == "expected element type <EntityDescriptor> but have <EntitiesDescriptor>" {
-		entities := &saml.EntitiesDescriptor{}
-		if err := xml.Unmarshal(data, entities); err != nil {
-			return nil, err
+		entity, err := FindEntity(bytes.NewReader(data), IsIdentityProvider)
+		if err == ErrEntityNotFound {
+			return nil, errors.New("no entity found with IDPSSODescriptor")
 		}
-
-		for i, e := range entities.EntityDescriptors {
-			if len(e.IDPSSODescriptors) > 0 {
-				return &entities.EntityDescriptors[i], nil
-			}
-		}
-		return nil, errors.New("no entity found with IDPSSODescriptor")
+		return entity, err
 	}
 	if err != nil {
 		return nil, err
@@ -49,8 +45,40 @@ func ParseMetadata(data []byte) (*saml.EntityDescriptor, error) {
 	return entity, nil
 }
 
+// ParseSignedMetadata is like ParseMetadata, but rejects metadata that does
+// not carry a valid signature made with one of certs, which are typically
+// the signing certificates of a federation.
+func ParseSignedMetadata(data []byte, certs []*x509.Certificate) (*saml.EntityDescriptor, error) {
+	if err := xrv.Validate(bytes.NewBuffer(data)); err != nil {
+		return nil, err
+	}
+	if err := saml.VerifyMetadataSignature(data, certs); err != nil {
+		return nil, err
+	}
+	return ParseMetadata(data)
+}
+
 // FetchMetadata returns metadata from an IDP metadata URL.
 func FetchMetadata(ctx context.Context, httpClient *http.Client, metadataURL url.URL) (*saml.EntityDescriptor, error) {
+	data, err := fetchMetadata(ctx, httpClient, metadataURL)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMetadata(data)
+}
+
+// FetchSignedMetadata returns metadata from an IDP metadata URL, rejecting
+// metadata that does not carry a valid signature made with one of certs.
+func FetchSignedMetadata(ctx context.Context, httpClient *http.Client, metadataURL url.URL, certs []*x509.Certificate) (*saml.EntityDescriptor, error) {
+	data, err := fetchMetadata(ctx, httpClient, metadataURL)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSignedMetadata(data, certs)
+}
+
+// fetchMetadata returns the metadata document at metadataURL.
+func fetchMetadata(ctx context.Context, httpClient *http.Client, metadataURL url.URL) ([]byte, error) {
 	req, err := http.NewRequest("GET", metadataURL.String(), nil)
 	if err != nil {
 		return nil, err
@@ -66,10 +94,5 @@ func FetchMetadata(ctx context.Context, httpClient *http.Client, metadataURL url
 		return nil, httperr.Response(*resp)
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	return ParseMetadata(data)
+	return ioutil.ReadAll(resp.Body)
 }
@@ -1,15 +1,22 @@
 package samlsp
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
 
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
+	"gotest.tools/golden"
+
+	"github.com/crewjam/saml"
 )
 
 func TestFetchMetadata(t *testing.T) {
@@ -26,3 +33,55 @@ func TestFetchMetadata(t *testing.T) {
 	assert.Check(t, err)
 	assert.Check(t, is.Equal("https://idp.testshib.org/idp/shibboleth", md.EntityID))
 }
+
+func TestFetchSignedMetadata(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	saml.Clock = dsig.NewFakeClockAt(test.Certificate.NotBefore)
+
+	signedMetadata := signMetadata(t, test, test.IDPMetadata)
+
+	var metadata []byte
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(metadata)
+	}))
+	defer testServer.Close()
+	u, _ := url.Parse(testServer.URL + "/metadata")
+	certs := []*x509.Certificate{test.Certificate}
+
+	metadata = signedMetadata
+	md, err := FetchSignedMetadata(context.Background(), testServer.Client(), *u, certs)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://idp.testshib.org/idp/shibboleth", md.EntityID))
+
+	metadata = test.IDPMetadata
+	_, err = FetchSignedMetadata(context.Background(), testServer.Client(), *u, certs)
+	assert.Check(t, is.Error(err, "metadata is not signed"))
+
+	metadata = bytes.Replace(signedMetadata, []byte("https://idp.testshib.org/idp/profile/SAML2/Redirect/SSO"),
+		[]byte("https://evil.example.com/idp/profile/SAML2/Redirect/SSO"), 1)
+	_, err = FetchSignedMetadata(context.Background(), testServer.Client(), *u, certs)
+	assert.Check(t, is.Error(err, "cannot validate signature on metadata: Signature could not be verified"))
+
+	// the metadata must be signed by one of the trusted certificates
+	otherCert := mustParseCertificate(golden.Get(t, "cert_2017.pem"))
+	_, err = ParseSignedMetadata(signedMetadata, []*x509.Certificate{otherCert})
+	assert.Check(t, is.Error(err, "cannot validate signature on metadata: Could not verify certificate against trusted certs"))
+}
+
+// signMetadata returns data, a metadata document, signed with the key of
+// test.
+func signMetadata(t *testing.T, test *MiddlewareTest, data []byte) []byte {
+	doc := etree.NewDocument()
+	assert.Assert(t, doc.ReadFromBytes(data))
+	doc.Root().CreateAttr("ID", "id-6e1a5e1bb8fc2e4bbd4a1e3d6d47da3e")
+	signingContext, err := dsig.NewSigningContext(test.Key, [][]byte{test.Certificate.Raw})
+	assert.Assert(t, err)
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	assert.Assert(t, signingContext.SetSignatureMethod(dsig.RSASHA256SignatureMethod))
+	signedEl, err := signingContext.SignEnveloped(doc.Root())
+	assert.Assert(t, err)
+	doc.SetRoot(signedEl)
+	signedData, err := doc.WriteToBytes()
+	assert.Assert(t, err)
+	return signedData
+}
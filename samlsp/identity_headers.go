@@ -0,0 +1,89 @@
+package samlsp
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The headers that carry the identity of the user to the application when
+// Middleware.IdentityHeaders is set.
+const (
+	// SubjectHeader carries the NameID of the subject of the session.
+	SubjectHeader = "X-Saml-Subject"
+
+	// AttributeHeaderPrefix is the prefix of the headers that carry the
+	// attributes of the session, one header per attribute, with one value
+	// per attribute value.
+	AttributeHeaderPrefix = "X-Saml-Attr-"
+)
+
+// setIdentityHeaders sets the identity headers of r to the subject and
+// attributes of session, replacing any that the client sent.
+func setIdentityHeaders(r *http.Request, session Session) {
+	stripIdentityHeaders(r.Header)
+
+	if s, ok := session.(SessionWithSubject); ok {
+		if subject := sanitizeHeaderValue(s.GetSubject()); subject != "" {
+			r.Header.Set(SubjectHeader, subject)
+		}
+	}
+
+	s, ok := session.(SessionWithAttributes)
+	if !ok {
+		return
+	}
+	attributes := s.GetAttributes()
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headerName := AttributeHeaderName(name)
+		if headerName == AttributeHeaderPrefix {
+			continue
+		}
+		for _, value := range attributes[name] {
+			r.Header.Add(headerName, sanitizeHeaderValue(value))
+		}
+	}
+}
+
+// stripIdentityHeaders removes the identity headers from header. Names
+// that differ only by underscores in place of dashes are removed too,
+// because some servers and gateways treat them as the same header.
+func stripIdentityHeaders(header http.Header) {
+	for name := range header {
+		normalized := strings.ToLower(strings.Replace(name, "_", "-", -1))
+		if normalized == strings.ToLower(SubjectHeader) ||
+			strings.HasPrefix(normalized, strings.ToLower(AttributeHeaderPrefix)) {
+			delete(header, name)
+		}
+	}
+}
+
+// AttributeHeaderName returns the name of the header that carries the
+// attribute named name. Characters that are not allowed in header names,
+// such as the colons and dots of URN and OID names, are replaced by dashes,
+// so "urn:oid:2.5.4.42" is carried in "X-Saml-Attr-Urn-Oid-2-5-4-42".
+func AttributeHeaderName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			b[i] = '-'
+		}
+	}
+	return http.CanonicalHeaderKey(AttributeHeaderPrefix + strings.Trim(string(b), "-"))
+}
+
+// sanitizeHeaderValue returns value without the control characters that
+// could end the header or inject others.
+func sanitizeHeaderValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+}
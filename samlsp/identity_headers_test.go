@@ -0,0 +1,74 @@
+package samlsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestMiddlewareSetsIdentityHeaders(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.IdentityHeaders = true
+
+	var upstreamHeader http.Header
+	handler := test.Middleware.RequireAccount(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamHeader = r.Header
+			w.WriteHeader(http.StatusTeapot)
+		}))
+
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	req.Header.Set("X-Saml-Subject", "admin")
+	req.Header.Set("X-Saml-Attr-Uid", "admin")
+	req.Header.Set("X-Saml-Attr-Groups", "admins")
+	req.Header["X_saml_attr_groups"] = []string{"admins"}
+	req.Header.Set("X-Other", "kept")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusTeapot, resp.Code))
+
+	// the headers sent by the client are replaced or removed
+	assert.Check(t, is.DeepEqual([]string{"_41bd295976dadd70e1480f318e772841"}, upstreamHeader["X-Saml-Subject"]))
+	assert.Check(t, is.DeepEqual([]string{"myself"}, upstreamHeader["X-Saml-Attr-Uid"]))
+	assert.Check(t, is.Len(upstreamHeader["X-Saml-Attr-Groups"], 0))
+	assert.Check(t, is.Len(upstreamHeader["X_saml_attr_groups"], 0))
+	assert.Check(t, is.Equal("kept", upstreamHeader.Get("X-Other")))
+
+	// multi-valued attributes have one value per attribute value
+	assert.Check(t, is.DeepEqual([]string{"Member", "Staff"}, upstreamHeader["X-Saml-Attr-Edupersonaffiliation"]))
+	assert.Check(t, is.DeepEqual([]string{"urn:mace:dir:entitlement:common-lib-terms"}, upstreamHeader["X-Saml-Attr-Edupersonentitlement"]))
+
+	// the request of the caller is not modified
+	assert.Check(t, is.Equal("admin", req.Header.Get("X-Saml-Subject")))
+}
+
+func TestMiddlewareOmitsIdentityHeadersByDefault(t *testing.T) {
+	test := NewMiddlewareTest(t)
+
+	handler := test.Middleware.RequireAccount(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Check(t, is.Equal("", r.Header.Get("X-Saml-Subject")))
+			assert.Check(t, is.Equal("", r.Header.Get("X-Saml-Attr-Uid")))
+			w.WriteHeader(http.StatusTeapot)
+		}))
+
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusTeapot, resp.Code))
+}
+
+func TestAttributeHeaderName(t *testing.T) {
+	assert.Check(t, is.Equal("X-Saml-Attr-Urn-Oid-2-5-4-42", AttributeHeaderName("urn:oid:2.5.4.42")))
+	assert.Check(t, is.Equal("X-Saml-Attr-Givenname", AttributeHeaderName("givenName")))
+	assert.Check(t, is.Equal("X-Saml-Attr-Session-Index", AttributeHeaderName("Session Index\r\n")))
+}
+
+func TestSanitizeHeaderValue(t *testing.T) {
+	assert.Check(t, is.Equal("aliceX-Injected: 1", sanitizeHeaderValue("alice\r\nX-Injected: 1")))
+}
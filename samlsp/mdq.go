@@ -0,0 +1,160 @@
+package samlsp
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec // SHA-1 is mandated by the MDQ entity ID transformation
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/httperr"
+
+	"github.com/crewjam/saml"
+)
+
+// MetadataResolver resolves the metadata of an identity provider from its
+// entity ID.
+type MetadataResolver interface {
+	ResolveMetadata(ctx context.Context, entityID string) (*saml.EntityDescriptor, error)
+}
+
+// ErrEntityNotFound is returned by a MetadataResolver when it has no
+// metadata for an entity.
+var ErrEntityNotFound = errors.New("entity not found")
+
+// DefaultMDQCacheDuration is how long an MDQClient caches metadata that
+// does not specify a cacheDuration.
+const DefaultMDQCacheDuration = time.Hour
+
+// MDQClient is a MetadataResolver that fetches the metadata of individual
+// entities on demand from a server implementing the Metadata Query
+// Protocol, as used by federations that are too large to consume as a
+// single aggregate.
+//
+// Entities are requested by the SHA-1 transformation of their entity ID.
+// The metadata must be signed by one of Certificates, and is cached until
+// its cacheDuration has elapsed or it is no longer valid.
+type MDQClient struct {
+	// BaseURL is the base URL of the MDQ server, without the trailing
+	// "/entities".
+	BaseURL url.URL
+
+	// Certificates are the certificates that the metadata must be signed
+	// with, typically the signing certificates of the federation.
+	Certificates []*x509.Certificate
+
+	// HTTPClient is used to query the server. The default is
+	// http.DefaultClient.
+	HTTPClient *http.Client
+
+	// CacheDuration is how long metadata that does not specify a
+	// cacheDuration is cached. The default is DefaultMDQCacheDuration.
+	CacheDuration time.Duration
+
+	mu    sync.Mutex
+	cache map[string]mdqCacheEntry
+}
+
+type mdqCacheEntry struct {
+	metadata *saml.EntityDescriptor
+	expires  time.Time
+}
+
+// ResolveMetadata implements MetadataResolver.
+func (c *MDQClient) ResolveMetadata(ctx context.Context, entityID string) (*saml.EntityDescriptor, error) {
+	now := saml.TimeNow()
+
+	c.mu.Lock()
+	entry, ok := c.cache[entityID]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.metadata, nil
+	}
+
+	md, err := c.fetch(ctx, entityID)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheDuration := c.CacheDuration
+	if cacheDuration == 0 {
+		cacheDuration = DefaultMDQCacheDuration
+	}
+	if md.CacheDuration > 0 {
+		cacheDuration = md.CacheDuration
+	}
+	expires := now.Add(cacheDuration)
+	if !md.ValidUntil.IsZero() && md.ValidUntil.Before(expires) {
+		expires = md.ValidUntil
+	}
+
+	c.mu.Lock()
+	if c.cache == nil {
+		c.cache = map[string]mdqCacheEntry{}
+	}
+	c.cache[entityID] = mdqCacheEntry{metadata: md, expires: expires}
+	c.mu.Unlock()
+	return md, nil
+}
+
+// fetch queries the server for the metadata of entityID.
+func (c *MDQClient) fetch(ctx context.Context, entityID string) (*saml.EntityDescriptor, error) {
+	req, err := http.NewRequest("GET", c.EntityURL(entityID).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/samlmetadata+xml")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrEntityNotFound
+	}
+	if resp.StatusCode >= 400 {
+		return nil, httperr.Response(*resp)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	md, err := ParseSignedMetadata(data, c.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	if md.EntityID != entityID {
+		return nil, fmt.Errorf("expected metadata for %q but got %q", entityID, md.EntityID)
+	}
+	if !md.ValidUntil.IsZero() && !saml.TimeNow().Before(md.ValidUntil) {
+		return nil, fmt.Errorf("metadata for %q expired at %s", entityID, md.ValidUntil.Format(time.RFC3339))
+	}
+	return md, nil
+}
+
+// EntityURL returns the URL at which the server publishes the metadata of
+// entityID, using the SHA-1 transformation of the entity ID.
+func (c *MDQClient) EntityURL(entityID string) *url.URL {
+	sum := sha1.Sum([]byte(entityID))
+	id := "{sha1}" + hex.EncodeToString(sum[:])
+
+	u := c.BaseURL
+	rawPath := strings.TrimSuffix(u.EscapedPath(), "/") + "/entities/" + url.PathEscape(id)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/entities/" + id
+	u.RawPath = rawPath
+	return &u
+}
@@ -0,0 +1,87 @@
+package samlsp
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	dsig "github.com/russellhaering/goxmldsig"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml"
+)
+
+func TestMDQClientEntityURL(t *testing.T) {
+	c := MDQClient{BaseURL: mustParseURL("https://mdq.example.com/global/")}
+	assert.Check(t, is.Equal("https://mdq.example.com/global/entities/%7Bsha1%7Dd03e57953345e57a1a82074d2d477c9ca38df976",
+		c.EntityURL("https://idp.testshib.org/idp/shibboleth").String()))
+}
+
+func TestMDQClientCanResolveMetadata(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	saml.Clock = dsig.NewFakeClockAt(test.Certificate.NotBefore)
+	saml.TimeNow = func() time.Time { return test.Certificate.NotBefore }
+
+	signedMetadata := signMetadata(t, test, bytes.Replace(test.IDPMetadata, []byte("<EntityDescriptor "),
+		[]byte(`<EntityDescriptor cacheDuration="PT1H" `), 1))
+	requests := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Check(t, is.Equal("application/samlmetadata+xml", r.Header.Get("Accept")))
+		if r.URL.EscapedPath() != "/entities/%7Bsha1%7Dd03e57953345e57a1a82074d2d477c9ca38df976" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.Write(signedMetadata)
+	}))
+	defer testServer.Close()
+
+	c := MDQClient{
+		BaseURL:      mustParseURL(testServer.URL),
+		Certificates: []*x509.Certificate{test.Certificate},
+		HTTPClient:   testServer.Client(),
+	}
+	var _ MetadataResolver = &c
+
+	md, err := c.ResolveMetadata(context.Background(), "https://idp.testshib.org/idp/shibboleth")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://idp.testshib.org/idp/shibboleth", md.EntityID))
+
+	// the metadata is cached for its cacheDuration
+	_, err = c.ResolveMetadata(context.Background(), "https://idp.testshib.org/idp/shibboleth")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(1, requests))
+
+	saml.TimeNow = func() time.Time { return test.Certificate.NotBefore.Add(61 * time.Minute) }
+	saml.Clock = dsig.NewFakeClockAt(saml.TimeNow())
+	_, err = c.ResolveMetadata(context.Background(), "https://idp.testshib.org/idp/shibboleth")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(2, requests))
+
+	_, err = c.ResolveMetadata(context.Background(), "https://idp.example.com/")
+	assert.Check(t, is.Equal(ErrEntityNotFound, err))
+}
+
+func TestMDQClientRejectsUnsignedMetadata(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(test.IDPMetadata)
+	}))
+	defer testServer.Close()
+
+	u, _ := url.Parse(testServer.URL)
+	c := MDQClient{
+		BaseURL:      *u,
+		Certificates: []*x509.Certificate{test.Certificate},
+		HTTPClient:   testServer.Client(),
+	}
+	_, err := c.ResolveMetadata(context.Background(), "https://idp.testshib.org/idp/shibboleth")
+	assert.Check(t, is.Error(err, "metadata is not signed"))
+}
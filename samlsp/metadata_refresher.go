@@ -0,0 +1,141 @@
+package samlsp
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// DefaultMetadataRefreshInterval is how often a MetadataRefresher fetches
+// metadata that does not specify a cacheDuration.
+const DefaultMetadataRefreshInterval = time.Hour
+
+// MetadataRefresher periodically fetches the metadata of an identity
+// provider and installs it in a ServiceProvider with SetIDPMetadata.
+//
+// Metadata is fetched again once its cacheDuration has elapsed, and always
+// before its validUntil time. When a refresh fails, the ServiceProvider
+// keeps using the metadata it has and the refresh is retried after
+// MinRefreshInterval.
+type MetadataRefresher struct {
+	ServiceProvider *saml.ServiceProvider
+	MetadataURL     url.URL
+
+	// HTTPClient is used to fetch the metadata. The default is
+	// http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Certificates, if not empty, are the certificates that the metadata
+	// must be signed with. See FetchSignedMetadata.
+	Certificates []*x509.Certificate
+
+	// MinRefreshInterval and MaxRefreshInterval bound the time between
+	// refreshes. They default to one minute and one day.
+	MinRefreshInterval time.Duration
+	MaxRefreshInterval time.Duration
+
+	// OnRefresh, if not nil, is called with the metadata after each
+	// successful refresh.
+	OnRefresh func(md *saml.EntityDescriptor)
+
+	// OnError, if not nil, is called with the error when a refresh fails.
+	OnError func(err error)
+}
+
+// Refresh fetches the metadata once and, if it is valid, installs it in
+// the ServiceProvider. If the ServiceProvider's StrictStructureCheck is
+// set, metadata that fails saml.CheckStructure is rejected. It returns the metadata that was installed.
+func (r *MetadataRefresher) Refresh(ctx context.Context) (*saml.EntityDescriptor, error) {
+	httpClient := r.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	data, err := fetchMetadata(ctx, httpClient, r.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	if r.ServiceProvider.StrictStructureCheck {
+		if err := saml.CheckStructure(data); err != nil {
+			return nil, err
+		}
+	}
+
+	var md *saml.EntityDescriptor
+	if len(r.Certificates) > 0 {
+		md, err = ParseSignedMetadata(data, r.Certificates)
+	} else {
+		md, err = ParseMetadata(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !md.ValidUntil.IsZero() && !saml.TimeNow().Before(md.ValidUntil) {
+		return nil, fmt.Errorf("metadata expired at %s", md.ValidUntil.Format(time.RFC3339))
+	}
+
+	r.ServiceProvider.SetIDPMetadata(md)
+	if r.OnRefresh != nil {
+		r.OnRefresh(md)
+	}
+	return md, nil
+}
+
+// Run refreshes the metadata immediately and then whenever it is due,
+// until ctx is done.
+func (r *MetadataRefresher) Run(ctx context.Context) {
+	for {
+		md, err := r.Refresh(ctx)
+		if err != nil && r.OnError != nil {
+			r.OnError(err)
+		}
+
+		timer := time.NewTimer(r.refreshInterval(md))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// refreshInterval returns how long to wait before fetching md again. md
+// is nil if the last refresh failed.
+func (r *MetadataRefresher) refreshInterval(md *saml.EntityDescriptor) time.Duration {
+	minInterval := r.MinRefreshInterval
+	if minInterval == 0 {
+		minInterval = time.Minute
+	}
+	maxInterval := r.MaxRefreshInterval
+	if maxInterval == 0 {
+		maxInterval = 24 * time.Hour
+	}
+	if md == nil {
+		return minInterval
+	}
+
+	interval := DefaultMetadataRefreshInterval
+	if md.CacheDuration > 0 {
+		interval = md.CacheDuration
+	}
+	if !md.ValidUntil.IsZero() {
+		// refresh halfway to validUntil so that there is time to retry
+		if untilInvalid := md.ValidUntil.Sub(saml.TimeNow()) / 2; untilInvalid < interval {
+			interval = untilInvalid
+		}
+	}
+
+	if interval < minInterval {
+		return minInterval
+	}
+	if interval > maxInterval {
+		return maxInterval
+	}
+	return interval
+}
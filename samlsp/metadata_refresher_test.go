@@ -0,0 +1,153 @@
+package samlsp
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml"
+)
+
+func TestMetadataRefresherInstallsMetadata(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	sp := &test.Middleware.ServiceProvider
+	sp.IDPMetadata = &saml.EntityDescriptor{EntityID: "https://old.example.com/"}
+
+	metadata := bytes.Replace(test.IDPMetadata,
+		[]byte("https://idp.testshib.org/idp/profile/SAML2/Redirect/SSO"),
+		[]byte("https://idp.testshib.org/idp/profile/SAML2/Redirect/SSO2"), 1)
+	statusCode := http.StatusOK
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+		w.Write(metadata)
+	}))
+	defer testServer.Close()
+	u, _ := url.Parse(testServer.URL + "/metadata")
+
+	var refreshed *saml.EntityDescriptor
+	r := MetadataRefresher{
+		ServiceProvider: sp,
+		MetadataURL:     *u,
+		HTTPClient:      testServer.Client(),
+		OnRefresh: func(md *saml.EntityDescriptor) {
+			refreshed = md
+		},
+	}
+	md, err := r.Refresh(context.Background())
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(md, refreshed))
+	assert.Check(t, is.Equal("https://idp.testshib.org/idp/profile/SAML2/Redirect/SSO2",
+		sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)))
+
+	// a failed refresh keeps the current metadata
+	statusCode = http.StatusInternalServerError
+	_, err = r.Refresh(context.Background())
+	assert.Check(t, err != nil)
+	assert.Check(t, is.Equal("https://idp.testshib.org/idp/profile/SAML2/Redirect/SSO2",
+		sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)))
+
+	// as does expired metadata
+	statusCode = http.StatusOK
+	metadata = bytes.Replace(metadata, []byte("<EntityDescriptor "),
+		[]byte(`<EntityDescriptor validUntil="2015-11-30T00:00:00Z" `), 1)
+	_, err = r.Refresh(context.Background())
+	assert.Check(t, is.Error(err, "metadata expired at 2015-11-30T00:00:00Z"))
+}
+
+func TestMetadataRefresherChecksStructure(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	sp := &test.Middleware.ServiceProvider
+	sp.StrictStructureCheck = true
+
+	// the Name attribute of the testshib metadata is only allowed on an
+	// EntitiesDescriptor
+	metadata := test.IDPMetadata
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(metadata)
+	}))
+	defer testServer.Close()
+	u, _ := url.Parse(testServer.URL + "/metadata")
+
+	r := MetadataRefresher{
+		ServiceProvider: sp,
+		MetadataURL:     *u,
+		HTTPClient:      testServer.Client(),
+	}
+	_, err := r.Refresh(context.Background())
+	assert.Check(t, is.Error(err, "structure check failed: /EntityDescriptor: unexpected attribute Name"))
+
+	metadata = bytes.Replace(metadata, []byte(` Name="urn:mace:shibboleth:testshib:two"`), nil, 1)
+	_, err = r.Refresh(context.Background())
+	assert.Check(t, err)
+}
+
+func TestMetadataRefresherRefreshInterval(t *testing.T) {
+	NewMiddlewareTest(t)
+	now := saml.TimeNow()
+	r := MetadataRefresher{}
+
+	assert.Check(t, is.Equal(time.Minute, r.refreshInterval(nil)))
+	assert.Check(t, is.Equal(DefaultMetadataRefreshInterval, r.refreshInterval(&saml.EntityDescriptor{})))
+	assert.Check(t, is.Equal(6*time.Hour, r.refreshInterval(&saml.EntityDescriptor{
+		CacheDuration: 6 * time.Hour,
+	})))
+	assert.Check(t, is.Equal(30*time.Minute, r.refreshInterval(&saml.EntityDescriptor{
+		CacheDuration: 6 * time.Hour,
+		ValidUntil:    now.Add(time.Hour),
+	})))
+	assert.Check(t, is.Equal(24*time.Hour, r.refreshInterval(&saml.EntityDescriptor{
+		CacheDuration: 30 * 24 * time.Hour,
+	})))
+
+	r.MinRefreshInterval = 5 * time.Minute
+	r.MaxRefreshInterval = 2 * time.Hour
+	assert.Check(t, is.Equal(5*time.Minute, r.refreshInterval(&saml.EntityDescriptor{
+		ValidUntil: now.Add(time.Minute),
+	})))
+	assert.Check(t, is.Equal(2*time.Hour, r.refreshInterval(&saml.EntityDescriptor{
+		CacheDuration: 6 * time.Hour,
+	})))
+}
+
+func TestMetadataRefresherRun(t *testing.T) {
+	test := NewMiddlewareTest(t)
+
+	requests := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(test.IDPMetadata)
+	}))
+	defer testServer.Close()
+	u, _ := url.Parse(testServer.URL + "/metadata")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var errs []error
+	r := MetadataRefresher{
+		ServiceProvider:    &test.Middleware.ServiceProvider,
+		MetadataURL:        *u,
+		HTTPClient:         testServer.Client(),
+		MinRefreshInterval: time.Millisecond,
+		MaxRefreshInterval: time.Millisecond,
+		OnError: func(err error) {
+			errs = append(errs, err)
+		},
+		OnRefresh: func(md *saml.EntityDescriptor) {
+			cancel()
+		},
+	}
+	r.Run(ctx)
+
+	assert.Check(t, is.Equal(2, requests))
+	assert.Check(t, is.Len(errs, 1))
+}
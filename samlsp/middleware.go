@@ -1,8 +1,17 @@
 package samlsp
 
 import (
+	"encoding/base64"
 	"encoding/xml"
+	"errors"
+	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
 
 	"github.com/crewjam/saml"
 )
@@ -45,11 +54,110 @@ type Middleware struct {
 	ResponseBinding string // either saml.HTTPPostBinding or saml.HTTPArtifactBinding
 	RequestTracker  RequestTracker
 	Session         SessionProvider
+
+	// IDPMetadataResolver, if not nil, resolves the metadata of the
+	// identity providers that users may authenticate with, for instance a
+	// MetadataMap. Responses are validated against the metadata of the
+	// identity provider that issued them, which must be the one the
+	// authentication request was sent to.
+	//
+	// The identity provider is chosen by ChooseIDP, then by the IDPParam
+	// query parameter, then by Discovery. If none of them chooses one,
+	// m.ServiceProvider.IDPMetadata is used.
+	IDPMetadataResolver MetadataResolver
+
+	// ChooseIDP, if not nil, returns the entity ID of the identity provider
+	// to authenticate the user of r with, or an empty string if it has no
+	// preference. It requires IDPMetadataResolver.
+	ChooseIDP func(r *http.Request) string
+
+	// IDPParam, if not empty, is the name of the query parameter in which
+	// a request may give the entity ID of the identity provider to
+	// authenticate with. It requires IDPMetadataResolver.
+	IDPParam string
+
+	// Discovery, if not nil, sends users to a discovery service to choose
+	// an identity provider before the SAML auth flow starts. It requires
+	// IDPMetadataResolver.
+	Discovery *DiscoveryService
+
+	// SilentCheckURL, if set, is the URL of the endpoint that checks
+	// whether the user is logged in at the identity provider without
+	// interacting with them, i.e. https://example.com/saml/check. See
+	// ServeSilentCheck.
+	SilentCheckURL url.URL
+
+	// IdentityHeaders, if true, makes RequireAccount pass the identity of
+	// the user to the handler in request headers, for applications behind a
+	// reverse proxy that cannot read the session: the subject in
+	// SubjectHeader and each attribute in a header named by
+	// AttributeHeaderName. Any such headers sent by the client are removed.
+	IdentityHeaders bool
+
+	// AttributeMapper, if not nil, maps the attributes of the assertions
+	// that sessions are created from.
+	AttributeMapper *AttributeMapper
+
+	// SessionRenewalWindow, if not zero, makes RequireAccount renew
+	// sessions that expire within it, by sending the user to the identity
+	// provider with an authentication request with IsPassive set, as
+	// ServeSilentCheck does. Only GET and HEAD requests are redirected, and
+	// each session is renewed at most once, so a user who is no longer
+	// logged in at the identity provider keeps the session until it
+	// expires. The sessions must implement SessionWithExpiry.
+	SessionRenewalWindow time.Duration
+
+	// AllowedRedirectHosts lists the hosts, other than the one of the ACS
+	// URL, of the absolute URLs that users may be redirected to after
+	// logging in, which come from tracked requests or the RelayState of
+	// unsolicited responses. An entry of the form "*.example.com" matches
+	// all the subdomains of example.com. Users are redirected to the
+	// DefaultRedirectURI of the ServiceProvider instead of any other URL.
+	AllowedRedirectHosts []string
+
+	// RedirectURIValidator, if not nil, reports whether users may be
+	// redirected to uri after logging in, instead of AllowedRedirectHosts.
+	RedirectURIValidator func(r *http.Request, uri string) bool
+
+	// LoginURL, if set, is the URL of the endpoint that starts the SAML
+	// auth flow for the local URI in the "target" query parameter, i.e.
+	// https://example.com/saml/login. See ServeLogin.
+	LoginURL url.URL
+
+	// APIRequestMatcher, if not nil, reports whether a request comes from
+	// an API client or a script, such as a single-page application, that
+	// cannot follow a redirect to the identity provider. RequireAccount
+	// answers such requests without a session with a 401 response whose
+	// JSON body is an APIChallenge, so that the client can send the user to
+	// LoginURL itself.
+	APIRequestMatcher func(r *http.Request) bool
+
+	// Skipper, if not nil, reports whether RequireAccount should serve a
+	// request without a session, i.e. a health check or a webhook. The
+	// session is still passed to the handler if there is one. See
+	// PublicRoute.
+	Skipper func(r *http.Request) bool
+
+	// LogoutURL, if set, is the URL of the endpoint that logs the user out,
+	// i.e. https://example.com/saml/logout. See ServeLogout.
+	LogoutURL url.URL
+
+	// PostForm, if not nil, writes the pages that send SAML messages to the
+	// identity provider with the HTTP-POST binding, instead of the plain
+	// forms whose scripts are allowed by hash.
+	PostForm *saml.PostForm
+
+	// ModifyAuthnRequest, if not nil, is called with each authentication
+	// request that the middleware makes, before it is signed and encoded,
+	// so that the request can be changed for r, for instance to set
+	// ForceAuthn, RequestedAuthnContext, a Subject or Extensions. If it
+	// returns an error, the auth flow fails with 500 Internal Server Error.
+	ModifyAuthnRequest func(r *http.Request, req *saml.AuthnRequest) error
 }
 
 // ServeHTTP implements http.Handler and serves the SAML-specific HTTP endpoints
-// on the URIs specified by m.ServiceProvider.MetadataURL and
-// m.ServiceProvider.AcsURL.
+// on the URIs specified by m.ServiceProvider.MetadataURL,
+// m.ServiceProvider.AcsURL and m.ServiceProvider.SloURL.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == m.ServiceProvider.MetadataURL.Path {
 		m.ServeMetadata(w, r)
@@ -61,6 +169,31 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == m.ServiceProvider.SloURL.Path {
+		m.ServeSLO(w, r)
+		return
+	}
+
+	if m.Discovery != nil && r.URL.Path == m.Discovery.ReturnURL.Path {
+		m.ServeDiscoveryResponse(w, r)
+		return
+	}
+
+	if m.SilentCheckURL.Path != "" && r.URL.Path == m.SilentCheckURL.Path {
+		m.ServeSilentCheck(w, r)
+		return
+	}
+
+	if m.LoginURL.Path != "" && r.URL.Path == m.LoginURL.Path {
+		m.ServeLogin(w, r)
+		return
+	}
+
+	if m.LogoutURL.Path != "" && r.URL.Path == m.LogoutURL.Path {
+		m.ServeLogout(w, r)
+		return
+	}
+
 	http.NotFoundHandler().ServeHTTP(w, r)
 }
 
@@ -77,17 +210,68 @@ func (m *Middleware) ServeACS(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
 	possibleRequestIDs := []string{}
-	if m.ServiceProvider.AllowIDPInitiated {
-		possibleRequestIDs = append(possibleRequestIDs, "")
+
+	var issuer string
+	if m.IDPMetadataResolver != nil {
+		issuer = responseIssuer(r)
 	}
 
+	var requestOptions AuthnRequestOptions
+	var trackedRequest *TrackedRequest
 	trackedRequests := m.RequestTracker.GetTrackedRequests(r)
-	for _, tr := range trackedRequests {
+	for i, tr := range trackedRequests {
+		// a LogoutRequest is not answered with an assertion
+		if tr.Logout {
+			continue
+		}
+		// a request sent to one identity provider cannot be answered by another
+		if issuer != "" && tr.IDPEntityID != "" && tr.IDPEntityID != issuer {
+			continue
+		}
 		possibleRequestIDs = append(possibleRequestIDs, tr.SAMLRequestID)
+
+		// the response must satisfy the authentication context that the
+		// request asked for
+		if tr.Index == r.Form.Get("RelayState") {
+			trackedRequest = &trackedRequests[i]
+			requestOptions.RequestedAuthnContext = tr.requestedAuthnContext()
+		}
 	}
 
-	assertion, err := m.ServiceProvider.ParseResponse(r, possibleRequestIDs)
+	sp := &m.ServiceProvider
+	if issuer != "" {
+		idpMetadata, err := m.IDPMetadataResolver.ResolveMetadata(r.Context(), issuer)
+		if err != nil {
+			m.OnError(w, r, err)
+			return
+		}
+		sp = m.serviceProviderFor(idpMetadata)
+	}
+	sp = requestOptions.apply(sp)
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); sp.AllowECP && mediaType == saml.PAOSContentType {
+		assertion, relayState, err := sp.ParseECPResponse(r, possibleRequestIDs)
+		if err != nil {
+			m.OnError(w, r, err)
+			return
+		}
+
+		// ECP clients return the relay state in a SOAP header rather than
+		// a form value, which is where CreateSessionFromAssertion looks.
+		r.Form.Set("RelayState", relayState)
+		m.CreateSessionFromAssertion(w, r, assertion, m.ServiceProvider.DefaultRedirectURI)
+		return
+	}
+
+	assertion, err := sp.ParseResponse(r, possibleRequestIDs)
 	if err != nil {
+		// the user is not logged in at the identity provider, which is
+		// expected of a silent check
+		if trackedRequest != nil && trackedRequest.Passive && isNoPassiveError(err) {
+			m.RequestTracker.StopTrackingRequest(w, r, trackedRequest.Index)
+			http.Redirect(w, r, m.redirectURIAfterLogin(r, trackedRequest.URI), http.StatusFound)
+			return
+		}
 		m.OnError(w, r, err)
 		return
 	}
@@ -96,6 +280,236 @@ func (m *Middleware) ServeACS(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// isNoPassiveError reports whether err is the error returned for a
+// response with the StatusNoPassive status.
+func isNoPassiveError(err error) bool {
+	invalidResponseErr, ok := err.(*saml.InvalidResponseError)
+	if !ok {
+		return false
+	}
+	badStatus, ok := invalidResponseErr.PrivateErr.(saml.ErrBadStatus)
+	return ok && badStatus.SubStatus == saml.StatusNoPassive
+}
+
+// ServeSLO handles requests for the SAML SLO endpoint. When the IDP sends a
+// LogoutRequest, the request is validated, the local session is deleted and
+// a LogoutResponse is returned to the IDP using the same binding that the
+// request arrived on. The response is signed if
+// m.ServiceProvider.SignatureMethod is set. Asynchronous LogoutRequests are
+// not answered; the user agent is redirected to DefaultRedirectURI instead.
+//
+// If m.Session implements SessionRevoker, the sessions of the NameID of the
+// LogoutRequest that were created from assertions of its issuer are revoked
+// as well, limited to its SessionIndexes if it has any.
+//
+// When the IDP sends a LogoutResponse to a LogoutRequest of ServeLogout, the
+// response is validated and the user is redirected to the URI they logged
+// out from.
+func (m *Middleware) ServeSLO(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("SAMLResponse") != "" {
+		m.serveLogoutResponse(w, r)
+		return
+	}
+	if r.Form.Get("SAMLRequest") == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	logoutRequest, err := m.ServiceProvider.ValidateLogoutRequestRequest(r)
+	if err != nil {
+		m.OnError(w, r, err)
+		return
+	}
+
+	if err := m.Session.DeleteSession(w, r); err != nil {
+		m.OnError(w, r, err)
+		return
+	}
+	if revoker, ok := m.Session.(SessionRevoker); ok && logoutRequest.Issuer != nil && logoutRequest.NameID != nil {
+		var sessionIndexes []string
+		for _, sessionIndex := range logoutRequest.SessionIndexes {
+			sessionIndexes = append(sessionIndexes, sessionIndex.Value)
+		}
+		if err := revoker.RevokeSessions(logoutRequest.Issuer.Value, logoutRequest.NameID.Value, sessionIndexes...); err != nil {
+			m.OnError(w, r, err)
+			return
+		}
+	}
+
+	// the IDP does not expect a response to an asynchronous request
+	if logoutRequest.IsAsynchronous() {
+		redirectURI := m.ServiceProvider.DefaultRedirectURI
+		if redirectURI == "" {
+			redirectURI = "/"
+		}
+		http.Redirect(w, r, redirectURI, http.StatusFound)
+		return
+	}
+
+	relayState := r.Form.Get("RelayState")
+	if r.URL.Query().Get("SAMLRequest") != "" {
+		redirectURL, err := m.ServiceProvider.MakeRedirectLogoutResponse(logoutRequest.ID, relayState)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Location", redirectURL.String())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+
+	if m.PostForm != nil {
+		logoutResponse, err := m.ServiceProvider.MakeLogoutResponse(
+			m.ServiceProvider.GetSLOBindingLocation(saml.HTTPPostBinding), logoutRequest.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.writePostForm(w, logoutResponse.PostFormData(relayState))
+		return
+	}
+	logoutResponse, err := m.ServiceProvider.MakePostLogoutResponse(logoutRequest.ID, relayState)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Security-Policy", ""+
+		"default-src; "+
+		"script-src 'sha256-ae3F9sw3MnGNUqmT+7gdyojm/I6ukOUOr9mHRkJJvCU='; "+
+		"reflected-xss block; referrer no-referrer;")
+	w.Header().Add("Content-type", "text/html")
+	w.Write([]byte(`<!DOCTYPE html><html><body>`))
+	w.Write(logoutResponse)
+	w.Write([]byte(`</body></html>`))
+}
+
+// serveLogoutResponse handles the LogoutResponse that the IDP sends to the
+// SLO endpoint in answer to the LogoutRequest of ServeLogout. The response
+// must answer the request tracked by its RelayState.
+func (m *Middleware) serveLogoutResponse(w http.ResponseWriter, r *http.Request) {
+	relayState := r.Form.Get("RelayState")
+	trackedRequest, err := m.RequestTracker.GetTrackedRequest(r, relayState)
+	if err != nil {
+		m.OnError(w, r, err)
+		return
+	}
+	if !trackedRequest.Logout {
+		m.OnError(w, r, errors.New("the RelayState does not name a LogoutRequest"))
+		return
+	}
+	if _, err := m.ServiceProvider.ParseLogoutResponse(r, []string{trackedRequest.SAMLRequestID}); err != nil {
+		m.OnError(w, r, err)
+		return
+	}
+	if err := m.RequestTracker.StopTrackingRequest(w, r, relayState); err != nil {
+		m.OnError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, m.redirectURIAfterLogin(r, trackedRequest.URI), http.StatusFound)
+}
+
+// ServeLogout handles requests for the logout endpoint, m.LogoutURL, which
+// may be GET or POST requests. It deletes the session of the user and, if
+// the IDP has a SingleLogoutService with the HTTP-Redirect or HTTP-POST
+// binding, sends the user there with a LogoutRequest for the subject and
+// SessionIndex of the session. The request is tracked like an
+// authentication request, and ServeSLO validates the LogoutResponse against
+// it. The user then returns to the local URI in the "target" parameter, or
+// the DefaultRedirectURI of the ServiceProvider.
+func (m *Middleware) ServeLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	target := r.FormValue(returnTargetParam)
+	if target == "" {
+		target = m.redirectURIAfterLogin(r, "")
+	}
+	if !isLocalURI(target) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	session, _ := m.Session.GetSession(r)
+	if err := m.Session.DeleteSession(w, r); err != nil {
+		m.OnError(w, r, err)
+		return
+	}
+
+	var nameID string
+	if s, ok := session.(SessionWithSubject); ok {
+		nameID = s.GetSubject()
+	}
+	binding := saml.HTTPRedirectBinding
+	bindingLocation := m.ServiceProvider.GetSLOBindingLocation(binding)
+	if bindingLocation == "" {
+		binding = saml.HTTPPostBinding
+		bindingLocation = m.ServiceProvider.GetSLOBindingLocation(binding)
+	}
+	if nameID == "" || bindingLocation == "" {
+		// there is no session at the IDP that we can end
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+
+	var sessionIndexes []string
+	if s, ok := session.(SessionWithAuthnStatement); ok && s.GetSessionIndex() != "" {
+		sessionIndexes = append(sessionIndexes, s.GetSessionIndex())
+	}
+	logoutRequest, err := m.ServiceProvider.MakeSessionLogoutRequest(bindingLocation, nameID, sessionIndexes...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// track the request as if it were for the target URI
+	r2 := r.WithContext(contextWithLogoutRequest(r.Context()))
+	r2.URL = targetURL
+	relayState, err := m.RequestTracker.TrackRequest(w, r2, logoutRequest.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if binding == saml.HTTPRedirectBinding {
+		redirectURL, err := m.ServiceProvider.LogoutRequestRedirectURL(logoutRequest, relayState)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Location", redirectURL.String())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	if m.PostForm != nil {
+		m.writePostForm(w, logoutRequest.PostFormData(relayState))
+		return
+	}
+	w.Header().Add("Content-Security-Policy", ""+
+		"default-src; "+
+		"script-src 'sha256-AjPdJSbZmeWHnEc5ykvJFay8FTWeTeRbs9dutfZ0HqE='; "+
+		"reflected-xss block; referrer no-referrer;")
+	w.Header().Add("Content-type", "text/html")
+	w.Write([]byte(`<!DOCTYPE html><html><body>`))
+	w.Write(logoutRequest.Post(relayState))
+	w.Write([]byte(`</body></html>`))
+}
+
+// writePostForm writes the page of m.PostForm that sends data to the
+// identity provider.
+func (m *Middleware) writePostForm(w http.ResponseWriter, data saml.PostFormData) {
+	if err := m.PostForm.Write(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // RequireAccount is HTTP middleware that requires that each request be
 // associated with a valid session. If the request is not associated with a valid
 // session, then rather than serve the request, the middleware redirects the user
@@ -103,12 +517,23 @@ func (m *Middleware) ServeACS(w http.ResponseWriter, r *http.Request) {
 func (m *Middleware) RequireAccount(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		session, err := m.Session.GetSession(r)
+		if m.Skipper != nil && m.Skipper(r) {
+			handler.ServeHTTP(w, m.requestWithSession(r, session))
+			return
+		}
+		if session != nil && m.shouldRenewSession(r, session) {
+			m.renewSession(w, r, session)
+			return
+		}
 		if session != nil {
-			r = r.WithContext(ContextWithSession(r.Context(), session))
-			handler.ServeHTTP(w, r)
+			handler.ServeHTTP(w, m.requestWithSession(r, session))
 			return
 		}
 		if err == ErrNoSession {
+			if m.APIRequestMatcher != nil && m.APIRequestMatcher(r) {
+				m.writeAPIChallenge(w, r)
+				return
+			}
 			m.HandleStartAuthFlow(w, r)
 			return
 		}
@@ -118,7 +543,28 @@ func (m *Middleware) RequireAccount(handler http.Handler) http.Handler {
 	})
 }
 
+// requestWithSession returns r with session, which may be nil, in its
+// context and, if m.IdentityHeaders is set, in its identity headers.
+func (m *Middleware) requestWithSession(r *http.Request, session Session) *http.Request {
+	ctx := r.Context()
+	if session != nil {
+		ctx = ContextWithSession(ctx, session)
+	}
+	r = r.WithContext(ctx)
+	if m.IdentityHeaders {
+		r.Header = r.Header.Clone()
+		if session != nil {
+			setIdentityHeaders(r, session)
+		} else {
+			stripIdentityHeaders(r.Header)
+		}
+	}
+	return r
+}
+
 // HandleStartAuthFlow is called to start the SAML authentication process.
+// The authentication request is made with the AuthnRequestOptions of the
+// request context, if there are any.
 func (m *Middleware) HandleStartAuthFlow(w http.ResponseWriter, r *http.Request) {
 	// If we try to redirect when the original request is the ACS URL we'll
 	// end up in a loop. This is a programming error, so we panic here. In
@@ -128,24 +574,244 @@ func (m *Middleware) HandleStartAuthFlow(w http.ResponseWriter, r *http.Request)
 		panic("don't wrap Middleware with RequireAccount")
 	}
 
+	if m.ServiceProvider.AllowECP && saml.IsECPRequest(r) {
+		m.handleStartECPAuthFlow(w, r)
+		return
+	}
+
+	if idpEntityID := m.chooseIDP(r); idpEntityID != "" {
+		m.startAuthFlowWithIDP(w, r, idpEntityID)
+		return
+	}
+
+	if m.Discovery != nil {
+		entityID := m.ServiceProvider.EntityID
+		if entityID == "" {
+			entityID = m.ServiceProvider.MetadataURL.String()
+		}
+		redirectURL := m.Discovery.RedirectURL(entityID, r.URL.RequestURI())
+		http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+		return
+	}
+
+	m.startAuthFlow(w, r, &m.ServiceProvider)
+}
+
+// chooseIDP returns the entity ID of the identity provider chosen for r by
+// m.ChooseIDP or m.IDPParam, or an empty string if neither chose one.
+func (m *Middleware) chooseIDP(r *http.Request) string {
+	if m.IDPMetadataResolver == nil {
+		return ""
+	}
+	if m.ChooseIDP != nil {
+		if entityID := m.ChooseIDP(r); entityID != "" {
+			return entityID
+		}
+	}
+	if m.IDPParam != "" {
+		return r.URL.Query().Get(m.IDPParam)
+	}
+	return ""
+}
+
+// startAuthFlowWithIDP sends the user to the identity provider with the
+// given entity ID, which must be known to m.IDPMetadataResolver. The
+// identity provider is recorded in the tracked request so that only it can
+// answer.
+func (m *Middleware) startAuthFlowWithIDP(w http.ResponseWriter, r *http.Request, idpEntityID string) {
+	idpMetadata, err := m.IDPMetadataResolver.ResolveMetadata(r.Context(), idpEntityID)
+	if err != nil {
+		m.OnError(w, r, err)
+		return
+	}
+	r = r.WithContext(contextWithIDPEntityID(r.Context(), idpMetadata.EntityID))
+	m.startAuthFlow(w, r, m.serviceProviderFor(idpMetadata))
+}
+
+// ServeDiscoveryResponse handles requests for the discovery response
+// endpoint, m.Discovery.ReturnURL. The identity provider chosen by the user
+// must be known to m.IDPMetadataResolver; the SAML auth flow then continues
+// with that identity provider.
+func (m *Middleware) ServeDiscoveryResponse(w http.ResponseWriter, r *http.Request) {
+	entityID, target, err := m.Discovery.ParseResponse(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if entityID == "" {
+		m.OnError(w, r, errors.New("no identity provider was chosen"))
+		return
+	}
+
+	// track the request as if it were for the original URI
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = targetURL
+	m.startAuthFlowWithIDP(w, r2, entityID)
+}
+
+// ServeLogin handles requests for the login endpoint, m.LoginURL. It starts
+// the SAML auth flow, after which the user is returned to the local URI in
+// the "target" query parameter. Users who already have a session are
+// returned immediately.
+func (m *Middleware) ServeLogin(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get(returnTargetParam)
+	if target == "" {
+		target = m.redirectURIAfterLogin(r, "")
+	}
+	if !isLocalURI(target) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if session, _ := m.Session.GetSession(r); session != nil {
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+
+	// track the request as if it were for the target URI
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = targetURL
+
+	if idpEntityID := m.chooseIDP(r); idpEntityID != "" {
+		m.startAuthFlowWithIDP(w, r2, idpEntityID)
+		return
+	}
+	m.HandleStartAuthFlow(w, r2)
+}
+
+// ServeSilentCheck handles requests for the silent check endpoint,
+// m.SilentCheckURL. It checks whether the user is logged in at the identity
+// provider by sending it an authentication request with IsPassive set, so
+// that the identity provider does not interact with the user. If the user
+// is logged in, a session is created. Either way, the user is then
+// returned to the local URI in the "target" query parameter.
+func (m *Middleware) ServeSilentCheck(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get(returnTargetParam)
+	if target == "" {
+		target = m.ServiceProvider.DefaultRedirectURI
+		if target == "" {
+			target = "/"
+		}
+	}
+	if !isLocalURI(target) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// the user is already logged in
+	if session, _ := m.Session.GetSession(r); session != nil {
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+
+	// track the request as if it were for the target URI
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	m.startPassiveAuthFlow(w, r, targetURL)
+}
+
+// startPassiveAuthFlow sends the user to the identity provider with an
+// authentication request with IsPassive set, which is tracked as if it
+// were for targetURL.
+func (m *Middleware) startPassiveAuthFlow(w http.ResponseWriter, r *http.Request, targetURL *url.URL) {
+	isPassive := true
+	requestOptions := AuthnRequestOptionsFromContext(r.Context())
+	requestOptions.IsPassive = &isPassive
+	r2 := r.WithContext(ContextWithAuthnRequestOptions(r.Context(), requestOptions))
+	r2.URL = targetURL
+
+	if idpEntityID := m.chooseIDP(r); idpEntityID != "" {
+		m.startAuthFlowWithIDP(w, r2, idpEntityID)
+		return
+	}
+	m.startAuthFlow(w, r2, &m.ServiceProvider)
+}
+
+// renewalCookieName is the name of the cookie that records that the
+// renewal of a session has been attempted.
+const renewalCookieName = "saml_renewal"
+
+// shouldRenewSession reports whether RequireAccount should renew session
+// rather than serve r.
+func (m *Middleware) shouldRenewSession(r *http.Request, session Session) bool {
+	if m.SessionRenewalWindow == 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	sessionWithExpiry, ok := session.(SessionWithExpiry)
+	if !ok {
+		return false
+	}
+	expiresAt := sessionWithExpiry.GetExpiresAt()
+	if expiresAt.IsZero() || expiresAt.Sub(saml.TimeNow()) > m.SessionRenewalWindow {
+		return false
+	}
+	_, err := r.Cookie(renewalCookieName)
+	return err == http.ErrNoCookie
+}
+
+// renewSession starts a passive authentication flow that returns the user
+// to the URI of r, and records that the renewal of session has been
+// attempted until it expires. CreateSessionFromAssertion removes the
+// record when a new session is created.
+func (m *Middleware) renewSession(w http.ResponseWriter, r *http.Request, session Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     renewalCookieName,
+		Value:    "1",
+		MaxAge:   int(sessionMaxAge(session, m.SessionRenewalWindow).Seconds()),
+		HttpOnly: true,
+		Secure:   m.ServiceProvider.AcsURL.Scheme == "https",
+		Path:     "/",
+	})
+	m.startPassiveAuthFlow(w, r, &url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery})
+}
+
+// serviceProviderFor returns a copy of m.ServiceProvider that uses
+// idpMetadata.
+func (m *Middleware) serviceProviderFor(idpMetadata *saml.EntityDescriptor) *saml.ServiceProvider {
+	sp := m.ServiceProvider
+	sp.SetIDPMetadata(idpMetadata)
+	return &sp
+}
+
+// startAuthFlow sends the user to the identity provider of sp with an
+// authentication request.
+func (m *Middleware) startAuthFlow(w http.ResponseWriter, r *http.Request, sp *saml.ServiceProvider) {
+	sp = m.authnRequestServiceProvider(r, sp)
+
 	var binding, bindingLocation string
 	if m.Binding != "" {
 		binding = m.Binding
-		bindingLocation = m.ServiceProvider.GetSSOBindingLocation(binding)
+		bindingLocation = sp.GetSSOBindingLocation(binding)
 	} else {
 		binding = saml.HTTPRedirectBinding
-		bindingLocation = m.ServiceProvider.GetSSOBindingLocation(binding)
+		bindingLocation = sp.GetSSOBindingLocation(binding)
 		if bindingLocation == "" {
 			binding = saml.HTTPPostBinding
-			bindingLocation = m.ServiceProvider.GetSSOBindingLocation(binding)
+			bindingLocation = sp.GetSSOBindingLocation(binding)
 		}
 	}
 
-	authReq, err := m.ServiceProvider.MakeAuthenticationRequest(bindingLocation, binding, m.ResponseBinding)
+	authReq, err := sp.MakeAuthenticationRequest(bindingLocation, binding, m.ResponseBinding)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	r = m.withSentAuthnRequestOptions(r, authReq)
 
 	// relayState is limited to 80 bytes but also must be integrity protected.
 	// this means that we cannot use a JWT because it is way to long. Instead
@@ -158,7 +824,7 @@ func (m *Middleware) HandleStartAuthFlow(w http.ResponseWriter, r *http.Request)
 	}
 
 	if binding == saml.HTTPRedirectBinding {
-		redirectURL, err := authReq.Redirect(relayState, &m.ServiceProvider)
+		redirectURL, err := authReq.Redirect(relayState, sp)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -168,6 +834,10 @@ func (m *Middleware) HandleStartAuthFlow(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	if binding == saml.HTTPPostBinding {
+		if m.PostForm != nil {
+			m.writePostForm(w, authReq.PostFormData(relayState))
+			return
+		}
 		w.Header().Add("Content-Security-Policy", ""+
 			"default-src; "+
 			"script-src 'sha256-AjPdJSbZmeWHnEc5ykvJFay8FTWeTeRbs9dutfZ0HqE='; "+
@@ -181,25 +851,109 @@ func (m *Middleware) HandleStartAuthFlow(w http.ResponseWriter, r *http.Request)
 	panic("not reached")
 }
 
+// authnRequestServiceProvider returns the ServiceProvider that makes the
+// authentication request for r: sp with the AuthnRequestOptions of the
+// context of r applied, and with m.ModifyAuthnRequest, if set, called for r.
+func (m *Middleware) authnRequestServiceProvider(r *http.Request, sp *saml.ServiceProvider) *saml.ServiceProvider {
+	sp = AuthnRequestOptionsFromContext(r.Context()).apply(sp)
+	if m.ModifyAuthnRequest == nil {
+		return sp
+	}
+	rv := *sp
+	rv.ModifyAuthnRequest = func(req *saml.AuthnRequest) error {
+		if sp.ModifyAuthnRequest != nil {
+			if err := sp.ModifyAuthnRequest(req); err != nil {
+				return err
+			}
+		}
+		return m.ModifyAuthnRequest(r, req)
+	}
+	return &rv
+}
+
+// withSentAuthnRequestOptions returns r with the options of authReq, as
+// m.ModifyAuthnRequest may have changed them, associated with its context,
+// so that the tracked request checks the response against what was
+// actually asked for.
+func (m *Middleware) withSentAuthnRequestOptions(r *http.Request, authReq *saml.AuthnRequest) *http.Request {
+	if m.ModifyAuthnRequest == nil {
+		return r
+	}
+	return r.WithContext(ContextWithAuthnRequestOptions(r.Context(), AuthnRequestOptions{
+		RequestedAuthnContext: authReq.RequestedAuthnContext,
+		ForceAuthn:            authReq.ForceAuthn,
+		IsPassive:             authReq.IsPassive,
+		Scoping:               authReq.Scoping,
+	}))
+}
+
+// handleStartECPAuthFlow starts the SAML authentication process for an ECP
+// client by responding with an AuthnRequest using the PAOS binding. The
+// client forwards the request to the IDP and delivers the response to the
+// ACS endpoint.
+func (m *Middleware) handleStartECPAuthFlow(w http.ResponseWriter, r *http.Request) {
+	sp := m.authnRequestServiceProvider(r, &m.ServiceProvider)
+	authReq, err := sp.MakeAuthenticationRequest(
+		sp.GetSSOBindingLocation(saml.SOAPBinding), saml.SOAPBinding, saml.PAOSBinding)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r = m.withSentAuthnRequestOptions(r, authReq)
+
+	relayState, err := m.RequestTracker.TrackRequest(w, r, authReq.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(authReq.PAOSRequest(relayState))
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", saml.PAOSContentType)
+	if _, err := w.Write(buf); err != nil {
+		log.Printf("ERROR: cannot write PAOS request: %s", err)
+	}
+}
+
 // CreateSessionFromAssertion is invoked by ServeHTTP when we have a new, valid SAML assertion.
 func (m *Middleware) CreateSessionFromAssertion(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion, redirectURI string) {
 	if trackedRequestIndex := r.Form.Get("RelayState"); trackedRequestIndex != "" {
 		trackedRequest, err := m.RequestTracker.GetTrackedRequest(r, trackedRequestIndex)
-		if err != nil {
+		switch {
+		case err == nil:
+			m.RequestTracker.StopTrackingRequest(w, r, trackedRequestIndex)
+			redirectURI = trackedRequest.URI
+		case m.ServiceProvider.AllowIDPInitiated:
+			// the RelayState of an unsolicited response is chosen by the
+			// IDP, and is only followed if it is allowed
+			redirectURI = m.ServiceProvider.IDPInitiatedRedirectURI(trackedRequestIndex)
+		default:
 			m.OnError(w, r, err)
 			return
 		}
-		m.RequestTracker.StopTrackingRequest(w, r, trackedRequestIndex)
-
-		redirectURI = trackedRequest.URI
 	}
 
+	if m.AttributeMapper != nil {
+		assertion = m.AttributeMapper.MapAssertion(assertion)
+	}
 	if err := m.Session.CreateSession(w, r, assertion); err != nil {
 		m.OnError(w, r, err)
 		return
 	}
+	if _, err := r.Cookie(renewalCookieName); err == nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:    renewalCookieName,
+			Expires: time.Unix(1, 0),
+			Path:    "/",
+		})
+	}
 
-	http.Redirect(w, r, redirectURI, http.StatusFound)
+	http.Redirect(w, r, m.redirectURIAfterLogin(r, redirectURI), http.StatusFound)
 }
 
 // RequireAttribute returns a middleware function that requires that the
@@ -232,3 +986,21 @@ func RequireAttribute(name, value string) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// responseIssuer returns the issuer of the SAML response posted in r, or
+// an empty string if there is none. The response is not validated.
+func responseIssuer(r *http.Request) string {
+	data, err := base64.StdEncoding.DecodeString(r.PostForm.Get("SAMLResponse"))
+	if err != nil {
+		return ""
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return ""
+	}
+	issuerEl := doc.FindElement("./Response/Issuer")
+	if issuerEl == nil {
+		return ""
+	}
+	return strings.TrimSpace(issuerEl.Text())
+}
@@ -2,12 +2,15 @@ package samlsp
 
 import (
 	"bytes"
+	"compress/flate"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"html/template"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -17,6 +20,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/beevik/etree"
 	"github.com/golang-jwt/jwt/v4"
 	dsig "github.com/russellhaering/goxmldsig"
 	"gotest.tools/assert"
@@ -110,11 +114,17 @@ func NewMiddlewareTest(t *testing.T) *MiddlewareTest {
 }
 
 func (test *MiddlewareTest) makeTrackedRequest(id string) string {
+	return test.makeTrackedRequestForIDP(id, "")
+}
+
+func (test *MiddlewareTest) makeTrackedRequestForIDP(id string, idpEntityID string) string {
 	codec := test.Middleware.RequestTracker.(CookieRequestTracker).Codec
 	token, err := codec.Encode(TrackedRequest{
 		Index:         "KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6",
 		SAMLRequestID: id,
 		URI:           "/frob",
+		IDPEntityID:   idpEntityID,
+		IssueInstant:  saml.TimeNow(),
 	})
 	if err != nil {
 		panic(err)
@@ -224,6 +234,63 @@ func TestMiddlewareRequireAccountNoCredsPostBinding(t *testing.T) {
 	assert.Check(t, is.Equal("text/html", resp.Header().Get("Content-type")))
 }
 
+func TestMiddlewareRequireAccountNoCredsPostBindingWithPostForm(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.ServiceProvider.IDPMetadata.IDPSSODescriptors[0].SingleSignOnServices = test.Middleware.ServiceProvider.IDPMetadata.IDPSSODescriptors[0].SingleSignOnServices[1:2]
+	test.Middleware.PostForm = &saml.PostForm{
+		Template: template.Must(template.New("branded").Parse(`<h1>Example</h1>` +
+			`<form method="post" action="{{.URL}}"><input type="hidden" name="{{.Param}}" value="{{.Value}}" />` +
+			`<input type="hidden" name="RelayState" value="{{.RelayState}}" /></form>` +
+			`<script nonce="{{.Nonce}}">document.forms[0].submit();</script>`)),
+		ContentSecurityPolicy: "default-src 'self'; script-src 'nonce-{nonce}'",
+	}
+
+	handler := test.Middleware.RequireAccount(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("not reached")
+		}))
+
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Check(t, is.Equal(http.StatusOK, resp.Code))
+	assert.Check(t, is.Equal("saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+test.makeTrackedRequest("id-00020406080a0c0e10121416181a1c1e20222426")+"; Path=/saml2/acs; Max-Age=90; HttpOnly; Secure",
+		resp.Header().Get("Set-Cookie")))
+	assert.Check(t, is.Equal("default-src 'self'; script-src 'nonce-fH6AgoSGiIqMjpCSlJaYmg=='",
+		resp.Header().Get("Content-Security-Policy")))
+	assert.Check(t, is.Contains(resp.Body.String(), `<h1>Example</h1><form method="post" action="https://idp.testshib.org/idp/profile/SAML2/POST/SSO">`))
+	assert.Check(t, is.Contains(resp.Body.String(), `name="RelayState" value="KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6"`))
+}
+
+func TestMiddlewareRequireAccountNoCredsECP(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.ServiceProvider.AllowECP = true
+
+	handler := test.Middleware.RequireAccount(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("not reached")
+		}))
+
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	req.Header.Set("Accept", "text/html; application/vnd.paos+xml")
+	req.Header.Set("PAOS", `ver="urn:liberty:paos:2003-08";"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"`)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Check(t, is.Equal(http.StatusOK, resp.Code))
+	assert.Check(t, is.Equal(saml.PAOSContentType, resp.Header().Get("Content-type")))
+	assert.Check(t, is.Equal("saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+test.makeTrackedRequest("id-00020406080a0c0e10121416181a1c1e20222426")+"; Path=/saml2/acs; Max-Age=90; HttpOnly; Secure",
+		resp.Header().Get("Set-Cookie")))
+	golden.Assert(t, resp.Body.String(), "expected_ecp_authn_request.xml")
+
+	// browsers are redirected as usual unless ECP is enabled
+	test.Middleware.ServiceProvider.AllowECP = false
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+}
+
 func TestMiddlewareRequireAccountCreds(t *testing.T) {
 	test := NewMiddlewareTest(t)
 	handler := test.Middleware.RequireAccount(
@@ -415,6 +482,59 @@ func TestMiddlewareCanParseResponse(t *testing.T) {
 		resp.Header()["Set-Cookie"]))
 }
 
+func TestMiddlewareFollowsAllowedRelayStatesOfUnsolicitedResponses(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.ServiceProvider.AllowIDPInitiated = true
+	test.Middleware.ServiceProvider.DefaultRedirectURI = "/home"
+	test.Middleware.ServiceProvider.IDPInitiatedRelayStates = []string{"/reports/*"}
+
+	for relayState, expectedLocation := range map[string]string{
+		"/reports/42":               "/reports/42",
+		"https://evil.example.com/": "/home",
+		"":                          "/home",
+	} {
+		v := &url.Values{}
+		v.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+		v.Set("RelayState", relayState)
+		req, _ := http.NewRequest("POST", "/saml2/acs", bytes.NewReader([]byte(v.Encode())))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		resp := httptest.NewRecorder()
+		test.Middleware.ServeHTTP(resp, req)
+		assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+		assert.Check(t, is.Equal(expectedLocation, resp.Header().Get("Location")), relayState)
+	}
+}
+
+func TestMiddlewareCanParseECPResponse(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.ServiceProvider.AllowECP = true
+
+	response := strings.TrimPrefix(string(test.SamlResponse), `<?xml version="1.0" encoding="UTF-8"?>`)
+	envelope := `<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/">` +
+		`<S:Header>` +
+		`<paos:Response xmlns:paos="urn:liberty:paos:2003-08" S:actor="http://schemas.xmlsoap.org/soap/actor/next" S:mustUnderstand="1"/>` +
+		`<ecp:RelayState xmlns:ecp="urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp" S:actor="http://schemas.xmlsoap.org/soap/actor/next" S:mustUnderstand="1">KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6</ecp:RelayState>` +
+		`</S:Header>` +
+		`<S:Body>` + response + `</S:Body>` +
+		`</S:Envelope>`
+	req, _ := http.NewRequest("POST", "/saml2/acs", strings.NewReader(envelope))
+	req.Header.Set("Content-Type", saml.PAOSContentType)
+	req.Header.Set("Cookie", ""+
+		"saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+test.makeTrackedRequest("id-9e61753d64e928af5a7a341a97f420c9"))
+
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+
+	assert.Check(t, is.Equal("/frob", resp.Header().Get("Location")))
+	assert.Check(t, is.DeepEqual([]string{
+		"saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6=; Domain=15661444.ngrok.io; Expires=Thu, 01 Jan 1970 00:00:01 GMT",
+		"ttt=" + test.expectedSessionCookie + "; " +
+			"Path=/; Domain=15661444.ngrok.io; Max-Age=7200; HttpOnly; Secure"},
+		resp.Header()["Set-Cookie"]))
+}
+
 func TestMiddlewareDefaultCookieDomainIPv4(t *testing.T) {
 	test := NewMiddlewareTest(t)
 	ipv4Loopback := net.IP{127, 0, 0, 1}
@@ -521,3 +641,539 @@ func TestMiddlewareHandlesInvalidResponse(t *testing.T) {
 	assert.Check(t, is.Equal("", resp.Header().Get("Location")))
 	assert.Check(t, is.Equal("", resp.Header().Get("Set-Cookie")))
 }
+
+func TestMiddlewareCanHandleIDPLogoutRequest(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	idp, logoutRequest := newIDPLogoutRequest(t, test)
+	assert.Check(t, idp.SignLogoutRequest(&logoutRequest))
+
+	expectedDeleteCookie := "ttt=; Path=/; Domain=15661444.ngrok.io; Expires=Thu, 01 Jan 1970 00:00:01 GMT"
+
+	// HTTP-Redirect binding
+	redirectURL := logoutRequest.Redirect("frob")
+	req, _ := http.NewRequest("GET", "/saml2/slo?"+redirectURL.RawQuery, nil)
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.DeepEqual([]string{expectedDeleteCookie}, resp.Header()["Set-Cookie"]))
+
+	location, err := url.Parse(resp.Header().Get("Location"))
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("idp.testshib.org", location.Host))
+	assert.Check(t, is.Equal("/idp/profile/SAML2/Redirect/SLO", location.Path))
+	assert.Check(t, is.Equal("frob", location.Query().Get("RelayState")))
+	logoutResponse := saml.LogoutResponse{}
+	buf, err := base64.StdEncoding.DecodeString(location.Query().Get("SAMLResponse"))
+	assert.Check(t, err)
+	buf, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(buf)))
+	assert.Check(t, err)
+	assert.Check(t, xml.Unmarshal(buf, &logoutResponse))
+	assert.Check(t, is.Equal(logoutRequest.ID, logoutResponse.InResponseTo))
+	assert.Check(t, is.Equal(saml.StatusSuccess, logoutResponse.Status.StatusCode.Value))
+	assert.Check(t, is.Nil(logoutResponse.Signature))
+	assert.Check(t, is.Equal(dsig.RSASHA256SignatureMethod, location.Query().Get("SigAlg")))
+	assert.Check(t, location.Query().Get("Signature") != "")
+
+	// HTTP-POST binding
+	form := url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString(logoutRequestXML(t, &logoutRequest))},
+		"RelayState":  {"frob"},
+	}
+	req, _ = http.NewRequest("POST", "/saml2/slo", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusOK, resp.Code))
+	assert.Check(t, is.DeepEqual([]string{expectedDeleteCookie}, resp.Header()["Set-Cookie"]))
+	assert.Check(t, is.Contains(resp.Body.String(), `action="https://idp.testshib.org/idp/profile/SAML2/POST/SLO"`))
+	assert.Check(t, is.Contains(resp.Body.String(), `name="SAMLResponse"`))
+	assert.Check(t, is.Contains(resp.Body.String(), `name="RelayState" value="frob"`))
+
+	// unsigned requests are rejected and the session is kept
+	logoutRequest.Signature = nil
+	req, _ = http.NewRequest("GET", "/saml2/slo?"+logoutRequest.Redirect("").RawQuery, nil)
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+	assert.Check(t, is.Len(resp.Header()["Set-Cookie"], 0))
+
+	// asynchronous requests are not answered
+	logoutRequest.Extensions = &saml.Extensions{Asynchronous: &saml.Asynchronous{}}
+	assert.Check(t, idp.SignLogoutRequest(&logoutRequest))
+	req, _ = http.NewRequest("GET", "/saml2/slo?"+logoutRequest.Redirect("frob").RawQuery, nil)
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.DeepEqual([]string{expectedDeleteCookie}, resp.Header()["Set-Cookie"]))
+	assert.Check(t, is.Equal("/", resp.Header().Get("Location")))
+}
+
+// newIDPLogoutRequest returns a ServiceProvider that signs LogoutRequests
+// on behalf of the IDP of test, and an unsigned LogoutRequest from it.
+func newIDPLogoutRequest(t *testing.T, test *MiddlewareTest) (*saml.ServiceProvider, saml.LogoutRequest) {
+	// the test certificate has expired, so validate signatures as of when it was valid
+	saml.Clock = dsig.NewFakeClockAt(test.Certificate.NotBefore)
+	test.Middleware.ServiceProvider.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	// sign the LogoutRequest on behalf of the IDP with the test key
+	idpDescriptor := &test.Middleware.ServiceProvider.IDPMetadata.IDPSSODescriptors[0]
+	idpDescriptor.KeyDescriptors = []saml.KeyDescriptor{{
+		Use: "signing",
+		KeyInfo: saml.KeyInfo{X509Data: saml.X509Data{X509Certificates: []saml.X509Certificate{{
+			Data: base64.StdEncoding.EncodeToString(test.Certificate.Raw),
+		}}}},
+	}}
+	idpDescriptor.SingleLogoutServices = []saml.Endpoint{
+		{Binding: saml.HTTPRedirectBinding, Location: "https://idp.testshib.org/idp/profile/SAML2/Redirect/SLO"},
+		{Binding: saml.HTTPPostBinding, Location: "https://idp.testshib.org/idp/profile/SAML2/POST/SLO"},
+	}
+	idp := &saml.ServiceProvider{
+		EntityID:        test.Middleware.ServiceProvider.IDPMetadata.EntityID,
+		Key:             test.Key,
+		Certificate:     test.Certificate,
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+	}
+	logoutRequest := saml.LogoutRequest{
+		ID:           "id-00020406080a0c0e10121416181a1c1e20222426",
+		Version:      "2.0",
+		IssueInstant: saml.TimeNow(),
+		Destination:  "https://15661444.ngrok.io/saml2/slo",
+		Issuer: &saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.EntityID,
+		},
+		NameID: &saml.NameID{Value: "myself"},
+	}
+	return idp, logoutRequest
+}
+
+func logoutRequestXML(t *testing.T, req *saml.LogoutRequest) []byte {
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Element())
+	buf, err := doc.WriteToBytes()
+	assert.Check(t, err)
+	return buf
+}
+
+func TestMiddlewareCanLogOut(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	idp, _ := newIDPLogoutRequest(t, test)
+	test.Middleware.LogoutURL = mustParseURL("https://15661444.ngrok.io/saml2/logout")
+	expectedDeleteCookie := "ttt=; Path=/; Domain=15661444.ngrok.io; Expires=Thu, 01 Jan 1970 00:00:01 GMT"
+
+	// the session is deleted and the IDP is sent a LogoutRequest
+	req, _ := http.NewRequest("GET", "/saml2/logout?target=%2Fbye", nil)
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Assert(t, is.Len(resp.Header()["Set-Cookie"], 2))
+	assert.Check(t, is.Equal(expectedDeleteCookie, resp.Header()["Set-Cookie"][0]))
+	trackingCookie := resp.Result().Cookies()[1]
+	assert.Check(t, is.Equal("/saml2/slo", trackingCookie.Path))
+
+	location, err := url.Parse(resp.Header().Get("Location"))
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("idp.testshib.org", location.Host))
+	assert.Check(t, is.Equal("/idp/profile/SAML2/Redirect/SLO", location.Path))
+	relayState := location.Query().Get("RelayState")
+	assert.Check(t, is.Equal("saml_"+relayState, trackingCookie.Name))
+	assert.Check(t, location.Query().Get("Signature") != "")
+	buf, err := base64.StdEncoding.DecodeString(location.Query().Get("SAMLRequest"))
+	assert.Check(t, err)
+	buf, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(buf)))
+	assert.Check(t, err)
+	logoutRequest := saml.LogoutRequest{}
+	assert.Check(t, xml.Unmarshal(buf, &logoutRequest))
+	assert.Check(t, is.Equal("https://idp.testshib.org/idp/profile/SAML2/Redirect/SLO", logoutRequest.Destination))
+	assert.Check(t, is.Equal("_41bd295976dadd70e1480f318e772841", logoutRequest.NameID.Value))
+	assert.Check(t, is.Len(logoutRequest.SessionIndexes, 1))
+
+	// the IDP answers at the SLO URL and the user is returned to the target
+	postLogoutResponse := func(inResponseTo string) *httptest.ResponseRecorder {
+		logoutResponse, err := idp.MakeLogoutResponse("https://15661444.ngrok.io/saml2/slo", inResponseTo)
+		assert.Assert(t, err)
+		doc := etree.NewDocument()
+		doc.SetRoot(logoutResponse.Element())
+		buf, err := doc.WriteToBytes()
+		assert.Assert(t, err)
+		form := url.Values{
+			"SAMLResponse": {base64.StdEncoding.EncodeToString(buf)},
+			"RelayState":   {relayState},
+		}
+		req, _ := http.NewRequest("POST", "/saml2/slo", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(trackingCookie)
+		resp := httptest.NewRecorder()
+		test.Middleware.ServeHTTP(resp, req)
+		return resp
+	}
+	resp = postLogoutResponse(logoutRequest.ID)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("/bye", resp.Header().Get("Location")))
+
+	// responses to other requests are rejected
+	resp = postLogoutResponse("id-other")
+	assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+
+	// and the tracked request cannot be used to log in
+	v := url.Values{}
+	v.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	v.Set("RelayState", relayState)
+	req, _ = http.NewRequest("POST", "/saml2/acs", strings.NewReader(v.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(trackingCookie)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+}
+
+func TestMiddlewareCanLogOutWithPostBinding(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	newIDPLogoutRequest(t, test)
+	idpDescriptor := &test.Middleware.ServiceProvider.IDPMetadata.IDPSSODescriptors[0]
+	idpDescriptor.SingleLogoutServices = idpDescriptor.SingleLogoutServices[1:]
+	test.Middleware.LogoutURL = mustParseURL("https://15661444.ngrok.io/saml2/logout")
+
+	req, _ := http.NewRequest("POST", "/saml2/logout", nil)
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusOK, resp.Code))
+	assert.Check(t, is.Contains(resp.Body.String(), `action="https://idp.testshib.org/idp/profile/SAML2/POST/SLO"`))
+	assert.Check(t, is.Contains(resp.Body.String(), `name="SAMLRequest"`))
+
+	scriptContent := "document.getElementById('SAMLSubmitButton').style.visibility=\"hidden\";document.getElementById('SAMLRequestForm').submit();"
+	assert.Check(t, is.Contains(resp.Body.String(), "<script>"+scriptContent+"</script>"))
+	scriptSum := sha256.Sum256([]byte(scriptContent))
+	scriptHash := base64.StdEncoding.EncodeToString(scriptSum[:])
+	assert.Check(t, is.Equal("default-src; script-src 'sha256-"+scriptHash+"'; reflected-xss block; referrer no-referrer;",
+		resp.Header().Get("Content-Security-Policy")))
+
+	// users without a session are returned immediately
+	req, _ = http.NewRequest("GET", "/saml2/logout?target=%2Fbye", nil)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("/bye", resp.Header().Get("Location")))
+
+	req, _ = http.NewRequest("GET", "/saml2/logout?target=https%3A%2F%2Fevil.com%2F", nil)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusBadRequest, resp.Code))
+
+	req, _ = http.NewRequest("DELETE", "/saml2/logout", nil)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusMethodNotAllowed, resp.Code))
+}
+
+func TestMiddlewareCanChooseIDP(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	idpMetadata, err := ReadMetadataMap(bytes.NewReader(test.IDPMetadata))
+	assert.Assert(t, err)
+	test.Middleware.ServiceProvider.IDPMetadata = nil
+	test.Middleware.IDPMetadataResolver = idpMetadata
+	test.Middleware.ChooseIDP = func(r *http.Request) string {
+		return "https://idp.testshib.org/idp/shibboleth"
+	}
+
+	handler := test.Middleware.RequireAccount(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("not reached")
+		}))
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+
+		test.makeTrackedRequestForIDP("id-00020406080a0c0e10121416181a1c1e20222426", "https://idp.testshib.org/idp/shibboleth")+
+		"; Path=/saml2/acs; Max-Age=90; HttpOnly; Secure",
+		resp.Header().Get("Set-Cookie")))
+	redirectURL, err := url.Parse(resp.Header().Get("Location"))
+	assert.Check(t, err)
+	decodedRequest, err := testsaml.ParseRedirectRequest(redirectURL)
+	assert.Check(t, err)
+	golden.Assert(t, string(decodedRequest), "expected_authn_request_secure.xml")
+
+	// an identity provider that is not known is rejected
+	test.Middleware.ChooseIDP = nil
+	test.Middleware.IDPParam = "idp"
+	req, _ = http.NewRequest("GET", "/frob?idp=https%3A%2F%2Fidp.example.com%2F", nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+}
+
+func TestMiddlewareRejectsResponseFromOtherIDP(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	idpMetadata, err := ReadMetadataMap(bytes.NewReader(test.IDPMetadata))
+	assert.Assert(t, err)
+	test.Middleware.IDPMetadataResolver = idpMetadata
+
+	v := &url.Values{}
+	v.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	v.Set("RelayState", "KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6")
+	req, _ := http.NewRequest("POST", "/saml2/acs", bytes.NewReader([]byte(v.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", ""+
+		"saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+
+		test.makeTrackedRequestForIDP("id-9e61753d64e928af5a7a341a97f420c9", "https://idp.example.com/"))
+
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+}
+
+func TestMiddlewareCanRequestAuthnContext(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	requested := &saml.RequestedAuthnContext{
+		Comparison:            "minimum",
+		AuthnContextClassRefs: []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:Password"},
+	}
+
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	req = req.WithContext(ContextWithAuthnRequestOptions(req.Context(), AuthnRequestOptions{
+		RequestedAuthnContext: requested,
+	}))
+	resp := httptest.NewRecorder()
+	test.Middleware.HandleStartAuthFlow(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	redirectURL, err := url.Parse(resp.Header().Get("Location"))
+	assert.Check(t, err)
+	decodedRequest, err := testsaml.ParseRedirectRequest(redirectURL)
+	assert.Check(t, err)
+	assert.Check(t, is.Contains(string(decodedRequest),
+		`<samlp:RequestedAuthnContext Comparison="minimum"><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:Password</saml:AuthnContextClassRef></samlp:RequestedAuthnContext>`))
+
+	codec := test.Middleware.RequestTracker.(CookieRequestTracker).Codec
+	cookie := resp.Result().Cookies()[0]
+	trackedRequest, err := codec.Decode(cookie.Value)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("minimum", trackedRequest.AuthnContextComparison))
+	assert.Check(t, is.DeepEqual([]string{"urn:oasis:names:tc:SAML:2.0:ac:classes:Password"}, trackedRequest.AuthnContextClassRefs))
+
+	// the response, authenticated with PasswordProtectedTransport, must
+	// satisfy the authentication context of the tracked request
+	for _, tc := range []struct {
+		ClassRef   string
+		StatusCode int
+	}{
+		{"urn:oasis:names:tc:SAML:2.0:ac:classes:Password", http.StatusFound},
+		{"urn:oasis:names:tc:SAML:2.0:ac:classes:X509", http.StatusForbidden},
+	} {
+		trackedRequest, err := codec.Encode(TrackedRequest{
+			Index:                  "KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6",
+			SAMLRequestID:          "id-9e61753d64e928af5a7a341a97f420c9",
+			URI:                    "/frob",
+			AuthnContextComparison: "minimum",
+			AuthnContextClassRefs:  []string{tc.ClassRef},
+		})
+		assert.Check(t, err)
+
+		v := &url.Values{}
+		v.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+		v.Set("RelayState", "KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6")
+		req, _ := http.NewRequest("POST", "/saml2/acs", bytes.NewReader([]byte(v.Encode())))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", "saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+trackedRequest)
+		resp := httptest.NewRecorder()
+		test.Middleware.ServeHTTP(resp, req)
+		assert.Check(t, is.Equal(tc.StatusCode, resp.Code), tc.ClassRef)
+	}
+}
+
+func TestMiddlewareCanModifyAuthnRequest(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.ModifyAuthnRequest = func(r *http.Request, req *saml.AuthnRequest) error {
+		if r.URL.Query().Get("login_hint") == "" {
+			return nil
+		}
+		forceAuthn := true
+		req.ForceAuthn = &forceAuthn
+		req.RequestedAuthnContext = &saml.RequestedAuthnContext{
+			Comparison:            "exact",
+			AuthnContextClassRefs: []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:X509"},
+		}
+		req.Subject = &saml.Subject{
+			NameID: &saml.NameID{
+				Format: string(saml.EmailAddressNameIDFormat),
+				Value:  r.URL.Query().Get("login_hint"),
+			},
+		}
+		return nil
+	}
+
+	req, _ := http.NewRequest("GET", "/frob?login_hint=alice@example.com", nil)
+	resp := httptest.NewRecorder()
+	test.Middleware.HandleStartAuthFlow(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	redirectURL, err := url.Parse(resp.Header().Get("Location"))
+	assert.Check(t, err)
+	decodedRequest, err := testsaml.ParseRedirectRequest(redirectURL)
+	assert.Check(t, err)
+	assert.Check(t, is.Contains(string(decodedRequest), `ForceAuthn="true"`))
+	assert.Check(t, is.Contains(string(decodedRequest),
+		`<saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">alice@example.com</saml:NameID>`))
+
+	// the tracked request checks the response against the modified request
+	codec := test.Middleware.RequestTracker.(CookieRequestTracker).Codec
+	trackedRequest, err := codec.Decode(resp.Result().Cookies()[0].Value)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("exact", trackedRequest.AuthnContextComparison))
+	assert.Check(t, is.DeepEqual([]string{"urn:oasis:names:tc:SAML:2.0:ac:classes:X509"}, trackedRequest.AuthnContextClassRefs))
+
+	// requests that are left alone are sent as configured
+	req, _ = http.NewRequest("GET", "/frob", nil)
+	resp = httptest.NewRecorder()
+	test.Middleware.HandleStartAuthFlow(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	redirectURL, err = url.Parse(resp.Header().Get("Location"))
+	assert.Check(t, err)
+	decodedRequest, err = testsaml.ParseRedirectRequest(redirectURL)
+	assert.Check(t, err)
+	assert.Check(t, !strings.Contains(string(decodedRequest), `ForceAuthn`))
+	assert.Check(t, !strings.Contains(string(decodedRequest), `<saml:Subject>`))
+
+	// errors fail the auth flow
+	test.Middleware.ModifyAuthnRequest = func(r *http.Request, req *saml.AuthnRequest) error {
+		return errors.New("cannot modify request")
+	}
+	req, _ = http.NewRequest("GET", "/frob", nil)
+	resp = httptest.NewRecorder()
+	test.Middleware.HandleStartAuthFlow(resp, req)
+	assert.Check(t, is.Equal(http.StatusInternalServerError, resp.Code))
+	assert.Check(t, is.Len(resp.Result().Cookies(), 0))
+}
+
+func TestMiddlewareSilentCheck(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.SilentCheckURL = mustParseURL("https://15661444.ngrok.io/saml2/check")
+
+	req, _ := http.NewRequest("GET", "/saml2/check?target=%2Ffrob", nil)
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	redirectURL, err := url.Parse(resp.Header().Get("Location"))
+	assert.Check(t, err)
+	decodedRequest, err := testsaml.ParseRedirectRequest(redirectURL)
+	assert.Check(t, err)
+	assert.Check(t, is.Contains(string(decodedRequest), ` IsPassive="true"`))
+
+	codec := test.Middleware.RequestTracker.(CookieRequestTracker).Codec
+	trackedRequest, err := codec.Decode(resp.Result().Cookies()[0].Value)
+	assert.Check(t, err)
+	assert.Check(t, trackedRequest.Passive)
+	assert.Check(t, is.Equal("/frob", trackedRequest.URI))
+
+	// a NoPassive response means that the user is not logged in
+	noPassiveResponse := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"` +
+		` ID="_8e8dc5f69a98cc4c1ff3427e5ce34606fd672f91e6" Version="2.0" IssueInstant="2015-12-01T01:57:09Z"` +
+		` Destination="https://15661444.ngrok.io/saml2/acs" InResponseTo="id-00020406080a0c0e10121416181a1c1e20222426">` +
+		`<saml:Issuer>https://idp.testshib.org/idp/shibboleth</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Responder">` +
+		`<samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:NoPassive"/>` +
+		`</samlp:StatusCode></samlp:Status></samlp:Response>`
+	for _, passive := range []bool{true, false} {
+		cookie, err := codec.Encode(TrackedRequest{
+			Index:         "KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6",
+			SAMLRequestID: "id-00020406080a0c0e10121416181a1c1e20222426",
+			URI:           "/frob",
+			Passive:       passive,
+		})
+		assert.Check(t, err)
+
+		v := &url.Values{}
+		v.Set("SAMLResponse", base64.StdEncoding.EncodeToString([]byte(noPassiveResponse)))
+		v.Set("RelayState", "KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6")
+		req, _ := http.NewRequest("POST", "/saml2/acs", bytes.NewReader([]byte(v.Encode())))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", "saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+cookie)
+		resp := httptest.NewRecorder()
+		test.Middleware.ServeHTTP(resp, req)
+		if passive {
+			assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+			assert.Check(t, is.Equal("/frob", resp.Header().Get("Location")))
+			assert.Check(t, is.DeepEqual([]string{
+				"saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6=; Domain=15661444.ngrok.io; Expires=Thu, 01 Jan 1970 00:00:01 GMT"},
+				resp.Header()["Set-Cookie"]))
+		} else {
+			assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+		}
+	}
+
+	// users that have a session are returned immediately
+	req, _ = http.NewRequest("GET", "/saml2/check?target=%2Ffrob", nil)
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("/frob", resp.Header().Get("Location")))
+
+	req, _ = http.NewRequest("GET", "/saml2/check?target=https%3A%2F%2Fevil.example.com%2F", nil)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusBadRequest, resp.Code))
+}
+
+func TestMiddlewareRenewsSessionsCloseToExpiry(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	served := false
+	handler := test.Middleware.RequireAccount(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served = true
+		}))
+	requireAccount := func(method string, cookie string) *httptest.ResponseRecorder {
+		served = false
+		req, _ := http.NewRequest(method, "/frob?page=2", nil)
+		req.Header.Set("Cookie", cookie)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// the session expires in two hours, which is outside the window
+	test.Middleware.SessionRenewalWindow = time.Hour
+	requireAccount("GET", "ttt="+test.expectedSessionCookie)
+	assert.Check(t, served)
+
+	// within the window, the user is sent to the IDP with a passive request
+	test.Middleware.SessionRenewalWindow = 3 * time.Hour
+	resp := requireAccount("GET", "ttt="+test.expectedSessionCookie)
+	assert.Check(t, !served)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("saml_renewal=1; Path=/; Max-Age=7200; HttpOnly; Secure", resp.Header()["Set-Cookie"][0]))
+	redirectURL, err := url.Parse(resp.Header().Get("Location"))
+	assert.Check(t, err)
+	decodedRequest, err := testsaml.ParseRedirectRequest(redirectURL)
+	assert.Check(t, err)
+	assert.Check(t, is.Contains(string(decodedRequest), ` IsPassive="true"`))
+	codec := test.Middleware.RequestTracker.(CookieRequestTracker).Codec
+	trackedRequest, err := codec.Decode(resp.Result().Cookies()[1].Value)
+	assert.Check(t, err)
+	assert.Check(t, trackedRequest.Passive)
+	assert.Check(t, is.Equal("/frob?page=2", trackedRequest.URI))
+
+	// the renewal is attempted only once, and never for other methods
+	requireAccount("GET", "ttt="+test.expectedSessionCookie+"; saml_renewal=1")
+	assert.Check(t, served)
+	requireAccount("POST", "ttt="+test.expectedSessionCookie)
+	assert.Check(t, served)
+
+	// a new session ends the renewal
+	v := &url.Values{}
+	v.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	v.Set("RelayState", "KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6")
+	req, _ := http.NewRequest("POST", "/saml2/acs", bytes.NewReader([]byte(v.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", "saml_renewal=1; "+
+		"saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+test.makeTrackedRequest("id-9e61753d64e928af5a7a341a97f420c9"))
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Contains(resp.Header()["Set-Cookie"], "saml_renewal=; Path=/; Expires=Thu, 01 Jan 1970 00:00:01 GMT"))
+}
@@ -2,11 +2,19 @@
 package samlsp
 
 import (
+	"crypto"
+	"crypto/hmac"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"errors"
+	"html/template"
+	"net"
 	"net/http"
 	"net/url"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	dsig "github.com/russellhaering/goxmldsig"
 
 	"github.com/crewjam/saml"
@@ -14,48 +22,126 @@ import (
 
 // Options represents the parameters for creating a new middleware
 type Options struct {
-	EntityID              string
-	URL                   url.URL
-	Key                   *rsa.PrivateKey
-	Certificate           *x509.Certificate
-	Intermediates         []*x509.Certificate
-	HTTPClient            *http.Client
-	AllowIDPInitiated     bool
-	DefaultRedirectURI    string
-	IDPMetadata           *saml.EntityDescriptor
-	SignRequest           bool
-	UseArtifactResponse   bool
-	ForceAuthn            bool // TODO(ross): this should be *bool
-	RequestedAuthnContext *saml.RequestedAuthnContext
-	CookieSameSite        http.SameSite
-	RelayStateFunc        func(w http.ResponseWriter, r *http.Request) string
-	LogoutBindings        []string
+	EntityID                   string
+	URL                        url.URL
+	Key                        *rsa.PrivateKey
+	Certificate                *x509.Certificate
+	Intermediates              []*x509.Certificate
+	HTTPClient                 *http.Client
+	AllowIDPInitiated          bool
+	IDPInitiatedRelayStates    []string
+	AllowECP                   bool
+	DefaultRedirectURI         string
+	IDPMetadata                *saml.EntityDescriptor
+	SignRequest                bool
+	UseArtifactResponse        bool
+	ForceAuthn                 bool // TODO(ross): this should be *bool
+	IsPassive                  bool
+	RequestedAuthnContext      *saml.RequestedAuthnContext
+	NameIDPolicy               *saml.NameIDPolicy
+	OmitNameIDPolicy           bool
+	AttributeConsumingServices []saml.AttributeConsumingService
+	Organization               *saml.Organization
+	ContactPeople              []saml.ContactPerson
+	UIInfo                     *saml.UIInfo
+	MetadataValidDuration      time.Duration
+	MetadataCacheDuration      time.Duration
+	OmitMetadataValidUntil     bool
+	ValidateAttributeScopes    bool
+	StrictStructureCheck       bool
+	MaxIssueDelay              time.Duration
+	MaxClockSkew               time.Duration
+	ReplayCache                saml.ReplayCache
+	RequestIDStore             saml.RequestIDStore
+	StrictConditions           bool
+	AcceptedDestinations       []string
+	AcceptedAudiences          []string
+	AdditionalTrustedIssuers   []string
+	ResponseSignaturePolicy    saml.ResponseSignaturePolicy
+	WantAssertionsSigned       *bool
+	ValidateSubjectAddress     bool
+	TrustedProxies             []*net.IPNet
+	Tracer                     saml.Tracer
+	CookieSameSite             http.SameSite
+	CookieDomain               string
+	CookiePath                 string
+	CookiePartitioned          bool
+	SessionCodec               SessionCodec
+	SessionSigningKey          crypto.Signer
+	SessionClaimsFunc          func(claims *JWTSessionClaims, assertion *saml.Assertion) error
+	RequestTrackerStore        SessionStore
+	TrackRequestsInRelayState  bool
+	RelayStateKey              []byte
+	AllowedRedirectHosts       []string
+	APIChallenge               bool
+	APIPathPrefixes            []string
+	PublicRoutes               []PublicRoute
+	PostFormTemplate           *template.Template
+	ContentSecurityPolicy      string
+	ModifyAuthnRequest         func(r *http.Request, req *saml.AuthnRequest) error
+	RelayStateFunc             func(w http.ResponseWriter, r *http.Request) string
+	LogoutBindings             []string
+	AttributeMapper            *AttributeMapper
+	HonorSessionNotOnOrAfter   bool
+	SessionRenewalWindow       time.Duration
 }
 
 // DefaultSessionCodec returns the default SessionCodec for the provided options,
-// a JWTSessionCodec configured to issue signed tokens.
+// a JWTSessionCodec configured to issue signed tokens. The tokens are signed
+// with opts.SessionSigningKey, by the algorithm that suits it, or else with
+// opts.Key by RS256.
 func DefaultSessionCodec(opts Options) JWTSessionCodec {
+	var key crypto.Signer = opts.Key
+	var signingMethod jwt.SigningMethod = defaultJWTSigningMethod
+	if opts.SessionSigningKey != nil {
+		key = opts.SessionSigningKey
+		signingMethod = jwtSigningMethodForKey(key)
+	}
 	return JWTSessionCodec{
-		SigningMethod: defaultJWTSigningMethod,
-		Audience:      opts.URL.String(),
-		Issuer:        opts.URL.String(),
-		MaxAge:        defaultSessionMaxAge,
-		Key:           opts.Key,
+		SigningMethod:            signingMethod,
+		Audience:                 opts.URL.String(),
+		Issuer:                   opts.URL.String(),
+		MaxAge:                   defaultSessionMaxAge,
+		Key:                      key,
+		ClaimsFunc:               opts.SessionClaimsFunc,
+		HonorSessionNotOnOrAfter: opts.HonorSessionNotOnOrAfter,
+	}
+}
+
+// sessionCodec returns opts.SessionCodec, or the default SessionCodec if
+// it is nil.
+func sessionCodec(opts Options) SessionCodec {
+	if opts.SessionCodec != nil {
+		return opts.SessionCodec
 	}
+	return DefaultSessionCodec(opts)
 }
 
 // DefaultSessionProvider returns the default SessionProvider for the provided options,
-// a CookieSessionProvider configured to store sessions in a cookie.
+// a CookieSessionProvider configured to store sessions in a cookie, encoded by
+// opts.SessionCodec or the default SessionCodec.
 func DefaultSessionProvider(opts Options) CookieSessionProvider {
 	return CookieSessionProvider{
-		Name:     defaultSessionCookieName,
-		Domain:   opts.URL.Host,
-		MaxAge:   defaultSessionMaxAge,
-		HTTPOnly: true,
-		Secure:   opts.URL.Scheme == "https",
-		SameSite: opts.CookieSameSite,
-		Codec:    DefaultSessionCodec(opts),
+		Name:        defaultSessionCookieName,
+		Domain:      cookieDomain(opts),
+		MaxAge:      defaultSessionMaxAge,
+		HTTPOnly:    true,
+		Secure:      opts.URL.Scheme == "https",
+		SameSite:    opts.CookieSameSite,
+		Codec:       sessionCodec(opts),
+		Path:        opts.CookiePath,
+		Partitioned: opts.CookiePartitioned,
+	}
+}
+
+// cookieDomain returns the domain of the session cookies for the provided
+// options: opts.CookieDomain, which may be a parent domain that the
+// sessions are shared with, or else the host of opts.URL.
+func cookieDomain(opts Options) string {
+	if opts.CookieDomain != "" {
+		return opts.CookieDomain
 	}
+	return opts.URL.Host
 }
 
 // DefaultTrackedRequestCodec returns a new TrackedRequestCodec for the provided
@@ -65,11 +151,20 @@ func DefaultTrackedRequestCodec(opts Options) JWTTrackedRequestCodec {
 		SigningMethod: defaultJWTSigningMethod,
 		Audience:      opts.URL.String(),
 		Issuer:        opts.URL.String(),
-		MaxAge:        saml.MaxIssueDelay,
+		MaxAge:        maxIssueDelay(opts),
 		Key:           opts.Key,
 	}
 }
 
+// maxIssueDelay returns how long a tracked request is valid for, which is
+// the time the IDP has to respond to it.
+func maxIssueDelay(opts Options) time.Duration {
+	if opts.MaxIssueDelay != 0 {
+		return opts.MaxIssueDelay
+	}
+	return saml.MaxIssueDelay
+}
+
 // DefaultRequestTracker returns a new RequestTracker for the provided options,
 // a CookieRequestTracker which uses cookies to track pending requests.
 func DefaultRequestTracker(opts Options, serviceProvider *saml.ServiceProvider) CookieRequestTracker {
@@ -77,10 +172,27 @@ func DefaultRequestTracker(opts Options, serviceProvider *saml.ServiceProvider)
 		ServiceProvider: serviceProvider,
 		NamePrefix:      "saml_",
 		Codec:           DefaultTrackedRequestCodec(opts),
-		MaxAge:          saml.MaxIssueDelay,
+		MaxAge:          maxIssueDelay(opts),
 		RelayStateFunc:  opts.RelayStateFunc,
 		SameSite:        opts.CookieSameSite,
+		Partitioned:     opts.CookiePartitioned,
+	}
+}
+
+// relayStateKey returns the key that pending requests are encrypted with
+// when they are tracked in the RelayState: opts.RelayStateKey, or else one
+// derived from opts.Key, which all the instances of the service provider
+// share.
+func relayStateKey(opts Options) ([]byte, error) {
+	if len(opts.RelayStateKey) > 0 {
+		return opts.RelayStateKey, nil
+	}
+	if opts.Key == nil {
+		return nil, errors.New("TrackRequestsInRelayState requires RelayStateKey or Key")
 	}
+	mac := hmac.New(sha256.New, x509.MarshalPKCS1PrivateKey(opts.Key))
+	mac.Write([]byte("saml-relay-state"))
+	return mac.Sum(nil), nil
 }
 
 // DefaultServiceProvider returns the default saml.ServiceProvider for the provided
@@ -94,7 +206,11 @@ func DefaultServiceProvider(opts Options) saml.ServiceProvider {
 	if opts.ForceAuthn {
 		forceAuthn = &opts.ForceAuthn
 	}
-	signatureMethod := dsig.RSASHA1SignatureMethod
+	var isPassive *bool
+	if opts.IsPassive {
+		isPassive = &opts.IsPassive
+	}
+	signatureMethod := dsig.RSASHA256SignatureMethod
 	if !opts.SignRequest {
 		signatureMethod = ""
 	}
@@ -108,21 +224,48 @@ func DefaultServiceProvider(opts Options) saml.ServiceProvider {
 	}
 
 	return saml.ServiceProvider{
-		EntityID:              opts.EntityID,
-		Key:                   opts.Key,
-		Certificate:           opts.Certificate,
-		HTTPClient:            opts.HTTPClient,
-		Intermediates:         opts.Intermediates,
-		MetadataURL:           *metadataURL,
-		AcsURL:                *acsURL,
-		SloURL:                *sloURL,
-		IDPMetadata:           opts.IDPMetadata,
-		ForceAuthn:            forceAuthn,
-		RequestedAuthnContext: opts.RequestedAuthnContext,
-		SignatureMethod:       signatureMethod,
-		AllowIDPInitiated:     opts.AllowIDPInitiated,
-		DefaultRedirectURI:    opts.DefaultRedirectURI,
-		LogoutBindings:        opts.LogoutBindings,
+		EntityID:                   opts.EntityID,
+		Key:                        opts.Key,
+		Certificate:                opts.Certificate,
+		HTTPClient:                 opts.HTTPClient,
+		Intermediates:              opts.Intermediates,
+		MetadataURL:                *metadataURL,
+		AcsURL:                     *acsURL,
+		SloURL:                     *sloURL,
+		IDPMetadata:                opts.IDPMetadata,
+		ForceAuthn:                 forceAuthn,
+		IsPassive:                  isPassive,
+		RequestedAuthnContext:      opts.RequestedAuthnContext,
+		NameIDPolicy:               opts.NameIDPolicy,
+		OmitNameIDPolicy:           opts.OmitNameIDPolicy,
+		AttributeConsumingServices: opts.AttributeConsumingServices,
+		Organization:               opts.Organization,
+		ContactPeople:              opts.ContactPeople,
+		UIInfo:                     opts.UIInfo,
+		MetadataValidDuration:      opts.MetadataValidDuration,
+		MetadataCacheDuration:      opts.MetadataCacheDuration,
+		OmitMetadataValidUntil:     opts.OmitMetadataValidUntil,
+		ValidateAttributeScopes:    opts.ValidateAttributeScopes,
+		StrictStructureCheck:       opts.StrictStructureCheck,
+		MaxIssueDelay:              opts.MaxIssueDelay,
+		MaxClockSkew:               opts.MaxClockSkew,
+		ReplayCache:                opts.ReplayCache,
+		RequestIDStore:             opts.RequestIDStore,
+		StrictConditions:           opts.StrictConditions,
+		AcceptedDestinations:       opts.AcceptedDestinations,
+		AcceptedAudiences:          opts.AcceptedAudiences,
+		AdditionalTrustedIssuers:   opts.AdditionalTrustedIssuers,
+		ResponseSignaturePolicy:    opts.ResponseSignaturePolicy,
+		WantAssertionsSigned:       opts.WantAssertionsSigned,
+		ValidateSubjectAddress:     opts.ValidateSubjectAddress,
+		TrustedProxies:             opts.TrustedProxies,
+		Tracer:                     opts.Tracer,
+		SignatureMethod:            signatureMethod,
+		AllowIDPInitiated:          opts.AllowIDPInitiated,
+		IDPInitiatedRelayStates:    opts.IDPInitiatedRelayStates,
+		AllowECP:                   opts.AllowECP,
+		DefaultRedirectURI:         opts.DefaultRedirectURI,
+		LogoutBindings:             opts.LogoutBindings,
 	}
 }
 
@@ -134,13 +277,45 @@ func DefaultServiceProvider(opts Options) saml.ServiceProvider {
 // in the returned Middleware.
 func New(opts Options) (*Middleware, error) {
 	m := &Middleware{
-		ServiceProvider: DefaultServiceProvider(opts),
-		Binding:         "",
-		ResponseBinding: saml.HTTPPostBinding,
-		OnError:         DefaultOnError,
-		Session:         DefaultSessionProvider(opts),
+		ServiceProvider:      DefaultServiceProvider(opts),
+		Binding:              "",
+		ResponseBinding:      saml.HTTPPostBinding,
+		OnError:              DefaultOnError,
+		Session:              DefaultSessionProvider(opts),
+		AttributeMapper:      opts.AttributeMapper,
+		SessionRenewalWindow: opts.SessionRenewalWindow,
+		AllowedRedirectHosts: opts.AllowedRedirectHosts,
+		ModifyAuthnRequest:   opts.ModifyAuthnRequest,
 	}
 	m.RequestTracker = DefaultRequestTracker(opts, &m.ServiceProvider)
+	m.LogoutURL = *opts.URL.ResolveReference(&url.URL{Path: "saml/logout"})
+	if opts.PostFormTemplate != nil || opts.ContentSecurityPolicy != "" {
+		m.PostForm = &saml.PostForm{
+			Template:              opts.PostFormTemplate,
+			ContentSecurityPolicy: opts.ContentSecurityPolicy,
+		}
+	}
+	if m.APIRequestMatcher = apiRequestMatcher(opts); m.APIRequestMatcher != nil {
+		m.LoginURL = *opts.URL.ResolveReference(&url.URL{Path: "saml/login"})
+	}
+	skipper, err := publicRoutesMatcher(opts.PublicRoutes)
+	if err != nil {
+		return nil, err
+	}
+	m.Skipper = skipper
+	if opts.RequestTrackerStore != nil {
+		m.RequestTracker = NewServerRequestTracker(opts, opts.RequestTrackerStore)
+	}
+	if opts.TrackRequestsInRelayState {
+		if opts.RequestTrackerStore != nil {
+			return nil, errors.New("RequestTrackerStore and TrackRequestsInRelayState cannot both be set")
+		}
+		key, err := relayStateKey(opts)
+		if err != nil {
+			return nil, err
+		}
+		m.RequestTracker = NewRelayStateRequestTracker(opts, key)
+	}
 	if opts.UseArtifactResponse {
 		m.ResponseBinding = saml.HTTPArtifactBinding
 	}
@@ -0,0 +1,104 @@
+package samlsp
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PublicRoute describes requests that RequireAccount serves without a
+// session, such as health checks, webhooks and public assets. A request
+// matches if it matches all of the fields that are set.
+type PublicRoute struct {
+	// Methods lists the methods of the requests, i.e. "GET" and "HEAD". All
+	// methods match if it is empty.
+	Methods []string
+
+	// Host is the host of the requests, with a port if they have one, or
+	// "*." followed by a domain that all of the subdomains of match.
+	Host string
+
+	// Path is a pattern of the path of the requests in the syntax of
+	// path.Match, i.e. "/static/*.css". A pattern that ends in "/**" matches
+	// all of the paths below it, i.e. "/static/**".
+	Path string
+
+	// PathRegexp matches the path of the requests.
+	PathRegexp *regexp.Regexp
+}
+
+// Match reports whether r is a request that route describes.
+func (route PublicRoute) Match(r *http.Request) bool {
+	if len(route.Methods) > 0 && !containsFold(route.Methods, r.Method) {
+		return false
+	}
+	if route.Host != "" && !matchHost(route.Host, r.Host) {
+		return false
+	}
+	if route.Path != "" && !matchPath(route.Path, r.URL.Path) {
+		return false
+	}
+	if route.PathRegexp != nil && !route.PathRegexp.MatchString(r.URL.Path) {
+		return false
+	}
+	return true
+}
+
+// validate returns an error if the Path of route is malformed.
+func (route PublicRoute) validate() error {
+	if _, err := path.Match(strings.TrimSuffix(route.Path, "/**"), ""); err != nil {
+		return fmt.Errorf("public route %q: %w", route.Path, err)
+	}
+	return nil
+}
+
+// matchPath reports whether p matches pattern. See PublicRoute.Path.
+func matchPath(pattern string, p string) bool {
+	p = path.Clean("/" + p)
+	if prefix := strings.TrimSuffix(pattern, "/**"); prefix != pattern {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+		for dir := p; dir != "/"; dir = path.Dir(dir) {
+			if ok, _ := path.Match(prefix, dir); ok {
+				return true
+			}
+		}
+		return false
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// publicRoutesMatcher returns a Skipper that matches the requests of
+// routes, or nil if there are none.
+func publicRoutesMatcher(routes []PublicRoute) (func(r *http.Request) bool, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	for _, route := range routes {
+		if err := route.validate(); err != nil {
+			return nil, err
+		}
+	}
+	routes = append([]PublicRoute(nil), routes...)
+	return func(r *http.Request) bool {
+		for _, route := range routes {
+			if route.Match(r) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package samlsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestPublicRouteMatch(t *testing.T) {
+	for _, tc := range []struct {
+		route  PublicRoute
+		method string
+		url    string
+		match  bool
+	}{
+		{PublicRoute{Path: "/healthz"}, "GET", "https://example.com/healthz", true},
+		{PublicRoute{Path: "/healthz"}, "GET", "https://example.com/healthz/", true},
+		{PublicRoute{Path: "/healthz"}, "GET", "https://example.com/healthz/x", false},
+		{PublicRoute{Path: "/static/*.css"}, "GET", "https://example.com/static/site.css", true},
+		{PublicRoute{Path: "/static/*.css"}, "GET", "https://example.com/static/a/site.css", false},
+		{PublicRoute{Path: "/static/**"}, "GET", "https://example.com/static/a/site.css", true},
+		{PublicRoute{Path: "/static/**"}, "GET", "https://example.com/static", true},
+		{PublicRoute{Path: "/static/**"}, "GET", "https://example.com/staticfoo", false},
+		{PublicRoute{Path: "/static/**"}, "GET", "https://example.com/static/../admin", false},
+		{PublicRoute{Path: "/*/assets/**"}, "GET", "https://example.com/app/assets/a/b.js", true},
+		{PublicRoute{Path: "/hooks/*", Methods: []string{"POST"}}, "POST", "https://example.com/hooks/github", true},
+		{PublicRoute{Path: "/hooks/*", Methods: []string{"post"}}, "POST", "https://example.com/hooks/github", true},
+		{PublicRoute{Path: "/hooks/*", Methods: []string{"POST"}}, "GET", "https://example.com/hooks/github", false},
+		{PublicRoute{PathRegexp: regexp.MustCompile(`^/v[0-9]+/status$`)}, "GET", "https://example.com/v2/status", true},
+		{PublicRoute{PathRegexp: regexp.MustCompile(`^/v[0-9]+/status$`)}, "GET", "https://example.com/v2/statuses", false},
+		{PublicRoute{Host: "*.cdn.example.com"}, "GET", "https://a.cdn.example.com/x", true},
+		{PublicRoute{Host: "*.cdn.example.com"}, "GET", "https://example.com/x", false},
+		{PublicRoute{Host: "status.example.com", Path: "/"}, "GET", "https://status.example.com/", true},
+		{PublicRoute{Host: "status.example.com", Path: "/"}, "GET", "https://status.example.com/x", false},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.url, nil)
+		assert.Check(t, is.Equal(tc.match, tc.route.Match(req)), "%+v %s %s", tc.route, tc.method, tc.url)
+	}
+}
+
+func TestMiddlewareSkipsPublicRoutes(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.IdentityHeaders = true
+	skipper, err := publicRoutesMatcher([]PublicRoute{{Methods: []string{"GET"}, Path: "/public/**"}})
+	assert.Assert(t, err)
+	test.Middleware.Skipper = skipper
+
+	var session Session
+	handler := test.Middleware.RequireAccount(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session = SessionFromContext(r.Context())
+			w.Header().Set("Subject", r.Header.Get(SubjectHeader))
+			w.WriteHeader(http.StatusTeapot)
+		}))
+
+	req, _ := http.NewRequest("GET", "/public/frob", nil)
+	req.Header.Set(SubjectHeader, "admin")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusTeapot, resp.Code))
+	assert.Check(t, is.Nil(session))
+	assert.Check(t, is.Equal("", resp.Header().Get("Subject")))
+	assert.Check(t, is.Equal("admin", req.Header.Get(SubjectHeader)))
+
+	// the session is passed on if there is one
+	req, _ = http.NewRequest("GET", "/public/frob", nil)
+	req.Header.Set("Cookie", "ttt="+test.expectedSessionCookie)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusTeapot, resp.Code))
+	assert.Check(t, session != nil)
+
+	// other methods and paths still require a session
+	for _, method := range []string{"GET", "POST"} {
+		path := "/public/frob"
+		if method == "GET" {
+			path = "/frob"
+		}
+		req, _ = http.NewRequest(method, path, nil)
+		resp = httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		assert.Check(t, is.Equal(http.StatusFound, resp.Code), "%s %s", method, path)
+	}
+
+	_, err = New(Options{URL: mustParseURL("https://15661444.ngrok.io/"), PublicRoutes: []PublicRoute{{Path: "/static/[a-"}}})
+	assert.Check(t, is.Error(err, `public route "/static/[a-": syntax error in pattern`))
+}
@@ -0,0 +1,60 @@
+package samlsp
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isAllowedRedirectURI reports whether the user may be redirected to uri
+// after logging in: a local URI, or an http or https URL of the host of
+// the ACS URL or of one of m.AllowedRedirectHosts. If
+// m.RedirectURIValidator is set, it decides instead.
+func (m *Middleware) isAllowedRedirectURI(r *http.Request, uri string) bool {
+	if m.RedirectURIValidator != nil {
+		return m.RedirectURIValidator(r, uri)
+	}
+	if isLocalURI(uri) {
+		return true
+	}
+	if strings.IndexFunc(uri, isControl) != -1 {
+		return false
+	}
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, m.ServiceProvider.AcsURL.Host) {
+		return true
+	}
+	for _, host := range m.AllowedRedirectHosts {
+		if matchHost(host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectURIAfterLogin returns uri if the user may be redirected to it
+// after logging in, and the DefaultRedirectURI of the ServiceProvider, or
+// "/", otherwise.
+func (m *Middleware) redirectURIAfterLogin(r *http.Request, uri string) string {
+	if uri != "" && m.isAllowedRedirectURI(r, uri) {
+		return uri
+	}
+	if m.ServiceProvider.DefaultRedirectURI != "" {
+		return m.ServiceProvider.DefaultRedirectURI
+	}
+	return "/"
+}
+
+// matchHost reports whether host matches pattern, which is a host, with a
+// port if host must have it, or "*." followed by a domain that all of the
+// subdomains of match.
+func matchHost(pattern string, host string) bool {
+	if domain := strings.TrimPrefix(pattern, "*"); domain != pattern {
+		return strings.HasPrefix(domain, ".") && len(host) > len(domain) &&
+			strings.EqualFold(host[len(host)-len(domain):], domain)
+	}
+	return strings.EqualFold(pattern, host)
+}
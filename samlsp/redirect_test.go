@@ -0,0 +1,70 @@
+package samlsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestMiddlewareAllowedRedirectURIs(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	test.Middleware.AllowedRedirectHosts = []string{"app.example.com", "*.example.org"}
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	for uri, allowed := range map[string]bool{
+		"/frob?a=b":                           true,
+		"https://15661444.ngrok.io/frob":      true,
+		"https://app.example.com/frob":        true,
+		"http://APP.example.com/frob":         true,
+		"https://a.b.example.org/frob":        true,
+		"https://example.org/frob":            false,
+		"https://evil-example.org/frob":       false,
+		"https://app.example.com.evil.com/":   false,
+		"https://evil.com/frob":               false,
+		"//evil.com/frob":                     false,
+		"/\\evil.com/frob":                    false,
+		"/\t/evil.com/frob":                   false,
+		"https://app.example.com@evil.com/":   false,
+		"https://user@app.example.com/frob":   false,
+		"javascript:alert(1)":                 false,
+		"ftp://app.example.com/frob":          false,
+		"https://15661444.ngrok.io.evil.com/": false,
+	} {
+		assert.Check(t, is.Equal(allowed, test.Middleware.isAllowedRedirectURI(req, uri)), uri)
+	}
+
+	test.Middleware.RedirectURIValidator = func(r *http.Request, uri string) bool {
+		return strings.HasPrefix(uri, "/public/")
+	}
+	assert.Check(t, test.Middleware.isAllowedRedirectURI(req, "/public/frob"))
+	assert.Check(t, !test.Middleware.isAllowedRedirectURI(req, "/frob"))
+}
+
+func TestMiddlewareDoesNotRedirectToForeignHosts(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	codec := test.Middleware.RequestTracker.(CookieRequestTracker).Codec
+	trackedRequest, err := codec.Encode(TrackedRequest{
+		Index:         "KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6",
+		SAMLRequestID: "id-9e61753d64e928af5a7a341a97f420c9",
+		URI:           "https://evil.com/frob",
+	})
+	assert.Assert(t, err)
+
+	v := &url.Values{}
+	v.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	v.Set("RelayState", "KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6")
+	req, _ := http.NewRequest("POST", "/saml2/acs", bytes.NewReader([]byte(v.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", "saml_KCosLjAyNDY4Ojw-QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6="+trackedRequest)
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("/", resp.Header().Get("Location")))
+}
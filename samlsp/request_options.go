@@ -0,0 +1,69 @@
+package samlsp
+
+import (
+	"context"
+
+	"github.com/crewjam/saml"
+)
+
+// AuthnRequestOptions overrides the configuration of the ServiceProvider
+// for a single authentication request.
+type AuthnRequestOptions struct {
+	// RequestedAuthnContext, if not nil, replaces the RequestedAuthnContext
+	// of the ServiceProvider. The response to the request must satisfy it.
+	RequestedAuthnContext *saml.RequestedAuthnContext
+
+	// ForceAuthn and IsPassive, if not nil, replace the ForceAuthn and
+	// IsPassive of the ServiceProvider.
+	ForceAuthn *bool
+	IsPassive  *bool
+
+	// Scoping, if not nil, replaces the Scoping of the ServiceProvider.
+	Scoping *saml.Scoping
+}
+
+// ContextWithAuthnRequestOptions returns a new context with opts
+// associated. When the middleware starts the SAML auth flow for a request
+// whose context has options, the authentication request is made with them.
+// For example, to require multi-factor authentication before serving a
+// sensitive page:
+//
+//	ctx := samlsp.ContextWithAuthnRequestOptions(r.Context(), samlsp.AuthnRequestOptions{
+//	    RequestedAuthnContext: &saml.RequestedAuthnContext{
+//	        Comparison:            "minimum",
+//	        AuthnContextClassRefs: []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:TimeSyncToken"},
+//	    },
+//	})
+//	m.HandleStartAuthFlow(w, r.WithContext(ctx))
+func ContextWithAuthnRequestOptions(ctx context.Context, opts AuthnRequestOptions) context.Context {
+	return context.WithValue(ctx, authnRequestOptionsIndex, opts)
+}
+
+// AuthnRequestOptionsFromContext returns the options associated with ctx,
+// or the zero AuthnRequestOptions if there are none.
+func AuthnRequestOptionsFromContext(ctx context.Context) AuthnRequestOptions {
+	opts, _ := ctx.Value(authnRequestOptionsIndex).(AuthnRequestOptions)
+	return opts
+}
+
+// apply returns sp, or a copy of sp with the options applied if there are
+// any.
+func (opts AuthnRequestOptions) apply(sp *saml.ServiceProvider) *saml.ServiceProvider {
+	if opts == (AuthnRequestOptions{}) {
+		return sp
+	}
+	rv := *sp
+	if opts.RequestedAuthnContext != nil {
+		rv.RequestedAuthnContext = opts.RequestedAuthnContext
+	}
+	if opts.ForceAuthn != nil {
+		rv.ForceAuthn = opts.ForceAuthn
+	}
+	if opts.IsPassive != nil {
+		rv.IsPassive = opts.IsPassive
+	}
+	if opts.Scoping != nil {
+		rv.Scoping = opts.Scoping
+	}
+	return &rv
+}
@@ -2,6 +2,9 @@ package samlsp
 
 import (
 	"net/http"
+	"time"
+
+	"github.com/crewjam/saml"
 )
 
 // RequestTracker tracks pending authentication requests.
@@ -34,6 +37,64 @@ type TrackedRequest struct {
 	Index         string `json:"-"`
 	SAMLRequestID string `json:"id"`
 	URI           string `json:"uri"`
+
+	// IDPEntityID is the entity ID of the identity provider that the
+	// request was sent to, if the middleware chose one. See
+	// IDPEntityIDFromContext.
+	IDPEntityID string `json:"idp,omitempty"`
+
+	// AuthnContextComparison and AuthnContextClassRefs are the
+	// authentication context that the request asked for, if it overrode the
+	// one of the ServiceProvider. See AuthnRequestOptions.
+	AuthnContextComparison string   `json:"acc,omitempty"`
+	AuthnContextClassRefs  []string `json:"acr,omitempty"`
+
+	// Passive is true if the request asked the identity provider not to
+	// interact with the user. See Middleware.ServeSilentCheck.
+	Passive bool `json:"passive,omitempty"`
+
+	// IssueInstant is when the request was made, so that trackers can
+	// expire it.
+	IssueInstant time.Time `json:"issue_instant,omitempty"`
+
+	// Logout is true if the request is a LogoutRequest, which the identity
+	// provider answers at the SLO URL rather than the ACS URL. See
+	// IsLogoutRequestContext.
+	Logout bool `json:"logout,omitempty"`
+}
+
+// newTrackedRequest returns the TrackedRequest for the SAML request with
+// the given ID, made for r, with the options in the context of r.
+func newTrackedRequest(r *http.Request, index string, samlRequestID string) TrackedRequest {
+	trackedRequest := TrackedRequest{
+		Index:         index,
+		SAMLRequestID: samlRequestID,
+		URI:           r.URL.String(),
+		IDPEntityID:   IDPEntityIDFromContext(r.Context()),
+		IssueInstant:  saml.TimeNow(),
+		Logout:        IsLogoutRequestContext(r.Context()),
+	}
+	requestOptions := AuthnRequestOptionsFromContext(r.Context())
+	if requested := requestOptions.RequestedAuthnContext; requested != nil {
+		trackedRequest.AuthnContextComparison = requested.Comparison
+		trackedRequest.AuthnContextClassRefs = requested.AuthnContextClassRefs
+	}
+	if requestOptions.IsPassive != nil && *requestOptions.IsPassive {
+		trackedRequest.Passive = true
+	}
+	return trackedRequest
+}
+
+// requestedAuthnContext returns the authentication context that the request
+// asked for, or nil if it did not override the one of the ServiceProvider.
+func (tr TrackedRequest) requestedAuthnContext() *saml.RequestedAuthnContext {
+	if len(tr.AuthnContextClassRefs) == 0 {
+		return nil
+	}
+	return &saml.RequestedAuthnContext{
+		Comparison:            tr.AuthnContextComparison,
+		AuthnContextClassRefs: tr.AuthnContextClassRefs,
+	}
 }
 
 // TrackedRequestCodec handles encoding and decoding of a TrackedRequest.
@@ -14,6 +14,12 @@ var _ RequestTracker = CookieRequestTracker{}
 
 // CookieRequestTracker tracks requests by setting a uniquely named
 // cookie for each request.
+//
+// The identity provider usually returns the response by a cross-site POST
+// to the ACS URL, which browsers do not send Lax or Strict cookies with, so
+// if SameSite is either and the ACS URL is https, the cookies are
+// SameSite=None instead. The cookies of LogoutRequests are set for the SLO
+// URL rather than the ACS URL.
 type CookieRequestTracker struct {
 	ServiceProvider *saml.ServiceProvider
 	NamePrefix      string
@@ -21,16 +27,16 @@ type CookieRequestTracker struct {
 	MaxAge          time.Duration
 	RelayStateFunc  func(w http.ResponseWriter, r *http.Request) string
 	SameSite        http.SameSite
+
+	// Partitioned, if true, makes the cookies partitioned (see CHIPS), for
+	// authentication flows started from iframes of other sites.
+	Partitioned bool
 }
 
 // TrackRequest starts tracking the SAML request with the given ID. It returns an
 // `index` that should be used as the RelayState in the SAMl request flow.
 func (t CookieRequestTracker) TrackRequest(w http.ResponseWriter, r *http.Request, samlRequestID string) (string, error) {
-	trackedRequest := TrackedRequest{
-		Index:         base64.RawURLEncoding.EncodeToString(randomBytes(42)),
-		SAMLRequestID: samlRequestID,
-		URI:           r.URL.String(),
-	}
+	trackedRequest := newTrackedRequest(r, base64.RawURLEncoding.EncodeToString(randomBytes(42)), samlRequestID)
 
 	if t.RelayStateFunc != nil {
 		relayState := t.RelayStateFunc(w, r)
@@ -44,15 +50,24 @@ func (t CookieRequestTracker) TrackRequest(w http.ResponseWriter, r *http.Reques
 		return "", err
 	}
 
-	http.SetCookie(w, &http.Cookie{
+	secure := t.ServiceProvider.AcsURL.Scheme == "https"
+	sameSite := t.SameSite
+	if secure && (sameSite == http.SameSiteLaxMode || sameSite == http.SameSiteStrictMode) {
+		sameSite = http.SameSiteNoneMode
+	}
+	path := t.ServiceProvider.AcsURL.Path
+	if trackedRequest.Logout {
+		path = t.ServiceProvider.SloURL.Path
+	}
+	setCookie(w, &http.Cookie{
 		Name:     t.NamePrefix + trackedRequest.Index,
 		Value:    signedTrackedRequest,
 		MaxAge:   int(t.MaxAge.Seconds()),
 		HttpOnly: true,
-		SameSite: t.SameSite,
-		Secure:   t.ServiceProvider.AcsURL.Scheme == "https",
-		Path:     t.ServiceProvider.AcsURL.Path,
-	})
+		SameSite: sameSite,
+		Secure:   secure,
+		Path:     path,
+	}, t.Partitioned)
 
 	return trackedRequest.Index, nil
 }
@@ -67,7 +82,7 @@ func (t CookieRequestTracker) StopTrackingRequest(w http.ResponseWriter, r *http
 	cookie.Value = ""
 	cookie.Domain = t.ServiceProvider.AcsURL.Hostname()
 	cookie.Expires = time.Unix(1, 0) // past time as close to epoch as possible, but not zero time.Time{}
-	http.SetCookie(w, cookie)
+	setCookie(w, cookie, t.Partitioned)
 	return nil
 }
 
@@ -0,0 +1,87 @@
+package samlsp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// encryptedTrackedRequestData is the additional data that
+// EncryptedTrackedRequestCodec authenticates, so that its ciphertexts
+// cannot be passed off as those of another use of the key.
+var encryptedTrackedRequestData = []byte("saml-tracked-request")
+
+// EncryptedTrackedRequestCodec encodes TrackedRequests as JSON sealed with
+// AES-GCM, so that, unlike JWTTrackedRequestCodec, the URI and other details
+// of the requests cannot be read by the client or the identity provider.
+type EncryptedTrackedRequestCodec struct {
+	// Key is the AES key, of 16, 24 or 32 bytes.
+	Key    []byte
+	MaxAge time.Duration
+}
+
+var _ TrackedRequestCodec = EncryptedTrackedRequestCodec{}
+
+type encryptedTrackedRequest struct {
+	TrackedRequest
+	ExpiresAt int64 `json:"exp"`
+}
+
+// Encode returns an encoded string representing the TrackedRequest. The
+// Index is not encoded.
+func (c EncryptedTrackedRequestCodec) Encode(value TrackedRequest) (string, error) {
+	aead, err := c.aead()
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(encryptedTrackedRequest{
+		TrackedRequest: value,
+		ExpiresAt:      saml.TimeNow().Add(c.MaxAge).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	nonce := randomBytes(aead.NonceSize())
+	sealed := aead.Seal(nonce, nonce, plaintext, encryptedTrackedRequestData)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decode returns a Tracked request from an encoded string.
+func (c EncryptedTrackedRequestCodec) Decode(encoded string) (*TrackedRequest, error) {
+	aead, err := c.aead()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("tracked request is too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], encryptedTrackedRequestData)
+	if err != nil {
+		return nil, err
+	}
+	var value encryptedTrackedRequest
+	if err := json.Unmarshal(plaintext, &value); err != nil {
+		return nil, err
+	}
+	if !saml.TimeNow().Before(time.Unix(value.ExpiresAt, 0)) {
+		return nil, errors.New("tracked request has expired")
+	}
+	return &value.TrackedRequest, nil
+}
+
+func (c EncryptedTrackedRequestCodec) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,71 @@
+package samlsp
+
+import (
+	"net/http"
+)
+
+var _ RequestTracker = RelayStateRequestTracker{}
+
+// RelayStateRequestTracker is an implementation of RequestTracker that
+// keeps nothing: each pending request travels, encoded by Codec, as the
+// RelayState of the SAML flow, and comes back with the response. It works
+// when the browser blocks the cookies of the ACS URL, i.e. because it is
+// on another host than the application, and needs no shared store between
+// the instances of the service provider.
+//
+// The encoded requests are much longer than the 80 bytes that the SAML
+// bindings allow for the RelayState, although most identity providers
+// accept them. Since the requests are not tied to the browser that made
+// them, a response can be delivered by another browser, and
+// StopTrackingRequest cannot prevent a RelayState from being used again
+// before it expires; set the RequestIDStore of the ServiceProvider to
+// accept each response only once.
+type RelayStateRequestTracker struct {
+	Codec TrackedRequestCodec
+}
+
+// NewRelayStateRequestTracker returns a RelayStateRequestTracker for the
+// provided options, which encrypts the requests with key.
+func NewRelayStateRequestTracker(opts Options, key []byte) RelayStateRequestTracker {
+	return RelayStateRequestTracker{
+		Codec: EncryptedTrackedRequestCodec{
+			Key:    key,
+			MaxAge: maxIssueDelay(opts),
+		},
+	}
+}
+
+// TrackRequest starts tracking the SAML request with the given ID. It
+// returns the encoded request as the index.
+func (t RelayStateRequestTracker) TrackRequest(w http.ResponseWriter, r *http.Request, samlRequestID string) (string, error) {
+	return t.Codec.Encode(newTrackedRequest(r, "", samlRequestID))
+}
+
+// StopTrackingRequest does nothing, as there is nothing to forget.
+func (t RelayStateRequestTracker) StopTrackingRequest(w http.ResponseWriter, r *http.Request, index string) error {
+	return nil
+}
+
+// GetTrackedRequests returns the request encoded in the RelayState of r,
+// if there is one.
+func (t RelayStateRequestTracker) GetTrackedRequests(r *http.Request) []TrackedRequest {
+	index := r.FormValue("RelayState")
+	if index == "" {
+		return []TrackedRequest{}
+	}
+	trackedRequest, err := t.GetTrackedRequest(r, index)
+	if err != nil {
+		return []TrackedRequest{}
+	}
+	return []TrackedRequest{*trackedRequest}
+}
+
+// GetTrackedRequest returns the request encoded in index.
+func (t RelayStateRequestTracker) GetTrackedRequest(r *http.Request, index string) (*TrackedRequest, error) {
+	trackedRequest, err := t.Codec.Decode(index)
+	if err != nil {
+		return nil, err
+	}
+	trackedRequest.Index = index
+	return trackedRequest, nil
+}
@@ -0,0 +1,110 @@
+package samlsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml"
+)
+
+func TestRelayStateRequestTracker(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	tracker := NewRelayStateRequestTracker(Options{}, bytes.Repeat([]byte{1}, 32))
+	test.Middleware.RequestTracker = tracker
+
+	// the request travels in the RelayState, unreadable, and no cookie is set
+	req, _ := http.NewRequest("GET", "/frob?secret=1", nil)
+	resp := httptest.NewRecorder()
+	index, err := tracker.TrackRequest(resp, req, "id-9e61753d64e928af5a7a341a97f420c9")
+	assert.Check(t, err)
+	assert.Check(t, is.Len(resp.Header()["Set-Cookie"], 0))
+	assert.Check(t, !strings.Contains(index, "frob"))
+	decoded, _ := base64.RawURLEncoding.DecodeString(index)
+	assert.Check(t, !bytes.Contains(decoded, []byte("frob")))
+	trackedRequest, err := tracker.GetTrackedRequest(req, index)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(index, trackedRequest.Index))
+	assert.Check(t, is.Equal("id-9e61753d64e928af5a7a341a97f420c9", trackedRequest.SAMLRequestID))
+	assert.Check(t, is.Equal("/frob?secret=1", trackedRequest.URI))
+
+	// the response is accepted without any cookie
+	v := &url.Values{}
+	v.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	v.Set("RelayState", index)
+	req, _ = http.NewRequest("POST", "/saml2/acs", bytes.NewReader([]byte(v.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("/frob?secret=1", resp.Header().Get("Location")))
+	assert.Check(t, is.Len(resp.Header()["Set-Cookie"], 1))
+}
+
+func TestRelayStateRequestTrackerRejectsForgeries(t *testing.T) {
+	NewMiddlewareTest(t)
+	tracker := NewRelayStateRequestTracker(Options{MaxIssueDelay: time.Minute}, bytes.Repeat([]byte{1}, 32))
+
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	index, err := tracker.TrackRequest(httptest.NewRecorder(), req, "id-1")
+	assert.Assert(t, err)
+
+	req, _ = http.NewRequest("POST", "/saml2/acs", nil)
+	req.Form = url.Values{"RelayState": {index}}
+	assert.Check(t, is.Len(tracker.GetTrackedRequests(req), 1))
+
+	// tampered with
+	sealed, _ := base64.RawURLEncoding.DecodeString(index)
+	sealed[len(sealed)-1] ^= 1
+	_, err = tracker.GetTrackedRequest(req, base64.RawURLEncoding.EncodeToString(sealed))
+	assert.Check(t, is.Error(err, "cipher: message authentication failed"))
+	_, err = tracker.GetTrackedRequest(req, "frob")
+	assert.Check(t, is.Error(err, "tracked request is too short"))
+
+	// sealed with another key
+	other := NewRelayStateRequestTracker(Options{}, bytes.Repeat([]byte{2}, 32))
+	_, err = other.GetTrackedRequest(req, index)
+	assert.Check(t, is.Error(err, "cipher: message authentication failed"))
+
+	// expired
+	now := saml.TimeNow()
+	saml.TimeNow = func() time.Time { return now.Add(time.Minute) }
+	_, err = tracker.GetTrackedRequest(req, index)
+	assert.Check(t, is.Error(err, "tracked request has expired"))
+	assert.Check(t, is.Len(tracker.GetTrackedRequests(req), 0))
+}
+
+func TestNewTracksRequestsInRelayState(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	opts := Options{
+		URL:                       mustParseURL("https://15661444.ngrok.io/"),
+		Key:                       test.Key,
+		TrackRequestsInRelayState: true,
+	}
+	m, err := New(opts)
+	assert.Assert(t, err)
+	tracker, ok := m.RequestTracker.(RelayStateRequestTracker)
+	assert.Assert(t, ok)
+
+	// instances that share the key of the service provider share the key
+	m2, err := New(opts)
+	assert.Assert(t, err)
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	index, err := tracker.TrackRequest(httptest.NewRecorder(), req, "id-1")
+	assert.Check(t, err)
+	_, err = m2.RequestTracker.GetTrackedRequest(req, index)
+	assert.Check(t, err)
+
+	_, err = New(Options{URL: opts.URL, TrackRequestsInRelayState: true})
+	assert.Check(t, is.Error(err, "TrackRequestsInRelayState requires RelayStateKey or Key"))
+	_, err = New(Options{URL: opts.URL, Key: test.Key, TrackRequestsInRelayState: true, RequestTrackerStore: &MemorySessionStore{}})
+	assert.Check(t, is.Error(err, "RequestTrackerStore and TrackRequestsInRelayState cannot both be set"))
+}
@@ -0,0 +1,102 @@
+package samlsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+var _ RequestTracker = ServerRequestTracker{}
+
+// ServerRequestTracker is an implementation of RequestTracker that keeps
+// pending requests in a SessionStore, keyed by the ID of the SAML request,
+// which is also the RelayState. Unlike CookieRequestTracker, it works when
+// the browser blocks the cookies of the ACS URL and when the response is
+// delivered to another instance of the service provider, provided that the
+// instances share the store.
+//
+// Since the pending requests are not tied to the browser that made them,
+// GetTrackedRequests only returns the request named by the RelayState of
+// the response.
+type ServerRequestTracker struct {
+	Store          SessionStore
+	MaxAge         time.Duration
+	RelayStateFunc func(w http.ResponseWriter, r *http.Request) string
+}
+
+// NewServerRequestTracker returns a ServerRequestTracker for the provided
+// options that keeps pending requests in store.
+func NewServerRequestTracker(opts Options, store SessionStore) ServerRequestTracker {
+	return ServerRequestTracker{
+		Store:          store,
+		MaxAge:         maxIssueDelay(opts),
+		RelayStateFunc: opts.RelayStateFunc,
+	}
+}
+
+// TrackRequest starts tracking the SAML request with the given ID. It
+// returns the ID, or the value returned by RelayStateFunc, as the index.
+func (t ServerRequestTracker) TrackRequest(w http.ResponseWriter, r *http.Request, samlRequestID string) (string, error) {
+	index := samlRequestID
+	if t.RelayStateFunc != nil {
+		if relayState := t.RelayStateFunc(w, r); relayState != "" {
+			index = relayState
+		}
+	}
+	trackedRequest := newTrackedRequest(r, index, samlRequestID)
+
+	data, err := json.Marshal(trackedRequest)
+	if err != nil {
+		return "", err
+	}
+	if err := t.Store.Put(SessionInfo{
+		ID:     index,
+		Expiry: trackedRequest.IssueInstant.Add(t.MaxAge),
+	}, data); err != nil {
+		return "", err
+	}
+	return index, nil
+}
+
+// StopTrackingRequest stops tracking the SAML request given by index.
+func (t ServerRequestTracker) StopTrackingRequest(w http.ResponseWriter, r *http.Request, index string) error {
+	return t.Store.Delete(index)
+}
+
+// GetTrackedRequests returns the pending request named by the RelayState
+// of r, if there is one.
+func (t ServerRequestTracker) GetTrackedRequests(r *http.Request) []TrackedRequest {
+	index := r.FormValue("RelayState")
+	if index == "" {
+		return []TrackedRequest{}
+	}
+	trackedRequest, err := t.GetTrackedRequest(r, index)
+	if err != nil {
+		return []TrackedRequest{}
+	}
+	return []TrackedRequest{*trackedRequest}
+}
+
+// GetTrackedRequest returns a pending tracked request.
+func (t ServerRequestTracker) GetTrackedRequest(r *http.Request, index string) (*TrackedRequest, error) {
+	data, err := t.Store.Get(index)
+	if err == os.ErrNotExist {
+		return nil, fmt.Errorf("request %q is not pending", index)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var trackedRequest TrackedRequest
+	if err := json.Unmarshal(data, &trackedRequest); err != nil {
+		return nil, err
+	}
+	trackedRequest.Index = index
+	if saml.TimeNow().After(trackedRequest.IssueInstant.Add(t.MaxAge)) {
+		return nil, fmt.Errorf("request %q has expired", index)
+	}
+	return &trackedRequest, nil
+}
@@ -0,0 +1,75 @@
+package samlsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml"
+)
+
+func TestServerRequestTracker(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	store := &MemorySessionStore{}
+	tracker := NewServerRequestTracker(Options{}, store)
+	test.Middleware.RequestTracker = tracker
+
+	// the request is tracked under its ID, which is the RelayState
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	index, err := tracker.TrackRequest(httptest.NewRecorder(), req, "id-9e61753d64e928af5a7a341a97f420c9")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("id-9e61753d64e928af5a7a341a97f420c9", index))
+	trackedRequest, err := tracker.GetTrackedRequest(req, index)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("/frob", trackedRequest.URI))
+	assert.Check(t, is.Equal(saml.TimeNow(), trackedRequest.IssueInstant))
+
+	// the response is accepted without any cookie
+	v := &url.Values{}
+	v.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	v.Set("RelayState", index)
+	req, _ = http.NewRequest("POST", "/saml2/acs", bytes.NewReader([]byte(v.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal("/frob", resp.Header().Get("Location")))
+	assert.Check(t, is.Len(resp.Header()["Set-Cookie"], 1))
+
+	// and the request is no longer pending
+	_, err = tracker.GetTrackedRequest(req, index)
+	assert.Check(t, is.Error(err, `request "id-9e61753d64e928af5a7a341a97f420c9" is not pending`))
+	assert.Check(t, is.Len(tracker.GetTrackedRequests(req), 0))
+}
+
+func TestServerRequestTrackerExpiry(t *testing.T) {
+	NewMiddlewareTest(t)
+	tracker := NewServerRequestTracker(Options{MaxIssueDelay: time.Minute}, &MemorySessionStore{})
+
+	req, _ := http.NewRequest("GET", "/frob", nil)
+	index, err := tracker.TrackRequest(httptest.NewRecorder(), req, "id-1")
+	assert.Check(t, err)
+
+	req, _ = http.NewRequest("POST", "/saml2/acs", nil)
+	req.Form = url.Values{"RelayState": {index}}
+	assert.Check(t, is.Len(tracker.GetTrackedRequests(req), 1))
+
+	// the request expires with the store entry, and even if the store
+	// kept it
+	tracker.MaxAge = time.Second
+	_, err = tracker.GetTrackedRequest(req, index)
+	assert.Check(t, err)
+	now := saml.TimeNow()
+	saml.TimeNow = func() time.Time { return now.Add(2 * time.Second) }
+	_, err = tracker.GetTrackedRequest(req, index)
+	assert.Check(t, is.Error(err, `request "id-1" has expired`))
+	saml.TimeNow = func() time.Time { return now.Add(2 * time.Minute) }
+	assert.Check(t, is.Len(tracker.GetTrackedRequests(req), 0))
+}
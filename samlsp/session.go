@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/crewjam/saml"
 )
@@ -18,6 +19,45 @@ type SessionWithAttributes interface {
 	GetAttributes() Attributes
 }
 
+// SessionWithSubject is a session that can expose the NameID of the subject
+// of the SAML assertion it was created from.
+type SessionWithSubject interface {
+	Session
+	GetSubject() string
+}
+
+// SessionWithAuthnStatement is a session that can expose how and when the
+// user authenticated, as described by the AuthnStatement of the SAML
+// assertion it was created from, so that applications can require a
+// stronger or more recent authentication, or log the user out of the
+// session at the identity provider.
+type SessionWithAuthnStatement interface {
+	Session
+
+	// GetAuthnContextClassRef returns the authentication context class
+	// that the user authenticated with, or an empty string.
+	GetAuthnContextClassRef() string
+
+	// GetAuthnInstant returns when the user authenticated.
+	GetAuthnInstant() time.Time
+
+	// GetSessionIndex returns the index of the session at the identity
+	// provider, or an empty string.
+	GetSessionIndex() string
+
+	// GetSessionNotOnOrAfter returns when the session at the identity
+	// provider ends, or the zero time if it did not say.
+	GetSessionNotOnOrAfter() time.Time
+}
+
+// SessionWithExpiry is a session that can expose when it expires, so that
+// the cookie that holds it does not outlive it and it can be renewed
+// before it does.
+type SessionWithExpiry interface {
+	Session
+	GetExpiresAt() time.Time
+}
+
 // ErrNoSession is the error returned when the remote user does not have a session
 var ErrNoSession = errors.New("saml: session not present")
 
@@ -57,7 +97,12 @@ type SessionCodec interface {
 
 type indexType int
 
-const sessionIndex indexType = iota
+const (
+	sessionIndex indexType = iota
+	idpEntityIDIndex
+	authnRequestOptionsIndex
+	logoutRequestIndex
+)
 
 // SessionFromContext returns the session associated with ctx, or nil
 // if no session are associated
@@ -74,6 +119,32 @@ func ContextWithSession(ctx context.Context, session Session) context.Context {
 	return context.WithValue(ctx, sessionIndex, session)
 }
 
+// IDPEntityIDFromContext returns the entity ID of the identity provider
+// that the middleware chose to authenticate the user of a request with, or
+// an empty string if none was chosen. RequestTracker implementations record
+// it in TrackedRequest.IDPEntityID.
+func IDPEntityIDFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(idpEntityIDIndex).(string)
+	return v
+}
+
+func contextWithIDPEntityID(ctx context.Context, entityID string) context.Context {
+	return context.WithValue(ctx, idpEntityIDIndex, entityID)
+}
+
+// IsLogoutRequestContext reports whether the request being tracked with ctx
+// is a LogoutRequest of Middleware.ServeLogout rather than an
+// authentication request. RequestTracker implementations record it in
+// TrackedRequest.Logout.
+func IsLogoutRequestContext(ctx context.Context) bool {
+	v, _ := ctx.Value(logoutRequestIndex).(bool)
+	return v
+}
+
+func contextWithLogoutRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, logoutRequestIndex, true)
+}
+
 // AttributeFromContext is a convenience method that returns the named attribute
 // from the session, if available.
 func AttributeFromContext(ctx context.Context, name string) string {
@@ -22,6 +22,14 @@ type CookieSessionProvider struct {
 	SameSite http.SameSite
 	MaxAge   time.Duration
 	Codec    SessionCodec
+
+	// Path is the path of the cookie. The default is "/".
+	Path string
+
+	// Partitioned, if true, makes the cookie partitioned (see CHIPS), so
+	// that sessions work in applications embedded in iframes of other
+	// sites in browsers that block third-party cookies.
+	Partitioned bool
 }
 
 // CreateSession is called when we have received a valid SAML assertion and
@@ -43,16 +51,16 @@ func (c CookieSessionProvider) CreateSession(w http.ResponseWriter, r *http.Requ
 		return err
 	}
 
-	http.SetCookie(w, &http.Cookie{
+	setCookie(w, &http.Cookie{
 		Name:     c.Name,
 		Domain:   c.Domain,
 		Value:    value,
-		MaxAge:   int(c.MaxAge.Seconds()),
+		MaxAge:   int(sessionMaxAge(session, c.MaxAge).Seconds()),
 		HttpOnly: c.HTTPOnly,
 		Secure:   c.Secure || r.URL.Scheme == "https",
 		SameSite: c.SameSite,
-		Path:     "/",
-	})
+		Path:     cookiePath(c.Path),
+	}, c.Partitioned)
 	return nil
 }
 
@@ -75,9 +83,9 @@ func (c CookieSessionProvider) DeleteSession(w http.ResponseWriter, r *http.Requ
 
 	cookie.Value = ""
 	cookie.Expires = time.Unix(1, 0) // past time as close to epoch as possible, but not zero time.Time{}
-	cookie.Path = "/"
+	cookie.Path = cookiePath(c.Path)
 	cookie.Domain = c.Domain
-	http.SetCookie(w, cookie)
+	setCookie(w, cookie, c.Partitioned)
 	return nil
 }
 
@@ -97,3 +105,22 @@ func (c CookieSessionProvider) GetSession(r *http.Request) (Session, error) {
 	}
 	return session, nil
 }
+
+// sessionMaxAge returns how long the cookie of session lasts: maxAge, or
+// less if the session expires sooner, but at least a second, since a
+// cookie without a maximum age would last until the browser is closed.
+// Expiry times are usually in whole seconds, so they are compared with the
+// current time truncated to the second.
+func sessionMaxAge(session Session, maxAge time.Duration) time.Duration {
+	if session, ok := session.(SessionWithExpiry); ok {
+		if expiresAt := session.GetExpiresAt(); !expiresAt.IsZero() {
+			if d := expiresAt.Sub(saml.TimeNow().Truncate(time.Second)); d < maxAge {
+				maxAge = d
+			}
+		}
+	}
+	if maxAge < time.Second {
+		return time.Second
+	}
+	return maxAge
+}
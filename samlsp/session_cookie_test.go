@@ -45,3 +45,42 @@ func TestCookieSameSite(t *testing.T) {
 		assert.Check(t, is.Equal(http.SameSiteStrictMode, cookie.SameSite))
 	})
 }
+
+func TestCookieAttributes(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	opts := Options{
+		URL:               mustParseURL("http://app.example.com:8080/"),
+		Key:               test.Key,
+		CookieDomain:      "example.com",
+		CookiePath:        "/app",
+		CookieSameSite:    http.SameSiteNoneMode,
+		CookiePartitioned: true,
+	}
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Check(t, DefaultSessionProvider(opts).CreateSession(resp, req, &saml.Assertion{}))
+	setCookie := resp.Header().Get("Set-Cookie")
+	assert.Check(t, is.Contains(setCookie, "; Path=/app; Domain=example.com; Max-Age=3600; HttpOnly; Secure; SameSite=None; Partitioned"))
+
+	// the cookie is deleted with the same attributes
+	resp = httptest.NewRecorder()
+	req.AddCookie(&http.Cookie{Name: "token", Value: "x"})
+	assert.Check(t, DefaultSessionProvider(opts).DeleteSession(resp, req))
+	assert.Check(t, is.Equal("token=; Path=/app; Domain=example.com; Expires=Thu, 01 Jan 1970 00:00:01 GMT; Secure; Partitioned",
+		resp.Header().Get("Set-Cookie")))
+
+	// the cookies that track requests survive the cross-site POST of the
+	// response to an https ACS URL
+	trackRequest := func(opts Options) string {
+		sp := DefaultServiceProvider(opts)
+		resp := httptest.NewRecorder()
+		_, err := DefaultRequestTracker(opts, &sp).TrackRequest(resp, httptest.NewRequest(http.MethodGet, "/", nil), "id-1")
+		assert.Check(t, err)
+		return resp.Header().Get("Set-Cookie")
+	}
+	opts = Options{URL: mustParseURL("https://app.example.com/"), Key: test.Key, CookieSameSite: http.SameSiteLaxMode}
+	assert.Check(t, is.Contains(trackRequest(opts), "; HttpOnly; Secure; SameSite=None"))
+	opts.URL = mustParseURL("http://app.example.com/")
+	assert.Check(t, is.Contains(trackRequest(opts), "; HttpOnly; SameSite=Lax"))
+}
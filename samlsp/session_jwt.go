@@ -1,7 +1,10 @@
 package samlsp
 
 import (
-	"crypto/rsa"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"errors"
 	"fmt"
 	"time"
@@ -23,7 +26,21 @@ type JWTSessionCodec struct {
 	Audience      string
 	Issuer        string
 	MaxAge        time.Duration
-	Key           *rsa.PrivateKey
+
+	// Key signs and verifies the tokens. It must suit SigningMethod: an
+	// *rsa.PrivateKey for RS256, an *ecdsa.PrivateKey for ES256 or an
+	// ed25519.PrivateKey for EdDSA, for example.
+	Key crypto.Signer
+
+	// ClaimsFunc, if not nil, is called with the claims of each new
+	// session and the assertion it is created from, so that the
+	// application can add claims of its own, usually to Extra.
+	ClaimsFunc func(claims *JWTSessionClaims, assertion *saml.Assertion) error
+
+	// HonorSessionNotOnOrAfter, if true, makes sessions expire no later
+	// than the SessionNotOnOrAfter of the AuthnStatement they are created
+	// from, when the identity provider ends its own session.
+	HonorSessionNotOnOrAfter bool
 }
 
 var _ SessionCodec = JWTSessionCodec{}
@@ -41,6 +58,8 @@ func (c JWTSessionCodec) New(assertion *saml.Assertion) (Session, error) {
 	claims.ExpiresAt = now.Add(c.MaxAge).Unix()
 	claims.NotBefore = now.Unix()
 
+	claims.IDPEntityID = assertion.Issuer.Value
+
 	if sub := assertion.Subject; sub != nil {
 		if nameID := sub.NameID; nameID != nil {
 			claims.Subject = nameID.Value
@@ -67,6 +86,30 @@ func (c JWTSessionCodec) New(assertion *saml.Assertion) (Session, error) {
 			authnStatement.SessionIndex)
 	}
 
+	if len(assertion.AuthnStatements) > 0 {
+		authnStatement := assertion.AuthnStatements[0]
+		if classRef := authnStatement.AuthnContext.AuthnContextClassRef; classRef != nil {
+			claims.AuthnContextClassRef = classRef.Value
+		}
+		if !authnStatement.AuthnInstant.IsZero() {
+			claims.AuthnInstant = authnStatement.AuthnInstant.Unix()
+		}
+		claims.SessionIndex = authnStatement.SessionIndex
+		if authnStatement.SessionNotOnOrAfter != nil {
+			claims.SessionNotOnOrAfter = authnStatement.SessionNotOnOrAfter.Unix()
+		}
+	}
+
+	if c.HonorSessionNotOnOrAfter && claims.SessionNotOnOrAfter != 0 && claims.SessionNotOnOrAfter < claims.ExpiresAt {
+		claims.ExpiresAt = claims.SessionNotOnOrAfter
+	}
+
+	if c.ClaimsFunc != nil {
+		if err := c.ClaimsFunc(&claims, assertion); err != nil {
+			return nil, err
+		}
+	}
+
 	return claims, nil
 }
 
@@ -117,15 +160,92 @@ type JWTSessionClaims struct {
 	jwt.StandardClaims
 	Attributes  Attributes `json:"attr"`
 	SAMLSession bool       `json:"saml-session"`
+
+	// IDPEntityID is the entity ID of the identity provider that issued
+	// the assertion the session was created from.
+	IDPEntityID string `json:"idp,omitempty"`
+
+	// AuthnContextClassRef, AuthnInstant, SessionIndex and
+	// SessionNotOnOrAfter come from the first AuthnStatement of the
+	// assertion. The times are in seconds since the epoch, and are zero if
+	// the statement did not give them.
+	AuthnContextClassRef string `json:"acr,omitempty"`
+	AuthnInstant         int64  `json:"auth_time,omitempty"`
+	SessionIndex         string `json:"sid,omitempty"`
+	SessionNotOnOrAfter  int64  `json:"sess_exp,omitempty"`
+
+	// Extra holds the claims added by the application, see
+	// JWTSessionCodec.ClaimsFunc.
+	Extra map[string]interface{} `json:"ext,omitempty"`
 }
 
-var _ Session = JWTSessionClaims{}
+var _ SessionWithAuthnStatement = JWTSessionClaims{}
+var _ SessionWithExpiry = JWTSessionClaims{}
 
 // GetAttributes implements SessionWithAttributes. It returns the SAMl attributes.
 func (c JWTSessionClaims) GetAttributes() Attributes {
 	return c.Attributes
 }
 
+// GetSubject implements SessionWithSubject. It returns the NameID of the
+// subject of the assertion.
+func (c JWTSessionClaims) GetSubject() string {
+	return c.Subject
+}
+
+// GetAuthnContextClassRef implements SessionWithAuthnStatement.
+func (c JWTSessionClaims) GetAuthnContextClassRef() string {
+	return c.AuthnContextClassRef
+}
+
+// GetAuthnInstant implements SessionWithAuthnStatement.
+func (c JWTSessionClaims) GetAuthnInstant() time.Time {
+	return unixTime(c.AuthnInstant)
+}
+
+// GetSessionIndex implements SessionWithAuthnStatement.
+func (c JWTSessionClaims) GetSessionIndex() string {
+	return c.SessionIndex
+}
+
+// GetSessionNotOnOrAfter implements SessionWithAuthnStatement.
+func (c JWTSessionClaims) GetSessionNotOnOrAfter() time.Time {
+	return unixTime(c.SessionNotOnOrAfter)
+}
+
+// GetExpiresAt implements SessionWithExpiry.
+func (c JWTSessionClaims) GetExpiresAt() time.Time {
+	return unixTime(c.ExpiresAt)
+}
+
+// jwtSigningMethodForKey returns the signing method of the JWTs signed by
+// key: ES256, ES384 or ES512 for ECDSA keys on the matching curves, EdDSA
+// for Ed25519 keys and RS256 otherwise.
+func jwtSigningMethodForKey(key crypto.Signer) jwt.SigningMethod {
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P384():
+			return jwt.SigningMethodES384
+		case elliptic.P521():
+			return jwt.SigningMethodES512
+		}
+		return jwt.SigningMethodES256
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA
+	}
+	return defaultJWTSigningMethod
+}
+
+// unixTime returns the time of sec seconds since the epoch, or the zero
+// time if sec is zero.
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
+
 // Attributes is a map of attributes provided in the SAML assertion
 type Attributes map[string][]string
 
@@ -0,0 +1,180 @@
+package samlsp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml"
+)
+
+func TestJWTSessionCarriesAuthnStatement(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	codec := DefaultSessionCodec(Options{
+		URL: mustParseURL("https://15661444.ngrok.io/"),
+		Key: test.Key,
+	})
+
+	authnInstant := time.Date(2015, 12, 1, 1, 56, 21, 0, time.UTC)
+	sessionNotOnOrAfter := time.Date(2015, 12, 1, 9, 56, 21, 0, time.UTC)
+	session, err := codec.New(&saml.Assertion{
+		Subject: &saml.Subject{NameID: &saml.NameID{Value: "alice"}},
+		AuthnStatements: []saml.AuthnStatement{{
+			AuthnInstant:        authnInstant,
+			SessionIndex:        "_6149230ee8fb88d3635c238509d9a35a",
+			SessionNotOnOrAfter: &sessionNotOnOrAfter,
+			AuthnContext: saml.AuthnContext{
+				AuthnContextClassRef: &saml.AuthnContextClassRef{Value: "urn:oasis:names:tc:SAML:2.0:ac:classes:MobileTwoFactorContract"},
+			},
+		}},
+	})
+	assert.Assert(t, err)
+
+	// the claims survive encoding
+	encoded, err := codec.Encode(session)
+	assert.Assert(t, err)
+	session, err = codec.Decode(encoded)
+	assert.Assert(t, err)
+
+	s := session.(SessionWithAuthnStatement)
+	assert.Check(t, is.Equal("urn:oasis:names:tc:SAML:2.0:ac:classes:MobileTwoFactorContract", s.GetAuthnContextClassRef()))
+	assert.Check(t, is.Equal(authnInstant, s.GetAuthnInstant()))
+	assert.Check(t, is.Equal("_6149230ee8fb88d3635c238509d9a35a", s.GetSessionIndex()))
+	assert.Check(t, is.Equal(sessionNotOnOrAfter, s.GetSessionNotOnOrAfter()))
+	assert.Check(t, is.Equal("alice", session.(SessionWithSubject).GetSubject()))
+
+	// the times are zero if the assertion has no AuthnStatement
+	session, err = codec.New(&saml.Assertion{})
+	assert.Assert(t, err)
+	s = session.(SessionWithAuthnStatement)
+	assert.Check(t, s.GetAuthnInstant().IsZero())
+	assert.Check(t, s.GetSessionNotOnOrAfter().IsZero())
+	assert.Check(t, is.Equal("", s.GetSessionIndex()))
+}
+
+func TestJWTSessionHonorsSessionNotOnOrAfter(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	opts := Options{
+		URL: mustParseURL("https://15661444.ngrok.io/"),
+		Key: test.Key,
+	}
+	sessionNotOnOrAfter := saml.TimeNow().Add(10 * time.Minute)
+	assertion := &saml.Assertion{
+		AuthnStatements: []saml.AuthnStatement{{SessionNotOnOrAfter: &sessionNotOnOrAfter}},
+	}
+
+	session, err := DefaultSessionCodec(opts).New(assertion)
+	assert.Assert(t, err)
+	assert.Check(t, is.Equal(saml.TimeNow().Add(time.Hour).Unix(), session.(SessionWithExpiry).GetExpiresAt().Unix()))
+
+	opts.HonorSessionNotOnOrAfter = true
+	session, err = DefaultSessionCodec(opts).New(assertion)
+	assert.Assert(t, err)
+	assert.Check(t, is.Equal(sessionNotOnOrAfter.Unix(), session.(SessionWithExpiry).GetExpiresAt().Unix()))
+
+	// the cookie does not outlive the session
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "https://15661444.ngrok.io/", nil)
+	assert.Check(t, DefaultSessionProvider(opts).CreateSession(resp, req, assertion))
+	assert.Check(t, is.Equal(600, resp.Result().Cookies()[0].MaxAge))
+}
+
+func TestJWTSessionSigningKeys(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Assert(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Assert(t, err)
+
+	for _, tc := range []struct {
+		key crypto.Signer
+		alg string
+	}{
+		{nil, "RS256"},
+		{ecdsaKey, "ES256"},
+		{ed25519Key, "EdDSA"},
+	} {
+		codec := DefaultSessionCodec(Options{
+			URL:               mustParseURL("https://15661444.ngrok.io/"),
+			Key:               test.Key,
+			SessionSigningKey: tc.key,
+		})
+		assert.Check(t, is.Equal(tc.alg, codec.SigningMethod.Alg()))
+
+		session, err := codec.New(&saml.Assertion{Subject: &saml.Subject{NameID: &saml.NameID{Value: "alice"}}})
+		assert.Assert(t, err)
+		encoded, err := codec.Encode(session)
+		assert.Assert(t, err)
+		session, err = codec.Decode(encoded)
+		assert.Assert(t, err)
+		assert.Check(t, is.Equal("alice", session.(SessionWithSubject).GetSubject()))
+	}
+}
+
+func TestJWTSessionCustomClaims(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	codec := DefaultSessionCodec(Options{
+		URL: mustParseURL("https://15661444.ngrok.io/"),
+		Key: test.Key,
+		SessionClaimsFunc: func(claims *JWTSessionClaims, assertion *saml.Assertion) error {
+			if claims.Subject == "mallory" {
+				return errors.New("mallory is not welcome")
+			}
+			claims.Extra = map[string]interface{}{"tenant": "acme", "roles": []string{"admin"}}
+			return nil
+		},
+	})
+
+	session, err := codec.New(&saml.Assertion{Subject: &saml.Subject{NameID: &saml.NameID{Value: "alice"}}})
+	assert.Assert(t, err)
+	encoded, err := codec.Encode(session)
+	assert.Assert(t, err)
+	session, err = codec.Decode(encoded)
+	assert.Assert(t, err)
+	assert.Check(t, is.DeepEqual(map[string]interface{}{"tenant": "acme", "roles": []interface{}{"admin"}},
+		session.(JWTSessionClaims).Extra))
+
+	_, err = codec.New(&saml.Assertion{Subject: &saml.Subject{NameID: &saml.NameID{Value: "mallory"}}})
+	assert.Check(t, is.Error(err, "mallory is not welcome"))
+}
+
+type stringSessionCodec struct{}
+
+func (stringSessionCodec) New(assertion *saml.Assertion) (Session, error) {
+	return assertion.Subject.NameID.Value, nil
+}
+
+func (stringSessionCodec) Encode(s Session) (string, error) {
+	return s.(string), nil
+}
+
+func (stringSessionCodec) Decode(signed string) (Session, error) {
+	return signed, nil
+}
+
+func TestSessionProviderUsesCustomCodec(t *testing.T) {
+	p := DefaultSessionProvider(Options{
+		URL:          mustParseURL("https://15661444.ngrok.io/"),
+		SessionCodec: stringSessionCodec{},
+	})
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "https://15661444.ngrok.io/", nil)
+	assert.Check(t, p.CreateSession(resp, req, &saml.Assertion{Subject: &saml.Subject{NameID: &saml.NameID{Value: "alice"}}}))
+	cookie := resp.Result().Cookies()[0]
+	assert.Check(t, is.Equal("alice", cookie.Value))
+
+	req.AddCookie(cookie)
+	session, err := p.GetSession(req)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("alice", session))
+}
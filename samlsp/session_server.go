@@ -0,0 +1,311 @@
+package samlsp
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// SessionStore stores the sessions of a ServerSessionProvider, keyed by
+// the opaque IDs kept in the session cookies. The sessions are stored as
+// encoded by the SessionCodec, along with a SessionInfo describing them so
+// that the sessions of a user can be listed and revoked.
+//
+// MemorySessionStore and SQLSessionStore implement it, and the
+// redissession module provides one backed by Redis. ServerRequestTracker
+// keeps pending requests in one as well.
+type SessionStore interface {
+	// Put stores the encoded session data under info.ID until info.Expiry.
+	Put(info SessionInfo, data []byte) error
+
+	// Get returns the data stored under id. If there is none, or it has
+	// expired, the returned error must be os.ErrNotExist.
+	Get(id string) ([]byte, error)
+
+	// Delete deletes the session stored under id, if there is one.
+	Delete(id string) error
+
+	// List returns the sessions of the subject nameID of the IDP issuer
+	// that have not expired.
+	List(issuer, nameID string) ([]SessionInfo, error)
+}
+
+// SessionInfo describes a session stored in a SessionStore.
+type SessionInfo struct {
+	// ID is the opaque ID of the session kept in the session cookie.
+	ID string
+
+	// Issuer is the entity ID of the IDP that issued the assertion the
+	// session was created from. NameIDs are only unique per IDP, so
+	// sessions are listed and revoked by both.
+	Issuer string
+
+	// NameID is the NameID of the subject of the session.
+	NameID string
+
+	// SessionIndex is the SessionIndex of the AuthnStatement that the
+	// session was created from, if it had one.
+	SessionIndex string
+
+	// Expiry is the time at which the session expires.
+	Expiry time.Time
+}
+
+// SessionRevoker is implemented by SessionProviders that can end sessions
+// other than the one of the current request, such as
+// ServerSessionProvider. When the provider of a Middleware implements it,
+// ServeSLO revokes the sessions named by each LogoutRequest, so that
+// LogoutRequests sent by the IDP over a back channel, or from another user
+// agent, end the sessions too.
+type SessionRevoker interface {
+	// Sessions returns the sessions of the subject nameID of the IDP
+	// issuer.
+	Sessions(issuer, nameID string) ([]SessionInfo, error)
+
+	// RevokeSessions ends the sessions of the subject nameID of the IDP
+	// issuer. If sessionIndexes are given, only the sessions created from
+	// an AuthnStatement with one of them are ended.
+	RevokeSessions(issuer, nameID string, sessionIndexes ...string) error
+}
+
+var _ SessionProvider = ServerSessionProvider{}
+var _ SessionRevoker = ServerSessionProvider{}
+
+// ServerSessionProvider is an implementation of SessionProvider that
+// stores sessions in a SessionStore and only an opaque, random ID in an
+// HTTP cookie. Unlike with CookieSessionProvider, the size of the cookie
+// does not grow with the attributes of the session, and a session ends as
+// soon as it is deleted from the store.
+type ServerSessionProvider struct {
+	Name     string
+	Domain   string
+	HTTPOnly bool
+	Secure   bool
+	SameSite http.SameSite
+	MaxAge   time.Duration
+	Codec    SessionCodec
+	Store    SessionStore
+
+	// Path is the path of the cookie. The default is "/".
+	Path string
+
+	// Partitioned, if true, makes the cookie partitioned (see CHIPS), so
+	// that sessions work in applications embedded in iframes of other
+	// sites in browsers that block third-party cookies.
+	Partitioned bool
+}
+
+// NewServerSessionProvider returns a ServerSessionProvider for the
+// provided options that stores sessions in store, with the same cookie
+// settings and codec as DefaultSessionProvider.
+func NewServerSessionProvider(opts Options, store SessionStore) ServerSessionProvider {
+	return ServerSessionProvider{
+		Name:        defaultSessionCookieName,
+		Domain:      cookieDomain(opts),
+		MaxAge:      defaultSessionMaxAge,
+		HTTPOnly:    true,
+		Secure:      opts.URL.Scheme == "https",
+		SameSite:    opts.CookieSameSite,
+		Codec:       sessionCodec(opts),
+		Store:       store,
+		Path:        opts.CookiePath,
+		Partitioned: opts.CookiePartitioned,
+	}
+}
+
+// CreateSession implements SessionProvider. It stores the session created
+// from the assertion under a new ID, which is set in the cookie.
+func (p ServerSessionProvider) CreateSession(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) error {
+	// Cookies should not have the port attached to them so strip it off
+	if domain, _, err := net.SplitHostPort(p.Domain); err == nil {
+		p.Domain = domain
+	}
+
+	session, err := p.Codec.New(assertion)
+	if err != nil {
+		return err
+	}
+	data, err := p.Codec.Encode(session)
+	if err != nil {
+		return err
+	}
+
+	maxAge := sessionMaxAge(session, p.MaxAge)
+	info := SessionInfo{
+		ID:     base64.RawURLEncoding.EncodeToString(randomBytes(32)),
+		Issuer: assertion.Issuer.Value,
+		Expiry: saml.TimeNow().Add(maxAge),
+	}
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		info.NameID = assertion.Subject.NameID.Value
+	}
+	if len(assertion.AuthnStatements) > 0 {
+		info.SessionIndex = assertion.AuthnStatements[0].SessionIndex
+	}
+	if err := p.Store.Put(info, []byte(data)); err != nil {
+		return err
+	}
+
+	setCookie(w, &http.Cookie{
+		Name:     p.Name,
+		Domain:   p.Domain,
+		Value:    info.ID,
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: p.HTTPOnly,
+		Secure:   p.Secure || r.URL.Scheme == "https",
+		SameSite: p.SameSite,
+		Path:     cookiePath(p.Path),
+	}, p.Partitioned)
+	return nil
+}
+
+// DeleteSession implements SessionProvider. It deletes the session from
+// the store and removes the cookie.
+func (p ServerSessionProvider) DeleteSession(w http.ResponseWriter, r *http.Request) error {
+	// Cookies should not have the port attached to them so strip it off
+	if domain, _, err := net.SplitHostPort(p.Domain); err == nil {
+		p.Domain = domain
+	}
+
+	cookie, err := r.Cookie(p.Name)
+	if err == http.ErrNoCookie {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.Store.Delete(cookie.Value); err != nil {
+		return err
+	}
+
+	cookie.Value = ""
+	cookie.Expires = time.Unix(1, 0) // past time as close to epoch as possible, but not zero time.Time{}
+	cookie.Path = cookiePath(p.Path)
+	cookie.Domain = p.Domain
+	setCookie(w, cookie, p.Partitioned)
+	return nil
+}
+
+// GetSession implements SessionProvider. It returns the session stored
+// under the ID in the cookie, or ErrNoSession if there is none.
+func (p ServerSessionProvider) GetSession(r *http.Request) (Session, error) {
+	cookie, err := r.Cookie(p.Name)
+	if err == http.ErrNoCookie {
+		return nil, ErrNoSession
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, err := p.Store.Get(cookie.Value)
+	if err == os.ErrNotExist {
+		return nil, ErrNoSession
+	} else if err != nil {
+		return nil, err
+	}
+
+	session, err := p.Codec.Decode(string(data))
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	return session, nil
+}
+
+// Sessions implements SessionRevoker. It returns the sessions of the
+// subject nameID of the IDP issuer in the store, for example to show them
+// to an administrator.
+func (p ServerSessionProvider) Sessions(issuer, nameID string) ([]SessionInfo, error) {
+	return p.Store.List(issuer, nameID)
+}
+
+// RevokeSessions implements SessionRevoker. The revoked sessions are
+// deleted from the store, so the next request made with any of them has no
+// session.
+func (p ServerSessionProvider) RevokeSessions(issuer, nameID string, sessionIndexes ...string) error {
+	sessions, err := p.Store.List(issuer, nameID)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if len(sessionIndexes) > 0 && !containsValue(sessionIndexes, session.SessionIndex) {
+			continue
+		}
+		if err := p.Store.Delete(session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemorySessionStore is an implementation of SessionStore that resides
+// completely in memory. It is suitable for a service provider that runs as
+// a single process, and its sessions are lost when the process exits.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+}
+
+type memorySession struct {
+	info SessionInfo
+	data []byte
+}
+
+// Put implements SessionStore. Expired sessions are discarded as a side
+// effect.
+func (s *MemorySessionStore) Put(info SessionInfo, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = map[string]memorySession{}
+	}
+
+	now := saml.TimeNow()
+	for k, v := range s.sessions {
+		if now.After(v.info.Expiry) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[info.ID] = memorySession{info: info, data: data}
+	return nil
+}
+
+// Get implements SessionStore.
+func (s *MemorySessionStore) Get(id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || saml.TimeNow().After(session.info.Expiry) {
+		return nil, os.ErrNotExist
+	}
+	return session.data, nil
+}
+
+// Delete implements SessionStore.
+func (s *MemorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// List implements SessionStore.
+func (s *MemorySessionStore) List(issuer, nameID string) ([]SessionInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := saml.TimeNow()
+	var rv []SessionInfo
+	for _, v := range s.sessions {
+		if v.info.Issuer == issuer && v.info.NameID == nameID && !now.After(v.info.Expiry) {
+			rv = append(rv, v.info)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Expiry.Before(rv[j].Expiry) })
+	return rv, nil
+}
@@ -0,0 +1,176 @@
+package samlsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml"
+)
+
+func TestServerSessionProvider(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	p := NewServerSessionProvider(Options{
+		URL: mustParseURL("https://15661444.ngrok.io/"),
+		Key: test.Key,
+	}, &MemorySessionStore{})
+
+	assertion := &saml.Assertion{
+		Issuer:  saml.Issuer{Value: "https://idp.example.com/metadata"},
+		Subject: &saml.Subject{NameID: &saml.NameID{Value: "alice"}},
+	}
+	createSession := func() *http.Cookie {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "https://15661444.ngrok.io/", nil)
+		assert.Check(t, p.CreateSession(resp, req, assertion))
+		cookies := resp.Result().Cookies()
+		assert.Assert(t, is.Len(cookies, 1))
+		return cookies[0]
+	}
+	getSession := func(cookie *http.Cookie) (Session, error) {
+		req := httptest.NewRequest(http.MethodGet, "https://15661444.ngrok.io/", nil)
+		req.AddCookie(cookie)
+		return p.GetSession(req)
+	}
+
+	cookie := createSession()
+	assert.Check(t, is.Equal("token", cookie.Name))
+	assert.Check(t, is.Len(cookie.Value, 43))
+	assert.Check(t, cookie.HttpOnly)
+	assert.Check(t, cookie.Secure)
+
+	session, err := getSession(cookie)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("alice", session.(JWTSessionClaims).Subject))
+
+	// a cookie that does not name a stored session has no session
+	_, err = getSession(&http.Cookie{Name: "token", Value: "unknown"})
+	assert.Check(t, is.Equal(ErrNoSession, err))
+
+	// deleting the session removes it from the store and expires the cookie
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "https://15661444.ngrok.io/", nil)
+	req.AddCookie(cookie)
+	assert.Check(t, p.DeleteSession(resp, req))
+	assert.Check(t, is.Equal("", resp.Result().Cookies()[0].Value))
+	_, err = getSession(cookie)
+	assert.Check(t, is.Equal(ErrNoSession, err))
+
+	// sessions can be listed and revoked by SessionIndex or by NameID
+	assertion.AuthnStatements = []saml.AuthnStatement{{SessionIndex: "index-1"}}
+	cookie1 := createSession()
+	assertion.AuthnStatements = []saml.AuthnStatement{{SessionIndex: "index-2"}}
+	cookie2 := createSession()
+	cookie3 := createSession()
+	sessions, err := p.Sessions("https://idp.example.com/metadata", "alice")
+	assert.Check(t, err)
+	assert.Check(t, is.Len(sessions, 3))
+	sessions, err = p.Sessions("https://idp.example.com/metadata", "bob")
+	assert.Check(t, err)
+	assert.Check(t, is.Len(sessions, 0))
+
+	// the NameIDs of different IDPs do not name the same subject
+	sessions, err = p.Sessions("https://other-idp.example.com/metadata", "alice")
+	assert.Check(t, err)
+	assert.Check(t, is.Len(sessions, 0))
+	assert.Check(t, p.RevokeSessions("https://other-idp.example.com/metadata", "alice"))
+	_, err = getSession(cookie1)
+	assert.Check(t, err)
+
+	assert.Check(t, p.RevokeSessions("https://idp.example.com/metadata", "alice", "index-1"))
+	_, err = getSession(cookie1)
+	assert.Check(t, is.Equal(ErrNoSession, err))
+	_, err = getSession(cookie2)
+	assert.Check(t, err)
+
+	assert.Check(t, p.RevokeSessions("https://idp.example.com/metadata", "alice"))
+	_, err = getSession(cookie2)
+	assert.Check(t, is.Equal(ErrNoSession, err))
+	_, err = getSession(cookie3)
+	assert.Check(t, is.Equal(ErrNoSession, err))
+}
+
+func TestMemorySessionStoreExpiry(t *testing.T) {
+	store := &MemorySessionStore{}
+	now := saml.TimeNow()
+	assert.Check(t, store.Put(SessionInfo{ID: "expired", NameID: "alice", Expiry: now.Add(-time.Minute)}, []byte("a")))
+	assert.Check(t, store.Put(SessionInfo{ID: "current", NameID: "alice", Expiry: now.Add(time.Minute)}, []byte("b")))
+
+	_, err := store.Get("expired")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+	data, err := store.Get("current")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("b", string(data)))
+
+	sessions, err := store.List("", "alice")
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual([]SessionInfo{{ID: "current", NameID: "alice", Expiry: now.Add(time.Minute)}}, sessions))
+
+	// expired sessions are discarded when others are stored
+	assert.Check(t, store.Put(SessionInfo{ID: "other", NameID: "bob", Expiry: now.Add(time.Minute)}, []byte("c")))
+	assert.Check(t, is.Len(store.sessions, 2))
+}
+
+func TestMiddlewareRevokesServerSessionsOnLogoutRequest(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	idp, logoutRequest := newIDPLogoutRequest(t, test)
+	store := &MemorySessionStore{}
+	p := NewServerSessionProvider(Options{
+		URL: mustParseURL("https://15661444.ngrok.io/"),
+		Key: test.Key,
+	}, store)
+	test.Middleware.Session = p
+
+	putSession := func(id, issuer, nameID, sessionIndex string) *http.Cookie {
+		session, err := p.Codec.New(&saml.Assertion{Issuer: saml.Issuer{Value: issuer}, Subject: &saml.Subject{NameID: &saml.NameID{Value: nameID}}})
+		assert.Assert(t, err)
+		data, err := p.Codec.Encode(session)
+		assert.Assert(t, err)
+		assert.Check(t, store.Put(SessionInfo{ID: id, Issuer: issuer, NameID: nameID, SessionIndex: sessionIndex, Expiry: saml.TimeNow().Add(time.Hour)}, []byte(data)))
+		return &http.Cookie{Name: p.Name, Value: id}
+	}
+	laptop := putSession("laptop", idp.EntityID, "myself", "index-1")
+	phone := putSession("phone", idp.EntityID, "myself", "index-2")
+	other := putSession("other", idp.EntityID, "someone-else", "index-1")
+	otherIDP := putSession("other-idp", "https://other-idp.example.com/metadata", "myself", "index-1")
+
+	// the IDP sends a LogoutRequest for one session, without the cookie of
+	// the user agent
+	logoutRequest.SessionIndexes = []saml.SessionIndex{{Value: "index-1"}}
+	logoutRequest.Extensions = &saml.Extensions{Asynchronous: &saml.Asynchronous{}}
+	assert.Check(t, idp.SignLogoutRequest(&logoutRequest))
+	req, _ := http.NewRequest("GET", "/saml2/slo?"+logoutRequest.Redirect("").RawQuery, nil)
+	resp := httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+
+	requireAccount := func(cookie *http.Cookie) int {
+		handler := test.Middleware.RequireAccount(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req, _ := http.NewRequest("GET", "/frob", nil)
+		req.AddCookie(cookie)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+	assert.Check(t, is.Equal(http.StatusFound, requireAccount(laptop)))
+	assert.Check(t, is.Equal(http.StatusOK, requireAccount(phone)))
+	assert.Check(t, is.Equal(http.StatusOK, requireAccount(other)))
+	assert.Check(t, is.Equal(http.StatusOK, requireAccount(otherIDP)))
+
+	// without SessionIndexes, all the sessions of the NameID are revoked
+	logoutRequest.SessionIndexes = nil
+	logoutRequest.Signature = nil
+	assert.Check(t, idp.SignLogoutRequest(&logoutRequest))
+	req, _ = http.NewRequest("GET", "/saml2/slo?"+logoutRequest.Redirect("").RawQuery, nil)
+	resp = httptest.NewRecorder()
+	test.Middleware.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, is.Equal(http.StatusFound, requireAccount(phone)))
+	assert.Check(t, is.Equal(http.StatusOK, requireAccount(other)))
+	assert.Check(t, is.Equal(http.StatusOK, requireAccount(otherIDP)))
+}
@@ -0,0 +1,143 @@
+package samlsp
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// DefaultSessionTable is the default name of the table that SQLSessionStore
+// stores sessions in.
+const DefaultSessionTable = "saml_sessions"
+
+// SQLSessionStore is an implementation of SessionStore that stores sessions
+// in a table of a database, so that they can be shared by many processes.
+// The table must have the following columns, which a statement such as
+// this one creates:
+//
+//	CREATE TABLE saml_sessions (
+//		id VARCHAR(64) PRIMARY KEY,
+//		issuer VARCHAR(1024) NOT NULL,
+//		name_id VARCHAR(255) NOT NULL,
+//		session_index VARCHAR(255) NOT NULL,
+//		data TEXT NOT NULL,
+//		expires_at BIGINT NOT NULL
+//	);
+//	CREATE INDEX saml_sessions_name_id ON saml_sessions (issuer, name_id);
+//
+// expires_at holds the expiry of the session in seconds since the epoch.
+// Expired sessions are ignored, and deleted when new sessions are stored.
+type SQLSessionStore struct {
+	DB *sql.DB
+
+	// Table is the name of the table. The default is DefaultSessionTable.
+	Table string
+
+	// Placeholder, if not nil, returns the placeholder of the n-th
+	// parameter of a statement, starting at 1, for drivers that do not
+	// accept "?", such as "$1" for PostgreSQL.
+	Placeholder func(n int) string
+
+	// Context, if not nil, is used for the queries. The default is
+	// context.Background().
+	Context context.Context
+}
+
+var _ SessionStore = (*SQLSessionStore)(nil)
+
+// query returns the statement q with the table name substituted for
+// {table} and the placeholders of the driver for "?".
+func (s *SQLSessionStore) query(q string) string {
+	table := s.Table
+	if table == "" {
+		table = DefaultSessionTable
+	}
+	q = strings.Replace(q, "{table}", table, -1)
+	if s.Placeholder == nil {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString(s.Placeholder(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *SQLSessionStore) context() context.Context {
+	if s.Context == nil {
+		return context.Background()
+	}
+	return s.Context
+}
+
+// Put implements SessionStore. Expired sessions are deleted as a side
+// effect.
+func (s *SQLSessionStore) Put(info SessionInfo, data []byte) error {
+	tx, err := s.DB.BeginTx(s.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(s.context(), s.query("DELETE FROM {table} WHERE id = ? OR expires_at < ?"),
+		info.ID, saml.TimeNow().Unix()); err != nil {
+		return fmt.Errorf("cannot delete sessions: %v", err)
+	}
+	if _, err := tx.ExecContext(s.context(), s.query("INSERT INTO {table} (id, issuer, name_id, session_index, data, expires_at) VALUES (?, ?, ?, ?, ?, ?)"),
+		info.ID, info.Issuer, info.NameID, info.SessionIndex, string(data), info.Expiry.Unix()); err != nil {
+		return fmt.Errorf("cannot store session: %v", err)
+	}
+	return tx.Commit()
+}
+
+// Get implements SessionStore.
+func (s *SQLSessionStore) Get(id string) ([]byte, error) {
+	var data string
+	err := s.DB.QueryRowContext(s.context(), s.query("SELECT data FROM {table} WHERE id = ? AND expires_at >= ?"),
+		id, saml.TimeNow().Unix()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+// Delete implements SessionStore.
+func (s *SQLSessionStore) Delete(id string) error {
+	_, err := s.DB.ExecContext(s.context(), s.query("DELETE FROM {table} WHERE id = ?"), id)
+	return err
+}
+
+// List implements SessionStore.
+func (s *SQLSessionStore) List(issuer, nameID string) ([]SessionInfo, error) {
+	rows, err := s.DB.QueryContext(s.context(), s.query("SELECT id, session_index, expires_at FROM {table} WHERE issuer = ? AND name_id = ? AND expires_at >= ? ORDER BY expires_at"),
+		issuer, nameID, saml.TimeNow().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rv []SessionInfo
+	for rows.Next() {
+		info := SessionInfo{Issuer: issuer, NameID: nameID}
+		var expiresAt int64
+		if err := rows.Scan(&info.ID, &info.SessionIndex, &expiresAt); err != nil {
+			return nil, err
+		}
+		info.Expiry = time.Unix(expiresAt, 0)
+		rv = append(rv, info)
+	}
+	return rv, rows.Err()
+}
@@ -0,0 +1,254 @@
+package samlsp
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	"github.com/crewjam/saml"
+)
+
+// fakeSQLRow is a row of the table of a fakeSQLDB.
+type fakeSQLRow struct {
+	ID           string
+	Issuer       string
+	NameID       string
+	SessionIndex string
+	Data         string
+	ExpiresAt    int64
+}
+
+// fakeSQLDB is a database/sql driver that keeps a single sessions table in
+// memory. It understands only the statements that SQLSessionStore makes,
+// and records them so that tests can check the SQL that is generated.
+type fakeSQLDB struct {
+	mu         sync.Mutex
+	rows       map[string]fakeSQLRow
+	statements []string
+	failInsert bool
+}
+
+func (db *fakeSQLDB) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeSQLConn{db: db}, nil
+}
+func (db *fakeSQLDB) Driver() driver.Driver { return nil }
+
+func (db *fakeSQLDB) exec(query string, args []driver.Value) ([][]driver.Value, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.statements = append(db.statements, query)
+	if db.rows == nil {
+		db.rows = map[string]fakeSQLRow{}
+	}
+
+	switch {
+	case strings.HasPrefix(query, "INSERT"):
+		if db.failInsert {
+			return nil, errors.New("disk full")
+		}
+		id := args[0].(string)
+		if _, ok := db.rows[id]; ok {
+			return nil, fmt.Errorf("duplicate key %q", id)
+		}
+		db.rows[id] = fakeSQLRow{
+			ID:           id,
+			Issuer:       args[1].(string),
+			NameID:       args[2].(string),
+			SessionIndex: args[3].(string),
+			Data:         args[4].(string),
+			ExpiresAt:    args[5].(int64),
+		}
+	case strings.HasPrefix(query, "DELETE") && strings.Contains(query, " OR expires_at < "):
+		for id, row := range db.rows {
+			if id == args[0].(string) || row.ExpiresAt < args[1].(int64) {
+				delete(db.rows, id)
+			}
+		}
+	case strings.HasPrefix(query, "DELETE"):
+		delete(db.rows, args[0].(string))
+	case strings.HasPrefix(query, "SELECT data "):
+		if row, ok := db.rows[args[0].(string)]; ok && row.ExpiresAt >= args[1].(int64) {
+			return [][]driver.Value{{row.Data}}, nil
+		}
+	case strings.HasPrefix(query, "SELECT id, session_index, expires_at "):
+		var rv [][]driver.Value
+		ids := []string{}
+		for id := range db.rows {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return db.rows[ids[i]].ExpiresAt < db.rows[ids[j]].ExpiresAt })
+		for _, id := range ids {
+			row := db.rows[id]
+			if row.Issuer == args[0].(string) && row.NameID == args[1].(string) && row.ExpiresAt >= args[2].(int64) {
+				rv = append(rv, []driver.Value{row.ID, row.SessionIndex, row.ExpiresAt})
+			}
+		}
+		return rv, nil
+	default:
+		return nil, fmt.Errorf("unexpected statement %q", query)
+	}
+	return nil, nil
+}
+
+type fakeSQLConn struct {
+	db       *fakeSQLDB
+	snapshot map[string]fakeSQLRow
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeSQLConn) Close() error { return nil }
+
+// Begin starts a transaction, which is rolled back by restoring a copy of
+// the table.
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.snapshot = map[string]fakeSQLRow{}
+	for id, row := range c.db.rows {
+		c.snapshot[id] = row
+	}
+	return c, nil
+}
+
+func (c *fakeSQLConn) Commit() error {
+	c.snapshot = nil
+	return nil
+}
+
+func (c *fakeSQLConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.rows = c.snapshot
+	c.snapshot = nil
+	return nil
+}
+
+type fakeSQLStmt struct {
+	conn  *fakeSQLConn
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, err := s.conn.db.exec(s.query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.conn.db.exec(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	columns := []string{"data"}
+	if strings.HasPrefix(s.query, "SELECT id, ") {
+		columns = []string{"id", "session_index", "expires_at"}
+	}
+	return &fakeSQLRows{columns: columns, rows: rows}, nil
+}
+
+type fakeSQLRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.columns }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestSQLSessionStore(t *testing.T) {
+	db := &fakeSQLDB{}
+	store := &SQLSessionStore{
+		DB:          sql.OpenDB(db),
+		Table:       "sessions",
+		Placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	}
+	now := saml.TimeNow().Truncate(time.Second)
+	idpA, idpB := "https://idp-a.example.com/metadata", "https://idp-b.example.com/metadata"
+
+	assert.Check(t, store.Put(SessionInfo{ID: "laptop", Issuer: idpA, NameID: "alice", SessionIndex: "index-1", Expiry: now.Add(time.Hour)}, []byte("a")))
+	assert.Check(t, is.DeepEqual([]string{
+		"DELETE FROM sessions WHERE id = $1 OR expires_at < $2",
+		"INSERT INTO sessions (id, issuer, name_id, session_index, data, expires_at) VALUES ($1, $2, $3, $4, $5, $6)",
+	}, db.statements))
+	assert.Check(t, is.DeepEqual(fakeSQLRow{ID: "laptop", Issuer: idpA, NameID: "alice", SessionIndex: "index-1", Data: "a", ExpiresAt: now.Add(time.Hour).Unix()},
+		db.rows["laptop"]))
+
+	// storing a session again replaces it
+	assert.Check(t, store.Put(SessionInfo{ID: "laptop", Issuer: idpA, NameID: "alice", SessionIndex: "index-1", Expiry: now.Add(2 * time.Hour)}, []byte("b")))
+	data, err := store.Get("laptop")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("b", string(data)))
+	assert.Check(t, is.Equal("SELECT data FROM sessions WHERE id = $1 AND expires_at >= $2", db.statements[len(db.statements)-1]))
+	_, err = store.Get("phone")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	// expired sessions are ignored, and deleted when others are stored
+	db.rows["old"] = fakeSQLRow{ID: "old", Issuer: idpA, NameID: "alice", Data: "c", ExpiresAt: now.Add(-time.Minute).Unix()}
+	_, err = store.Get("old")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+	assert.Check(t, store.Put(SessionInfo{ID: "phone", Issuer: idpA, NameID: "alice", SessionIndex: "index-2", Expiry: now.Add(time.Hour)}, []byte("d")))
+	assert.Check(t, store.Put(SessionInfo{ID: "desktop", Issuer: idpA, NameID: "bob", Expiry: now.Add(time.Hour)}, []byte("e")))
+	_, ok := db.rows["old"]
+	assert.Check(t, !ok)
+
+	// the sessions of another IDP's subject with the same NameID are not
+	// listed
+	assert.Check(t, store.Put(SessionInfo{ID: "tablet", Issuer: idpB, NameID: "alice", Expiry: now.Add(time.Hour)}, []byte("f")))
+	sessions, err := store.List(idpA, "alice")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("SELECT id, session_index, expires_at FROM sessions WHERE issuer = $1 AND name_id = $2 AND expires_at >= $3 ORDER BY expires_at",
+		db.statements[len(db.statements)-1]))
+	assert.Check(t, is.DeepEqual([]SessionInfo{
+		{ID: "phone", Issuer: idpA, NameID: "alice", SessionIndex: "index-2", Expiry: now.Add(time.Hour)},
+		{ID: "laptop", Issuer: idpA, NameID: "alice", SessionIndex: "index-1", Expiry: now.Add(2 * time.Hour)},
+	}, sessions))
+
+	assert.Check(t, store.Delete("phone"))
+	assert.Check(t, is.Equal("DELETE FROM sessions WHERE id = $1", db.statements[len(db.statements)-1]))
+	sessions, err = store.List(idpA, "alice")
+	assert.Check(t, err)
+	assert.Check(t, is.Len(sessions, 1))
+
+	// the session is not deleted if the new one cannot be stored
+	db.failInsert = true
+	assert.Check(t, is.ErrorContains(store.Put(SessionInfo{ID: "laptop", Issuer: idpA, NameID: "alice", Expiry: now.Add(time.Hour)}, []byte("g")),
+		"cannot store session: disk full"))
+	data, err = store.Get("laptop")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("b", string(data)))
+}
+
+func TestSQLSessionStoreDefaults(t *testing.T) {
+	db := &fakeSQLDB{}
+	store := &SQLSessionStore{DB: sql.OpenDB(db)}
+	_, err := store.Get("laptop")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+	assert.Check(t, is.DeepEqual([]string{"SELECT data FROM saml_sessions WHERE id = ? AND expires_at >= ?"}, db.statements))
+}
@@ -0,0 +1,140 @@
+package samlsp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+// TenantResolver resolves the tenant that a request is for, and the
+// options of the service provider that serves the tenant.
+type TenantResolver interface {
+	// ResolveTenant returns the ID of the tenant that r is for, typically
+	// determined from its host or path.
+	ResolveTenant(r *http.Request) (tenantID string, err error)
+
+	// TenantOptions returns the options to create the middleware of the
+	// tenant with. Each tenant has its own EntityID, URL, keys and IDP
+	// metadata.
+	TenantOptions(ctx context.Context, tenantID string) (Options, error)
+}
+
+// MultiTenantMiddleware serves many tenants, each with its own service
+// provider, from one handler. The Middleware of each tenant is created
+// the first time the tenant is seen and cached until Forget is called.
+//
+// Request tracking and sessions are isolated per tenant: the tracking
+// cookies and session tokens are signed with the key of the tenant and
+// issued for its URL, and the session cookie of each tenant has its own
+// name, so that tenants that share a host do not replace each other's
+// sessions.
+type MultiTenantMiddleware struct {
+	Tenants TenantResolver
+
+	// NewMiddleware, if not nil, creates the Middleware of a tenant from
+	// its options. The default is New.
+	NewMiddleware func(tenantID string, opts Options) (*Middleware, error)
+
+	// OnError is called when the tenant of a request cannot be resolved.
+	// The default is DefaultOnError.
+	OnError ErrorFunction
+
+	mu          sync.Mutex
+	middlewares map[string]*Middleware
+}
+
+// Middleware returns the Middleware of the tenant that r is for.
+func (mt *MultiTenantMiddleware) Middleware(r *http.Request) (*Middleware, error) {
+	tenantID, err := mt.Tenants.ResolveTenant(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mt.mu.Lock()
+	m, ok := mt.middlewares[tenantID]
+	mt.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+
+	opts, err := mt.Tenants.TenantOptions(r.Context(), tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if mt.NewMiddleware != nil {
+		m, err = mt.NewMiddleware(tenantID, opts)
+	} else {
+		m, err = New(opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sessionProvider, ok := m.Session.(CookieSessionProvider); ok && sessionProvider.Name == defaultSessionCookieName {
+		sessionProvider.Name = tenantSessionCookieName(tenantID)
+		m.Session = sessionProvider
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if existing, ok := mt.middlewares[tenantID]; ok {
+		// another request created it first
+		return existing, nil
+	}
+	if mt.middlewares == nil {
+		mt.middlewares = map[string]*Middleware{}
+	}
+	mt.middlewares[tenantID] = m
+	return m, nil
+}
+
+// Forget discards the cached Middleware of the tenant, so that it is
+// created again from the current options of the tenant when it is next
+// needed.
+func (mt *MultiTenantMiddleware) Forget(tenantID string) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	delete(mt.middlewares, tenantID)
+}
+
+// ServeHTTP implements http.Handler and serves the SAML-specific HTTP
+// endpoints of the tenant that r is for. See Middleware.ServeHTTP.
+func (mt *MultiTenantMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m, err := mt.Middleware(r)
+	if err != nil {
+		mt.onError(w, r, err)
+		return
+	}
+	m.ServeHTTP(w, r)
+}
+
+// RequireAccount is HTTP middleware that requires that each request be
+// associated with a valid session of the tenant it is for. See
+// Middleware.RequireAccount.
+func (mt *MultiTenantMiddleware) RequireAccount(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m, err := mt.Middleware(r)
+		if err != nil {
+			mt.onError(w, r, err)
+			return
+		}
+		m.RequireAccount(handler).ServeHTTP(w, r)
+	})
+}
+
+func (mt *MultiTenantMiddleware) onError(w http.ResponseWriter, r *http.Request, err error) {
+	if mt.OnError != nil {
+		mt.OnError(w, r, err)
+		return
+	}
+	DefaultOnError(w, r, err)
+}
+
+// tenantSessionCookieName returns the name of the session cookie of the
+// tenant. Tenant IDs may contain characters that are not allowed in cookie
+// names, so the name is derived from a hash of the ID.
+func tenantSessionCookieName(tenantID string) string {
+	sum := sha256.Sum256([]byte(tenantID))
+	return defaultSessionCookieName + "_" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,88 @@
+package samlsp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type testTenantResolver struct {
+	test          *MiddlewareTest
+	optionsLoaded int
+}
+
+func (tr *testTenantResolver) ResolveTenant(r *http.Request) (string, error) {
+	tenantID := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]
+	if tenantID != "a" && tenantID != "b" {
+		return "", errors.New("unknown tenant")
+	}
+	return tenantID, nil
+}
+
+func (tr *testTenantResolver) TenantOptions(ctx context.Context, tenantID string) (Options, error) {
+	tr.optionsLoaded++
+	return Options{
+		URL:         mustParseURL("https://sp.example.com/" + tenantID + "/"),
+		Key:         tr.test.Key,
+		Certificate: tr.test.Certificate,
+		IDPMetadata: tr.test.Middleware.ServiceProvider.IDPMetadata,
+	}, nil
+}
+
+func TestMultiTenantMiddleware(t *testing.T) {
+	test := NewMiddlewareTest(t)
+	tenants := &testTenantResolver{test: test}
+	mt := &MultiTenantMiddleware{Tenants: tenants}
+
+	req, _ := http.NewRequest("GET", "/a/saml/metadata", nil)
+	resp := httptest.NewRecorder()
+	mt.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusOK, resp.Code))
+	assert.Check(t, strings.Contains(resp.Body.String(), `entityID="https://sp.example.com/a/saml/metadata"`))
+
+	req, _ = http.NewRequest("GET", "/b/saml/metadata", nil)
+	resp = httptest.NewRecorder()
+	mt.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusOK, resp.Code))
+	assert.Check(t, strings.Contains(resp.Body.String(), `entityID="https://sp.example.com/b/saml/metadata"`))
+
+	// middleware are cached per tenant
+	req, _ = http.NewRequest("GET", "/a/saml/metadata", nil)
+	ma, err := mt.Middleware(req)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(2, tenants.optionsLoaded))
+	mt.Forget("a")
+	ma2, err := mt.Middleware(req)
+	assert.Check(t, err)
+	assert.Check(t, ma != ma2)
+	assert.Check(t, is.Equal(3, tenants.optionsLoaded))
+
+	// sessions and tracked requests are isolated per tenant
+	req, _ = http.NewRequest("GET", "/b/", nil)
+	mb, err := mt.Middleware(req)
+	assert.Check(t, err)
+	assert.Check(t, ma2.Session.(CookieSessionProvider).Name != mb.Session.(CookieSessionProvider).Name)
+	assert.Check(t, is.Equal("/a/saml/acs", ma2.ServiceProvider.AcsURL.Path))
+	assert.Check(t, is.Equal("/b/saml/acs", mb.ServiceProvider.AcsURL.Path))
+
+	handler := mt.RequireAccount(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("not reached")
+	}))
+	req, _ = http.NewRequest("GET", "/b/frob", nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusFound, resp.Code))
+	assert.Check(t, strings.Contains(resp.Header().Get("Set-Cookie"), "Path=/b/saml/acs;"))
+
+	// requests for unknown tenants are rejected
+	req, _ = http.NewRequest("GET", "/c/saml/metadata", nil)
+	resp = httptest.NewRecorder()
+	mt.ServeHTTP(resp, req)
+	assert.Check(t, is.Equal(http.StatusForbidden, resp.Code))
+}
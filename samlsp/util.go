@@ -2,6 +2,7 @@ package samlsp
 
 import (
 	"io"
+	"strings"
 
 	"github.com/crewjam/saml"
 )
@@ -14,3 +15,16 @@ func randomBytes(n int) []byte {
 	}
 	return rv
 }
+
+// isLocalURI reports whether s is a URI on this host that is safe to
+// redirect to, as opposed to one that would make an open redirect. Browsers
+// drop tabs and newlines from URIs, so URIs with control characters are
+// not, lest "/\t/example.com" become "//example.com".
+func isLocalURI(s string) bool {
+	return strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//") && !strings.HasPrefix(s, "/\\") &&
+		strings.IndexFunc(s, isControl) == -1
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"compress/flate"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/beevik/etree"
@@ -13,19 +16,25 @@ import (
 
 // RequestedAuthnContext represents the SAML object of the same name, an indication of the
 // requirements on the authentication process.
+//
+// Comparison is one of "exact" (the default), "minimum", "better" or
+// "maximum", and describes how the authentication context of the assertion
+// must compare to AuthnContextClassRefs.
 type RequestedAuthnContext struct {
-	XMLName              xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequestedAuthnContext"`
-	Comparison           string   `xml:",attr"`
-	AuthnContextClassRef string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+	XMLName               xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequestedAuthnContext"`
+	Comparison            string   `xml:",attr"`
+	AuthnContextClassRefs []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
 }
 
 // Element returns an etree.Element representing the object in XML form.
 func (r *RequestedAuthnContext) Element() *etree.Element {
 	el := etree.NewElement("samlp:RequestedAuthnContext")
 	el.CreateAttr("Comparison", r.Comparison)
-	elContext := etree.NewElement("saml:AuthnContextClassRef")
-	elContext.SetText(r.AuthnContextClassRef)
-	el.AddChild(elContext)
+	for _, classRef := range r.AuthnContextClassRefs {
+		elContext := etree.NewElement("saml:AuthnContextClassRef")
+		elContext.SetText(classRef)
+		el.AddChild(elContext)
+	}
 	return el
 }
 
@@ -43,12 +52,13 @@ type AuthnRequest struct {
 	Consent      string    `xml:",attr"`
 	Issuer       *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
 	Signature    *etree.Element
+	Extensions   *Extensions
 
 	Subject               *Subject
 	NameIDPolicy          *NameIDPolicy `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
 	Conditions            *Conditions
 	RequestedAuthnContext *RequestedAuthnContext
-	//Scoping               *Scoping // TODO
+	Scoping               *Scoping
 
 	ForceAuthn                     *bool  `xml:",attr"`
 	IsPassive                      *bool  `xml:",attr"`
@@ -57,6 +67,12 @@ type AuthnRequest struct {
 	ProtocolBinding                string `xml:",attr"`
 	AttributeConsumingServiceIndex string `xml:",attr"`
 	ProviderName                   string `xml:",attr"`
+
+	// AnyElements and AnyAttrs hold the elements and attributes of the
+	// request that are not modeled above, so that they survive a round
+	// trip.
+	AnyElements []AnyElement `xml:",any"`
+	AnyAttrs    []xml.Attr   `xml:",any,attr"`
 }
 
 // LogoutRequest  represents the SAML object of the same name, a request from an IDP
@@ -71,13 +87,33 @@ type LogoutRequest struct {
 	IssueInstant time.Time  `xml:",attr"`
 	NotOnOrAfter *time.Time `xml:",attr"`
 	Destination  string     `xml:",attr"`
+	Reason       string     `xml:",attr,omitempty"`
 	Issuer       *Issuer    `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
 	NameID       *NameID
+	EncryptedID  *etree.Element `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedID"`
 	Signature    *etree.Element
+	Extensions   *Extensions
+
+	SessionIndexes []SessionIndex `xml:"SessionIndex"`
+}
 
-	SessionIndex *SessionIndex `xml:"SessionIndex"`
+// IsAsynchronous returns true if the request carries the aslo:Asynchronous
+// extension, which indicates that the requester does not expect a
+// LogoutResponse.
+func (r *LogoutRequest) IsAsynchronous() bool {
+	return r.Extensions != nil && r.Extensions.Asynchronous != nil
 }
 
+const (
+	// LogoutReasonUser is the Reason of a LogoutRequest that the principal
+	// requested, for example by choosing to log out.
+	LogoutReasonUser = "urn:oasis:names:tc:SAML:2.0:logout:user"
+
+	// LogoutReasonAdmin is the Reason of a LogoutRequest that an
+	// administrator requested.
+	LogoutReasonAdmin = "urn:oasis:names:tc:SAML:2.0:logout:admin"
+)
+
 // Element returns an etree.Element representing the object in XML form.
 func (r *LogoutRequest) Element() *etree.Element {
 	el := etree.NewElement("samlp:LogoutRequest")
@@ -92,17 +128,26 @@ func (r *LogoutRequest) Element() *etree.Element {
 	if r.Destination != "" {
 		el.CreateAttr("Destination", r.Destination)
 	}
+	if r.Reason != "" {
+		el.CreateAttr("Reason", r.Reason)
+	}
 	if r.Issuer != nil {
 		el.AddChild(r.Issuer.Element())
 	}
 	if r.Signature != nil {
 		el.AddChild(r.Signature)
 	}
+	if r.Extensions != nil {
+		el.AddChild(r.Extensions.Element())
+	}
 	if r.NameID != nil {
 		el.AddChild(r.NameID.Element())
 	}
-	if r.SessionIndex != nil {
-		el.AddChild(r.SessionIndex.Element())
+	if r.EncryptedID != nil {
+		el.AddChild(r.EncryptedID)
+	}
+	for _, sessionIndex := range r.SessionIndexes {
+		el.AddChild(sessionIndex.Element())
 	}
 	return el
 }
@@ -140,6 +185,11 @@ func (r *LogoutRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) err
 	return nil
 }
 
+// SoapRequest returns a SOAP Envelope containing the LogoutRequest request
+func (r *LogoutRequest) SoapRequest() *etree.Element {
+	return soapEnvelope(r.Element())
+}
+
 // Bytes returns a byte array representation of the LogoutRequest
 func (r *LogoutRequest) Bytes() ([]byte, error) {
 	doc := etree.NewDocument()
@@ -197,6 +247,9 @@ func (r *AuthnRequest) Element() *etree.Element {
 	if r.Signature != nil {
 		el.AddChild(r.Signature)
 	}
+	if r.Extensions != nil {
+		el.AddChild(r.Extensions.Element())
+	}
 	if r.Subject != nil {
 		el.AddChild(r.Subject.Element())
 	}
@@ -209,9 +262,9 @@ func (r *AuthnRequest) Element() *etree.Element {
 	if r.RequestedAuthnContext != nil {
 		el.AddChild(r.RequestedAuthnContext.Element())
 	}
-	//if r.Scoping != nil {
-	//	el.AddChild(r.Scoping.Element())
-	//}
+	if r.Scoping != nil {
+		el.AddChild(r.Scoping.Element())
+	}
 	if r.ForceAuthn != nil {
 		el.CreateAttr("ForceAuthn", strconv.FormatBool(*r.ForceAuthn))
 	}
@@ -233,6 +286,7 @@ func (r *AuthnRequest) Element() *etree.Element {
 	if r.ProviderName != "" {
 		el.CreateAttr("ProviderName", r.ProviderName)
 	}
+	addAnyContent(el, r.AnyAttrs, r.AnyElements)
 	return el
 }
 
@@ -262,6 +316,7 @@ func (r *AuthnRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) erro
 		return err
 	}
 	r.IssueInstant = time.Time(aux.IssueInstant)
+	r.AnyAttrs = withoutNamespaceDeclarations(r.AnyAttrs)
 	return nil
 }
 
@@ -321,6 +376,78 @@ func (a *NameIDPolicy) Element() *etree.Element {
 	return el
 }
 
+// Scoping represents the SAML object of the same name, which lets a service
+// provider behind a proxy constrain the identity providers that may
+// authenticate the user and say on whose behalf the request is made.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.4.1.2
+type Scoping struct {
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Scoping"`
+	ProxyCount   *int     `xml:",attr"`
+	IDPList      *IDPList
+	RequesterIDs []string `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequesterID"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (s *Scoping) Element() *etree.Element {
+	el := etree.NewElement("samlp:Scoping")
+	if s.ProxyCount != nil {
+		el.CreateAttr("ProxyCount", strconv.Itoa(*s.ProxyCount))
+	}
+	if s.IDPList != nil {
+		el.AddChild(s.IDPList.Element())
+	}
+	for _, requesterID := range s.RequesterIDs {
+		el.CreateElement("samlp:RequesterID").SetText(requesterID)
+	}
+	return el
+}
+
+// IDPList represents the SAML object of the same name, the identity
+// providers that a requester trusts to authenticate the user.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.4.1.3
+type IDPList struct {
+	XMLName     xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:protocol IDPList"`
+	IDPEntries  []IDPEntry `xml:"urn:oasis:names:tc:SAML:2.0:protocol IDPEntry"`
+	GetComplete string     `xml:"urn:oasis:names:tc:SAML:2.0:protocol GetComplete,omitempty"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (l *IDPList) Element() *etree.Element {
+	el := etree.NewElement("samlp:IDPList")
+	for _, entry := range l.IDPEntries {
+		el.AddChild(entry.Element())
+	}
+	if l.GetComplete != "" {
+		el.CreateElement("samlp:GetComplete").SetText(l.GetComplete)
+	}
+	return el
+}
+
+// IDPEntry represents the SAML object of the same name.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.4.1.3.1
+type IDPEntry struct {
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol IDPEntry"`
+	ProviderID string   `xml:",attr"`
+	Name       string   `xml:",attr,omitempty"`
+	Loc        string   `xml:",attr,omitempty"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (e *IDPEntry) Element() *etree.Element {
+	el := etree.NewElement("samlp:IDPEntry")
+	el.CreateAttr("ProviderID", e.ProviderID)
+	if e.Name != "" {
+		el.CreateAttr("Name", e.Name)
+	}
+	if e.Loc != "" {
+		el.CreateAttr("Loc", e.Loc)
+	}
+	return el
+}
+
 // ArtifactResolve represents the SAML object of the same name.
 type ArtifactResolve struct {
 	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:protocol ArtifactResolve"`
@@ -364,13 +491,7 @@ func (r *ArtifactResolve) Element() *etree.Element {
 
 // SoapRequest returns a SOAP Envelope contining the ArtifactResolve request
 func (r *ArtifactResolve) SoapRequest() *etree.Element {
-	envelope := etree.NewElement("soapenv:Envelope")
-	envelope.CreateAttr("xmlns:soapenv", "http://schemas.xmlsoap.org/soap/envelope/")
-	envelope.CreateAttr("xmlns:xsi", "http://www.w3.org/2001/XMLSchema-instance")
-	body := etree.NewElement("soapenv:Body")
-	envelope.AddChild(body)
-	body.AddChild(r.Element())
-	return envelope
+	return soapEnvelope(r.Element())
 }
 
 // MarshalXML implements xml.Marshaler
@@ -443,7 +564,9 @@ func (r *ArtifactResponse) Element() *etree.Element {
 		el.AddChild(r.Signature)
 	}
 	el.AddChild(r.Status.Element())
-	el.AddChild(r.Response.Element())
+	if r.Response.ID != "" {
+		el.AddChild(r.Response.Element())
+	}
 	return el
 }
 
@@ -489,6 +612,7 @@ type Response struct {
 	Consent      string    `xml:",attr"`
 	Issuer       *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
 	Signature    *etree.Element
+	Extensions   *Extensions
 	Status       Status `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
 
 	// TODO(ross): more than one EncryptedAssertion is allowed
@@ -496,6 +620,12 @@ type Response struct {
 
 	// TODO(ross): more than one Assertion is allowed
 	Assertion *Assertion `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+
+	// AnyElements and AnyAttrs hold the elements and attributes of the
+	// response that are not modeled above, so that they survive a round
+	// trip.
+	AnyElements []AnyElement `xml:",any"`
+	AnyAttrs    []xml.Attr   `xml:",any,attr"`
 }
 
 // Element returns an etree.Element representing the object in XML form.
@@ -531,6 +661,9 @@ func (r *Response) Element() *etree.Element {
 	if r.Signature != nil {
 		el.AddChild(r.Signature)
 	}
+	if r.Extensions != nil {
+		el.AddChild(r.Extensions.Element())
+	}
 	el.AddChild(r.Status.Element())
 	if r.EncryptedAssertion != nil {
 		el.AddChild(r.EncryptedAssertion)
@@ -538,6 +671,7 @@ func (r *Response) Element() *etree.Element {
 	if r.Assertion != nil {
 		el.AddChild(r.Assertion.Element())
 	}
+	addAnyContent(el, r.AnyAttrs, r.AnyElements)
 	return el
 }
 
@@ -567,6 +701,7 @@ func (r *Response) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 		return err
 	}
 	r.IssueInstant = time.Time(aux.IssueInstant)
+	r.AnyAttrs = withoutNamespaceDeclarations(r.AnyAttrs)
 	return nil
 }
 
@@ -736,9 +871,15 @@ type Assertion struct {
 	Conditions   *Conditions
 	// Advice *Advice
 	// Statements []Statement
-	AuthnStatements []AuthnStatement `xml:"AuthnStatement"`
-	// AuthzDecisionStatements []AuthzDecisionStatement
-	AttributeStatements []AttributeStatement `xml:"AttributeStatement"`
+	AuthnStatements         []AuthnStatement         `xml:"AuthnStatement"`
+	AuthzDecisionStatements []AuthzDecisionStatement `xml:"AuthzDecisionStatement"`
+	AttributeStatements     []AttributeStatement     `xml:"AttributeStatement"`
+
+	// AnyElements and AnyAttrs hold the elements and attributes of the
+	// assertion that are not modeled above, such as its Advice, so that
+	// they survive a round trip.
+	AnyElements []AnyElement `xml:",any"`
+	AnyAttrs    []xml.Attr   `xml:",any,attr"`
 }
 
 // Element returns an etree.Element representing the object in XML form.
@@ -761,10 +902,14 @@ func (a *Assertion) Element() *etree.Element {
 	for _, authnStatement := range a.AuthnStatements {
 		el.AddChild(authnStatement.Element())
 	}
+	for _, authzDecisionStatement := range a.AuthzDecisionStatements {
+		el.AddChild(authzDecisionStatement.Element())
+	}
 	for _, attributeStatement := range a.AttributeStatements {
 		el.AddChild(attributeStatement.Element())
 	}
-	err := etreeutils.TransformExcC14n(el, canonicalizerPrefixList)
+	addAnyContent(el, a.AnyAttrs, a.AnyElements)
+	err := etreeutils.TransformExcC14n(el, canonicalizerPrefixList, false)
 	if err != nil {
 		panic(err)
 	}
@@ -784,6 +929,7 @@ func (a *Assertion) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 		return err
 	}
 	a.IssueInstant = time.Time(aux.IssueInstant)
+	a.AnyAttrs = withoutNamespaceDeclarations(a.AnyAttrs)
 	return nil
 }
 
@@ -842,6 +988,266 @@ func (a *NameID) Element() *etree.Element {
 	return el
 }
 
+// AsyncSLONamespace is the namespace of the SAML V2.0 Asynchronous Single
+// Logout Protocol Extension.
+//
+// See http://docs.oasis-open.org/security/saml/Post2.0/saml-async-slo/v1.0/saml-async-slo-v1.0.pdf
+const AsyncSLONamespace = "urn:oasis:names:tc:SAML:2.0:protocol:ext:async-slo"
+
+// Extensions represents the SAML element Extensions.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.2.1
+type Extensions struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Extensions"`
+
+	Asynchronous *Asynchronous
+
+	// Elements are the other extensions, such as those defined by eIDAS,
+	// which are carried as they are. Each element declares the namespaces
+	// that it uses.
+	Elements []*etree.Element
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (e *Extensions) Element() *etree.Element {
+	el := etree.NewElement("samlp:Extensions")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	if e.Asynchronous != nil {
+		el.AddChild(e.Asynchronous.Element())
+	}
+	for _, child := range e.Elements {
+		el.AddChild(child.Copy())
+	}
+	return el
+}
+
+// MarshalXML implements xml.Marshaler
+func (e *Extensions) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "Extensions"}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if e.Asynchronous != nil {
+		if err := enc.Encode(e.Asynchronous); err != nil {
+			return err
+		}
+	}
+	for _, child := range e.Elements {
+		if err := encodeEtreeElement(enc, child); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// UnmarshalXML implements xml.Unmarshaler
+func (e *Extensions) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	e.XMLName = start.Name
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if token.Name.Space == AsyncSLONamespace && token.Name.Local == "Asynchronous" {
+				e.Asynchronous = &Asynchronous{}
+				if err := d.DecodeElement(e.Asynchronous, &token); err != nil {
+					return err
+				}
+				continue
+			}
+			child, err := decodeEtreeElement(d, token, nil)
+			if err != nil {
+				return err
+			}
+			e.Elements = append(e.Elements, child)
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// decodeEtreeElement reads the element that starts with start from d into
+// an etree.Element, which is added to parent unless parent is nil. The
+// element declares its namespace, unless it is the same as the one of
+// parent, and the namespaces of its attributes, so that it stands on its
+// own when it is moved to another document.
+func decodeEtreeElement(d *xml.Decoder, start xml.StartElement, parent *etree.Element) (*etree.Element, error) {
+	el := etree.NewElement(start.Name.Local)
+	if parent == nil || start.Name.Space != elementNamespace(parent) {
+		el.CreateAttr("xmlns", start.Name.Space)
+	}
+	if parent != nil {
+		parent.AddChild(el)
+	}
+
+	for _, attr := range start.Attr {
+		switch {
+		case attr.Name.Space == "xmlns":
+			el.CreateAttr("xmlns:"+attr.Name.Local, attr.Value)
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			// the namespace of the element is declared above
+		case attr.Name.Space == "":
+			el.CreateAttr(attr.Name.Local, attr.Value)
+		case attr.Name.Space == "http://www.w3.org/XML/1998/namespace":
+			el.CreateAttr("xml:"+attr.Name.Local, attr.Value)
+		default:
+			prefix := namespacePrefix(el, attr.Name.Space)
+			if prefix == "" {
+				prefix = fmt.Sprintf("ns%d", len(el.Attr))
+				el.CreateAttr("xmlns:"+prefix, attr.Name.Space)
+			}
+			el.CreateAttr(prefix+":"+attr.Name.Local, attr.Value)
+		}
+	}
+
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if _, err := decodeEtreeElement(d, token, el); err != nil {
+				return nil, err
+			}
+		case xml.CharData:
+			el.CreateCharData(string(token))
+		case xml.Comment:
+			el.CreateComment(string(token))
+		case xml.EndElement:
+			return el, nil
+		}
+	}
+}
+
+// elementNamespace returns the default namespace in scope at el, as
+// declared by decodeEtreeElement.
+func elementNamespace(el *etree.Element) string {
+	for ; el != nil; el = el.Parent() {
+		if attr := el.SelectAttr("xmlns"); attr != nil && attr.Space == "" {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// namespacePrefix returns the prefix that is declared for namespace at el,
+// or an empty string if there is none.
+func namespacePrefix(el *etree.Element, namespace string) string {
+	for ; el != nil; el = el.Parent() {
+		for _, attr := range el.Attr {
+			if attr.Space == "xmlns" && attr.Value == namespace {
+				return attr.Key
+			}
+		}
+	}
+	return ""
+}
+
+// encodeEtreeElement writes el to enc. The names of el and its attributes
+// are written as they are, including their prefixes, so el must declare
+// the namespaces that it uses.
+func encodeEtreeElement(enc *xml.Encoder, el *etree.Element) error {
+	start := xml.StartElement{Name: xml.Name{Local: el.FullTag()}}
+	for _, attr := range el.Attr {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: attr.FullKey()}, Value: attr.Value})
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, token := range el.Child {
+		var err error
+		switch token := token.(type) {
+		case *etree.Element:
+			err = encodeEtreeElement(enc, token)
+		case *etree.CharData:
+			err = enc.EncodeToken(xml.CharData(token.Data))
+		case *etree.Comment:
+			err = enc.EncodeToken(xml.Comment(token.Data))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// AnyElement holds an XML element that is not modeled by the type that
+// contains it, so that it survives being parsed and serialized again.
+type AnyElement struct {
+	Element *etree.Element
+}
+
+// MarshalXML implements xml.Marshaler
+func (a AnyElement) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return encodeEtreeElement(e, a.Element)
+}
+
+// UnmarshalXML implements xml.Unmarshaler
+func (a *AnyElement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	el, err := decodeEtreeElement(d, start, nil)
+	if err != nil {
+		return err
+	}
+	a.Element = el
+	return nil
+}
+
+// withoutNamespaceDeclarations returns attrs without the namespace
+// declarations, which encoding/xml reports as attributes but which are
+// not content of the element.
+func withoutNamespaceDeclarations(attrs []xml.Attr) []xml.Attr {
+	var rv []xml.Attr
+	for _, attr := range attrs {
+		if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+			continue
+		}
+		rv = append(rv, attr)
+	}
+	return rv
+}
+
+// addAnyContent adds the attributes and elements that are not modeled by
+// the type that el represents to el, declaring the namespaces of the
+// attributes as needed.
+func addAnyContent(el *etree.Element, attrs []xml.Attr, elements []AnyElement) {
+	for _, attr := range attrs {
+		switch attr.Name.Space {
+		case "":
+			el.CreateAttr(attr.Name.Local, attr.Value)
+		case "http://www.w3.org/XML/1998/namespace":
+			el.CreateAttr("xml:"+attr.Name.Local, attr.Value)
+		default:
+			prefix := namespacePrefix(el, attr.Name.Space)
+			if prefix == "" {
+				prefix = fmt.Sprintf("ns%d", len(el.Attr))
+				el.CreateAttr("xmlns:"+prefix, attr.Name.Space)
+			}
+			el.CreateAttr(prefix+":"+attr.Name.Local, attr.Value)
+		}
+	}
+	for _, element := range elements {
+		el.AddChild(element.Element.Copy())
+	}
+}
+
+// Asynchronous represents the aslo:Asynchronous extension of a
+// LogoutRequest.
+//
+// See http://docs.oasis-open.org/security/saml/Post2.0/saml-async-slo/v1.0/saml-async-slo-v1.0.pdf §2.1
+type Asynchronous struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol:ext:async-slo Asynchronous"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (a *Asynchronous) Element() *etree.Element {
+	el := etree.NewElement("aslo:Asynchronous")
+	el.CreateAttr("xmlns:aslo", AsyncSLONamespace)
+	return el
+}
+
 // SessionIndex represents the SAML element SessionIndex.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.7.1
@@ -886,12 +1292,16 @@ func (a *SubjectConfirmation) Element() *etree.Element {
 // SubjectConfirmationData represents the SAML element SubjectConfirmationData.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.4.1.2
+//
+// KeyInfos holds the keys of a holder-of-key confirmation, in which case the
+// element is of the KeyInfoConfirmationDataType (§2.4.1.3).
 type SubjectConfirmationData struct {
 	NotBefore    time.Time `xml:",attr"`
 	NotOnOrAfter time.Time `xml:",attr"`
 	Recipient    string    `xml:",attr"`
 	InResponseTo string    `xml:",attr"`
 	Address      string    `xml:",attr"`
+	KeyInfos     []KeyInfo `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
 }
 
 // Element returns an etree.Element representing the object in XML form.
@@ -912,6 +1322,18 @@ func (s *SubjectConfirmationData) Element() *etree.Element {
 	if s.Address != "" {
 		el.CreateAttr("Address", s.Address)
 	}
+	if len(s.KeyInfos) > 0 {
+		el.CreateAttr("xmlns:xsi", "http://www.w3.org/2001/XMLSchema-instance")
+		el.CreateAttr("xsi:type", "saml:KeyInfoConfirmationDataType")
+	}
+	for _, keyInfo := range s.KeyInfos {
+		keyInfoEl := el.CreateElement("ds:KeyInfo")
+		keyInfoEl.CreateAttr("xmlns:ds", "http://www.w3.org/2000/09/xmldsig#")
+		x509DataEl := keyInfoEl.CreateElement("ds:X509Data")
+		for _, cert := range keyInfo.X509Data.X509Certificates {
+			x509DataEl.CreateElement("ds:X509Certificate").SetText(cert.Data)
+		}
+	}
 	return el
 }
 
@@ -953,6 +1375,16 @@ type Conditions struct {
 	AudienceRestrictions []AudienceRestriction `xml:"AudienceRestriction"`
 	OneTimeUse           *OneTimeUse
 	ProxyRestriction     *ProxyRestriction
+
+	// DelegationRestriction is the Condition of DelegationRestrictionType,
+	// if any, that lists the chain of delegates through which the assertion
+	// was issued.
+	DelegationRestriction *DelegationRestriction `xml:"-"`
+
+	// AnyElements hold the conditions that are not modeled above, such as
+	// Condition elements of custom types, so that they survive a round
+	// trip.
+	AnyElements []AnyElement `xml:",any"`
 }
 
 // Element returns an etree.Element representing the object in XML form.
@@ -973,12 +1405,20 @@ func (c *Conditions) Element() *etree.Element {
 	if c.ProxyRestriction != nil {
 		el.AddChild(c.ProxyRestriction.Element())
 	}
+	if c.DelegationRestriction != nil {
+		el.AddChild(c.DelegationRestriction.Element())
+	}
+	addAnyContent(el, nil, c.AnyElements)
 	return el
 }
 
 // MarshalXML implements xml.Marshaler
 func (c *Conditions) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
 	type Alias Conditions
+	alias := Alias(*c)
+	if c.DelegationRestriction != nil {
+		alias.AnyElements = append([]AnyElement{{Element: c.DelegationRestriction.Element()}}, c.AnyElements...)
+	}
 	aux := &struct {
 		NotBefore    RelaxedTime `xml:",attr"`
 		NotOnOrAfter RelaxedTime `xml:",attr"`
@@ -986,7 +1426,7 @@ func (c *Conditions) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
 	}{
 		NotBefore:    RelaxedTime(c.NotBefore),
 		NotOnOrAfter: RelaxedTime(c.NotOnOrAfter),
-		Alias:        (*Alias)(c),
+		Alias:        &alias,
 	}
 	return e.EncodeElement(aux, start)
 }
@@ -1006,6 +1446,27 @@ func (c *Conditions) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error
 	}
 	c.NotBefore = time.Time(aux.NotBefore)
 	c.NotOnOrAfter = time.Time(aux.NotOnOrAfter)
+
+	// the delegation restriction is a Condition of a custom type, which
+	// encoding/xml cannot select by its xsi:type
+	anyElements := c.AnyElements[:0]
+	for _, anyElement := range c.AnyElements {
+		if !isDelegationRestriction(anyElement.Element) {
+			anyElements = append(anyElements, anyElement)
+			continue
+		}
+		if c.DelegationRestriction != nil {
+			return errors.New("Conditions contains more than one DelegationRestriction")
+		}
+		c.DelegationRestriction = &DelegationRestriction{}
+		if err := unmarshalEtreeHack(anyElement.Element.Copy(), c.DelegationRestriction); err != nil {
+			return err
+		}
+	}
+	if len(anyElements) == 0 {
+		anyElements = nil
+	}
+	c.AnyElements = anyElements
 	return nil
 }
 
@@ -1051,8 +1512,8 @@ func (a *OneTimeUse) Element() *etree.Element {
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.5.1.6
 type ProxyRestriction struct {
-	Count     *int
-	Audiences []Audience
+	Count     *int       `xml:",attr"`
+	Audiences []Audience `xml:"Audience"`
 }
 
 // Element returns an etree.Element representing the object in XML form.
@@ -1067,6 +1528,111 @@ func (a *ProxyRestriction) Element() *etree.Element {
 	return el
 }
 
+// DelegationNamespace is the name space of the SAML V2.0 Condition for
+// Delegation Restriction.
+const DelegationNamespace = "urn:oasis:names:tc:SAML:2.0:conditions:delegation"
+
+// DelegationRestriction represents a SAML Condition of type
+// del:DelegationRestrictionType. Delegates lists the parties through which
+// the assertion was issued, in the order in which they acted.
+//
+// See http://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-delegation-cs-01.pdf §2
+type DelegationRestriction struct {
+	Delegates []Delegate `xml:"urn:oasis:names:tc:SAML:2.0:conditions:delegation Delegate"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (a *DelegationRestriction) Element() *etree.Element {
+	el := etree.NewElement("saml:Condition")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:xsi", "http://www.w3.org/2001/XMLSchema-instance")
+	el.CreateAttr("xmlns:del", DelegationNamespace)
+	el.CreateAttr("xsi:type", "del:DelegationRestrictionType")
+	for _, v := range a.Delegates {
+		el.AddChild(v.Element())
+	}
+	return el
+}
+
+// isDelegationRestriction returns true if el is a Condition of type
+// del:DelegationRestrictionType. The prefix of the type is not resolved, as
+// its declaration may be on an ancestor of el that is no longer available.
+func isDelegationRestriction(el *etree.Element) bool {
+	if el.Tag != "Condition" {
+		return false
+	}
+	for _, attr := range el.Attr {
+		if attr.Key != "type" || attr.Space == "" {
+			continue
+		}
+		value := attr.Value
+		if i := strings.IndexByte(value, ':'); i >= 0 {
+			value = value[i+1:]
+		}
+		return value == "DelegationRestrictionType"
+	}
+	return false
+}
+
+// Delegate represents the element del:Delegate, which identifies a party
+// that acted on behalf of the subject of an assertion.
+//
+// See http://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-delegation-cs-01.pdf §2.1
+type Delegate struct {
+	DelegationInstant  time.Time `xml:",attr"`
+	ConfirmationMethod string    `xml:",attr"`
+	// BaseID               *BaseID  ... TODO
+	NameID *NameID `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	// EncryptedID          *EncryptedID  ... TODO
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (a *Delegate) Element() *etree.Element {
+	el := etree.NewElement("del:Delegate")
+	if !a.DelegationInstant.IsZero() {
+		el.CreateAttr("DelegationInstant", a.DelegationInstant.Format(timeFormat))
+	}
+	if a.ConfirmationMethod != "" {
+		el.CreateAttr("ConfirmationMethod", a.ConfirmationMethod)
+	}
+	if a.NameID != nil {
+		el.AddChild(a.NameID.Element())
+	}
+	return el
+}
+
+// MarshalXML implements xml.Marshaler
+func (a *Delegate) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type Alias Delegate
+	aux := &struct {
+		DelegationInstant *RelaxedTime `xml:",attr,omitempty"`
+		*Alias
+	}{
+		Alias: (*Alias)(a),
+	}
+	if !a.DelegationInstant.IsZero() {
+		delegationInstant := RelaxedTime(a.DelegationInstant)
+		aux.DelegationInstant = &delegationInstant
+	}
+	return e.EncodeElement(aux, start)
+}
+
+// UnmarshalXML implements xml.Unmarshaler
+func (a *Delegate) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias Delegate
+	aux := &struct {
+		DelegationInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		Alias: (*Alias)(a),
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	a.DelegationInstant = time.Time(aux.DelegationInstant)
+	return nil
+}
+
 // AuthnStatement represents the SAML element AuthnStatement.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.7.2
@@ -1181,6 +1747,58 @@ func (a *AuthnContextClassRef) Element() *etree.Element {
 	return el
 }
 
+// Values of the Decision attribute of an AuthzDecisionStatement.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.7.4.1
+const (
+	// DecisionPermit means the specified action is permitted.
+	DecisionPermit = "Permit"
+
+	// DecisionDeny means the specified action is denied.
+	DecisionDeny = "Deny"
+
+	// DecisionIndeterminate means the SAML authority cannot determine whether
+	// the specified action is permitted or denied.
+	DecisionIndeterminate = "Indeterminate"
+)
+
+// AuthzDecisionStatement represents the SAML element AuthzDecisionStatement.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.7.4
+type AuthzDecisionStatement struct {
+	Resource string   `xml:",attr"`
+	Decision string   `xml:",attr"`
+	Actions  []Action `xml:"urn:oasis:names:tc:SAML:2.0:assertion Action"`
+	// Evidence *Evidence ... TODO
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (a *AuthzDecisionStatement) Element() *etree.Element {
+	el := etree.NewElement("saml:AuthzDecisionStatement")
+	el.CreateAttr("Resource", a.Resource)
+	el.CreateAttr("Decision", a.Decision)
+	for _, v := range a.Actions {
+		el.AddChild(v.Element())
+	}
+	return el
+}
+
+// Action represents the SAML element Action.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.7.4.2
+type Action struct {
+	Namespace string `xml:",attr"`
+	Value     string `xml:",chardata"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (a *Action) Element() *etree.Element {
+	el := etree.NewElement("saml:Action")
+	el.CreateAttr("Namespace", a.Namespace)
+	el.SetText(a.Value)
+	return el
+}
+
 // AttributeStatement represents the SAML element AttributeStatement.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §2.7.3
@@ -1319,3 +1937,615 @@ func (r *LogoutResponse) UnmarshalXML(d *xml.Decoder, start xml.StartElement) er
 	r.IssueInstant = time.Time(aux.IssueInstant)
 	return nil
 }
+
+// AttributeQuery represents the SAML object of the same name, a request from a
+// service provider to an attribute authority for attributes of a subject.
+//
+// Each entry in Attributes names an attribute being requested. If an entry
+// carries Values, the attribute authority must only return the attribute if it
+// has one of those values, and must not return any other values.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.3.2.3
+type AttributeQuery struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AttributeQuery"`
+
+	ID           string    `xml:",attr"`
+	Version      string    `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Destination  string    `xml:",attr"`
+	Consent      string    `xml:",attr"`
+	Issuer       *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature    *etree.Element
+	Subject      *Subject    `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+	Attributes   []Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (r *AttributeQuery) Element() *etree.Element {
+	el := etree.NewElement("samlp:AttributeQuery")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", r.ID)
+	el.CreateAttr("Version", r.Version)
+	el.CreateAttr("IssueInstant", r.IssueInstant.Format(timeFormat))
+	if r.Destination != "" {
+		el.CreateAttr("Destination", r.Destination)
+	}
+	if r.Consent != "" {
+		el.CreateAttr("Consent", r.Consent)
+	}
+	if r.Issuer != nil {
+		el.AddChild(r.Issuer.Element())
+	}
+	if r.Signature != nil {
+		el.AddChild(r.Signature)
+	}
+	if r.Subject != nil {
+		el.AddChild(r.Subject.Element())
+	}
+	for _, v := range r.Attributes {
+		el.AddChild(v.Element())
+	}
+	return el
+}
+
+// SoapRequest returns a SOAP Envelope containing the AttributeQuery request
+func (r *AttributeQuery) SoapRequest() *etree.Element {
+	return soapEnvelope(r.Element())
+}
+
+// MarshalXML implements xml.Marshaler
+func (r *AttributeQuery) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type Alias AttributeQuery
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		IssueInstant: RelaxedTime(r.IssueInstant),
+		Alias:        (*Alias)(r),
+	}
+	return e.Encode(aux)
+}
+
+// UnmarshalXML implements xml.Unmarshaler
+func (r *AttributeQuery) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias AttributeQuery
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		Alias: (*Alias)(r),
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	r.IssueInstant = time.Time(aux.IssueInstant)
+	return nil
+}
+
+// AuthzDecisionQuery represents the SAML object of the same name, a request
+// to a policy decision point asking whether the subject may perform Actions on
+// Resource.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.3.2.4
+type AuthzDecisionQuery struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthzDecisionQuery"`
+
+	ID           string    `xml:",attr"`
+	Version      string    `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Destination  string    `xml:",attr"`
+	Consent      string    `xml:",attr"`
+	Resource     string    `xml:",attr"`
+	Issuer       *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature    *etree.Element
+	Subject      *Subject `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+	Actions      []Action `xml:"urn:oasis:names:tc:SAML:2.0:assertion Action"`
+	// Evidence *Evidence ... TODO
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (r *AuthzDecisionQuery) Element() *etree.Element {
+	el := etree.NewElement("samlp:AuthzDecisionQuery")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", r.ID)
+	el.CreateAttr("Version", r.Version)
+	el.CreateAttr("IssueInstant", r.IssueInstant.Format(timeFormat))
+	if r.Destination != "" {
+		el.CreateAttr("Destination", r.Destination)
+	}
+	if r.Consent != "" {
+		el.CreateAttr("Consent", r.Consent)
+	}
+	el.CreateAttr("Resource", r.Resource)
+	if r.Issuer != nil {
+		el.AddChild(r.Issuer.Element())
+	}
+	if r.Signature != nil {
+		el.AddChild(r.Signature)
+	}
+	if r.Subject != nil {
+		el.AddChild(r.Subject.Element())
+	}
+	for _, v := range r.Actions {
+		el.AddChild(v.Element())
+	}
+	return el
+}
+
+// SoapRequest returns a SOAP Envelope containing the AuthzDecisionQuery request
+func (r *AuthzDecisionQuery) SoapRequest() *etree.Element {
+	return soapEnvelope(r.Element())
+}
+
+// MarshalXML implements xml.Marshaler
+func (r *AuthzDecisionQuery) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type Alias AuthzDecisionQuery
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		IssueInstant: RelaxedTime(r.IssueInstant),
+		Alias:        (*Alias)(r),
+	}
+	return e.Encode(aux)
+}
+
+// UnmarshalXML implements xml.Unmarshaler
+func (r *AuthzDecisionQuery) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias AuthzDecisionQuery
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		Alias: (*Alias)(r),
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	r.IssueInstant = time.Time(aux.IssueInstant)
+	return nil
+}
+
+// AuthnQuery represents the SAML object of the same name, a request to an
+// authentication authority for assertions about existing authentication
+// sessions of the subject.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.3.2.2
+type AuthnQuery struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnQuery"`
+
+	ID                    string    `xml:",attr"`
+	Version               string    `xml:",attr"`
+	IssueInstant          time.Time `xml:",attr"`
+	Destination           string    `xml:",attr"`
+	Consent               string    `xml:",attr"`
+	SessionIndex          string    `xml:",attr"`
+	Issuer                *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature             *etree.Element
+	Subject               *Subject `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+	RequestedAuthnContext *RequestedAuthnContext
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (r *AuthnQuery) Element() *etree.Element {
+	el := etree.NewElement("samlp:AuthnQuery")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", r.ID)
+	el.CreateAttr("Version", r.Version)
+	el.CreateAttr("IssueInstant", r.IssueInstant.Format(timeFormat))
+	if r.Destination != "" {
+		el.CreateAttr("Destination", r.Destination)
+	}
+	if r.Consent != "" {
+		el.CreateAttr("Consent", r.Consent)
+	}
+	if r.SessionIndex != "" {
+		el.CreateAttr("SessionIndex", r.SessionIndex)
+	}
+	if r.Issuer != nil {
+		el.AddChild(r.Issuer.Element())
+	}
+	if r.Signature != nil {
+		el.AddChild(r.Signature)
+	}
+	if r.Subject != nil {
+		el.AddChild(r.Subject.Element())
+	}
+	if r.RequestedAuthnContext != nil {
+		el.AddChild(r.RequestedAuthnContext.Element())
+	}
+	return el
+}
+
+// SoapRequest returns a SOAP Envelope containing the AuthnQuery request
+func (r *AuthnQuery) SoapRequest() *etree.Element {
+	return soapEnvelope(r.Element())
+}
+
+// MarshalXML implements xml.Marshaler
+func (r *AuthnQuery) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type Alias AuthnQuery
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		IssueInstant: RelaxedTime(r.IssueInstant),
+		Alias:        (*Alias)(r),
+	}
+	return e.Encode(aux)
+}
+
+// UnmarshalXML implements xml.Unmarshaler
+func (r *AuthnQuery) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias AuthnQuery
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		Alias: (*Alias)(r),
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	r.IssueInstant = time.Time(aux.IssueInstant)
+	return nil
+}
+
+// NameIDMappingRequest represents the SAML object of the same name, a request
+// to map the name identifier of a principal into a different format or
+// namespace.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.8.1
+type NameIDMappingRequest struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDMappingRequest"`
+
+	ID           string    `xml:",attr"`
+	Version      string    `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Destination  string    `xml:",attr"`
+	Consent      string    `xml:",attr"`
+	Issuer       *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature    *etree.Element
+	NameID       *NameID        `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	EncryptedID  *etree.Element `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedID"`
+	NameIDPolicy *NameIDPolicy  `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (r *NameIDMappingRequest) Element() *etree.Element {
+	el := etree.NewElement("samlp:NameIDMappingRequest")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", r.ID)
+	el.CreateAttr("Version", r.Version)
+	el.CreateAttr("IssueInstant", r.IssueInstant.Format(timeFormat))
+	if r.Destination != "" {
+		el.CreateAttr("Destination", r.Destination)
+	}
+	if r.Consent != "" {
+		el.CreateAttr("Consent", r.Consent)
+	}
+	if r.Issuer != nil {
+		el.AddChild(r.Issuer.Element())
+	}
+	if r.Signature != nil {
+		el.AddChild(r.Signature)
+	}
+	if r.NameID != nil {
+		el.AddChild(r.NameID.Element())
+	}
+	if r.EncryptedID != nil {
+		el.AddChild(r.EncryptedID)
+	}
+	if r.NameIDPolicy != nil {
+		el.AddChild(r.NameIDPolicy.Element())
+	}
+	return el
+}
+
+// SoapRequest returns a SOAP Envelope containing the NameIDMappingRequest request
+func (r *NameIDMappingRequest) SoapRequest() *etree.Element {
+	return soapEnvelope(r.Element())
+}
+
+// MarshalXML implements xml.Marshaler
+func (r *NameIDMappingRequest) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type Alias NameIDMappingRequest
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		IssueInstant: RelaxedTime(r.IssueInstant),
+		Alias:        (*Alias)(r),
+	}
+	return e.Encode(aux)
+}
+
+// UnmarshalXML implements xml.Unmarshaler
+func (r *NameIDMappingRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias NameIDMappingRequest
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		Alias: (*Alias)(r),
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	r.IssueInstant = time.Time(aux.IssueInstant)
+	return nil
+}
+
+// NameIDMappingResponse represents the SAML object of the same name, the
+// response to a NameIDMappingRequest.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.8.2
+type NameIDMappingResponse struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDMappingResponse"`
+
+	ID           string    `xml:",attr"`
+	InResponseTo string    `xml:",attr"`
+	Version      string    `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Destination  string    `xml:",attr"`
+	Consent      string    `xml:",attr"`
+	Issuer       *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature    *etree.Element
+	Status       Status         `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	NameID       *NameID        `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	EncryptedID  *etree.Element `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedID"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (r *NameIDMappingResponse) Element() *etree.Element {
+	el := etree.NewElement("samlp:NameIDMappingResponse")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", r.ID)
+	if r.InResponseTo != "" {
+		el.CreateAttr("InResponseTo", r.InResponseTo)
+	}
+	el.CreateAttr("Version", r.Version)
+	el.CreateAttr("IssueInstant", r.IssueInstant.Format(timeFormat))
+	if r.Destination != "" {
+		el.CreateAttr("Destination", r.Destination)
+	}
+	if r.Consent != "" {
+		el.CreateAttr("Consent", r.Consent)
+	}
+	if r.Issuer != nil {
+		el.AddChild(r.Issuer.Element())
+	}
+	if r.Signature != nil {
+		el.AddChild(r.Signature)
+	}
+	el.AddChild(r.Status.Element())
+	if r.NameID != nil {
+		el.AddChild(r.NameID.Element())
+	}
+	if r.EncryptedID != nil {
+		el.AddChild(r.EncryptedID)
+	}
+	return el
+}
+
+// MarshalXML implements xml.Marshaler
+func (r *NameIDMappingResponse) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type Alias NameIDMappingResponse
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		IssueInstant: RelaxedTime(r.IssueInstant),
+		Alias:        (*Alias)(r),
+	}
+	return e.Encode(aux)
+}
+
+// UnmarshalXML implements xml.Unmarshaler
+func (r *NameIDMappingResponse) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias NameIDMappingResponse
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		Alias: (*Alias)(r),
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	r.IssueInstant = time.Time(aux.IssueInstant)
+	return nil
+}
+
+// ManageNameIDRequest represents the SAML object of the same name, a request
+// to change the name identifier of a principal or to terminate its use.
+//
+// Exactly one of NewID, NewEncryptedID and Terminate should be set.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.6.1
+type ManageNameIDRequest struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol ManageNameIDRequest"`
+
+	ID             string    `xml:",attr"`
+	Version        string    `xml:",attr"`
+	IssueInstant   time.Time `xml:",attr"`
+	Destination    string    `xml:",attr"`
+	Consent        string    `xml:",attr"`
+	Issuer         *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature      *etree.Element
+	NameID         *NameID        `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	EncryptedID    *etree.Element `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedID"`
+	NewID          string         `xml:"urn:oasis:names:tc:SAML:2.0:protocol NewID"`
+	NewEncryptedID *etree.Element `xml:"urn:oasis:names:tc:SAML:2.0:protocol NewEncryptedID"`
+	Terminate      *Terminate
+}
+
+// Terminate represents the SAML element Terminate, which indicates that the
+// name identifier in a ManageNameIDRequest should no longer be used.
+type Terminate struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Terminate"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (r *ManageNameIDRequest) Element() *etree.Element {
+	el := etree.NewElement("samlp:ManageNameIDRequest")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", r.ID)
+	el.CreateAttr("Version", r.Version)
+	el.CreateAttr("IssueInstant", r.IssueInstant.Format(timeFormat))
+	if r.Destination != "" {
+		el.CreateAttr("Destination", r.Destination)
+	}
+	if r.Consent != "" {
+		el.CreateAttr("Consent", r.Consent)
+	}
+	if r.Issuer != nil {
+		el.AddChild(r.Issuer.Element())
+	}
+	if r.Signature != nil {
+		el.AddChild(r.Signature)
+	}
+	if r.NameID != nil {
+		el.AddChild(r.NameID.Element())
+	}
+	if r.EncryptedID != nil {
+		el.AddChild(r.EncryptedID)
+	}
+	if r.NewID != "" {
+		newIDEl := etree.NewElement("samlp:NewID")
+		newIDEl.SetText(r.NewID)
+		el.AddChild(newIDEl)
+	}
+	if r.NewEncryptedID != nil {
+		el.AddChild(r.NewEncryptedID)
+	}
+	if r.Terminate != nil {
+		el.AddChild(etree.NewElement("samlp:Terminate"))
+	}
+	return el
+}
+
+// SoapRequest returns a SOAP Envelope containing the ManageNameIDRequest request
+func (r *ManageNameIDRequest) SoapRequest() *etree.Element {
+	return soapEnvelope(r.Element())
+}
+
+// MarshalXML implements xml.Marshaler
+func (r *ManageNameIDRequest) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type Alias ManageNameIDRequest
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		IssueInstant: RelaxedTime(r.IssueInstant),
+		Alias:        (*Alias)(r),
+	}
+	return e.Encode(aux)
+}
+
+// UnmarshalXML implements xml.Unmarshaler
+func (r *ManageNameIDRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias ManageNameIDRequest
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		Alias: (*Alias)(r),
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	r.IssueInstant = time.Time(aux.IssueInstant)
+	return nil
+}
+
+// ManageNameIDResponse represents the SAML object of the same name, the
+// response to a ManageNameIDRequest.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf §3.6.2
+type ManageNameIDResponse struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol ManageNameIDResponse"`
+
+	ID           string    `xml:",attr"`
+	InResponseTo string    `xml:",attr"`
+	Version      string    `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Destination  string    `xml:",attr"`
+	Consent      string    `xml:",attr"`
+	Issuer       *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature    *etree.Element
+	Status       Status `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (r *ManageNameIDResponse) Element() *etree.Element {
+	el := etree.NewElement("samlp:ManageNameIDResponse")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", r.ID)
+	if r.InResponseTo != "" {
+		el.CreateAttr("InResponseTo", r.InResponseTo)
+	}
+	el.CreateAttr("Version", r.Version)
+	el.CreateAttr("IssueInstant", r.IssueInstant.Format(timeFormat))
+	if r.Destination != "" {
+		el.CreateAttr("Destination", r.Destination)
+	}
+	if r.Consent != "" {
+		el.CreateAttr("Consent", r.Consent)
+	}
+	if r.Issuer != nil {
+		el.AddChild(r.Issuer.Element())
+	}
+	if r.Signature != nil {
+		el.AddChild(r.Signature)
+	}
+	el.AddChild(r.Status.Element())
+	return el
+}
+
+// MarshalXML implements xml.Marshaler
+func (r *ManageNameIDResponse) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type Alias ManageNameIDResponse
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		IssueInstant: RelaxedTime(r.IssueInstant),
+		Alias:        (*Alias)(r),
+	}
+	return e.Encode(aux)
+}
+
+// UnmarshalXML implements xml.Unmarshaler
+func (r *ManageNameIDResponse) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias ManageNameIDResponse
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		Alias: (*Alias)(r),
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	r.IssueInstant = time.Time(aux.IssueInstant)
+	return nil
+}
+
+// soapEnvelope returns a SOAP Envelope whose Body contains el.
+func soapEnvelope(el *etree.Element) *etree.Element {
+	envelope := etree.NewElement("soapenv:Envelope")
+	envelope.CreateAttr("xmlns:soapenv", "http://schemas.xmlsoap.org/soap/envelope/")
+	envelope.CreateAttr("xmlns:xsi", "http://www.w3.org/2001/XMLSchema-instance")
+	body := etree.NewElement("soapenv:Body")
+	envelope.AddChild(body)
+	body.AddChild(el)
+	return envelope
+}
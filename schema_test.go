@@ -98,14 +98,85 @@ func TestAuthnStatementMarshalWithoutSessionNotOnOrAfter(t *testing.T) {
 func TestRequestedAuthnContext(t *testing.T) {
 	expected := RequestedAuthnContext{
 		Comparison: "comparison",
+		AuthnContextClassRefs: []string{
+			"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+			"urn:oasis:names:tc:SAML:2.0:ac:classes:X509",
+		},
 	}
 
 	doc := etree.NewDocument()
 	doc.SetRoot(expected.Element())
 	x, err := doc.WriteToBytes()
 	assert.Check(t, err)
-	assert.Check(t, is.Equal(`<samlp:RequestedAuthnContext Comparison="comparison"><saml:AuthnContextClassRef/></samlp:RequestedAuthnContext>`,
+	assert.Check(t, is.Equal(`<samlp:RequestedAuthnContext Comparison="comparison">`+
+		`<saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef>`+
+		`<saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:X509</saml:AuthnContextClassRef>`+
+		`</samlp:RequestedAuthnContext>`,
+		string(x)))
+
+	actual := RequestedAuthnContext{}
+	err = xml.Unmarshal([]byte(`<samlp:RequestedAuthnContext xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" Comparison="comparison">`+
+		`<saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef>`+
+		`<saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:X509</saml:AuthnContextClassRef>`+
+		`</samlp:RequestedAuthnContext>`), &actual)
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(expected.AuthnContextClassRefs, actual.AuthnContextClassRefs))
+}
+
+func TestAuthnRequestScopingXMLRoundTrip(t *testing.T) {
+	proxyCount := 2
+	expected := Scoping{
+		XMLName:    xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "Scoping"},
+		ProxyCount: &proxyCount,
+		IDPList: &IDPList{
+			XMLName: xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "IDPList"},
+			IDPEntries: []IDPEntry{
+				{
+					XMLName:    xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "IDPEntry"},
+					ProviderID: "https://idp.example.com/",
+					Name:       "Example",
+				},
+				{
+					XMLName:    xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:protocol", Local: "IDPEntry"},
+					ProviderID: "https://idp.example.org/",
+					Loc:        "https://idp.example.org/sso",
+				},
+			},
+			GetComplete: "https://proxy.example.com/idps",
+		},
+		RequesterIDs: []string{"https://sp.example.com/"},
+	}
+	request := AuthnRequest{
+		ID:           "request-id",
+		Version:      "2.0",
+		IssueInstant: time.Date(2021, 10, 8, 12, 30, 0, 0, time.UTC),
+		Scoping:      &expected,
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(request.Element())
+	x, err := doc.WriteToBytes()
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(`<samlp:AuthnRequest xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="request-id" Version="2.0" IssueInstant="2021-10-08T12:30:00Z">`+
+		`<samlp:Scoping ProxyCount="2"><samlp:IDPList>`+
+		`<samlp:IDPEntry ProviderID="https://idp.example.com/" Name="Example"/>`+
+		`<samlp:IDPEntry ProviderID="https://idp.example.org/" Loc="https://idp.example.org/sso"/>`+
+		`<samlp:GetComplete>https://proxy.example.com/idps</samlp:GetComplete>`+
+		`</samlp:IDPList><samlp:RequesterID>https://sp.example.com/</samlp:RequesterID></samlp:Scoping>`+
+		`</samlp:AuthnRequest>`,
 		string(x)))
+
+	var actual AuthnRequest
+	err = xml.Unmarshal(x, &actual)
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(&expected, actual.Scoping))
+
+	x, err = xml.Marshal(request)
+	assert.Check(t, err)
+	actual = AuthnRequest{}
+	err = xml.Unmarshal(x, &actual)
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(&expected, actual.Scoping))
 }
 
 func TestArtifactResolveElement(t *testing.T) {
@@ -221,8 +292,8 @@ func TestLogoutRequestXMLRoundTrip(t *testing.T) {
 		NameID: &NameID{
 			Value: "name-id",
 		},
-		SessionIndex: &SessionIndex{
-			Value: "index",
+		SessionIndexes: []SessionIndex{
+			{Value: "index"},
 		},
 	}
 
@@ -260,8 +331,8 @@ func TestLogoutRequestMarshalWithoutNotOnOrAfter(t *testing.T) {
 		NameID: &NameID{
 			Value: "name-id",
 		},
-		SessionIndex: &SessionIndex{
-			Value: "index",
+		SessionIndexes: []SessionIndex{
+			{Value: "index"},
 		},
 	}
 
@@ -277,3 +348,254 @@ func TestLogoutRequestMarshalWithoutNotOnOrAfter(t *testing.T) {
 	assert.Check(t, err)
 	assert.Check(t, is.DeepEqual(expected, actual))
 }
+
+func TestLogoutRequestMarshalWithSessionIndexesAndReason(t *testing.T) {
+	issueInstant := time.Date(2021, 10, 8, 12, 30, 0, 0, time.UTC)
+	expected := LogoutRequest{
+		ID:           "request-id",
+		Version:      "2.0",
+		IssueInstant: issueInstant,
+		Reason:       LogoutReasonAdmin,
+		Issuer: &Issuer{
+			XMLName: xml.Name{
+				Space: "urn:oasis:names:tc:SAML:2.0:assertion",
+				Local: "Issuer",
+			},
+			Value: "uri:issuer",
+		},
+		NameID: &NameID{
+			Value: "name-id",
+		},
+		SessionIndexes: []SessionIndex{
+			{Value: "index-1"},
+			{Value: "index-2"},
+		},
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(expected.Element())
+	x, err := doc.WriteToBytes()
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(`<samlp:LogoutRequest xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="request-id" Version="2.0" IssueInstant="2021-10-08T12:30:00Z" Reason="urn:oasis:names:tc:SAML:2.0:logout:admin"><saml:Issuer>uri:issuer</saml:Issuer><saml:NameID>name-id</saml:NameID><samlp:SessionIndex xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol">index-1</samlp:SessionIndex><samlp:SessionIndex xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol">index-2</samlp:SessionIndex></samlp:LogoutRequest>`,
+		string(x)))
+
+	var actual LogoutRequest
+	err = xml.Unmarshal(x, &actual)
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(expected, actual))
+}
+
+func TestLogoutRequestMarshalWithAsynchronousExtension(t *testing.T) {
+	issueInstant := time.Date(2021, 10, 8, 12, 30, 0, 0, time.UTC)
+	expected := LogoutRequest{
+		ID:           "request-id",
+		Version:      "2.0",
+		IssueInstant: issueInstant,
+		Issuer: &Issuer{
+			XMLName: xml.Name{
+				Space: "urn:oasis:names:tc:SAML:2.0:assertion",
+				Local: "Issuer",
+			},
+			Value: "uri:issuer",
+		},
+		Extensions: &Extensions{
+			XMLName: xml.Name{
+				Space: "urn:oasis:names:tc:SAML:2.0:protocol",
+				Local: "Extensions",
+			},
+			Asynchronous: &Asynchronous{
+				XMLName: xml.Name{
+					Space: AsyncSLONamespace,
+					Local: "Asynchronous",
+				},
+			},
+		},
+		NameID: &NameID{
+			Value: "name-id",
+		},
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(expected.Element())
+	x, err := doc.WriteToBytes()
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(`<samlp:LogoutRequest xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="request-id" Version="2.0" IssueInstant="2021-10-08T12:30:00Z"><saml:Issuer>uri:issuer</saml:Issuer><samlp:Extensions xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"><aslo:Asynchronous xmlns:aslo="urn:oasis:names:tc:SAML:2.0:protocol:ext:async-slo"/></samlp:Extensions><saml:NameID>name-id</saml:NameID></samlp:LogoutRequest>`,
+		string(x)))
+
+	var actual LogoutRequest
+	err = xml.Unmarshal(x, &actual)
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(expected, actual))
+	assert.Check(t, actual.IsAsynchronous())
+}
+
+func TestExtensionsMarshalWithOtherElements(t *testing.T) {
+	spType := etree.NewElement("eidas:SPType")
+	spType.CreateAttr("xmlns:eidas", "http://eidas.europa.eu/saml-extensions")
+	spType.SetText("public")
+	expected := Extensions{Elements: []*etree.Element{spType}}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(expected.Element())
+	x, err := doc.WriteToBytes()
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(`<samlp:Extensions xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"><eidas:SPType xmlns:eidas="http://eidas.europa.eu/saml-extensions">public</eidas:SPType></samlp:Extensions>`,
+		string(x)))
+
+	var actual Extensions
+	err = xml.Unmarshal(x, &actual)
+	assert.Check(t, err)
+	assert.Assert(t, is.Len(actual.Elements, 1))
+	doc = etree.NewDocument()
+	doc.SetRoot(actual.Elements[0])
+	x, err = doc.WriteToBytes()
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(`<SPType xmlns="http://eidas.europa.eu/saml-extensions" xmlns:eidas="http://eidas.europa.eu/saml-extensions">public</SPType>`, string(x)))
+
+	// the elements survive encoding/xml as well
+	x, err = xml.Marshal(&actual)
+	assert.Check(t, err)
+	var again Extensions
+	err = xml.Unmarshal(x, &again)
+	assert.Check(t, err)
+	assert.Assert(t, is.Len(again.Elements, 1))
+	assert.Check(t, is.Equal("public", again.Elements[0].Text()))
+}
+
+func TestResponseXMLRoundTripPreservesUnknownContent(t *testing.T) {
+	x := []byte(`<samlp:Response xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:ext="urn:example:ext" ID="response-id" Version="2.0" IssueInstant="2021-10-08T12:30:00Z" ext:flag="yes">` +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>` +
+		`<saml:Assertion ID="assertion-id" Version="2.0" IssueInstant="2021-10-08T12:30:00Z">` +
+		`<saml:Issuer>https://idp.example.com/</saml:Issuer>` +
+		`<saml:Advice><saml:AssertionIDRef>other-id</saml:AssertionIDRef></saml:Advice>` +
+		`</saml:Assertion>` +
+		`<ext:Trailer>data</ext:Trailer>` +
+		`</samlp:Response>`)
+
+	var response Response
+	err := xml.Unmarshal(x, &response)
+	assert.Assert(t, err)
+	assert.Check(t, is.DeepEqual([]xml.Attr{{Name: xml.Name{Space: "urn:example:ext", Local: "flag"}, Value: "yes"}}, response.AnyAttrs))
+	assert.Assert(t, is.Len(response.AnyElements, 1))
+	assert.Check(t, is.Equal("Trailer", response.AnyElements[0].Element.Tag))
+	assert.Assert(t, is.Len(response.Assertion.AnyElements, 1))
+	assert.Check(t, is.Equal("Advice", response.Assertion.AnyElements[0].Element.Tag))
+
+	doc := etree.NewDocument()
+	doc.SetRoot(response.Element())
+	x, err = doc.WriteToBytes()
+	assert.Assert(t, err)
+
+	var actual Response
+	err = xml.Unmarshal(x, &actual)
+	assert.Assert(t, err)
+	assert.Check(t, is.DeepEqual(response.AnyAttrs, actual.AnyAttrs))
+	assert.Assert(t, is.Len(actual.AnyElements, 1))
+	assert.Check(t, is.Equal("data", actual.AnyElements[0].Element.Text()))
+	assert.Assert(t, is.Len(actual.Assertion.AnyElements, 1))
+	assert.Check(t, is.Equal("other-id", actual.Assertion.AnyElements[0].Element.FindElement("./AssertionIDRef").Text()))
+}
+
+func TestEntityDescriptorXMLRoundTripPreservesUnknownContent(t *testing.T) {
+	x := []byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ext="urn:example:ext" entityID="https://sp.example.com/" ext:flag="yes">` +
+		`<ext:Trailer>data</ext:Trailer>` +
+		`</md:EntityDescriptor>`)
+
+	var md EntityDescriptor
+	err := xml.Unmarshal(x, &md)
+	assert.Assert(t, err)
+
+	x, err = xml.Marshal(md)
+	assert.Assert(t, err)
+	var actual EntityDescriptor
+	err = xml.Unmarshal(x, &actual)
+	assert.Assert(t, err)
+	assert.Check(t, is.DeepEqual([]xml.Attr{{Name: xml.Name{Space: "urn:example:ext", Local: "flag"}, Value: "yes"}}, actual.AnyAttrs))
+	assert.Assert(t, is.Len(actual.AnyElements, 1))
+	assert.Check(t, is.Equal("data", actual.AnyElements[0].Element.Text()))
+}
+
+func TestConditionsXMLRoundTrip(t *testing.T) {
+	x := []byte(`<saml:Conditions xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" NotBefore="2021-10-08T12:30:00Z" NotOnOrAfter="2021-10-08T12:35:00Z">` +
+		`<saml:AudienceRestriction><saml:Audience>https://sp.example.com/</saml:Audience></saml:AudienceRestriction>` +
+		`<saml:OneTimeUse/>` +
+		`<saml:ProxyRestriction Count="2"><saml:Audience>https://a.example.com/</saml:Audience><saml:Audience>https://b.example.com/</saml:Audience></saml:ProxyRestriction>` +
+		`<saml:Condition xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:ext="urn:example:ext" xsi:type="ext:CustomCondition"/>` +
+		`</saml:Conditions>`)
+
+	var conditions Conditions
+	err := xml.Unmarshal(x, &conditions)
+	assert.Assert(t, err)
+	assert.Check(t, conditions.OneTimeUse != nil)
+	assert.Assert(t, conditions.ProxyRestriction != nil)
+	assert.Check(t, is.DeepEqual(2, *conditions.ProxyRestriction.Count))
+	assert.Check(t, is.DeepEqual([]Audience{{Value: "https://a.example.com/"}, {Value: "https://b.example.com/"}}, conditions.ProxyRestriction.Audiences))
+	assert.Assert(t, is.Len(conditions.AnyElements, 1))
+	assert.Check(t, is.Equal("Condition", conditions.AnyElements[0].Element.Tag))
+
+	doc := etree.NewDocument()
+	doc.SetRoot(conditions.Element())
+	x, err = doc.WriteToBytes()
+	assert.Assert(t, err)
+
+	var actual Conditions
+	err = xml.Unmarshal(x, &actual)
+	assert.Assert(t, err)
+	assert.Check(t, is.DeepEqual(conditions.ProxyRestriction, actual.ProxyRestriction))
+	assert.Check(t, actual.OneTimeUse != nil)
+	assert.Assert(t, is.Len(actual.AnyElements, 1))
+	assert.Check(t, is.Equal("ext:CustomCondition", actual.AnyElements[0].Element.SelectAttrValue("xsi:type", "")))
+}
+
+func TestConditionsDelegationRestriction(t *testing.T) {
+	x := []byte(`<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:del="urn:oasis:names:tc:SAML:2.0:conditions:delegation" ID="_1" IssueInstant="2021-10-08T12:30:00Z" Version="2.0">` +
+		`<saml:Issuer>https://idp.example.com/</saml:Issuer>` +
+		`<saml:Conditions NotBefore="2021-10-08T12:30:00Z" NotOnOrAfter="2021-10-08T12:35:00Z">` +
+		`<saml:Condition xsi:type="del:DelegationRestrictionType">` +
+		`<del:Delegate DelegationInstant="2021-10-08T12:29:00Z" ConfirmationMethod="urn:oasis:names:tc:SAML:2.0:cm:holder-of-key">` +
+		`<saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:entity">https://proxy.example.com/</saml:NameID>` +
+		`</del:Delegate>` +
+		`<del:Delegate><saml:NameID>https://portal.example.com/</saml:NameID></del:Delegate>` +
+		`</saml:Condition>` +
+		`</saml:Conditions>` +
+		`</saml:Assertion>`)
+
+	expected := &DelegationRestriction{
+		Delegates: []Delegate{
+			{
+				DelegationInstant:  time.Date(2021, 10, 8, 12, 29, 0, 0, time.UTC),
+				ConfirmationMethod: HolderOfKeyConfirmationMethod,
+				NameID: &NameID{
+					Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+					Value:  "https://proxy.example.com/",
+				},
+			},
+			{
+				NameID: &NameID{Value: "https://portal.example.com/"},
+			},
+		},
+	}
+
+	var assertion Assertion
+	err := xml.Unmarshal(x, &assertion)
+	assert.Assert(t, err)
+	assert.Check(t, is.DeepEqual(expected, assertion.Conditions.DelegationRestriction))
+	assert.Check(t, is.Len(assertion.Conditions.AnyElements, 0))
+
+	// through Element
+	doc := etree.NewDocument()
+	doc.SetRoot(assertion.Element())
+	x, err = doc.WriteToBytes()
+	assert.Assert(t, err)
+	var actual Assertion
+	assert.Assert(t, xml.Unmarshal(x, &actual))
+	assert.Check(t, is.DeepEqual(expected, actual.Conditions.DelegationRestriction))
+
+	// through MarshalXML
+	x, err = xml.Marshal(assertion.Conditions)
+	assert.Assert(t, err)
+	var conditions Conditions
+	assert.Assert(t, xml.Unmarshal(x, &conditions))
+	assert.Check(t, is.DeepEqual(expected, conditions.DelegationRestriction))
+	assert.Check(t, is.Len(conditions.AnyElements, 0))
+}
@@ -3,18 +3,25 @@ package saml
 import (
 	"bytes"
 	"compress/flate"
+	"context"
+	"crypto"
 	"crypto/rsa"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	xrv "github.com/mattermost/xml-roundtrip-validator"
@@ -65,13 +72,29 @@ type ServiceProvider struct {
 	// Entity ID is optional - if not specified then MetadataURL will be used
 	EntityID string
 
-	// Key is the RSA private key we use to sign requests.
-	Key *rsa.PrivateKey
+	// Key is the private key we use to sign requests. It may be any
+	// crypto.Signer with an RSA or ECDSA public key, such as a key held in
+	// an HSM or a cloud KMS. Assertions can only be decrypted if Key is an
+	// *rsa.PrivateKey.
+	Key crypto.PrivateKey
 
-	// Certificate is the RSA public part of Key.
+	// Certificate is the public part of Key.
 	Certificate   *x509.Certificate
 	Intermediates []*x509.Certificate
 
+	// DecryptionKeys, if not empty, are the keys used to decrypt encrypted
+	// assertions and identifiers instead of Key. They are tried in order, so
+	// that during certificate rotation assertions encrypted to either the
+	// old or the new certificate can be decrypted. The certificate of each
+	// is published in the metadata for encryption, and Certificate is then
+	// published for signing only.
+	DecryptionKeys []DecryptionKey
+
+	// SigningKeys, if not nil, holds the keys used to sign requests instead
+	// of Key and Certificate, which are then used for decryption only. Use
+	// it to publish the next signing certificate ahead of a key rollover.
+	SigningKeys *SigningKeys
+
 	// HTTPClient to use during SAML artifact resolution
 	HTTPClient *http.Client
 
@@ -83,32 +106,193 @@ type ServiceProvider struct {
 	// on this host, i.e. https://example.com/saml/acs
 	AcsURL url.URL
 
+	// AssertionConsumerServices, if not empty, are the assertion consumer
+	// service endpoints published in the metadata, which may use different
+	// bindings and URLs. Responses sent to any of them are accepted. The
+	// default publishes AcsURL with the HTTP-POST and HTTP-Artifact
+	// bindings, and the PAOS binding if AllowECP is set.
+	AssertionConsumerServices []IndexedEndpoint
+
+	// AcceptedDestinations lists URLs, other than those of the assertion
+	// consumer services, that are accepted as the Destination of responses
+	// and the Recipient of their subject confirmations. Behind a
+	// TLS-terminating proxy, for instance, the IDP addresses responses to
+	// the external URL of the ACS, which may differ from AcsURL.
+	AcceptedDestinations []string
+
+	// AcceptDestination, if not nil, is called with a Destination or
+	// Recipient that is not otherwise accepted, and accepts it if it
+	// returns true.
+	AcceptDestination func(destination string) bool
+
+	// AcceptedAudiences lists audience URIs, other than the entity ID of
+	// the SP, that are accepted in the AudienceRestriction of assertions.
+	AcceptedAudiences []string
+
+	// AcceptAudience, if not nil, is called with each audience of an
+	// AudienceRestriction that is not otherwise accepted, and accepts it
+	// if it returns true.
+	AcceptAudience func(audience string) bool
+
+	// ResponseSignaturePolicy describes which of the Response and Assertion
+	// elements of responses from the IDP must be signed, in authentication
+	// responses and in the responses to queries alike. The default,
+	// EitherSignatureSufficient, requires that one of them be signed.
+	ResponseSignaturePolicy ResponseSignaturePolicy
+
+	// AdditionalTrustedIssuers lists Issuer values, other than the entity
+	// ID in the IDP metadata, that are accepted in the messages and
+	// assertions of the IDP. Some IDPs, such as Azure AD, and some proxies
+	// issue assertions with an Issuer that is not their entity ID.
+	AdditionalTrustedIssuers []string
+
+	// AcceptIssuer, if not nil, is called with an Issuer that is not
+	// otherwise accepted, and accepts it if it returns true.
+	AcceptIssuer func(issuer string) bool
+
+	// AssertionConsumerServiceIndex, if not nil, makes authentication
+	// requests refer to the assertion consumer service with this index in
+	// the metadata of the service provider rather than sending AcsURL and
+	// the response binding. Responses must then be sent to the location of
+	// that endpoint.
+	AssertionConsumerServiceIndex *int
+
+	// AttributeConsumingServiceIndex, if not nil, is sent in authentication
+	// requests to refer to the attribute consuming service with this index
+	// in the metadata of the service provider, which describes the
+	// attributes that the identity provider should release.
+	AttributeConsumingServiceIndex *int
+
+	// AttributeConsumingServices are published in the metadata to describe
+	// the service and the attributes that it requests from identity
+	// providers, which federations use to derive attribute release
+	// policies.
+	AttributeConsumingServices []AttributeConsumingService
+
+	// Organization and ContactPeople, if set, are published in the
+	// metadata to describe the organization responsible for the service
+	// provider and whom to contact about it.
+	Organization  *Organization
+	ContactPeople []ContactPerson
+
+	// UIInfo, if not nil, is published in the metadata for login and
+	// discovery interfaces to show the name, description and logo of the
+	// service provider.
+	UIInfo *UIInfo
+
 	// SloURL is the full URL to the SAML Single Logout endpoint on this host.
 	// i.e. https://example.com/saml/slo
 	SloURL url.URL
 
-	// IDPMetadata is the metadata from the identity provider.
+	// IDPMetadata is the metadata from the identity provider. Use
+	// SetIDPMetadata to replace it once the ServiceProvider is in use.
 	IDPMetadata *EntityDescriptor
 
 	// AuthnNameIDFormat is the format used in the NameIDPolicy for
 	// authentication requests
 	AuthnNameIDFormat NameIDFormat
 
+	// NameIDPolicy, if not nil, is the NameIDPolicy sent in authentication
+	// requests, so that AllowCreate can be set to false or left out and
+	// SPNameQualifier can be given. If its Format is nil, AuthnNameIDFormat
+	// is used. The default asks for AuthnNameIDFormat with AllowCreate set
+	// to true.
+	NameIDPolicy *NameIDPolicy
+
+	// OmitNameIDPolicy, if true, leaves the NameIDPolicy out of
+	// authentication requests altogether, for identity providers that
+	// reject the policies they do not expect.
+	OmitNameIDPolicy bool
+
 	// MetadataValidDuration is a duration used to calculate validUntil
 	// attribute in the metadata endpoint
 	MetadataValidDuration time.Duration
 
+	// MetadataCacheDuration, if not zero, is published as the cacheDuration
+	// of the metadata, i.e. how long the IDP may cache it before fetching
+	// it again.
+	MetadataCacheDuration time.Duration
+
+	// OmitMetadataValidUntil, if true, leaves validUntil out of the
+	// metadata, for registrations with federations that keep metadata for
+	// longer than any fixed validity.
+	OmitMetadataValidUntil bool
+
 	// ForceAuthn allows you to force re-authentication of users even if the user
 	// has a SSO session at the IdP.
 	ForceAuthn *bool
 
+	// IsPassive asks the IdP not to interact with users. If it cannot
+	// authenticate a user without interaction, for instance because the user
+	// has no SSO session, it responds with the StatusNoPassive status.
+	IsPassive *bool
+
+	// Scoping, if not nil, is sent in authentication requests to constrain
+	// the identity providers that a proxying IdP may use to authenticate
+	// users, and to identify the requesters on whose behalf the requests
+	// are made.
+	Scoping *Scoping
+
+	// AuthnRequestExtensions, if not empty, are sent in the samlp:Extensions
+	// element of authentication requests, for instance the eIDAS SPType and
+	// RequestedAttributes. Each element must declare the namespaces that it
+	// uses.
+	AuthnRequestExtensions []*etree.Element
+
 	// RequestedAuthnContext allow you to specify the requested authentication
-	// context in authentication requests
+	// context in authentication requests. The authentication statements of
+	// assertions in responses must satisfy it.
 	RequestedAuthnContext *RequestedAuthnContext
 
-	// AllowIdpInitiated
+	// ModifyAuthnRequest, if not nil, is called with each authentication
+	// request before it is signed, so that it can be changed, for instance
+	// to set ForceAuthn, a Subject or Extensions. If it returns an error,
+	// the request is not made.
+	ModifyAuthnRequest func(req *AuthnRequest) error
+
+	// AuthnContextClassOrder lists authentication context classes from the
+	// weakest to the strongest. It is used to check that authentication
+	// statements satisfy a RequestedAuthnContext whose Comparison is
+	// "minimum", "better" or "maximum". The default is
+	// DefaultAuthnContextClassOrder.
+	AuthnContextClassOrder []string
+
+	// ValidateAttributeScopes, if true, rejects assertions with values of
+	// ScopedAttributes whose scope, the part after the "@", is not one of
+	// the shibmd:Scope extensions of the IDP metadata. This prevents an IDP
+	// of a federation from asserting identities in the scope of another.
+	ValidateAttributeScopes bool
+
+	// ScopedAttributes are the names of the attributes whose scopes are
+	// validated if ValidateAttributeScopes is true. The default is
+	// DefaultScopedAttributes.
+	ScopedAttributes []string
+
+	// StrictStructureCheck, if true, rejects the responses, logout
+	// requests and responses and SOAP responses that the SP receives, and
+	// the metadata that MetadataRefresher fetches for it, if they fail
+	// CheckStructure, before processing them any further.
+	StrictStructureCheck bool
+
+	// AllowIDPInitiated, if true, accepts unsolicited responses, that is,
+	// responses of IDP-initiated SSO, which are not in response to a
+	// request of the SP. If false, responses without an InResponseTo are
+	// rejected, whatever request IDs are passed to ParseResponse.
 	AllowIDPInitiated bool
 
+	// IDPInitiatedRelayStates lists the URIs that the RelayState of an
+	// unsolicited response may send the user to once they are logged in.
+	// An entry that ends with "*" matches any RelayState that starts with
+	// the rest of the entry. Unsolicited responses cannot be used as open
+	// redirects, since a RelayState that is not listed is ignored in favor
+	// of DefaultRedirectURI. See IDPInitiatedRedirectURI.
+	IDPInitiatedRelayStates []string
+
+	// AllowECP enables the Enhanced Client or Proxy (ECP) profile. The
+	// metadata advertises an assertion consumer service using the PAOS
+	// binding, which ECP clients use to deliver responses.
+	AllowECP bool
+
 	// DefaultRedirectURI where untracked requests (as of IDPInitiated) are redirected to
 	DefaultRedirectURI string
 
@@ -116,12 +300,118 @@ type ServiceProvider struct {
 	// to verify signatures.
 	SignatureVerifier SignatureVerifier
 
-	// SignatureMethod, if non-empty, authentication requests will be signed
+	// SignatureMethod, if non-empty, authentication requests will be signed.
+	// If the IDP declares the signature algorithms it supports in its
+	// metadata and SignatureMethod is not one of them, the first of them
+	// that can be used with the signing key is used instead.
 	SignatureMethod string
 
+	// AuthnRequestsSigned, if not nil, is published in the metadata to tell
+	// the IDP whether the SP signs its authentication requests. The default
+	// is true if SignatureMethod is set. Requests are only signed if
+	// SignatureMethod is set, so an IDP that enforces the flag rejects the
+	// requests of an SP that declares it without setting SignatureMethod.
+	AuthnRequestsSigned *bool
+
+	// WantAssertionsSigned, if not nil, is published in the metadata to
+	// tell the IDP whether the SP wants assertions to be signed. The
+	// default is true. If it is set to true, assertions that are not signed
+	// are rejected, whatever ResponseSignaturePolicy.
+	WantAssertionsSigned *bool
+
+	// AllowedSignatureMethods and AllowedDigestMethods list the algorithm
+	// URIs that are acceptable in the signatures of messages from the IDP.
+	// Messages signed with other algorithms are rejected. If empty,
+	// DefaultAllowedSignatureMethods and DefaultAllowedDigestMethods are
+	// used, which do not allow SHA-1.
+	AllowedSignatureMethods []string
+	AllowedDigestMethods    []string
+
 	// LogoutBindings specify the bindings available for SLO endpoint. If empty,
 	// HTTP-POST binding is used.
 	LogoutBindings []string
+
+	// AsynchronousLogout, if true, marks the LogoutRequests that we send over
+	// front-channel bindings with the aslo:Asynchronous extension, telling
+	// the IDP that we do not expect a LogoutResponse.
+	AsynchronousLogout bool
+
+	// SOAPRetries is the number of times SendLogoutRequestSOAP retries a
+	// request that failed because of a network error or a 5xx response from
+	// the IDP. Retries are spaced by an exponential backoff.
+	SOAPRetries int
+
+	// MaxIssueDelay and MaxClockSkew, if not zero, are used instead of the
+	// package-level MaxIssueDelay and MaxClockSkew, so that service
+	// providers can have different tolerances for their IDPs.
+	MaxIssueDelay time.Duration
+	MaxClockSkew  time.Duration
+
+	// AssertionValidators are called with each assertion of an
+	// authentication response that passes the built-in checks, to enforce conditions of the deployment such as the
+	// presence of attributes or the freshness of the AuthnInstant. If one
+	// of them returns an error, the assertion is rejected.
+	AssertionValidators []func(assertion *Assertion) error
+
+	// ResponseValidators are called with each authentication Response whose
+	// signatures have been verified, before its assertion is validated. If one of them
+	// returns an error, the response is rejected.
+	ResponseValidators []func(response *Response) error
+
+	// RequestIDStore, if not nil, remembers the IDs of the authentication
+	// requests and queries that the SP issues. A response is then accepted
+	// if it is in response to one of them, in addition to the request IDs
+	// passed to ParseResponse, and each request is answered at most once.
+	// See MemoryRequestIDStore.
+	RequestIDStore RequestIDStore
+
+	// ReplayCache, if not nil, remembers the IDs of the assertions that have
+	// been accepted, and assertions that have been accepted before are
+	// rejected. This enforces the OneTimeUse condition, and protects against
+	// the replay of assertions that do not have it. See MemoryReplayCache.
+	ReplayCache ReplayCache
+
+	// EventSink, if not nil, is told about the requests that the SP issues
+	// and the responses and logout messages that it accepts or rejects, for
+	// audit logging and monitoring.
+	EventSink EventSink
+
+	// StrictConditions, if true, rejects assertions with conditions that the
+	// SP cannot enforce: conditions of types other than AudienceRestriction,
+	// OneTimeUse, ProxyRestriction and DelegationRestriction, and OneTimeUse
+	// if there is no ReplayCache. Otherwise such conditions are ignored. The
+	// delegates of a DelegationRestriction are left to the application to
+	// check.
+	StrictConditions bool
+
+	// ValidateSubjectAddress, if true, requires that the client that
+	// presents a response has the Address of the SubjectConfirmationData of
+	// its assertion, if the IDP gave one. Only ParseResponse and
+	// ParseECPResponse see the client; the other methods that parse
+	// responses reject such assertions.
+	ValidateSubjectAddress bool
+
+	// TrustedProxies are the networks of the reverse proxies in front of the
+	// SP. The address of a client that connects through them is taken from
+	// the X-Forwarded-For header that they set.
+	TrustedProxies []*net.IPNet
+
+	// Tracer, if not nil, traces the parsing and validation of responses,
+	// SOAP round-trips, signature verification and decryption.
+	Tracer Tracer
+
+	// TimeSource, if not nil, is the source of the current time that is
+	// used to issue messages and to check their validity. The default is
+	// TimeNow, which is shared by all service providers.
+	TimeSource TimeSource
+
+	// RandReader, if not nil, is the source of the random bytes of the IDs
+	// of the messages the SP issues, instead of the package-level
+	// RandReader. It must be cryptographically secure outside of tests.
+	RandReader io.Reader
+
+	// currentIDPMetadata holds the metadata passed to SetIDPMetadata.
+	currentIDPMetadata atomic.Value
 }
 
 // MaxIssueDelay is the longest allowed time between when a SAML assertion is
@@ -148,47 +438,40 @@ func (sp *ServiceProvider) Metadata() *EntityDescriptor {
 	}
 
 	authnRequestsSigned := len(sp.SignatureMethod) > 0
+	if sp.AuthnRequestsSigned != nil {
+		authnRequestsSigned = *sp.AuthnRequestsSigned
+	}
 	wantAssertionsSigned := true
-	validUntil := TimeNow().Add(validDuration)
+	if sp.WantAssertionsSigned != nil {
+		wantAssertionsSigned = *sp.WantAssertionsSigned
+	}
+	var validUntil *time.Time
+	if !sp.OmitMetadataValidUntil {
+		t := sp.now().Add(validDuration)
+		validUntil = &t
+	}
 
 	var keyDescriptors []KeyDescriptor
 	if sp.Certificate != nil {
-		certBytes := sp.Certificate.Raw
-		for _, intermediate := range sp.Intermediates {
-			certBytes = append(certBytes, intermediate.Raw...)
+		chain := append([]*x509.Certificate{sp.Certificate}, sp.Intermediates...)
+		if len(sp.DecryptionKeys) == 0 {
+			keyDescriptors = appendEncryptionKeyDescriptor(keyDescriptors, chain)
 		}
-		keyDescriptors = []KeyDescriptor{
-			{
-				Use: "encryption",
-				KeyInfo: KeyInfo{
-					X509Data: X509Data{
-						X509Certificates: []X509Certificate{
-							{Data: base64.StdEncoding.EncodeToString(certBytes)},
-						},
-					},
-				},
-				EncryptionMethods: []EncryptionMethod{
-					{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
-					{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
-					{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
-					{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
-				},
-			},
+		if len(sp.SignatureMethod) > 0 && sp.SigningKeys == nil {
+			keyDescriptors = append(keyDescriptors, signingKeyDescriptor(chain))
 		}
-		if len(sp.SignatureMethod) > 0 {
-			keyDescriptors = append(keyDescriptors, KeyDescriptor{
-				Use: "signing",
-				KeyInfo: KeyInfo{
-					X509Data: X509Data{
-						X509Certificates: []X509Certificate{
-							{Data: base64.StdEncoding.EncodeToString(certBytes)},
-						},
-					},
-				},
-			})
+	}
+
+	if len(sp.SignatureMethod) > 0 && sp.SigningKeys != nil {
+		for _, cert := range sp.SigningKeys.Certificates() {
+			keyDescriptors = append(keyDescriptors, signingKeyDescriptor([]*x509.Certificate{cert}))
 		}
 	}
 
+	for _, decryptionKey := range sp.DecryptionKeys {
+		keyDescriptors = appendEncryptionKeyDescriptor(keyDescriptors, []*x509.Certificate{decryptionKey.Certificate})
+	}
+
 	var sloEndpoints []Endpoint
 	for _, binding := range sp.LogoutBindings {
 		sloEndpoints = append(sloEndpoints, Endpoint{
@@ -198,17 +481,29 @@ func (sp *ServiceProvider) Metadata() *EntityDescriptor {
 		})
 	}
 
-	return &EntityDescriptor{
-		EntityID:   firstSet(sp.EntityID, sp.MetadataURL.String()),
-		ValidUntil: validUntil,
+	acsEndpoints := sp.assertionConsumerServices()
+
+	var extensions *MetadataExtensions
+	if sp.UIInfo != nil {
+		extensions = &MetadataExtensions{UIInfo: sp.UIInfo}
+	}
+
+	ed := &EntityDescriptor{
+		EntityID:      firstSet(sp.EntityID, sp.MetadataURL.String()),
+		CacheDuration: sp.MetadataCacheDuration,
+		Extensions: signaturePolicy{
+			SignatureMethods: sp.AllowedSignatureMethods,
+			DigestMethods:    sp.AllowedDigestMethods,
+		}.metadataExtensions(),
 
 		SPSSODescriptors: []SPSSODescriptor{
 			{
 				SSODescriptor: SSODescriptor{
 					RoleDescriptor: RoleDescriptor{
 						ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+						Extensions:                 extensions,
 						KeyDescriptors:             keyDescriptors,
-						ValidUntil:                 &validUntil,
+						ValidUntil:                 validUntil,
 					},
 					SingleLogoutServices: sloEndpoints,
 					NameIDFormats:        []NameIDFormat{sp.AuthnNameIDFormat},
@@ -216,23 +511,74 @@ func (sp *ServiceProvider) Metadata() *EntityDescriptor {
 				AuthnRequestsSigned:  &authnRequestsSigned,
 				WantAssertionsSigned: &wantAssertionsSigned,
 
-				AssertionConsumerServices: []IndexedEndpoint{
-					{
-						Binding:  HTTPPostBinding,
-						Location: sp.AcsURL.String(),
-						Index:    1,
-					},
-					{
-						Binding:  HTTPArtifactBinding,
-						Location: sp.AcsURL.String(),
-						Index:    2,
-					},
-				},
+				AssertionConsumerServices:  acsEndpoints,
+				AttributeConsumingServices: sp.AttributeConsumingServices,
 			},
 		},
+		Organization:  sp.Organization,
+		ContactPeople: sp.ContactPeople,
+	}
+	if validUntil != nil {
+		ed.ValidUntil = *validUntil
+	}
+	return ed
+}
+
+// SignedMetadata returns the service provider metadata with an enveloped
+// signature made with the signing key of the service provider, as required
+// by federations that only accept self-signed metadata.
+func (sp *ServiceProvider) SignedMetadata() (*EntityDescriptor, error) {
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
+		return nil, err
+	}
+	md := sp.Metadata()
+	if err := signMetadata(md, signingContext, sp.RandReader); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// certificateKeyInfo returns a KeyInfo that carries chain, a certificate
+// followed by the intermediate certificates that issued it, with one
+// X509Certificate element per certificate.
+func certificateKeyInfo(chain []*x509.Certificate) KeyInfo {
+	keyInfo := KeyInfo{}
+	for _, cert := range chain {
+		keyInfo.X509Data.X509Certificates = append(keyInfo.X509Data.X509Certificates,
+			X509Certificate{Data: base64.StdEncoding.EncodeToString(cert.Raw)})
+	}
+	return keyInfo
+}
+
+// signingKeyDescriptor returns a KeyDescriptor that publishes chain for
+// signing.
+func signingKeyDescriptor(chain []*x509.Certificate) KeyDescriptor {
+	return KeyDescriptor{
+		Use:     "signing",
+		KeyInfo: certificateKeyInfo(chain),
 	}
 }
 
+// appendEncryptionKeyDescriptor appends a KeyDescriptor that publishes
+// chain for encryption to keyDescriptors. Assertions can only be encrypted
+// to an RSA key, so an EC certificate is not published for encryption.
+func appendEncryptionKeyDescriptor(keyDescriptors []KeyDescriptor, chain []*x509.Certificate) []KeyDescriptor {
+	if _, ok := chain[0].PublicKey.(*rsa.PublicKey); !ok {
+		return keyDescriptors
+	}
+	return append(keyDescriptors, KeyDescriptor{
+		Use:     "encryption",
+		KeyInfo: certificateKeyInfo(chain),
+		EncryptionMethods: []EncryptionMethod{
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
+		},
+	})
+}
+
 // MakeRedirectAuthenticationRequest creates a SAML authentication request using
 // the HTTP-Redirect binding. It returns a URL that we will redirect the user to
 // in order to start the auth process.
@@ -270,18 +616,15 @@ func (req *AuthnRequest) Redirect(relayState string, sp *ServiceProvider) (*url.
 		query += "&RelayState=" + relayState
 	}
 	if len(sp.SignatureMethod) > 0 {
-		query += "&SigAlg=" + url.QueryEscape(sp.SignatureMethod)
 		signingContext, err := GetSigningContext(sp)
-
 		if err != nil {
 			return nil, err
 		}
 
-		sig, err := signingContext.SignString(query)
+		query, err = signRedirectQuery(query, sp.signatureMethod(), signingContext)
 		if err != nil {
 			return nil, err
 		}
-		query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(sig))
 	}
 
 	rv.RawQuery = query
@@ -292,7 +635,7 @@ func (req *AuthnRequest) Redirect(relayState string, sp *ServiceProvider) (*url.
 // GetSSOBindingLocation returns URL for the IDP's Single Sign On Service binding
 // of the specified type (HTTPRedirectBinding or HTTPPostBinding)
 func (sp *ServiceProvider) GetSSOBindingLocation(binding string) string {
-	for _, idpSSODescriptor := range sp.IDPMetadata.IDPSSODescriptors {
+	for _, idpSSODescriptor := range sp.idpMetadata().IDPSSODescriptors {
 		for _, singleSignOnService := range idpSSODescriptor.SingleSignOnServices {
 			if singleSignOnService.Binding == binding {
 				return singleSignOnService.Location
@@ -305,8 +648,8 @@ func (sp *ServiceProvider) GetSSOBindingLocation(binding string) string {
 // GetArtifactBindingLocation returns URL for the IDP's Artifact binding of the
 // specified type
 func (sp *ServiceProvider) GetArtifactBindingLocation(binding string) string {
-	for _, idpSSODescriptor := range sp.IDPMetadata.IDPSSODescriptors {
-		for _, artifactResolutionService := range idpSSODescriptor.ArtifactResolutionServices {
+	for _, idpSSODescriptor := range sp.idpMetadata().IDPSSODescriptors {
+		for _, artifactResolutionService := range idpSSODescriptor.artifactResolutionServices() {
 			if artifactResolutionService.Binding == binding {
 				return artifactResolutionService.Location
 			}
@@ -315,10 +658,72 @@ func (sp *ServiceProvider) GetArtifactBindingLocation(binding string) string {
 	return ""
 }
 
+// GetArtifactResolutionLocation returns the URL of the IDP's
+// ArtifactResolutionService that must be used to resolve artifact, using the
+// specified binding (typically SOAPBinding). It returns an error if the
+// artifact was not issued by the IDP.
+//
+// The endpoint is selected by the artifact's EndpointIndex. It is an error
+// if the IDP does not advertise an endpoint with that index and binding.
+func (sp *ServiceProvider) GetArtifactResolutionLocation(artifact *Artifact, binding string) (string, error) {
+	if artifact.SourceID != ArtifactSourceID(sp.idpMetadata().EntityID) {
+		return "", fmt.Errorf("artifact was not issued by %s", sp.idpMetadata().EntityID)
+	}
+
+	for _, idpSSODescriptor := range sp.idpMetadata().IDPSSODescriptors {
+		for _, artifactResolutionService := range idpSSODescriptor.artifactResolutionServices() {
+			if artifactResolutionService.Binding == binding && artifactResolutionService.Index == int(artifact.EndpointIndex) {
+				return artifactResolutionService.Location, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("IDP has no ArtifactResolutionService with index %d and binding %s", artifact.EndpointIndex, binding)
+}
+
+// GetAttributeServiceLocation returns URL for the IDP's Attribute Service
+// binding of the specified type (typically SOAPBinding)
+func (sp *ServiceProvider) GetAttributeServiceLocation(binding string) string {
+	for _, attributeAuthorityDescriptor := range sp.idpMetadata().AttributeAuthorityDescriptors {
+		for _, attributeService := range attributeAuthorityDescriptor.AttributeServices {
+			if attributeService.Binding == binding {
+				return attributeService.Location
+			}
+		}
+	}
+	return ""
+}
+
+// GetAuthzServiceLocation returns URL for the IDP's Authorization Decision
+// Service binding of the specified type (typically SOAPBinding)
+func (sp *ServiceProvider) GetAuthzServiceLocation(binding string) string {
+	for _, pdpDescriptor := range sp.idpMetadata().PDPDescriptors {
+		for _, authzService := range pdpDescriptor.AuthzServices {
+			if authzService.Binding == binding {
+				return authzService.Location
+			}
+		}
+	}
+	return ""
+}
+
+// GetAuthnQueryServiceLocation returns URL for the IDP's Authentication Query
+// Service binding of the specified type (typically SOAPBinding)
+func (sp *ServiceProvider) GetAuthnQueryServiceLocation(binding string) string {
+	for _, authnAuthorityDescriptor := range sp.idpMetadata().AuthnAuthorityDescriptors {
+		for _, authnQueryService := range authnAuthorityDescriptor.AuthnQueryServices {
+			if authnQueryService.Binding == binding {
+				return authnQueryService.Location
+			}
+		}
+	}
+	return ""
+}
+
 // GetSLOBindingLocation returns URL for the IDP's Single Log Out Service binding
 // of the specified type (HTTPRedirectBinding or HTTPPostBinding)
 func (sp *ServiceProvider) GetSLOBindingLocation(binding string) string {
-	for _, idpSSODescriptor := range sp.IDPMetadata.IDPSSODescriptors {
+	for _, idpSSODescriptor := range sp.idpMetadata().IDPSSODescriptors {
 		for _, singleLogoutService := range idpSSODescriptor.SingleLogoutServices {
 			if singleLogoutService.Binding == binding {
 				return singleLogoutService.Location
@@ -328,30 +733,152 @@ func (sp *ServiceProvider) GetSLOBindingLocation(binding string) string {
 	return ""
 }
 
+// GetNameIDMappingServiceLocation returns URL for the IDP's Name Identifier
+// Mapping Service binding of the specified type (typically SOAPBinding)
+func (sp *ServiceProvider) GetNameIDMappingServiceLocation(binding string) string {
+	for _, idpSSODescriptor := range sp.idpMetadata().IDPSSODescriptors {
+		for _, nameIDMappingService := range idpSSODescriptor.NameIDMappingServices {
+			if nameIDMappingService.Binding == binding {
+				return nameIDMappingService.Location
+			}
+		}
+	}
+	return ""
+}
+
+// GetManageNameIDServiceLocation returns URL for the IDP's Manage Name ID
+// Service binding of the specified type (typically SOAPBinding)
+func (sp *ServiceProvider) GetManageNameIDServiceLocation(binding string) string {
+	for _, idpSSODescriptor := range sp.idpMetadata().IDPSSODescriptors {
+		for _, manageNameIDService := range idpSSODescriptor.ManageNameIDServices {
+			if manageNameIDService.Binding == binding {
+				return manageNameIDService.Location
+			}
+		}
+	}
+	return ""
+}
+
+// SetIDPMetadata replaces the metadata from the identity provider. Unlike
+// assigning IDPMetadata, it is safe to call while the ServiceProvider is
+// handling requests, so it can be used to refresh the metadata in the
+// background.
+func (sp *ServiceProvider) SetIDPMetadata(md *EntityDescriptor) {
+	sp.currentIDPMetadata.Store(md)
+}
+
+// now returns the current time of the SP's TimeSource.
+func (sp *ServiceProvider) now() time.Time {
+	return timeNow(sp.TimeSource)
+}
+
+// randomBytes returns n bytes read from the SP's RandReader.
+func (sp *ServiceProvider) randomBytes(n int) []byte {
+	return randomBytesFrom(sp.RandReader, n)
+}
+
+func (sp *ServiceProvider) maxIssueDelay() time.Duration {
+	if sp.MaxIssueDelay != 0 {
+		return sp.MaxIssueDelay
+	}
+	return MaxIssueDelay
+}
+
+func (sp *ServiceProvider) maxClockSkew() time.Duration {
+	if sp.MaxClockSkew != 0 {
+		return sp.MaxClockSkew
+	}
+	return MaxClockSkew
+}
+
+// idpMetadata returns the metadata from the identity provider: the
+// metadata last passed to SetIDPMetadata, or IDPMetadata if there is none.
+func (sp *ServiceProvider) idpMetadata() *EntityDescriptor {
+	if md, ok := sp.currentIDPMetadata.Load().(*EntityDescriptor); ok {
+		return md
+	}
+	return sp.IDPMetadata
+}
+
+// idpRole identifies a role of the IDP, each of which has its own role
+// descriptor and keys in the IDP metadata.
+type idpRole int
+
+const (
+	idpSSORole idpRole = iota
+	attributeAuthorityRole
+	authnAuthorityRole
+	pdpRole
+)
+
+// keyDescriptors returns the keys of the role descriptors of role in the
+// IDP metadata.
+func (sp *ServiceProvider) keyDescriptors(role idpRole) []KeyDescriptor {
+	var keyDescriptors []KeyDescriptor
+	md := sp.idpMetadata()
+	switch role {
+	case idpSSORole:
+		for _, descriptor := range md.IDPSSODescriptors {
+			keyDescriptors = append(keyDescriptors, descriptor.KeyDescriptors...)
+		}
+	case attributeAuthorityRole:
+		for _, descriptor := range md.AttributeAuthorityDescriptors {
+			keyDescriptors = append(keyDescriptors, descriptor.KeyDescriptors...)
+		}
+	case authnAuthorityRole:
+		for _, descriptor := range md.AuthnAuthorityDescriptors {
+			keyDescriptors = append(keyDescriptors, descriptor.KeyDescriptors...)
+		}
+	case pdpRole:
+		for _, descriptor := range md.PDPDescriptors {
+			keyDescriptors = append(keyDescriptors, descriptor.KeyDescriptors...)
+		}
+	}
+	return keyDescriptors
+}
+
 // getIDPSigningCerts returns the certificates which we can use to verify things
 // signed by the IDP in PEM format, or nil if no such certificate is found.
 func (sp *ServiceProvider) getIDPSigningCerts() ([]*x509.Certificate, error) {
+	return sp.getRoleSigningCerts(idpSSORole)
+}
+
+// getRoleSigningCerts returns the certificates which we can use to verify
+// messages that the IDP sends in role. The certificates of the role
+// descriptor are used if it has any, and those of the IDP SSO descriptor
+// otherwise, since many IDPs only publish keys for the latter.
+func (sp *ServiceProvider) getRoleSigningCerts(role idpRole) ([]*x509.Certificate, error) {
+	certs, err := signingCerts(sp.keyDescriptors(role))
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 && role != idpSSORole {
+		return sp.getRoleSigningCerts(idpSSORole)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("cannot find any signing certificate in the IDP SSO descriptor")
+	}
+	return certs, nil
+}
+
+// signingCerts returns the certificates of keyDescriptors that may be used
+// for signing.
+func signingCerts(keyDescriptors []KeyDescriptor) ([]*x509.Certificate, error) {
 	var certStrs []string
 
 	// We need to include non-empty certs where the "use" attribute is
 	// either set to "signing" or is missing
-	for _, idpSSODescriptor := range sp.IDPMetadata.IDPSSODescriptors {
-		for _, keyDescriptor := range idpSSODescriptor.KeyDescriptors {
-			if len(keyDescriptor.KeyInfo.X509Data.X509Certificates) != 0 {
-				switch keyDescriptor.Use {
-				case "", "signing":
-					for _, certificate := range keyDescriptor.KeyInfo.X509Data.X509Certificates {
-						certStrs = append(certStrs, certificate.Data)
-					}
+	for _, keyDescriptor := range keyDescriptors {
+		if len(keyDescriptor.KeyInfo.X509Data.X509Certificates) != 0 {
+			switch keyDescriptor.Use {
+			case "", "signing":
+				for _, certificate := range keyDescriptor.KeyInfo.X509Data.X509Certificates {
+					certStrs = append(certStrs, certificate.Data)
 				}
 			}
 		}
 	}
 
-	if len(certStrs) == 0 {
-		return nil, errors.New("cannot find any signing certificate in the IDP SSO descriptor")
-	}
-
 	var certs []*x509.Certificate
 
 	// cleanup whitespace
@@ -376,8 +903,8 @@ func (sp *ServiceProvider) getIDPSigningCerts() ([]*x509.Certificate, error) {
 // MakeArtifactResolveRequest produces a new ArtifactResolve object to send to the idp's Artifact resolver
 func (sp *ServiceProvider) MakeArtifactResolveRequest(artifactID string) (*ArtifactResolve, error) {
 	req := ArtifactResolve{
-		ID:           fmt.Sprintf("id-%x", randomBytes(20)),
-		IssueInstant: TimeNow(),
+		ID:           fmt.Sprintf("id-%x", sp.randomBytes(20)),
+		IssueInstant: sp.now(),
 		Version:      "2.0",
 		Issuer: &Issuer{
 			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
@@ -395,155 +922,531 @@ func (sp *ServiceProvider) MakeArtifactResolveRequest(artifactID string) (*Artif
 	return &req, nil
 }
 
-// MakeAuthenticationRequest produces a new AuthnRequest object to send to the idpURL
-// that uses the specified binding (HTTPRedirectBinding or HTTPPostBinding)
-func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string, binding string, resultBinding string) (*AuthnRequest, error) {
-
-	allowCreate := true
-	nameIDFormat := sp.nameIDFormat()
-	req := AuthnRequest{
-		AssertionConsumerServiceURL: sp.AcsURL.String(),
-		Destination:                 idpURL,
-		ProtocolBinding:             resultBinding, // default binding for the response
-		ID:                          fmt.Sprintf("id-%x", randomBytes(20)),
-		IssueInstant:                TimeNow(),
-		Version:                     "2.0",
+// MakeAttributeQuery produces a new AttributeQuery object to send to the
+// attribute authority at aaURL, asking for the specified attributes of the
+// subject identified by nameID. If attributes is empty, the attribute
+// authority is asked for all attributes it is willing to release.
+//
+// An attribute that has values restricts the query to those values: the
+// attribute authority must only return the values that were requested.
+// See NewQueryAttribute.
+func (sp *ServiceProvider) MakeAttributeQuery(aaURL string, nameID *NameID, attributes []Attribute) (*AttributeQuery, error) {
+	req := AttributeQuery{
+		ID:           fmt.Sprintf("id-%x", sp.randomBytes(20)),
+		IssueInstant: sp.now(),
+		Version:      "2.0",
+		Destination:  aaURL,
 		Issuer: &Issuer{
 			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
 			Value:  firstSet(sp.EntityID, sp.MetadataURL.String()),
 		},
-		NameIDPolicy: &NameIDPolicy{
-			AllowCreate: &allowCreate,
-			// TODO(ross): figure out exactly policy we need
-			// urn:mace:shibboleth:1.0:nameIdentifier
-			// urn:oasis:names:tc:SAML:2.0:nameid-format:transient
-			Format: &nameIDFormat,
+		Subject: &Subject{
+			NameID: nameID,
 		},
-		ForceAuthn:            sp.ForceAuthn,
-		RequestedAuthnContext: sp.RequestedAuthnContext,
+		Attributes: attributes,
 	}
-	// We don't need to sign the XML document if the IDP uses HTTP-Redirect binding
-	if len(sp.SignatureMethod) > 0 && binding == HTTPPostBinding {
-		if err := sp.SignAuthnRequest(&req); err != nil {
+
+	if len(sp.SignatureMethod) > 0 {
+		if err := sp.SignAttributeQuery(&req); err != nil {
 			return nil, err
 		}
 	}
-	return &req, nil
-}
 
-// GetSigningContext returns a dsig.SigningContext initialized based on the Service Provider's configuration
-func GetSigningContext(sp *ServiceProvider) (*dsig.SigningContext, error) {
-	keyPair := tls.Certificate{
-		Certificate: [][]byte{sp.Certificate.Raw},
-		PrivateKey:  sp.Key,
-		Leaf:        sp.Certificate,
-	}
-	// TODO: add intermediates for SP
-	//for _, cert := range sp.Intermediates {
-	//	keyPair.Certificate = append(keyPair.Certificate, cert.Raw)
-	//}
-	keyStore := dsig.TLSCertKeyStore(keyPair)
-
-	if sp.SignatureMethod != dsig.RSASHA1SignatureMethod &&
-		sp.SignatureMethod != dsig.RSASHA256SignatureMethod &&
-		sp.SignatureMethod != dsig.RSASHA512SignatureMethod {
-		return nil, fmt.Errorf("invalid signing method %s", sp.SignatureMethod)
-	}
-	signatureMethod := sp.SignatureMethod
-	signingContext := dsig.NewDefaultSigningContext(keyStore)
-	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(canonicalizerPrefixList)
-	if err := signingContext.SetSignatureMethod(signatureMethod); err != nil {
+	if err := sp.putRequestID(req.ID); err != nil {
 		return nil, err
 	}
+	sp.requestIssued("AttributeQuery", req.ID, aaURL)
+	return &req, nil
+}
 
-	return signingContext, nil
+// NewQueryAttribute returns an Attribute for use in an AttributeQuery. If
+// values are specified, only those values of the attribute are requested.
+func NewQueryAttribute(name, nameFormat string, values ...string) Attribute {
+	attr := Attribute{
+		Name:       name,
+		NameFormat: nameFormat,
+	}
+	for _, value := range values {
+		attr.Values = append(attr.Values, AttributeValue{
+			Type:  "xs:string",
+			Value: value,
+		})
+	}
+	return attr
 }
 
-// SignArtifactResolve adds the `Signature` element to the `ArtifactResolve`.
-func (sp *ServiceProvider) SignArtifactResolve(req *ArtifactResolve) error {
-	signingContext, err := GetSigningContext(sp)
-	if err != nil {
-		return err
+// MakeAuthzDecisionQuery produces a new AuthzDecisionQuery object to send to
+// the policy decision point at pdpURL, asking whether the subject identified
+// by nameID may perform actions on resource.
+func (sp *ServiceProvider) MakeAuthzDecisionQuery(pdpURL string, nameID *NameID, resource string, actions []Action) (*AuthzDecisionQuery, error) {
+	req := AuthzDecisionQuery{
+		ID:           fmt.Sprintf("id-%x", sp.randomBytes(20)),
+		IssueInstant: sp.now(),
+		Version:      "2.0",
+		Destination:  pdpURL,
+		Resource:     resource,
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  firstSet(sp.EntityID, sp.MetadataURL.String()),
+		},
+		Subject: &Subject{
+			NameID: nameID,
+		},
+		Actions: actions,
 	}
-	assertionEl := req.Element()
 
-	signedRequestEl, err := signingContext.SignEnveloped(assertionEl)
-	if err != nil {
-		return err
+	if len(sp.SignatureMethod) > 0 {
+		if err := sp.SignAuthzDecisionQuery(&req); err != nil {
+			return nil, err
+		}
 	}
 
-	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
-	req.Signature = sigEl.(*etree.Element)
-	return nil
+	if err := sp.putRequestID(req.ID); err != nil {
+		return nil, err
+	}
+	sp.requestIssued("AuthzDecisionQuery", req.ID, pdpURL)
+	return &req, nil
 }
 
-// SignAuthnRequest adds the `Signature` element to the `AuthnRequest`.
-func (sp *ServiceProvider) SignAuthnRequest(req *AuthnRequest) error {
-
-	signingContext, err := GetSigningContext(sp)
-	if err != nil {
-		return err
+// MakeAuthnQuery produces a new AuthnQuery object to send to the
+// authentication authority at authnQueryURL, asking for the existing
+// authentication sessions of the subject identified by nameID. If sessionIndex
+// or requestedAuthnContext are specified, only matching sessions are requested.
+func (sp *ServiceProvider) MakeAuthnQuery(authnQueryURL string, nameID *NameID, sessionIndex string, requestedAuthnContext *RequestedAuthnContext) (*AuthnQuery, error) {
+	req := AuthnQuery{
+		ID:           fmt.Sprintf("id-%x", sp.randomBytes(20)),
+		IssueInstant: sp.now(),
+		Version:      "2.0",
+		Destination:  authnQueryURL,
+		SessionIndex: sessionIndex,
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  firstSet(sp.EntityID, sp.MetadataURL.String()),
+		},
+		Subject: &Subject{
+			NameID: nameID,
+		},
+		RequestedAuthnContext: requestedAuthnContext,
 	}
-	assertionEl := req.Element()
 
-	signedRequestEl, err := signingContext.SignEnveloped(assertionEl)
-	if err != nil {
-		return err
+	if len(sp.SignatureMethod) > 0 {
+		if err := sp.SignAuthnQuery(&req); err != nil {
+			return nil, err
+		}
 	}
 
-	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
-	req.Signature = sigEl.(*etree.Element)
-	return nil
-}
-
-// MakePostAuthenticationRequest creates a SAML authentication request using
-// the HTTP-POST binding. It returns HTML text representing an HTML form that
-// can be sent presented to a browser to initiate the login process.
-func (sp *ServiceProvider) MakePostAuthenticationRequest(relayState string) ([]byte, error) {
-	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(HTTPPostBinding), HTTPPostBinding, HTTPPostBinding)
-	if err != nil {
+	if err := sp.putRequestID(req.ID); err != nil {
 		return nil, err
 	}
-	return req.Post(relayState), nil
+	sp.requestIssued("AuthnQuery", req.ID, authnQueryURL)
+	return &req, nil
 }
 
-// Post returns an HTML form suitable for using the HTTP-POST binding with the request
-func (req *AuthnRequest) Post(relayState string) []byte {
-	doc := etree.NewDocument()
-	doc.SetRoot(req.Element())
-	reqBuf, err := doc.WriteToBytes()
-	if err != nil {
-		panic(err)
-	}
-	encodedReqBuf := base64.StdEncoding.EncodeToString(reqBuf)
-
-	tmpl := template.Must(template.New("saml-post-form").Parse(`` +
-		`<form method="post" action="{{.URL}}" id="SAMLRequestForm">` +
-		`<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}" />` +
-		`<input type="hidden" name="RelayState" value="{{.RelayState}}" />` +
-		`<input id="SAMLSubmitButton" type="submit" value="Submit" />` +
-		`</form>` +
-		`<script>document.getElementById('SAMLSubmitButton').style.visibility="hidden";` +
-		`document.getElementById('SAMLRequestForm').submit();</script>`))
-	data := struct {
-		URL         string
-		SAMLRequest string
-		RelayState  string
-	}{
-		URL:         req.Destination,
-		SAMLRequest: encodedReqBuf,
-		RelayState:  relayState,
+// MakeNameIDMappingRequest produces a new NameIDMappingRequest object to send
+// to the IDP's name identifier mapping service at mappingURL, asking for the
+// identifier of the principal identified by nameID as described by
+// nameIDPolicy.
+func (sp *ServiceProvider) MakeNameIDMappingRequest(mappingURL string, nameID *NameID, nameIDPolicy *NameIDPolicy) (*NameIDMappingRequest, error) {
+	req := NameIDMappingRequest{
+		ID:           fmt.Sprintf("id-%x", sp.randomBytes(20)),
+		IssueInstant: sp.now(),
+		Version:      "2.0",
+		Destination:  mappingURL,
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  firstSet(sp.EntityID, sp.MetadataURL.String()),
+		},
+		NameID:       nameID,
+		NameIDPolicy: nameIDPolicy,
 	}
 
-	rv := bytes.Buffer{}
-	if err := tmpl.Execute(&rv, data); err != nil {
-		panic(err)
+	if len(sp.SignatureMethod) > 0 {
+		if err := sp.SignNameIDMappingRequest(&req); err != nil {
+			return nil, err
+		}
 	}
 
-	return rv.Bytes()
+	return &req, nil
 }
 
-// AssertionAttributes is a list of AssertionAttribute
+// MakeManageNameIDRequest produces a new ManageNameIDRequest object to send to
+// the IDP's manage name ID service at idpURL. If terminate is true, the request
+// tells the IDP that nameID will no longer be used; otherwise it tells the IDP
+// that the SP will refer to the principal by newID from now on.
+func (sp *ServiceProvider) MakeManageNameIDRequest(idpURL string, nameID *NameID, newID string, terminate bool) (*ManageNameIDRequest, error) {
+	req := ManageNameIDRequest{
+		ID:           fmt.Sprintf("id-%x", sp.randomBytes(20)),
+		IssueInstant: sp.now(),
+		Version:      "2.0",
+		Destination:  idpURL,
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  firstSet(sp.EntityID, sp.MetadataURL.String()),
+		},
+		NameID: nameID,
+	}
+	if terminate {
+		req.Terminate = &Terminate{}
+	} else {
+		req.NewID = newID
+	}
+
+	if len(sp.SignatureMethod) > 0 {
+		if err := sp.SignManageNameIDRequest(&req); err != nil {
+			return nil, err
+		}
+	}
+
+	return &req, nil
+}
+
+// MakeAuthenticationRequest produces a new AuthnRequest object to send to the idpURL
+// that uses the specified binding (HTTPRedirectBinding or HTTPPostBinding)
+func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string, binding string, resultBinding string) (*AuthnRequest, error) {
+	acsURL := sp.AcsURL.String()
+	if endpoint := sp.defaultAssertionConsumerService(resultBinding); endpoint != nil {
+		acsURL = endpoint.Location
+	}
+	req := AuthnRequest{
+		AssertionConsumerServiceURL: acsURL,
+		Destination:                 idpURL,
+		ProtocolBinding:             resultBinding, // default binding for the response
+		ID:                          fmt.Sprintf("id-%x", sp.randomBytes(20)),
+		IssueInstant:                sp.now(),
+		Version:                     "2.0",
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  firstSet(sp.EntityID, sp.MetadataURL.String()),
+		},
+		NameIDPolicy:          sp.nameIDPolicy(),
+		ForceAuthn:            sp.ForceAuthn,
+		IsPassive:             sp.IsPassive,
+		RequestedAuthnContext: sp.RequestedAuthnContext,
+		Scoping:               sp.Scoping,
+	}
+	if sp.AssertionConsumerServiceIndex != nil {
+		// the index is mutually exclusive with the URL and binding
+		req.AssertionConsumerServiceIndex = strconv.Itoa(*sp.AssertionConsumerServiceIndex)
+		req.AssertionConsumerServiceURL = ""
+		req.ProtocolBinding = ""
+	}
+	if sp.AttributeConsumingServiceIndex != nil {
+		req.AttributeConsumingServiceIndex = strconv.Itoa(*sp.AttributeConsumingServiceIndex)
+	}
+	if len(sp.AuthnRequestExtensions) > 0 {
+		req.Extensions = &Extensions{Elements: sp.AuthnRequestExtensions}
+	}
+	if sp.ModifyAuthnRequest != nil {
+		if err := sp.ModifyAuthnRequest(&req); err != nil {
+			return nil, err
+		}
+	}
+	// We don't need to sign the XML document if the IDP uses HTTP-Redirect binding
+	if len(sp.SignatureMethod) > 0 && (binding == HTTPPostBinding || binding == SOAPBinding) {
+		if err := sp.SignAuthnRequest(&req); err != nil {
+			return nil, err
+		}
+	}
+	if err := sp.putRequestID(req.ID); err != nil {
+		return nil, err
+	}
+	sp.requestIssued("AuthnRequest", req.ID, idpURL)
+	return &req, nil
+}
+
+// IDPInitiatedRedirectURI returns the URI to send the user to after an
+// unsolicited response with the given RelayState: the RelayState itself if
+// it is one of IDPInitiatedRelayStates, otherwise DefaultRedirectURI.
+func (sp *ServiceProvider) IDPInitiatedRedirectURI(relayState string) string {
+	if relayState == "" {
+		return sp.DefaultRedirectURI
+	}
+	for _, allowed := range sp.IDPInitiatedRelayStates {
+		if relayState == allowed {
+			return relayState
+		}
+		if prefix := strings.TrimSuffix(allowed, "*"); prefix != allowed && strings.HasPrefix(relayState, prefix) {
+			return relayState
+		}
+	}
+	return sp.DefaultRedirectURI
+}
+
+// putRequestID records id in sp.RequestIDStore, if there is one.
+func (sp *ServiceProvider) putRequestID(id string) error {
+	if sp.RequestIDStore == nil {
+		return nil
+	}
+	return sp.requestIDStore().PutRequestID(id, sp.now().Add(sp.maxIssueDelay()))
+}
+
+// takeRequestID removes id from sp.RequestIDStore, if there is one, and
+// reports whether it was the ID of an outstanding request.
+func (sp *ServiceProvider) takeRequestID(id string) (bool, error) {
+	if sp.RequestIDStore == nil || id == "" {
+		return false, nil
+	}
+	err := sp.requestIDStore().TakeRequestID(id)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DecryptionKey is a private key used by a ServiceProvider to decrypt
+// assertions, together with the certificate that carries its public key.
+type DecryptionKey struct {
+	Key         crypto.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// decryptionKeys returns the private keys used to decrypt assertions and
+// identifiers, in the order they are tried.
+func (sp *ServiceProvider) decryptionKeys() []crypto.PrivateKey {
+	if len(sp.DecryptionKeys) == 0 {
+		return []crypto.PrivateKey{sp.Key}
+	}
+	keys := make([]crypto.PrivateKey, len(sp.DecryptionKeys))
+	for i, decryptionKey := range sp.DecryptionKeys {
+		keys[i] = decryptionKey.Key
+	}
+	return keys
+}
+
+// GetSigningContext returns a dsig.SigningContext initialized based on the Service Provider's configuration
+func GetSigningContext(sp *ServiceProvider) (*dsig.SigningContext, error) {
+	signatureMethod := sp.signatureMethod()
+	if !isSupportedSignatureMethod(signatureMethod) {
+		return nil, fmt.Errorf("invalid signing method %s", signatureMethod)
+	}
+	if sp.SigningKeys != nil {
+		key, cert := sp.SigningKeys.Active()
+		return newSigningContext(key, cert, nil, signatureMethod)
+	}
+	return newSigningContext(sp.Key, sp.Certificate, sp.Intermediates, signatureMethod)
+}
+
+// signatureMethod returns the signature method to sign messages to the IDP
+// with. That is SignatureMethod unless the IDP metadata declares the
+// signature algorithms that the IDP supports and SignatureMethod is not one
+// of them, in which case it is the first of them that can be used with the
+// signing key.
+func (sp *ServiceProvider) signatureMethod() string {
+	idpMetadata := sp.idpMetadata()
+	if sp.SignatureMethod == "" || !isSupportedSignatureMethod(sp.SignatureMethod) || idpMetadata == nil {
+		return sp.SignatureMethod
+	}
+	idpSigningMethods := idpMetadata.SigningMethods()
+	if len(idpSigningMethods) == 0 {
+		return sp.SignatureMethod
+	}
+	for _, signingMethod := range idpSigningMethods {
+		if signingMethod.Algorithm == sp.SignatureMethod {
+			return sp.SignatureMethod
+		}
+	}
+
+	key := sp.Key
+	if sp.SigningKeys != nil {
+		key, _ = sp.SigningKeys.Active()
+	}
+	for _, signingMethod := range idpSigningMethods {
+		if isSupportedSignatureMethod(signingMethod.Algorithm) && signatureMethodMatchesKey(signingMethod.Algorithm, key) {
+			return signingMethod.Algorithm
+		}
+	}
+	return sp.SignatureMethod
+}
+
+// isSupportedSignatureMethod returns true if signatureMethod may be used
+// to sign the messages of a ServiceProvider.
+func isSupportedSignatureMethod(signatureMethod string) bool {
+	switch signatureMethod {
+	case dsig.RSASHA1SignatureMethod, dsig.RSASHA256SignatureMethod, dsig.RSASHA512SignatureMethod,
+		dsig.ECDSASHA256SignatureMethod, dsig.ECDSASHA384SignatureMethod, dsig.ECDSASHA512SignatureMethod:
+		return true
+	}
+	return false
+}
+
+// SignArtifactResolve adds the `Signature` element to the `ArtifactResolve`.
+func (sp *ServiceProvider) SignArtifactResolve(req *ArtifactResolve) error {
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
+		return err
+	}
+	assertionEl := req.Element()
+
+	signedRequestEl, err := signingContext.SignEnveloped(assertionEl)
+	if err != nil {
+		return err
+	}
+
+	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
+	req.Signature = sigEl.(*etree.Element)
+	return nil
+}
+
+// SignAttributeQuery adds the `Signature` element to the `AttributeQuery`.
+func (sp *ServiceProvider) SignAttributeQuery(req *AttributeQuery) error {
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
+		return err
+	}
+	requestEl := req.Element()
+
+	signedRequestEl, err := signingContext.SignEnveloped(requestEl)
+	if err != nil {
+		return err
+	}
+
+	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
+	req.Signature = sigEl.(*etree.Element)
+	return nil
+}
+
+// SignAuthzDecisionQuery adds the `Signature` element to the `AuthzDecisionQuery`.
+func (sp *ServiceProvider) SignAuthzDecisionQuery(req *AuthzDecisionQuery) error {
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
+		return err
+	}
+	requestEl := req.Element()
+
+	signedRequestEl, err := signingContext.SignEnveloped(requestEl)
+	if err != nil {
+		return err
+	}
+
+	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
+	req.Signature = sigEl.(*etree.Element)
+	return nil
+}
+
+// SignAuthnQuery adds the `Signature` element to the `AuthnQuery`.
+func (sp *ServiceProvider) SignAuthnQuery(req *AuthnQuery) error {
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
+		return err
+	}
+	requestEl := req.Element()
+
+	signedRequestEl, err := signingContext.SignEnveloped(requestEl)
+	if err != nil {
+		return err
+	}
+
+	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
+	req.Signature = sigEl.(*etree.Element)
+	return nil
+}
+
+// SignNameIDMappingRequest adds the `Signature` element to the `NameIDMappingRequest`.
+func (sp *ServiceProvider) SignNameIDMappingRequest(req *NameIDMappingRequest) error {
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
+		return err
+	}
+	requestEl := req.Element()
+
+	signedRequestEl, err := signingContext.SignEnveloped(requestEl)
+	if err != nil {
+		return err
+	}
+
+	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
+	req.Signature = sigEl.(*etree.Element)
+	return nil
+}
+
+// SignManageNameIDRequest adds the `Signature` element to the `ManageNameIDRequest`.
+func (sp *ServiceProvider) SignManageNameIDRequest(req *ManageNameIDRequest) error {
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
+		return err
+	}
+	requestEl := req.Element()
+
+	signedRequestEl, err := signingContext.SignEnveloped(requestEl)
+	if err != nil {
+		return err
+	}
+
+	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
+	req.Signature = sigEl.(*etree.Element)
+	return nil
+}
+
+// SignAuthnRequest adds the `Signature` element to the `AuthnRequest`.
+func (sp *ServiceProvider) SignAuthnRequest(req *AuthnRequest) error {
+
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
+		return err
+	}
+	assertionEl := req.Element()
+
+	signedRequestEl, err := signingContext.SignEnveloped(assertionEl)
+	if err != nil {
+		return err
+	}
+
+	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
+	req.Signature = sigEl.(*etree.Element)
+	return nil
+}
+
+// MakePostAuthenticationRequest creates a SAML authentication request using
+// the HTTP-POST binding. It returns HTML text representing an HTML form that
+// can be sent presented to a browser to initiate the login process.
+func (sp *ServiceProvider) MakePostAuthenticationRequest(relayState string) ([]byte, error) {
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(HTTPPostBinding), HTTPPostBinding, HTTPPostBinding)
+	if err != nil {
+		return nil, err
+	}
+	return req.Post(relayState), nil
+}
+
+// Post returns an HTML form suitable for using the HTTP-POST binding with the request
+func (req *AuthnRequest) Post(relayState string) []byte {
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Element())
+	reqBuf, err := doc.WriteToBytes()
+	if err != nil {
+		panic(err)
+	}
+	encodedReqBuf := base64.StdEncoding.EncodeToString(reqBuf)
+
+	tmpl := template.Must(template.New("saml-post-form").Parse(`` +
+		`<form method="post" action="{{.URL}}" id="SAMLRequestForm">` +
+		`<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}" />` +
+		`<input type="hidden" name="RelayState" value="{{.RelayState}}" />` +
+		`<input id="SAMLSubmitButton" type="submit" value="Submit" />` +
+		`</form>` +
+		`<script>document.getElementById('SAMLSubmitButton').style.visibility="hidden";` +
+		`document.getElementById('SAMLRequestForm').submit();</script>`))
+	data := struct {
+		URL         string
+		SAMLRequest string
+		RelayState  string
+	}{
+		URL:         req.Destination,
+		SAMLRequest: encodedReqBuf,
+		RelayState:  relayState,
+	}
+
+	rv := bytes.Buffer{}
+	if err := tmpl.Execute(&rv, data); err != nil {
+		panic(err)
+	}
+
+	return rv.Bytes()
+}
+
+// AssertionAttributes is a list of AssertionAttribute
 type AssertionAttributes []AssertionAttribute
 
 // Get returns the assertion attribute whose Name or FriendlyName
@@ -582,16 +1485,34 @@ func (ivr *InvalidResponseError) Error() string {
 	return fmt.Sprintf("Authentication failed")
 }
 
+// Unwrap returns PrivateErr, so that errors.Is and errors.As can tell why
+// the response is invalid.
+func (ivr *InvalidResponseError) Unwrap() error {
+	return ivr.PrivateErr
+}
+
 // ErrBadStatus is returned when the assertion provided is valid but the
 // status code is not "urn:oasis:names:tc:SAML:2.0:status:Success".
+//
+// SubStatus is the second-level status code, if there is one, which tells
+// why the request failed, e.g. StatusNoPassive.
 type ErrBadStatus struct {
-	Status string
+	Status    string
+	SubStatus string
 }
 
 func (e ErrBadStatus) Error() string {
 	return e.Status
 }
 
+func newErrBadStatus(status Status) ErrBadStatus {
+	rv := ErrBadStatus{Status: status.StatusCode.Value}
+	if status.StatusCode.StatusCode != nil {
+		rv.SubStatus = status.StatusCode.StatusCode.Value
+	}
+	return rv
+}
+
 func responseIsSigned(response *etree.Element) (bool, error) {
 	signatureElement, err := findChild(response, "http://www.w3.org/2000/09/xmldsig#", "Signature")
 	if err != nil {
@@ -600,19 +1521,132 @@ func responseIsSigned(response *etree.Element) (bool, error) {
 	return signatureElement != nil, nil
 }
 
-// validateDestination validates the Destination attribute.
-// If the response is signed, the Destination is required to be present.
-func (sp *ServiceProvider) validateDestination(response *etree.Element, responseDom *Response) error {
-	signed, err := responseIsSigned(response)
-	if err != nil {
-		return err
+// assertionConsumerServices returns the assertion consumer service
+// endpoints published in the metadata.
+func (sp *ServiceProvider) assertionConsumerServices() []IndexedEndpoint {
+	if len(sp.AssertionConsumerServices) > 0 {
+		return sp.AssertionConsumerServices
+	}
+	rv := []IndexedEndpoint{
+		{
+			Binding:  HTTPPostBinding,
+			Location: sp.AcsURL.String(),
+			Index:    1,
+		},
+		{
+			Binding:  HTTPArtifactBinding,
+			Location: sp.AcsURL.String(),
+			Index:    2,
+		},
+	}
+	if sp.AllowECP {
+		rv = append(rv, IndexedEndpoint{
+			Binding:  PAOSBinding,
+			Location: sp.AcsURL.String(),
+			Index:    3,
+		})
+	}
+	return rv
+}
+
+// defaultAssertionConsumerService returns the default assertion consumer
+// service endpoint with the given binding, or nil if there is none. As in
+// http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf §2.2.3,
+// that is the first endpoint with isDefault set to true, or else the first
+// without isDefault set to false, or else the first endpoint.
+func (sp *ServiceProvider) defaultAssertionConsumerService(binding string) *IndexedEndpoint {
+	var first, implicit *IndexedEndpoint
+	for _, endpoint := range sp.assertionConsumerServices() {
+		if endpoint.Binding != binding {
+			continue
+		}
+		endpoint := endpoint
+		if endpoint.IsDefault != nil && *endpoint.IsDefault {
+			return &endpoint
+		}
+		if first == nil {
+			first = &endpoint
+		}
+		if implicit == nil && endpoint.IsDefault == nil {
+			implicit = &endpoint
+		}
+	}
+	if implicit != nil {
+		return implicit
+	}
+	return first
+}
+
+// isAcsURL returns true if location is AcsURL or the location of one of the
+// assertion consumer service endpoints published in the metadata.
+func (sp *ServiceProvider) isAcsURL(location string) bool {
+	if location == sp.AcsURL.String() {
+		return true
+	}
+	for _, endpoint := range sp.assertionConsumerServices() {
+		if endpoint.Location == location {
+			return true
+		}
+	}
+	return false
+}
+
+// isAcceptedDestination returns true if location is the location of an
+// assertion consumer service, one of AcceptedDestinations, or accepted by
+// AcceptDestination.
+func (sp *ServiceProvider) isAcceptedDestination(location string) bool {
+	if sp.isAcsURL(location) {
+		return true
+	}
+	for _, destination := range sp.AcceptedDestinations {
+		if destination == location {
+			return true
+		}
+	}
+	return sp.AcceptDestination != nil && sp.AcceptDestination(location)
+}
+
+// isAcceptedAudience returns true if audience is the entity ID of the SP,
+// one of AcceptedAudiences, or accepted by AcceptAudience.
+func (sp *ServiceProvider) isAcceptedAudience(audience string) bool {
+	if audience == firstSet(sp.EntityID, sp.MetadataURL.String()) {
+		return true
+	}
+	for _, acceptedAudience := range sp.AcceptedAudiences {
+		if acceptedAudience == audience {
+			return true
+		}
+	}
+	return sp.AcceptAudience != nil && sp.AcceptAudience(audience)
+}
+
+// isTrustedIssuer returns true if issuer is the entity ID of the IDP, one
+// of AdditionalTrustedIssuers, or accepted by AcceptIssuer.
+func (sp *ServiceProvider) isTrustedIssuer(issuer string) bool {
+	if issuer == sp.idpMetadata().EntityID {
+		return true
+	}
+	for _, trustedIssuer := range sp.AdditionalTrustedIssuers {
+		if trustedIssuer == issuer {
+			return true
+		}
+	}
+	return sp.AcceptIssuer != nil && sp.AcceptIssuer(issuer)
+}
+
+// validateDestination validates the Destination attribute.
+// If the response is signed, the Destination is required to be present.
+func (sp *ServiceProvider) validateDestination(response *etree.Element, responseDom *Response) error {
+	signed, err := responseIsSigned(response)
+	if err != nil {
+		return err
 	}
 
 	// Compare if the response is signed OR the Destination is provided.
 	// (Even if the response is not signed, if the Destination is set it must match.)
 	if signed || responseDom.Destination != "" {
-		if responseDom.Destination != sp.AcsURL.String() {
-			return fmt.Errorf("`Destination` does not match AcsURL (expected %q, actual %q)", sp.AcsURL.String(), responseDom.Destination)
+		if !sp.isAcceptedDestination(responseDom.Destination) {
+			return errorOfKind(ErrWrongDestination, "`Destination` does not match AcsURL (expected %q, actual %q)", sp.AcsURL.String(), responseDom.Destination)
 		}
 	}
 
@@ -621,8 +1655,27 @@ func (sp *ServiceProvider) validateDestination(response *etree.Element, response
 
 // ParseResponse extracts the SAML IDP response received in req, resolves
 // artifacts when necessary, validates it, and returns the verified assertion.
+//
+// An assertion whose subject is confirmed with the holder-of-key method is
+// only accepted if req was sent with one of the TLS client certificates it
+// names. The other methods that parse responses do not see the client, and
+// reject such assertions.
 func (sp *ServiceProvider) ParseResponse(req *http.Request, possibleRequestIDs []string) (*Assertion, error) {
-	now := TimeNow()
+	ctx, span := startSpan(withPresentingRequest(req.Context(), req), sp.Tracer, "saml.ServiceProvider.ParseResponse")
+	span.SetAttribute(AttributeIDPEntityID, sp.idpMetadata().EntityID)
+	if req.Form.Get("SAMLart") != "" {
+		span.SetAttribute(AttributeBinding, HTTPArtifactBinding)
+	} else {
+		span.SetAttribute(AttributeBinding, HTTPPostBinding)
+	}
+	assertion, err := sp.parseResponse(ctx, req, possibleRequestIDs)
+	span.End(err)
+	return assertion, err
+}
+
+func (sp *ServiceProvider) parseResponse(ctx context.Context, req *http.Request, possibleRequestIDs []string) (*Assertion, error) {
+	start := time.Now()
+	now := sp.now()
 
 	var assertion *Assertion
 
@@ -634,148 +1687,944 @@ func (sp *ServiceProvider) ParseResponse(req *http.Request, possibleRequestIDs [
 	if req.Form.Get("SAMLart") != "" {
 		retErr.Response = req.Form.Get("SAMLart")
 
-		req, err := sp.MakeArtifactResolveRequest(req.Form.Get("SAMLart"))
+		artifact, err := ParseArtifact(req.Form.Get("SAMLart"))
 		if err != nil {
-			retErr.PrivateErr = fmt.Errorf("Cannot generate artifact resolution request: %s", err)
-			return nil, retErr
+			retErr.PrivateErr = err
+			return nil, sp.rejectResponse(start, retErr)
 		}
-
-		doc := etree.NewDocument()
-		doc.SetRoot(req.SoapRequest())
-
-		var requestBuffer bytes.Buffer
-		doc.WriteTo(&requestBuffer)
-		client := sp.HTTPClient
-		if client == nil {
-			client = http.DefaultClient
-		}
-		response, err := client.Post(sp.GetArtifactBindingLocation(SOAPBinding), "text/xml", &requestBuffer)
+		location, err := sp.GetArtifactResolutionLocation(artifact, SOAPBinding)
 		if err != nil {
-			retErr.PrivateErr = fmt.Errorf("Error during artifact resolution: %s", err)
-			return nil, retErr
+			retErr.PrivateErr = err
+			return nil, sp.rejectResponse(start, retErr)
 		}
-		defer response.Body.Close()
-		if response.StatusCode != 200 {
-			retErr.PrivateErr = fmt.Errorf("Error during artifact resolution: HTTP status %d (%s)", response.StatusCode, response.Status)
-			return nil, retErr
+
+		req, err := sp.MakeArtifactResolveRequest(req.Form.Get("SAMLart"))
+		if err != nil {
+			retErr.PrivateErr = fmt.Errorf("Cannot generate artifact resolution request: %s", err)
+			return nil, sp.rejectResponse(start, retErr)
 		}
-		rawResponseBuf, err := ioutil.ReadAll(response.Body)
+
+		resolveCtx, span := startSpan(ctx, sp.Tracer, "saml.ServiceProvider.ResolveArtifact")
+		span.SetAttribute(AttributeIDPEntityID, sp.idpMetadata().EntityID)
+		span.SetAttribute(AttributeMessageID, req.ID)
+		rawResponseBuf, err := sp.postSOAPContext(resolveCtx, location, req.SoapRequest())
+		span.End(err)
 		if err != nil {
 			retErr.PrivateErr = fmt.Errorf("Error during artifact resolution: %s", err)
-			return nil, retErr
+			return nil, sp.rejectResponse(start, retErr)
 		}
-		assertion, err = sp.ParseXMLArtifactResponse(rawResponseBuf, possibleRequestIDs, req.ID)
+		assertion, err = sp.parseXMLArtifactResponseContext(ctx, rawResponseBuf, possibleRequestIDs, req.ID)
 		if err != nil {
 			return nil, err
 		}
 	} else {
 		rawResponseBuf, err := base64.StdEncoding.DecodeString(req.PostForm.Get("SAMLResponse"))
 		if err != nil {
-			retErr.PrivateErr = fmt.Errorf("cannot parse base64: %s", err)
-			return nil, retErr
+			retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "cannot parse base64: %s", err)
+			return nil, sp.rejectResponse(start, retErr)
 		}
 		retErr.Response = string(rawResponseBuf)
-		assertion, err = sp.ParseXMLResponse(rawResponseBuf, possibleRequestIDs)
+		assertion, err = sp.parseXMLResponseContext(ctx, rawResponseBuf, possibleRequestIDs)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return assertion, nil
-
-}
-
-// ParseXMLArtifactResponse validates the SAML Artifact resolver response
-// and returns the verified assertion.
-//
-// This function handles verifying the digital signature, and verifying
-// that the specified conditions and properties are met.
-//
-// If the function fails it will return an InvalidResponseError whose
-// properties are useful in describing which part of the parsing process
-// failed. However, to discourage inadvertent disclosure the diagnostic
-// information, the Error() method returns a static string.
-func (sp *ServiceProvider) ParseXMLArtifactResponse(decodedResponseXML []byte, possibleRequestIDs []string, artifactRequestID string) (*Assertion, error) {
-	now := TimeNow()
-	//var err error
-	retErr := &InvalidResponseError{
-		Now:      now,
-		Response: string(decodedResponseXML),
+	return assertion, nil
+
+}
+
+// rejectResponse reports a response that was rejected before it could be
+// parsed to sp.EventSink, and returns err.
+func (sp *ServiceProvider) rejectResponse(start time.Time, err error) error {
+	sp.responseProcessed(start, noopSpan{}, nil, nil, err)
+	return err
+}
+
+// ParseXMLArtifactResponse validates the SAML Artifact resolver response
+// and returns the verified assertion.
+//
+// This function handles verifying the digital signature, and verifying
+// that the specified conditions and properties are met.
+//
+// If the function fails it will return an InvalidResponseError whose
+// properties are useful in describing which part of the parsing process
+// failed. However, to discourage inadvertent disclosure the diagnostic
+// information, the Error() method returns a static string.
+func (sp *ServiceProvider) ParseXMLArtifactResponse(decodedResponseXML []byte, possibleRequestIDs []string, artifactRequestID string) (*Assertion, error) {
+	return sp.parseXMLArtifactResponseContext(context.Background(), decodedResponseXML, possibleRequestIDs, artifactRequestID)
+}
+
+func (sp *ServiceProvider) parseXMLArtifactResponseContext(ctx context.Context, decodedResponseXML []byte, possibleRequestIDs []string, artifactRequestID string) (*Assertion, error) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, sp.Tracer, "saml.ServiceProvider.ParseXMLArtifactResponse")
+	assertion, err := sp.parseXMLArtifactResponse(ctx, decodedResponseXML, possibleRequestIDs, artifactRequestID)
+	sp.responseProcessed(start, span, decodedResponseXML, assertion, err)
+	return assertion, err
+}
+
+func (sp *ServiceProvider) parseXMLArtifactResponse(ctx context.Context, decodedResponseXML []byte, possibleRequestIDs []string, artifactRequestID string) (*Assertion, error) {
+	now := sp.now()
+	//var err error
+	retErr := &InvalidResponseError{
+		Now:      now,
+		Response: string(decodedResponseXML),
+	}
+
+	// ensure that the response XML is well formed before we parse it
+	if err := xrv.Validate(bytes.NewReader(decodedResponseXML)); err != nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "invalid xml: %s", err)
+		return nil, retErr
+	}
+	if err := sp.checkStructure(decodedResponseXML); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+
+	envelope := &struct {
+		XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+		Body    struct {
+			ArtifactResponse ArtifactResponse
+		} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	}{}
+	if err := xml.Unmarshal(decodedResponseXML, &envelope); err != nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "cannot unmarshal response: %s", err)
+		return nil, retErr
+	}
+
+	resp := envelope.Body.ArtifactResponse
+
+	// Validate ArtifactResponse
+	if resp.InResponseTo != artifactRequestID {
+		retErr.PrivateErr = errorOfKind(ErrStaleInResponseTo, "`InResponseTo` does not match the artifact request ID (expected %v)", artifactRequestID)
+		return nil, retErr
+	}
+	if resp.IssueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		retErr.PrivateErr = errorOfKind(ErrExpiredResponse, "response IssueInstant expired at %s", resp.IssueInstant.Add(sp.maxIssueDelay()))
+		return nil, retErr
+	}
+	if resp.Issuer != nil && !sp.isTrustedIssuer(resp.Issuer.Value) {
+		retErr.PrivateErr = errorOfKind(ErrWrongIssuer, "response Issuer does not match the IDP metadata (expected %q)", sp.idpMetadata().EntityID)
+		return nil, retErr
+	}
+	if resp.Status.StatusCode.Value != StatusSuccess {
+		retErr.PrivateErr = newErrBadStatus(resp.Status)
+		return nil, retErr
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(decodedResponseXML); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+
+	artifactEl := doc.FindElement("Envelope/Body/ArtifactResponse")
+	if artifactEl == nil {
+		retErr.PrivateErr = fmt.Errorf("missing ArtifactResponse")
+		return nil, retErr
+	}
+	responseEl := doc.FindElement("Envelope/Body/ArtifactResponse/Response")
+	if responseEl == nil {
+		retErr.PrivateErr = fmt.Errorf("missing inner Response")
+		return nil, retErr
+	}
+
+	if err := sp.traceSignature(ctx, artifactEl, sp.validateArtifactSigned); err != nil && !errors.Is(err, ErrMissingSignature) {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	// the signatures of the Response and Assertion, if any, are verified
+	// again by validateXMLResponse
+	artifactSigned, err := responseIsSigned(artifactEl)
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	assertion, updatedResponse, err := sp.validateXMLResponse(ctx, &resp.Response, responseEl, possibleRequestIDs, now, !artifactSigned)
+	if err != nil {
+		retErr.PrivateErr = err
+		if updatedResponse != nil {
+			retErr.Response = *updatedResponse
+		}
+		return nil, retErr
+	}
+
+	return assertion, nil
+}
+
+// QueryAttributes sends an AttributeQuery for the subject identified by nameID
+// to the IDP's attribute service using the SOAP binding and returns the
+// verified assertion from the response.
+func (sp *ServiceProvider) QueryAttributes(nameID *NameID, attributes []Attribute) (*Assertion, error) {
+	ctx, span := startSpan(context.Background(), sp.Tracer, "saml.ServiceProvider.QueryAttributes")
+	span.SetAttribute(AttributeIDPEntityID, sp.idpMetadata().EntityID)
+	span.SetAttribute(AttributeBinding, SOAPBinding)
+	assertion, err := sp.queryAttributes(ctx, span, nameID, attributes)
+	span.End(err)
+	return assertion, err
+}
+
+func (sp *ServiceProvider) queryAttributes(ctx context.Context, span Span, nameID *NameID, attributes []Attribute) (*Assertion, error) {
+	req, err := sp.MakeAttributeQuery(sp.GetAttributeServiceLocation(SOAPBinding), nameID, attributes)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttribute(AttributeMessageID, req.ID)
+
+	rawResponseBuf, err := sp.postSOAPContext(ctx, req.Destination, req.SoapRequest())
+	if err != nil {
+		return nil, fmt.Errorf("error during attribute query: %s", err)
+	}
+	return sp.ParseXMLAttributeQueryResponse(rawResponseBuf, req)
+}
+
+// ParseXMLAttributeQueryResponse parses and validates the SOAP response to
+// query and returns the verified assertion.
+//
+// In addition to the signature and conditions of the response, this function
+// verifies that the assertion is about the subject of the query and that any
+// attribute which was requested with specific values was returned with only
+// those values. Signatures are verified with the keys of the attribute
+// authority of the IDP, or with those of its SSO descriptor if the
+// attribute authority has none.
+//
+// Only the first assertion in the response is considered. To receive every
+// assertion, use ParseXMLAttributeQueryResponseAssertions.
+//
+// If the function fails it will return an InvalidResponseError whose
+// properties are useful in describing which part of the parsing process
+// failed. However, to discourage inadvertent disclosure the diagnostic
+// information, the Error() method returns a static string.
+func (sp *ServiceProvider) ParseXMLAttributeQueryResponse(decodedResponseXML []byte, query *AttributeQuery) (*Assertion, error) {
+	start := time.Now()
+	assertion, err := sp.parseXMLAttributeQueryResponse(decodedResponseXML, query)
+	sp.attributeQueryProcessed(start, query, err)
+	return assertion, err
+}
+
+func (sp *ServiceProvider) parseXMLAttributeQueryResponse(decodedResponseXML []byte, query *AttributeQuery) (*Assertion, error) {
+	retErr := &InvalidResponseError{
+		Now:      sp.now(),
+		Response: string(decodedResponseXML),
+	}
+
+	result, err := sp.parseXMLQueryResponse(decodedResponseXML, attributeAuthorityRole, query.ID, query.Subject, query.validateAssertion, retErr.Now)
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	if len(result.Assertions) == 0 {
+		retErr.PrivateErr = errors.New("response does not contain an assertion")
+		return nil, retErr
+	}
+	if !result.Assertions[0].Verified {
+		retErr.PrivateErr = result.Assertions[0].Err
+		return nil, retErr
+	}
+	return result.Assertions[0].Assertion, nil
+}
+
+// QueryResponse is the parsed response to a query such as an AttributeQuery.
+// An attribute authority may return more than one assertion, for example one
+// for each of its attribute sources.
+type QueryResponse struct {
+	// Response is the verified Response. Its Assertion and EncryptedAssertion
+	// fields are cleared; the assertions are available in Assertions.
+	Response *Response
+
+	// Assertions holds every assertion in the response, in document order,
+	// including those which failed validation.
+	Assertions []QueryAssertion
+}
+
+// QueryAssertion is an assertion returned in response to a query.
+type QueryAssertion struct {
+	// Assertion is the (decrypted) assertion. It is nil if an encrypted
+	// assertion could not be decrypted.
+	Assertion *Assertion
+
+	// Verified is true if the signature and conditions of the assertion were
+	// validated. Assertions which are not verified must not be trusted.
+	Verified bool
+
+	// Err describes why validation failed if Verified is false.
+	Err error
+}
+
+// VerifiedAssertions returns the assertions of r which passed validation.
+func (r *QueryResponse) VerifiedAssertions() []*Assertion {
+	var assertions []*Assertion
+	for _, a := range r.Assertions {
+		if a.Verified {
+			assertions = append(assertions, a.Assertion)
+		}
+	}
+	return assertions
+}
+
+// ParseXMLAttributeQueryResponseAssertions parses and validates the SOAP
+// response to query and returns the Response together with all of the
+// assertions it contains.
+//
+// An error is returned if the Response itself is invalid. Each assertion is
+// then validated as described for ParseXMLAttributeQueryResponse, and the
+// outcome is recorded on the assertion rather than failing the whole response.
+//
+// If the function fails it will return an InvalidResponseError whose
+// properties are useful in describing which part of the parsing process
+// failed. However, to discourage inadvertent disclosure the diagnostic
+// information, the Error() method returns a static string.
+func (sp *ServiceProvider) ParseXMLAttributeQueryResponseAssertions(decodedResponseXML []byte, query *AttributeQuery) (*QueryResponse, error) {
+	retErr := &InvalidResponseError{
+		Now:      sp.now(),
+		Response: string(decodedResponseXML),
+	}
+
+	result, err := sp.parseXMLQueryResponse(decodedResponseXML, attributeAuthorityRole, query.ID, query.Subject, query.validateAssertion, retErr.Now)
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	return result, nil
+}
+
+// QueryAuthzDecision sends an AuthzDecisionQuery for the subject identified
+// by nameID to the IDP's authorization decision service using the SOAP binding
+// and returns the verified decision.
+func (sp *ServiceProvider) QueryAuthzDecision(nameID *NameID, resource string, actions []Action) (*AuthzDecisionStatement, error) {
+	req, err := sp.MakeAuthzDecisionQuery(sp.GetAuthzServiceLocation(SOAPBinding), nameID, resource, actions)
+	if err != nil {
+		return nil, err
+	}
+
+	rawResponseBuf, err := sp.postSOAP(req.Destination, req.SoapRequest())
+	if err != nil {
+		return nil, fmt.Errorf("error during authorization decision query: %s", err)
+	}
+	return sp.ParseXMLAuthzDecisionQueryResponse(rawResponseBuf, req)
+}
+
+// ParseXMLAuthzDecisionQueryResponse parses and validates the SOAP response to
+// query and returns the AuthzDecisionStatement from the first verified
+// assertion.
+//
+// If the function fails it will return an InvalidResponseError whose
+// properties are useful in describing which part of the parsing process
+// failed. However, to discourage inadvertent disclosure the diagnostic
+// information, the Error() method returns a static string.
+func (sp *ServiceProvider) ParseXMLAuthzDecisionQueryResponse(decodedResponseXML []byte, query *AuthzDecisionQuery) (*AuthzDecisionStatement, error) {
+	retErr := &InvalidResponseError{
+		Now:      sp.now(),
+		Response: string(decodedResponseXML),
+	}
+
+	result, err := sp.parseXMLQueryResponse(decodedResponseXML, pdpRole, query.ID, query.Subject, query.validateAssertion, retErr.Now)
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	for _, a := range result.Assertions {
+		if !a.Verified {
+			retErr.PrivateErr = a.Err
+			return nil, retErr
+		}
+		if len(a.Assertion.AuthzDecisionStatements) > 0 {
+			return &a.Assertion.AuthzDecisionStatements[0], nil
+		}
+	}
+	retErr.PrivateErr = errors.New("response does not contain an AuthzDecisionStatement")
+	return nil, retErr
+}
+
+// validateAssertion checks that the authorization decisions in assertion
+// concern the resource that was queried.
+func (r *AuthzDecisionQuery) validateAssertion(assertion *Assertion) error {
+	for _, statement := range assertion.AuthzDecisionStatements {
+		if statement.Resource != r.Resource {
+			return fmt.Errorf("AuthzDecisionStatement Resource %q does not match the query", statement.Resource)
+		}
+	}
+	return nil
+}
+
+// QueryAuthnSession sends an AuthnQuery for the subject identified by nameID
+// to the IDP's authentication query service using the SOAP binding. It returns
+// the verified assertion describing the subject's authentication session, or
+// nil if the IDP has no matching session.
+func (sp *ServiceProvider) QueryAuthnSession(nameID *NameID, sessionIndex string, requestedAuthnContext *RequestedAuthnContext) (*Assertion, error) {
+	req, err := sp.MakeAuthnQuery(sp.GetAuthnQueryServiceLocation(SOAPBinding), nameID, sessionIndex, requestedAuthnContext)
+	if err != nil {
+		return nil, err
+	}
+
+	rawResponseBuf, err := sp.postSOAP(req.Destination, req.SoapRequest())
+	if err != nil {
+		return nil, fmt.Errorf("error during authentication query: %s", err)
+	}
+	return sp.ParseXMLAuthnQueryResponse(rawResponseBuf, req)
+}
+
+// ParseXMLAuthnQueryResponse parses and validates the SOAP response to query
+// and returns the first verified assertion. Each AuthnStatement in the
+// assertion must match the SessionIndex and RequestedAuthnContext of the
+// query. If the response contains no assertion, meaning that the IDP has no
+// matching session, the returned assertion is nil.
+//
+// If the function fails it will return an InvalidResponseError whose
+// properties are useful in describing which part of the parsing process
+// failed. However, to discourage inadvertent disclosure the diagnostic
+// information, the Error() method returns a static string.
+func (sp *ServiceProvider) ParseXMLAuthnQueryResponse(decodedResponseXML []byte, query *AuthnQuery) (*Assertion, error) {
+	retErr := &InvalidResponseError{
+		Now:      sp.now(),
+		Response: string(decodedResponseXML),
+	}
+
+	result, err := sp.parseXMLQueryResponse(decodedResponseXML, authnAuthorityRole, query.ID, query.Subject, query.validateAssertion, retErr.Now)
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	if len(result.Assertions) == 0 {
+		return nil, nil
+	}
+	if !result.Assertions[0].Verified {
+		retErr.PrivateErr = result.Assertions[0].Err
+		return nil, retErr
+	}
+	return result.Assertions[0].Assertion, nil
+}
+
+// validateAssertion checks that the authentication statements in assertion
+// match the session index and authentication context of the query. Only the
+// "exact" comparison of authentication contexts is checked; the ordering of
+// contexts for the other comparison types is specific to the IDP.
+func (r *AuthnQuery) validateAssertion(assertion *Assertion) error {
+	if len(assertion.AuthnStatements) == 0 {
+		return errors.New("assertion does not contain an AuthnStatement")
+	}
+	for _, statement := range assertion.AuthnStatements {
+		if r.SessionIndex != "" && statement.SessionIndex != r.SessionIndex {
+			return fmt.Errorf("AuthnStatement SessionIndex %q does not match the query", statement.SessionIndex)
+		}
+		if r.RequestedAuthnContext == nil {
+			continue
+		}
+		if r.RequestedAuthnContext.Comparison != "" && r.RequestedAuthnContext.Comparison != "exact" {
+			continue
+		}
+		classRef := authnContextClassRef(statement)
+		if !containsString(r.RequestedAuthnContext.AuthnContextClassRefs, classRef) {
+			return fmt.Errorf("AuthnStatement AuthnContextClassRef %q does not match the query", classRef)
+		}
+	}
+	return nil
+}
+
+// MapNameID sends a NameIDMappingRequest for the principal identified by
+// nameID to the IDP's name identifier mapping service using the SOAP binding
+// and returns the mapped identifier.
+func (sp *ServiceProvider) MapNameID(nameID *NameID, nameIDPolicy *NameIDPolicy) (*NameID, error) {
+	req, err := sp.MakeNameIDMappingRequest(sp.GetNameIDMappingServiceLocation(SOAPBinding), nameID, nameIDPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	rawResponseBuf, err := sp.postSOAP(req.Destination, req.SoapRequest())
+	if err != nil {
+		return nil, fmt.Errorf("error during name identifier mapping: %s", err)
+	}
+	return sp.ParseXMLNameIDMappingResponse(rawResponseBuf, req)
+}
+
+// ParseXMLNameIDMappingResponse parses and validates the SOAP response to req
+// and returns the mapped name identifier, decrypting it if necessary. The
+// response carries no assertion, so it must be signed by the IDP.
+//
+// If the function fails it will return an InvalidResponseError whose
+// properties are useful in describing which part of the parsing process
+// failed. However, to discourage inadvertent disclosure the diagnostic
+// information, the Error() method returns a static string.
+func (sp *ServiceProvider) ParseXMLNameIDMappingResponse(decodedResponseXML []byte, req *NameIDMappingRequest) (*NameID, error) {
+	now := sp.now()
+	retErr := &InvalidResponseError{
+		Now:      now,
+		Response: string(decodedResponseXML),
+	}
+
+	// ensure that the response XML is well formed before we parse it
+	if err := xrv.Validate(bytes.NewReader(decodedResponseXML)); err != nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "invalid xml: %s", err)
+		return nil, retErr
+	}
+	if err := sp.checkStructure(decodedResponseXML); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+
+	envelope := &struct {
+		XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+		Body    struct {
+			NameIDMappingResponse NameIDMappingResponse
+		} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	}{}
+	if err := xml.Unmarshal(decodedResponseXML, &envelope); err != nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "cannot unmarshal response: %s", err)
+		return nil, retErr
+	}
+
+	resp := envelope.Body.NameIDMappingResponse
+	if resp.InResponseTo != req.ID {
+		retErr.PrivateErr = fmt.Errorf("`InResponseTo` does not match the mapping request ID (expected %v)", req.ID)
+		return nil, retErr
+	}
+	if resp.IssueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		retErr.PrivateErr = errorOfKind(ErrExpiredResponse, "response IssueInstant expired at %s", resp.IssueInstant.Add(sp.maxIssueDelay()))
+		return nil, retErr
+	}
+	if resp.Issuer != nil && !sp.isTrustedIssuer(resp.Issuer.Value) {
+		retErr.PrivateErr = errorOfKind(ErrWrongIssuer, "response Issuer does not match the IDP metadata (expected %q)", sp.idpMetadata().EntityID)
+		return nil, retErr
+	}
+	if resp.Status.StatusCode.Value != StatusSuccess {
+		retErr.PrivateErr = newErrBadStatus(resp.Status)
+		return nil, retErr
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(decodedResponseXML); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	responseEl := doc.FindElement("Envelope/Body/NameIDMappingResponse")
+	if responseEl == nil {
+		retErr.PrivateErr = fmt.Errorf("missing NameIDMappingResponse")
+		return nil, retErr
+	}
+	signed, err := responseIsSigned(responseEl)
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	if !signed {
+		retErr.PrivateErr = errors.New("NameIDMappingResponse must be signed")
+		return nil, retErr
+	}
+	if err := sp.validateSignature(responseEl); err != nil {
+		retErr.PrivateErr = fmt.Errorf("cannot validate signature on NameIDMappingResponse: %v", err)
+		return nil, retErr
+	}
+
+	if resp.NameID != nil {
+		return resp.NameID, nil
+	}
+	encryptedIDEl := responseEl.FindElement("./EncryptedID")
+	if encryptedIDEl == nil {
+		retErr.PrivateErr = errors.New("response does not contain a NameID")
+		return nil, retErr
+	}
+	plaintextNameID, err := decryptElementWithKeys(sp.decryptionKeys(), encryptedIDEl)
+	if err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	if err := xrv.Validate(bytes.NewReader(plaintextNameID)); err != nil {
+		retErr.PrivateErr = fmt.Errorf("plaintext NameID contains invalid XML: %s", err)
+		return nil, retErr
+	}
+	nameID := &NameID{}
+	if err := xml.Unmarshal(plaintextNameID, nameID); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	return nameID, nil
+}
+
+// ChangeNameID tells the IDP, using the SOAP binding, that the SP will refer
+// to the principal identified by nameID as newID from now on.
+func (sp *ServiceProvider) ChangeNameID(nameID *NameID, newID string) error {
+	return sp.manageNameID(nameID, newID, false)
+}
+
+// TerminateNameID tells the IDP, using the SOAP binding, that the SP will no
+// longer use nameID to refer to the principal.
+func (sp *ServiceProvider) TerminateNameID(nameID *NameID) error {
+	return sp.manageNameID(nameID, "", true)
+}
+
+func (sp *ServiceProvider) manageNameID(nameID *NameID, newID string, terminate bool) error {
+	req, err := sp.MakeManageNameIDRequest(sp.GetManageNameIDServiceLocation(SOAPBinding), nameID, newID, terminate)
+	if err != nil {
+		return err
+	}
+
+	rawResponseBuf, err := sp.postSOAP(req.Destination, req.SoapRequest())
+	if err != nil {
+		return fmt.Errorf("error during name identifier management: %s", err)
+	}
+	return sp.ParseXMLManageNameIDResponse(rawResponseBuf, req)
+}
+
+// ParseXMLManageNameIDResponse parses and validates the SOAP response to req.
+// It returns nil if the IDP accepted the request. The response must be signed
+// by the IDP.
+//
+// If the function fails it will return an InvalidResponseError whose
+// properties are useful in describing which part of the parsing process
+// failed. However, to discourage inadvertent disclosure the diagnostic
+// information, the Error() method returns a static string.
+func (sp *ServiceProvider) ParseXMLManageNameIDResponse(decodedResponseXML []byte, req *ManageNameIDRequest) error {
+	now := sp.now()
+	retErr := &InvalidResponseError{
+		Now:      now,
+		Response: string(decodedResponseXML),
+	}
+
+	// ensure that the response XML is well formed before we parse it
+	if err := xrv.Validate(bytes.NewReader(decodedResponseXML)); err != nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "invalid xml: %s", err)
+		return retErr
+	}
+	if err := sp.checkStructure(decodedResponseXML); err != nil {
+		retErr.PrivateErr = err
+		return retErr
+	}
+
+	envelope := &struct {
+		XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+		Body    struct {
+			ManageNameIDResponse ManageNameIDResponse
+		} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	}{}
+	if err := xml.Unmarshal(decodedResponseXML, &envelope); err != nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "cannot unmarshal response: %s", err)
+		return retErr
+	}
+
+	resp := envelope.Body.ManageNameIDResponse
+	if resp.InResponseTo != req.ID {
+		retErr.PrivateErr = fmt.Errorf("`InResponseTo` does not match the request ID (expected %v)", req.ID)
+		return retErr
+	}
+	if resp.IssueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		retErr.PrivateErr = errorOfKind(ErrExpiredResponse, "response IssueInstant expired at %s", resp.IssueInstant.Add(sp.maxIssueDelay()))
+		return retErr
+	}
+	if resp.Issuer != nil && !sp.isTrustedIssuer(resp.Issuer.Value) {
+		retErr.PrivateErr = errorOfKind(ErrWrongIssuer, "response Issuer does not match the IDP metadata (expected %q)", sp.idpMetadata().EntityID)
+		return retErr
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(decodedResponseXML); err != nil {
+		retErr.PrivateErr = err
+		return retErr
+	}
+	responseEl := doc.FindElement("Envelope/Body/ManageNameIDResponse")
+	if responseEl == nil {
+		retErr.PrivateErr = fmt.Errorf("missing ManageNameIDResponse")
+		return retErr
+	}
+	signed, err := responseIsSigned(responseEl)
+	if err != nil {
+		retErr.PrivateErr = err
+		return retErr
+	}
+	if !signed {
+		retErr.PrivateErr = errors.New("ManageNameIDResponse must be signed")
+		return retErr
+	}
+	if err := sp.validateSignature(responseEl); err != nil {
+		retErr.PrivateErr = fmt.Errorf("cannot validate signature on ManageNameIDResponse: %v", err)
+		return retErr
+	}
+
+	if resp.Status.StatusCode.Value != StatusSuccess {
+		retErr.PrivateErr = newErrBadStatus(resp.Status)
+		return retErr
 	}
+	return nil
+}
 
+// parseXMLQueryResponse parses and validates the SOAP response to the query
+// identified by queryID. Each assertion must be about subject and is further
+// checked by validate.
+func (sp *ServiceProvider) parseXMLQueryResponse(decodedResponseXML []byte, role idpRole, queryID string, subject *Subject, validate func(*Assertion) error, now time.Time) (*QueryResponse, error) {
 	// ensure that the response XML is well formed before we parse it
 	if err := xrv.Validate(bytes.NewReader(decodedResponseXML)); err != nil {
-		retErr.PrivateErr = fmt.Errorf("invalid xml: %s", err)
-		return nil, retErr
+		return nil, fmt.Errorf("invalid xml: %s", err)
+	}
+	if err := sp.checkStructure(decodedResponseXML); err != nil {
+		return nil, err
 	}
 
 	envelope := &struct {
 		XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
 		Body    struct {
-			ArtifactResponse ArtifactResponse
+			Response Response
 		} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
 	}{}
 	if err := xml.Unmarshal(decodedResponseXML, &envelope); err != nil {
-		retErr.PrivateErr = fmt.Errorf("cannot unmarshal response: %s", err)
-		return nil, retErr
+		return nil, fmt.Errorf("cannot unmarshal response: %s", err)
 	}
 
-	resp := envelope.Body.ArtifactResponse
-
-	// Validate ArtifactResponse
-	if resp.InResponseTo != artifactRequestID {
-		retErr.PrivateErr = fmt.Errorf("`InResponseTo` does not match the artifact request ID (expected %v)", artifactRequestID)
-		return nil, retErr
+	resp := envelope.Body.Response
+	resp.Assertion = nil
+	resp.EncryptedAssertion = nil
+	if resp.InResponseTo != queryID {
+		return nil, fmt.Errorf("`InResponseTo` does not match the query request ID (expected %v)", queryID)
 	}
-	if resp.IssueInstant.Add(MaxIssueDelay).Before(now) {
-		retErr.PrivateErr = fmt.Errorf("response IssueInstant expired at %s", resp.IssueInstant.Add(MaxIssueDelay))
-		return nil, retErr
+	if sp.RequestIDStore != nil {
+		outstanding, err := sp.takeRequestID(queryID)
+		if err != nil {
+			return nil, err
+		}
+		if !outstanding {
+			return nil, fmt.Errorf("query request ID %v is not outstanding", queryID)
+		}
 	}
-	if resp.Issuer != nil && resp.Issuer.Value != sp.IDPMetadata.EntityID {
-		retErr.PrivateErr = fmt.Errorf("response Issuer does not match the IDP metadata (expected %q)", sp.IDPMetadata.EntityID)
-		return nil, retErr
+	if resp.IssueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		return nil, errorOfKind(ErrExpiredResponse, "response IssueInstant expired at %s", resp.IssueInstant.Add(sp.maxIssueDelay()))
+	}
+	if resp.Issuer != nil && !sp.isTrustedIssuer(resp.Issuer.Value) {
+		return nil, errorOfKind(ErrWrongIssuer, "response Issuer does not match the IDP metadata (expected %q)", sp.idpMetadata().EntityID)
 	}
 	if resp.Status.StatusCode.Value != StatusSuccess {
-		retErr.PrivateErr = ErrBadStatus{Status: resp.Status.StatusCode.Value}
-		return nil, retErr
+		return nil, newErrBadStatus(resp.Status)
 	}
 
 	doc := etree.NewDocument()
 	if err := doc.ReadFromBytes(decodedResponseXML); err != nil {
-		retErr.PrivateErr = err
-		return nil, retErr
+		return nil, err
+	}
+	responseEl := doc.FindElement("Envelope/Body/Response")
+	if responseEl == nil {
+		return nil, fmt.Errorf("missing Response")
 	}
 
-	artifactEl := doc.FindElement("Envelope/Body/ArtifactResponse")
-	if artifactEl == nil {
-		retErr.PrivateErr = fmt.Errorf("missing ArtifactResponse")
-		return nil, retErr
+	responseSigned, err := responseIsSigned(responseEl)
+	if err != nil {
+		return nil, err
 	}
-	responseEl := doc.FindElement("Envelope/Body/ArtifactResponse/Response")
-	if responseEl == nil {
-		retErr.PrivateErr = fmt.Errorf("missing inner Response")
-		return nil, retErr
+	if responseSigned {
+		if err := sp.validateRoleSignature(responseEl, role); err != nil {
+			return nil, fmt.Errorf("cannot validate signature on Response: %v", err)
+		}
 	}
 
-	haveSignature := false
-	var err error
-	if err = sp.validateArtifactSigned(artifactEl); err != nil && err.Error() != "either the Response or Assertion must be signed" {
-		retErr.PrivateErr = err
-		return nil, retErr
+	result := &QueryResponse{Response: &resp}
+	for _, el := range responseEl.ChildElements() {
+		var assertionEl *etree.Element
+		switch el.Tag {
+		case "Assertion":
+			assertionEl = el
+		case "EncryptedAssertion":
+			plaintextAssertion, err := decryptElementWithKeys(sp.decryptionKeys(), el)
+			if err != nil {
+				result.Assertions = append(result.Assertions, QueryAssertion{Err: err})
+				continue
+			}
+			if err := xrv.Validate(bytes.NewReader(plaintextAssertion)); err != nil {
+				result.Assertions = append(result.Assertions, QueryAssertion{
+					Err: fmt.Errorf("plaintext response contains invalid XML: %s", err),
+				})
+				continue
+			}
+			plaintextDoc := etree.NewDocument()
+			if err := plaintextDoc.ReadFromBytes(plaintextAssertion); err != nil {
+				result.Assertions = append(result.Assertions, QueryAssertion{
+					Err: fmt.Errorf("cannot parse plaintext response %v", err),
+				})
+				continue
+			}
+			assertionEl = plaintextDoc.Root()
+		default:
+			continue
+		}
+		result.Assertions = append(result.Assertions, sp.validateQueryAssertionEl(assertionEl, role, subject, validate, responseSigned, now))
 	}
-	if err == nil {
-		haveSignature = true
+	return result, nil
+}
+
+// validateQueryAssertionEl unmarshals and validates a single assertion from
+// the response to a query. The signatures of the response and assertion must
+// satisfy ResponseSignaturePolicy.
+func (sp *ServiceProvider) validateQueryAssertionEl(assertionEl *etree.Element, role idpRole, subject *Subject, validate func(*Assertion) error, responseSigned bool, now time.Time) QueryAssertion {
+	rv := QueryAssertion{}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(assertionEl.Copy())
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		rv.Err = err
+		return rv
 	}
-	assertion, updatedResponse, err := sp.validateXMLResponse(&resp.Response, responseEl, possibleRequestIDs, now, !haveSignature)
+	rv.Assertion = &Assertion{}
+	if err := xml.Unmarshal(buf, rv.Assertion); err != nil {
+		rv.Err = err
+		return rv
+	}
+
+	assertionSigned, err := responseIsSigned(assertionEl)
 	if err != nil {
-		retErr.PrivateErr = err
-		if updatedResponse != nil {
-			retErr.Response = *updatedResponse
+		rv.Err = err
+		return rv
+	}
+	if assertionSigned {
+		if err := sp.validateRoleSignature(assertionEl, role); err != nil {
+			rv.Err = fmt.Errorf("cannot validate signature on Assertion: %v", err)
+			return rv
 		}
-		return nil, retErr
+	}
+	if err := sp.responseSignaturePolicy().check(responseSigned, assertionSigned); err != nil {
+		rv.Err = err
+		return rv
 	}
 
-	return assertion, nil
+	if err := sp.validateQueryAssertion(rv.Assertion, subject, now); err != nil {
+		rv.Err = fmt.Errorf("assertion invalid: %s", err)
+		return rv
+	}
+	if err := validate(rv.Assertion); err != nil {
+		rv.Err = fmt.Errorf("assertion invalid: %s", err)
+		return rv
+	}
+	rv.Verified = true
+	return rv
+}
+
+// validateQueryAssertion checks that an assertion returned in response to a
+// query about subject is acceptable. (The digital signature on the assertion
+// is not checked -- this should be done before calling this function).
+func (sp *ServiceProvider) validateQueryAssertion(assertion *Assertion, subject *Subject, now time.Time) error {
+	if assertion.IssueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		return errorOfKind(ErrExpiredAssertion, "expired on %s", assertion.IssueInstant.Add(sp.maxIssueDelay()))
+	}
+	if !sp.isTrustedIssuer(assertion.Issuer.Value) {
+		return errorOfKind(ErrWrongIssuer, "issuer is not %q", sp.idpMetadata().EntityID)
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil ||
+		subject == nil || subject.NameID == nil ||
+		assertion.Subject.NameID.Value != subject.NameID.Value {
+		return fmt.Errorf("assertion Subject does not match the query")
+	}
+	if assertion.Conditions != nil {
+		if err := sp.validateConditions(assertion.Conditions, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateAssertion checks that every attribute of assertion which was
+// requested with specific values was returned with a subset of those values
+// (SAML core 3.3.2.3).
+func (r *AttributeQuery) validateAssertion(assertion *Assertion) error {
+	for _, attributeStatement := range assertion.AttributeStatements {
+		for _, attr := range attributeStatement.Attributes {
+			for _, requested := range r.Attributes {
+				if requested.Name != attr.Name || len(requested.Values) == 0 {
+					continue
+				}
+				if requested.NameFormat != "" && attr.NameFormat != "" && requested.NameFormat != attr.NameFormat {
+					continue
+				}
+				for _, value := range attr.Values {
+					if !hasAttributeValue(requested.Values, value.Value) {
+						return fmt.Errorf("attribute %q contains value %q which was not requested", attr.Name, value.Value)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func hasAttributeValue(values []AttributeValue, value string) bool {
+	for _, v := range values {
+		if v.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// postSOAP sends envelope to location using the SOAP binding and returns the
+// body of the response.
+func (sp *ServiceProvider) postSOAP(location string, envelope *etree.Element) ([]byte, error) {
+	return sp.postSOAPContext(context.Background(), location, envelope)
+}
+
+// postSOAPContext is like postSOAP, but the request is bound to ctx.
+func (sp *ServiceProvider) postSOAPContext(ctx context.Context, location string, envelope *etree.Element) ([]byte, error) {
+	return postSOAPEnvelope(ctx, sp.HTTPClient, location, envelope)
+}
+
+// postSOAPEnvelope sends envelope to location with client using the SOAP
+// binding and returns the body of the response. If client is nil,
+// http.DefaultClient is used.
+func postSOAPEnvelope(ctx context.Context, client *http.Client, location string, envelope *etree.Element) ([]byte, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(envelope)
+
+	var requestBuffer bytes.Buffer
+	if _, err := doc.WriteTo(&requestBuffer); err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", location, &requestBuffer)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, soapStatusError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// soapStatusError is returned by postSOAP when the server responds with a
+// status other than 200 OK.
+type soapStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e soapStatusError) Error() string {
+	return fmt.Sprintf("HTTP status %d (%s)", e.StatusCode, e.Status)
+}
+
+// soapRetryBackoff is the delay before the first retry of a SOAP request. It
+// doubles with every retry.
+var soapRetryBackoff = 250 * time.Millisecond
+
+// postSOAPWithRetries is like postSOAPContext, but retries the request up to
+// sp.SOAPRetries times if it fails with a network error or a 5xx status.
+func (sp *ServiceProvider) postSOAPWithRetries(ctx context.Context, location string, envelope *etree.Element) ([]byte, error) {
+	backoff := soapRetryBackoff
+	for attempt := 0; ; attempt++ {
+		buf, err := sp.postSOAPContext(ctx, location, envelope.Copy())
+		if err == nil || attempt >= sp.SOAPRetries || ctx.Err() != nil {
+			return buf, err
+		}
+		if statusErr, ok := err.(soapStatusError); ok && statusErr.StatusCode < 500 {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
 }
 
 // ParseXMLResponse parses and validates the SAML IDP response and
@@ -790,7 +2639,19 @@ func (sp *ServiceProvider) ParseXMLArtifactResponse(decodedResponseXML []byte, p
 // failed. However, to discourage inadvertent disclosure the diagnostic
 // information, the Error() method returns a static string.
 func (sp *ServiceProvider) ParseXMLResponse(decodedResponseXML []byte, possibleRequestIDs []string) (*Assertion, error) {
-	now := TimeNow()
+	return sp.parseXMLResponseContext(context.Background(), decodedResponseXML, possibleRequestIDs)
+}
+
+func (sp *ServiceProvider) parseXMLResponseContext(ctx context.Context, decodedResponseXML []byte, possibleRequestIDs []string) (*Assertion, error) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, sp.Tracer, "saml.ServiceProvider.ParseXMLResponse")
+	assertion, err := sp.parseXMLResponse(ctx, decodedResponseXML, possibleRequestIDs)
+	sp.responseProcessed(start, span, decodedResponseXML, assertion, err)
+	return assertion, err
+}
+
+func (sp *ServiceProvider) parseXMLResponse(ctx context.Context, decodedResponseXML []byte, possibleRequestIDs []string) (*Assertion, error) {
+	now := sp.now()
 	var err error
 	retErr := &InvalidResponseError{
 		Now:      now,
@@ -799,14 +2660,18 @@ func (sp *ServiceProvider) ParseXMLResponse(decodedResponseXML []byte, possibleR
 
 	// ensure that the response XML is well formed before we parse it
 	if err := xrv.Validate(bytes.NewReader(decodedResponseXML)); err != nil {
-		retErr.PrivateErr = fmt.Errorf("invalid xml: %s", err)
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "invalid xml: %s", err)
+		return nil, retErr
+	}
+	if err := sp.checkStructure(decodedResponseXML); err != nil {
+		retErr.PrivateErr = err
 		return nil, retErr
 	}
 
 	// do some validation first before we decrypt
 	resp := Response{}
 	if err := xml.Unmarshal(decodedResponseXML, &resp); err != nil {
-		retErr.PrivateErr = fmt.Errorf("cannot unmarshal response: %s", err)
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "cannot unmarshal response: %s", err)
 		return nil, retErr
 	}
 
@@ -816,7 +2681,7 @@ func (sp *ServiceProvider) ParseXMLResponse(decodedResponseXML []byte, possibleR
 		return nil, retErr
 	}
 
-	assertion, updatedResponse, err := sp.validateXMLResponse(&resp, doc.Root(), possibleRequestIDs, now, true)
+	assertion, updatedResponse, err := sp.validateXMLResponse(ctx, &resp, doc.Root(), possibleRequestIDs, now, true)
 	if err != nil {
 		retErr.PrivateErr = err
 		if updatedResponse != nil {
@@ -834,18 +2699,28 @@ func (sp *ServiceProvider) ParseXMLResponse(decodedResponseXML []byte, possibleR
 // This function handles decrypting the message, verifying the digital
 // signature on the assertion, and verifying that the specified conditions
 // and properties are met.
-func (sp *ServiceProvider) validateXMLResponse(resp *Response, responseEl *etree.Element, possibleRequestIDs []string, now time.Time, needSig bool) (*Assertion, *string, error) {
-	var err error
+func (sp *ServiceProvider) validateXMLResponse(ctx context.Context, resp *Response, responseEl *etree.Element, possibleRequestIDs []string, now time.Time, needSig bool) (*Assertion, *string, error) {
 	var updatedResponse *string
 	if err := sp.validateDestination(responseEl, resp); err != nil {
 		return nil, updatedResponse, err
 	}
 
+	if resp.InResponseTo == "" && !sp.AllowIDPInitiated {
+		return nil, updatedResponse, errorOfKind(ErrUnsolicitedResponse, "unsolicited responses are not allowed")
+	}
+
 	requestIDvalid := false
 
 	if sp.AllowIDPInitiated {
 		requestIDvalid = true
 	} else {
+		outstanding, err := sp.takeRequestID(resp.InResponseTo)
+		if err != nil {
+			return nil, updatedResponse, err
+		}
+		if outstanding {
+			possibleRequestIDs = append([]string{resp.InResponseTo}, possibleRequestIDs...)
+		}
 		for _, possibleRequestID := range possibleRequestIDs {
 			if resp.InResponseTo == possibleRequestID {
 				requestIDvalid = true
@@ -854,19 +2729,51 @@ func (sp *ServiceProvider) validateXMLResponse(resp *Response, responseEl *etree
 	}
 
 	if !requestIDvalid {
-		return nil, updatedResponse, fmt.Errorf("`InResponseTo` does not match any of the possible request IDs (expected %v)", possibleRequestIDs)
+		return nil, updatedResponse, errorOfKind(ErrStaleInResponseTo, "`InResponseTo` does not match any of the possible request IDs (expected %v)", possibleRequestIDs)
 	}
 
-	if resp.IssueInstant.Add(MaxIssueDelay).Before(now) {
-		return nil, updatedResponse, fmt.Errorf("response IssueInstant expired at %s", resp.IssueInstant.Add(MaxIssueDelay))
+	if resp.IssueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		return nil, updatedResponse, errorOfKind(ErrExpiredResponse, "response IssueInstant expired at %s", resp.IssueInstant.Add(sp.maxIssueDelay()))
 	}
-	if resp.Issuer != nil && resp.Issuer.Value != sp.IDPMetadata.EntityID {
-		return nil, updatedResponse, fmt.Errorf("response Issuer does not match the IDP metadata (expected %q)", sp.IDPMetadata.EntityID)
+	if resp.Issuer != nil && !sp.isTrustedIssuer(resp.Issuer.Value) {
+		return nil, updatedResponse, errorOfKind(ErrWrongIssuer, "response Issuer does not match the IDP metadata (expected %q)", sp.idpMetadata().EntityID)
 	}
 	if resp.Status.StatusCode.Value != StatusSuccess {
-		return nil, updatedResponse, ErrBadStatus{Status: resp.Status.StatusCode.Value}
+		return nil, updatedResponse, newErrBadStatus(resp.Status)
+	}
+
+	assertion, updatedResponse, err := sp.extractAssertion(ctx, resp, responseEl, needSig)
+	if err != nil {
+		return nil, updatedResponse, err
+	}
+
+	for _, validate := range sp.ResponseValidators {
+		if err := validate(resp); err != nil {
+			return nil, updatedResponse, err
+		}
+	}
+
+	if err := sp.validateHolderOfKey(ctx, assertion); err != nil {
+		return nil, updatedResponse, fmt.Errorf("assertion invalid: %w", err)
+	}
+	if err := sp.validateSubjectAddress(ctx, assertion); err != nil {
+		return nil, updatedResponse, fmt.Errorf("assertion invalid: %w", err)
 	}
+	if err := sp.validateAssertion(assertion, possibleRequestIDs, now); err != nil {
+		return nil, updatedResponse, fmt.Errorf("assertion invalid: %w", err)
+	}
+
+	return assertion, updatedResponse, nil
+}
 
+// extractAssertion returns the assertion carried by resp, decrypting it if
+// necessary, after verifying the signatures on the Response and Assertion
+// elements and checking them against ResponseSignaturePolicy. If needSig is
+// false, the caller has already verified a signature of an enclosing message
+// covering responseEl, which counts as a signature of the Response.
+func (sp *ServiceProvider) extractAssertion(ctx context.Context, resp *Response, responseEl *etree.Element, needSig bool) (*Assertion, *string, error) {
+	var err error
+	var updatedResponse *string
 	var assertion *Assertion
 	if resp.EncryptedAssertion == nil {
 		// TODO(ross): verify that the namespace is urn:oasis:names:tc:SAML:2.0:protocol
@@ -874,7 +2781,22 @@ func (sp *ServiceProvider) validateXMLResponse(resp *Response, responseEl *etree
 			return nil, updatedResponse, fmt.Errorf("expected to find a response object, not %s", responseEl.Tag)
 		}
 
-		if err = sp.validateSigned(responseEl); err != nil && !(!needSig && err.Error() == "either the Response or Assertion must be signed") {
+		if err = sp.traceSignature(ctx, responseEl, sp.validateSigned); err != nil && !errors.Is(err, ErrMissingSignature) {
+			return nil, updatedResponse, err
+		}
+		responseSigned, err := responseIsSigned(responseEl)
+		if err != nil {
+			return nil, updatedResponse, err
+		}
+		assertionSigned := false
+		if assertionEl, err := findChild(responseEl, "urn:oasis:names:tc:SAML:2.0:assertion", "Assertion"); err != nil {
+			return nil, updatedResponse, err
+		} else if assertionEl != nil {
+			if assertionSigned, err = responseIsSigned(assertionEl); err != nil {
+				return nil, updatedResponse, err
+			}
+		}
+		if err := sp.responseSignaturePolicy().check(responseSigned || !needSig, assertionSigned); err != nil {
 			return nil, updatedResponse, err
 		}
 
@@ -890,24 +2812,16 @@ func (sp *ServiceProvider) validateXMLResponse(resp *Response, responseEl *etree
 			return nil, updatedResponse, err
 		}
 		if responseSigned {
-			if err := sp.validateSigned(responseEl); err != nil {
+			if err := sp.traceSignature(ctx, responseEl, sp.validateSigned); err != nil {
 				return nil, updatedResponse, err
 			}
 		}
 
-		var key interface{} = sp.Key
-		keyEl := responseEl.FindElement("//EncryptedAssertion/EncryptedKey")
-		if keyEl != nil {
-			key, err = xmlenc.Decrypt(sp.Key, keyEl)
-			if err != nil {
-				return nil, updatedResponse, fmt.Errorf("failed to decrypt key from response: %s", err)
-			}
-		}
-
-		el := responseEl.FindElement("//EncryptedAssertion/EncryptedData")
-		plaintextAssertion, err := xmlenc.Decrypt(key, el)
+		_, span := startSpan(ctx, sp.Tracer, "saml.ServiceProvider.DecryptAssertion")
+		plaintextAssertion, err := decryptElementWithKeys(sp.decryptionKeys(), responseEl.FindElement("//EncryptedAssertion"))
+		span.End(err)
 		if err != nil {
-			return nil, updatedResponse, fmt.Errorf("failed to decrypt response: %s", err)
+			return nil, updatedResponse, kindError{kind: ErrDecryptionFailed, err: err}
 		}
 		updatedResponse = new(string)
 		*updatedResponse = string(plaintextAssertion)
@@ -923,8 +2837,14 @@ func (sp *ServiceProvider) validateXMLResponse(resp *Response, responseEl *etree
 		}
 
 		// the decrypted assertion may be signed too
-		// otherwise, a signed response is sufficient
-		if err := sp.validateSigned(doc.Root()); err != nil && !((responseSigned || !needSig) && err.Error() == "either the Response or Assertion must be signed") {
+		if err := sp.traceSignature(ctx, doc.Root(), sp.validateSigned); err != nil && !errors.Is(err, ErrMissingSignature) {
+			return nil, updatedResponse, err
+		}
+		assertionSigned, err := responseIsSigned(doc.Root())
+		if err != nil {
+			return nil, updatedResponse, err
+		}
+		if err := sp.responseSignaturePolicy().check(responseSigned || !needSig, assertionSigned); err != nil {
 			return nil, updatedResponse, err
 		}
 
@@ -936,23 +2856,74 @@ func (sp *ServiceProvider) validateXMLResponse(resp *Response, responseEl *etree
 		}
 	}
 
-	if err := sp.validateAssertion(assertion, possibleRequestIDs, now); err != nil {
-		return nil, updatedResponse, fmt.Errorf("assertion invalid: %s", err)
+	if assertion == nil {
+		return nil, updatedResponse, errorOfKind(ErrMissingAssertion, "response does not contain an assertion")
 	}
-
 	return assertion, updatedResponse, nil
 }
 
+// decryptElement decrypts el, an EncryptedAssertion or EncryptedID element,
+// using privateKey and returns the plaintext.
+func decryptElement(privateKey interface{}, el *etree.Element) ([]byte, error) {
+	key := privateKey
+	keyEl := el.FindElement("./EncryptedKey")
+	if keyEl != nil {
+		var err error
+		key, err = xmlenc.Decrypt(privateKey, keyEl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt key from response: %s", err)
+		}
+	}
+
+	plaintextAssertion, err := xmlenc.Decrypt(key, el.FindElement("./EncryptedData"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt response: %s", err)
+	}
+	return plaintextAssertion, nil
+}
+
+// decryptElementWithKeys decrypts el with each of privateKeys in turn and
+// returns the first plaintext obtained. If none of the keys can decrypt
+// el, the error from the last one is returned.
+func decryptElementWithKeys(privateKeys []crypto.PrivateKey, el *etree.Element) ([]byte, error) {
+	var err error
+	for _, privateKey := range privateKeys {
+		var plaintext []byte
+		plaintext, err = decryptElement(privateKey, el)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, err
+}
+
+// decryptNameID decrypts el, an EncryptedID element, using the first of
+// privateKeys that can decrypt it and returns the NameID it contains.
+func decryptNameID(privateKeys []crypto.PrivateKey, el *etree.Element) (*NameID, error) {
+	plaintext, err := decryptElementWithKeys(privateKeys, el)
+	if err != nil {
+		return nil, err
+	}
+	if err := xrv.Validate(bytes.NewReader(plaintext)); err != nil {
+		return nil, fmt.Errorf("plaintext NameID contains invalid XML: %s", err)
+	}
+	nameID := &NameID{}
+	if err := xml.Unmarshal(plaintext, nameID); err != nil {
+		return nil, err
+	}
+	return nameID, nil
+}
+
 // validateAssertion checks that the conditions specified in assertion match
 // the requirements to accept. If validation fails, it returns an error describing
 // the failure. (The digital signature on the assertion is not checked -- this
 // should be done before calling this function).
 func (sp *ServiceProvider) validateAssertion(assertion *Assertion, possibleRequestIDs []string, now time.Time) error {
-	if assertion.IssueInstant.Add(MaxIssueDelay).Before(now) {
-		return fmt.Errorf("expired on %s", assertion.IssueInstant.Add(MaxIssueDelay))
+	if assertion.IssueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		return errorOfKind(ErrExpiredAssertion, "expired on %s", assertion.IssueInstant.Add(sp.maxIssueDelay()))
 	}
-	if assertion.Issuer.Value != sp.IDPMetadata.EntityID {
-		return fmt.Errorf("issuer is not %q", sp.IDPMetadata.EntityID)
+	if !sp.isTrustedIssuer(assertion.Issuer.Value) {
+		return errorOfKind(ErrWrongIssuer, "issuer is not %q", sp.idpMetadata().EntityID)
 	}
 	for _, subjectConfirmation := range assertion.Subject.SubjectConfirmations {
 		requestIDvalid := false
@@ -982,32 +2953,164 @@ func (sp *ServiceProvider) validateAssertion(assertion *Assertion, possibleReque
 				}
 			}
 			if !requestIDvalid {
-				return fmt.Errorf("assertion SubjectConfirmation one of the possible request IDs (%v)", possibleRequestIDs)
+				return errorOfKind(ErrStaleInResponseTo, "assertion SubjectConfirmation one of the possible request IDs (%v)", possibleRequestIDs)
+			}
+		}
+		if !sp.isAcceptedDestination(subjectConfirmation.SubjectConfirmationData.Recipient) {
+			return errorOfKind(ErrWrongDestination, "assertion SubjectConfirmation Recipient is not %s", sp.AcsURL.String())
+		}
+		if subjectConfirmation.SubjectConfirmationData.NotOnOrAfter.Add(sp.maxClockSkew()).Before(now) {
+			return errorOfKind(ErrExpiredAssertion, "assertion SubjectConfirmationData is expired")
+		}
+	}
+	if err := sp.validateAuthnContext(assertion); err != nil {
+		return err
+	}
+	if err := sp.validateAttributeScopes(assertion); err != nil {
+		return err
+	}
+	if err := sp.validateConditions(assertion.Conditions, now); err != nil {
+		return err
+	}
+	for _, validate := range sp.AssertionValidators {
+		if err := validate(assertion); err != nil {
+			return err
+		}
+	}
+	return sp.checkReplay(assertion)
+}
+
+// checkReplay records the ID of assertion in sp.ReplayCache, if there is
+// one, and fails if the assertion has been accepted before. The ID is
+// remembered for as long as the assertion could otherwise be accepted.
+func (sp *ServiceProvider) checkReplay(assertion *Assertion) error {
+	if sp.ReplayCache == nil {
+		return nil
+	}
+	seen, err := sp.replayCache().Seen(assertion.ID, assertion.IssueInstant.Add(sp.maxIssueDelay()))
+	if err != nil {
+		return fmt.Errorf("cannot check the replay cache: %v", err)
+	}
+	if seen {
+		return errorOfKind(ErrReplayedAssertion, "assertion %s has already been used", assertion.ID)
+	}
+	return nil
+}
+
+// DefaultScopedAttributes is the default value of
+// ServiceProvider.ScopedAttributes: eduPersonPrincipalName,
+// eduPersonScopedAffiliation, and the subject-id and pairwise-id of the
+// SAML V2.0 Subject Identifier Attributes Profile.
+var DefaultScopedAttributes = []string{
+	"urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+	"urn:oid:1.3.6.1.4.1.5923.1.1.1.9",
+	"urn:oasis:names:tc:SAML:attribute:subject-id",
+	"urn:oasis:names:tc:SAML:attribute:pairwise-id",
+}
+
+// validateAttributeScopes checks that the values of the scoped attributes
+// of assertion are in a scope that the IDP is authorized to assert, if
+// sp.ValidateAttributeScopes is set.
+func (sp *ServiceProvider) validateAttributeScopes(assertion *Assertion) error {
+	if !sp.ValidateAttributeScopes {
+		return nil
+	}
+	scopedAttributes := sp.ScopedAttributes
+	if scopedAttributes == nil {
+		scopedAttributes = DefaultScopedAttributes
+	}
+	scopes := sp.idpMetadata().Scopes()
+
+	for _, attributeStatement := range assertion.AttributeStatements {
+		for _, attribute := range attributeStatement.Attributes {
+			if !containsString(scopedAttributes, attribute.Name) {
+				continue
+			}
+			for _, value := range attribute.Values {
+				i := strings.LastIndex(value.Value, "@")
+				if i < 0 {
+					return errorOfKind(ErrUnauthorizedScope, "value of attribute %s is not scoped", attribute.Name)
+				}
+				if !scopeAuthorized(scopes, value.Value[i+1:]) {
+					return errorOfKind(ErrUnauthorizedScope, "scope %q of attribute %s is not authorized for the IDP", value.Value[i+1:], attribute.Name)
+				}
 			}
 		}
-		if subjectConfirmation.SubjectConfirmationData.Recipient != sp.AcsURL.String() {
-			return fmt.Errorf("assertion SubjectConfirmation Recipient is not %s", sp.AcsURL.String())
+	}
+	return nil
+}
+
+// scopeAuthorized returns true if scope matches one of scopes.
+func scopeAuthorized(scopes []Scope, scope string) bool {
+	for _, s := range scopes {
+		if s.Matches(scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAuthnContext checks that the authentication statements of
+// assertion satisfy sp.RequestedAuthnContext, if there is one.
+func (sp *ServiceProvider) validateAuthnContext(assertion *Assertion) error {
+	requested := sp.RequestedAuthnContext
+	if requested == nil || len(requested.AuthnContextClassRefs) == 0 {
+		return nil
+	}
+	if len(assertion.AuthnStatements) == 0 {
+		return errorOfKind(ErrInsufficientAuthnContext, "assertion does not contain an AuthnStatement")
+	}
+
+	for _, statement := range assertion.AuthnStatements {
+		classRef := authnContextClassRef(statement)
+		satisfied, err := authnContextSatisfies(requested, classRef, sp.AuthnContextClassOrder)
+		if err != nil {
+			return err
 		}
-		if subjectConfirmation.SubjectConfirmationData.NotOnOrAfter.Add(MaxClockSkew).Before(now) {
-			return fmt.Errorf("assertion SubjectConfirmationData is expired")
+		if !satisfied {
+			return errorOfKind(ErrInsufficientAuthnContext, "AuthnStatement AuthnContextClassRef %q does not satisfy the requested authentication context", classRef)
 		}
 	}
-	if assertion.Conditions.NotBefore.Add(-MaxClockSkew).After(now) {
-		return fmt.Errorf("assertion Conditions is not yet valid")
+	return nil
+}
+
+// authnContextClassRef returns the authentication context class of
+// statement, or an empty string if it has none.
+func authnContextClassRef(statement AuthnStatement) string {
+	if statement.AuthnContext.AuthnContextClassRef == nil {
+		return ""
+	}
+	return statement.AuthnContext.AuthnContextClassRef.Value
+}
+
+// validateConditions checks the validity period and audience restrictions of
+// the assertion conditions.
+func (sp *ServiceProvider) validateConditions(conditions *Conditions, now time.Time) error {
+	if conditions.NotBefore.Add(-sp.maxClockSkew()).After(now) {
+		return errorOfKind(ErrAssertionNotYetValid, "assertion Conditions is not yet valid")
 	}
-	if assertion.Conditions.NotOnOrAfter.Add(MaxClockSkew).Before(now) {
-		return fmt.Errorf("assertion Conditions is expired")
+	if conditions.NotOnOrAfter.Add(sp.maxClockSkew()).Before(now) {
+		return errorOfKind(ErrExpiredAssertion, "assertion Conditions is expired")
 	}
 
-	audienceRestrictionsValid := len(assertion.Conditions.AudienceRestrictions) == 0
+	audienceRestrictionsValid := len(conditions.AudienceRestrictions) == 0
 	audience := firstSet(sp.EntityID, sp.MetadataURL.String())
-	for _, audienceRestriction := range assertion.Conditions.AudienceRestrictions {
-		if audienceRestriction.Audience.Value == audience {
+	for _, audienceRestriction := range conditions.AudienceRestrictions {
+		if sp.isAcceptedAudience(audienceRestriction.Audience.Value) {
 			audienceRestrictionsValid = true
 		}
 	}
 	if !audienceRestrictionsValid {
-		return fmt.Errorf("assertion Conditions AudienceRestriction does not contain %q", audience)
+		return errorOfKind(ErrWrongAudience, "assertion Conditions AudienceRestriction does not contain %q", audience)
+	}
+
+	if sp.StrictConditions {
+		if len(conditions.AnyElements) > 0 {
+			return errorOfKind(ErrUnsupportedCondition, "assertion Conditions contains an unsupported condition <%s>", conditions.AnyElements[0].Element.Tag)
+		}
+		if conditions.OneTimeUse != nil && sp.ReplayCache == nil {
+			return errorOfKind(ErrUnsupportedCondition, "assertion Conditions OneTimeUse cannot be enforced without a ReplayCache")
+		}
 	}
 	return nil
 }
@@ -1051,7 +3154,7 @@ func (sp *ServiceProvider) validateArtifactSigned(artifactEl *etree.Element) err
 	}
 	if sigEl != nil {
 		if err = sp.validateSignature(artifactEl); err != nil {
-			return fmt.Errorf("cannot validate signature on Response: %v", err)
+			return errorOfKind(ErrSignatureInvalid, "cannot validate signature on Response: %v", err)
 		}
 		haveSignature = true
 	}
@@ -1062,7 +3165,7 @@ func (sp *ServiceProvider) validateArtifactSigned(artifactEl *etree.Element) err
 	}
 	if responseEl != nil {
 		err = sp.validateSigned(responseEl)
-		if err != nil && err.Error() != "either the Response or Assertion must be signed" {
+		if err != nil && !errors.Is(err, ErrMissingSignature) {
 			return err
 		}
 		if err == nil {
@@ -1071,7 +3174,7 @@ func (sp *ServiceProvider) validateArtifactSigned(artifactEl *etree.Element) err
 	}
 
 	if !haveSignature {
-		return errors.New("either the ArtifactResponse, Response or Assertion must be signed")
+		return errorOfKind(ErrMissingSignature, "either the ArtifactResponse, Response or Assertion must be signed")
 	}
 	return nil
 }
@@ -1090,7 +3193,7 @@ func (sp *ServiceProvider) validateSigned(responseEl *etree.Element) error {
 	}
 	if sigEl != nil {
 		if err = sp.validateSignature(responseEl); err != nil {
-			return fmt.Errorf("cannot validate signature on Response: %v", err)
+			return errorOfKind(ErrSignatureInvalid, "cannot validate signature on Response: %v", err)
 		}
 		haveSignature = true
 	}
@@ -1106,50 +3209,68 @@ func (sp *ServiceProvider) validateSigned(responseEl *etree.Element) error {
 		}
 		if sigEl != nil {
 			if err = sp.validateSignature(assertionEl); err != nil {
-				return fmt.Errorf("cannot validate signature on Response: %v", err)
+				return errorOfKind(ErrSignatureInvalid, "cannot validate signature on Response: %v", err)
 			}
 			haveSignature = true
 		}
 	}
 
 	if !haveSignature {
-		return errors.New("either the Response or Assertion must be signed")
+		return errorOfKind(ErrMissingSignature, "either the Response or Assertion must be signed")
 	}
 	return nil
 }
 
 // validateSignature returns nill iff the Signature embedded in the element is valid
 func (sp *ServiceProvider) validateSignature(el *etree.Element) error {
-	certs, err := sp.getIDPSigningCerts()
+	return sp.validateRoleSignature(el, idpSSORole)
+}
+
+// validateRoleSignature returns nil iff the Signature embedded in el is
+// valid and made with a key of role. See getRoleSigningCerts.
+func (sp *ServiceProvider) validateRoleSignature(el *etree.Element, role idpRole) error {
+	certs, err := sp.getRoleSigningCerts(role)
 	if err != nil {
 		return err
 	}
+	return verifySignature(el, certs, sp.SignatureVerifier, sp.signaturePolicy(), dsigClock(sp.TimeSource))
+}
+
+// responseSignaturePolicy returns ResponseSignaturePolicy, strengthened to
+// require signed assertions if WantAssertionsSigned is true.
+func (sp *ServiceProvider) responseSignaturePolicy() ResponseSignaturePolicy {
+	if sp.WantAssertionsSigned == nil || !*sp.WantAssertionsSigned {
+		return sp.ResponseSignaturePolicy
+	}
+	switch sp.ResponseSignaturePolicy {
+	case RequireResponseSigned, RequireResponseAndAssertionSigned:
+		return RequireResponseAndAssertionSigned
+	default:
+		return RequireAssertionSigned
+	}
+}
+
+// signaturePolicy returns the algorithms allowed in signatures from the IDP.
+func (sp *ServiceProvider) signaturePolicy() signaturePolicy {
+	return signaturePolicy{
+		SignatureMethods: sp.AllowedSignatureMethods,
+		DigestMethods:    sp.AllowedDigestMethods,
+	}
+}
 
+// verifySignature returns nil iff the Signature embedded in el is valid,
+// uses algorithms allowed by policy and was made with one of certs. If
+// verifier is non-nil, it is used to verify the signature instead of the
+// default validation context.
+func verifySignature(el *etree.Element, certs []*x509.Certificate, verifier SignatureVerifier, policy signaturePolicy, clock *dsig.Clock) error {
 	certificateStore := dsig.MemoryX509CertificateStore{
 		Roots: certs,
 	}
 
 	validationContext := dsig.NewDefaultValidationContext(&certificateStore)
 	validationContext.IdAttribute = "ID"
-	if Clock != nil {
-		validationContext.Clock = Clock
-	}
-
-	// Some SAML responses contain a RSAKeyValue element. One of two things is happening here:
-	//
-	// (1) We're getting something signed by a key we already know about -- the public key
-	//     of the signing cert provided in the metadata.
-	// (2) We're getting something signed by a key we *don't* know about, and which we have
-	//     no ability to verify.
-	//
-	// The best course of action is to just remove the KeyInfo so that dsig falls back to
-	// verifying against the public key provided in the metadata.
-	if el.FindElement("./Signature/KeyInfo/X509Data/X509Certificate") == nil {
-		if sigEl := el.FindElement("./Signature"); sigEl != nil {
-			if keyInfo := sigEl.FindElement("KeyInfo"); keyInfo != nil {
-				sigEl.RemoveChild(keyInfo)
-			}
-		}
+	if clock != nil {
+		validationContext.Clock = clock
 	}
 
 	ctx, err := etreeutils.NSBuildParentContext(el)
@@ -1164,37 +3285,40 @@ func (sp *ServiceProvider) validateSignature(el *etree.Element) error {
 	if err != nil {
 		return err
 	}
-
-	if sp.SignatureVerifier != nil {
-		return sp.SignatureVerifier.VerifySignature(validationContext, el)
+	if err := normalizeECDSASignature(el); err != nil {
+		return err
 	}
 
-	_, err = validationContext.Validate(el)
-	return err
+	// Some SAML responses contain a RSAKeyValue element, or refer to the
+	// signing certificate rather than carrying it. One of two things is
+	// happening here:
+	//
+	// (1) We're getting something signed by a key we already know about -- the public key
+	//     of the signing cert provided in the metadata.
+	// (2) We're getting something signed by a key we *don't* know about, and which we have
+	//     no ability to verify.
+	//
+	// The best course of action is to replace the KeyInfo with the certificate from the
+	// metadata that it refers to, or to remove it so that dsig falls back to verifying
+	// against the public key provided in the metadata.
+	resolveKeyInfoCertificate(el, certs)
+	preferTrustedCertificate(el, certs)
+
+	if verifier != nil {
+		err = verifier.VerifySignature(validationContext, el)
+	} else {
+		_, err = validationContext.Validate(el)
+	}
+	if err != nil {
+		return err
+	}
+	return policy.check(el)
 }
 
 // SignLogoutRequest adds the `Signature` element to the `LogoutRequest`.
 func (sp *ServiceProvider) SignLogoutRequest(req *LogoutRequest) error {
-	keyPair := tls.Certificate{
-		Certificate: [][]byte{sp.Certificate.Raw},
-		PrivateKey:  sp.Key,
-		Leaf:        sp.Certificate,
-	}
-	// TODO: add intermediates for SP
-	//for _, cert := range sp.Intermediates {
-	//	keyPair.Certificate = append(keyPair.Certificate, cert.Raw)
-	//}
-	keyStore := dsig.TLSCertKeyStore(keyPair)
-
-	if sp.SignatureMethod != dsig.RSASHA1SignatureMethod &&
-		sp.SignatureMethod != dsig.RSASHA256SignatureMethod &&
-		sp.SignatureMethod != dsig.RSASHA512SignatureMethod {
-		return fmt.Errorf("invalid signing method %s", sp.SignatureMethod)
-	}
-	signatureMethod := sp.SignatureMethod
-	signingContext := dsig.NewDefaultSigningContext(keyStore)
-	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(canonicalizerPrefixList)
-	if err := signingContext.SetSignatureMethod(signatureMethod); err != nil {
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
 		return err
 	}
 
@@ -1212,10 +3336,22 @@ func (sp *ServiceProvider) SignLogoutRequest(req *LogoutRequest) error {
 
 // MakeLogoutRequest produces a new LogoutRequest object for idpURL.
 func (sp *ServiceProvider) MakeLogoutRequest(idpURL, nameID string) (*LogoutRequest, error) {
+	return sp.makeLogoutRequest(idpURL, nameID, sp.AsynchronousLogout)
+}
+
+// MakeSessionLogoutRequest produces a new LogoutRequest object for idpURL
+// that asks the IDP to end only the sessions of the principal with the
+// given indexes, or all of them if there are none.
+func (sp *ServiceProvider) MakeSessionLogoutRequest(idpURL, nameID string, sessionIndexes ...string) (*LogoutRequest, error) {
+	return sp.makeLogoutRequest(idpURL, nameID, sp.AsynchronousLogout, sessionIndexes...)
+}
 
+// makeLogoutRequest produces a new LogoutRequest object for idpURL, carrying
+// the aslo:Asynchronous extension if asynchronous is true.
+func (sp *ServiceProvider) makeLogoutRequest(idpURL, nameID string, asynchronous bool, sessionIndexes ...string) (*LogoutRequest, error) {
 	req := LogoutRequest{
-		ID:           fmt.Sprintf("id-%x", randomBytes(20)),
-		IssueInstant: TimeNow(),
+		ID:           fmt.Sprintf("id-%x", sp.randomBytes(20)),
+		IssueInstant: sp.now(),
 		Version:      "2.0",
 		Destination:  idpURL,
 		Issuer: &Issuer{
@@ -1225,18 +3361,137 @@ func (sp *ServiceProvider) MakeLogoutRequest(idpURL, nameID string) (*LogoutRequ
 		NameID: &NameID{
 			Format:          sp.nameIDFormat(),
 			Value:           nameID,
-			NameQualifier:   sp.IDPMetadata.EntityID,
+			NameQualifier:   sp.idpMetadata().EntityID,
 			SPNameQualifier: sp.Metadata().EntityID,
 		},
 	}
+	for _, sessionIndex := range sessionIndexes {
+		req.SessionIndexes = append(req.SessionIndexes, SessionIndex{Value: sessionIndex})
+	}
+	if asynchronous {
+		req.Extensions = &Extensions{Asynchronous: &Asynchronous{}}
+	}
 	if len(sp.SignatureMethod) > 0 {
 		if err := sp.SignLogoutRequest(&req); err != nil {
 			return nil, err
 		}
 	}
+	sp.requestIssued("LogoutRequest", req.ID, idpURL)
 	return &req, nil
 }
 
+// SendLogoutRequestSOAP sends a LogoutRequest for the principal identified by
+// nameID to the IDP's SOAP Single Logout endpoint, and validates the
+// LogoutResponse that the IDP returns synchronously. The request is signed if
+// SignatureMethod is set, and is retried as specified by SOAPRetries.
+//
+// It returns nil if the IDP logged the principal out. If the IDP did not
+// succeed, the InvalidResponseError's PrivateErr is an ErrBadStatus.
+func (sp *ServiceProvider) SendLogoutRequestSOAP(ctx context.Context, nameID string) error {
+	location := sp.GetSLOBindingLocation(SOAPBinding)
+	if location == "" {
+		return fmt.Errorf("IDP has no SingleLogoutService with binding %s", SOAPBinding)
+	}
+	// the asynchronous extension does not apply to the SOAP binding
+	req, err := sp.makeLogoutRequest(location, nameID, false)
+	if err != nil {
+		return err
+	}
+
+	rawResponseBuf, err := sp.postSOAPWithRetries(ctx, location, req.SoapRequest())
+	if err != nil {
+		return fmt.Errorf("error during logout: %s", err)
+	}
+	return sp.ParseXMLLogoutResponse(rawResponseBuf, req)
+}
+
+// ParseXMLLogoutResponse parses and validates the SOAP response to req. It
+// returns nil if the IDP logged the principal out. The response must be
+// signed by the IDP.
+//
+// If the function fails it will return an InvalidResponseError whose
+// properties are useful in describing which part of the parsing process
+// failed. However, to discourage inadvertent disclosure the diagnostic
+// information, the Error() method returns a static string.
+func (sp *ServiceProvider) ParseXMLLogoutResponse(decodedResponseXML []byte, req *LogoutRequest) error {
+	err := sp.parseXMLLogoutResponse(decodedResponseXML, req)
+	sp.logoutResponseReceived(err)
+	return err
+}
+
+func (sp *ServiceProvider) parseXMLLogoutResponse(decodedResponseXML []byte, req *LogoutRequest) error {
+	now := sp.now()
+	retErr := &InvalidResponseError{
+		Now:      now,
+		Response: string(decodedResponseXML),
+	}
+
+	// ensure that the response XML is well formed before we parse it
+	if err := xrv.Validate(bytes.NewReader(decodedResponseXML)); err != nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "invalid xml: %s", err)
+		return retErr
+	}
+	if err := sp.checkStructure(decodedResponseXML); err != nil {
+		retErr.PrivateErr = err
+		return retErr
+	}
+
+	envelope := &struct {
+		XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+		Body    struct {
+			LogoutResponse LogoutResponse
+		} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	}{}
+	if err := xml.Unmarshal(decodedResponseXML, &envelope); err != nil {
+		retErr.PrivateErr = errorOfKind(ErrMalformedResponse, "cannot unmarshal response: %s", err)
+		return retErr
+	}
+
+	resp := envelope.Body.LogoutResponse
+	if resp.InResponseTo != req.ID {
+		retErr.PrivateErr = fmt.Errorf("`InResponseTo` does not match the request ID (expected %v)", req.ID)
+		return retErr
+	}
+	if resp.IssueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		retErr.PrivateErr = errorOfKind(ErrExpiredResponse, "response IssueInstant expired at %s", resp.IssueInstant.Add(sp.maxIssueDelay()))
+		return retErr
+	}
+	if resp.Issuer != nil && !sp.isTrustedIssuer(resp.Issuer.Value) {
+		retErr.PrivateErr = errorOfKind(ErrWrongIssuer, "response Issuer does not match the IDP metadata (expected %q)", sp.idpMetadata().EntityID)
+		return retErr
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(decodedResponseXML); err != nil {
+		retErr.PrivateErr = err
+		return retErr
+	}
+	responseEl := doc.FindElement("Envelope/Body/LogoutResponse")
+	if responseEl == nil {
+		retErr.PrivateErr = fmt.Errorf("missing LogoutResponse")
+		return retErr
+	}
+	signed, err := responseIsSigned(responseEl)
+	if err != nil {
+		retErr.PrivateErr = err
+		return retErr
+	}
+	if !signed {
+		retErr.PrivateErr = errors.New("LogoutResponse must be signed")
+		return retErr
+	}
+	if err := sp.validateSignature(responseEl); err != nil {
+		retErr.PrivateErr = fmt.Errorf("cannot validate signature on LogoutResponse: %v", err)
+		return retErr
+	}
+
+	if resp.Status.StatusCode.Value != StatusSuccess {
+		retErr.PrivateErr = newErrBadStatus(resp.Status)
+		return retErr
+	}
+	return nil
+}
+
 // MakeRedirectLogoutRequest creates a SAML authentication request using
 // the HTTP-Redirect binding. It returns a URL that we will redirect the user to
 // in order to start the auth process.
@@ -1245,9 +3500,33 @@ func (sp *ServiceProvider) MakeRedirectLogoutRequest(nameID, relayState string)
 	if err != nil {
 		return nil, err
 	}
+	return sp.LogoutRequestRedirectURL(req, relayState)
+}
+
+// LogoutRequestRedirectURL returns the URL that sends req, which was made
+// by MakeLogoutRequest or MakeSessionLogoutRequest, to its Destination
+// using the HTTP-Redirect binding. If SignatureMethod is set, the
+// signature is carried in the query.
+func (sp *ServiceProvider) LogoutRequestRedirectURL(req *LogoutRequest, relayState string) (*url.URL, error) {
+	if len(sp.SignatureMethod) > 0 {
+		// the binding carries the signature in the query instead
+		unsigned := *req
+		unsigned.Signature = nil
+		return sp.redirectURL(unsigned.Destination, "SAMLRequest", unsigned.Element(), relayState)
+	}
 	return req.Redirect(relayState), nil
 }
 
+// redirectURL returns a URL that sends el to destination using the
+// HTTP-Redirect binding, signed with our signing key.
+func (sp *ServiceProvider) redirectURL(destination string, param string, el *etree.Element, relayState string) (*url.URL, error) {
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
+		return nil, err
+	}
+	return signedRedirectURL(destination, param, el, relayState, sp.signatureMethod(), signingContext)
+}
+
 // Redirect returns a URL suitable for using the redirect binding with the request
 func (req *LogoutRequest) Redirect(relayState string) *url.URL {
 	w := &bytes.Buffer{}
@@ -1320,13 +3599,46 @@ func (req *LogoutRequest) Post(relayState string) []byte {
 	return rv.Bytes()
 }
 
+// EncryptNameID replaces the NameID of the request with an EncryptedID that
+// can only be decrypted with the private key of cert, typically the
+// encryption certificate from the metadata of the recipient. The request
+// must be signed after the NameID has been encrypted.
+func (req *LogoutRequest) EncryptNameID(cert *x509.Certificate) error {
+	if req.NameID == nil {
+		return errors.New("request has no NameID")
+	}
+
+	nameIDEl := req.NameID.Element()
+	nameIDEl.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	doc := etree.NewDocument()
+	doc.SetRoot(nameIDEl)
+	plaintext, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+
+	encryptor := xmlenc.OAEP()
+	encryptor.BlockCipher = xmlenc.AES128CBC
+	encryptor.DigestMethod = &xmlenc.SHA1
+	encryptedDataEl, err := encryptor.Encrypt(cert, plaintext, nil)
+	if err != nil {
+		return err
+	}
+	encryptedDataEl.CreateAttr("Type", "http://www.w3.org/2001/04/xmlenc#Element")
+
+	req.EncryptedID = etree.NewElement("saml:EncryptedID")
+	req.EncryptedID.AddChild(encryptedDataEl)
+	req.NameID = nil
+	return nil
+}
+
 // MakeLogoutResponse produces a new LogoutResponse object for idpURL and logoutRequestID.
 func (sp *ServiceProvider) MakeLogoutResponse(idpURL, logoutRequestID string) (*LogoutResponse, error) {
 	response := LogoutResponse{
-		ID:           fmt.Sprintf("id-%x", randomBytes(20)),
+		ID:           fmt.Sprintf("id-%x", sp.randomBytes(20)),
 		InResponseTo: logoutRequestID,
 		Version:      "2.0",
-		IssueInstant: TimeNow(),
+		IssueInstant: sp.now(),
 		Destination:  idpURL,
 		Issuer: &Issuer{
 			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
@@ -1355,6 +3667,11 @@ func (sp *ServiceProvider) MakeRedirectLogoutResponse(logoutRequestID, relayStat
 	if err != nil {
 		return nil, err
 	}
+	if len(sp.SignatureMethod) > 0 {
+		// the binding carries the signature in the query instead
+		resp.Signature = nil
+		return sp.redirectURL(resp.Destination, "SAMLResponse", resp.Element(), relayState)
+	}
 	return resp.Redirect(relayState), nil
 }
 
@@ -1432,26 +3749,8 @@ func (resp *LogoutResponse) Post(relayState string) []byte {
 
 // SignLogoutResponse adds the `Signature` element to the `LogoutResponse`.
 func (sp *ServiceProvider) SignLogoutResponse(resp *LogoutResponse) error {
-	keyPair := tls.Certificate{
-		Certificate: [][]byte{sp.Certificate.Raw},
-		PrivateKey:  sp.Key,
-		Leaf:        sp.Certificate,
-	}
-	// TODO: add intermediates for SP
-	//for _, cert := range sp.Intermediates {
-	//	keyPair.Certificate = append(keyPair.Certificate, cert.Raw)
-	//}
-	keyStore := dsig.TLSCertKeyStore(keyPair)
-
-	if sp.SignatureMethod != dsig.RSASHA1SignatureMethod &&
-		sp.SignatureMethod != dsig.RSASHA256SignatureMethod &&
-		sp.SignatureMethod != dsig.RSASHA512SignatureMethod {
-		return fmt.Errorf("invalid signing method %s", sp.SignatureMethod)
-	}
-	signatureMethod := sp.SignatureMethod
-	signingContext := dsig.NewDefaultSigningContext(keyStore)
-	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(canonicalizerPrefixList)
-	if err := signingContext.SetSignatureMethod(signatureMethod); err != nil {
+	signingContext, err := GetSigningContext(sp)
+	if err != nil {
 		return err
 	}
 
@@ -1467,6 +3766,27 @@ func (sp *ServiceProvider) SignLogoutResponse(resp *LogoutResponse) error {
 	return nil
 }
 
+// nameIDPolicy returns the NameIDPolicy to send in authentication requests,
+// or nil if it is omitted.
+func (sp *ServiceProvider) nameIDPolicy() *NameIDPolicy {
+	if sp.OmitNameIDPolicy {
+		return nil
+	}
+	nameIDFormat := sp.nameIDFormat()
+	if sp.NameIDPolicy == nil {
+		allowCreate := true
+		return &NameIDPolicy{
+			AllowCreate: &allowCreate,
+			Format:      &nameIDFormat,
+		}
+	}
+	policy := *sp.NameIDPolicy
+	if policy.Format == nil {
+		policy.Format = &nameIDFormat
+	}
+	return &policy
+}
+
 func (sp *ServiceProvider) nameIDFormat() string {
 	var nameIDFormat string
 	switch sp.AuthnNameIDFormat {
@@ -1483,46 +3803,84 @@ func (sp *ServiceProvider) nameIDFormat() string {
 
 // ValidateLogoutResponseRequest validates the LogoutResponse content from the request
 func (sp *ServiceProvider) ValidateLogoutResponseRequest(req *http.Request) error {
-	if data := req.URL.Query().Get("SAMLResponse"); data != "" {
-		return sp.ValidateLogoutResponseRedirect(data)
+	_, err := sp.parseLogoutResponseRequest(req)
+	sp.logoutResponseReceived(err)
+	return err
+}
+
+// ParseLogoutResponse validates the LogoutResponse that the IDP sent to our
+// SLO endpoint, using either the HTTP-Redirect or the HTTP-POST binding, in
+// answer to one of the LogoutRequests with possibleRequestIDs, and returns
+// it.
+func (sp *ServiceProvider) ParseLogoutResponse(req *http.Request, possibleRequestIDs []string) (*LogoutResponse, error) {
+	resp, err := sp.parseLogoutResponseRequest(req)
+	if err == nil && !containsString(possibleRequestIDs, resp.InResponseTo) {
+		err = errorOfKind(ErrStaleInResponseTo, "`InResponseTo` does not match any of the possible request IDs (expected %v)", possibleRequestIDs)
+	}
+	sp.logoutResponseReceived(err)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (sp *ServiceProvider) parseLogoutResponseRequest(req *http.Request) (*LogoutResponse, error) {
+	query := req.URL.Query()
+	if data := query.Get("SAMLResponse"); data != "" {
+		if !hasRedirectSignature(query) {
+			return sp.validateLogoutResponseRedirect(data, "")
+		}
+		return sp.validateLogoutResponseRedirect(data, req.URL.RawQuery)
 	}
 
 	err := req.ParseForm()
 	if err != nil {
-		return fmt.Errorf("unable to parse form: %v", err)
+		return nil, fmt.Errorf("unable to parse form: %v", err)
 	}
 
-	return sp.ValidateLogoutResponseForm(req.PostForm.Get("SAMLResponse"))
+	return sp.validateLogoutResponseForm(req.PostForm.Get("SAMLResponse"))
 }
 
 // ValidateLogoutResponseForm returns a nil error if the logout response is valid.
 func (sp *ServiceProvider) ValidateLogoutResponseForm(postFormData string) error {
+	_, err := sp.validateLogoutResponseForm(postFormData)
+	sp.logoutResponseReceived(err)
+	return err
+}
+
+func (sp *ServiceProvider) validateLogoutResponseForm(postFormData string) (*LogoutResponse, error) {
 	rawResponseBuf, err := base64.StdEncoding.DecodeString(postFormData)
 	if err != nil {
-		return fmt.Errorf("unable to parse base64: %s", err)
+		return nil, fmt.Errorf("unable to parse base64: %s", err)
 	}
 
 	// TODO(ross): add test case for this (SLO does not have tests right now)
 	if err := xrv.Validate(bytes.NewReader(rawResponseBuf)); err != nil {
-		return fmt.Errorf("response contains invalid XML: %s", err)
+		return nil, fmt.Errorf("response contains invalid XML: %s", err)
+	}
+	if err := sp.checkStructure(rawResponseBuf); err != nil {
+		return nil, err
 	}
 
 	var resp LogoutResponse
 	if err := xml.Unmarshal(rawResponseBuf, &resp); err != nil {
-		return fmt.Errorf("cannot unmarshal response: %s", err)
+		return nil, fmt.Errorf("cannot unmarshal response: %s", err)
 	}
 
 	if err := sp.validateLogoutResponse(&resp); err != nil {
-		return err
+		return nil, err
 	}
 
 	doc := etree.NewDocument()
 	if err := doc.ReadFromBytes(rawResponseBuf); err != nil {
-		return err
+		return nil, err
 	}
 
 	responseEl := doc.Root()
-	return sp.validateSigned(responseEl)
+	if err := sp.validateSigned(responseEl); err != nil {
+		return nil, err
+	}
+	return &resp, nil
 }
 
 // ValidateLogoutResponseRedirect returns a nil error if the logout response is valid.
@@ -1530,18 +3888,31 @@ func (sp *ServiceProvider) ValidateLogoutResponseForm(postFormData string) error
 // URL Binding appears to be gzip / flate encoded
 // See https://www.oasis-open.org/committees/download.php/20645/sstc-saml-tech-overview-2%200-draft-10.pdf  6.6
 func (sp *ServiceProvider) ValidateLogoutResponseRedirect(queryParameterData string) error {
+	_, err := sp.validateLogoutResponseRedirect(queryParameterData, "")
+	sp.logoutResponseReceived(err)
+	return err
+}
+
+// validateLogoutResponseRedirect validates the logout response sent using
+// the HTTP-Redirect binding. If rawQuery is not empty, it is the query that
+// the response was received with, which carries the signature of the IDP.
+// Otherwise the response itself must be signed.
+func (sp *ServiceProvider) validateLogoutResponseRedirect(queryParameterData string, rawQuery string) (*LogoutResponse, error) {
 	rawResponseBuf, err := base64.StdEncoding.DecodeString(queryParameterData)
 	if err != nil {
-		return fmt.Errorf("unable to parse base64: %s", err)
+		return nil, fmt.Errorf("unable to parse base64: %s", err)
 	}
 
 	gr, err := ioutil.ReadAll(flate.NewReader(bytes.NewBuffer(rawResponseBuf)))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if err := xrv.Validate(bytes.NewReader(gr)); err != nil {
-		return err
+		return nil, err
+	}
+	if err := sp.checkStructure(gr); err != nil {
+		return nil, err
 	}
 
 	decoder := xml.NewDecoder(bytes.NewReader(gr))
@@ -1550,20 +3921,41 @@ func (sp *ServiceProvider) ValidateLogoutResponseRedirect(queryParameterData str
 
 	err = decoder.Decode(&resp)
 	if err != nil {
-		return fmt.Errorf("unable to flate decode: %s", err)
+		return nil, fmt.Errorf("unable to flate decode: %s", err)
 	}
 
 	if err := sp.validateLogoutResponse(&resp); err != nil {
-		return err
+		return nil, err
 	}
 
 	doc := etree.NewDocument()
 	if _, err := doc.ReadFrom(bytes.NewReader(gr)); err != nil {
-		return err
+		return nil, err
+	}
+
+	if rawQuery != "" {
+		if err := sp.validateRedirectSignature(rawQuery); err != nil {
+			return nil, errorOfKind(ErrSignatureInvalid, "cannot validate signature on LogoutResponse: %v", err)
+		}
+		return &resp, nil
 	}
 
 	responseEl := doc.Root()
-	return sp.validateSigned(responseEl)
+	if err := sp.validateSigned(responseEl); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// validateRedirectSignature returns nil iff rawQuery, the query of a message
+// that the IDP sent using the HTTP-Redirect binding, carries a valid
+// signature of the IDP.
+func (sp *ServiceProvider) validateRedirectSignature(rawQuery string) error {
+	certs, err := sp.getRoleSigningCerts(idpSSORole)
+	if err != nil {
+		return err
+	}
+	return verifyRedirectSignature(rawQuery, certs, sp.signaturePolicy())
 }
 
 // validateLogoutResponse validates the LogoutResponse fields. Returns a nil error if the LogoutResponse is valid.
@@ -1572,12 +3964,12 @@ func (sp *ServiceProvider) validateLogoutResponse(resp *LogoutResponse) error {
 		return fmt.Errorf("`Destination` does not match SloURL (expected %q)", sp.SloURL.String())
 	}
 
-	now := time.Now()
-	if resp.IssueInstant.Add(MaxIssueDelay).Before(now) {
-		return fmt.Errorf("issueInstant expired at %s", resp.IssueInstant.Add(MaxIssueDelay))
+	now := sp.now()
+	if resp.IssueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		return fmt.Errorf("issueInstant expired at %s", resp.IssueInstant.Add(sp.maxIssueDelay()))
 	}
-	if resp.Issuer.Value != sp.IDPMetadata.EntityID {
-		return fmt.Errorf("issuer does not match the IDP metadata (expected %q)", sp.IDPMetadata.EntityID)
+	if !sp.isTrustedIssuer(resp.Issuer.Value) {
+		return fmt.Errorf("issuer does not match the IDP metadata (expected %q)", sp.idpMetadata().EntityID)
 	}
 	if resp.Status.StatusCode.Value != StatusSuccess {
 		return fmt.Errorf("status code was not %s", StatusSuccess)
@@ -1586,6 +3978,141 @@ func (sp *ServiceProvider) validateLogoutResponse(resp *LogoutResponse) error {
 	return nil
 }
 
+// ValidateLogoutRequestRequest validates the LogoutRequest that the IDP sent
+// to our SLO endpoint, using either the HTTP-Redirect or the HTTP-POST binding.
+// It returns the validated request, which is needed to build the
+// LogoutResponse.
+func (sp *ServiceProvider) ValidateLogoutRequestRequest(req *http.Request) (*LogoutRequest, error) {
+	query := req.URL.Query()
+	if data := query.Get("SAMLRequest"); data != "" {
+		if hasRedirectSignature(query) {
+			return sp.validateLogoutRequestRedirect(data, req.URL.RawQuery)
+		}
+		return sp.ValidateLogoutRequestRedirect(data)
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse form: %v", err)
+	}
+
+	return sp.ValidateLogoutRequestForm(req.PostForm.Get("SAMLRequest"))
+}
+
+// ValidateLogoutRequestForm returns the LogoutRequest if the logout request
+// sent using the HTTP-POST binding is valid.
+func (sp *ServiceProvider) ValidateLogoutRequestForm(postFormData string) (*LogoutRequest, error) {
+	rawRequestBuf, err := base64.StdEncoding.DecodeString(postFormData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse base64: %s", err)
+	}
+	return sp.validateLogoutRequestXML(rawRequestBuf, "")
+}
+
+// ValidateLogoutRequestRedirect returns the LogoutRequest if the logout
+// request sent using the HTTP-Redirect binding is valid.
+func (sp *ServiceProvider) ValidateLogoutRequestRedirect(queryParameterData string) (*LogoutRequest, error) {
+	return sp.validateLogoutRequestRedirect(queryParameterData, "")
+}
+
+// validateLogoutRequestRedirect returns the LogoutRequest if the logout
+// request sent using the HTTP-Redirect binding is valid. If rawQuery is not
+// empty, it is the query that the request was received with, which carries
+// the signature of the IDP.
+func (sp *ServiceProvider) validateLogoutRequestRedirect(queryParameterData string, rawQuery string) (*LogoutRequest, error) {
+	rawRequestBuf, err := base64.StdEncoding.DecodeString(queryParameterData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse base64: %s", err)
+	}
+
+	gr, err := ioutil.ReadAll(flate.NewReader(bytes.NewBuffer(rawRequestBuf)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to flate decode: %s", err)
+	}
+	return sp.validateLogoutRequestXML(gr, rawQuery)
+}
+
+// validateLogoutRequestXML validates the decoded LogoutRequest XML, including
+// the signature of the IDP, which is required. The signature is carried by
+// rawQuery if it is not empty, and by the request itself otherwise.
+func (sp *ServiceProvider) validateLogoutRequestXML(rawRequestBuf []byte, rawQuery string) (*LogoutRequest, error) {
+	req, err := sp.parseLogoutRequestXML(rawRequestBuf, rawQuery)
+	sp.logoutRequestReceived(req, err)
+	return req, err
+}
+
+func (sp *ServiceProvider) parseLogoutRequestXML(rawRequestBuf []byte, rawQuery string) (*LogoutRequest, error) {
+	if err := xrv.Validate(bytes.NewReader(rawRequestBuf)); err != nil {
+		return nil, fmt.Errorf("request contains invalid XML: %s", err)
+	}
+	if err := sp.checkStructure(rawRequestBuf); err != nil {
+		return nil, err
+	}
+
+	var req LogoutRequest
+	if err := xml.Unmarshal(rawRequestBuf, &req); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal request: %s", err)
+	}
+
+	if err := sp.validateLogoutRequest(&req); err != nil {
+		return nil, err
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(rawRequestBuf); err != nil {
+		return nil, err
+	}
+	requestEl := doc.Root()
+	if rawQuery != "" {
+		if err := sp.validateRedirectSignature(rawQuery); err != nil {
+			return nil, fmt.Errorf("cannot validate signature on LogoutRequest: %v", err)
+		}
+	} else {
+		sigEl, err := findChild(requestEl, "http://www.w3.org/2000/09/xmldsig#", "Signature")
+		if err != nil {
+			return nil, err
+		}
+		if sigEl == nil {
+			return nil, errors.New("LogoutRequest must be signed")
+		}
+		if err := sp.validateSignature(requestEl); err != nil {
+			return nil, fmt.Errorf("cannot validate signature on LogoutRequest: %v", err)
+		}
+	}
+
+	if req.EncryptedID != nil {
+		var err error
+		req.NameID, err = decryptNameID(sp.decryptionKeys(), requestEl.FindElement("./EncryptedID"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt NameID: %v", err)
+		}
+		req.EncryptedID = nil
+	}
+	if req.NameID == nil {
+		return nil, errors.New("LogoutRequest has no NameID")
+	}
+	return &req, nil
+}
+
+// validateLogoutRequest validates the LogoutRequest fields. Returns a nil error if the LogoutRequest is valid.
+func (sp *ServiceProvider) validateLogoutRequest(req *LogoutRequest) error {
+	if req.Destination != "" && req.Destination != sp.SloURL.String() {
+		return fmt.Errorf("`Destination` does not match SloURL (expected %q)", sp.SloURL.String())
+	}
+
+	now := sp.now()
+	if req.IssueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		return fmt.Errorf("issueInstant expired at %s", req.IssueInstant.Add(sp.maxIssueDelay()))
+	}
+	if req.NotOnOrAfter != nil && !now.Before(*req.NotOnOrAfter) {
+		return fmt.Errorf("request expired at %s", req.NotOnOrAfter)
+	}
+	if req.Issuer == nil || !sp.isTrustedIssuer(req.Issuer.Value) {
+		return fmt.Errorf("issuer does not match the IDP metadata (expected %q)", sp.idpMetadata().EntityID)
+	}
+	return nil
+}
+
 func firstSet(a, b string) string {
 	if a == "" {
 		return b
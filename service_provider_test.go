@@ -2,12 +2,18 @@ package saml
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"html"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"regexp"
 	"strings"
@@ -22,6 +28,7 @@ import (
 	dsig "github.com/russellhaering/goxmldsig"
 
 	"github.com/crewjam/saml/testsaml"
+	"github.com/crewjam/saml/xmlenc"
 )
 
 type ServiceProviderTest struct {
@@ -104,6 +111,51 @@ func TestSPCanSetAuthenticationNameIDFormat(t *testing.T) {
 	assert.Check(t, is.Equal(string(EmailAddressNameIDFormat), *req.NameIDPolicy.Format))
 }
 
+func TestSPCanSetAuthenticationNameIDPolicy(t *testing.T) {
+	test := NewServiceProviderTest(t)
+
+	s := ServiceProvider{
+		Key:               test.Key,
+		Certificate:       test.Certificate,
+		MetadataURL:       mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:            mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		AuthnNameIDFormat: PersistentNameIDFormat,
+	}
+	policyXML := func(req *AuthnRequest) string {
+		doc := etree.NewDocument()
+		doc.SetRoot(req.NameIDPolicy.Element())
+		x, err := doc.WriteToString()
+		assert.Check(t, err)
+		return x
+	}
+
+	// defaults to AllowCreate="true"
+	req, err := s.MakeAuthenticationRequest("", HTTPRedirectBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(`<samlp:NameIDPolicy Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent" AllowCreate="true"/>`, policyXML(req)))
+
+	// AllowCreate="false" and an SPNameQualifier
+	allowCreate := false
+	spNameQualifier := "https://affiliation.example.com/"
+	s.NameIDPolicy = &NameIDPolicy{AllowCreate: &allowCreate, SPNameQualifier: &spNameQualifier}
+	req, err = s.MakeAuthenticationRequest("", HTTPRedirectBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(`<samlp:NameIDPolicy Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent" SPNameQualifier="https://affiliation.example.com/" AllowCreate="false"/>`, policyXML(req)))
+	assert.Check(t, is.Nil(s.NameIDPolicy.Format))
+
+	// AllowCreate omitted
+	s.NameIDPolicy = &NameIDPolicy{}
+	req, err = s.MakeAuthenticationRequest("", HTTPRedirectBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(`<samlp:NameIDPolicy Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"/>`, policyXML(req)))
+
+	// NameIDPolicy omitted
+	s.OmitNameIDPolicy = true
+	req, err = s.MakeAuthenticationRequest("", HTTPRedirectBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	assert.Check(t, is.Nil(req.NameIDPolicy))
+}
+
 func TestSPCanProduceMetadataWithEncryptionCert(t *testing.T) {
 	test := NewServiceProviderTest(t)
 	s := ServiceProvider{
@@ -123,6 +175,95 @@ func TestSPCanProduceMetadataWithEncryptionCert(t *testing.T) {
 	golden.Assert(t, string(spMetadata), t.Name()+"_metadata")
 }
 
+func TestSPCanProduceMetadataWithoutValidUntil(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:                    test.Key,
+		Certificate:            test.Certificate,
+		MetadataURL:            mustParseURL("https://example.com/saml2/metadata"),
+		AcsURL:                 mustParseURL("https://example.com/saml2/acs"),
+		MetadataCacheDuration:  time.Hour,
+		OmitMetadataValidUntil: true,
+	}
+
+	buf, err := xml.Marshal(s.Metadata())
+	assert.Assert(t, err)
+	assert.Check(t, !strings.Contains(string(buf), "validUntil"), string(buf))
+	assert.Check(t, strings.Contains(string(buf), `cacheDuration="PT1H"`), string(buf))
+
+	var actual EntityDescriptor
+	assert.Assert(t, xml.Unmarshal(buf, &actual))
+	assert.Check(t, actual.ValidUntil.IsZero())
+	assert.Check(t, is.Equal(time.Hour, actual.CacheDuration))
+}
+
+func TestSPCanProduceMetadataWithSigningFlags(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:             test.Key,
+		Certificate:     test.Certificate,
+		MetadataURL:     mustParseURL("https://example.com/saml2/metadata"),
+		AcsURL:          mustParseURL("https://example.com/saml2/acs"),
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+	}
+	spssoDescriptor := s.Metadata().SPSSODescriptors[0]
+	assert.Check(t, *spssoDescriptor.AuthnRequestsSigned)
+	assert.Check(t, *spssoDescriptor.WantAssertionsSigned)
+
+	authnRequestsSigned, wantAssertionsSigned := false, false
+	s.AuthnRequestsSigned = &authnRequestsSigned
+	s.WantAssertionsSigned = &wantAssertionsSigned
+	spssoDescriptor = s.Metadata().SPSSODescriptors[0]
+	assert.Check(t, !*spssoDescriptor.AuthnRequestsSigned)
+	assert.Check(t, !*spssoDescriptor.WantAssertionsSigned)
+}
+
+func TestSPResponseSignaturePolicyHonorsWantAssertionsSigned(t *testing.T) {
+	s := ServiceProvider{ResponseSignaturePolicy: RequireResponseSigned}
+	assert.Check(t, is.Equal(RequireResponseSigned, s.responseSignaturePolicy()))
+
+	wantAssertionsSigned := true
+	s.WantAssertionsSigned = &wantAssertionsSigned
+	assert.Check(t, is.Equal(RequireResponseAndAssertionSigned, s.responseSignaturePolicy()))
+	s.ResponseSignaturePolicy = EitherSignatureSufficient
+	assert.Check(t, is.Equal(RequireAssertionSigned, s.responseSignaturePolicy()))
+	err := s.responseSignaturePolicy().check(true, false)
+	assert.Check(t, errors.Is(err, ErrMissingSignature))
+}
+
+func TestSPCanProduceSignedMetadata(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.Certificate.NotBefore)
+	s := ServiceProvider{
+		Key:             test.Key,
+		Certificate:     test.Certificate,
+		MetadataURL:     mustParseURL("https://example.com/saml2/metadata"),
+		AcsURL:          mustParseURL("https://example.com/saml2/acs"),
+		IDPMetadata:     &EntityDescriptor{},
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	md, err := s.SignedMetadata()
+	assert.Assert(t, err)
+	assert.Check(t, md.ID != "")
+	assert.Check(t, md.Signature != nil)
+
+	buf, err := xml.Marshal(md)
+	assert.Assert(t, err)
+	assert.Check(t, VerifyMetadataSignature(buf, []*x509.Certificate{test.Certificate}))
+
+	var actual EntityDescriptor
+	assert.Assert(t, xml.Unmarshal(buf, &actual))
+	assert.Check(t, is.Equal("Signature", actual.Signature.Tag))
+
+	md.EntityID = "https://evil.example.com/saml2/metadata"
+	buf, err = xml.Marshal(md)
+	assert.Assert(t, err)
+	assert.Check(t, is.ErrorContains(VerifyMetadataSignature(buf, []*x509.Certificate{test.Certificate}), "cannot validate signature on metadata"))
+}
+
 func TestSPCanProduceMetadataWithBothCerts(t *testing.T) {
 	test := NewServiceProviderTest(t)
 	s := ServiceProvider{
@@ -145,6 +286,127 @@ func TestSPCanProduceMetadataWithBothCerts(t *testing.T) {
 
 }
 
+func TestSPCanProduceMetadataWithAttributeConsumingService(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	isRequired := true
+	s := ServiceProvider{
+		Key:            test.Key,
+		Certificate:    test.Certificate,
+		MetadataURL:    mustParseURL("https://example.com/saml2/metadata"),
+		AcsURL:         mustParseURL("https://example.com/saml2/acs"),
+		SloURL:         mustParseURL("https://example.com/saml2/slo"),
+		IDPMetadata:    &EntityDescriptor{},
+		LogoutBindings: []string{HTTPPostBinding},
+		AttributeConsumingServices: []AttributeConsumingService{
+			{
+				Index:               1,
+				ServiceNames:        []LocalizedName{{Lang: "en", Value: "Example"}, {Lang: "de", Value: "Beispiel"}},
+				ServiceDescriptions: []LocalizedName{{Lang: "en", Value: "An example service"}},
+				RequestedAttributes: []RequestedAttribute{
+					{
+						Attribute: Attribute{
+							FriendlyName: "mail",
+							Name:         "urn:oid:0.9.2342.19200300.100.1.3",
+							NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+						},
+						IsRequired: &isRequired,
+					},
+					{
+						Attribute: Attribute{
+							FriendlyName: "displayName",
+							Name:         "urn:oid:2.16.840.1.113730.3.1.241",
+							NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+						},
+					},
+				},
+			},
+		},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	spMetadata, err := xml.MarshalIndent(s.Metadata(), "", "  ")
+	assert.Check(t, err)
+	golden.Assert(t, string(spMetadata), t.Name()+"_metadata")
+
+	var actual EntityDescriptor
+	assert.Check(t, xml.Unmarshal(spMetadata, &actual))
+	assert.Check(t, is.DeepEqual(s.AttributeConsumingServices, actual.SPSSODescriptors[0].AttributeConsumingServices))
+}
+
+func TestSPCanProduceMetadataWithContacts(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:            test.Key,
+		Certificate:    test.Certificate,
+		MetadataURL:    mustParseURL("https://example.com/saml2/metadata"),
+		AcsURL:         mustParseURL("https://example.com/saml2/acs"),
+		SloURL:         mustParseURL("https://example.com/saml2/slo"),
+		IDPMetadata:    &EntityDescriptor{},
+		LogoutBindings: []string{HTTPPostBinding},
+		Organization: &Organization{
+			OrganizationNames:        []LocalizedName{{Lang: "en", Value: "Example"}, {Lang: "de", Value: "Beispiel"}},
+			OrganizationDisplayNames: []LocalizedName{{Lang: "en", Value: "Example Inc."}},
+			OrganizationURLs:         []LocalizedURI{{Lang: "en", Value: "https://example.com/"}},
+		},
+		ContactPeople: []ContactPerson{
+			{
+				ContactType:    "technical",
+				GivenName:      "Alice",
+				EmailAddresses: []string{"mailto:alice@example.com"},
+			},
+			{
+				ContactType:     "other",
+				RemdContactType: REFEDSSecurityContactType,
+				GivenName:       "Security Team",
+				EmailAddresses:  []string{"mailto:security@example.com"},
+			},
+		},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	spMetadata, err := xml.MarshalIndent(s.Metadata(), "", "  ")
+	assert.Check(t, err)
+	golden.Assert(t, string(spMetadata), t.Name()+"_metadata")
+
+	var actual EntityDescriptor
+	assert.Check(t, xml.Unmarshal(spMetadata, &actual))
+	assert.Check(t, is.DeepEqual(s.Organization, actual.Organization))
+	assert.Check(t, is.DeepEqual(s.ContactPeople, actual.ContactPeople))
+}
+
+func TestSPCanProduceMetadataWithUIInfo(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:            test.Key,
+		Certificate:    test.Certificate,
+		MetadataURL:    mustParseURL("https://example.com/saml2/metadata"),
+		AcsURL:         mustParseURL("https://example.com/saml2/acs"),
+		SloURL:         mustParseURL("https://example.com/saml2/slo"),
+		IDPMetadata:    &EntityDescriptor{},
+		LogoutBindings: []string{HTTPPostBinding},
+		UIInfo: &UIInfo{
+			DisplayNames:         []LocalizedName{{Lang: "en", Value: "Example"}},
+			Descriptions:         []LocalizedName{{Lang: "en", Value: "An example service"}},
+			Logos:                []Logo{{Height: 60, Width: 80, Value: "https://example.com/logo.png"}},
+			InformationURLs:      []LocalizedURI{{Lang: "en", Value: "https://example.com/about"}},
+			PrivacyStatementURLs: []LocalizedURI{{Lang: "en", Value: "https://example.com/privacy"}},
+		},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	spMetadata, err := xml.MarshalIndent(s.Metadata(), "", "  ")
+	assert.Check(t, err)
+	golden.Assert(t, string(spMetadata), t.Name()+"_metadata")
+
+	var actual EntityDescriptor
+	assert.Check(t, xml.Unmarshal(spMetadata, &actual))
+	assert.Check(t, is.Equal("Example", actual.UIInfo().DisplayName("en")))
+	assert.Check(t, is.DeepEqual(s.UIInfo.Logos, actual.UIInfo().Logos))
+}
+
 func TestCanProduceMetadataNoCerts(t *testing.T) {
 	test := NewServiceProviderTest(t)
 	s := ServiceProvider{
@@ -266,6 +528,48 @@ func TestSPCanProducePostRequest(t *testing.T) {
 	golden.Assert(t, string(form), t.Name()+"_form")
 }
 
+func TestSPSignsWithAlgorithmSupportedByIDP(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:             test.Key,
+		Certificate:     test.Certificate,
+		MetadataURL:     mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:          mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata:     &EntityDescriptor{},
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	// the IDP does not declare the algorithms it supports
+	assert.Check(t, is.Equal(dsig.RSASHA256SignatureMethod, s.signatureMethod()))
+
+	// the IDP supports the configured algorithm
+	s.IDPMetadata.Extensions = &MetadataExtensions{SigningMethods: []SigningMethod{
+		{Algorithm: dsig.RSASHA512SignatureMethod},
+		{Algorithm: dsig.RSASHA256SignatureMethod},
+	}}
+	assert.Check(t, is.Equal(dsig.RSASHA256SignatureMethod, s.signatureMethod()))
+
+	// the IDP does not support the configured algorithm, so the first one
+	// that it supports for RSA keys is used
+	s.IDPMetadata.Extensions = nil
+	s.IDPMetadata.IDPSSODescriptors[0].Extensions = &MetadataExtensions{SigningMethods: []SigningMethod{
+		{Algorithm: dsig.ECDSASHA256SignatureMethod},
+		{Algorithm: dsig.RSASHA512SignatureMethod},
+	}}
+	assert.Check(t, is.Equal(dsig.RSASHA512SignatureMethod, s.signatureMethod()))
+	redirectURL, err := s.MakeRedirectAuthenticationRequest("relayState")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(dsig.RSASHA512SignatureMethod, redirectURL.Query().Get("SigAlg")))
+
+	// none of the algorithms that the IDP supports can be used
+	s.IDPMetadata.IDPSSODescriptors[0].Extensions = &MetadataExtensions{SigningMethods: []SigningMethod{
+		{Algorithm: dsig.ECDSASHA256SignatureMethod},
+	}}
+	assert.Check(t, is.Equal(dsig.RSASHA256SignatureMethod, s.signatureMethod()))
+}
+
 func TestSPCanProduceSignedRequestRedirectBinding(t *testing.T) {
 	test := NewServiceProviderTest(t)
 	TimeNow = func() time.Time {
@@ -331,6 +635,49 @@ func TestSPCanProduceSignedRequestPostBinding(t *testing.T) {
 	golden.Assert(t, string(decodedRequest), t.Name()+"_decodedRequest")
 }
 
+func TestSPCanModifyAuthnRequest(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:             test.Key,
+		Certificate:     test.Certificate,
+		MetadataURL:     mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:          mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata:     &EntityDescriptor{},
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+		ModifyAuthnRequest: func(req *AuthnRequest) error {
+			if req.Signature != nil {
+				return errors.New("request is already signed")
+			}
+			forceAuthn := true
+			req.ForceAuthn = &forceAuthn
+			return nil
+		},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req, err := s.MakeAuthenticationRequest(s.GetSSOBindingLocation(HTTPPostBinding), HTTPPostBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	assert.Check(t, req.ForceAuthn != nil && *req.ForceAuthn)
+	assert.Check(t, req.Signature != nil)
+
+	// the signature covers the modified request
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Element())
+	validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{test.Certificate},
+	})
+	validationContext.Clock = dsig.NewFakeClockAt(test.Certificate.NotBefore)
+	_, err = validationContext.Validate(doc.Root())
+	assert.Check(t, err)
+
+	s.ModifyAuthnRequest = func(req *AuthnRequest) error {
+		return errors.New("cannot modify request")
+	}
+	_, err = s.MakeAuthenticationRequest(s.GetSSOBindingLocation(HTTPPostBinding), HTTPPostBinding, HTTPPostBinding)
+	assert.Check(t, is.Error(err, "cannot modify request"))
+}
+
 func TestSPFailToProduceSignedRequestWithBogusSignatureMethod(t *testing.T) {
 	test := NewServiceProviderTest(t)
 	TimeNow = func() time.Time {
@@ -467,6 +814,10 @@ func TestSPCanHandleOneloginResponse(t *testing.T) {
 		MetadataURL: mustParseURL("https://29ee6d2e.ngrok.io/saml/metadata"),
 		AcsURL:      mustParseURL("https://29ee6d2e.ngrok.io/saml/acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -532,6 +883,44 @@ func TestSPCanHandleOneloginResponse(t *testing.T) {
 		assertion.AttributeStatements[0].Attributes))
 }
 
+func TestSPRejectsSHA1SignaturesByDefault(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	TimeNow = func() time.Time {
+		rv, _ := time.Parse("Mon Jan 2 15:04:05 UTC 2006", "Tue Jan 5 17:53:12 UTC 2016")
+		return rv
+	}
+	Clock = dsig.NewFakeClockAt(TimeNow())
+
+	SamlResponse := golden.Get(t, "TestSPCanHandleOneloginResponse_response")
+	test.IDPMetadata = golden.Get(t, "TestSPCanHandleOneloginResponse_IDPMetadata")
+
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://29ee6d2e.ngrok.io/saml/metadata"),
+		AcsURL:      mustParseURL("https://29ee6d2e.ngrok.io/saml/acs"),
+		IDPMetadata: &EntityDescriptor{},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req := http.Request{PostForm: url.Values{}}
+	req.PostForm.Set("SAMLResponse", string(SamlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-d40c15c104b52691eccf0a2a5c8a15595be75423"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"cannot validate signature on Response: signature method \"http://www.w3.org/2000/09/xmldsig#rsa-sha1\" is not allowed"))
+
+	// SHA-1 signatures are still rejected when only the digest is allowed
+	s.AllowedDigestMethods = []string{"http://www.w3.org/2000/09/xmldsig#sha1"}
+	_, err = s.ParseResponse(&req, []string{"id-d40c15c104b52691eccf0a2a5c8a15595be75423"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"cannot validate signature on Response: signature method \"http://www.w3.org/2000/09/xmldsig#rsa-sha1\" is not allowed"))
+
+	s.AllowedSignatureMethods = []string{dsig.RSASHA1SignatureMethod}
+	_, err = s.ParseResponse(&req, []string{"id-d40c15c104b52691eccf0a2a5c8a15595be75423"})
+	assert.Check(t, err)
+}
+
 func TestSPCanHandleOktaSignedResponseEncryptedAssertion(t *testing.T) {
 	test := NewServiceProviderTest(t)
 	// An actual response from okta - captured with trivial.go + test.Key/test.Certificate
@@ -750,10 +1139,9 @@ func TestSPRejectsInjectedComment(t *testing.T) {
 	{
 		x, _ := base64.StdEncoding.DecodeString(string(SamlResponse))
 		y := strings.Replace(string(x), "ross@octolabs.io", "ross@<!-- and a comment -->octolabs.io", 1)
-		SamlResponse = []byte(base64.StdEncoding.EncodeToString([]byte(y)))
 
 		req := http.Request{PostForm: url.Values{}}
-		req.PostForm.Set("SAMLResponse", string(SamlResponse))
+		req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString([]byte(y)))
 		assertion, err := s.ParseResponse(&req, []string{"id-fd419a5ab0472645427f8e07d87a3a5dd0b2e9a6"})
 
 		// Note: I would expect the injected comment to be stripped and for the signature
@@ -769,13 +1157,16 @@ func TestSPRejectsInjectedComment(t *testing.T) {
 	// this is an invalid response with a commend injected per CVE-2018-7340
 	// ref: https://duo.com/blog/duo-finds-saml-vulnerabilities-affecting-multiple-implementations
 	// it *MUST NOT* validate
+	//
+	// It is derived from the original response rather than the one above,
+	// which no longer contains the NameID to replace, and which validates
+	// now that the injected comment is stripped.
 	{
 		x, _ := base64.StdEncoding.DecodeString(string(SamlResponse))
 		y := strings.Replace(string(x), "ross@octolabs.io", "ross@octolabs.io<!-- and a comment -->.example.com", 1)
-		SamlResponse = []byte(base64.StdEncoding.EncodeToString([]byte(y)))
 
 		req := http.Request{PostForm: url.Values{}}
-		req.PostForm.Set("SAMLResponse", string(SamlResponse))
+		req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString([]byte(y)))
 		_, err := s.ParseResponse(&req, []string{"id-fd419a5ab0472645427f8e07d87a3a5dd0b2e9a6"})
 		assert.Check(t, err != nil)
 
@@ -923,16 +1314,7 @@ func TestSPCanParseResponse(t *testing.T) {
 	}, assertion.AttributeStatements[0].Attributes))
 }
 
-func (test *ServiceProviderTest) replaceDestination(newDestination string) {
-	newStr := ""
-	if newDestination != "" {
-		newStr = `Destination="` + newDestination + `"`
-	}
-	test.SamlResponse = bytes.Replace(test.SamlResponse,
-		[]byte(`Destination="https://15661444.ngrok.io/saml2/acs"`), []byte(newStr), 1)
-}
-
-func TestSPCanProcessResponseWithoutDestination(t *testing.T) {
+func TestSPRejectsUnsolicitedResponsesUnlessAllowed(t *testing.T) {
 	test := NewServiceProviderTest(t)
 	s := ServiceProvider{
 		Key:         test.Key,
@@ -944,55 +1326,58 @@ func TestSPCanProcessResponseWithoutDestination(t *testing.T) {
 	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
 
+	unsolicitedResponse := strings.Replace(string(test.SamlResponse),
+		`InResponseTo="id-9e61753d64e928af5a7a341a97f420c9"`, "", 1)
 	req := http.Request{PostForm: url.Values{}}
-	test.replaceDestination("")
-	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
-	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
-	assert.Check(t, err)
-}
-
-func (test *ServiceProviderTest) responseDom() (doc *etree.Document) {
-	doc = etree.NewDocument()
-	doc.ReadFromBytes(test.SamlResponse)
-	return doc
-}
-
-func addSignatureToDocument(doc *etree.Document) *etree.Document {
-	responseEl := doc.FindElement("//Response")
-	signatureEl := doc.CreateElement("xmldsig:Signature")
-	signatureEl.CreateAttr("xmlns:xmldsig", "http://www.w3.org/2000/09/xmldsig#")
-	responseEl.AddChild(signatureEl)
-	return doc
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString([]byte(unsolicitedResponse)))
+	_, err = s.ParseResponse(&req, []string{""})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "unsolicited responses are not allowed"))
 }
 
-func removeDestinationFromDocument(doc *etree.Document) *etree.Document {
-	responseEl := doc.FindElement("//Response")
-	responseEl.RemoveAttr("Destination")
-	return doc
+func TestSPCanLimitTheRedirectsOfUnsolicitedResponses(t *testing.T) {
+	s := ServiceProvider{
+		DefaultRedirectURI:      "/",
+		IDPInitiatedRelayStates: []string{"/reports", "https://app.example.com/*"},
+	}
+	assert.Check(t, is.Equal("/reports", s.IDPInitiatedRedirectURI("/reports")))
+	assert.Check(t, is.Equal("/", s.IDPInitiatedRedirectURI("/reports/42")))
+	assert.Check(t, is.Equal("https://app.example.com/42", s.IDPInitiatedRedirectURI("https://app.example.com/42")))
+	assert.Check(t, is.Equal("/", s.IDPInitiatedRedirectURI("https://evil.example.com/")))
+	assert.Check(t, is.Equal("/", s.IDPInitiatedRedirectURI("")))
 }
 
-func TestServiceProviderMismatchedDestinationsWithSignaturePresent(t *testing.T) {
+func TestSPCanTrackRequestIDsInAStore(t *testing.T) {
 	test := NewServiceProviderTest(t)
+	store := &MemoryRequestIDStore{}
 	s := ServiceProvider{
-		Key:         test.Key,
-		Certificate: test.Certificate,
-		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
-		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
-		IDPMetadata: &EntityDescriptor{},
+		Key:            test.Key,
+		Certificate:    test.Certificate,
+		MetadataURL:    mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:         mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata:    &EntityDescriptor{},
+		RequestIDStore: store,
 	}
 	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
 
+	authnRequest, err := s.MakeAuthenticationRequest("", HTTPRedirectBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	assert.Check(t, store.TakeRequestID(authnRequest.ID))
+
+	// the request was issued by another instance of the SP
+	assert.Check(t, store.PutRequestID("id-9e61753d64e928af5a7a341a97f420c9", TimeNow().Add(time.Minute)))
+
 	req := http.Request{PostForm: url.Values{}}
-	s.AcsURL = mustParseURL("https://wrong/saml2/acs")
-	bytes, _ := addSignatureToDocument(test.responseDom()).WriteToBytes()
-	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(bytes))
-	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
-	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
-		"`Destination` does not match AcsURL (expected \"https://wrong/saml2/acs\", actual \"https://15661444.ngrok.io/saml2/acs\")"))
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	_, err = s.ParseResponse(&req, nil)
+	assert.Check(t, err)
+
+	// each request is answered at most once
+	_, err = s.ParseResponse(&req, nil)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "`InResponseTo` does not match any of the possible request IDs (expected [])"))
 }
 
-func TestServiceProviderMissingDestinationWithSignaturePresent(t *testing.T) {
+func TestSPCanUseCustomValidators(t *testing.T) {
 	test := NewServiceProviderTest(t)
 	s := ServiceProvider{
 		Key:         test.Key,
@@ -1004,17 +1389,400 @@ func TestServiceProviderMissingDestinationWithSignaturePresent(t *testing.T) {
 	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
 
+	var validatedResponseID, validatedAssertionID string
+	s.ResponseValidators = []func(*Response) error{
+		func(response *Response) error {
+			validatedResponseID = response.ID
+			return nil
+		},
+	}
+	s.AssertionValidators = []func(*Assertion) error{
+		func(assertion *Assertion) error {
+			validatedAssertionID = assertion.ID
+			return nil
+		},
+	}
+
 	req := http.Request{PostForm: url.Values{}}
-	bytes, _ := removeDestinationFromDocument(addSignatureToDocument(test.responseDom())).WriteToBytes()
-	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(bytes))
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
 	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
-	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
-		"`Destination` does not match AcsURL (expected \"https://15661444.ngrok.io/saml2/acs\", actual \"\")"))
-}
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("_e9b3332eeaf348da6786aed16300aca9", validatedResponseID))
+	assert.Check(t, is.Equal("_543eb64ea4ce19647a1f2aef5b91245d", validatedAssertionID))
 
-func TestSPMismatchedDestinationsWithSignaturePresent(t *testing.T) {
-	test := NewServiceProviderTest(t)
-	s := ServiceProvider{
+	s.AssertionValidators = append(s.AssertionValidators, func(assertion *Assertion) error {
+		if assertion.AttributeStatements[0].Attributes[0].Name != "urn:oid:0.9.2342.19200300.100.1.3" {
+			return errors.New("the mail attribute is required")
+		}
+		return nil
+	})
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "assertion invalid: the mail attribute is required"))
+
+	s.ResponseValidators = append(s.ResponseValidators, func(response *Response) error {
+		return errors.New("no responses today")
+	})
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "no responses today"))
+}
+
+func TestSPValidationErrorsCanBeClassified(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	newSP := func() *ServiceProvider {
+		s := &ServiceProvider{
+			Key:         test.Key,
+			Certificate: test.Certificate,
+			MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+			AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+			IDPMetadata: &EntityDescriptor{},
+		}
+		err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+		assert.Check(t, err)
+		return s
+	}
+	parse := func(s *ServiceProvider, response []byte, possibleRequestIDs ...string) error {
+		req := http.Request{PostForm: url.Values{}}
+		req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(response))
+		_, err := s.ParseResponse(&req, possibleRequestIDs)
+		return err
+	}
+
+	s := newSP()
+	err := parse(s, []byte("<Response"), "id-9e61753d64e928af5a7a341a97f420c9")
+	assert.Check(t, errors.Is(err, ErrMalformedResponse))
+
+	err = parse(s, test.SamlResponse, "id-other")
+	assert.Check(t, errors.Is(err, ErrStaleInResponseTo))
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"`InResponseTo` does not match any of the possible request IDs (expected [id-other])"))
+
+	err = parse(s, []byte(strings.Replace(string(test.SamlResponse),
+		`InResponseTo="id-9e61753d64e928af5a7a341a97f420c9"`, "", 1)))
+	assert.Check(t, errors.Is(err, ErrUnsolicitedResponse))
+
+	s.TimeSource = dsig.NewFakeClockAt(TimeNow().Add(time.Hour))
+	err = parse(s, test.SamlResponse, "id-9e61753d64e928af5a7a341a97f420c9")
+	assert.Check(t, errors.Is(err, ErrExpiredResponse))
+
+	s = newSP()
+	s.AcsURL = mustParseURL("https://sp.example.com/saml2/acs")
+	err = parse(s, test.SamlResponse, "id-9e61753d64e928af5a7a341a97f420c9")
+	assert.Check(t, errors.Is(err, ErrWrongDestination))
+
+	s = newSP()
+	s.EntityID = "https://sp.example.com/saml2/metadata"
+	err = parse(s, test.SamlResponse, "id-9e61753d64e928af5a7a341a97f420c9")
+	assert.Check(t, errors.Is(err, ErrWrongAudience))
+	assert.Check(t, !errors.Is(err, ErrExpiredAssertion))
+
+	s = newSP()
+	s.ReplayCache = &MemoryReplayCache{}
+	err = parse(s, test.SamlResponse, "id-9e61753d64e928af5a7a341a97f420c9")
+	assert.Check(t, err)
+	err = parse(s, test.SamlResponse, "id-9e61753d64e928af5a7a341a97f420c9")
+	assert.Check(t, errors.Is(err, ErrReplayedAssertion))
+}
+
+func TestSPRejectsReplayedAssertions(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+		ReplayCache: &MemoryReplayCache{},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req := http.Request{PostForm: url.Values{}}
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "assertion invalid: assertion _543eb64ea4ce19647a1f2aef5b91245d has already been used"))
+}
+
+func TestSPCanUseItsOwnRandReader(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+		RandReader:  &testRandomReader{Next: 1},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req, err := s.MakeAuthenticationRequest("", HTTPRedirectBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("id-01030507090b0d0f11131517191b1d1f21232527", req.ID))
+
+	// the package-level RandReader is not used
+	assert.Check(t, is.Equal("id-00020406080a0c0e10121416181a1c1e20222426", fmt.Sprintf("id-%x", randomBytes(20))))
+}
+
+func TestSPCanConfigureIssueDelayAndClockSkew(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+		TimeSource:  dsig.NewFakeClockAt(TimeNow().Add(5 * time.Minute)),
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req := http.Request{PostForm: url.Values{}}
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "response IssueInstant expired at 2015-12-01 01:57:51.375 +0000 UTC"))
+
+	s.MaxIssueDelay = 10 * time.Minute
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+
+	// the IDP's clock is ahead of ours
+	s.TimeSource = dsig.NewFakeClockAt(TimeNow().Add(-5 * time.Minute))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "assertion invalid: assertion Conditions is not yet valid"))
+
+	s.MaxClockSkew = 10 * time.Minute
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+}
+
+func TestSPCanUseItsOwnClock(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+		TimeSource:  dsig.NewFakeClockAt(TimeNow()),
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	// the global clocks are ignored in favour of the SP's clock
+	TimeNow = func() time.Time { return time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC) }
+	Clock = nil
+
+	req := http.Request{PostForm: url.Values{}}
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+
+	authnRequest, err := s.MakeAuthenticationRequest("", HTTPRedirectBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC), authnRequest.IssueInstant))
+
+	s.TimeSource = dsig.NewFakeClockAt(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "response IssueInstant expired at 2015-12-01 01:57:51.375 +0000 UTC"))
+}
+
+func TestSPValidatesRequestedAuthnContext(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	// the response was authenticated with PasswordProtectedTransport
+	for _, tc := range []struct {
+		Comparison string
+		ClassRefs  []string
+		Satisfied  bool
+	}{
+		{"", []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"}, true},
+		{"exact", []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:X509", "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"}, true},
+		{"exact", []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:X509"}, false},
+		{"minimum", []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:Password"}, true},
+		{"minimum", []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"}, true},
+		{"minimum", []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:SmartcardPKI"}, false},
+		{"better", []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:Password"}, true},
+		{"better", []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"}, false},
+		{"maximum", []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:X509"}, true},
+		{"maximum", []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:Password"}, false},
+		{"minimum", []string{"https://example.com/unknown"}, false},
+	} {
+		s.RequestedAuthnContext = &RequestedAuthnContext{
+			Comparison:            tc.Comparison,
+			AuthnContextClassRefs: tc.ClassRefs,
+		}
+		req := http.Request{PostForm: url.Values{}}
+		req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+		_, err := s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+		if tc.Satisfied {
+			assert.Check(t, err, "%s %v", tc.Comparison, tc.ClassRefs)
+		} else {
+			assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+				"assertion invalid: AuthnStatement AuthnContextClassRef \"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport\" does not satisfy the requested authentication context"),
+				"%s %v", tc.Comparison, tc.ClassRefs)
+		}
+	}
+
+	// the order of authentication context classes can be changed
+	s.AuthnContextClassOrder = []string{
+		"urn:oasis:names:tc:SAML:2.0:ac:classes:X509",
+		"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+	}
+	s.RequestedAuthnContext = &RequestedAuthnContext{
+		Comparison:            "better",
+		AuthnContextClassRefs: []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:X509"},
+	}
+	req := http.Request{PostForm: url.Values{}}
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+}
+
+func (test *ServiceProviderTest) replaceDestination(newDestination string) {
+	newStr := ""
+	if newDestination != "" {
+		newStr = `Destination="` + newDestination + `"`
+	}
+	test.SamlResponse = bytes.Replace(test.SamlResponse,
+		[]byte(`Destination="https://15661444.ngrok.io/saml2/acs"`), []byte(newStr), 1)
+}
+
+func TestSPCanProcessResponseWithoutDestination(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req := http.Request{PostForm: url.Values{}}
+	test.replaceDestination("")
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+}
+
+func (test *ServiceProviderTest) responseDom() (doc *etree.Document) {
+	doc = etree.NewDocument()
+	doc.ReadFromBytes(test.SamlResponse)
+	return doc
+}
+
+func addSignatureToDocument(doc *etree.Document) *etree.Document {
+	responseEl := doc.FindElement("//Response")
+	signatureEl := doc.CreateElement("xmldsig:Signature")
+	signatureEl.CreateAttr("xmlns:xmldsig", "http://www.w3.org/2000/09/xmldsig#")
+	responseEl.AddChild(signatureEl)
+	return doc
+}
+
+func removeDestinationFromDocument(doc *etree.Document) *etree.Document {
+	responseEl := doc.FindElement("//Response")
+	responseEl.RemoveAttr("Destination")
+	return doc
+}
+
+func TestServiceProviderMismatchedDestinationsWithSignaturePresent(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req := http.Request{PostForm: url.Values{}}
+	s.AcsURL = mustParseURL("https://wrong/saml2/acs")
+	bytes, _ := addSignatureToDocument(test.responseDom()).WriteToBytes()
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(bytes))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"`Destination` does not match AcsURL (expected \"https://wrong/saml2/acs\", actual \"https://15661444.ngrok.io/saml2/acs\")"))
+}
+
+func TestSPAcceptsResponseForAnyAssertionConsumerService(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	isDefault := true
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://other.example.com/saml2/acs"),
+		AssertionConsumerServices: []IndexedEndpoint{
+			{Binding: HTTPPostBinding, Location: "https://other.example.com/saml2/acs", Index: 0},
+			{Binding: HTTPPostBinding, Location: "https://15661444.ngrok.io/saml2/acs", Index: 1, IsDefault: &isDefault},
+			{Binding: HTTPArtifactBinding, Location: "https://other.example.com/saml2/artifact", Index: 2},
+		},
+		IDPMetadata: &EntityDescriptor{},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	assert.Check(t, is.DeepEqual(s.AssertionConsumerServices, s.Metadata().SPSSODescriptors[0].AssertionConsumerServices))
+
+	// requests ask for the default endpoint with the response binding
+	authnRequest, err := s.MakeAuthenticationRequest("", HTTPRedirectBinding, HTTPPostBinding)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://15661444.ngrok.io/saml2/acs", authnRequest.AssertionConsumerServiceURL))
+	authnRequest, err = s.MakeAuthenticationRequest("", HTTPRedirectBinding, HTTPArtifactBinding)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://other.example.com/saml2/artifact", authnRequest.AssertionConsumerServiceURL))
+
+	// the response is sent to an endpoint other than AcsURL
+	req := http.Request{PostForm: url.Values{}}
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+
+	// but not to one that is not published
+	s.AssertionConsumerServices = s.AssertionConsumerServices[:1]
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"`Destination` does not match AcsURL (expected \"https://other.example.com/saml2/acs\", actual \"https://15661444.ngrok.io/saml2/acs\")"))
+}
+
+func TestServiceProviderMissingDestinationWithSignaturePresent(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req := http.Request{PostForm: url.Values{}}
+	bytes, _ := removeDestinationFromDocument(addSignatureToDocument(test.responseDom())).WriteToBytes()
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(bytes))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"`Destination` does not match AcsURL (expected \"https://15661444.ngrok.io/saml2/acs\", actual \"\")"))
+}
+
+func TestSPMismatchedDestinationsWithSignaturePresent(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
 		Key:         test.Key,
 		Certificate: test.Certificate,
 		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
@@ -1054,6 +1822,61 @@ func TestSPMismatchedDestinationsWithNoSignaturePresent(t *testing.T) {
 		"`Destination` does not match AcsURL (expected \"https://15661444.ngrok.io/saml2/acs\", actual \"https://wrong/saml2/acs\")"))
 }
 
+func TestSPCanAcceptOtherDestinations(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req := http.Request{PostForm: url.Values{}}
+	test.replaceDestination("https://sp.example.com/saml2/acs")
+	bytes, _ := test.responseDom().WriteToBytes()
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(bytes))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, errors.Is(err, ErrWrongDestination))
+
+	s.AcceptedDestinations = []string{"https://sp.example.com/saml2/acs"}
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+
+	s.AcceptedDestinations = nil
+	s.AcceptDestination = func(destination string) bool {
+		return strings.HasPrefix(destination, "https://sp.example.com/")
+	}
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+}
+
+func TestSPCanAcceptOtherAudiences(t *testing.T) {
+	s := ServiceProvider{
+		MetadataURL: mustParseURL("https://sp.example.com/saml2/metadata"),
+	}
+	conditions := &Conditions{
+		NotBefore:    TimeNow(),
+		NotOnOrAfter: TimeNow().Add(time.Minute),
+		AudienceRestrictions: []AudienceRestriction{
+			{Audience: Audience{Value: "https://sp.internal/saml2/metadata"}},
+		},
+	}
+	err := s.validateConditions(conditions, TimeNow())
+	assert.Check(t, errors.Is(err, ErrWrongAudience))
+
+	s.AcceptedAudiences = []string{"https://sp.internal/saml2/metadata"}
+	assert.Check(t, s.validateConditions(conditions, TimeNow()))
+
+	s.AcceptedAudiences = nil
+	s.AcceptAudience = func(audience string) bool {
+		return audience == "https://sp.internal/saml2/metadata"
+	}
+	assert.Check(t, s.validateConditions(conditions, TimeNow()))
+}
+
 func TestSPMissingDestinationWithSignaturePresent(t *testing.T) {
 	test := NewServiceProviderTest(t)
 	s := ServiceProvider{
@@ -1227,6 +2050,10 @@ func TestXswPermutationThreeIsRejected(t *testing.T) {
 		MetadataURL: mustParseURL("http://sp.example.com/demo1/metadata.php"),
 		AcsURL:      mustParseURL("http://sp.example.com/demo1/index.php?acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(idpMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -1255,6 +2082,10 @@ func TestXswPermutationFourIsRejected(t *testing.T) {
 		MetadataURL: mustParseURL("http://sp.example.com/demo1/metadata.php"),
 		AcsURL:      mustParseURL("http://sp.example.com/demo1/index.php?acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(idpMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -1283,6 +2114,10 @@ func TestXswPermutationFiveIsRejected(t *testing.T) {
 		MetadataURL: mustParseURL("http://sp.example.com/demo1/metadata.php"),
 		AcsURL:      mustParseURL("http://sp.example.com/demo1/index.php?acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(idpMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -1310,6 +2145,10 @@ func TestXswPermutationSixIsRejected(t *testing.T) {
 		MetadataURL: mustParseURL("http://sp.example.com/demo1/metadata.php"),
 		AcsURL:      mustParseURL("http://sp.example.com/demo1/index.php?acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(idpMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -1340,6 +2179,10 @@ func TestXswPermutationSevenIsRejected(t *testing.T) {
 		MetadataURL: mustParseURL("http://sp.example.com/demo1/metadata.php"),
 		AcsURL:      mustParseURL("http://sp.example.com/demo1/index.php?acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(idpMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -1371,6 +2214,10 @@ func TestXswPermutationEightIsRejected(t *testing.T) {
 		MetadataURL: mustParseURL("http://sp.example.com/demo1/metadata.php"),
 		AcsURL:      mustParseURL("http://sp.example.com/demo1/index.php?acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(idpMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -1402,6 +2249,10 @@ func TestXswPermutationNineIsRejected(t *testing.T) {
 		MetadataURL: mustParseURL("http://sp.example.com/demo1/metadata.php"),
 		AcsURL:      mustParseURL("http://sp.example.com/demo1/index.php?acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(idpMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -1429,6 +2280,10 @@ func TestSPRealWorldKeyInfoHasRSAPublicKeyNotX509Cert(t *testing.T) {
 		MetadataURL: mustParseURL("https://preview.docrocket-ross.test.octolabs.io/saml/metadata"),
 		AcsURL:      mustParseURL("https://preview.docrocket-ross.test.octolabs.io/saml/acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(idpMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -1442,6 +2297,60 @@ func TestSPRealWorldKeyInfoHasRSAPublicKeyNotX509Cert(t *testing.T) {
 	assert.Check(t, err)
 }
 
+func TestSPResolvesKeyInfoCertificateReferences(t *testing.T) {
+	cert := mustParseCertificate(golden.Get(t, "sp_cert.pem"))
+	nextKey := mustParsePrivateKey(golden.Get(t, "sp_next_key.pem"))
+	nextCert := mustParseCertificate(golden.Get(t, "sp_next_cert.pem"))
+	nextCert.SubjectKeyId = []byte{0x01, 0x02, 0x03, 0x04}
+	certs := []*x509.Certificate{cert, nextCert}
+	clock := dsig.NewFakeClockAt(cert.NotBefore)
+
+	signingContext, err := newSigningContext(nextKey, nextCert, nil, dsig.RSASHA256SignatureMethod)
+	assert.Assert(t, err)
+	el := etree.NewElement("samlp:LogoutRequest")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", "id-00020406080a0c0e10121416181a1c1e")
+	signedEl, err := signingContext.SignEnveloped(el)
+	assert.Assert(t, err)
+
+	// withKeyInfo returns a copy of signedEl whose KeyInfo has the given
+	// content instead of the signing certificate
+	withKeyInfo := func(content string) *etree.Element {
+		el := signedEl.Copy()
+		keyInfoEl := el.FindElement("./Signature/KeyInfo")
+		for _, child := range keyInfoEl.ChildElements() {
+			keyInfoEl.RemoveChild(child)
+		}
+		doc := etree.NewDocument()
+		assert.Assert(t, doc.ReadFromString(`<ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">`+content+`</ds:KeyInfo>`))
+		for _, child := range doc.Root().ChildElements() {
+			keyInfoEl.AddChild(child)
+		}
+		return el
+	}
+
+	assert.Check(t, verifySignature(withKeyInfo(`<ds:X509Data><ds:X509IssuerSerial>`+
+		`<ds:X509IssuerName>CN = sp.example.com</ds:X509IssuerName>`+
+		`<ds:X509SerialNumber>2</ds:X509SerialNumber>`+
+		`</ds:X509IssuerSerial></ds:X509Data>`), certs, nil, signaturePolicy{}, clock))
+	assert.Check(t, verifySignature(withKeyInfo(`<ds:X509Data><ds:X509SKI>AQIDBA==</ds:X509SKI></ds:X509Data>`),
+		certs, nil, signaturePolicy{}, clock))
+	assert.Check(t, verifySignature(withKeyInfo(`<ds:KeyName>01020304</ds:KeyName>`),
+		certs, nil, signaturePolicy{}, clock))
+	assert.Check(t, verifySignature(withKeyInfo(`<ds:KeyName>sp.example.com</ds:KeyName>`),
+		certs, nil, signaturePolicy{}, clock))
+
+	// a reference to a certificate that is not trusted cannot be resolved
+	assert.Check(t, is.Error(verifySignature(withKeyInfo(`<ds:X509Data><ds:X509IssuerSerial>`+
+		`<ds:X509IssuerName>CN=sp.example.com</ds:X509IssuerName>`+
+		`<ds:X509SerialNumber>3</ds:X509SerialNumber>`+
+		`</ds:X509IssuerSerial></ds:X509Data>`), certs, nil, signaturePolicy{}, clock), "Missing x509 Element"))
+
+	// a reference to the wrong trusted certificate fails verification
+	assert.Check(t, verifySignature(withKeyInfo(`<ds:KeyName>localhost</ds:KeyName>`),
+		certs, nil, signaturePolicy{}, clock) != nil)
+}
+
 func TestSPRealWorldAssertionSignedNotResponse(t *testing.T) {
 	// This is a real world SAML response that we observed. It contains <ds:RSAKeyValue> elements rather than
 	// a certificate in the response.
@@ -1460,6 +2369,10 @@ func TestSPRealWorldAssertionSignedNotResponse(t *testing.T) {
 		MetadataURL: mustParseURL("https://preview.docrocket-ross.test.octolabs.io/saml/metadata"),
 		AcsURL:      mustParseURL("https://preview.docrocket-ross.test.octolabs.io/saml/acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(idpMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -1499,6 +2412,10 @@ func TestServiceProviderCanHandleSignedAssertionsResponse(t *testing.T) {
 		MetadataURL: mustParseURL("http://sp.example.com/demo1/metadata.php"),
 		AcsURL:      mustParseURL("http://sp.example.com/demo1/index.php?acs"),
 		IDPMetadata: &EntityDescriptor{},
+
+		// this response is signed with SHA-1
+		AllowedSignatureMethods: []string{dsig.RSASHA1SignatureMethod},
+		AllowedDigestMethods:    []string{"http://www.w3.org/2000/09/xmldsig#sha1"},
 	}
 	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
@@ -1550,12 +2467,65 @@ func TestServiceProviderCanHandleSignedAssertionsResponse(t *testing.T) {
 	}, assertion.AttributeStatements[0].Attributes))
 }
 
-func TestSPResponseWithNoIssuer(t *testing.T) {
-	test := NewServiceProviderTest(t)
+func TestSPResponseWithNoIssuer(t *testing.T) {
+	test := NewServiceProviderTest(t)
+
+	// This test case for the IdP response with no <Issuer> element. SAML standard says
+	// that the <Issuer> element MAY be omitted in the <Response> (but MUST present in the <Assertion>).
+
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req := http.Request{PostForm: url.Values{}}
+
+	// Response with no <Issuer> (modified ServiceProviderTest.SamlResponse)
+	samlResponse := golden.Get(t, "TestSPResponseWithNoIssuer_response")
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(samlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+}
+
+func TestSPCanTrustAdditionalIssuers(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	// the IDP issues responses with an Issuer other than its entity ID
+	s.IDPMetadata.EntityID = "https://sts.example.com/d9a8e6c4/"
+
+	req := http.Request{PostForm: url.Values{}}
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, errors.Is(err, ErrWrongIssuer))
 
-	// This test case for the IdP response with no <Issuer> element. SAML standard says
-	// that the <Issuer> element MAY be omitted in the <Response> (but MUST present in the <Assertion>).
+	s.AdditionalTrustedIssuers = []string{"https://idp.testshib.org/idp/shibboleth"}
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+
+	s.AdditionalTrustedIssuers = nil
+	s.AcceptIssuer = func(issuer string) bool {
+		return strings.HasPrefix(issuer, "https://idp.testshib.org/")
+	}
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+}
 
+func TestSPEnforcesResponseSignaturePolicy(t *testing.T) {
+	test := NewServiceProviderTest(t)
 	s := ServiceProvider{
 		Key:         test.Key,
 		Certificate: test.Certificate,
@@ -1566,13 +2536,27 @@ func TestSPResponseWithNoIssuer(t *testing.T) {
 	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
 	assert.Check(t, err)
 
+	// the response is not signed, but its assertion is
 	req := http.Request{PostForm: url.Values{}}
-
-	// Response with no <Issuer> (modified ServiceProviderTest.SamlResponse)
-	samlResponse := golden.Get(t, "TestSPResponseWithNoIssuer_response")
-	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(samlResponse))
-	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
-	assert.Check(t, err)
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	for _, tc := range []struct {
+		Policy ResponseSignaturePolicy
+		Err    string
+	}{
+		{Policy: EitherSignatureSufficient},
+		{Policy: RequireAssertionSigned},
+		{Policy: RequireResponseSigned, Err: "the Response must be signed"},
+		{Policy: RequireResponseAndAssertionSigned, Err: "both the Response and Assertion must be signed"},
+	} {
+		s.ResponseSignaturePolicy = tc.Policy
+		_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+		if tc.Err == "" {
+			assert.Check(t, err)
+			continue
+		}
+		assert.Check(t, errors.Is(err, ErrMissingSignature))
+		assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, tc.Err))
+	}
 }
 
 func TestGetArtifactBindingLocation(t *testing.T) {
@@ -1595,6 +2579,32 @@ func TestGetArtifactBindingLocation(t *testing.T) {
 
 	location = sp.GetArtifactBindingLocation(SOAPBinding)
 	assert.Check(t, is.Equal(location, "https://samltest.id/idp/profile/SAML2/SOAP/ArtifactResolution"))
+
+	// the deprecated field still lists the endpoints, without their indexes
+	assert.Check(t, is.DeepEqual([]Endpoint{{Binding: SOAPBinding, Location: "https://samltest.id/idp/profile/SAML2/SOAP/ArtifactResolution"}},
+		sp.IDPMetadata.IDPSSODescriptors[0].ArtifactResolutionServices))
+}
+
+func TestSPUsesDeprecatedArtifactResolutionServices(t *testing.T) {
+	sp := ServiceProvider{
+		IDPMetadata: &EntityDescriptor{
+			EntityID: "https://idp.example.com/metadata",
+			IDPSSODescriptors: []IDPSSODescriptor{{
+				ArtifactResolutionServices: []Endpoint{
+					{Binding: SOAPBinding, Location: "https://idp.example.com/artifact/0"},
+					{Binding: SOAPBinding, Location: "https://idp.example.com/artifact/1"},
+				},
+			}},
+		},
+	}
+
+	assert.Check(t, is.Equal("https://idp.example.com/artifact/0", sp.GetArtifactBindingLocation(SOAPBinding)))
+
+	// the endpoints are indexed by their position
+	artifact := &Artifact{SourceID: ArtifactSourceID("https://idp.example.com/metadata"), EndpointIndex: 1}
+	location, err := sp.GetArtifactResolutionLocation(artifact, SOAPBinding)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://idp.example.com/artifact/1", location))
 }
 
 func TestMakeArtifactResolveRequest(t *testing.T) {
@@ -1772,3 +2782,921 @@ func TestParseBadXMLArtifactResponse(t *testing.T) {
 		"failed to decrypt response: certificate does not match provided key"))
 	assert.Check(t, is.Nil(assertion))
 }
+
+func TestSPCanResolveArtifact(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	TimeNow = func() time.Time {
+		rv, _ := time.Parse(timeFormat, "2021-08-17T10:26:57Z")
+		return rv
+	}
+	Clock = dsig.NewFakeClockAt(TimeNow())
+
+	// an actual response from samltest.id
+	samlResponse := golden.Get(t, "TestParseXMLArtifactResponse_response")
+	test.IDPMetadata = golden.Get(t, "TestGetArtifactBindingLocation_IDPMetadata")
+
+	// the ArtifactResolve ID is derived from RandReader, make it match the
+	// InResponseTo of the recorded response
+	reqID, err := hex.DecodeString("218eb155248f7db7c85fe4e2709a3f17a70d09c7")
+	assert.Check(t, err)
+	RandReader = bytes.NewReader(reqID)
+
+	artifact := Artifact{
+		EndpointIndex: 2,
+		SourceID:      ArtifactSourceID("https://samltest.id/saml/idp"),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc := etree.NewDocument()
+		_, err := doc.ReadFrom(r.Body)
+		assert.Check(t, err)
+		el := doc.FindElement("./Envelope/Body/ArtifactResolve/Artifact")
+		assert.Assert(t, el != nil)
+		assert.Check(t, is.Equal(artifact.String(), el.Text()))
+
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = w.Write(samlResponse)
+	}))
+	defer server.Close()
+
+	sp := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("http://localhost:8000/saml/metadata"),
+		AcsURL:      mustParseURL("http://localhost:8000/saml/acs"),
+		IDPMetadata: &EntityDescriptor{},
+	}
+	err = xml.Unmarshal(test.IDPMetadata, &sp.IDPMetadata)
+	assert.Check(t, err)
+	sp.IDPMetadata.IDPSSODescriptors[0].SSODescriptor.ArtifactResolutionServices = append(
+		sp.IDPMetadata.IDPSSODescriptors[0].SSODescriptor.ArtifactResolutionServices,
+		IndexedEndpoint{Binding: SOAPBinding, Location: server.URL, Index: 2})
+
+	req := http.Request{PostForm: url.Values{}, Form: url.Values{}}
+	req.Form.Set("SAMLart", artifact.String())
+	assertion, err := sp.ParseResponse(&req, []string{"id-f3c7bc7d626a4ededa6028b718e5252c6e770b94"})
+	assert.Check(t, err)
+	assert.Assert(t, assertion != nil)
+	assert.Check(t, is.Equal("https://samltest.id/saml/idp", assertion.Issuer.Value))
+
+	// artifacts of an endpoint that the IDP does not advertise are rejected
+	artifact.EndpointIndex = 7
+	req.Form.Set("SAMLart", artifact.String())
+	_, err = sp.ParseResponse(&req, []string{"id-f3c7bc7d626a4ededa6028b718e5252c6e770b94"})
+	assert.Check(t, is.ErrorContains(err.(*InvalidResponseError).PrivateErr,
+		"IDP has no ArtifactResolutionService with index 7 and binding "+SOAPBinding))
+
+	// artifacts issued by another entity are rejected
+	artifact.EndpointIndex = 2
+	artifact.SourceID = ArtifactSourceID("https://evil.example.com/saml/idp")
+	req.Form.Set("SAMLart", artifact.String())
+	_, err = sp.ParseResponse(&req, []string{"id-f3c7bc7d626a4ededa6028b718e5252c6e770b94"})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"artifact was not issued by https://samltest.id/saml/idp"))
+
+	req.Form.Set("SAMLart", "bogus")
+	_, err = sp.ParseResponse(&req, []string{"id-f3c7bc7d626a4ededa6028b718e5252c6e770b94"})
+	assert.Check(t, is.ErrorContains(err.(*InvalidResponseError).PrivateErr, "cannot decode artifact"))
+}
+
+func TestGetAttributeServiceLocation(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+
+	location := test.SP.GetAttributeServiceLocation(SOAPBinding)
+	assert.Check(t, is.Equal(location, ""))
+
+	test.SP.IDPMetadata.AttributeAuthorityDescriptors = []AttributeAuthorityDescriptor{{
+		AttributeServices: []Endpoint{{
+			Binding:  SOAPBinding,
+			Location: "https://idp.example.com/saml/attributes",
+		}},
+	}}
+	location = test.SP.GetAttributeServiceLocation(SOAPBinding)
+	assert.Check(t, is.Equal(location, "https://idp.example.com/saml/attributes"))
+}
+
+func TestMakeAttributeQuery(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+
+	req, err := test.SP.MakeAttributeQuery("https://idp.example.com/saml/attributes",
+		&NameID{Format: string(PersistentNameIDFormat), Value: "alice"},
+		[]Attribute{
+			NewQueryAttribute("urn:oid:1.3.6.1.4.1.5923.1.1.1.1", "urn:oasis:names:tc:SAML:2.0:attrname-format:uri", "member", "staff"),
+			NewQueryAttribute("urn:oid:0.9.2342.19200300.100.1.3", "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"),
+		})
+	assert.Check(t, err)
+
+	doc := etree.NewDocument()
+	doc.SetRoot(req.SoapRequest())
+	x, err := doc.WriteToString()
+	assert.Check(t, err)
+	golden.Assert(t, x, t.Name())
+
+	// the request survives a round trip through encoding/xml
+	req2 := AttributeQuery{}
+	assert.Check(t, xml.Unmarshal([]byte(x), &struct {
+		Body struct {
+			AttributeQuery *AttributeQuery
+		}
+	}{Body: struct{ AttributeQuery *AttributeQuery }{&req2}}))
+	assert.Check(t, is.Equal(req2.ID, req.ID))
+	assert.Check(t, is.Equal(req2.Subject.NameID.Value, "alice"))
+	assert.Check(t, is.Len(req2.Attributes, 2))
+	assert.Check(t, is.Len(req2.Attributes[0].Values, 2))
+	assert.Check(t, is.Equal(req2.Attributes[0].Values[1].Value, "staff"))
+}
+
+// makeAttributeQueryResponse returns a SOAP envelope containing a Response to
+// query, signed by the IDP, with one assertion about the query subject for
+// each of attributeSets.
+func (test *IdentityProviderTest) makeAttributeQueryResponse(t *testing.T, query *AttributeQuery, attributeSets ...[]Attribute) []byte {
+	var assertions []Assertion
+	for _, attributes := range attributeSets {
+		assertions = append(assertions, Assertion{
+			Subject: &Subject{NameID: query.Subject.NameID},
+			AttributeStatements: []AttributeStatement{{
+				Attributes: attributes,
+			}},
+		})
+	}
+	return test.makeQueryResponse(t, query.ID, assertions...)
+}
+
+// makeQueryResponse returns a SOAP envelope containing a Response to the query
+// identified by queryID, signed by the IDP and containing assertions.
+func (test *IdentityProviderTest) makeQueryResponse(t *testing.T, queryID string, assertions ...Assertion) []byte {
+	issuer := Issuer{
+		Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+		Value:  test.IDP.MetadataURL.String(),
+	}
+	resp := Response{
+		ID:           fmt.Sprintf("id-%x", randomBytes(20)),
+		InResponseTo: queryID,
+		Version:      "2.0",
+		IssueInstant: TimeNow(),
+		Issuer:       &issuer,
+		Status:       Status{StatusCode: StatusCode{Value: StatusSuccess}},
+	}
+	var assertionEls []*etree.Element
+	for _, assertion := range assertions {
+		assertion.ID = fmt.Sprintf("id-%x", randomBytes(20))
+		assertion.IssueInstant = TimeNow()
+		assertion.Version = "2.0"
+		assertion.Issuer = issuer
+		assertionEls = append(assertionEls, assertion.Element())
+	}
+	responseEl := func() *etree.Element {
+		el := resp.Element()
+		for _, assertionEl := range assertionEls {
+			el.AddChild(assertionEl.Copy())
+		}
+		return el
+	}
+
+	resp.Signature = test.signEnveloped(t, responseEl())
+	return soapEnvelopeBytes(t, responseEl())
+}
+
+// signEnveloped returns an enveloped signature of el by the IDP.
+func (test *IdentityProviderTest) signEnveloped(t *testing.T, el *etree.Element) *etree.Element {
+	keyStore := dsig.TLSCertKeyStore(tls.Certificate{
+		Certificate: [][]byte{test.IDP.Certificate.Raw},
+		PrivateKey:  test.IDP.Key,
+		Leaf:        test.IDP.Certificate,
+	})
+	signingContext := dsig.NewDefaultSigningContext(keyStore)
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(canonicalizerPrefixList)
+	signedEl, err := signingContext.SignEnveloped(el)
+	assert.Check(t, err)
+	return signedEl.Child[len(signedEl.Child)-1].(*etree.Element)
+}
+
+// soapEnvelopeBytes returns the serialized SOAP envelope containing el.
+func soapEnvelopeBytes(t *testing.T, el *etree.Element) []byte {
+	doc := etree.NewDocument()
+	doc.SetRoot(soapEnvelope(el))
+	buf, err := doc.WriteToBytes()
+	assert.Check(t, err)
+	return buf
+}
+
+func TestSPCanSendLogoutRequestSOAP(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	// the IDP certificate has expired, so validate signatures as of when it was valid
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+	defer func(backoff time.Duration) { soapRetryBackoff = backoff }(soapRetryBackoff)
+	soapRetryBackoff = time.Millisecond
+
+	attempts := 0
+	failures := 1
+	statusCode := StatusSuccess
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= failures {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		req := struct {
+			Body struct {
+				LogoutRequest LogoutRequest
+			}
+		}{}
+		assert.Check(t, xml.NewDecoder(r.Body).Decode(&req))
+		assert.Check(t, is.Equal("alice", req.Body.LogoutRequest.NameID.Value))
+
+		resp := LogoutResponse{
+			ID:           fmt.Sprintf("id-%x", randomBytes(20)),
+			InResponseTo: req.Body.LogoutRequest.ID,
+			Version:      "2.0",
+			IssueInstant: TimeNow(),
+			Issuer: &Issuer{
+				Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+				Value:  test.IDP.MetadataURL.String(),
+			},
+			Status: Status{StatusCode: StatusCode{Value: statusCode}},
+		}
+		resp.Signature = test.signEnveloped(t, resp.Element())
+		_, _ = w.Write(soapEnvelopeBytes(t, resp.Element()))
+	}))
+	defer server.Close()
+	test.SP.IDPMetadata.IDPSSODescriptors[0].SingleLogoutServices = []Endpoint{{
+		Binding:  SOAPBinding,
+		Location: server.URL,
+	}}
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	// without retries the IDP's transient failure is reported
+	err := test.SP.SendLogoutRequestSOAP(context.Background(), "alice")
+	assert.Check(t, is.Error(err, "error during logout: HTTP status 503 (503 Service Unavailable)"))
+
+	attempts = 0
+	test.SP.SOAPRetries = 2
+	err = test.SP.SendLogoutRequestSOAP(context.Background(), "alice")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(2, attempts))
+
+	attempts = 0
+	statusCode = StatusResponder
+	err = test.SP.SendLogoutRequestSOAP(context.Background(), "alice")
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, StatusResponder))
+
+	// retries stop when the context is done
+	attempts = 0
+	failures = 10
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	soapRetryBackoff = time.Second
+	err = test.SP.SendLogoutRequestSOAP(ctx, "alice")
+	assert.Check(t, is.Error(err, "error during logout: context deadline exceeded"))
+	assert.Check(t, is.Equal(1, attempts))
+}
+
+func TestSPCanValidateLogoutRequest(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	// the IDP certificate has expired, so validate signatures as of when it was valid
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+	test.SP.SloURL = mustParseURL("https://sp.example.com/saml2/slo")
+
+	makeRequest := func() *LogoutRequest {
+		req := &LogoutRequest{
+			ID:           "id-00020406080a0c0e10121416181a1c1e20222426",
+			Version:      "2.0",
+			IssueInstant: TimeNow(),
+			Destination:  test.SP.SloURL.String(),
+			Issuer: &Issuer{
+				Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+				Value:  test.IDP.MetadataURL.String(),
+			},
+			NameID: &NameID{Value: "alice"},
+		}
+		req.Signature = test.signEnveloped(t, req.Element())
+		return req
+	}
+
+	req := makeRequest()
+	r, _ := http.NewRequest("GET", req.Redirect("").String(), nil)
+	got, err := test.SP.ValidateLogoutRequestRequest(r)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(req.ID, got.ID))
+	assert.Check(t, is.Equal("alice", got.NameID.Value))
+
+	doc := etree.NewDocument()
+	doc.SetRoot(req.Element())
+	buf, err := doc.WriteToBytes()
+	assert.Check(t, err)
+	form := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(buf)}}
+	r, _ = http.NewRequest("POST", test.SP.SloURL.String(), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	got, err = test.SP.ValidateLogoutRequestRequest(r)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(req.ID, got.ID))
+
+	req = makeRequest()
+	req.Signature = nil
+	_, err = test.SP.ValidateLogoutRequestRedirect(req.Redirect("").Query().Get("SAMLRequest"))
+	assert.Check(t, is.Error(err, "LogoutRequest must be signed"))
+
+	req = makeRequest()
+	req.Issuer.Value = "https://evil.example.com/metadata"
+	_, err = test.SP.ValidateLogoutRequestRedirect(req.Redirect("").Query().Get("SAMLRequest"))
+	assert.Check(t, is.Error(err, "issuer does not match the IDP metadata (expected \"https://idp.example.com/saml/metadata\")"))
+
+	req = makeRequest()
+	req.NameID.Value = "mallory"
+	_, err = test.SP.ValidateLogoutRequestRedirect(req.Redirect("").Query().Get("SAMLRequest"))
+	assert.Check(t, is.ErrorContains(err, "cannot validate signature on LogoutRequest"))
+
+	test.SP.StrictStructureCheck = true
+	req = makeRequest()
+	_, err = test.SP.ValidateLogoutRequestRedirect(req.Redirect("").Query().Get("SAMLRequest"))
+	assert.Check(t, err)
+	req.NameID = nil
+	req.Signature = test.signEnveloped(t, req.Element())
+	_, err = test.SP.ValidateLogoutRequestRedirect(req.Redirect("").Query().Get("SAMLRequest"))
+	assert.Check(t, is.Error(err, "structure check failed: /LogoutRequest: missing element BaseID or NameID or EncryptedID"))
+	test.SP.StrictStructureCheck = false
+
+	req = makeRequest()
+	notOnOrAfter := TimeNow()
+	req.NotOnOrAfter = &notOnOrAfter
+	req.Signature = test.signEnveloped(t, req.Element())
+	_, err = test.SP.ValidateLogoutRequestRedirect(req.Redirect("").Query().Get("SAMLRequest"))
+	assert.Check(t, is.ErrorContains(err, "request expired at"))
+
+	req = makeRequest()
+	TimeNow = func() time.Time {
+		rv, _ := time.Parse(timeFormat, "2015-12-01T02:07:09.123Z")
+		return rv
+	}
+	_, err = test.SP.ValidateLogoutRequestRedirect(req.Redirect("").Query().Get("SAMLRequest"))
+	assert.Check(t, is.ErrorContains(err, "issueInstant expired at"))
+}
+
+func TestSPCanValidateEncryptedLogoutRequest(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	// the IDP certificate has expired, so validate signatures as of when it was valid
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+	test.SP.SloURL = mustParseURL("https://sp.example.com/saml2/slo")
+
+	req := &LogoutRequest{
+		ID:           "id-00020406080a0c0e10121416181a1c1e20222426",
+		Version:      "2.0",
+		IssueInstant: TimeNow(),
+		Destination:  test.SP.SloURL.String(),
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  test.IDP.MetadataURL.String(),
+		},
+		NameID: &NameID{
+			Format: string(PersistentNameIDFormat),
+			Value:  "alice",
+		},
+	}
+	assert.Check(t, req.EncryptNameID(test.SPCertificate))
+	assert.Check(t, is.Nil(req.NameID))
+	assert.Check(t, req.EncryptedID != nil)
+	req.Signature = test.signEnveloped(t, req.Element())
+
+	got, err := test.SP.ValidateLogoutRequestRedirect(req.Redirect("").Query().Get("SAMLRequest"))
+	assert.Check(t, err)
+	assert.Check(t, is.Nil(got.EncryptedID))
+	assert.Check(t, is.DeepEqual(&NameID{Format: string(PersistentNameIDFormat), Value: "alice"}, got.NameID))
+
+	// the SP cannot decrypt a NameID that was encrypted for someone else
+	req.NameID = &NameID{Value: "alice"}
+	req.EncryptedID = nil
+	req.Signature = nil
+	assert.Check(t, req.EncryptNameID(mustParseCertificate(golden.Get(t, "cert_2017.pem"))))
+	req.Signature = test.signEnveloped(t, req.Element())
+	_, err = test.SP.ValidateLogoutRequestRedirect(req.Redirect("").Query().Get("SAMLRequest"))
+	assert.Check(t, is.ErrorContains(err, "cannot decrypt NameID"))
+}
+
+func TestSPCanQueryAttributes(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	// the IDP certificate has expired, so validate signatures as of when it was valid
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	affiliation := "urn:oid:1.3.6.1.4.1.5923.1.1.1.1"
+	var returnedAttributes []Attribute
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := struct {
+			Body struct {
+				AttributeQuery AttributeQuery
+			}
+		}{}
+		assert.Check(t, xml.NewDecoder(r.Body).Decode(&query))
+		_, _ = w.Write(test.makeAttributeQueryResponse(t, &query.Body.AttributeQuery, returnedAttributes))
+	}))
+	defer server.Close()
+	test.SP.IDPMetadata.AttributeAuthorityDescriptors = []AttributeAuthorityDescriptor{{
+		AttributeServices: []Endpoint{{Binding: SOAPBinding, Location: server.URL}},
+	}}
+
+	nameID := &NameID{Format: string(PersistentNameIDFormat), Value: "alice"}
+	requested := []Attribute{NewQueryAttribute(affiliation, "", "member", "staff")}
+
+	returnedAttributes = []Attribute{NewQueryAttribute(affiliation, "", "staff")}
+	assertion, err := test.SP.QueryAttributes(nameID, requested)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(assertion.Subject.NameID.Value, "alice"))
+	assert.Check(t, is.Equal(assertion.AttributeStatements[0].Attributes[0].Values[0].Value, "staff"))
+
+	// a value that was not requested is rejected
+	returnedAttributes = []Attribute{NewQueryAttribute(affiliation, "", "staff", "faculty")}
+	_, err = test.SP.QueryAttributes(nameID, requested)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"assertion invalid: attribute \"urn:oid:1.3.6.1.4.1.5923.1.1.1.1\" contains value \"faculty\" which was not requested"))
+
+	// attributes requested without values may have any value
+	_, err = test.SP.QueryAttributes(nameID, []Attribute{NewQueryAttribute(affiliation, "")})
+	assert.Check(t, err)
+}
+
+func TestSPRejectsAttributeQueryResponseForOtherSubject(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	query, err := test.SP.MakeAttributeQuery("https://idp.example.com/saml/attributes",
+		&NameID{Format: string(PersistentNameIDFormat), Value: "alice"}, nil)
+	assert.Check(t, err)
+
+	otherQuery := *query
+	otherQuery.Subject = &Subject{NameID: &NameID{Value: "mallory"}}
+	rawResponse := test.makeAttributeQueryResponse(t, &otherQuery, nil)
+
+	_, err = test.SP.ParseXMLAttributeQueryResponse(rawResponse, query)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"assertion invalid: assertion Subject does not match the query"))
+
+	otherQuery.ID = "id-other"
+	rawResponse = test.makeAttributeQueryResponse(t, &otherQuery, nil)
+	_, err = test.SP.ParseXMLAttributeQueryResponse(rawResponse, query)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"`InResponseTo` does not match the query request ID (expected "+query.ID+")"))
+}
+
+func TestSPEnforcesResponseSignaturePolicyOnQueries(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	query, err := test.SP.MakeAttributeQuery("https://idp.example.com/saml/attributes",
+		&NameID{Format: string(PersistentNameIDFormat), Value: "alice"}, nil)
+	assert.Check(t, err)
+
+	// the response is signed, but its assertion is not
+	rawResponse := test.makeAttributeQueryResponse(t, query, nil)
+	_, err = test.SP.ParseXMLAttributeQueryResponse(rawResponse, query)
+	assert.Check(t, err)
+
+	test.SP.ResponseSignaturePolicy = RequireAssertionSigned
+	_, err = test.SP.ParseXMLAttributeQueryResponse(rawResponse, query)
+	assert.Check(t, is.ErrorContains(err.(*InvalidResponseError).PrivateErr, "the Assertion must be signed"))
+}
+
+func TestSPCanParseAttributeQueryResponseWithMultipleAssertions(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	affiliation := "urn:oid:1.3.6.1.4.1.5923.1.1.1.1"
+	mail := "urn:oid:0.9.2342.19200300.100.1.3"
+	query, err := test.SP.MakeAttributeQuery("https://idp.example.com/saml/attributes",
+		&NameID{Format: string(PersistentNameIDFormat), Value: "alice"},
+		[]Attribute{NewQueryAttribute(affiliation, "", "staff"), NewQueryAttribute(mail, "")})
+	assert.Check(t, err)
+
+	rawResponse := test.makeAttributeQueryResponse(t, query,
+		[]Attribute{NewQueryAttribute(mail, "", "alice@example.com")},
+		[]Attribute{NewQueryAttribute(affiliation, "", "faculty")},
+		[]Attribute{NewQueryAttribute(affiliation, "", "staff")})
+
+	result, err := test.SP.ParseXMLAttributeQueryResponseAssertions(rawResponse, query)
+	assert.Check(t, err)
+	assert.Check(t, is.Nil(result.Response.Assertion))
+	assert.Check(t, is.Len(result.Assertions, 3))
+	assert.Check(t, result.Assertions[0].Verified)
+	assert.Check(t, !result.Assertions[1].Verified)
+	assert.Check(t, is.Error(result.Assertions[1].Err,
+		"assertion invalid: attribute \"urn:oid:1.3.6.1.4.1.5923.1.1.1.1\" contains value \"faculty\" which was not requested"))
+	assert.Check(t, result.Assertions[2].Verified)
+
+	verified := result.VerifiedAssertions()
+	assert.Check(t, is.Len(verified, 2))
+	assert.Check(t, is.Equal(verified[0].AttributeStatements[0].Attributes[0].Values[0].Value, "alice@example.com"))
+	assert.Check(t, is.Equal(verified[1].AttributeStatements[0].Attributes[0].Values[0].Value, "staff"))
+
+	// the single assertion variant only considers the first assertion
+	assertion, err := test.SP.ParseXMLAttributeQueryResponse(rawResponse, query)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(assertion.ID, verified[0].ID))
+}
+
+func TestSPVerifiesAttributeQueryResponseWithAttributeAuthorityKeys(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	query, err := test.SP.MakeAttributeQuery("https://idp.example.com/saml/attributes",
+		&NameID{Format: string(PersistentNameIDFormat), Value: "alice"}, nil)
+	assert.Check(t, err)
+	rawResponse := test.makeAttributeQueryResponse(t, query, nil)
+
+	// the SSO service and the attribute authority use different keys
+	otherCert := mustParseCertificate(golden.Get(t, "cert_2017.pem"))
+	test.SP.IDPMetadata.IDPSSODescriptors[0].KeyDescriptors = []KeyDescriptor{
+		{Use: "signing", KeyInfo: holderOfKeyKeyInfo(otherCert)},
+	}
+	test.SP.IDPMetadata.AttributeAuthorityDescriptors = []AttributeAuthorityDescriptor{{
+		RoleDescriptor: RoleDescriptor{
+			KeyDescriptors: []KeyDescriptor{{Use: "signing", KeyInfo: holderOfKeyKeyInfo(test.IDP.Certificate)}},
+		},
+	}}
+	_, err = test.SP.ParseXMLAttributeQueryResponse(rawResponse, query)
+	assert.Check(t, err)
+
+	test.SP.IDPMetadata.AttributeAuthorityDescriptors[0].KeyDescriptors = []KeyDescriptor{
+		{Use: "signing", KeyInfo: holderOfKeyKeyInfo(otherCert)},
+	}
+	_, err = test.SP.ParseXMLAttributeQueryResponse(rawResponse, query)
+	assert.Check(t, is.ErrorContains(err.(*InvalidResponseError).PrivateErr, "cannot validate signature"))
+
+	// without keys of its own, the attribute authority uses those of the
+	// SSO service
+	test.SP.IDPMetadata.AttributeAuthorityDescriptors[0].KeyDescriptors = nil
+	test.SP.IDPMetadata.IDPSSODescriptors[0].KeyDescriptors = []KeyDescriptor{
+		{Use: "signing", KeyInfo: holderOfKeyKeyInfo(test.IDP.Certificate)},
+	}
+	_, err = test.SP.ParseXMLAttributeQueryResponse(rawResponse, query)
+	assert.Check(t, err)
+}
+
+func TestMakeAuthzDecisionQuery(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+
+	req, err := test.SP.MakeAuthzDecisionQuery("https://idp.example.com/saml/authz",
+		&NameID{Format: string(PersistentNameIDFormat), Value: "alice"},
+		"https://sp.example.com/reports",
+		[]Action{{Namespace: "urn:oasis:names:tc:SAML:1.0:action:ghpp", Value: "GET"}})
+	assert.Check(t, err)
+
+	doc := etree.NewDocument()
+	doc.SetRoot(req.SoapRequest())
+	x, err := doc.WriteToString()
+	assert.Check(t, err)
+	golden.Assert(t, x, t.Name())
+
+	x2, err := xml.Marshal(req)
+	assert.Check(t, err)
+	req2 := AuthzDecisionQuery{}
+	assert.Check(t, xml.Unmarshal(x2, &req2))
+	assert.Check(t, is.Equal(req2.Resource, "https://sp.example.com/reports"))
+	assert.Check(t, is.DeepEqual(req2.Actions, req.Actions))
+}
+
+func TestSPCanQueryAuthzDecision(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	resource := "https://sp.example.com/reports"
+	actions := []Action{{Namespace: "urn:oasis:names:tc:SAML:1.0:action:ghpp", Value: "GET"}}
+	returnedResource := resource
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := struct {
+			Body struct {
+				AuthzDecisionQuery AuthzDecisionQuery
+			}
+		}{}
+		assert.Check(t, xml.NewDecoder(r.Body).Decode(&query))
+		_, _ = w.Write(test.makeQueryResponse(t, query.Body.AuthzDecisionQuery.ID, Assertion{
+			Subject: query.Body.AuthzDecisionQuery.Subject,
+			AuthzDecisionStatements: []AuthzDecisionStatement{{
+				Resource: returnedResource,
+				Decision: DecisionPermit,
+				Actions:  query.Body.AuthzDecisionQuery.Actions,
+			}},
+		}))
+	}))
+	defer server.Close()
+	test.SP.IDPMetadata.PDPDescriptors = []PDPDescriptor{{
+		AuthzServices: []Endpoint{{Binding: SOAPBinding, Location: server.URL}},
+	}}
+
+	nameID := &NameID{Format: string(PersistentNameIDFormat), Value: "alice"}
+	statement, err := test.SP.QueryAuthzDecision(nameID, resource, actions)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(statement.Decision, DecisionPermit))
+	assert.Check(t, is.DeepEqual(statement.Actions, actions))
+
+	returnedResource = "https://sp.example.com/admin"
+	_, err = test.SP.QueryAuthzDecision(nameID, resource, actions)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"assertion invalid: AuthzDecisionStatement Resource \"https://sp.example.com/admin\" does not match the query"))
+}
+
+func TestSPCanQueryAuthnSession(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	var returnedStatements []AuthnStatement
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := struct {
+			Body struct {
+				AuthnQuery AuthnQuery
+			}
+		}{}
+		assert.Check(t, xml.NewDecoder(r.Body).Decode(&query))
+		if returnedStatements == nil {
+			_, _ = w.Write(test.makeQueryResponse(t, query.Body.AuthnQuery.ID))
+			return
+		}
+		_, _ = w.Write(test.makeQueryResponse(t, query.Body.AuthnQuery.ID, Assertion{
+			Subject:         query.Body.AuthnQuery.Subject,
+			AuthnStatements: returnedStatements,
+		}))
+	}))
+	defer server.Close()
+	test.SP.IDPMetadata.AuthnAuthorityDescriptors = []AuthnAuthorityDescriptor{{
+		AuthnQueryServices: []Endpoint{{Binding: SOAPBinding, Location: server.URL}},
+	}}
+
+	nameID := &NameID{Format: string(PersistentNameIDFormat), Value: "alice"}
+	requestedAuthnContext := &RequestedAuthnContext{
+		Comparison:            "exact",
+		AuthnContextClassRefs: []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"},
+	}
+	returnedStatements = []AuthnStatement{{
+		AuthnInstant: TimeNow(),
+		SessionIndex: "session-1",
+		AuthnContext: AuthnContext{
+			AuthnContextClassRef: &AuthnContextClassRef{Value: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"},
+		},
+	}}
+
+	assertion, err := test.SP.QueryAuthnSession(nameID, "session-1", requestedAuthnContext)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(assertion.AuthnStatements[0].SessionIndex, "session-1"))
+
+	_, err = test.SP.QueryAuthnSession(nameID, "session-2", nil)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"assertion invalid: AuthnStatement SessionIndex \"session-1\" does not match the query"))
+
+	_, err = test.SP.QueryAuthnSession(nameID, "", &RequestedAuthnContext{
+		AuthnContextClassRefs: []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:Kerberos"},
+	})
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr,
+		"assertion invalid: AuthnStatement AuthnContextClassRef \"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport\" does not match the query"))
+
+	// no session
+	returnedStatements = nil
+	assertion, err = test.SP.QueryAuthnSession(nameID, "session-1", nil)
+	assert.Check(t, err)
+	assert.Check(t, is.Nil(assertion))
+}
+
+func TestSPCanMapNameID(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	format := string(PersistentNameIDFormat)
+	spNameQualifier := "https://affiliation.example.com"
+	req, err := test.SP.MakeNameIDMappingRequest("https://idp.example.com/saml/nameidmapping",
+		&NameID{Format: string(TransientNameIDFormat), Value: "transient-1"},
+		&NameIDPolicy{Format: &format, SPNameQualifier: &spNameQualifier})
+	assert.Check(t, err)
+
+	mappedNameID := NameID{Format: format, SPNameQualifier: spNameQualifier, Value: "persistent-1"}
+	resp := NameIDMappingResponse{
+		ID:           fmt.Sprintf("id-%x", randomBytes(20)),
+		InResponseTo: req.ID,
+		Version:      "2.0",
+		IssueInstant: TimeNow(),
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  test.IDP.MetadataURL.String(),
+		},
+		Status: Status{StatusCode: StatusCode{Value: StatusSuccess}},
+		NameID: &mappedNameID,
+	}
+
+	// unsigned responses are rejected
+	_, err = test.SP.ParseXMLNameIDMappingResponse(soapEnvelopeBytes(t, resp.Element()), req)
+	assert.Check(t, is.Error(err.(*InvalidResponseError).PrivateErr, "NameIDMappingResponse must be signed"))
+
+	resp.Signature = test.signEnveloped(t, resp.Element())
+	nameID, err := test.SP.ParseXMLNameIDMappingResponse(soapEnvelopeBytes(t, resp.Element()), req)
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(nameID, &mappedNameID))
+
+	// the mapped identifier may be encrypted to the SP
+	doc := etree.NewDocument()
+	doc.SetRoot(mappedNameID.Element())
+	plaintext, err := doc.WriteToBytes()
+	assert.Check(t, err)
+	encryptor := xmlenc.OAEP()
+	encryptor.BlockCipher = xmlenc.AES128CBC
+	encryptedDataEl, err := encryptor.Encrypt(test.SPCertificate, plaintext, nil)
+	assert.Check(t, err)
+	encryptedDataEl.CreateAttr("Type", "http://www.w3.org/2001/04/xmlenc#Element")
+	resp.EncryptedID = etree.NewElement("saml:EncryptedID")
+	resp.EncryptedID.AddChild(encryptedDataEl)
+	resp.NameID = nil
+	resp.Signature = nil
+	resp.Signature = test.signEnveloped(t, resp.Element())
+
+	nameID, err = test.SP.ParseXMLNameIDMappingResponse(soapEnvelopeBytes(t, resp.Element()), req)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(nameID.Value, "persistent-1"))
+	assert.Check(t, is.Equal(nameID.SPNameQualifier, spNameQualifier))
+}
+
+func TestSPCanDecryptWithRolledOverKeys(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	oldKey := DecryptionKey{Key: test.SPKey, Certificate: test.SPCertificate}
+	newKey := DecryptionKey{
+		Key:         mustParsePrivateKey(golden.Get(t, "key_2017.pem")),
+		Certificate: mustParseCertificate(golden.Get(t, "cert_2017.pem")),
+	}
+
+	// makeResponse returns a response with an assertion encrypted to the
+	// first encryption certificate in serviceProviderMetadata.
+	makeResponse := func(serviceProviderMetadata *EntityDescriptor) []byte {
+		req := IdpAuthnRequest{
+			Now:                     TimeNow(),
+			IDP:                     &test.IDP,
+			Request:                 AuthnRequest{ID: "id-00020406080a0c0e10121416181a1c1e20222426"},
+			ServiceProviderMetadata: serviceProviderMetadata,
+			ACSEndpoint: &IndexedEndpoint{
+				Binding:  HTTPPostBinding,
+				Location: test.SP.AcsURL.String(),
+			},
+		}
+		req.SPSSODescriptor = &req.ServiceProviderMetadata.SPSSODescriptors[0]
+		req.HTTPRequest, _ = http.NewRequest("GET", "https://idp.example.com/saml/sso", nil)
+		assert.Check(t, DefaultAssertionMaker{}.MakeAssertion(&req, &Session{
+			ID:       "f00df00df00d",
+			UserName: "alice",
+		}))
+		assert.Check(t, req.MakeAssertionEl())
+		assert.Check(t, req.AssertionEl.Tag == "EncryptedAssertion")
+		assert.Check(t, req.MakeResponse())
+
+		doc := etree.NewDocument()
+		doc.SetRoot(req.ResponseEl)
+		buf, err := doc.WriteToBytes()
+		assert.Check(t, err)
+		return buf
+	}
+
+	// the IDP still has the metadata from before the rollover
+	oldResponse := makeResponse(test.SP.Metadata())
+
+	test.SP.DecryptionKeys = []DecryptionKey{newKey, oldKey}
+	metadata := test.SP.Metadata()
+	var encryptionCerts []string
+	for _, keyDescriptor := range metadata.SPSSODescriptors[0].KeyDescriptors {
+		assert.Check(t, is.Equal("encryption", keyDescriptor.Use))
+		encryptionCerts = append(encryptionCerts, keyDescriptor.KeyInfo.X509Data.X509Certificates[0].Data)
+	}
+	assert.Check(t, is.DeepEqual([]string{
+		base64.StdEncoding.EncodeToString(newKey.Certificate.Raw),
+		base64.StdEncoding.EncodeToString(oldKey.Certificate.Raw),
+	}, encryptionCerts))
+	newResponse := makeResponse(metadata)
+
+	for _, response := range [][]byte{oldResponse, newResponse} {
+		assertion, err := test.SP.ParseXMLResponse(response, []string{"id-00020406080a0c0e10121416181a1c1e20222426"})
+		assert.Check(t, err)
+		assert.Check(t, assertion != nil)
+	}
+
+	// once the old key is removed, assertions encrypted to it are rejected
+	test.SP.DecryptionKeys = []DecryptionKey{newKey}
+	_, err := test.SP.ParseXMLResponse(newResponse, []string{"id-00020406080a0c0e10121416181a1c1e20222426"})
+	assert.Check(t, err)
+	_, err = test.SP.ParseXMLResponse(oldResponse, []string{"id-00020406080a0c0e10121416181a1c1e20222426"})
+	assert.Check(t, is.ErrorContains(err.(*InvalidResponseError).PrivateErr, "failed to decrypt"))
+}
+
+func TestSPCanRolloverSigningKey(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	var gotRequests int
+	test.IDP.ManageNameIDProvider = &mockManageNameIDProvider{
+		ManageNameIDFunc: func(r *http.Request, serviceProviderID string, req *ManageNameIDRequest) error {
+			gotRequests++
+			return nil
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(test.IDP.ServeManageNameID))
+	defer server.Close()
+	test.IDP.ManageNameIDURL = mustParseURL(server.URL + "/saml/manage")
+	test.SP.IDPMetadata = test.IDP.Metadata()
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+
+	nextKey := mustParsePrivateKey(golden.Get(t, "sp_next_key.pem"))
+	nextCert := mustParseCertificate(golden.Get(t, "sp_next_cert.pem"))
+	test.SP.SigningKeys = NewSigningKeys(test.SPKey, test.SPCertificate)
+	test.SP.SigningKeys.SetNext(nextKey, nextCert)
+
+	// the IDP fetches the metadata, which publishes both certificates,
+	// before the rollover
+	metadata := test.SP.Metadata()
+	var signingCerts []string
+	for _, keyDescriptor := range metadata.SPSSODescriptors[0].KeyDescriptors {
+		if keyDescriptor.Use == "signing" {
+			signingCerts = append(signingCerts, keyDescriptor.KeyInfo.X509Data.X509Certificates[0].Data)
+		}
+	}
+	assert.Check(t, is.DeepEqual([]string{
+		base64.StdEncoding.EncodeToString(test.SPCertificate.Raw),
+		base64.StdEncoding.EncodeToString(nextCert.Raw),
+	}, signingCerts))
+	test.IDP.ServiceProviderProvider = &mockServiceProviderProvider{
+		GetServiceProviderFunc: func(r *http.Request, serviceProviderID string) (*EntityDescriptor, error) {
+			return metadata, nil
+		},
+	}
+
+	err := test.SP.TerminateNameID(&NameID{Format: string(PersistentNameIDFormat), Value: "alice"})
+	assert.Check(t, err)
+
+	assert.Check(t, test.SP.SigningKeys.Rollover())
+	key, cert := test.SP.SigningKeys.Active()
+	assert.Check(t, is.Equal(nextKey, key))
+	assert.Check(t, is.Equal(nextCert, cert))
+	assert.Check(t, is.Len(test.SP.SigningKeys.Certificates(), 1))
+
+	err = test.SP.TerminateNameID(&NameID{Format: string(PersistentNameIDFormat), Value: "alice"})
+	assert.Check(t, err)
+	assert.Check(t, is.Equal(2, gotRequests))
+
+	assert.Check(t, is.Error(test.SP.SigningKeys.Rollover(), "there is no next signing key"))
+}
+
+func TestSPValidatesAttributeScopes(t *testing.T) {
+	s := ServiceProvider{
+		IDPMetadata: &EntityDescriptor{
+			EntityID: "https://idp.example.com/saml/metadata",
+			IDPSSODescriptors: []IDPSSODescriptor{{
+				SSODescriptor: SSODescriptor{
+					RoleDescriptor: RoleDescriptor{
+						Extensions: &MetadataExtensions{
+							Scopes: []Scope{{Value: "example.com"}},
+						},
+					},
+				},
+			}},
+		},
+	}
+	assertion := func(name, value string) *Assertion {
+		return &Assertion{
+			AttributeStatements: []AttributeStatement{{
+				Attributes: []Attribute{{
+					Name:   name,
+					Values: []AttributeValue{{Value: value}},
+				}},
+			}},
+		}
+	}
+	eppn := "urn:oid:1.3.6.1.4.1.5923.1.1.1.6"
+
+	// validation is opt-in
+	assert.Check(t, s.validateAttributeScopes(assertion(eppn, "alice@evil.com")))
+
+	s.ValidateAttributeScopes = true
+	assert.Check(t, s.validateAttributeScopes(assertion(eppn, "alice@example.com")))
+	assert.Check(t, s.validateAttributeScopes(assertion("urn:oid:0.9.2342.19200300.100.1.3", "alice@evil.com")))
+	assert.Check(t, is.Error(s.validateAttributeScopes(assertion(eppn, "alice@evil.com")),
+		`scope "evil.com" of attribute urn:oid:1.3.6.1.4.1.5923.1.1.1.6 is not authorized for the IDP`))
+	assert.Check(t, is.Error(s.validateAttributeScopes(assertion(eppn, "alice")),
+		"value of attribute urn:oid:1.3.6.1.4.1.5923.1.1.1.6 is not scoped"))
+}
+
+func TestSPCanRejectUnsupportedConditions(t *testing.T) {
+	s := ServiceProvider{
+		MetadataURL: mustParseURL("https://sp.example.com/saml2/metadata"),
+	}
+	conditions := &Conditions{
+		NotBefore:    TimeNow(),
+		NotOnOrAfter: TimeNow().Add(time.Minute),
+		OneTimeUse:   &OneTimeUse{},
+	}
+
+	// by default, conditions that cannot be enforced are ignored
+	assert.Check(t, s.validateConditions(conditions, TimeNow()))
+
+	s.StrictConditions = true
+	err := s.validateConditions(conditions, TimeNow())
+	assert.Check(t, errors.Is(err, ErrUnsupportedCondition))
+	assert.Check(t, is.Error(err, "assertion Conditions OneTimeUse cannot be enforced without a ReplayCache"))
+
+	s.ReplayCache = &MemoryReplayCache{}
+	assert.Check(t, s.validateConditions(conditions, TimeNow()))
+
+	conditions.AnyElements = []AnyElement{{Element: etree.NewElement("saml:Condition")}}
+	err = s.validateConditions(conditions, TimeNow())
+	assert.Check(t, is.Error(err, "assertion Conditions contains an unsupported condition <Condition>"))
+}
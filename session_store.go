@@ -0,0 +1,271 @@
+package saml
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// SessionStore is an interface used by IdentityProvider to store the
+// sessions of users along with the service providers that participate in
+// each of them, that is, the NameID and SessionIndex that each one was
+// issued. The IDP looks up the sessions that a LogoutRequest refers to in it,
+// and the participants that must be logged out with them. When the IDP runs
+// as many processes, they must share a SessionStore, i.e. the IDPStore of
+// the redissession package. See MemorySessionStore.
+type SessionStore interface {
+	// Create stores session under its ID.
+	Create(session *Session) error
+
+	// Get returns the session with ID sessionID. If there is no such
+	// session, or it has expired, the returned error must be
+	// os.ErrNotExist.
+	Get(sessionID string) (*Session, error)
+
+	// AddServiceProvider records that participant was issued an assertion
+	// during the session with ID sessionID, replacing any previous record
+	// of the same service provider. If there is no such session, the
+	// returned error must be os.ErrNotExist.
+	AddServiceProvider(sessionID string, participant SessionParticipant) error
+
+	// FindSession returns the ID of the session during which nameID was
+	// issued to the service provider serviceProviderID. If sessionIndex is
+	// not empty, the session index issued to the service provider must
+	// match as well. If there is no such session, the returned error must
+	// be os.ErrNotExist.
+	FindSession(serviceProviderID string, nameID string, sessionIndex string) (string, error)
+
+	// Delete removes the session with ID sessionID and returns its
+	// participants. If there is no such session, the returned error must
+	// be os.ErrNotExist.
+	Delete(sessionID string) ([]SessionParticipant, error)
+
+	// DeleteExpired removes the sessions that have expired. Implementations
+	// that expire sessions by themselves may do nothing.
+	DeleteExpired() error
+}
+
+// MemorySessionStore is an implementation of SessionStore that resides
+// completely in memory. It is suitable for an IDP that runs as a single
+// process. Expired sessions are removed whenever a session is created, and
+// by DeleteExpired.
+//
+// TimeSource, if not nil, is the source of the current time used to expire
+// sessions. Otherwise the TimeSource of the IdentityProvider is used, or
+// TimeNow.
+type MemorySessionStore struct {
+	TimeSource TimeSource
+
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+}
+
+type memorySession struct {
+	Session      Session
+	Participants []SessionParticipant
+}
+
+// expired returns true if the session has an expiry time that has passed.
+func (s *memorySession) expired(now time.Time) bool {
+	return !s.Session.ExpireTime.IsZero() && now.After(s.Session.ExpireTime)
+}
+
+// Create implements SessionStore.
+func (s *MemorySessionStore) Create(session *Session) error {
+	return s.create(session, timeNow(s.TimeSource))
+}
+
+func (s *MemorySessionStore) create(session *Session, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = map[string]*memorySession{}
+	}
+	s.deleteExpired(now)
+	s.sessions[session.ID] = &memorySession{Session: *session}
+	return nil
+}
+
+// Get implements SessionStore.
+func (s *MemorySessionStore) Get(sessionID string) (*Session, error) {
+	return s.get(sessionID, timeNow(s.TimeSource))
+}
+
+func (s *MemorySessionStore) get(sessionID string, now time.Time) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok || session.expired(now) {
+		return nil, os.ErrNotExist
+	}
+	rv := session.Session
+	return &rv, nil
+}
+
+// AddServiceProvider implements SessionStore.
+func (s *MemorySessionStore) AddServiceProvider(sessionID string, participant SessionParticipant) error {
+	return s.addServiceProvider(sessionID, participant, timeNow(s.TimeSource))
+}
+
+func (s *MemorySessionStore) addServiceProvider(sessionID string, participant SessionParticipant, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok || session.expired(now) {
+		return os.ErrNotExist
+	}
+	for i, p := range session.Participants {
+		if p.ServiceProviderID == participant.ServiceProviderID {
+			session.Participants[i] = participant
+			return nil
+		}
+	}
+	session.Participants = append(session.Participants, participant)
+	return nil
+}
+
+// FindSession implements SessionStore.
+func (s *MemorySessionStore) FindSession(serviceProviderID string, nameID string, sessionIndex string) (string, error) {
+	return s.findSession(serviceProviderID, nameID, sessionIndex, timeNow(s.TimeSource))
+}
+
+func (s *MemorySessionStore) findSession(serviceProviderID string, nameID string, sessionIndex string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sessionID, session := range s.sessions {
+		if session.expired(now) {
+			continue
+		}
+		if sessionHasParticipant(session.Participants, serviceProviderID, nameID, sessionIndex) {
+			return sessionID, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// Delete implements SessionStore.
+func (s *MemorySessionStore) Delete(sessionID string) ([]SessionParticipant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	delete(s.sessions, sessionID)
+	return session.Participants, nil
+}
+
+// DeleteExpired implements SessionStore.
+func (s *MemorySessionStore) DeleteExpired() error {
+	return s.deleteExpiredAt(timeNow(s.TimeSource))
+}
+
+func (s *MemorySessionStore) deleteExpiredAt(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteExpired(now)
+	return nil
+}
+
+func (s *MemorySessionStore) deleteExpired(now time.Time) {
+	for id, session := range s.sessions {
+		if session.expired(now) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// memorySessionStoreView is a MemorySessionStore that expires sessions using
+// the TimeSource of the IdentityProvider that uses it.
+type memorySessionStoreView struct {
+	store      *MemorySessionStore
+	timeSource TimeSource
+}
+
+func (v memorySessionStoreView) Create(session *Session) error {
+	return v.store.create(session, timeNow(v.timeSource))
+}
+
+func (v memorySessionStoreView) Get(sessionID string) (*Session, error) {
+	return v.store.get(sessionID, timeNow(v.timeSource))
+}
+
+func (v memorySessionStoreView) AddServiceProvider(sessionID string, participant SessionParticipant) error {
+	return v.store.addServiceProvider(sessionID, participant, timeNow(v.timeSource))
+}
+
+func (v memorySessionStoreView) FindSession(serviceProviderID string, nameID string, sessionIndex string) (string, error) {
+	return v.store.findSession(serviceProviderID, nameID, sessionIndex, timeNow(v.timeSource))
+}
+
+func (v memorySessionStoreView) Delete(sessionID string) ([]SessionParticipant, error) {
+	return v.store.Delete(sessionID)
+}
+
+func (v memorySessionStoreView) DeleteExpired() error {
+	return v.store.deleteExpiredAt(timeNow(v.timeSource))
+}
+
+// sessionStore returns the SessionStore of the IDP. A MemorySessionStore
+// without a TimeSource of its own uses that of the IDP.
+func (idp *IdentityProvider) sessionStore() SessionStore {
+	if s, ok := idp.SessionStore.(*MemorySessionStore); ok && s.TimeSource == nil {
+		return memorySessionStoreView{store: s, timeSource: idp.TimeSource}
+	}
+	return idp.SessionStore
+}
+
+// sessionHasParticipant returns true if nameID was issued to the service
+// provider serviceProviderID by one of participants, with sessionIndex
+// unless it is empty.
+func sessionHasParticipant(participants []SessionParticipant, serviceProviderID string, nameID string, sessionIndex string) bool {
+	for _, p := range participants {
+		if p.ServiceProviderID != serviceProviderID || p.NameID.Value != nameID {
+			continue
+		}
+		if sessionIndex != "" && p.SessionIndex != sessionIndex {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// addSessionServiceProvider records participant in the session of the
+// SessionStore of the IDP, creating the session first if it is not stored
+// yet.
+func (idp *IdentityProvider) addSessionServiceProvider(session *Session, participant SessionParticipant) error {
+	store := idp.sessionStore()
+	err := store.AddServiceProvider(session.ID, participant)
+	if err != os.ErrNotExist {
+		return err
+	}
+	if err := store.Create(session); err != nil {
+		return err
+	}
+	return store.AddServiceProvider(session.ID, participant)
+}
+
+// findSession returns the ID of the session during which nameID was issued
+// to the service provider serviceProviderID, with sessionIndex unless it is
+// empty, from the SessionStore of the IDP. If there is no such session, the
+// returned error is os.ErrNotExist.
+func (idp *IdentityProvider) findSession(serviceProviderID string, nameID string, sessionIndex string) (string, error) {
+	if idp.SessionStore == nil {
+		return "", os.ErrNotExist
+	}
+	return idp.sessionStore().FindSession(serviceProviderID, nameID, sessionIndex)
+}
+
+// takeSessionParticipants returns the participants of the session with ID
+// sessionID, and removes the session from the SessionStore of the IDP.
+func (idp *IdentityProvider) takeSessionParticipants(sessionID string) ([]SessionParticipant, error) {
+	if idp.SessionStore == nil {
+		return nil, nil
+	}
+	participants, err := idp.sessionStore().Delete(sessionID)
+	if err == os.ErrNotExist {
+		return nil, nil
+	}
+	return participants, err
+}
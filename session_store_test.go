@@ -0,0 +1,113 @@
+package saml
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	dsig "github.com/russellhaering/goxmldsig"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	TimeNow = func() time.Time {
+		rv, _ := time.Parse("Mon Jan 2 15:04:05 MST 2006", "Mon Dec 1 01:57:09 UTC 2015")
+		return rv
+	}
+	store := &MemorySessionStore{}
+	expireTime := TimeNow().Add(time.Hour)
+	participant := SessionParticipant{
+		ServiceProviderID: "https://sp.example.com/saml2/metadata",
+		NameID:            NameID{Value: "alice"},
+		SessionIndex:      "index-1",
+		ExpireTime:        expireTime,
+	}
+
+	assert.Check(t, is.Equal(os.ErrNotExist, store.AddServiceProvider("session-1", participant)))
+	assert.Check(t, store.Create(&Session{ID: "session-1", UserName: "alice", ExpireTime: expireTime}))
+	assert.Check(t, store.AddServiceProvider("session-1", participant))
+	session, err := store.Get("session-1")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("alice", session.UserName))
+
+	sessionID, err := store.FindSession("https://sp.example.com/saml2/metadata", "alice", "index-1")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("session-1", sessionID))
+	_, err = store.FindSession("https://sp.example.com/saml2/metadata", "alice", "index-2")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	participants, err := store.Delete("session-1")
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual([]SessionParticipant{participant}, participants))
+	_, err = store.Get("session-1")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+	_, err = store.Delete("session-1")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	// expired sessions cannot be found, and are swept
+	assert.Check(t, store.Create(&Session{ID: "session-2", ExpireTime: TimeNow().Add(-time.Minute)}))
+	_, err = store.Get("session-2")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+	assert.Check(t, store.DeleteExpired())
+	assert.Check(t, is.Len(store.sessions, 0))
+}
+
+func TestMemorySessionStoreUsesTimeSource(t *testing.T) {
+	TimeNow = func() time.Time {
+		rv, _ := time.Parse("Mon Jan 2 15:04:05 MST 2006", "Mon Dec 1 01:57:09 UTC 2015")
+		return rv
+	}
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	session := &Session{ID: "session-1", ExpireTime: now.Add(-time.Minute)}
+
+	// the store's own TimeSource is used instead of TimeNow
+	store := &MemorySessionStore{TimeSource: dsig.NewFakeClockAt(now)}
+	assert.Check(t, store.Create(session))
+	_, err := store.Get("session-1")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	// otherwise that of the IDP that uses it
+	store = &MemorySessionStore{}
+	idp := IdentityProvider{SessionStore: store, TimeSource: dsig.NewFakeClockAt(now)}
+	assert.Check(t, store.Create(session))
+	_, err = store.Get("session-1")
+	assert.Check(t, err)
+	_, err = idp.sessionStore().Get("session-1")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+}
+
+func TestIDPRecordsSessionParticipantsInSessionStore(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	store := &MemorySessionStore{}
+	test.IDP.SessionStore = store
+
+	req := newNameIDTestRequest(t, test, "")
+	session := &Session{ID: "f00df00df00d", Index: "index-1", NameID: "alice", ExpireTime: TimeNow().Add(time.Hour)}
+	assert.Check(t, DefaultAssertionMaker{}.MakeAssertion(req, session))
+	test.IDP.addSessionParticipant(req, session)
+
+	// the session is created when it is first used
+	sessionID, err := store.FindSession("https://sp.example.com/saml2/metadata", "alice", "index-1")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("f00df00df00d", sessionID))
+	got, err := store.Get(sessionID)
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("index-1", got.Index))
+}
+
+func TestIDPLogsSessionParticipantsWithoutSessionStore(t *testing.T) {
+	test := NewIdentifyProviderTest(t)
+	var logs bytes.Buffer
+	test.IDP.Logger = log.New(&logs, "", 0)
+	test.IDP.SingleLogoutStore = &MemorySingleLogoutStore{}
+
+	req := newNameIDTestRequest(t, test, "")
+	session := &Session{ID: "f00df00df00d", Index: "index-1", NameID: "alice", ExpireTime: TimeNow().Add(time.Hour)}
+	assert.Check(t, DefaultAssertionMaker{}.MakeAssertion(req, session))
+	test.IDP.addSessionParticipant(req, session)
+	assert.Check(t, is.Equal("cannot record session participant https://sp.example.com/saml2/metadata: a SingleLogoutStore is configured without a SessionStore, so the logout of the session will not be propagated to it\n",
+		logs.String()))
+}
@@ -0,0 +1,560 @@
+package saml
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// newSigningContext returns a signing context that signs with key using
+// signatureMethod. cert and intermediates are included in the KeyInfo of
+// the signatures it produces.
+//
+// key may be any crypto.Signer with an RSA or ECDSA public key, so keys
+// held in an HSM or a cloud KMS can be used as well as in-memory keys.
+func newSigningContext(key crypto.PrivateKey, cert *x509.Certificate, intermediates []*x509.Certificate, signatureMethod string) (*dsig.SigningContext, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("signing key of type %T does not implement crypto.Signer", key)
+	}
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		signer = ecdsaSigner{signer}
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", signer.Public())
+	}
+
+	if cert == nil {
+		return nil, errors.New("a certificate is required to sign")
+	}
+	if publicKey, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(signer.Public()) {
+		return nil, errors.New("certificate does not match the signing key")
+	}
+
+	certs := [][]byte{cert.Raw}
+	for _, intermediate := range intermediates {
+		certs = append(certs, intermediate.Raw)
+	}
+
+	signingContext, err := dsig.NewSigningContext(signer, certs)
+	if err != nil {
+		return nil, err
+	}
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(canonicalizerPrefixList)
+	if err := signingContext.SetSignatureMethod(signatureMethod); err != nil {
+		return nil, err
+	}
+	return signingContext, nil
+}
+
+// DefaultAllowedSignatureMethods are the signature methods accepted on
+// inbound messages by a ServiceProvider or IdentityProvider that does not
+// configure AllowedSignatureMethods. SHA-1 based methods are not included.
+var DefaultAllowedSignatureMethods = []string{
+	dsig.RSASHA256SignatureMethod,
+	dsig.RSASHA384SignatureMethod,
+	dsig.RSASHA512SignatureMethod,
+	dsig.ECDSASHA256SignatureMethod,
+	dsig.ECDSASHA384SignatureMethod,
+	dsig.ECDSASHA512SignatureMethod,
+}
+
+// DefaultAllowedDigestMethods are the digest methods accepted in the
+// references of signatures on inbound messages by a ServiceProvider or
+// IdentityProvider that does not configure AllowedDigestMethods. SHA-1 is
+// not included.
+var DefaultAllowedDigestMethods = []string{
+	"http://www.w3.org/2001/04/xmlenc#sha256",
+	"http://www.w3.org/2001/04/xmldsig-more#sha384",
+	"http://www.w3.org/2001/04/xmlenc#sha512",
+}
+
+// defaultSignatureMethod returns the signature method used when none is
+// configured for key.
+func defaultSignatureMethod(key crypto.PrivateKey) string {
+	if signer, ok := key.(crypto.Signer); ok {
+		if _, ok := signer.Public().(*ecdsa.PublicKey); ok {
+			return dsig.ECDSASHA256SignatureMethod
+		}
+	}
+	return dsig.RSASHA256SignatureMethod
+}
+
+// SigningKeys holds the keys a ServiceProvider signs with, so that the
+// signing key can be rolled over without downtime. Both the active
+// certificate and the next certificate are published in the metadata, so
+// federations that pre-trust the next certificate keep accepting signed
+// requests once it becomes active.
+//
+// SigningKeys is safe for concurrent use.
+type SigningKeys struct {
+	mu              sync.RWMutex
+	key             crypto.PrivateKey
+	certificate     *x509.Certificate
+	nextKey         crypto.PrivateKey
+	nextCertificate *x509.Certificate
+}
+
+// NewSigningKeys returns SigningKeys that sign with key, whose public part
+// is certificate.
+func NewSigningKeys(key crypto.PrivateKey, certificate *x509.Certificate) *SigningKeys {
+	return &SigningKeys{key: key, certificate: certificate}
+}
+
+// Active returns the key that is currently used to sign, and its
+// certificate.
+func (k *SigningKeys) Active() (crypto.PrivateKey, *x509.Certificate) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.key, k.certificate
+}
+
+// SetNext sets the key that becomes active on the next call to Rollover.
+// Its certificate is published in the metadata from now on.
+func (k *SigningKeys) SetNext(key crypto.PrivateKey, certificate *x509.Certificate) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.nextKey = key
+	k.nextCertificate = certificate
+}
+
+// Rollover atomically makes the next key the active one. The certificate
+// of the previously active key is no longer published.
+func (k *SigningKeys) Rollover() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.nextKey == nil {
+		return errors.New("there is no next signing key")
+	}
+	k.key, k.certificate = k.nextKey, k.nextCertificate
+	k.nextKey, k.nextCertificate = nil, nil
+	return nil
+}
+
+// Certificates returns the certificates to publish for signing: the active
+// certificate followed by the next certificate, if any.
+func (k *SigningKeys) Certificates() []*x509.Certificate {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	certs := []*x509.Certificate{k.certificate}
+	if k.nextCertificate != nil {
+		certs = append(certs, k.nextCertificate)
+	}
+	return certs
+}
+
+// VerifyMetadataSignature returns nil iff the root element of the metadata
+// document data, an EntityDescriptor or an EntitiesDescriptor, carries a
+// valid enveloped signature made with one of certs. Federations such as
+// InCommon and eduGAIN sign their aggregated metadata, and consumers must
+// verify it against the federation signing certificate before trusting it.
+func VerifyMetadataSignature(data []byte, certs []*x509.Certificate) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return fmt.Errorf("cannot parse metadata: %v", err)
+	}
+	el := doc.Root()
+	if el == nil {
+		return errors.New("metadata is empty")
+	}
+	if el.FindElement("./Signature") == nil {
+		return errors.New("metadata is not signed")
+	}
+	if err := verifySignature(el, certs, nil, signaturePolicy{}, Clock); err != nil {
+		return fmt.Errorf("cannot validate signature on metadata: %v", err)
+	}
+	return nil
+}
+
+// signaturePolicy lists the algorithms that are acceptable in the
+// signatures of inbound messages. An empty list means the corresponding
+// default is used.
+type signaturePolicy struct {
+	SignatureMethods []string
+	DigestMethods    []string
+}
+
+// methods returns the signature methods and digest methods that the policy
+// allows.
+func (p signaturePolicy) methods() (signatureMethods, digestMethods []string) {
+	signatureMethods = p.SignatureMethods
+	if len(signatureMethods) == 0 {
+		signatureMethods = DefaultAllowedSignatureMethods
+	}
+	digestMethods = p.DigestMethods
+	if len(digestMethods) == 0 {
+		digestMethods = DefaultAllowedDigestMethods
+	}
+	return signatureMethods, digestMethods
+}
+
+// metadataExtensions returns the metadata extensions that declare support
+// for the algorithms that the policy allows.
+func (p signaturePolicy) metadataExtensions() *MetadataExtensions {
+	signatureMethods, digestMethods := p.methods()
+	extensions := &MetadataExtensions{}
+	for _, digestMethod := range digestMethods {
+		extensions.DigestMethods = append(extensions.DigestMethods, DigestMethod{Algorithm: digestMethod})
+	}
+	for _, signatureMethod := range signatureMethods {
+		extensions.SigningMethods = append(extensions.SigningMethods, SigningMethod{Algorithm: signatureMethod})
+	}
+	return extensions
+}
+
+// signatureMethodMatchesKey returns true if signatureMethod is an algorithm
+// for the type of key.
+func signatureMethodMatchesKey(signatureMethod string, key crypto.PrivateKey) bool {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return strings.Contains(signatureMethod, "#rsa-")
+	case *ecdsa.PublicKey:
+		return strings.Contains(signatureMethod, "#ecdsa-")
+	}
+	return false
+}
+
+// check returns an error if the Signature that references el uses a
+// signature method or a digest method that the policy does not allow. It
+// is called once the signature has been verified.
+func (p signaturePolicy) check(el *etree.Element) error {
+	signatureMethods, digestMethods := p.methods()
+
+	uri := "#" + el.SelectAttrValue("ID", "")
+	for _, sigEl := range el.SelectElements("Signature") {
+		referenceEl := sigEl.FindElement("./SignedInfo/Reference")
+		if referenceEl == nil || referenceEl.SelectAttrValue("URI", "") != uri {
+			continue
+		}
+
+		signatureMethodEl := sigEl.FindElement("./SignedInfo/SignatureMethod")
+		if signatureMethodEl == nil {
+			return errors.New("signature has no SignatureMethod")
+		}
+		if signatureMethod := signatureMethodEl.SelectAttrValue("Algorithm", ""); !containsString(signatureMethods, signatureMethod) {
+			return fmt.Errorf("signature method %q is not allowed", signatureMethod)
+		}
+		for _, digestMethodEl := range sigEl.FindElements("./SignedInfo/Reference/DigestMethod") {
+			if digestMethod := digestMethodEl.SelectAttrValue("Algorithm", ""); !containsString(digestMethods, digestMethod) {
+				return fmt.Errorf("digest method %q is not allowed", digestMethod)
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ecdsaSigner wraps an ECDSA signer so that it produces signatures in the
+// form required by XML Signature, which is the concatenation of r and s
+// each padded to the size of the curve, rather than the ASN.1 encoding
+// produced by crypto/ecdsa.
+type ecdsaSigner struct {
+	crypto.Signer
+}
+
+// Sign implements crypto.Signer
+func (s ecdsaSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	asn1Signature, err := s.Signer.Sign(rand, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(asn1Signature, &sig); err != nil {
+		return nil, err
+	}
+
+	size := (s.Public().(*ecdsa.PublicKey).Curve.Params().BitSize + 7) / 8
+	rv := make([]byte, 2*size)
+	sig.R.FillBytes(rv[:size])
+	sig.S.FillBytes(rv[size:])
+	return rv, nil
+}
+
+// isECDSASignatureMethod returns true if signatureMethod is one of the
+// ECDSA signature methods defined in RFC 4051.
+func isECDSASignatureMethod(signatureMethod string) bool {
+	switch signatureMethod {
+	case dsig.ECDSASHA1SignatureMethod, dsig.ECDSASHA256SignatureMethod,
+		dsig.ECDSASHA384SignatureMethod, dsig.ECDSASHA512SignatureMethod:
+		return true
+	}
+	return false
+}
+
+// normalizeECDSASignature rewrites the SignatureValue of the Signature in
+// el from the XML Signature encoding of an ECDSA signature to the ASN.1
+// encoding understood by dsig. Signatures that are not ECDSA signatures,
+// or that are already ASN.1 encoded, are left alone.
+func normalizeECDSASignature(el *etree.Element) error {
+	signatureMethodEl := el.FindElement("./Signature/SignedInfo/SignatureMethod")
+	if signatureMethodEl == nil || !isECDSASignatureMethod(signatureMethodEl.SelectAttrValue("Algorithm", "")) {
+		return nil
+	}
+	signatureValueEl := el.FindElement("./Signature/SignatureValue")
+	if signatureValueEl == nil {
+		return nil
+	}
+
+	signatureValue, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(signatureValueEl.Text()), ""))
+	if err != nil {
+		return fmt.Errorf("cannot decode SignatureValue: %v", err)
+	}
+
+	var sig struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(signatureValue, &sig); err == nil && len(rest) == 0 {
+		return nil
+	}
+	if len(signatureValue) == 0 || len(signatureValue)%2 != 0 {
+		return fmt.Errorf("invalid ECDSA signature length %d", len(signatureValue))
+	}
+
+	size := len(signatureValue) / 2
+	sig.R = new(big.Int).SetBytes(signatureValue[:size])
+	sig.S = new(big.Int).SetBytes(signatureValue[size:])
+	asn1Signature, err := asn1.Marshal(sig)
+	if err != nil {
+		return err
+	}
+	signatureValueEl.SetText(base64.StdEncoding.EncodeToString(asn1Signature))
+	return nil
+}
+
+// preferTrustedCertificate moves the X509Certificate in the KeyInfo of the
+// Signature in el that is most likely to be the trusted signing certificate
+// to the front of its X509Data. A signer may send its full certificate
+// chain in any order, but dsig only considers the first certificate, so
+// without this a signature would be rejected whenever the leaf is not sent
+// first. Since metadata may publish intermediates alongside the leaf, a
+// trusted certificate that is not a CA is preferred over one that is.
+func preferTrustedCertificate(el *etree.Element, certs []*x509.Certificate) {
+	x509DataEl := el.FindElement("./Signature/KeyInfo/X509Data")
+	if x509DataEl == nil {
+		return
+	}
+	certEls := x509DataEl.SelectElements("X509Certificate")
+	if len(certEls) < 2 {
+		return
+	}
+
+	var preferred *etree.Element
+	for _, certEl := range certEls {
+		cert := trustedCertificate(certEl, certs)
+		if cert == nil {
+			continue
+		}
+		if !cert.IsCA {
+			preferred = certEl
+			break
+		}
+		if preferred == nil {
+			preferred = certEl
+		}
+	}
+	if preferred != nil && preferred != certEls[0] {
+		x509DataEl.RemoveChild(preferred)
+		x509DataEl.InsertChildAt(certEls[0].Index(), preferred)
+	}
+}
+
+// trustedCertificate returns the certificate of certs that certEl, an
+// X509Certificate element, contains, or nil if it contains none of them.
+func trustedCertificate(certEl *etree.Element, certs []*x509.Certificate) *x509.Certificate {
+	certBytes, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(certEl.Text()), ""))
+	if err != nil {
+		return nil
+	}
+	for _, cert := range certs {
+		if bytes.Equal(certBytes, cert.Raw) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// resolveKeyInfoCertificate rewrites the KeyInfo of the Signature in el so
+// that it carries the signing certificate inline, as dsig requires. Some
+// identity providers, such as Keycloak and Shibboleth, identify the
+// certificate by reference instead, with an X509IssuerSerial, an X509SKI or
+// a KeyName, so the certificate of certs it refers to is put in its place.
+//
+// A KeyInfo that carries no X509Certificate and refers to none of certs,
+// such as one with only an RSAKeyValue, is removed, so that dsig falls back
+// to the trusted certificate if there is only one.
+func resolveKeyInfoCertificate(el *etree.Element, certs []*x509.Certificate) {
+	sigEl := el.FindElement("./Signature")
+	if sigEl == nil {
+		return
+	}
+	keyInfoEl := sigEl.FindElement("KeyInfo")
+	if keyInfoEl == nil || keyInfoEl.FindElement("./X509Data/X509Certificate") != nil {
+		return
+	}
+
+	cert := referencedCertificate(keyInfoEl, certs)
+	if cert == nil {
+		sigEl.RemoveChild(keyInfoEl)
+		return
+	}
+	for _, child := range keyInfoEl.ChildElements() {
+		keyInfoEl.RemoveChild(child)
+	}
+	x509DataEl := keyInfoEl.CreateElement("X509Data")
+	x509DataEl.Space = keyInfoEl.Space
+	certEl := x509DataEl.CreateElement("X509Certificate")
+	certEl.Space = keyInfoEl.Space
+	certEl.SetText(base64.StdEncoding.EncodeToString(cert.Raw))
+}
+
+// referencedCertificate returns the certificate of certs that keyInfoEl, a
+// KeyInfo element, refers to by issuer and serial number, by subject key
+// identifier or by name, or nil if it refers to none of them.
+//
+// A KeyName matches the hex encoded subject key identifier, the common name
+// or the distinguished name of the subject of a certificate.
+func referencedCertificate(keyInfoEl *etree.Element, certs []*x509.Certificate) *x509.Certificate {
+	for _, issuerSerialEl := range keyInfoEl.FindElements("./X509Data/X509IssuerSerial") {
+		issuerNameEl := issuerSerialEl.FindElement("X509IssuerName")
+		serialNumberEl := issuerSerialEl.FindElement("X509SerialNumber")
+		if issuerNameEl == nil || serialNumberEl == nil {
+			continue
+		}
+		serialNumber, ok := new(big.Int).SetString(strings.TrimSpace(serialNumberEl.Text()), 10)
+		if !ok {
+			continue
+		}
+		for _, cert := range certs {
+			if cert.SerialNumber.Cmp(serialNumber) == 0 &&
+				normalizeDistinguishedName(cert.Issuer.String()) == normalizeDistinguishedName(issuerNameEl.Text()) {
+				return cert
+			}
+		}
+	}
+
+	for _, skiEl := range keyInfoEl.FindElements("./X509Data/X509SKI") {
+		ski, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(skiEl.Text()), ""))
+		if err != nil || len(ski) == 0 {
+			continue
+		}
+		for _, cert := range certs {
+			if bytes.Equal(cert.SubjectKeyId, ski) {
+				return cert
+			}
+		}
+	}
+
+	for _, keyNameEl := range keyInfoEl.SelectElements("KeyName") {
+		keyName := strings.TrimSpace(keyNameEl.Text())
+		if keyName == "" {
+			continue
+		}
+		for _, cert := range certs {
+			if len(cert.SubjectKeyId) > 0 && strings.EqualFold(keyName, hex.EncodeToString(cert.SubjectKeyId)) {
+				return cert
+			}
+			if keyName == cert.Subject.CommonName ||
+				normalizeDistinguishedName(keyName) == normalizeDistinguishedName(cert.Subject.String()) {
+				return cert
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeDistinguishedName returns the RFC 2253 string representation of
+// a distinguished name with the spaces around its separators removed and
+// in lower case, so that names written by different implementations can be
+// compared.
+func normalizeDistinguishedName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(strings.TrimSpace(name), ",") {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			b.WriteString(strings.TrimSpace(part[:i]))
+			b.WriteByte('=')
+			b.WriteString(strings.TrimSpace(part[i+1:]))
+		} else {
+			b.WriteString(strings.TrimSpace(part))
+		}
+	}
+	return strings.ToLower(b.String())
+}
+
+// ResponseSignaturePolicy describes which of the Response and Assertion
+// elements of a response from the IDP must be signed. Every signature that
+// is present must be valid, whatever the policy.
+type ResponseSignaturePolicy int
+
+const (
+	// EitherSignatureSufficient accepts a response if either the Response
+	// or the Assertion is signed. It is the default.
+	EitherSignatureSufficient ResponseSignaturePolicy = iota
+
+	// RequireResponseSigned requires that the Response be signed. A
+	// response that arrives in a signed ArtifactResponse satisfies it.
+	RequireResponseSigned
+
+	// RequireAssertionSigned requires that the Assertion be signed.
+	RequireAssertionSigned
+
+	// RequireResponseAndAssertionSigned requires that both the Response
+	// and the Assertion be signed.
+	RequireResponseAndAssertionSigned
+)
+
+// check returns an error of kind ErrMissingSignature if the signatures of a
+// response do not satisfy the policy.
+func (p ResponseSignaturePolicy) check(responseSigned, assertionSigned bool) error {
+	switch p {
+	case RequireResponseSigned:
+		if !responseSigned {
+			return errorOfKind(ErrMissingSignature, "the Response must be signed")
+		}
+	case RequireAssertionSigned:
+		if !assertionSigned {
+			return errorOfKind(ErrMissingSignature, "the Assertion must be signed")
+		}
+	case RequireResponseAndAssertionSigned:
+		if !responseSigned || !assertionSigned {
+			return errorOfKind(ErrMissingSignature, "both the Response and Assertion must be signed")
+		}
+	default:
+		if !responseSigned && !assertionSigned {
+			return errorOfKind(ErrMissingSignature, "either the Response or Assertion must be signed")
+		}
+	}
+	return nil
+}
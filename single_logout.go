@@ -0,0 +1,809 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+)
+
+// logoutStateValidDuration is how long the IDP waits for a session
+// participant to return a LogoutResponse over a front-channel binding.
+const logoutStateValidDuration = 5 * time.Minute
+
+// SessionParticipant is a service provider that was issued an assertion
+// during a session of the IDP, and that must be notified when the session
+// ends.
+type SessionParticipant struct {
+	// ServiceProviderID is the entity ID of the service provider.
+	ServiceProviderID string
+
+	// NameID is the name identifier of the principal that was issued to the
+	// service provider.
+	NameID NameID
+
+	// SessionIndex is the session index that was issued to the service
+	// provider.
+	SessionIndex string
+
+	// ExpireTime is the time after which the session is no longer valid.
+	ExpireTime time.Time
+}
+
+// LogoutState records the progress of a logout that the IdentityProvider
+// propagates to the session participants using front-channel bindings,
+// while the user agent visits each participant in turn.
+type LogoutState struct {
+	// ServiceProviderID is the entity ID of the service provider that sent
+	// the LogoutRequest, or empty if the logout was initiated by the IDP.
+	ServiceProviderID string
+
+	// RequestID is the ID of the LogoutRequest, if any.
+	RequestID string
+
+	// Binding is the binding that the LogoutRequest was received with.
+	Binding string
+
+	// RelayState is the relay state that accompanied the LogoutRequest.
+	RelayState string
+
+	// RedirectURI is where the user agent is sent once a logout initiated
+	// by the IDP is complete.
+	RedirectURI string
+
+	// Asynchronous is set when the LogoutRequest carried the
+	// aslo:Asynchronous extension, so no LogoutResponse is returned.
+	Asynchronous bool
+
+	// Pending are the session participants that have not been logged out
+	// yet. If PendingRequestID is set, a LogoutRequest with that ID has
+	// been sent to the first of them.
+	Pending          []SessionParticipant
+	PendingRequestID string
+
+	// PartialLogout is set when at least one session participant could
+	// not be logged out.
+	PartialLogout bool
+
+	// ExpireTime is the time after which the logout can no longer be
+	// continued.
+	ExpireTime time.Time
+}
+
+// SingleLogoutStore is an interface used by IdentityProvider to keep the
+// progress of logouts that are propagated to the session participants using
+// front-channel bindings. The participants themselves are tracked in the
+// SessionStore. The default implementation is MemorySingleLogoutStore.
+type SingleLogoutStore interface {
+	// PutLogoutState stores state under id, which is sent to the session
+	// participants as the relay state.
+	PutLogoutState(id string, state *LogoutState) error
+
+	// TakeLogoutState returns the state stored under id and removes it from
+	// the store. If there is no such state, or it has expired, the returned
+	// error must be os.ErrNotExist.
+	TakeLogoutState(id string) (*LogoutState, error)
+}
+
+// MemorySingleLogoutStore is an implementation of SingleLogoutStore that
+// resides completely in memory. It is suitable for an IDP that runs as a
+// single process.
+//
+// TimeSource, if not nil, is the source of the current time used to expire
+// states. Otherwise the TimeSource of the IdentityProvider is used, or
+// TimeNow.
+type MemorySingleLogoutStore struct {
+	TimeSource TimeSource
+
+	mu     sync.Mutex
+	states map[string]*LogoutState
+}
+
+// PutLogoutState implements SingleLogoutStore. Expired states are discarded
+// as a side effect.
+func (s *MemorySingleLogoutStore) PutLogoutState(id string, state *LogoutState) error {
+	return s.putLogoutState(id, state, timeNow(s.TimeSource))
+}
+
+func (s *MemorySingleLogoutStore) putLogoutState(id string, state *LogoutState, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.states == nil {
+		s.states = map[string]*LogoutState{}
+	}
+
+	for k, v := range s.states {
+		if now.After(v.ExpireTime) {
+			delete(s.states, k)
+		}
+	}
+	s.states[id] = state
+	return nil
+}
+
+// TakeLogoutState implements SingleLogoutStore.
+func (s *MemorySingleLogoutStore) TakeLogoutState(id string) (*LogoutState, error) {
+	return s.takeLogoutState(id, timeNow(s.TimeSource))
+}
+
+func (s *MemorySingleLogoutStore) takeLogoutState(id string, now time.Time) (*LogoutState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[id]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	delete(s.states, id)
+	if now.After(state.ExpireTime) {
+		return nil, os.ErrNotExist
+	}
+	return state, nil
+}
+
+// memorySingleLogoutStoreView is a MemorySingleLogoutStore that expires
+// states using the TimeSource of the IdentityProvider that uses it.
+type memorySingleLogoutStoreView struct {
+	store      *MemorySingleLogoutStore
+	timeSource TimeSource
+}
+
+func (v memorySingleLogoutStoreView) PutLogoutState(id string, state *LogoutState) error {
+	return v.store.putLogoutState(id, state, timeNow(v.timeSource))
+}
+
+func (v memorySingleLogoutStoreView) TakeLogoutState(id string) (*LogoutState, error) {
+	return v.store.takeLogoutState(id, timeNow(v.timeSource))
+}
+
+// singleLogoutStore returns the SingleLogoutStore of the IDP. A
+// MemorySingleLogoutStore without a TimeSource of its own uses that of the
+// IDP.
+func (idp *IdentityProvider) singleLogoutStore() SingleLogoutStore {
+	if s, ok := idp.SingleLogoutStore.(*MemorySingleLogoutStore); ok && s.TimeSource == nil {
+		return memorySingleLogoutStoreView{store: s, timeSource: idp.TimeSource}
+	}
+	return idp.SingleLogoutStore
+}
+
+// addSessionParticipant records that the service provider of req was
+// issued an assertion during session, so that it is notified when the
+// session ends.
+func (idp *IdentityProvider) addSessionParticipant(req *IdpAuthnRequest, session *Session) {
+	if idp.SessionStore == nil {
+		if idp.SingleLogoutStore != nil {
+			idp.Logger.Printf("cannot record session participant %s: a SingleLogoutStore is configured without a SessionStore, so the logout of the session will not be propagated to it",
+				req.ServiceProviderMetadata.EntityID)
+		}
+		return
+	}
+	if req.Assertion == nil || req.Assertion.Subject == nil || req.Assertion.Subject.NameID == nil {
+		return
+	}
+
+	participant := SessionParticipant{
+		ServiceProviderID: req.ServiceProviderMetadata.EntityID,
+		NameID:            *req.Assertion.Subject.NameID,
+		ExpireTime:        session.ExpireTime,
+	}
+	if len(req.Assertion.AuthnStatements) > 0 {
+		participant.SessionIndex = req.Assertion.AuthnStatements[0].SessionIndex
+	}
+	if err := idp.addSessionServiceProvider(session, participant); err != nil {
+		idp.Logger.Printf("failed to record session participant %s: %s", participant.ServiceProviderID, err)
+	}
+}
+
+// ServeSLO handles the Single Logout endpoint of the IDP. Service providers
+// send signed LogoutRequests using the SOAP, HTTP-Redirect or HTTP-POST
+// binding. The IDP ends the session, if the SessionProvider implements
+// LogoutSessionProvider, and propagates the logout to the other session
+// participants recorded in the SessionStore.
+//
+// Participants with a SOAP SingleLogoutService are logged out over the back
+// channel. For requests received over a front-channel binding, the other
+// participants are visited in turn by the user agent and return their
+// LogoutResponses to this endpoint. Finally, a signed LogoutResponse is
+// returned to the requesting service provider. Its second-level status is
+// PartialLogout if any participant could not be logged out.
+//
+// If the LogoutRequest carries the aslo:Asynchronous extension, no
+// LogoutResponse is returned and the last front-channel participant is sent
+// an asynchronous LogoutRequest too, so the user agent remains with it.
+//
+// If the request is invalid or cannot be verified a simple StatusBadRequest
+// response is sent.
+func (idp *IdentityProvider) ServeSLO(w http.ResponseWriter, r *http.Request) {
+	binding, messageBuf, relayState, err := readSLOMessage(r)
+	if err != nil {
+		idp.Logger.Printf("cannot read logout message: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := xrv.Validate(bytes.NewReader(messageBuf)); err != nil {
+		idp.Logger.Printf("invalid logout message: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := idp.checkStructure(messageBuf); err != nil {
+		idp.Logger.Printf("invalid logout message: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(messageBuf); err != nil {
+		idp.Logger.Printf("invalid logout message: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	messageEl := doc.Root()
+	if binding == SOAPBinding {
+		messageEl = doc.FindElement("Envelope/Body/LogoutRequest")
+	}
+
+	switch {
+	case messageEl != nil && messageEl.Tag == "LogoutRequest":
+		idp.handleLogoutRequest(w, r, messageEl, binding, relayState)
+	case messageEl != nil && messageEl.Tag == "LogoutResponse" && binding != SOAPBinding:
+		idp.handleLogoutResponse(w, r, messageEl, relayState)
+	default:
+		idp.Logger.Printf("expected LogoutRequest or LogoutResponse")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	}
+}
+
+// ServeIDPInitiatedLogout ends the session with ID sessionID and propagates
+// the logout to the session participants, as ServeSLO does. Once all
+// participants have been visited, the user agent is redirected to
+// redirectURI. If redirectURI is empty, the last front-channel participant
+// is sent an asynchronous LogoutRequest and the user agent remains with it.
+func (idp *IdentityProvider) ServeIDPInitiatedLogout(w http.ResponseWriter, r *http.Request, sessionID string, redirectURI string) {
+	idp.startLogout(w, r, []string{sessionID}, &LogoutState{
+		Binding:     HTTPRedirectBinding,
+		RedirectURI: redirectURI,
+	})
+}
+
+// readSLOMessage returns the protocol message that was sent to the Single
+// Logout endpoint, the binding it was sent with and the relay state.
+func readSLOMessage(r *http.Request) (string, []byte, string, error) {
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		data := firstSet(query.Get("SAMLRequest"), query.Get("SAMLResponse"))
+		compressedMessage, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return "", nil, "", fmt.Errorf("cannot decode message: %s", err)
+		}
+		messageBuf, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressedMessage)))
+		if err != nil {
+			return "", nil, "", fmt.Errorf("cannot decompress message: %s", err)
+		}
+		return HTTPRedirectBinding, messageBuf, query.Get("RelayState"), nil
+
+	case "POST":
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+			if err := r.ParseForm(); err != nil {
+				return "", nil, "", err
+			}
+			data := firstSet(r.PostForm.Get("SAMLRequest"), r.PostForm.Get("SAMLResponse"))
+			messageBuf, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return "", nil, "", fmt.Errorf("cannot decode message: %s", err)
+			}
+			return HTTPPostBinding, messageBuf, r.PostForm.Get("RelayState"), nil
+		}
+		messageBuf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "", nil, "", err
+		}
+		return SOAPBinding, messageBuf, "", nil
+
+	default:
+		return "", nil, "", fmt.Errorf("method %s not allowed", r.Method)
+	}
+}
+
+// handleLogoutRequest handles a LogoutRequest sent by a service provider.
+func (idp *IdentityProvider) handleLogoutRequest(w http.ResponseWriter, r *http.Request, requestEl *etree.Element, binding string, relayState string) {
+	req, err := idp.parseLogoutRequest(r, requestEl)
+	if err != nil {
+		idp.Logger.Printf("invalid LogoutRequest: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if req.IsAsynchronous() && binding == SOAPBinding {
+		idp.Logger.Printf("invalid LogoutRequest: asynchronous logout is not allowed with the SOAP binding")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// A request without a SessionIndex applies to any session of the
+	// principal, otherwise it applies to the session of each index.
+	sessionIndexes := []string{""}
+	if len(req.SessionIndexes) > 0 {
+		sessionIndexes = nil
+		for _, sessionIndex := range req.SessionIndexes {
+			sessionIndexes = append(sessionIndexes, sessionIndex.Value)
+		}
+	}
+	var sessionIDs []string
+	for _, sessionIndex := range sessionIndexes {
+		sessionID, err := idp.findSession(req.Issuer.Value, req.NameID.Value, sessionIndex)
+		if err == os.ErrNotExist {
+			continue
+		} else if err != nil {
+			idp.Logger.Printf("cannot find session: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+
+	idp.startLogout(w, r, sessionIDs, &LogoutState{
+		ServiceProviderID: req.Issuer.Value,
+		RequestID:         req.ID,
+		Binding:           binding,
+		RelayState:        relayState,
+		Asynchronous:      req.IsAsynchronous(),
+	})
+}
+
+// parseLogoutRequest validates the LogoutRequest in requestEl, including
+// the signature of the service provider that sent it.
+func (idp *IdentityProvider) parseLogoutRequest(r *http.Request, requestEl *etree.Element) (*LogoutRequest, error) {
+	req := &LogoutRequest{}
+	if err := unmarshalEtreeHack(requestEl.Copy(), req); err != nil {
+		return nil, err
+	}
+	if req.Version != "2.0" {
+		return nil, fmt.Errorf("expected SAML request version 2.0 got %v", req.Version)
+	}
+	if req.IssueInstant.Add(MaxIssueDelay).Before(idp.now()) {
+		return nil, fmt.Errorf("request expired at %s", req.IssueInstant.Add(MaxIssueDelay))
+	}
+	if req.NotOnOrAfter != nil && !idp.now().Before(*req.NotOnOrAfter) {
+		return nil, fmt.Errorf("request expired at %s", req.NotOnOrAfter)
+	}
+	if req.Destination != "" && req.Destination != idp.LogoutURL.String() {
+		return nil, fmt.Errorf("expected destination to be %q, not %q", idp.LogoutURL.String(), req.Destination)
+	}
+	if req.Issuer == nil {
+		return nil, fmt.Errorf("request has no Issuer")
+	}
+
+	serviceProvider, err := idp.ServiceProviderProvider.GetServiceProvider(r, req.Issuer.Value)
+	if err == os.ErrNotExist {
+		return nil, fmt.Errorf("cannot handle request from unknown service provider %s", req.Issuer.Value)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot find service provider %s: %v", req.Issuer.Value, err)
+	}
+	if err := idp.validateSPMessageSignature(r, requestEl, serviceProvider); err != nil {
+		return nil, fmt.Errorf("cannot validate signature on LogoutRequest: %v", err)
+	}
+
+	if req.EncryptedID != nil {
+		req.NameID, err = decryptNameID([]crypto.PrivateKey{idp.Key}, requestEl.FindElement("./EncryptedID"))
+		if err != nil {
+			return nil, err
+		}
+		req.EncryptedID = nil
+	}
+	if req.NameID == nil {
+		return nil, fmt.Errorf("request has no NameID")
+	}
+	return req, nil
+}
+
+// startLogout ends the sessions with IDs sessionIDs, logs out the session
+// participants that have a SOAP SingleLogoutService and, for front-channel
+// logouts, queues the remaining participants in state.
+func (idp *IdentityProvider) startLogout(w http.ResponseWriter, r *http.Request, sessionIDs []string, state *LogoutState) {
+	var participants []SessionParticipant
+	for _, sessionID := range sessionIDs {
+		if sessionProvider, ok := idp.SessionProvider.(LogoutSessionProvider); ok {
+			if err := sessionProvider.DeleteSession(w, r, sessionID); err != nil {
+				idp.Logger.Printf("failed to delete session: %s", err)
+				state.PartialLogout = true
+			}
+		}
+
+		sessionParticipants, err := idp.takeSessionParticipants(sessionID)
+		if err != nil {
+			idp.Logger.Printf("cannot find session participants: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		participants = append(participants, sessionParticipants...)
+	}
+
+	for _, participant := range participants {
+		if participant.ServiceProviderID == state.ServiceProviderID {
+			continue
+		}
+		serviceProvider, err := idp.ServiceProviderProvider.GetServiceProvider(r, participant.ServiceProviderID)
+		if err != nil {
+			idp.Logger.Printf("cannot find service provider %s: %v", participant.ServiceProviderID, err)
+			state.PartialLogout = true
+			continue
+		}
+
+		if endpoint := sloEndpoint(serviceProvider, SOAPBinding); endpoint != nil {
+			if err := idp.sendLogoutRequestSOAP(r.Context(), participant, serviceProvider, endpoint.Location); err != nil {
+				idp.Logger.Printf("failed to log out of %s: %s", participant.ServiceProviderID, err)
+				state.PartialLogout = true
+			}
+			continue
+		}
+		if state.Binding != SOAPBinding && sloEndpoint(serviceProvider, HTTPRedirectBinding, HTTPPostBinding) != nil {
+			state.Pending = append(state.Pending, participant)
+			continue
+		}
+		idp.Logger.Printf("service provider %s has no usable SingleLogoutService", participant.ServiceProviderID)
+		state.PartialLogout = true
+	}
+
+	idp.continueLogout(w, r, state)
+}
+
+// continueLogout sends the user agent to the next pending session
+// participant, or finishes the logout if there are none left.
+func (idp *IdentityProvider) continueLogout(w http.ResponseWriter, r *http.Request, state *LogoutState) {
+	for len(state.Pending) > 0 {
+		participant := state.Pending[0]
+		if err := idp.sendLogoutRequestFrontChannel(w, r, participant, state); err != nil {
+			idp.Logger.Printf("failed to log out of %s: %s", participant.ServiceProviderID, err)
+			state.PartialLogout = true
+			state.Pending = state.Pending[1:]
+			continue
+		}
+		return
+	}
+	idp.finishLogout(w, r, state)
+}
+
+// sendLogoutRequestFrontChannel sends the user agent to participant with a
+// LogoutRequest. The state of the logout is stored under the relay state,
+// which the participant returns along with its LogoutResponse.
+func (idp *IdentityProvider) sendLogoutRequestFrontChannel(w http.ResponseWriter, r *http.Request, participant SessionParticipant, state *LogoutState) error {
+	serviceProvider, err := idp.ServiceProviderProvider.GetServiceProvider(r, participant.ServiceProviderID)
+	if err != nil {
+		return err
+	}
+	endpoint := sloEndpoint(serviceProvider, HTTPRedirectBinding, HTTPPostBinding)
+	if endpoint == nil {
+		return fmt.Errorf("service provider has no front-channel SingleLogoutService")
+	}
+
+	// When nobody waits for the outcome of the logout, the last participant
+	// is asked not to respond and the user agent stays with it.
+	if len(state.Pending) == 1 && !state.wantsResult() {
+		req, err := idp.makeLogoutRequest(participant, serviceProvider, endpoint.Location, true)
+		if err != nil {
+			return err
+		}
+		return idp.writeFrontChannelLogoutRequest(w, r, req, endpoint.Binding, "")
+	}
+
+	req, err := idp.makeLogoutRequest(participant, serviceProvider, endpoint.Location, false)
+	if err != nil {
+		return err
+	}
+
+	if idp.SingleLogoutStore == nil {
+		return fmt.Errorf("no SingleLogoutStore is configured to keep the state of the logout")
+	}
+	stateID := fmt.Sprintf("%x", idp.randomBytes(20))
+	state.PendingRequestID = req.ID
+	state.ExpireTime = idp.now().Add(logoutStateValidDuration)
+	if err := idp.singleLogoutStore().PutLogoutState(stateID, state); err != nil {
+		return err
+	}
+	return idp.writeFrontChannelLogoutRequest(w, r, req, endpoint.Binding, stateID)
+}
+
+// writeFrontChannelLogoutRequest sends the user agent to the destination of
+// req using binding, which is either HTTP-Redirect or HTTP-POST.
+func (idp *IdentityProvider) writeFrontChannelLogoutRequest(w http.ResponseWriter, r *http.Request, req *LogoutRequest, binding string, relayState string) error {
+	if binding == HTTPRedirectBinding {
+		// the binding carries the signature in the query instead
+		unsignedReq := *req
+		unsignedReq.Signature = nil
+		location, err := idp.redirectURL(req.Destination, "SAMLRequest", unsignedReq.Element(), relayState)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r, location.String(), http.StatusFound)
+		return nil
+	}
+	if idp.PostForm != nil {
+		return idp.PostForm.Write(w, req.PostFormData(relayState))
+	}
+	w.Header().Set("Content-Type", "text/html")
+	_, err := w.Write(req.Post(relayState))
+	return err
+}
+
+// wantsResult returns true if the logout ends by returning a LogoutResponse
+// or by redirecting the user agent, rather than leaving the user agent with
+// the last session participant.
+func (state *LogoutState) wantsResult() bool {
+	if state.ServiceProviderID == "" {
+		return state.RedirectURI != ""
+	}
+	return !state.Asynchronous
+}
+
+// handleLogoutResponse handles a LogoutResponse that a session participant
+// returned over a front-channel binding, and continues the logout.
+func (idp *IdentityProvider) handleLogoutResponse(w http.ResponseWriter, r *http.Request, responseEl *etree.Element, relayState string) {
+	if idp.SingleLogoutStore == nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	state, err := idp.singleLogoutStore().TakeLogoutState(relayState)
+	if err != nil || len(state.Pending) == 0 {
+		idp.Logger.Printf("cannot find logout state %q: %v", relayState, err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	participant := state.Pending[0]
+	state.Pending = state.Pending[1:]
+	serviceProvider, err := idp.ServiceProviderProvider.GetServiceProvider(r, participant.ServiceProviderID)
+	if err == nil {
+		err = idp.validateLogoutResponse(r, responseEl, state.PendingRequestID, serviceProvider)
+	}
+	if err != nil {
+		idp.Logger.Printf("failed to log out of %s: %s", participant.ServiceProviderID, err)
+		state.PartialLogout = true
+	}
+	state.PendingRequestID = ""
+
+	idp.continueLogout(w, r, state)
+}
+
+// finishLogout returns the final LogoutResponse to the service provider that
+// requested the logout, or redirects the user agent to state.RedirectURI if
+// the logout was initiated by the IDP. If neither is wanted, a short
+// confirmation is shown instead.
+func (idp *IdentityProvider) finishLogout(w http.ResponseWriter, r *http.Request, state *LogoutState) {
+	if !state.wantsResult() {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = fmt.Fprintln(w, "You have been logged out.")
+		return
+	}
+	if state.ServiceProviderID == "" {
+		http.Redirect(w, r, state.RedirectURI, http.StatusFound)
+		return
+	}
+
+	status := Status{StatusCode: StatusCode{Value: StatusSuccess}}
+	if state.PartialLogout {
+		status.StatusCode.StatusCode = &StatusCode{Value: StatusPartialLogout}
+	}
+
+	if state.Binding == SOAPBinding {
+		resp, err := idp.makeLogoutResponse(state.RequestID, "", status)
+		if err != nil {
+			idp.Logger.Printf("failed to make response: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		doc := etree.NewDocument()
+		doc.SetRoot(soapEnvelope(resp.Element()))
+		w.Header().Set("Content-Type", "text/xml")
+		if _, err := doc.WriteTo(w); err != nil {
+			idp.Logger.Printf("failed to write response: %s", err)
+		}
+		return
+	}
+
+	serviceProvider, err := idp.ServiceProviderProvider.GetServiceProvider(r, state.ServiceProviderID)
+	if err != nil {
+		idp.Logger.Printf("cannot find service provider %s: %v", state.ServiceProviderID, err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	bindings := []string{HTTPRedirectBinding, HTTPPostBinding}
+	if state.Binding == HTTPPostBinding {
+		bindings = []string{HTTPPostBinding, HTTPRedirectBinding}
+	}
+	endpoint := sloEndpoint(serviceProvider, bindings...)
+	if endpoint == nil {
+		idp.Logger.Printf("service provider %s has no front-channel SingleLogoutService", state.ServiceProviderID)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	resp, err := idp.makeLogoutResponse(state.RequestID, firstSet(endpoint.ResponseLocation, endpoint.Location), status)
+	if err != nil {
+		idp.Logger.Printf("failed to make response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if endpoint.Binding == HTTPRedirectBinding {
+		// the binding carries the signature in the query instead
+		resp.Signature = nil
+		location, err := idp.redirectURL(resp.Destination, "SAMLResponse", resp.Element(), state.RelayState)
+		if err != nil {
+			idp.Logger.Printf("failed to make response: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, location.String(), http.StatusFound)
+		return
+	}
+	if idp.PostForm != nil {
+		if err := idp.PostForm.Write(w, resp.PostFormData(state.RelayState)); err != nil {
+			idp.Logger.Printf("failed to write response: %s", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if _, err := w.Write(resp.Post(state.RelayState)); err != nil {
+		idp.Logger.Printf("failed to write response: %s", err)
+	}
+}
+
+// sendLogoutRequestSOAP logs participant out over the back channel using the
+// SOAP SingleLogoutService at location.
+func (idp *IdentityProvider) sendLogoutRequestSOAP(ctx context.Context, participant SessionParticipant, serviceProvider *EntityDescriptor, location string) error {
+	req, err := idp.makeLogoutRequest(participant, serviceProvider, location, false)
+	if err != nil {
+		return err
+	}
+	responseBuf, err := postSOAPEnvelope(ctx, idp.HTTPClient, location, req.SoapRequest())
+	if err != nil {
+		return err
+	}
+
+	if err := xrv.Validate(bytes.NewReader(responseBuf)); err != nil {
+		return err
+	}
+	if err := idp.checkStructure(responseBuf); err != nil {
+		return err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(responseBuf); err != nil {
+		return err
+	}
+	responseEl := doc.FindElement("Envelope/Body/LogoutResponse")
+	if responseEl == nil {
+		return errors.New("missing LogoutResponse")
+	}
+	return idp.validateLogoutResponse(nil, responseEl, req.ID, serviceProvider)
+}
+
+// validateLogoutResponse returns nil iff responseEl is a successful
+// LogoutResponse to the request with ID requestID, signed by serviceProvider.
+// r is the request that the response was received in, or nil if it was
+// received over the back channel.
+func (idp *IdentityProvider) validateLogoutResponse(r *http.Request, responseEl *etree.Element, requestID string, serviceProvider *EntityDescriptor) error {
+	resp := &LogoutResponse{}
+	if err := unmarshalEtreeHack(responseEl.Copy(), resp); err != nil {
+		return err
+	}
+	if resp.InResponseTo != requestID {
+		return fmt.Errorf("`InResponseTo` does not match the request ID (expected %v)", requestID)
+	}
+	if resp.IssueInstant.Add(MaxIssueDelay).Before(idp.now()) {
+		return fmt.Errorf("response IssueInstant expired at %s", resp.IssueInstant.Add(MaxIssueDelay))
+	}
+	if resp.Issuer == nil || resp.Issuer.Value != serviceProvider.EntityID {
+		return fmt.Errorf("response Issuer does not match the service provider (expected %q)", serviceProvider.EntityID)
+	}
+	if err := idp.validateSPMessageSignature(r, responseEl, serviceProvider); err != nil {
+		return fmt.Errorf("cannot validate signature on LogoutResponse: %v", err)
+	}
+	if resp.Status.StatusCode.Value != StatusSuccess {
+		return newErrBadStatus(resp.Status)
+	}
+	return nil
+}
+
+// makeLogoutRequest returns a signed LogoutRequest for participant, whose
+// metadata is serviceProvider. If asynchronous is true the request carries
+// the aslo:Asynchronous extension.
+func (idp *IdentityProvider) makeLogoutRequest(participant SessionParticipant, serviceProvider *EntityDescriptor, destination string, asynchronous bool) (*LogoutRequest, error) {
+	nameID := participant.NameID
+	req := &LogoutRequest{
+		ID:           fmt.Sprintf("id-%x", idp.randomBytes(20)),
+		Version:      "2.0",
+		IssueInstant: idp.now(),
+		Destination:  destination,
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL.String(),
+		},
+		NameID: &nameID,
+	}
+	if participant.SessionIndex != "" {
+		req.SessionIndexes = []SessionIndex{{Value: participant.SessionIndex}}
+	}
+	if asynchronous {
+		req.Extensions = &Extensions{Asynchronous: &Asynchronous{}}
+	}
+
+	// encrypt the NameID if the service provider can decrypt it, as we do
+	// for assertions
+	cert, err := spEncryptionCert(serviceProvider)
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	if cert != nil {
+		if err := req.EncryptNameID(cert); err != nil {
+			return nil, err
+		}
+	}
+
+	signingContext, err := idp.signingContext()
+	if err != nil {
+		return nil, err
+	}
+	signedRequestEl, err := signingContext.SignEnveloped(req.Element())
+	if err != nil {
+		return nil, err
+	}
+	sigEl := signedRequestEl.Child[len(signedRequestEl.Child)-1]
+	req.Signature = sigEl.(*etree.Element)
+	return req, nil
+}
+
+// makeLogoutResponse returns a signed LogoutResponse to the request with ID
+// requestID.
+func (idp *IdentityProvider) makeLogoutResponse(requestID string, destination string, status Status) (*LogoutResponse, error) {
+	resp := &LogoutResponse{
+		ID:           fmt.Sprintf("id-%x", idp.randomBytes(20)),
+		InResponseTo: requestID,
+		Version:      "2.0",
+		IssueInstant: idp.now(),
+		Destination:  destination,
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  idp.MetadataURL.String(),
+		},
+		Status: status,
+	}
+
+	signingContext, err := idp.signingContext()
+	if err != nil {
+		return nil, err
+	}
+	signedResponseEl, err := signingContext.SignEnveloped(resp.Element())
+	if err != nil {
+		return nil, err
+	}
+	sigEl := signedResponseEl.Child[len(signedResponseEl.Child)-1]
+	resp.Signature = sigEl.(*etree.Element)
+	return resp, nil
+}
+
+// sloEndpoint returns the first SingleLogoutService of serviceProvider that
+// uses one of bindings, in order of preference, or nil if there is none.
+func sloEndpoint(serviceProvider *EntityDescriptor, bindings ...string) *Endpoint {
+	for _, binding := range bindings {
+		for _, spssoDescriptor := range serviceProvider.SPSSODescriptors {
+			for _, endpoint := range spssoDescriptor.SingleLogoutServices {
+				if endpoint.Binding == binding {
+					endpoint := endpoint
+					return &endpoint
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type mockLogoutSessionProvider struct {
+	mockSessionProvider
+	DeletedSessionIDs []string
+}
+
+func (m *mockLogoutSessionProvider) DeleteSession(w http.ResponseWriter, r *http.Request, sessionID string) error {
+	m.DeletedSessionIDs = append(m.DeletedSessionIDs, sessionID)
+	return nil
+}
+
+type SingleLogoutTest struct {
+	*IdentityProviderTest
+	Store           *MemorySingleLogoutStore
+	Sessions        *MemorySessionStore
+	SessionProvider *mockLogoutSessionProvider
+	BackChannelSP   ServiceProvider
+	FrontChannelSP  ServiceProvider
+	BackChannelHits int
+}
+
+// NewSingleLogoutTest returns an IDP whose session "session-1" has three
+// participants: test.SP, which logs out using the HTTP-Redirect binding, a
+// service provider that logs out over the back channel using SOAP, and one
+// that logs out using the HTTP-Redirect binding.
+func NewSingleLogoutTest(t *testing.T) *SingleLogoutTest {
+	test := &SingleLogoutTest{IdentityProviderTest: NewIdentifyProviderTest(t)}
+	// the test certificates have expired, so validate signatures as of when they were valid
+	Clock = dsig.NewFakeClockAt(test.IDP.Certificate.NotBefore)
+
+	test.Store = &MemorySingleLogoutStore{}
+	test.Sessions = &MemorySessionStore{}
+	test.SessionProvider = &mockLogoutSessionProvider{}
+	test.IDP.LogoutURL = mustParseURL("https://idp.example.com/saml/slo")
+	test.IDP.SingleLogoutStore = test.Store
+	test.IDP.SessionStore = test.Sessions
+	test.IDP.SessionProvider = test.SessionProvider
+
+	test.SP.SloURL = mustParseURL("https://sp.example.com/saml2/slo")
+	test.SP.LogoutBindings = []string{HTTPRedirectBinding}
+	test.SP.SignatureMethod = dsig.RSASHA256SignatureMethod
+	test.SP.IDPMetadata = test.IDP.Metadata()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.BackChannelHits++
+		doc := etree.NewDocument()
+		_, err := doc.ReadFrom(r.Body)
+		assert.Check(t, err)
+		requestEl := doc.FindElement("./Envelope/Body/LogoutRequest")
+		req := LogoutRequest{}
+		assert.Check(t, unmarshalEtreeHack(requestEl, &req))
+		assert.Check(t, is.Nil(req.NameID))
+		assert.Check(t, is.Equal("index-2", req.SessionIndexes[0].Value))
+
+		// the IDP encrypts the NameID because the SP metadata has an encryption key
+		nameID, err := decryptNameID([]crypto.PrivateKey{test.SPKey}, requestEl.FindElement("./EncryptedID"))
+		assert.Check(t, err)
+		assert.Check(t, is.Equal("bob", nameID.Value))
+
+		resp, err := test.BackChannelSP.MakeLogoutResponse("", req.ID)
+		assert.Check(t, err)
+		_, _ = w.Write(soapEnvelopeBytes(t, resp.Element()))
+	}))
+	t.Cleanup(server.Close)
+
+	test.BackChannelSP = test.SP
+	test.BackChannelSP.MetadataURL = mustParseURL("https://backchannel.example.com/saml2/metadata")
+	test.BackChannelSP.SloURL = mustParseURL(server.URL)
+	test.BackChannelSP.LogoutBindings = []string{SOAPBinding}
+
+	test.FrontChannelSP = test.SP
+	test.FrontChannelSP.MetadataURL = mustParseURL("https://frontchannel.example.com/saml2/metadata")
+	test.FrontChannelSP.SloURL = mustParseURL("https://frontchannel.example.com/saml2/slo")
+
+	test.IDP.ServiceProviderProvider = &mockServiceProviderProvider{
+		GetServiceProviderFunc: func(r *http.Request, serviceProviderID string) (*EntityDescriptor, error) {
+			for _, sp := range []ServiceProvider{test.SP, test.BackChannelSP, test.FrontChannelSP} {
+				if serviceProviderID == sp.MetadataURL.String() {
+					return sp.Metadata(), nil
+				}
+			}
+			return nil, os.ErrNotExist
+		},
+	}
+
+	for _, participant := range []SessionParticipant{
+		{ServiceProviderID: test.SP.MetadataURL.String(), NameID: NameID{Value: "alice"}, SessionIndex: "index-1"},
+		{ServiceProviderID: test.BackChannelSP.MetadataURL.String(), NameID: NameID{Value: "bob"}, SessionIndex: "index-2"},
+		{ServiceProviderID: test.FrontChannelSP.MetadataURL.String(), NameID: NameID{Value: "carol"}, SessionIndex: "index-3"},
+	} {
+		participant.ExpireTime = TimeNow().Add(time.Hour)
+		test.addSessionParticipant(t, "session-1", participant)
+	}
+	return test
+}
+
+// addSessionParticipant records participant in the session with ID
+// sessionID, creating the session if it is not stored yet.
+func (test *SingleLogoutTest) addSessionParticipant(t *testing.T, sessionID string, participant SessionParticipant) {
+	if _, err := test.Sessions.Get(sessionID); err == os.ErrNotExist {
+		assert.Check(t, test.Sessions.Create(&Session{ID: sessionID, ExpireTime: participant.ExpireTime}))
+	}
+	assert.Check(t, test.Sessions.AddServiceProvider(sessionID, participant))
+}
+
+func decodeRedirectLogoutResponse(t *testing.T, location *url.URL) *LogoutResponse {
+	compressedResponse, err := base64.StdEncoding.DecodeString(location.Query().Get("SAMLResponse"))
+	assert.Check(t, err)
+	responseBuf, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressedResponse)))
+	assert.Check(t, err)
+	resp := &LogoutResponse{}
+	assert.Check(t, xml.Unmarshal(responseBuf, resp))
+	return resp
+}
+
+func TestIDPCanPropagateLogout(t *testing.T) {
+	test := NewSingleLogoutTest(t)
+
+	// test.SP starts the logout
+	logoutRequest, err := test.SP.MakeLogoutRequest(test.IDP.LogoutURL.String(), "alice")
+	assert.Check(t, err)
+	redirectURL := logoutRequest.Redirect("ThisIsTheRelayState")
+	w := httptest.NewRecorder()
+	test.IDP.Handler().ServeHTTP(w, httptest.NewRequest("GET", redirectURL.String(), nil))
+	assert.Check(t, is.Equal(http.StatusFound, w.Code))
+	assert.Check(t, is.Equal(1, test.BackChannelHits))
+	assert.Check(t, is.DeepEqual([]string{"session-1"}, test.SessionProvider.DeletedSessionIDs))
+
+	// the user agent visits the front-channel participant
+	location := w.Header().Get("Location")
+	frontChannelRequest, err := test.FrontChannelSP.ValidateLogoutRequestRequest(httptest.NewRequest("GET", location, nil))
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("carol", frontChannelRequest.NameID.Value))
+	assert.Check(t, is.Equal("index-3", frontChannelRequest.SessionIndexes[0].Value))
+
+	locationURL, err := url.Parse(location)
+	assert.Check(t, err)
+	relayState := locationURL.Query().Get("RelayState")
+	redirectURL, err = test.FrontChannelSP.MakeRedirectLogoutResponse(frontChannelRequest.ID, relayState)
+	assert.Check(t, err)
+	w = httptest.NewRecorder()
+	test.IDP.Handler().ServeHTTP(w, httptest.NewRequest("GET", redirectURL.String(), nil))
+	assert.Check(t, is.Equal(http.StatusFound, w.Code))
+
+	// and finally returns to test.SP
+	finalURL, err := url.Parse(w.Header().Get("Location"))
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("https://sp.example.com/saml2/slo", finalURL.Scheme+"://"+finalURL.Host+finalURL.Path))
+	assert.Check(t, is.Equal("ThisIsTheRelayState", finalURL.Query().Get("RelayState")))
+	resp := decodeRedirectLogoutResponse(t, finalURL)
+	assert.Check(t, is.Equal(logoutRequest.ID, resp.InResponseTo))
+	assert.Check(t, is.Equal(StatusSuccess, resp.Status.StatusCode.Value))
+	assert.Check(t, is.Nil(resp.Status.StatusCode.StatusCode))
+	assert.Check(t, is.Nil(resp.Signature))
+	assert.Check(t, test.SP.ValidateLogoutResponseRequest(httptest.NewRequest("GET", finalURL.String(), nil)))
+
+	// the signature covers the relay state
+	tamperedQuery := finalURL.Query()
+	tamperedQuery.Set("RelayState", "SomeOtherRelayState")
+	tamperedURL := *finalURL
+	tamperedURL.RawQuery = tamperedQuery.Encode()
+	assert.Check(t, is.ErrorContains(test.SP.ValidateLogoutResponseRequest(httptest.NewRequest("GET", tamperedURL.String(), nil)),
+		"cannot validate signature on LogoutResponse"))
+
+	_, err = test.Sessions.FindSession(test.SP.MetadataURL.String(), "alice", "")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+
+	// the relay state cannot be used twice
+	w = httptest.NewRecorder()
+	test.IDP.Handler().ServeHTTP(w, httptest.NewRequest("GET", redirectURL.String(), nil))
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+}
+
+func TestIDPReportsPartialLogout(t *testing.T) {
+	test := NewSingleLogoutTest(t)
+
+	// the front-channel participant cannot be reached over SOAP
+	req, err := test.SP.MakeLogoutRequest(test.IDP.LogoutURL.String(), "alice")
+	assert.Check(t, err)
+	w := httptest.NewRecorder()
+	test.IDP.Handler().ServeHTTP(w, httptest.NewRequest("POST", test.IDP.LogoutURL.String(),
+		bytes.NewReader(soapEnvelopeBytes(t, req.Element()))))
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Equal(1, test.BackChannelHits))
+
+	envelope := struct {
+		Body struct {
+			LogoutResponse LogoutResponse
+		}
+	}{}
+	assert.Check(t, xml.Unmarshal(w.Body.Bytes(), &envelope))
+	resp := envelope.Body.LogoutResponse
+	assert.Check(t, is.Equal(req.ID, resp.InResponseTo))
+	assert.Check(t, is.Equal(StatusSuccess, resp.Status.StatusCode.Value))
+	assert.Check(t, is.Equal(StatusPartialLogout, resp.Status.StatusCode.StatusCode.Value))
+}
+
+func TestIDPLogsOutSessionsOfEachSessionIndex(t *testing.T) {
+	test := NewSingleLogoutTest(t)
+	test.addSessionParticipant(t, "session-2", SessionParticipant{
+		ServiceProviderID: test.SP.MetadataURL.String(),
+		NameID:            NameID{Value: "alice"},
+		SessionIndex:      "index-4",
+		ExpireTime:        TimeNow().Add(time.Hour),
+	})
+	test.addSessionParticipant(t, "session-3", SessionParticipant{
+		ServiceProviderID: test.SP.MetadataURL.String(),
+		NameID:            NameID{Value: "alice"},
+		SessionIndex:      "index-5",
+		ExpireTime:        TimeNow().Add(time.Hour),
+	})
+
+	req, err := test.SP.MakeLogoutRequest(test.IDP.LogoutURL.String(), "alice")
+	assert.Check(t, err)
+	req.SessionIndexes = []SessionIndex{{Value: "index-4"}, {Value: "index-5"}}
+	req.Signature = nil
+	assert.Check(t, test.SP.SignLogoutRequest(req))
+	w := httptest.NewRecorder()
+	test.IDP.Handler().ServeHTTP(w, httptest.NewRequest("POST", test.IDP.LogoutURL.String(),
+		bytes.NewReader(soapEnvelopeBytes(t, req.Element()))))
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.DeepEqual([]string{"session-2", "session-3"}, test.SessionProvider.DeletedSessionIDs))
+	assert.Check(t, is.Equal(0, test.BackChannelHits))
+
+	// session-1 is left alone
+	sessionID, err := test.Sessions.FindSession(test.SP.MetadataURL.String(), "alice", "index-1")
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("session-1", sessionID))
+}
+
+func TestIDPCanDecryptLogoutRequestNameID(t *testing.T) {
+	test := NewSingleLogoutTest(t)
+	test.Sessions.Delete("session-1")
+	test.addSessionParticipant(t, "session-2", SessionParticipant{
+		ServiceProviderID: test.SP.MetadataURL.String(),
+		NameID:            NameID{Value: "alice"},
+		SessionIndex:      "index-1",
+		ExpireTime:        TimeNow().Add(time.Hour),
+	})
+
+	req, err := test.SP.MakeLogoutRequest(test.IDP.LogoutURL.String(), "alice")
+	assert.Check(t, err)
+	assert.Check(t, req.EncryptNameID(test.IDP.Certificate))
+	req.Signature = nil
+	assert.Check(t, test.SP.SignLogoutRequest(req))
+	w := httptest.NewRecorder()
+	test.IDP.Handler().ServeHTTP(w, httptest.NewRequest("POST", test.IDP.LogoutURL.String(),
+		bytes.NewReader(soapEnvelopeBytes(t, req.Element()))))
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.DeepEqual([]string{"session-2"}, test.SessionProvider.DeletedSessionIDs))
+}
+
+func TestIDPRejectsExpiredLogoutRequest(t *testing.T) {
+	test := NewSingleLogoutTest(t)
+
+	req, err := test.SP.MakeLogoutRequest(test.IDP.LogoutURL.String(), "alice")
+	assert.Check(t, err)
+	notOnOrAfter := TimeNow()
+	req.NotOnOrAfter = &notOnOrAfter
+	req.Signature = nil
+	assert.Check(t, test.SP.SignLogoutRequest(req))
+	w := httptest.NewRecorder()
+	test.IDP.Handler().ServeHTTP(w, httptest.NewRequest("GET", req.Redirect("").String(), nil))
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	assert.Check(t, is.Len(test.SessionProvider.DeletedSessionIDs, 0))
+}
+
+func TestIDPHonorsAsynchronousLogoutRequest(t *testing.T) {
+	test := NewSingleLogoutTest(t)
+	test.SP.AsynchronousLogout = true
+
+	redirectURL, err := test.SP.MakeRedirectLogoutRequest("alice", "ThisIsTheRelayState")
+	assert.Check(t, err)
+	w := httptest.NewRecorder()
+	test.IDP.Handler().ServeHTTP(w, httptest.NewRequest("GET", redirectURL.String(), nil))
+	assert.Check(t, is.Equal(http.StatusFound, w.Code))
+	assert.Check(t, is.Equal(1, test.BackChannelHits))
+	assert.Check(t, is.DeepEqual([]string{"session-1"}, test.SessionProvider.DeletedSessionIDs))
+
+	// nobody waits for the result, so the last participant is not asked to respond
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("frontchannel.example.com", location.Host))
+	assert.Check(t, is.Equal("", location.Query().Get("RelayState")))
+	frontChannelRequest, err := test.FrontChannelSP.ValidateLogoutRequestRequest(httptest.NewRequest("GET", location.String(), nil))
+	assert.Check(t, err)
+	assert.Check(t, is.Equal("carol", frontChannelRequest.NameID.Value))
+	assert.Check(t, frontChannelRequest.IsAsynchronous())
+}
+
+func TestIDPRejectsAsynchronousLogoutRequestOverSOAP(t *testing.T) {
+	test := NewSingleLogoutTest(t)
+	test.SP.AsynchronousLogout = true
+
+	req, err := test.SP.MakeLogoutRequest(test.IDP.LogoutURL.String(), "alice")
+	assert.Check(t, err)
+	assert.Check(t, req.IsAsynchronous())
+	w := httptest.NewRecorder()
+	test.IDP.Handler().ServeHTTP(w, httptest.NewRequest("POST", test.IDP.LogoutURL.String(),
+		bytes.NewReader(soapEnvelopeBytes(t, req.Element()))))
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	assert.Check(t, is.Len(test.SessionProvider.DeletedSessionIDs, 0))
+}
+
+func TestIDPRejectsUnsignedLogoutRequest(t *testing.T) {
+	test := NewSingleLogoutTest(t)
+	test.SP.SignatureMethod = ""
+
+	redirectURL, err := test.SP.MakeRedirectLogoutRequest("alice", "")
+	assert.Check(t, err)
+	w := httptest.NewRecorder()
+	test.IDP.Handler().ServeHTTP(w, httptest.NewRequest("GET", redirectURL.String(), nil))
+	assert.Check(t, is.Equal(http.StatusBadRequest, w.Code))
+	assert.Check(t, is.Equal(0, test.BackChannelHits))
+	assert.Check(t, is.Len(test.SessionProvider.DeletedSessionIDs, 0))
+}
+
+func TestIDPCanInitiateLogout(t *testing.T) {
+	test := NewSingleLogoutTest(t)
+	test.Sessions.Delete("session-1")
+	test.addSessionParticipant(t, "session-2", SessionParticipant{
+		ServiceProviderID: test.BackChannelSP.MetadataURL.String(),
+		NameID:            NameID{Value: "bob"},
+		SessionIndex:      "index-2",
+		ExpireTime:        TimeNow().Add(time.Hour),
+	})
+
+	w := httptest.NewRecorder()
+	test.IDP.ServeIDPInitiatedLogout(w, httptest.NewRequest("GET", "https://idp.example.com/logout", nil), "session-2", "/goodbye")
+	assert.Check(t, is.Equal(http.StatusFound, w.Code))
+	assert.Check(t, is.Equal("/goodbye", w.Header().Get("Location")))
+	assert.Check(t, is.Equal(1, test.BackChannelHits))
+	assert.Check(t, is.DeepEqual([]string{"session-2"}, test.SessionProvider.DeletedSessionIDs))
+}
+
+func TestIDPInitiatedLogoutWithoutRedirectURI(t *testing.T) {
+	test := NewSingleLogoutTest(t)
+	test.Sessions.Delete("session-1")
+
+	w := httptest.NewRecorder()
+	test.IDP.ServeIDPInitiatedLogout(w, httptest.NewRequest("GET", "https://idp.example.com/logout", nil), "session-1", "")
+	assert.Check(t, is.Equal(http.StatusOK, w.Code))
+	assert.Check(t, is.Equal("You have been logged out.\n", w.Body.String()))
+	assert.Check(t, is.DeepEqual([]string{"session-1"}, test.SessionProvider.DeletedSessionIDs))
+}
+
+func TestMemorySingleLogoutStore(t *testing.T) {
+	store := &MemorySingleLogoutStore{}
+	state := &LogoutState{RequestID: "id-1", ExpireTime: TimeNow().Add(time.Minute)}
+	assert.Check(t, store.PutLogoutState("state", state))
+	got, err := store.TakeLogoutState("state")
+	assert.Check(t, err)
+	assert.Check(t, is.DeepEqual(state, got))
+	_, err = store.TakeLogoutState("state")
+	assert.Check(t, is.Equal(os.ErrNotExist, err))
+}
@@ -0,0 +1,1051 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// StructureViolation describes how an element of a SAML document does not
+// fit the structure that CheckStructure expects.
+type StructureViolation struct {
+	// Path is the path of the offending element from the root of the
+	// document, e.g. /Response/Assertion/Subject.
+	Path    string
+	Message string
+}
+
+func (v StructureViolation) String() string {
+	return v.Path + ": " + v.Message
+}
+
+// StructureError is returned by CheckStructure when a document does not
+// have the structure of a SAML document. It lists all the violations found.
+type StructureError struct {
+	Violations []StructureViolation
+}
+
+func (e *StructureError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.String()
+	}
+	return "structure check failed: " + strings.Join(messages, "; ")
+}
+
+// CheckStructure makes a partial structural check of the SAML protocol
+// message, assertion or metadata document in data. If data is a SOAP
+// envelope, the message in its body is checked. It returns a
+// *StructureError that lists the violations if the check fails.
+//
+// This is not XML Schema validation. The element names, attributes and
+// attribute types are checked against an abridged copy of the content
+// models of the SAML 2.0 assertion, protocol and metadata schemas that is
+// compiled into the package. Sequences are matched greedily and choices
+// are flattened, so some documents that the schemas reject pass the
+// check. The XML Signature and XML Encryption elements that SAML documents
+// embed are not checked, as they are checked when signatures are verified
+// and assertions decrypted, nor is the content of elements of type anyType
+// such as AttributeValue.
+func CheckStructure(data []byte) error {
+	root, err := readSchemaNode(data)
+	if err != nil {
+		return err
+	}
+	if root.name == soapEnvelopeName {
+		if root, err = soapBodyMessage(root); err != nil {
+			return err
+		}
+	}
+	v := schemaValidator{}
+	decl, ok := schemaElements[root.name]
+	if !ok {
+		v.violation("/"+root.name.Local, "element is not a SAML protocol message, assertion or metadata document")
+	} else {
+		v.validate(root, decl, "/"+root.name.Local)
+	}
+	if len(v.violations) > 0 {
+		return &StructureError{Violations: v.violations}
+	}
+	return nil
+}
+
+// checkStructure applies CheckStructure to the inbound message in data if
+// StrictStructureCheck is set.
+func (sp *ServiceProvider) checkStructure(data []byte) error {
+	if !sp.StrictStructureCheck {
+		return nil
+	}
+	return CheckStructure(data)
+}
+
+// checkStructure applies CheckStructure to the inbound message in data if
+// StrictStructureCheck is set.
+func (idp *IdentityProvider) checkStructure(data []byte) error {
+	if !idp.StrictStructureCheck {
+		return nil
+	}
+	return CheckStructure(data)
+}
+
+var (
+	soapEnvelopeName = xml.Name{Space: "http://schemas.xmlsoap.org/soap/envelope/", Local: "Envelope"}
+	soapBodyName     = xml.Name{Space: "http://schemas.xmlsoap.org/soap/envelope/", Local: "Body"}
+)
+
+// soapBodyMessage returns the first element of the body of a SOAP
+// envelope.
+func soapBodyMessage(envelope *schemaNode) (*schemaNode, error) {
+	for _, child := range envelope.children {
+		if child.name == soapBodyName && len(child.children) > 0 {
+			return child.children[0], nil
+		}
+	}
+	return nil, fmt.Errorf("SOAP envelope has no message")
+}
+
+// schemaNode is an element of the document being validated.
+type schemaNode struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*schemaNode
+	text     string
+}
+
+func readSchemaNode(data []byte) (*schemaNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var stack []*schemaNode
+	var root *schemaNode
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			node := &schemaNode{name: token.Name, attrs: token.Copy().Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(token)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("document is empty")
+	}
+	return root, nil
+}
+
+type schemaValidator struct {
+	violations []StructureViolation
+}
+
+func (v *schemaValidator) violation(path string, format string, args ...interface{}) {
+	v.violations = append(v.violations, StructureViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *schemaValidator) validate(node *schemaNode, decl *schemaType, path string) {
+	if decl.opaque {
+		return
+	}
+	v.validateAttrs(node, decl, path)
+
+	if decl.text != nil {
+		if len(node.children) > 0 {
+			v.violation(path, "unexpected element %s", node.children[0].name.Local)
+		}
+		if err := decl.text.check(node.text); err != nil {
+			v.violation(path, "%s", err)
+		}
+		return
+	}
+	if strings.TrimSpace(node.text) != "" && !decl.mixed {
+		v.violation(path, "unexpected text content")
+	}
+	v.validateContent(node, decl, path)
+}
+
+func (v *schemaValidator) validateAttrs(node *schemaNode, decl *schemaType, path string) {
+	seen := map[string]bool{}
+	for _, attr := range node.attrs {
+		switch {
+		case attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns"):
+			continue
+		case attr.Name.Space == "http://www.w3.org/2001/XMLSchema-instance":
+			// xsi attributes are allowed on every element
+			continue
+		}
+
+		name := attr.Name.Local
+		if attr.Name.Space == "http://www.w3.org/XML/1998/namespace" {
+			name = "xml:" + name
+		} else if attr.Name.Space != "" {
+			name = "{" + attr.Name.Space + "}" + name
+		}
+
+		attrDecl := decl.attr(name)
+		if attrDecl == nil {
+			// attributes of other namespaces are allowed by anyAttribute
+			if attr.Name.Space == "" || !decl.anyAttr {
+				v.violation(path, "unexpected attribute %s", name)
+			}
+			continue
+		}
+		seen[name] = true
+		if err := attrDecl.typ.check(attr.Value); err != nil {
+			v.violation(path, "attribute %s: %s", name, err)
+		}
+	}
+	for _, attrDecl := range decl.allAttrs() {
+		if attrDecl.required && !seen[attrDecl.name] {
+			v.violation(path, "missing required attribute %s", attrDecl.name)
+		}
+	}
+}
+
+func (v *schemaValidator) validateContent(node *schemaNode, decl *schemaType, path string) {
+	particles := decl.allContent()
+	p, count := 0, 0
+	for _, child := range node.children {
+		childPath := path + "/" + child.name.Local
+		matched := false
+		for p < len(particles) {
+			particle := particles[p]
+			if particle.matches(child.name, decl.namespace) && (particle.max < 0 || count < particle.max) {
+				count++
+				matched = true
+				break
+			}
+			if count < particle.min {
+				v.violation(path, "missing element %s before %s", particle.describe(), child.name.Local)
+			}
+			p, count = p+1, 0
+		}
+		if !matched {
+			v.violation(childPath, "unexpected element")
+			continue
+		}
+		if childDecl, ok := schemaElements[child.name]; ok {
+			v.validate(child, childDecl, childPath)
+		}
+	}
+	for ; p < len(particles); p, count = p+1, 0 {
+		if count < particles[p].min {
+			v.violation(path, "missing element %s", particles[p].describe())
+		}
+	}
+	if len(node.children) < decl.minElements {
+		v.violation(path, "element must not be empty")
+	}
+}
+
+// schemaType is the content model of an element.
+type schemaType struct {
+	namespace string
+	base      *schemaType
+	attrs     []schemaAttr
+	anyAttr   bool
+	content   []schemaParticle
+
+	// text is the type of the text content of elements with simple
+	// content.
+	text *simpleType
+
+	// mixed allows text between the elements of complex content.
+	mixed bool
+
+	// minElements is the number of child elements that the element must
+	// have at least, for choices that the particles cannot express.
+	minElements int
+
+	// opaque elements are not validated.
+	opaque bool
+}
+
+func (t *schemaType) attr(name string) *schemaAttr {
+	for ; t != nil; t = t.base {
+		for i := range t.attrs {
+			if t.attrs[i].name == name {
+				return &t.attrs[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (t *schemaType) allAttrs() []schemaAttr {
+	if t.base == nil {
+		return t.attrs
+	}
+	return append(append([]schemaAttr{}, t.base.allAttrs()...), t.attrs...)
+}
+
+func (t *schemaType) allContent() []schemaParticle {
+	if t.base == nil {
+		return t.content
+	}
+	return append(append([]schemaParticle{}, t.base.allContent()...), t.content...)
+}
+
+type schemaAttr struct {
+	name     string
+	typ      *simpleType
+	required bool
+}
+
+// schemaParticle is an element of a sequence, which matches any one of
+// names, or any element of another namespace than the one of the
+// schema if other is true, or any element at all if any is true.
+type schemaParticle struct {
+	names    []xml.Name
+	other    bool
+	any      bool
+	min, max int
+}
+
+func (p schemaParticle) matches(name xml.Name, namespace string) bool {
+	for _, n := range p.names {
+		if n == name {
+			return true
+		}
+	}
+	if p.other {
+		return name.Space != "" && name.Space != namespace
+	}
+	return p.any
+}
+
+func (p schemaParticle) describe() string {
+	if p.any || p.other {
+		return "(any)"
+	}
+	names := make([]string, len(p.names))
+	for i, n := range p.names {
+		names[i] = n.Local
+	}
+	return strings.Join(names, " or ")
+}
+
+// simpleType is an XML Schema simple type.
+type simpleType struct {
+	name  string
+	valid func(value string) bool
+}
+
+func (t *simpleType) check(value string) error {
+	if t.valid != nil && !t.valid(strings.TrimSpace(value)) {
+		return fmt.Errorf("%q is not a valid %s", value, t.name)
+	}
+	return nil
+}
+
+var (
+	ncNameRegexp   = regexp.MustCompile(`^[\pL_][\pL\pN_.\-]*$`)
+	dateTimeRegexp = regexp.MustCompile(`^-?\d{4,}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+\-]\d{2}:\d{2})?$`)
+
+	xsString  = &simpleType{name: "string"}
+	xsNCName  = &simpleType{name: "NCName", valid: ncNameRegexp.MatchString}
+	xsID      = &simpleType{name: "ID", valid: ncNameRegexp.MatchString}
+	xsAnyURI  = &simpleType{name: "anyURI", valid: validAnyURI}
+	xsBoolean = &simpleType{name: "boolean", valid: func(value string) bool {
+		switch value {
+		case "true", "false", "1", "0":
+			return true
+		}
+		return false
+	}}
+	xsDateTime = &simpleType{name: "dateTime", valid: dateTimeRegexp.MatchString}
+	xsDuration = &simpleType{name: "duration", valid: func(value string) bool {
+		var d Duration
+		return d.UnmarshalText([]byte(value)) == nil
+	}}
+	xsUnsignedShort = &simpleType{name: "unsignedShort", valid: func(value string) bool {
+		_, err := strconv.ParseUint(value, 10, 16)
+		return err == nil
+	}}
+	xsNonNegativeInteger = &simpleType{name: "nonNegativeInteger", valid: func(value string) bool {
+		_, err := strconv.ParseUint(value, 10, 64)
+		return err == nil
+	}}
+	xsBase64Binary = &simpleType{name: "base64Binary", valid: func(value string) bool {
+		value = strings.Join(strings.Fields(value), "")
+		_, err := base64.StdEncoding.DecodeString(value)
+		return err == nil
+	}}
+	xsAnyURIList = &simpleType{name: "list of anyURI", valid: func(value string) bool {
+		uris := strings.Fields(value)
+		for _, uri := range uris {
+			if !validAnyURI(uri) {
+				return false
+			}
+		}
+		return len(uris) > 0
+	}}
+)
+
+func validAnyURI(value string) bool {
+	_, err := url.Parse(strings.TrimSpace(value))
+	return err == nil
+}
+
+func enumeration(name string, values ...string) *simpleType {
+	return &simpleType{name: name, valid: func(value string) bool {
+		return containsString(values, value)
+	}}
+}
+
+const (
+	assertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	protocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	mdNamespace        = "urn:oasis:names:tc:SAML:2.0:metadata"
+	dsigNamespace      = "http://www.w3.org/2000/09/xmldsig#"
+	xencNamespace      = "http://www.w3.org/2001/04/xmlenc#"
+)
+
+func samlName(local string) xml.Name {
+	return xml.Name{Space: assertionNamespace, Local: local}
+}
+
+func samlpName(local string) xml.Name {
+	return xml.Name{Space: protocolNamespace, Local: local}
+}
+
+func mdName(local string) xml.Name {
+	return xml.Name{Space: mdNamespace, Local: local}
+}
+
+func optionalElement(names ...xml.Name) schemaParticle {
+	return schemaParticle{names: names, min: 0, max: 1}
+}
+
+func requiredElement(names ...xml.Name) schemaParticle {
+	return schemaParticle{names: names, min: 1, max: 1}
+}
+
+func zeroOrMoreElements(names ...xml.Name) schemaParticle {
+	return schemaParticle{names: names, min: 0, max: -1}
+}
+
+func oneOrMoreElements(names ...xml.Name) schemaParticle {
+	return schemaParticle{names: names, min: 1, max: -1}
+}
+
+func optionalAttr(name string, typ *simpleType) schemaAttr {
+	return schemaAttr{name: name, typ: typ}
+}
+
+func requiredAttr(name string, typ *simpleType) schemaAttr {
+	return schemaAttr{name: name, typ: typ, required: true}
+}
+
+var (
+	dsSignature       = xml.Name{Space: dsigNamespace, Local: "Signature"}
+	dsKeyInfo         = xml.Name{Space: dsigNamespace, Local: "KeyInfo"}
+	xencEncryptedData = xml.Name{Space: xencNamespace, Local: "EncryptedData"}
+	xencEncryptedKey  = xml.Name{Space: xencNamespace, Local: "EncryptedKey"}
+
+	identifiers = []xml.Name{samlName("BaseID"), samlName("NameID"), samlName("EncryptedID")}
+)
+
+// schemaElements are the global elements of the SAML 2.0 assertion,
+// protocol and metadata schemas, by name. Their content models are
+// abridged: each is a flat sequence of particles that CheckStructure
+// matches greedily, and nested choices and groups are folded into it.
+var schemaElements = map[xml.Name]*schemaType{}
+
+func init() {
+	opaque := &schemaType{opaque: true}
+	simple := func(namespace string, typ *simpleType, attrs ...schemaAttr) *schemaType {
+		return &schemaType{namespace: namespace, text: typ, attrs: attrs}
+	}
+
+	// the elements of other schemas are validated when they are processed
+	schemaElements[dsSignature] = opaque
+	schemaElements[dsKeyInfo] = opaque
+	schemaElements[xencEncryptedData] = opaque
+	schemaElements[xencEncryptedKey] = opaque
+
+	// saml-schema-assertion-2.0
+	nameIDType := simple(assertionNamespace, xsString,
+		optionalAttr("NameQualifier", xsString),
+		optionalAttr("SPNameQualifier", xsString),
+		optionalAttr("Format", xsAnyURI),
+		optionalAttr("SPProvidedID", xsString))
+	encryptedElementType := &schemaType{
+		namespace: assertionNamespace,
+		content:   []schemaParticle{requiredElement(xencEncryptedData), zeroOrMoreElements(xencEncryptedKey)},
+	}
+	evidence := []xml.Name{samlName("AssertionIDRef"), samlName("AssertionURIRef"), samlName("Assertion"), samlName("EncryptedAssertion")}
+	attributeType := &schemaType{
+		namespace: assertionNamespace,
+		attrs: []schemaAttr{
+			requiredAttr("Name", xsString),
+			optionalAttr("NameFormat", xsAnyURI),
+			optionalAttr("FriendlyName", xsString),
+		},
+		anyAttr: true,
+		content: []schemaParticle{zeroOrMoreElements(samlName("AttributeValue"))},
+	}
+
+	for name, decl := range map[string]*schemaType{
+		"AssertionIDRef":  simple(assertionNamespace, xsNCName),
+		"AssertionURIRef": simple(assertionNamespace, xsAnyURI),
+		"Issuer":          nameIDType,
+		"NameID":          nameIDType,
+		"BaseID":          opaque,
+		"EncryptedID":     encryptedElementType,
+		"Assertion": {
+			namespace: assertionNamespace,
+			attrs: []schemaAttr{
+				requiredAttr("Version", xsString),
+				requiredAttr("ID", xsID),
+				requiredAttr("IssueInstant", xsDateTime),
+			},
+			content: []schemaParticle{
+				requiredElement(samlName("Issuer")),
+				optionalElement(dsSignature),
+				optionalElement(samlName("Subject")),
+				optionalElement(samlName("Conditions")),
+				optionalElement(samlName("Advice")),
+				zeroOrMoreElements(samlName("Statement"), samlName("AuthnStatement"), samlName("AuthzDecisionStatement"), samlName("AttributeStatement")),
+			},
+		},
+		"EncryptedAssertion": encryptedElementType,
+		"Subject": {
+			namespace:   assertionNamespace,
+			content:     []schemaParticle{optionalElement(identifiers...), zeroOrMoreElements(samlName("SubjectConfirmation"))},
+			minElements: 1,
+		},
+		"SubjectConfirmation": {
+			namespace: assertionNamespace,
+			attrs:     []schemaAttr{requiredAttr("Method", xsAnyURI)},
+			content:   []schemaParticle{optionalElement(identifiers...), optionalElement(samlName("SubjectConfirmationData"))},
+		},
+		"SubjectConfirmationData": {
+			namespace: assertionNamespace,
+			attrs: []schemaAttr{
+				optionalAttr("NotBefore", xsDateTime),
+				optionalAttr("NotOnOrAfter", xsDateTime),
+				optionalAttr("Recipient", xsAnyURI),
+				optionalAttr("InResponseTo", xsNCName),
+				optionalAttr("Address", xsString),
+			},
+			anyAttr: true,
+			content: []schemaParticle{{any: true, max: -1}},
+			mixed:   true,
+		},
+		"Conditions": {
+			namespace: assertionNamespace,
+			attrs: []schemaAttr{
+				optionalAttr("NotBefore", xsDateTime),
+				optionalAttr("NotOnOrAfter", xsDateTime),
+			},
+			content: []schemaParticle{zeroOrMoreElements(samlName("Condition"), samlName("AudienceRestriction"), samlName("OneTimeUse"), samlName("ProxyRestriction"))},
+		},
+		"Condition": opaque,
+		"AudienceRestriction": {
+			namespace: assertionNamespace,
+			content:   []schemaParticle{oneOrMoreElements(samlName("Audience"))},
+		},
+		"Audience":   simple(assertionNamespace, xsAnyURI),
+		"OneTimeUse": {namespace: assertionNamespace},
+		"ProxyRestriction": {
+			namespace: assertionNamespace,
+			attrs:     []schemaAttr{optionalAttr("Count", xsNonNegativeInteger)},
+			content:   []schemaParticle{zeroOrMoreElements(samlName("Audience"))},
+		},
+		"Advice": {
+			namespace: assertionNamespace,
+			content:   []schemaParticle{{names: evidence, other: true, max: -1}},
+		},
+		"Statement": opaque,
+		"AuthnStatement": {
+			namespace: assertionNamespace,
+			attrs: []schemaAttr{
+				requiredAttr("AuthnInstant", xsDateTime),
+				optionalAttr("SessionIndex", xsString),
+				optionalAttr("SessionNotOnOrAfter", xsDateTime),
+			},
+			content: []schemaParticle{optionalElement(samlName("SubjectLocality")), requiredElement(samlName("AuthnContext"))},
+		},
+		"SubjectLocality": {
+			namespace: assertionNamespace,
+			attrs:     []schemaAttr{optionalAttr("Address", xsString), optionalAttr("DNSName", xsString)},
+		},
+		"AuthnContext": {
+			namespace: assertionNamespace,
+			content: []schemaParticle{
+				optionalElement(samlName("AuthnContextClassRef")),
+				optionalElement(samlName("AuthnContextDecl"), samlName("AuthnContextDeclRef")),
+				zeroOrMoreElements(samlName("AuthenticatingAuthority")),
+			},
+			minElements: 1,
+		},
+		"AuthnContextClassRef":    simple(assertionNamespace, xsAnyURI),
+		"AuthnContextDeclRef":     simple(assertionNamespace, xsAnyURI),
+		"AuthnContextDecl":        opaque,
+		"AuthenticatingAuthority": simple(assertionNamespace, xsAnyURI),
+		"AttributeStatement": {
+			namespace: assertionNamespace,
+			content:   []schemaParticle{oneOrMoreElements(samlName("Attribute"), samlName("EncryptedAttribute"))},
+		},
+		"Attribute":          attributeType,
+		"AttributeValue":     opaque,
+		"EncryptedAttribute": encryptedElementType,
+		"AuthzDecisionStatement": {
+			namespace: assertionNamespace,
+			attrs: []schemaAttr{
+				requiredAttr("Resource", xsAnyURI),
+				requiredAttr("Decision", enumeration("DecisionType", "Permit", "Deny", "Indeterminate")),
+			},
+			content: []schemaParticle{oneOrMoreElements(samlName("Action")), optionalElement(samlName("Evidence"))},
+		},
+		"Action": simple(assertionNamespace, xsString, requiredAttr("Namespace", xsAnyURI)),
+		"Evidence": {
+			namespace: assertionNamespace,
+			content:   []schemaParticle{oneOrMoreElements(evidence...)},
+		},
+	} {
+		schemaElements[samlName(name)] = decl
+	}
+
+	// saml-schema-protocol-2.0
+	requestAbstractType := &schemaType{
+		namespace: protocolNamespace,
+		attrs: []schemaAttr{
+			requiredAttr("ID", xsID),
+			requiredAttr("Version", xsString),
+			requiredAttr("IssueInstant", xsDateTime),
+			optionalAttr("Destination", xsAnyURI),
+			optionalAttr("Consent", xsAnyURI),
+		},
+		content: []schemaParticle{
+			optionalElement(samlName("Issuer")),
+			optionalElement(dsSignature),
+			optionalElement(samlpName("Extensions")),
+		},
+	}
+	statusResponseType := &schemaType{
+		namespace: protocolNamespace,
+		attrs: []schemaAttr{
+			requiredAttr("ID", xsID),
+			optionalAttr("InResponseTo", xsNCName),
+			requiredAttr("Version", xsString),
+			requiredAttr("IssueInstant", xsDateTime),
+			optionalAttr("Destination", xsAnyURI),
+			optionalAttr("Consent", xsAnyURI),
+		},
+		content: []schemaParticle{
+			optionalElement(samlName("Issuer")),
+			optionalElement(dsSignature),
+			optionalElement(samlpName("Extensions")),
+			requiredElement(samlpName("Status")),
+		},
+	}
+	subjectQueryAbstractType := &schemaType{
+		namespace: protocolNamespace,
+		base:      requestAbstractType,
+		content:   []schemaParticle{requiredElement(samlName("Subject"))},
+	}
+
+	for name, decl := range map[string]*schemaType{
+		"Extensions": {
+			namespace: protocolNamespace,
+			content:   []schemaParticle{{other: true, min: 1, max: -1}},
+		},
+		"Status": {
+			namespace: protocolNamespace,
+			content: []schemaParticle{
+				requiredElement(samlpName("StatusCode")),
+				optionalElement(samlpName("StatusMessage")),
+				optionalElement(samlpName("StatusDetail")),
+			},
+		},
+		"StatusCode": {
+			namespace: protocolNamespace,
+			attrs:     []schemaAttr{requiredAttr("Value", xsAnyURI)},
+			content:   []schemaParticle{optionalElement(samlpName("StatusCode"))},
+		},
+		"StatusMessage": simple(protocolNamespace, xsString),
+		"StatusDetail": {
+			namespace: protocolNamespace,
+			content:   []schemaParticle{{any: true, max: -1}},
+		},
+		"AssertionIDRequest": {
+			namespace: protocolNamespace,
+			base:      requestAbstractType,
+			content:   []schemaParticle{oneOrMoreElements(samlName("AssertionIDRef"))},
+		},
+		"SubjectQuery": opaque,
+		"AuthnQuery": {
+			namespace: protocolNamespace,
+			base:      subjectQueryAbstractType,
+			attrs:     []schemaAttr{optionalAttr("SessionIndex", xsString)},
+			content:   []schemaParticle{optionalElement(samlpName("RequestedAuthnContext"))},
+		},
+		"RequestedAuthnContext": {
+			namespace: protocolNamespace,
+			attrs:     []schemaAttr{optionalAttr("Comparison", enumeration("AuthnContextComparisonType", "exact", "minimum", "maximum", "better"))},
+			content:   []schemaParticle{oneOrMoreElements(samlName("AuthnContextClassRef"), samlName("AuthnContextDeclRef"))},
+		},
+		"AttributeQuery": {
+			namespace: protocolNamespace,
+			base:      subjectQueryAbstractType,
+			content:   []schemaParticle{zeroOrMoreElements(samlName("Attribute"))},
+		},
+		"AuthzDecisionQuery": {
+			namespace: protocolNamespace,
+			base:      subjectQueryAbstractType,
+			attrs:     []schemaAttr{requiredAttr("Resource", xsAnyURI)},
+			content:   []schemaParticle{oneOrMoreElements(samlName("Action")), optionalElement(samlName("Evidence"))},
+		},
+		"AuthnRequest": {
+			namespace: protocolNamespace,
+			base:      requestAbstractType,
+			attrs: []schemaAttr{
+				optionalAttr("ForceAuthn", xsBoolean),
+				optionalAttr("IsPassive", xsBoolean),
+				optionalAttr("ProtocolBinding", xsAnyURI),
+				optionalAttr("AssertionConsumerServiceIndex", xsUnsignedShort),
+				optionalAttr("AssertionConsumerServiceURL", xsAnyURI),
+				optionalAttr("AttributeConsumingServiceIndex", xsUnsignedShort),
+				optionalAttr("ProviderName", xsString),
+			},
+			content: []schemaParticle{
+				optionalElement(samlName("Subject")),
+				optionalElement(samlpName("NameIDPolicy")),
+				optionalElement(samlName("Conditions")),
+				optionalElement(samlpName("RequestedAuthnContext")),
+				optionalElement(samlpName("Scoping")),
+			},
+		},
+		"NameIDPolicy": {
+			namespace: protocolNamespace,
+			attrs: []schemaAttr{
+				optionalAttr("Format", xsAnyURI),
+				optionalAttr("SPNameQualifier", xsString),
+				optionalAttr("AllowCreate", xsBoolean),
+			},
+		},
+		"Scoping": {
+			namespace: protocolNamespace,
+			attrs:     []schemaAttr{optionalAttr("ProxyCount", xsNonNegativeInteger)},
+			content:   []schemaParticle{optionalElement(samlpName("IDPList")), zeroOrMoreElements(samlpName("RequesterID"))},
+		},
+		"RequesterID": simple(protocolNamespace, xsAnyURI),
+		"IDPList": {
+			namespace: protocolNamespace,
+			content:   []schemaParticle{oneOrMoreElements(samlpName("IDPEntry")), optionalElement(samlpName("GetComplete"))},
+		},
+		"IDPEntry": {
+			namespace: protocolNamespace,
+			attrs: []schemaAttr{
+				requiredAttr("ProviderID", xsAnyURI),
+				optionalAttr("Name", xsString),
+				optionalAttr("Loc", xsAnyURI),
+			},
+		},
+		"GetComplete": simple(protocolNamespace, xsAnyURI),
+		"Response": {
+			namespace: protocolNamespace,
+			base:      statusResponseType,
+			content:   []schemaParticle{zeroOrMoreElements(samlName("Assertion"), samlName("EncryptedAssertion"))},
+		},
+		"ArtifactResolve": {
+			namespace: protocolNamespace,
+			base:      requestAbstractType,
+			content:   []schemaParticle{requiredElement(samlpName("Artifact"))},
+		},
+		"Artifact": simple(protocolNamespace, xsString),
+		"ArtifactResponse": {
+			namespace: protocolNamespace,
+			base:      statusResponseType,
+			content:   []schemaParticle{{any: true, max: 1}},
+		},
+		"ManageNameIDRequest": {
+			namespace: protocolNamespace,
+			base:      requestAbstractType,
+			content: []schemaParticle{
+				requiredElement(samlName("NameID"), samlName("EncryptedID")),
+				requiredElement(samlpName("NewID"), samlpName("NewEncryptedID"), samlpName("Terminate")),
+			},
+		},
+		"NewID":                simple(protocolNamespace, xsString),
+		"NewEncryptedID":       {namespace: protocolNamespace, base: encryptedElementType},
+		"Terminate":            {namespace: protocolNamespace},
+		"ManageNameIDResponse": {namespace: protocolNamespace, base: statusResponseType},
+		"LogoutRequest": {
+			namespace: protocolNamespace,
+			base:      requestAbstractType,
+			attrs: []schemaAttr{
+				optionalAttr("Reason", xsString),
+				optionalAttr("NotOnOrAfter", xsDateTime),
+			},
+			content: []schemaParticle{requiredElement(identifiers...), zeroOrMoreElements(samlpName("SessionIndex"))},
+		},
+		"SessionIndex":   simple(protocolNamespace, xsString),
+		"LogoutResponse": {namespace: protocolNamespace, base: statusResponseType},
+		"NameIDMappingRequest": {
+			namespace: protocolNamespace,
+			base:      requestAbstractType,
+			content:   []schemaParticle{requiredElement(identifiers...), requiredElement(samlpName("NameIDPolicy"))},
+		},
+		"NameIDMappingResponse": {
+			namespace: protocolNamespace,
+			base:      statusResponseType,
+			content:   []schemaParticle{requiredElement(samlName("NameID"), samlName("EncryptedID"))},
+		},
+	} {
+		schemaElements[samlpName(name)] = decl
+	}
+
+	// saml-schema-metadata-2.0
+	localizedName := simple(mdNamespace, xsString, requiredAttr("xml:lang", xsString))
+	localizedURI := simple(mdNamespace, xsAnyURI, requiredAttr("xml:lang", xsString))
+	endpointType := &schemaType{
+		namespace: mdNamespace,
+		attrs: []schemaAttr{
+			requiredAttr("Binding", xsAnyURI),
+			requiredAttr("Location", xsAnyURI),
+			optionalAttr("ResponseLocation", xsAnyURI),
+		},
+		anyAttr: true,
+		content: []schemaParticle{{other: true, max: -1}},
+	}
+	indexedEndpointType := &schemaType{
+		namespace: mdNamespace,
+		base:      endpointType,
+		attrs: []schemaAttr{
+			requiredAttr("index", xsUnsignedShort),
+			optionalAttr("isDefault", xsBoolean),
+		},
+	}
+	cacheAttrs := []schemaAttr{
+		optionalAttr("ID", xsID),
+		optionalAttr("validUntil", xsDateTime),
+		optionalAttr("cacheDuration", xsDuration),
+	}
+	roleDescriptorType := &schemaType{
+		namespace: mdNamespace,
+		attrs: append(append([]schemaAttr{}, cacheAttrs...),
+			requiredAttr("protocolSupportEnumeration", xsAnyURIList),
+			optionalAttr("errorURL", xsAnyURI)),
+		anyAttr: true,
+		content: []schemaParticle{
+			optionalElement(dsSignature),
+			optionalElement(mdName("Extensions")),
+			zeroOrMoreElements(mdName("KeyDescriptor")),
+			optionalElement(mdName("Organization")),
+			zeroOrMoreElements(mdName("ContactPerson")),
+		},
+	}
+	ssoDescriptorType := &schemaType{
+		namespace: mdNamespace,
+		base:      roleDescriptorType,
+		content: []schemaParticle{
+			zeroOrMoreElements(mdName("ArtifactResolutionService")),
+			zeroOrMoreElements(mdName("SingleLogoutService")),
+			zeroOrMoreElements(mdName("ManageNameIDService")),
+			zeroOrMoreElements(mdName("NameIDFormat")),
+		},
+	}
+	roles := []xml.Name{
+		mdName("RoleDescriptor"),
+		mdName("IDPSSODescriptor"),
+		mdName("SPSSODescriptor"),
+		mdName("AuthnAuthorityDescriptor"),
+		mdName("AttributeAuthorityDescriptor"),
+		mdName("PDPDescriptor"),
+		mdName("AffiliationDescriptor"),
+	}
+
+	for name, decl := range map[string]*schemaType{
+		"EntitiesDescriptor": {
+			namespace: mdNamespace,
+			attrs:     append(append([]schemaAttr{}, cacheAttrs...), optionalAttr("Name", xsString)),
+			content: []schemaParticle{
+				optionalElement(dsSignature),
+				optionalElement(mdName("Extensions")),
+				oneOrMoreElements(mdName("EntityDescriptor"), mdName("EntitiesDescriptor")),
+			},
+		},
+		"EntityDescriptor": {
+			namespace: mdNamespace,
+			attrs:     append(append([]schemaAttr{}, cacheAttrs...), requiredAttr("entityID", xsAnyURI)),
+			anyAttr:   true,
+			content: []schemaParticle{
+				optionalElement(dsSignature),
+				optionalElement(mdName("Extensions")),
+				oneOrMoreElements(roles...),
+				optionalElement(mdName("Organization")),
+				zeroOrMoreElements(mdName("ContactPerson")),
+				zeroOrMoreElements(mdName("AdditionalMetadataLocation")),
+			},
+		},
+		"Extensions": {
+			namespace: mdNamespace,
+			content:   []schemaParticle{{other: true, min: 1, max: -1}},
+		},
+		"RoleDescriptor": opaque,
+		"IDPSSODescriptor": {
+			namespace: mdNamespace,
+			base:      ssoDescriptorType,
+			attrs:     []schemaAttr{optionalAttr("WantAuthnRequestsSigned", xsBoolean)},
+			content: []schemaParticle{
+				oneOrMoreElements(mdName("SingleSignOnService")),
+				zeroOrMoreElements(mdName("NameIDMappingService")),
+				zeroOrMoreElements(mdName("AssertionIDRequestService")),
+				zeroOrMoreElements(mdName("AttributeProfile")),
+				zeroOrMoreElements(samlName("Attribute")),
+			},
+		},
+		"SPSSODescriptor": {
+			namespace: mdNamespace,
+			base:      ssoDescriptorType,
+			attrs: []schemaAttr{
+				optionalAttr("AuthnRequestsSigned", xsBoolean),
+				optionalAttr("WantAssertionsSigned", xsBoolean),
+			},
+			content: []schemaParticle{
+				oneOrMoreElements(mdName("AssertionConsumerService")),
+				zeroOrMoreElements(mdName("AttributeConsumingService")),
+			},
+		},
+		"AuthnAuthorityDescriptor": {
+			namespace: mdNamespace,
+			base:      roleDescriptorType,
+			content: []schemaParticle{
+				oneOrMoreElements(mdName("AuthnQueryService")),
+				zeroOrMoreElements(mdName("AssertionIDRequestService")),
+				zeroOrMoreElements(mdName("NameIDFormat")),
+			},
+		},
+		"PDPDescriptor": {
+			namespace: mdNamespace,
+			base:      roleDescriptorType,
+			content: []schemaParticle{
+				oneOrMoreElements(mdName("AuthzService")),
+				zeroOrMoreElements(mdName("AssertionIDRequestService")),
+				zeroOrMoreElements(mdName("NameIDFormat")),
+			},
+		},
+		"AttributeAuthorityDescriptor": {
+			namespace: mdNamespace,
+			base:      roleDescriptorType,
+			content: []schemaParticle{
+				oneOrMoreElements(mdName("AttributeService")),
+				zeroOrMoreElements(mdName("AssertionIDRequestService")),
+				zeroOrMoreElements(mdName("NameIDFormat")),
+				zeroOrMoreElements(mdName("AttributeProfile")),
+				zeroOrMoreElements(samlName("Attribute")),
+			},
+		},
+		"AffiliationDescriptor": {
+			namespace: mdNamespace,
+			attrs:     append(append([]schemaAttr{}, cacheAttrs...), requiredAttr("affiliationOwnerID", xsAnyURI)),
+			anyAttr:   true,
+			content: []schemaParticle{
+				optionalElement(dsSignature),
+				optionalElement(mdName("Extensions")),
+				oneOrMoreElements(mdName("AffiliateMember")),
+				zeroOrMoreElements(mdName("KeyDescriptor")),
+			},
+		},
+		"AffiliateMember": simple(mdNamespace, xsAnyURI),
+		"KeyDescriptor": {
+			namespace: mdNamespace,
+			attrs:     []schemaAttr{optionalAttr("use", enumeration("KeyTypes", "encryption", "signing"))},
+			content:   []schemaParticle{requiredElement(dsKeyInfo), zeroOrMoreElements(mdName("EncryptionMethod"))},
+		},
+		"EncryptionMethod": {
+			namespace: mdNamespace,
+			attrs:     []schemaAttr{requiredAttr("Algorithm", xsAnyURI)},
+			content:   []schemaParticle{{any: true, max: -1}},
+			mixed:     true,
+		},
+		"Organization": {
+			namespace: mdNamespace,
+			anyAttr:   true,
+			content: []schemaParticle{
+				optionalElement(mdName("Extensions")),
+				oneOrMoreElements(mdName("OrganizationName")),
+				oneOrMoreElements(mdName("OrganizationDisplayName")),
+				oneOrMoreElements(mdName("OrganizationURL")),
+			},
+		},
+		"OrganizationName":        localizedName,
+		"OrganizationDisplayName": localizedName,
+		"OrganizationURL":         localizedURI,
+		"ContactPerson": {
+			namespace: mdNamespace,
+			attrs:     []schemaAttr{requiredAttr("contactType", enumeration("ContactTypeType", "technical", "support", "administrative", "billing", "other"))},
+			anyAttr:   true,
+			content: []schemaParticle{
+				optionalElement(mdName("Extensions")),
+				optionalElement(mdName("Company")),
+				optionalElement(mdName("GivenName")),
+				optionalElement(mdName("SurName")),
+				zeroOrMoreElements(mdName("EmailAddress")),
+				zeroOrMoreElements(mdName("TelephoneNumber")),
+			},
+		},
+		"Company":         simple(mdNamespace, xsString),
+		"GivenName":       simple(mdNamespace, xsString),
+		"SurName":         simple(mdNamespace, xsString),
+		"EmailAddress":    simple(mdNamespace, xsAnyURI),
+		"TelephoneNumber": simple(mdNamespace, xsString),
+		"AdditionalMetadataLocation": simple(mdNamespace, xsAnyURI,
+			requiredAttr("namespace", xsAnyURI)),
+		"ArtifactResolutionService": indexedEndpointType,
+		"SingleLogoutService":       endpointType,
+		"ManageNameIDService":       endpointType,
+		"NameIDFormat":              simple(mdNamespace, xsAnyURI),
+		"SingleSignOnService":       endpointType,
+		"NameIDMappingService":      endpointType,
+		"AssertionIDRequestService": endpointType,
+		"AttributeProfile":          simple(mdNamespace, xsAnyURI),
+		"AssertionConsumerService":  indexedEndpointType,
+		"AttributeConsumingService": {
+			namespace: mdNamespace,
+			attrs: []schemaAttr{
+				requiredAttr("index", xsUnsignedShort),
+				optionalAttr("isDefault", xsBoolean),
+			},
+			content: []schemaParticle{
+				oneOrMoreElements(mdName("ServiceName")),
+				zeroOrMoreElements(mdName("ServiceDescription")),
+				oneOrMoreElements(mdName("RequestedAttribute")),
+			},
+		},
+		"ServiceName":        localizedName,
+		"ServiceDescription": localizedName,
+		"RequestedAttribute": {
+			namespace: mdNamespace,
+			base:      attributeType,
+			attrs:     []schemaAttr{optionalAttr("isRequired", xsBoolean)},
+		},
+		"AuthnQueryService": endpointType,
+		"AuthzService":      endpointType,
+		"AttributeService":  endpointType,
+	} {
+		schemaElements[mdName(name)] = decl
+	}
+}
@@ -0,0 +1,87 @@
+package saml
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestCheckStructureAcceptsValidDocuments(t *testing.T) {
+	forceAuthn := true
+	request := AuthnRequest{
+		ID:                          "id-00020406080a0c0e10121416181a1c1e",
+		Version:                     "2.0",
+		IssueInstant:                time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC),
+		Destination:                 "https://idp.example.com/saml/sso",
+		AssertionConsumerServiceURL: "https://sp.example.com/saml2/acs",
+		ProtocolBinding:             HTTPPostBinding,
+		Issuer:                      &Issuer{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity", Value: "https://sp.example.com/saml2/metadata"},
+		NameIDPolicy:                &NameIDPolicy{Format: &[]string{string(TransientNameIDFormat)}[0]},
+		ForceAuthn:                  &forceAuthn,
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(request.Element())
+	buf, err := doc.WriteToBytes()
+	assert.Assert(t, err)
+	assert.Check(t, CheckStructure(buf))
+
+	test := NewServiceProviderTest(t)
+	assert.Check(t, CheckStructure(test.SamlResponse))
+
+	sp := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://sp.example.com/saml2/metadata"),
+		AcsURL:      mustParseURL("https://sp.example.com/saml2/acs"),
+	}
+	buf, err = xml.Marshal(sp.Metadata())
+	assert.Assert(t, err)
+	assert.Check(t, CheckStructure(buf))
+}
+
+func TestCheckStructureReportsViolations(t *testing.T) {
+	err := CheckStructure([]byte(`<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ` +
+		`Version="2.0" IssueInstant="yesterday" ForceAuthn="yes" Colour="blue">` +
+		`<samlp:NameIDPolicy AllowCreate="true">urn:oasis:names:tc:SAML:2.0:nameid-format:transient</samlp:NameIDPolicy>` +
+		`<saml:Issuer>https://sp.example.com/saml2/metadata</saml:Issuer>` +
+		`</samlp:AuthnRequest>`))
+	assert.Check(t, is.DeepEqual(&StructureError{Violations: []StructureViolation{
+		{Path: "/AuthnRequest", Message: `attribute IssueInstant: "yesterday" is not a valid dateTime`},
+		{Path: "/AuthnRequest", Message: `attribute ForceAuthn: "yes" is not a valid boolean`},
+		{Path: "/AuthnRequest", Message: "unexpected attribute Colour"},
+		{Path: "/AuthnRequest", Message: "missing required attribute ID"},
+		{Path: "/AuthnRequest/NameIDPolicy", Message: "unexpected text content"},
+		{Path: "/AuthnRequest/Issuer", Message: "unexpected element"},
+	}}, err))
+
+	err = CheckStructure([]byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ` +
+		`ID="id-1" Version="2.0" IssueInstant="2015-12-01T01:57:09Z">` +
+		`<saml:Issuer>https://idp.example.com/saml/metadata</saml:Issuer>` +
+		`<saml:Assertion ID="id-2" Version="2.0" IssueInstant="2015-12-01T01:57:09Z">` +
+		`<saml:Subject/>` +
+		`</saml:Assertion>` +
+		`</samlp:Response>`))
+	assert.Check(t, is.DeepEqual(&StructureError{Violations: []StructureViolation{
+		{Path: "/Response", Message: "missing element Status before Assertion"},
+		{Path: "/Response/Assertion", Message: "missing element Issuer before Subject"},
+		{Path: "/Response/Assertion/Subject", Message: "element must not be empty"},
+	}}, err))
+
+	// the message in the body of a SOAP envelope is checked
+	err = CheckStructure([]byte(`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>` +
+		`<samlp:ArtifactResolve xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-1" Version="2.0" IssueInstant="2015-12-01T01:57:09Z"/>` +
+		`</soap:Body></soap:Envelope>`))
+	assert.Check(t, is.DeepEqual(&StructureError{Violations: []StructureViolation{
+		{Path: "/ArtifactResolve", Message: "missing element Artifact"},
+	}}, err))
+
+	err = CheckStructure([]byte(`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body/></soap:Envelope>`))
+	assert.Check(t, is.Error(err, "SOAP envelope has no message"))
+
+	err = CheckStructure([]byte(`<html></html>`))
+	assert.Check(t, is.Error(err, "structure check failed: /html: element is not a SAML protocol message, assertion or metadata document"))
+}
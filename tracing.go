@@ -0,0 +1,66 @@
+package saml
+
+import (
+	"context"
+	"errors"
+
+	"github.com/beevik/etree"
+)
+
+// Tracer starts the spans with which a ServiceProvider or IdentityProvider
+// traces the expensive parts of its work: parsing and validating responses,
+// SOAP round-trips, signature verification and decryption. The oteltrace
+// package provides a Tracer backed by an OpenTelemetry TracerProvider.
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx, if
+	// any, and returns a context that carries the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute annotates the span with a key and value, e.g.
+	// AttributeMessageID and the ID of a message.
+	SetAttribute(key string, value string)
+
+	// End ends the span. If err is not nil, the span is marked as failed.
+	End(err error)
+}
+
+// The keys of the attributes that annotate spans.
+const (
+	AttributeIDPEntityID = "saml.idp.entity_id"
+	AttributeSPEntityID  = "saml.sp.entity_id"
+	AttributeBinding     = "saml.binding"
+	AttributeMessageID   = "saml.message.id"
+)
+
+// startSpan starts a span with tracer, which may be nil, in which case the
+// span does nothing.
+func startSpan(ctx context.Context, tracer Tracer, name string) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, name)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value string) {}
+
+func (noopSpan) End(err error) {}
+
+// traceSignature verifies the signature of el with verify within a span. A
+// missing signature does not fail the span, since whether a signature is
+// required is up to the caller.
+func (sp *ServiceProvider) traceSignature(ctx context.Context, el *etree.Element, verify func(el *etree.Element) error) error {
+	_, span := startSpan(ctx, sp.Tracer, "saml.ServiceProvider.VerifySignature")
+	span.SetAttribute(AttributeMessageID, el.SelectAttrValue("ID", ""))
+	err := verify(el)
+	if errors.Is(err, ErrMissingSignature) {
+		span.End(nil)
+	} else {
+		span.End(err)
+	}
+	return err
+}
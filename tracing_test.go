@@ -0,0 +1,90 @@
+package saml
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type recordedSpan struct {
+	name       string
+	parent     *recordedSpan
+	attributes map[string]string
+	ended      bool
+	err        error
+}
+
+func (s *recordedSpan) SetAttribute(key string, value string) {
+	s.attributes[key] = value
+}
+
+func (s *recordedSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+type spanKey struct{}
+
+type recordingTracer struct {
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	span := &recordedSpan{name: name, parent: parent, attributes: map[string]string{}}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func TestSPCanBeTraced(t *testing.T) {
+	test := NewServiceProviderTest(t)
+	tracer := &recordingTracer{}
+	s := ServiceProvider{
+		Key:         test.Key,
+		Certificate: test.Certificate,
+		MetadataURL: mustParseURL("https://15661444.ngrok.io/saml2/metadata"),
+		AcsURL:      mustParseURL("https://15661444.ngrok.io/saml2/acs"),
+		IDPMetadata: &EntityDescriptor{},
+		Tracer:      tracer,
+	}
+	err := xml.Unmarshal(test.IDPMetadata, &s.IDPMetadata)
+	assert.Check(t, err)
+
+	req := http.Request{PostForm: url.Values{}}
+	req.PostForm.Set("SAMLResponse", base64.StdEncoding.EncodeToString(test.SamlResponse))
+	_, err = s.ParseResponse(&req, []string{"id-9e61753d64e928af5a7a341a97f420c9"})
+	assert.Check(t, err)
+
+	var names []string
+	for _, span := range tracer.spans {
+		names = append(names, span.name)
+		assert.Check(t, span.ended)
+		assert.Check(t, span.err)
+	}
+	assert.Check(t, is.DeepEqual([]string{
+		"saml.ServiceProvider.ParseResponse",
+		"saml.ServiceProvider.ParseXMLResponse",
+		"saml.ServiceProvider.DecryptAssertion",
+		"saml.ServiceProvider.VerifySignature",
+	}, names))
+	assert.Check(t, is.Equal(HTTPPostBinding, tracer.spans[0].attributes[AttributeBinding]))
+	assert.Check(t, is.Equal("https://idp.testshib.org/idp/shibboleth", tracer.spans[0].attributes[AttributeIDPEntityID]))
+	assert.Check(t, tracer.spans[1].parent == tracer.spans[0])
+	assert.Check(t, is.Equal("_e9b3332eeaf348da6786aed16300aca9", tracer.spans[1].attributes[AttributeMessageID]))
+	assert.Check(t, tracer.spans[2].parent == tracer.spans[1])
+	assert.Check(t, tracer.spans[3].parent == tracer.spans[1])
+
+	// failures are recorded on the spans
+	tracer.spans = nil
+	_, err = s.ParseResponse(&req, []string{"wrong"})
+	assert.Check(t, err != nil)
+	assert.Assert(t, is.Len(tracer.spans, 2))
+	assert.Check(t, is.Equal(err, tracer.spans[0].err))
+	assert.Check(t, is.Equal(err, tracer.spans[1].err))
+}
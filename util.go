@@ -16,15 +16,47 @@ var TimeNow = func() time.Time { return time.Now().UTC() }
 // not nil, otherwise the default clock is used.
 var Clock *dsig.Clock
 
+// TimeSource is the source of the current time of a ServiceProvider or
+// IdentityProvider. A *dsig.Clock is a TimeSource, and if one is used it
+// is assigned to the dsig validation contexts too.
+type TimeSource interface {
+	Now() time.Time
+}
+
+// timeNow returns the current time of clock, or of TimeNow if clock is nil.
+func timeNow(clock TimeSource) time.Time {
+	if clock == nil {
+		return TimeNow()
+	}
+	return clock.Now().UTC()
+}
+
+// dsigClock returns the clock to assign to dsig validation contexts.
+func dsigClock(clock TimeSource) *dsig.Clock {
+	if c, ok := clock.(*dsig.Clock); ok && c != nil {
+		return c
+	}
+	return Clock
+}
+
 // RandReader is the io.Reader that produces cryptographically random
 // bytes when they are need by the library. The default value is
 // rand.Reader, but it can be replaced for testing.
 var RandReader = rand.Reader
 
 func randomBytes(n int) []byte {
+	return randomBytesFrom(RandReader, n)
+}
+
+// randomBytesFrom returns n bytes read from r, or from RandReader if r is
+// nil.
+func randomBytesFrom(r io.Reader, n int) []byte {
+	if r == nil {
+		r = RandReader
+	}
 	rv := make([]byte, n)
 
-	if _, err := io.ReadFull(RandReader, rv); err != nil {
+	if _, err := io.ReadFull(r, rv); err != nil {
 		panic(err)
 	}
 	return rv
@@ -1,8 +1,10 @@
 package xmlenc
 
 import (
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"math/rand"
 	"testing"
 
 	"gotest.tools/assert"
@@ -103,3 +105,65 @@ func TestCanDecryptWithoutCertificate(t *testing.T) {
 		//assertion.NotNil(t, plaintext)
 	})
 }
+
+func TestCanDecryptOAEPWithSHA256(t *testing.T) {
+	RandReader = rand.New(rand.NewSource(0)) //nolint:gosec // deterministic random numbers for tests
+
+	b, _ := pem.Decode(golden.Get(t, "cert.cert"))
+	certificate, err := x509.ParseCertificate(b.Bytes)
+	assert.Check(t, err)
+	b, _ = pem.Decode(golden.Get(t, "cert.key"))
+	key, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	assert.Check(t, err)
+	plaintext := []byte("top secret message")
+
+	t.Run("OAEP", func(t *testing.T) {
+		e := OAEP()
+		e.BlockCipher = AES256GCM
+		e.DigestMethod = SHA256
+		el, err := e.Encrypt(certificate, plaintext, nil)
+		assert.Check(t, err)
+		assert.Check(t, is.Equal("http://www.w3.org/2001/04/xmlenc#sha256",
+			el.FindElement(".//EncryptedKey/EncryptionMethod/DigestMethod").SelectAttrValue("Algorithm", "")))
+
+		actualPlaintext, err := Decrypt(key, el)
+		assert.Check(t, err)
+		assert.Check(t, is.DeepEqual(plaintext, actualPlaintext))
+	})
+
+	t.Run("OAEPWithWrongMGF", func(t *testing.T) {
+		// rsa-oaep-mgf1p always uses SHA-1 for MGF1, whatever the digest
+		// method is
+		e := OAEP()
+		e.DigestMethod = SHA256
+		e.keyEncrypter = func(e RSA, pubKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+			return rsa.EncryptOAEP(e.DigestMethod.Hash(), RandReader, pubKey, plaintext, nil)
+		}
+		el, err := e.Encrypt(certificate, plaintext, nil)
+		assert.Check(t, err)
+
+		_, err = Decrypt(key, el)
+		assert.Check(t, is.Error(err, "crypto/rsa: decryption error"))
+	})
+
+	t.Run("OAEP11", func(t *testing.T) {
+		e := OAEP11()
+		e.DigestMethod = SHA1
+		e.MGFDigestMethod = SHA256
+		el, err := e.Encrypt(certificate, plaintext, nil)
+		assert.Check(t, err)
+		encryptionMethodEl := el.FindElement(".//EncryptedKey/EncryptionMethod")
+		assert.Check(t, is.Equal("http://www.w3.org/2009/xmlenc11#rsa-oaep", encryptionMethodEl.SelectAttrValue("Algorithm", "")))
+		assert.Check(t, is.Equal("http://www.w3.org/2009/xmlenc11#mgf1sha256", encryptionMethodEl.FindElement("./MGF").SelectAttrValue("Algorithm", "")))
+		assert.Check(t, is.Equal("http://www.w3.org/2009/xmlenc11#aes256-gcm", el.FindElement("./EncryptionMethod").SelectAttrValue("Algorithm", "")))
+
+		actualPlaintext, err := Decrypt(key, el)
+		assert.Check(t, err)
+		assert.Check(t, is.DeepEqual(plaintext, actualPlaintext))
+
+		// the MGF digest defaults to SHA-1 when the MGF element is absent
+		encryptionMethodEl.RemoveChild(encryptionMethodEl.FindElement("./MGF"))
+		_, err = Decrypt(key, el)
+		assert.Check(t, is.Error(err, "crypto/rsa: decryption error"))
+	})
+}
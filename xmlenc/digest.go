@@ -1,6 +1,7 @@
 package xmlenc
 
 import (
+	"crypto"
 	"crypto/sha1" //nolint:gosec // required for protocol support
 	"crypto/sha256"
 	"crypto/sha512"
@@ -10,8 +11,9 @@ import (
 )
 
 type digestMethod struct {
-	algorithm string
-	hash      func() hash.Hash
+	algorithm  string
+	hash       func() hash.Hash
+	cryptoHash crypto.Hash
 }
 
 func (dm digestMethod) Algorithm() string {
@@ -25,32 +27,59 @@ func (dm digestMethod) Hash() hash.Hash {
 var (
 	// SHA1 implements the SHA-1 digest method (which is considered insecure)
 	SHA1 = digestMethod{
-		algorithm: "http://www.w3.org/2000/09/xmldsig#sha1",
-		hash:      sha1.New,
+		algorithm:  "http://www.w3.org/2000/09/xmldsig#sha1",
+		hash:       sha1.New,
+		cryptoHash: crypto.SHA1,
 	}
 
 	// SHA256 implements the SHA-256 digest method
 	SHA256 = digestMethod{
-		algorithm: "http://www.w3.org/2000/09/xmldsig#sha256",
-		hash:      sha256.New,
+		algorithm:  "http://www.w3.org/2001/04/xmlenc#sha256",
+		hash:       sha256.New,
+		cryptoHash: crypto.SHA256,
+	}
+
+	// SHA384 implements the SHA-384 digest method
+	SHA384 = digestMethod{
+		algorithm:  "http://www.w3.org/2001/04/xmldsig-more#sha384",
+		hash:       sha512.New384,
+		cryptoHash: crypto.SHA384,
 	}
 
 	// SHA512 implements the SHA-512 digest method
 	SHA512 = digestMethod{
-		algorithm: "http://www.w3.org/2000/09/xmldsig#sha512",
-		hash:      sha512.New,
+		algorithm:  "http://www.w3.org/2001/04/xmlenc#sha512",
+		hash:       sha512.New,
+		cryptoHash: crypto.SHA512,
 	}
 
 	// RIPEMD160 implements the RIPEMD160 digest method
 	RIPEMD160 = digestMethod{
-		algorithm: "http://www.w3.org/2000/09/xmldsig#ripemd160",
-		hash:      ripemd160.New,
+		algorithm:  "http://www.w3.org/2001/04/xmlenc#ripemd160",
+		hash:       ripemd160.New,
+		cryptoHash: crypto.RIPEMD160,
 	}
 )
 
+// mgfDigestMethods maps the algorithms of the xenc11:MGF element to the
+// digest used by MGF1.
+var mgfDigestMethods = map[string]DigestMethod{
+	"http://www.w3.org/2009/xmlenc11#mgf1sha1":   SHA1,
+	"http://www.w3.org/2009/xmlenc11#mgf1sha256": SHA256,
+	"http://www.w3.org/2009/xmlenc11#mgf1sha384": SHA384,
+	"http://www.w3.org/2009/xmlenc11#mgf1sha512": SHA512,
+}
+
 func init() {
 	RegisterDigestMethod(SHA1)
 	RegisterDigestMethod(SHA256)
+	RegisterDigestMethod(SHA384)
 	RegisterDigestMethod(SHA512)
 	RegisterDigestMethod(RIPEMD160)
+
+	// earlier versions of this package used these identifiers, which are
+	// not defined by any specification
+	digestMethods["http://www.w3.org/2000/09/xmldsig#sha256"] = SHA256
+	digestMethods["http://www.w3.org/2000/09/xmldsig#sha512"] = SHA512
+	digestMethods["http://www.w3.org/2000/09/xmldsig#ripemd160"] = RIPEMD160
 }
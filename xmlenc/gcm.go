@@ -3,7 +3,6 @@ package xmlenc
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -58,8 +57,6 @@ func (e GCM) Encrypt(key interface{}, plaintext []byte, nonce []byte) (*etree.El
 	em.CreateAttr("Algorithm", e.algorithm)
 	em.CreateAttr("xmlns:xenc", "http://www.w3.org/2001/04/xmlenc#")
 
-	plaintext = appendPadding(plaintext, block.BlockSize())
-
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, err
@@ -67,14 +64,17 @@ func (e GCM) Encrypt(key interface{}, plaintext []byte, nonce []byte) (*etree.El
 
 	if nonce == nil {
 		// generate random nonce when it's nil
-		nonce := make([]byte, aesgcm.NonceSize())
-		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-			panic(err.Error())
+		nonce = make([]byte, aesgcm.NonceSize())
+		if _, err := io.ReadFull(RandReader, nonce); err != nil {
+			return nil, err
 		}
 	}
+	if len(nonce) != aesgcm.NonceSize() {
+		return nil, fmt.Errorf("nonce must be %d bytes", aesgcm.NonceSize())
+	}
 
-	ciphertext := make([]byte, len(plaintext))
-	text := aesgcm.Seal(nil, nonce, ciphertext, nil)
+	// the cipher value is the nonce followed by the ciphertext and tag
+	text := aesgcm.Seal(append([]byte{}, nonce...), nonce, plaintext, nil)
 
 	cd := encryptedDataEl.CreateElement("xenc:CipherData")
 	cd.CreateAttr("xmlns:xenc", "http://www.w3.org/2001/04/xmlenc#")
@@ -136,8 +136,24 @@ var (
 		algorithm: "http://www.w3.org/2009/xmlenc11#aes128-gcm",
 		cipher:    aes.NewCipher,
 	}
+
+	// AES192GCM implements AES192-GCM mode for encryption and decryption
+	AES192GCM BlockCipher = GCM{
+		keySize:   24,
+		algorithm: "http://www.w3.org/2009/xmlenc11#aes192-gcm",
+		cipher:    aes.NewCipher,
+	}
+
+	// AES256GCM implements AES256-GCM mode for encryption and decryption
+	AES256GCM BlockCipher = GCM{
+		keySize:   32,
+		algorithm: "http://www.w3.org/2009/xmlenc11#aes256-gcm",
+		cipher:    aes.NewCipher,
+	}
 )
 
 func init() {
 	RegisterDecrypter(AES128GCM)
+	RegisterDecrypter(AES192GCM)
+	RegisterDecrypter(AES256GCM)
 }
@@ -0,0 +1,59 @@
+package xmlenc
+
+import (
+	"crypto"
+	"crypto/rsa"
+)
+
+// oaepOptions returns the options for RSA-OAEP with digestMethod as the
+// digest of the label and mgfDigestMethod as the digest of MGF1. xmlenc
+// allows the two to differ: rsa-oaep-mgf1p always uses MGF1 with SHA-1,
+// and xmlenc11#rsa-oaep names the MGF1 digest in an MGF element.
+func oaepOptions(digestMethod DigestMethod, mgfDigestMethod DigestMethod) (*rsa.OAEPOptions, error) {
+	hash, err := cryptoHash(digestMethod)
+	if err != nil {
+		return nil, err
+	}
+	mgfHash, err := cryptoHash(mgfDigestMethod)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.OAEPOptions{Hash: hash, MGFHash: mgfHash}, nil
+}
+
+// cryptoHash returns the crypto.Hash of one of the digest methods of this
+// package.
+func cryptoHash(dm DigestMethod) (crypto.Hash, error) {
+	var h crypto.Hash
+	switch dm := dm.(type) {
+	case digestMethod:
+		h = dm.cryptoHash
+	case *digestMethod:
+		h = dm.cryptoHash
+	}
+	if !h.Available() {
+		return 0, ErrAlgorithmNotImplemented(dm.Algorithm())
+	}
+	return h, nil
+}
+
+// encryptOAEP encrypts plaintext for pubKey using RSA-OAEP with an empty label.
+func encryptOAEP(digestMethod DigestMethod, mgfDigestMethod DigestMethod, pubKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	opts, err := oaepOptions(digestMethod, mgfDigestMethod)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.EncryptOAEPWithOptions(RandReader, pubKey, plaintext, opts)
+}
+
+// decryptOAEP decrypts ciphertext using RSA-OAEP with an empty label.
+func decryptOAEP(digestMethod DigestMethod, mgfDigestMethod DigestMethod, privKey *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
+	opts, err := oaepOptions(digestMethod, mgfDigestMethod)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MGFHash == opts.Hash {
+		return rsa.DecryptOAEP(opts.Hash.New(), RandReader, privKey, ciphertext, nil)
+	}
+	return privKey.Decrypt(RandReader, ciphertext, opts)
+}
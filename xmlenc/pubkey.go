@@ -11,11 +11,15 @@ import (
 
 // RSA implements Encrypter and Decrypter using RSA public key encryption.
 //
-// Use function like OAEP(), or PKCS1v15() to get an instance of this type ready
-// to use.
+// Use function like OAEP(), OAEP11() or PKCS1v15() to get an instance of this
+// type ready to use.
 type RSA struct {
 	BlockCipher  BlockCipher
-	DigestMethod DigestMethod // only for OAEP
+	DigestMethod DigestMethod // only for OAEP and OAEP11
+
+	// MGFDigestMethod is the digest used by the MGF1 mask generation
+	// function. It only applies to OAEP11; OAEP always uses SHA-1.
+	MGFDigestMethod DigestMethod
 
 	algorithm    string
 	keyEncrypter func(e RSA, pubKey *rsa.PublicKey, plaintext []byte) ([]byte, error)
@@ -67,6 +71,15 @@ func (e RSA) Encrypt(certificate interface{}, plaintext []byte, nonce []byte) (*
 		dm.CreateAttr("Algorithm", e.DigestMethod.Algorithm())
 		dm.CreateAttr("xmlns:ds", "http://www.w3.org/2000/09/xmldsig#")
 	}
+	if e.algorithm == oaep11Algorithm {
+		for algorithm, digestMethod := range mgfDigestMethods {
+			if digestMethod.Algorithm() == e.mgfDigestMethod().Algorithm() {
+				mgf := encryptionMethodEl.CreateElement("xenc11:MGF")
+				mgf.CreateAttr("Algorithm", algorithm)
+				mgf.CreateAttr("xmlns:xenc11", "http://www.w3.org/2009/xmlenc11#")
+			}
+		}
+	}
 	{
 		innerKeyInfoEl := encryptedKey.CreateElement("ds:KeyInfo")
 		x509data := innerKeyInfoEl.CreateElement("ds:X509Data")
@@ -118,23 +131,67 @@ func (e RSA) Decrypt(key interface{}, ciphertextEl *etree.Element) ([]byte, erro
 		}
 	}
 
+	{
+		mgfEl := ciphertextEl.FindElement("./EncryptionMethod/MGF")
+		if mgfEl == nil {
+			e.MGFDigestMethod = SHA1
+		} else {
+			mgfAlgorithmStr := mgfEl.SelectAttrValue("Algorithm", "")
+			digestMethod, ok := mgfDigestMethods[mgfAlgorithmStr]
+			if !ok {
+				return nil, ErrAlgorithmNotImplemented(mgfAlgorithmStr)
+			}
+			e.MGFDigestMethod = digestMethod
+		}
+	}
+
 	return e.keyDecrypter(e, rsaKey, ciphertext)
 }
 
+// mgfDigestMethod returns the digest used by MGF1.
+func (e RSA) mgfDigestMethod() DigestMethod {
+	if e.algorithm != oaep11Algorithm || e.MGFDigestMethod == nil {
+		return SHA1
+	}
+	return e.MGFDigestMethod
+}
+
+const oaep11Algorithm = "http://www.w3.org/2009/xmlenc11#rsa-oaep"
+
 // OAEP returns a version of RSA that implements RSA in OAEP-MGF1P mode. By default
 // the block cipher used is AES-256 CBC and the digest method is SHA-256. You can
 // specify other ciphers and digest methods by assigning to BlockCipher or
-// DigestMethod.
+// DigestMethod. The mask generation function is always MGF1 with SHA-1.
 func OAEP() RSA {
 	return RSA{
 		BlockCipher:  AES256CBC,
 		DigestMethod: SHA256,
 		algorithm:    "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p",
 		keyEncrypter: func(e RSA, pubKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
-			return rsa.EncryptOAEP(e.DigestMethod.Hash(), RandReader, pubKey, plaintext, nil)
+			return encryptOAEP(e.DigestMethod, SHA1, pubKey, plaintext)
+		},
+		keyDecrypter: func(e RSA, privKey *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
+			return decryptOAEP(e.DigestMethod, SHA1, privKey, ciphertext)
+		},
+	}
+}
+
+// OAEP11 returns a version of RSA that implements RSA-OAEP as defined by XML
+// Encryption 1.1, which allows the digest of the mask generation function to
+// be chosen. By default the block cipher used is AES-256 GCM and both digest
+// methods are SHA-256. You can specify other ciphers and digest methods by
+// assigning to BlockCipher, DigestMethod or MGFDigestMethod.
+func OAEP11() RSA {
+	return RSA{
+		BlockCipher:     AES256GCM,
+		DigestMethod:    SHA256,
+		MGFDigestMethod: SHA256,
+		algorithm:       oaep11Algorithm,
+		keyEncrypter: func(e RSA, pubKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+			return encryptOAEP(e.DigestMethod, e.mgfDigestMethod(), pubKey, plaintext)
 		},
 		keyDecrypter: func(e RSA, privKey *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
-			return rsa.DecryptOAEP(e.DigestMethod.Hash(), RandReader, privKey, ciphertext, nil)
+			return decryptOAEP(e.DigestMethod, e.mgfDigestMethod(), privKey, ciphertext)
 		},
 	}
 }
@@ -158,5 +215,6 @@ func PKCS1v15() RSA {
 
 func init() {
 	RegisterDecrypter(OAEP())
+	RegisterDecrypter(OAEP11())
 	RegisterDecrypter(PKCS1v15())
 }
@@ -57,6 +57,7 @@ func TestDataAES128(t *testing.T) {
 		RandReader = rand.New(rand.NewSource(0)) //nolint:gosec  // deterministic random numbers for tests
 		plaintext := "top secret message to use with gcm"
 
+		var ciphertext string
 		{
 			encrypter := AES128GCM
 			cipherEl, encErr := encrypter.Encrypt([]byte("abcdefghijklmnop"), []byte(plaintext), []byte("1234567890AZ"))
@@ -65,9 +66,33 @@ func TestDataAES128(t *testing.T) {
 			doc := etree.NewDocument()
 			doc.SetRoot(cipherEl)
 			doc.IndentTabs()
-			_, err := doc.WriteToString()
+			var err error
+			ciphertext, err = doc.WriteToString()
 			assert.Check(t, err)
 		}
+
+		{
+			decrypter := AES128GCM
+			doc := etree.NewDocument()
+			err := doc.ReadFromString(ciphertext)
+			assert.Check(t, err)
+
+			actualPlaintext, err := decrypter.Decrypt([]byte("abcdefghijklmnop"), doc.Root())
+			assert.Check(t, err)
+			assert.Check(t, is.Equal(plaintext, string(actualPlaintext)))
+		}
+	})
+
+	t.Run("GCM256", func(t *testing.T) {
+		RandReader = rand.New(rand.NewSource(0)) //nolint:gosec  // deterministic random numbers for tests
+		plaintext := "top secret message to use with gcm"
+		key := []byte("abcdefghijklmnopqrstuvwxyz012345")
+
+		cipherEl, err := AES256GCM.Encrypt(key, []byte(plaintext), nil)
+		assert.Check(t, err)
+		actualPlaintext, err := Decrypt(key, cipherEl)
+		assert.Check(t, err)
+		assert.Check(t, is.Equal(plaintext, string(actualPlaintext)))
 	})
 }
 